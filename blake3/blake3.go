@@ -0,0 +1,232 @@
+// Package blake3 implements the BLAKE3 hash function, unkeyed and with the
+// default 32-byte output, as a hash.Hash.
+//
+// The input is split into 1 KiB chunks, each hashed by compressing its
+// 64-byte blocks in sequence. The chunk chaining values are then merged
+// pairwise into a binary tree, whose root, compressed with the ROOT flag,
+// gives the digest. This is the portable single-threaded algorithm of the
+// reference implementation; it needs no SIMD to keep up with disk reads.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the size of a BLAKE3 digest in bytes
+const Size = 32
+
+// BlockSize is the block size of BLAKE3 in bytes
+const BlockSize = 64
+
+const (
+	chunkLen = 1024
+
+	chunkStart = 1 << 0
+	chunkEnd   = 1 << 1
+	parent     = 1 << 2
+	root       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// compress is the BLAKE3 compression function. It returns the full state;
+// the first 8 words are the chaining value.
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < 7; r++ {
+		g(&s, 0, 4, 8, 12, m[0], m[1])
+		g(&s, 1, 5, 9, 13, m[2], m[3])
+		g(&s, 2, 6, 10, 14, m[4], m[5])
+		g(&s, 3, 7, 11, 15, m[6], m[7])
+		g(&s, 0, 5, 10, 15, m[8], m[9])
+		g(&s, 1, 6, 11, 12, m[10], m[11])
+		g(&s, 2, 7, 8, 13, m[12], m[13])
+		g(&s, 3, 4, 9, 14, m[14], m[15])
+
+		var p [16]uint32
+		for i, j := range permutation {
+			p[i] = m[j]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+// output is a compression not yet done, which gives either a chaining
+// value or, with the ROOT flag, the digest
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	s := compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	return [8]uint32(s[:8])
+}
+
+func parentOutput(left, right [8]uint32) output {
+	o := output{cv: iv, blockLen: BlockSize, flags: parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// chunkState hashes one chunk
+type chunkState struct {
+	cv      [8]uint32
+	counter uint64 // Index of the chunk
+	buf     [BlockSize]byte
+	bufLen  int
+	blocks  int // Blocks compressed
+	length  int // Bytes taken, buffered ones included
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: iv, counter: counter}
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocks == 0 {
+		return chunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(p []byte) {
+	for len(p) > 0 {
+		// The last block is compressed by output, with CHUNK_END, so a
+		// full buffer is only compressed once more input comes
+		if c.bufLen == BlockSize {
+			block := words(&c.buf)
+			s := compress(&c.cv, &block, c.counter, BlockSize, c.startFlag())
+			c.cv = [8]uint32(s[:8])
+			c.blocks++
+			c.bufLen = 0
+		}
+		n := copy(c.buf[c.bufLen:], p)
+		c.bufLen += n
+		c.length += n
+		p = p[n:]
+	}
+}
+
+func (c *chunkState) output() output {
+	var buf [BlockSize]byte
+	copy(buf[:], c.buf[:c.bufLen])
+	return output{
+		cv:       c.cv,
+		block:    words(&buf),
+		counter:  c.counter,
+		blockLen: uint32(c.bufLen),
+		flags:    c.startFlag() | chunkEnd,
+	}
+}
+
+func words(b *[BlockSize]byte) [16]uint32 {
+	var w [16]uint32
+	for i := range w {
+		w[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return w
+}
+
+// digest is a BLAKE3 hash in progress
+type digest struct {
+	chunk  chunkState
+	stack  [54][8]uint32 // Chaining values of complete subtrees, 2^54 chunks at most
+	stackN int
+}
+
+// New returns a hash.Hash computing the BLAKE3 digest
+func New() hash.Hash {
+	d := new(digest)
+	d.Reset()
+	return d
+}
+
+// Sum256 returns the BLAKE3 digest of data
+func Sum256(data []byte) [Size]byte {
+	d := New()
+	d.Write(data)
+	return [Size]byte(d.Sum(nil))
+}
+
+func (d *digest) Size() int      { return Size }
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Reset() {
+	d.chunk = newChunkState(0)
+	d.stackN = 0
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// As with blocks, a full chunk is only merged into the tree once
+		// more input shows it is not the root
+		if d.chunk.length == chunkLen {
+			cv := d.chunk.output()
+			d.addChunk(cv.chainingValue(), d.chunk.counter+1)
+			d.chunk = newChunkState(d.chunk.counter + 1)
+		}
+		take := min(chunkLen-d.chunk.length, len(p))
+		d.chunk.update(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// addChunk pushes the chaining value of a chunk, first merging the
+// subtrees it completes: one for each trailing zero bit of the chunk count
+func (d *digest) addChunk(cv [8]uint32, total uint64) {
+	for total&1 == 0 {
+		d.stackN--
+		p := parentOutput(d.stack[d.stackN], cv)
+		cv = p.chainingValue()
+		total >>= 1
+	}
+	d.stack[d.stackN] = cv
+	d.stackN++
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	o := d.chunk.output()
+	for i := d.stackN - 1; i >= 0; i-- {
+		o = parentOutput(d.stack[i], o.chainingValue())
+	}
+	s := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|root)
+	for _, w := range s[:8] {
+		b = binary.LittleEndian.AppendUint32(b, w)
+	}
+	return b
+}
@@ -0,0 +1,69 @@
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// These test vectors are from the BLAKE3 reference test_vectors.json: the
+// input is n bytes of the repeating sequence 0, 1, ..., 250.
+var testVectors = []struct {
+	n    int
+	hash string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+	{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+	{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+}
+
+func input(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestSum256(t *testing.T) {
+	for _, tv := range testVectors {
+		sum := Sum256(input(tv.n))
+		if got := hex.EncodeToString(sum[:]); got != tv.hash {
+			t.Errorf("%d bytes: got %s, want %s", tv.n, got, tv.hash)
+		}
+	}
+}
+
+func TestWriteSplit(t *testing.T) {
+	// Writes of any size, ending on block and chunk boundaries or not,
+	// must give the same digest
+	for _, tv := range testVectors {
+		for _, step := range []int{1, 63, 64, 1000, 1024, 4096} {
+			h := New()
+			for p := input(tv.n); len(p) > 0; {
+				k := min(step, len(p))
+				h.Write(p[:k])
+				p = p[k:]
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != tv.hash {
+				t.Errorf("%d bytes in writes of %d: got %s, want %s", tv.n, step, got, tv.hash)
+			}
+		}
+	}
+}
+
+func TestSumKeepsState(t *testing.T) {
+	h := New()
+	data := input(3072)
+	h.Write(data[:2000])
+	h.Sum(nil)
+	h.Write(data[2000:])
+	if got, want := hex.EncodeToString(h.Sum(nil)), testVectors[6].hash; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
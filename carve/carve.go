@@ -0,0 +1,259 @@
+// Package carve recovers files from raw bytes, such as the free space of a
+// filesystem, by their signatures.
+//
+// Files are looked for at every 512-byte boundary, where filesystems start
+// them. The end of each is found from its own structure where the format
+// allows (JPEG markers, PNG chunks, SQLite and EVTX headers) or from its
+// trailer (ZIP, PDF). Only the bytes that follow the header in the input
+// are recovered, so a file fragmented in the original filesystem comes back
+// with whatever followed its first fragment.
+package carve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Type is a kind of file that can be carved
+type Type struct {
+	Name string // Short name, e.g. "jpeg"
+	Ext  string // File name extension, e.g. ".jpg"
+
+	header []byte
+	// size returns the length of the file at off, reading no further than
+	// limit bytes, or 0 if it is not a valid file or does not end in time
+	size func(r io.ReaderAt, off, limit int64) int64
+}
+
+// Types are the kinds of file Scan recovers
+var Types = []*Type{
+	{Name: "jpeg", Ext: ".jpg", header: []byte{0xFF, 0xD8, 0xFF}, size: jpegSize},
+	{Name: "png", Ext: ".png", header: []byte("\x89PNG\r\n\x1a\n"), size: pngSize},
+	{Name: "pdf", Ext: ".pdf", header: []byte("%PDF-"), size: pdfSize},
+	{Name: "zip", Ext: ".zip", header: []byte("PK\x03\x04"), size: zipSize},
+	{Name: "sqlite", Ext: ".sqlite", header: []byte("SQLite format 3\x00"), size: sqliteSize},
+	{Name: "evtx", Ext: ".evtx", header: []byte("ElfFile\x00"), size: evtxSize},
+}
+
+// Match is a file found by Scan
+type Match struct {
+	Offset int64
+	Size   int64
+	Type   *Type
+}
+
+const (
+	sectorSize = 512
+	scanChunk  = 1 << 20
+)
+
+// Scan looks for files of the given types in the first size bytes of r.
+// Files larger than maxSize are not recovered. A file found inside another
+// one, such as a JPEG in a ZIP, is not reported separately.
+func Scan(r io.ReaderAt, size, maxSize int64, types []*Type) ([]Match, error) {
+	var matches []Match
+	var next int64 // End of the last file found
+	buf := make([]byte, scanChunk)
+	for base := int64(0); base < size; base += scanChunk {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), size-base)], base)
+		if err != nil && err != io.EOF {
+			return matches, fmt.Errorf("reading at offset %d: %w", base, err)
+		}
+		for off := 0; off < n; off += sectorSize {
+			pos := base + int64(off)
+			if pos < next {
+				continue
+			}
+			for _, t := range types {
+				if !bytes.HasPrefix(buf[off:n], t.header) {
+					continue
+				}
+				if length := t.size(r, pos, min(maxSize, size-pos)); length > 0 {
+					matches = append(matches, Match{Offset: pos, Size: length, Type: t})
+					next = pos + length
+					break
+				}
+			}
+		}
+	}
+	return matches, nil
+}
+
+// readAt reads len(b) bytes at off, reporting whether they were all there
+func readAt(r io.ReaderAt, b []byte, off int64) bool {
+	n, _ := r.ReadAt(b, off)
+	return n == len(b)
+}
+
+// find returns the offset of the first occurrence of pattern at or after
+// off and before off+limit, or -1
+func find(r io.ReaderAt, pattern []byte, off, limit int64) int64 {
+	buf := make([]byte, 64<<10+len(pattern)-1)
+	for pos := off; pos < off+limit; pos += int64(len(buf) - len(pattern) + 1) {
+		n, _ := r.ReadAt(buf[:min(int64(len(buf)), off+limit-pos)], pos)
+		if i := bytes.Index(buf[:n], pattern); i >= 0 {
+			return pos + int64(i)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return -1
+}
+
+// jpegSize walks the marker segments to the start of the scan, then the
+// entropy-coded data to the end marker. Walking the segments skips EXIF
+// thumbnails, whose own end markers would cut the image short.
+func jpegSize(r io.ReaderAt, off, limit int64) int64 {
+	pos := int64(2)
+	var m [4]byte
+	for {
+		if pos+4 > limit || !readAt(r, m[:], off+pos) || m[0] != 0xFF {
+			return 0
+		}
+		marker, length := m[1], int64(binary.BigEndian.Uint16(m[2:4]))
+		if marker == 0xFF {
+			pos++ // Fill byte
+			continue
+		}
+		if length < 2 {
+			return 0
+		}
+		pos += 2 + length
+		if marker == 0xDA { // Start of scan
+			break
+		}
+	}
+
+	// In the entropy-coded data, 0xFF is followed by 0 (a stuffed byte),
+	// a restart marker, or a marker that ends the scan
+	buf := make([]byte, 64<<10)
+	for pos < limit {
+		n, _ := r.ReadAt(buf[:min(int64(len(buf)), limit-pos)], off+pos)
+		if n < 2 {
+			return 0
+		}
+		for i := 0; i+1 < n; i++ {
+			if buf[i] != 0xFF {
+				continue
+			}
+			// Other markers start the segments and scans that progressive
+			// JPEGs have before the end; bytes that are not markers, or
+			// a new image, mean this is not a JPEG
+			switch c := buf[i+1]; {
+			case c == 0xD9:
+				return pos + int64(i) + 2
+			case c == 0xD8 || (c != 0 && c < 0xC0):
+				return 0
+			}
+		}
+		pos += int64(n - 1)
+	}
+	return 0
+}
+
+// pngSize walks the chunks to IEND
+func pngSize(r io.ReaderAt, off, limit int64) int64 {
+	pos := int64(8)
+	var h [8]byte
+	for pos+12 <= limit && readAt(r, h[:], off+pos) {
+		length := int64(binary.BigEndian.Uint32(h[0:4]))
+		for _, c := range h[4:8] {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+				return 0
+			}
+		}
+		pos += 12 + length // Length, type, data, CRC
+		if string(h[4:8]) == "IEND" {
+			if pos > limit {
+				return 0
+			}
+			return pos
+		}
+	}
+	return 0
+}
+
+// pdfSize takes the PDF to its last %%EOF before the next PDF starts:
+// linearized and incrementally updated files have more than one
+func pdfSize(r io.ReaderAt, off, limit int64) int64 {
+	end := int64(0)
+	nextPDF := find(r, []byte("%PDF-"), off+1, limit-1)
+	if nextPDF >= 0 {
+		limit = nextPDF - off
+	}
+	for pos := int64(0); pos < limit; {
+		i := find(r, []byte("%%EOF"), off+pos, limit-pos)
+		if i < 0 {
+			break
+		}
+		pos = i - off + 5
+		end = pos
+	}
+	if end == 0 {
+		return 0
+	}
+
+	// Take the end of line after the marker
+	var eol [2]byte
+	n, _ := r.ReadAt(eol[:min(2, limit-end)], off+end)
+	switch {
+	case n == 2 && string(eol[:]) == "\r\n":
+		end += 2
+	case n >= 1 && (eol[0] == '\n' || eol[0] == '\r'):
+		end++
+	}
+	return end
+}
+
+// zipSize ends the archive after its end of central directory record and
+// comment
+func zipSize(r io.ReaderAt, off, limit int64) int64 {
+	i := find(r, []byte("PK\x05\x06"), off, limit)
+	var rec [22]byte
+	if i < 0 || !readAt(r, rec[:], i) {
+		return 0
+	}
+	end := i - off + 22 + int64(binary.LittleEndian.Uint16(rec[20:22]))
+	if end > limit {
+		return 0
+	}
+	return end
+}
+
+// sqliteSize multiplies the page size by the page count in the header,
+// which is valid if written by the same change as the version number
+func sqliteSize(r io.ReaderAt, off, limit int64) int64 {
+	var h [100]byte
+	if !readAt(r, h[:], off) {
+		return 0
+	}
+	pageSize := int64(binary.BigEndian.Uint16(h[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	pages := int64(binary.BigEndian.Uint32(h[28:32]))
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 || pages == 0 ||
+		binary.BigEndian.Uint32(h[24:28]) != binary.BigEndian.Uint32(h[92:96]) {
+		return 0
+	}
+	if size := pageSize * pages; size <= limit {
+		return size
+	}
+	return 0
+}
+
+// evtxSize counts the 64 KiB chunks after the 4 KiB file header
+func evtxSize(r io.ReaderAt, off, limit int64) int64 {
+	var h [128]byte
+	if !readAt(r, h[:], off) || binary.LittleEndian.Uint16(h[40:42]) != 4096 {
+		return 0
+	}
+	chunks := int64(binary.LittleEndian.Uint16(h[42:44]))
+	if size := 4096 + chunks*65536; chunks > 0 && size <= limit {
+		return size
+	}
+	return 0
+}
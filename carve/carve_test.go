@@ -0,0 +1,132 @@
+package carve
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testFiles(t *testing.T) map[string][]byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// An APP1 segment holding a thumbnail, whose end marker must not end
+	// the image
+	thumb := []byte{0xFF, 0xD8, 0x00, 0xFF, 0xD9}
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(2 + len(thumb))}, thumb...)
+	jpegData := append(append(jpg.Bytes()[:2:2], app1...), jpg.Bytes()[2:]...)
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	w, _ := zw.Create("a.txt")
+	w.Write([]byte("hello"))
+	zw.SetComment("comment")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A linearized PDF has an end marker after the first page too
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n%%EOF\n2 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\r\n")
+
+	sqlite := make([]byte, 1024)
+	copy(sqlite, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(sqlite[16:], 512)
+	binary.BigEndian.PutUint32(sqlite[24:], 7)
+	binary.BigEndian.PutUint32(sqlite[28:], 2)
+	binary.BigEndian.PutUint32(sqlite[92:], 7)
+
+	evtx := make([]byte, 4096+65536)
+	copy(evtx, "ElfFile\x00")
+	binary.LittleEndian.PutUint16(evtx[40:], 4096)
+	binary.LittleEndian.PutUint16(evtx[42:], 1)
+
+	return map[string][]byte{
+		"jpeg": jpegData, "png": pngData.Bytes(), "zip": zipData.Bytes(),
+		"pdf": pdf, "sqlite": sqlite, "evtx": evtx,
+	}
+}
+
+func TestScan(t *testing.T) {
+	files := testFiles(t)
+
+	// Each file starts on a sector boundary, after filler that has a
+	// stray header off the boundary
+	var data []byte
+	want := make(map[int64]string)
+	for _, name := range []string{"jpeg", "png", "zip", "pdf", "sqlite", "evtx"} {
+		filler := bytes.Repeat([]byte{0xAA}, 1000)
+		copy(filler[100:], "%PDF-")
+		data = append(data, filler...)
+		data = append(data, make([]byte, -len(data)&(sectorSize-1))...)
+		want[int64(len(data))] = name
+		data = append(data, files[name]...)
+	}
+	data = append(data, bytes.Repeat([]byte{0xAA}, 1000)...)
+
+	matches, err := Scan(bytes.NewReader(data), int64(len(data)), 1<<20, Types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != len(want) {
+		t.Errorf("found %d files, want %d", len(matches), len(want))
+	}
+	for _, m := range matches {
+		name, ok := want[m.Offset]
+		if !ok || m.Type.Name != name {
+			t.Errorf("found %s at %d, want %q there", m.Type.Name, m.Offset, name)
+			continue
+		}
+		if m.Size != int64(len(files[name])) {
+			t.Errorf("%s: size %d, want %d", name, m.Size, len(files[name]))
+		}
+	}
+}
+
+func TestScanMaxSize(t *testing.T) {
+	files := testFiles(t)
+	data := files["evtx"]
+	matches, err := Scan(bytes.NewReader(data), int64(len(data)), 4096, Types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("found %v in a file over the size limit", matches)
+	}
+}
+
+func TestScanTruncated(t *testing.T) {
+	for name, data := range testFiles(t) {
+		data = data[:len(data)-3]
+		matches, err := Scan(bytes.NewReader(data), int64(len(data)), 1<<20, Types)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "pdf" {
+			// What is left ends at the first end marker
+			want := int64(bytes.Index(data, []byte("%%EOF")) + 6)
+			if len(matches) != 1 || matches[0].Size != want {
+				t.Errorf("pdf: found %v, want one of %d bytes", matches, want)
+			}
+			continue
+		}
+		if len(matches) != 0 {
+			t.Errorf("%s: found %d files in a truncated one", name, len(matches))
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package config reads the settings file of rawhide, which gives flags to
+// use unless the command line gives them, for every image and for named
+// profiles, so that the key and options of an image used often need not
+// be typed each time. The file is a small part of TOML:
+//
+//	# Flags for every image, by their names without the dash
+//	cache = 64
+//
+//	# Flags of a command
+//	[ls]
+//	tz = "UTC"
+//
+//	# A profile, picked with -profile laptop, or for the images whose
+//	# path matches a pattern or whose first MiB has the given SHA-256
+//	[profile.laptop]
+//	match = ["/evidence/laptop-*.img"]
+//	head-sha256 = ["9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]
+//	K = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+//	sz = 4096
+//
+//	[profile.laptop.ls]
+//	tz = "Europe/Amsterdam"
+//
+// Values are strings, integers or true and false; match and head-sha256
+// are arrays of strings.
+package config
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HeadSize is how much of the start of an image head-sha256 is a digest of
+const HeadSize = 1 << 20
+
+// Setting is a flag and the value it is given
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Settings are the flags given by the whole file or by a profile
+type Settings struct {
+	Flags    []Setting            // Flags before the command, in order
+	Commands map[string][]Setting // Flags of each command, in order
+}
+
+// Profile is a named set of settings and the images it is for
+type Profile struct {
+	Name       string
+	Match      []string // Patterns of filepath.Match for the image path
+	HeadSHA256 []string // Digests of the first HeadSize bytes of the image
+	Settings
+}
+
+// Config is a settings file
+type Config struct {
+	Settings            // Used for every image
+	Profiles []*Profile // In the order of the file
+}
+
+// DefaultPath returns where the settings file is unless -config says
+// otherwise, fscat.toml in the user's configuration directory
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "fscat.toml"), nil
+}
+
+// Load reads the settings file at path
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse reads a settings file
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{}
+	settings := &c.Settings
+	var profile *Profile
+	command := ""
+	seen := make(map[string]bool) // Tables and keys so far
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		wrap := func(err error) error { return fmt.Errorf("line %d: %w", line, err) }
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") || strings.HasPrefix(text, "[[") {
+				return nil, wrap(fmt.Errorf("bad table header %s", text))
+			}
+			table = strings.TrimSpace(text[1 : len(text)-1])
+			if seen[table] {
+				return nil, wrap(fmt.Errorf("table [%s] given twice", table))
+			}
+			seen[table] = true
+			parts := strings.Split(table, ".")
+			for _, p := range parts {
+				if !isBareKey(p) {
+					return nil, wrap(fmt.Errorf("bad table name [%s]", table))
+				}
+			}
+			settings, profile, command = &c.Settings, nil, ""
+			switch {
+			case parts[0] != "profile" && len(parts) == 1:
+				command = parts[0]
+			case parts[0] == "profile" && (len(parts) == 2 || len(parts) == 3):
+				profile = c.Profile(parts[1])
+				if profile == nil {
+					profile = &Profile{Name: parts[1]}
+					c.Profiles = append(c.Profiles, profile)
+				}
+				settings = &profile.Settings
+				if len(parts) == 3 {
+					command = parts[2]
+				}
+			default:
+				return nil, wrap(fmt.Errorf("unknown table [%s]: use [command], [profile.name] or [profile.name.command]", table))
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !isBareKey(key) {
+			return nil, wrap(fmt.Errorf("want key = value, got %s", text))
+		}
+		if seen[table+"\x00"+key] {
+			return nil, wrap(fmt.Errorf("%s given twice", key))
+		}
+		seen[table+"\x00"+key] = true
+
+		if profile != nil && command == "" && (key == "match" || key == "head-sha256") {
+			list, err := parseArray(value)
+			if err != nil {
+				return nil, wrap(fmt.Errorf("%s: %w", key, err))
+			}
+			if key == "match" {
+				for _, pattern := range list {
+					if _, err := filepath.Match(pattern, ""); err != nil {
+						return nil, wrap(fmt.Errorf("match %q: %w", pattern, err))
+					}
+				}
+				profile.Match = list
+				continue
+			}
+			for i, digest := range list {
+				if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+					return nil, wrap(fmt.Errorf("head-sha256 %q is not a SHA-256 digest in hexadecimal", digest))
+				}
+				list[i] = strings.ToLower(digest)
+			}
+			profile.HeadSHA256 = list
+			continue
+		}
+
+		v, err := parseValue(value)
+		if err != nil {
+			return nil, wrap(fmt.Errorf("%s: %w", key, err))
+		}
+		s := Setting{Name: key, Value: v}
+		if command == "" {
+			settings.Flags = append(settings.Flags, s)
+			continue
+		}
+		if settings.Commands == nil {
+			settings.Commands = make(map[string][]Setting)
+		}
+		settings.Commands[command] = append(settings.Commands[command], s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// stripComment removes a # comment from a line, leaving one in a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch b := line[i]; {
+		case quote == '"' && b == '\\':
+			i++
+		case quote != 0 && b == quote:
+			quote = 0
+		case quote == 0 && (b == '"' || b == '\''):
+			quote = b
+		case quote == 0 && b == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// isBareKey reports whether s is a key TOML allows without quotes
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue decodes a string, integer or boolean to the text a flag is
+// set with
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", errors.New("no value")
+	case s == "true" || s == "false":
+		return s, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(s[1:len(s)-1], "'") {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad value %s: use a string, an integer, true or false", s)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// parseArray decodes an array of strings on one line
+func parseArray(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, errors.New("want an array of strings")
+	}
+	var list []string
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	for rest != "" {
+		end := 1
+		if quote := rest[0]; quote == '"' || quote == '\'' {
+			for end < len(rest) && rest[end] != quote {
+				if quote == '"' && rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		}
+		if end > len(rest) {
+			return nil, fmt.Errorf("bad string %s", rest)
+		}
+		v, err := parseValue(rest[:end])
+		if err != nil || rest[0] != '"' && rest[0] != '\'' {
+			return nil, errors.New("want an array of strings")
+		}
+		list = append(list, v)
+		rest = strings.TrimSpace(rest[end:])
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, errors.New("want commas between the strings of an array")
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return list, nil
+}
+
+// Profile returns the profile with the given name, or nil
+func (c *Config) Profile(name string) *Profile {
+	for _, p := range c.Profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Find returns the first profile for the image at path, or nil. A pattern
+// with a path separator is matched against the absolute path, one without
+// against the file name. headDigest gives the SHA-256 of the first HeadSize
+// bytes of the image, in hexadecimal, and is only called if a profile
+// lists digests.
+func (c *Config) Find(path string, headDigest func() (string, error)) (*Profile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	digest, digested := "", false
+	for _, p := range c.Profiles {
+		for _, pattern := range p.Match {
+			name := filepath.Base(path)
+			if strings.ContainsRune(pattern, filepath.Separator) || strings.Contains(pattern, "/") {
+				name = abs
+			}
+			if ok, _ := filepath.Match(filepath.FromSlash(pattern), name); ok {
+				return p, nil
+			}
+		}
+		if len(p.HeadSHA256) == 0 {
+			continue
+		}
+		if !digested {
+			if digest, err = headDigest(); err != nil {
+				return nil, err
+			}
+			digested = true
+		}
+		for _, d := range p.HeadSHA256 {
+			if d == digest {
+				return p, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// HeadDigest returns the SHA-256 of the first HeadSize bytes of r, or of
+// all of it if it is smaller, in hexadecimal
+func HeadDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.CopyN(h, r, HeadSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
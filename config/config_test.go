@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const example = `# Flags for every image
+cache = 64
+mmap = true # a comment after a value
+
+[ls]
+tz = "UTC"
+
+[profile.laptop]
+match = ["/evidence/laptop-*.img", 'laptop.dd']
+K = "0011#not a comment"
+sz = 4_096
+
+[profile.laptop.ls]
+tz = 'Europe/Amsterdam'
+
+[profile.usb]
+head-sha256 = ["9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"]
+lba-size = 0x1000
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Settings: Settings{
+			Flags:    []Setting{{"cache", "64"}, {"mmap", "true"}},
+			Commands: map[string][]Setting{"ls": {{"tz", "UTC"}}},
+		},
+		Profiles: []*Profile{
+			{
+				Name:  "laptop",
+				Match: []string{"/evidence/laptop-*.img", "laptop.dd"},
+				Settings: Settings{
+					Flags:    []Setting{{"K", "0011#not a comment"}, {"sz", "4096"}},
+					Commands: map[string][]Setting{"ls": {{"tz", "Europe/Amsterdam"}}},
+				},
+			},
+			{
+				Name:       "usb",
+				HeadSHA256: []string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+				Settings:   Settings{Flags: []Setting{{"lba-size", "4096"}}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Parse = %+v, want %+v", c, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		text, err string
+	}{
+		{"cache", "line 1: want key = value"},
+		{"cache = 1\ncache = 2", "line 2: cache given twice"},
+		{"[ls]\n[ls]", "line 2: table [ls] given twice"},
+		{"[profile.a.b.c]", "unknown table"},
+		{"[profile]", "unknown table"},
+		{"[a b]", "bad table name"},
+		{"K = 00ff", "bad value 00ff"},
+		{`K = "abc`, "bad string"},
+		{"[profile.a]\nmatch = \"*.img\"", "want an array of strings"},
+		{"[profile.a]\nmatch = [\"[\"]", "match \"[\""},
+		{"[profile.a]\nhead-sha256 = [\"abc\"]", "not a SHA-256 digest"},
+		{"[ls]\nmatch = [\"x\"]", "bad value"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.text))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) = %v, want an error with %q", tt.text, err, tt.err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	c, err := Parse(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := 0
+	headDigest := func(digest string) func() (string, error) {
+		return func() (string, error) {
+			digests++
+			return digest, nil
+		}
+	}
+	usb := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		path, digest, want string
+	}{
+		{"/evidence/laptop-1.img", usb, "laptop"},
+		{"/elsewhere/laptop-1.img", usb, "usb"},
+		{filepath.Join("some", "dir", "laptop.dd"), "", "laptop"},
+		{"/evidence/other.img", "0000", ""},
+	}
+	for _, tt := range tests {
+		p, err := c.Find(filepath.FromSlash(tt.path), headDigest(tt.digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if p != nil {
+			got = p.Name
+		}
+		if got != tt.want {
+			t.Errorf("Find(%s) = profile %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	// The digest is only taken when no pattern matched first
+	if digests != 2 {
+		t.Errorf("%d digests taken, want 2", digests)
+	}
+
+	wantErr := errors.New("unreadable")
+	if _, err := c.Find("x.img", func() (string, error) { return "", wantErr }); err != wantErr {
+		t.Errorf("Find with a failing digest = %v, want %v", err, wantErr)
+	}
+}
+
+func TestHeadDigest(t *testing.T) {
+	short, err := HeadDigest(strings.NewReader("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"; short != want {
+		t.Errorf("HeadDigest(test) = %s, want %s", short, want)
+	}
+
+	// Only the first HeadSize bytes count
+	a, _ := HeadDigest(strings.NewReader(strings.Repeat("x", HeadSize) + "a"))
+	b, _ := HeadDigest(strings.NewReader(strings.Repeat("x", HeadSize) + "b"))
+	if a != b {
+		t.Error("bytes past HeadSize changed the digest")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/fs"
+	"sort"
 )
 
 // Type represents a filesystem type
@@ -24,6 +26,16 @@ const (
 	GPT // GUID Partition Table
 	APFS
 	HFSPlus
+	BSDLabel // BSD disklabel
+	SunVTOC  // Sun/Solaris VTOC label (SPARC or x86)
+
+	// Recognized but not readable
+	ExFAT
+	Btrfs
+	XFS
+	LUKS // LUKS encrypted volume
+	Squashfs
+	ISO9660
 )
 
 func (t Type) String() string {
@@ -50,6 +62,22 @@ func (t Type) String() string {
 		return "APFS"
 	case HFSPlus:
 		return "HFS+"
+	case BSDLabel:
+		return "BSD disklabel"
+	case SunVTOC:
+		return "Sun VTOC"
+	case ExFAT:
+		return "exFAT"
+	case Btrfs:
+		return "btrfs"
+	case XFS:
+		return "XFS"
+	case LUKS:
+		return "LUKS"
+	case Squashfs:
+		return "squashfs"
+	case ISO9660:
+		return "ISO 9660"
 	default:
 		return "unknown"
 	}
@@ -67,7 +95,7 @@ func (t Type) IsExt() bool {
 
 // IsPartitionTable returns true if the type is a partition table format
 func (t Type) IsPartitionTable() bool {
-	return t == MBR || t == GPT
+	return t == MBR || t == GPT || t == BSDLabel || t == SunVTOC
 }
 
 // IsApple returns true if the type is an Apple filesystem
@@ -75,64 +103,302 @@ func (t Type) IsApple() bool {
 	return t == APFS || t == HFSPlus
 }
 
+// Candidate is one hypothesis about what an image holds
+type Candidate struct {
+	Type       Type
+	Confidence int    // 0-100, higher is more certain
+	Evidence   string // What the guess is based on
+	Offset     int64  // Where the filesystem starts within the image, usually 0
+}
+
 // Detect identifies the filesystem type from a reader.
 // It reads the necessary header bytes to identify the filesystem.
+// It returns the most likely of the candidates from DetectAll.
 func Detect(r io.ReaderAt) (Type, error) {
+	candidates, err := DetectAll(r)
+	if err != nil || len(candidates) == 0 {
+		return Unknown, err
+	}
+	return candidates[0].Type, nil
+}
+
+// DetectAll returns every filesystem type the image's header bytes are
+// consistent with, most likely first, so callers can fall back to the
+// next guess when the first one fails to open
+func DetectAll(r io.ReaderAt) ([]Candidate, error) {
 	// Read first 4KB which should contain all magic bytes we need
 	header := make([]byte, 4096)
 	n, err := r.ReadAt(header, 0)
 	if err != nil && err != io.EOF {
-		return Unknown, fmt.Errorf("reading header: %w", err)
+		return nil, fmt.Errorf("reading header: %w", err)
 	}
 	if n < 512 {
-		return Unknown, fmt.Errorf("file too small: %d bytes", n)
+		return nil, fmt.Errorf("file too small: %d bytes", n)
+	}
+	header = header[:n]
+
+	var candidates []Candidate
+	add := func(t Type, confidence int, evidence string, args ...any) {
+		candidates = append(candidates, Candidate{Type: t, Confidence: confidence, Evidence: fmt.Sprintf(evidence, args...)})
 	}
 
 	// Check for GPT (GUID Partition Table) - "EFI PART" at LBA 1 (offset 512)
 	if n >= 520 && bytes.Equal(header[512:520], []byte("EFI PART")) {
-		return GPT, nil
+		add(GPT, 95, "GPT header at offset 512")
+	}
+
+	// On 4Kn disks LBA 1 is at offset 4096
+	gptSig := make([]byte, 8)
+	if _, err := r.ReadAt(gptSig, 4096); err == nil && bytes.Equal(gptSig, []byte("EFI PART")) {
+		add(GPT, 90, "GPT header at offset 4096")
 	}
 
-	// Check for APFS container superblock - "NXSB" at offset 32
+	// Check for APFS container superblock - "NXSB" at offset 32, in an
+	// object of type 1
 	if n >= 36 && binary.LittleEndian.Uint32(header[32:36]) == 0x4253584E {
-		return APFS, nil
+		if binary.LittleEndian.Uint16(header[24:26]) == 1 {
+			add(APFS, 95, "NXSB container superblock at offset 0")
+		} else {
+			add(APFS, 60, "NXSB magic at offset 32 with object type %#x", binary.LittleEndian.Uint16(header[24:26]))
+		}
 	}
 
 	// Check for HFS+ volume header at offset 1024
-	// Signature is 'H+' (0x482B) or 'HX' (0x4858) in big-endian
-	if n >= 1026 {
-		sig := binary.BigEndian.Uint16(header[1024:1026])
-		if sig == 0x482B || sig == 0x4858 {
-			return HFSPlus, nil
+	// Signature is 'H+' (0x482B) or 'HX' (0x4858) in big-endian,
+	// followed by version 4 or 5
+	if n >= 1028 {
+		sig, version := binary.BigEndian.Uint16(header[1024:1026]), binary.BigEndian.Uint16(header[1026:1028])
+		switch {
+		case (sig == 0x482B && version == 4) || (sig == 0x4858 && version == 5):
+			add(HFSPlus, 90, "volume header signature %q version %d at offset 1024", header[1024:1026], version)
+		case sig == 0x482B || sig == 0x4858:
+			add(HFSPlus, 50, "volume header signature %q at offset 1024 with version %d", header[1024:1026], version)
+		case sig == 0x4244:
+			if offset := embeddedHFSPlus(header[1024:]); offset > 0 {
+				candidates = append(candidates, Candidate{Type: HFSPlus, Confidence: 90, Offset: offset,
+					Evidence: fmt.Sprintf("HFS+ volume embedded in an HFS wrapper at offset %d", offset)})
+			}
 		}
 	}
 
 	// Check NTFS (offset 3: "NTFS    ")
 	if n >= 11 && bytes.Equal(header[3:11], []byte("NTFS    ")) {
-		return NTFS, nil
+		if header[510] == 0x55 && header[511] == 0xAA {
+			add(NTFS, 95, "NTFS OEM ID and boot signature")
+		} else {
+			add(NTFS, 70, "NTFS OEM ID without boot signature")
+		}
 	}
 
 	// Check for ext2/3/4 superblock magic at offset 0x438 (1080)
 	// The superblock starts at byte 1024
-	if n >= 1082 {
-		magic := binary.LittleEndian.Uint16(header[0x438:0x43A])
-		if magic == 0xEF53 {
-			return detectExtVersion(header[1024:]), nil
+	if n >= 1024+0x68 && binary.LittleEndian.Uint16(header[0x438:0x43A]) == 0xEF53 {
+		sb := header[1024:]
+		logBlockSize := binary.LittleEndian.Uint32(sb[24:28])
+		if logBlockSize <= 6 && binary.LittleEndian.Uint32(sb[0:4]) != 0 {
+			add(detectExtVersion(sb), 90, "superblock magic at offset 1080 and plausible geometry")
+		} else {
+			add(detectExtVersion(sb), 50, "superblock magic at offset 1080")
 		}
 	}
 
-	// Check for FAT boot sector signature or MBR partition table
-	if header[510] == 0x55 && header[511] == 0xAA {
+	// Check for a BSD disklabel in sector 1, magic at its start and end
+	if n >= 512+136 && binary.LittleEndian.Uint32(header[512:516]) == 0x82564557 &&
+		binary.LittleEndian.Uint32(header[512+132:512+136]) == 0x82564557 {
+		add(BSDLabel, 85, "disklabel magic in sector 1")
+	}
+
+	// Check for a Sun VTOC: SPARC labels are sector 0 with magic 0xDABE at
+	// offset 508, x86 labels are sector 1 with the VTOC sanity value at 12
+	if isSunLabel(header[:512]) {
+		add(SunVTOC, 85, "SPARC label magic and checksum in sector 0")
+	}
+	if n >= 512+16 && binary.LittleEndian.Uint32(header[512+12:512+16]) == 0x600DDEEE {
+		add(SunVTOC, 80, "VTOC sanity value in sector 1")
+	}
+
+	// Formats with a magic number at the start
+	switch {
+	case bytes.HasPrefix(header, []byte("LUKS\xba\xbe")):
+		add(LUKS, 95, "LUKS header version %d", binary.BigEndian.Uint16(header[6:8]))
+	case bytes.HasPrefix(header, []byte("XFSB")) && isXFSBlockSize(binary.BigEndian.Uint32(header[4:8])):
+		add(XFS, 90, "XFS superblock magic and block size")
+	case bytes.HasPrefix(header, []byte("hsqs")):
+		add(Squashfs, 90, "squashfs magic, version %d.%d",
+			binary.LittleEndian.Uint16(header[28:30]), binary.LittleEndian.Uint16(header[30:32]))
+	}
+
+	// Superblocks beyond the first 4 KiB: the ISO 9660 volume descriptors
+	// start at 32 KiB, the btrfs superblock is at 64 KiB
+	magic := make([]byte, 8)
+	if _, err := r.ReadAt(magic[:6], 0x8000); err == nil && bytes.Equal(magic[1:6], []byte("CD001")) {
+		add(ISO9660, 90, "volume descriptor at offset 32768")
+	}
+	if _, err := r.ReadAt(magic, 0x10040); err == nil && bytes.Equal(magic, []byte("_BHRfS_M")) {
+		add(Btrfs, 90, "superblock magic at offset 65600")
+	}
+
+	// Check for FAT boot sector signature or MBR partition table. exFAT
+	// boot sectors have the signature, but no BPB.
+	if bytes.Equal(header[3:11], []byte("EXFAT   ")) {
+		add(ExFAT, 95, "exFAT OEM ID")
+	} else if header[510] == 0x55 && header[511] == 0xAA {
 		// Check if this looks like a partition table (MBR)
 		// MBR has partition entries at offset 446-509
 		if isMBRPartitionTable(header) {
-			return MBR, nil
+			add(MBR, 70, "boot signature and valid partition entries")
+			if hasFATBPB(header) {
+				add(detectFATVersion(header), 30, "boot signature and plausible BPB")
+			}
+		} else if isFATLabeled(header) {
+			add(detectFATVersion(header), 90, "boot signature and FAT type label")
+		} else {
+			// Otherwise it's a FAT filesystem
+			add(detectFATVersion(header), 50, "boot signature")
 		}
-		// Otherwise it's a FAT filesystem
-		return detectFATVersion(header), nil
 	}
 
-	return Unknown, nil
+	if len(candidates) == 0 {
+		candidates = probeAPFS(r)
+	}
+	if len(candidates) == 0 {
+		candidates = probeBackups(r)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	return candidates, nil
+}
+
+// embeddedHFSPlus returns the offset of the HFS+ volume an HFS master
+// directory block wraps, or 0 if it wraps none. The embedded volume lies in
+// the wrapper's allocation blocks, which start at drAlBlSt 512-byte sectors.
+func embeddedHFSPlus(mdb []byte) int64 {
+	if binary.BigEndian.Uint16(mdb[0x7C:0x7E]) != 0x482B {
+		return 0
+	}
+	blockSize := int64(binary.BigEndian.Uint32(mdb[0x14:0x18]))
+	firstBlock := int64(binary.BigEndian.Uint16(mdb[0x1C:0x1E]))
+	startBlock := int64(binary.BigEndian.Uint16(mdb[0x7E:0x80]))
+	if blockSize == 0 || blockSize%512 != 0 {
+		return 0
+	}
+	return firstBlock*512 + startBlock*blockSize
+}
+
+// maxAPFSProbe bounds how far into an image probeAPFS looks
+const maxAPFSProbe = 1 << 20
+
+// probeAPFS looks for an APFS container superblock at the 4 KiB block
+// boundaries near the start of an image, for dumps in which the container
+// does not start at offset 0
+func probeAPFS(r io.ReaderAt) []Candidate {
+	obj := make([]byte, 36)
+	for offset := int64(4096); offset < maxAPFSProbe; offset += 4096 {
+		if _, err := r.ReadAt(obj, offset); err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(obj[32:36]) == 0x4253584E && binary.LittleEndian.Uint16(obj[24:26]) == 1 {
+			return []Candidate{{Type: APFS, Confidence: 80, Offset: offset,
+				Evidence: fmt.Sprintf("NXSB container superblock at offset %d", offset)}}
+		}
+	}
+	return nil
+}
+
+// probeBackups looks for the backup copies filesystems keep of their boot
+// sector or superblock, for images whose start is damaged: FAT32's backup
+// boot sector in sector 6, NTFS's in the last sector of the volume, and the
+// ext superblock copy in block group 1
+func probeBackups(r io.ReaderAt) []Candidate {
+	var candidates []Candidate
+	sector := make([]byte, 4096)
+	for ss := int64(512); ss <= 4096; ss *= 2 {
+		if _, err := r.ReadAt(sector[:512], 6*ss); err == nil && sector[510] == 0x55 && sector[511] == 0xAA &&
+			bytes.Equal(sector[82:90], []byte("FAT32   ")) && int64(binary.LittleEndian.Uint16(sector[11:13])) == ss {
+			candidates = append(candidates, Candidate{Type: FAT32, Confidence: 60, Evidence: fmt.Sprintf("backup boot sector at offset %d", 6*ss)})
+			break
+		}
+	}
+
+	if size := sizeOf(r); size > 0 {
+		for ss := int64(512); ss <= 4096 && ss <= size; ss *= 2 {
+			if _, err := r.ReadAt(sector[:512], size-ss); err == nil && bytes.Equal(sector[3:11], []byte("NTFS    ")) &&
+				int64(binary.LittleEndian.Uint16(sector[11:13])) == ss {
+				candidates = append(candidates, Candidate{Type: NTFS, Confidence: 60, Evidence: fmt.Sprintf("backup boot sector at offset %d", size-ss)})
+				break
+			}
+		}
+	}
+
+	// Group 1 starts 8 blocks per byte of block size in, after the boot
+	// block with 1 KiB blocks
+	sb := sector[:1024]
+	for logBlockSize := int64(0); logBlockSize <= 6; logBlockSize++ {
+		blockSize := int64(1024) << logBlockSize
+		offset := 8 * blockSize * blockSize
+		if blockSize == 1024 {
+			offset += 1024
+		}
+		if _, err := r.ReadAt(sb, offset); err != nil {
+			continue
+		}
+		if binary.LittleEndian.Uint16(sb[0x38:0x3A]) == 0xEF53 &&
+			int64(binary.LittleEndian.Uint32(sb[24:28])) == logBlockSize &&
+			binary.LittleEndian.Uint16(sb[0x5A:0x5C]) == 1 {
+			candidates = append(candidates, Candidate{Type: detectExtVersion(sb), Confidence: 60, Evidence: fmt.Sprintf("backup superblock at offset %d", offset)})
+			break
+		}
+	}
+	return candidates
+}
+
+// sizeOf returns the size of r if it can tell, or -1
+func sizeOf(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+// isXFSBlockSize checks for a power of two XFS supports as block size
+func isXFSBlockSize(size uint32) bool {
+	return size >= 512 && size <= 65536 && size&(size-1) == 0
+}
+
+// isFATLabeled checks for the filesystem type label of a FAT boot sector
+func isFATLabeled(header []byte) bool {
+	return bytes.Equal(header[54:59], []byte("FAT12")) ||
+		bytes.Equal(header[54:59], []byte("FAT16")) ||
+		bytes.Equal(header[82:87], []byte("FAT32"))
+}
+
+// hasFATBPB checks whether a boot sector's BIOS parameter block has
+// plausible sector and cluster sizes
+func hasFATBPB(header []byte) bool {
+	bps := binary.LittleEndian.Uint16(header[11:13])
+	spc := header[13]
+	return bps >= 512 && bps <= 4096 && bps&(bps-1) == 0 &&
+		spc != 0 && spc&(spc-1) == 0 && header[16] != 0
+}
+
+// isSunLabel checks for a SPARC disk label: magic 0xDABE, and all 16-bit
+// words XOR to zero
+func isSunLabel(sector []byte) bool {
+	if binary.BigEndian.Uint16(sector[508:510]) != 0xDABE {
+		return false
+	}
+	var sum uint16
+	for i := 0; i < 512; i += 2 {
+		sum ^= binary.BigEndian.Uint16(sector[i : i+2])
+	}
+	return sum == 0
 }
 
 // isMBRPartitionTable checks if the boot sector contains a valid MBR partition table
@@ -319,3 +585,93 @@ func detectExtVersion(superblock []byte) Type {
 
 	return Ext2
 }
+
+// Match is a filesystem or partition table signature found by Scan
+type Match struct {
+	Offset int64 // Offset of the start of the filesystem or table
+	Type   Type
+}
+
+// scanChunk is the amount of image Scan reads at a time
+const scanChunk = 1 << 20
+
+// Scan slides over the image at 512-byte steps and reports every offset at
+// which a filesystem or GPT appears to start. Only signatures unlikely to
+// occur by chance are considered, so MBRs and FAT volumes without a type
+// label are not reported.
+func Scan(r io.ReaderAt, size int64) ([]Match, error) {
+	var matches []Match
+	buf := make([]byte, scanChunk+4096)
+	for base := int64(0); base < size; base += scanChunk {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), size-base)], base)
+		if err != nil && err != io.EOF {
+			return matches, fmt.Errorf("reading at offset %d: %w", base, err)
+		}
+		for off := 0; off < scanChunk && off+512 <= n; off += 512 {
+			if t := sniff(buf[off:n]); t != Unknown {
+				matches = append(matches, Match{Offset: base + int64(off), Type: t})
+			}
+		}
+	}
+	return matches, nil
+}
+
+// sniff checks for a filesystem or GPT starting at the beginning of b
+func sniff(b []byte) Type {
+	if len(b) >= 520 && bytes.Equal(b[512:520], []byte("EFI PART")) {
+		return GPT
+	}
+
+	if bytes.HasPrefix(b, []byte("LUKS\xba\xbe")) {
+		return LUKS
+	}
+	if bytes.HasPrefix(b, []byte("XFSB")) && isXFSBlockSize(binary.BigEndian.Uint32(b[4:8])) {
+		return XFS
+	}
+	if bytes.HasPrefix(b, []byte("hsqs")) && binary.LittleEndian.Uint16(b[28:30]) == 4 {
+		return Squashfs
+	}
+	if bytes.Equal(b[3:11], []byte("EXFAT   ")) && b[510] == 0x55 && b[511] == 0xAA {
+		return ExFAT
+	}
+
+	// The container superblock is object type 1
+	if len(b) >= 36 && binary.LittleEndian.Uint32(b[32:36]) == 0x4253584E &&
+		binary.LittleEndian.Uint16(b[24:26]) == 1 {
+		return APFS
+	}
+
+	// Volume header version 4 for HFS+, 5 for HFSX
+	if len(b) >= 1028 {
+		sig, version := binary.BigEndian.Uint16(b[1024:1026]), binary.BigEndian.Uint16(b[1026:1028])
+		if (sig == 0x482B && version == 4) || (sig == 0x4858 && version == 5) {
+			return HFSPlus
+		}
+	}
+
+	if b[510] == 0x55 && b[511] == 0xAA {
+		if bytes.Equal(b[3:11], []byte("NTFS    ")) {
+			return NTFS
+		}
+		bps := binary.LittleEndian.Uint16(b[11:13])
+		if bps >= 512 && bps <= 4096 && bps&(bps-1) == 0 &&
+			(bytes.Equal(b[82:90], []byte("FAT32   ")) || bytes.Equal(b[54:62], []byte("FAT12   ")) ||
+				bytes.Equal(b[54:62], []byte("FAT16   "))) {
+			return detectFATVersion(b)
+		}
+	}
+
+	// The superblock at 1024: block size at most 64 KiB, and the first
+	// data block is 1 for 1 KiB blocks and 0 otherwise
+	if len(b) >= 1024+0x68 && binary.LittleEndian.Uint16(b[0x438:0x43A]) == 0xEF53 {
+		sb := b[1024:]
+		logBlockSize := binary.LittleEndian.Uint32(sb[24:28])
+		firstDataBlock := binary.LittleEndian.Uint32(sb[20:24])
+		if logBlockSize <= 6 && (firstDataBlock == 1) == (logBlockSize == 0) &&
+			binary.LittleEndian.Uint32(sb[0:4]) != 0 {
+			return detectExtVersion(sb)
+		}
+	}
+
+	return Unknown
+}
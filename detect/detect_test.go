@@ -0,0 +1,148 @@
+package detect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	image := make([]byte, 3*scanChunk)
+
+	// An ext4 superblock for a filesystem straddling the first chunk boundary
+	ext := image[scanChunk-512:]
+	binary.LittleEndian.PutUint32(ext[1024:], 128)       // Inode count
+	binary.LittleEndian.PutUint32(ext[1024+24:], 2)      // 4 KiB blocks
+	binary.LittleEndian.PutUint16(ext[0x438:], 0xEF53)   // Magic
+	binary.LittleEndian.PutUint32(ext[1024+0x60:], 0x40) // Extents
+
+	// A FAT16 boot sector
+	fat := image[scanChunk+4096:]
+	binary.LittleEndian.PutUint16(fat[11:], 512)
+	copy(fat[54:], "FAT16   ")
+	fat[510], fat[511] = 0x55, 0xAA
+
+	// An HFS+ signature without the right version is not a match
+	binary.BigEndian.PutUint16(image[2*scanChunk+1024:], 0x482B)
+
+	matches, err := Scan(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Match{{scanChunk - 512, Ext4}, {scanChunk + 4096, FAT16}}
+	if fmt.Sprint(matches) != fmt.Sprint(want) {
+		t.Errorf("Scan = %v, want %v", matches, want)
+	}
+}
+
+func TestDetectAll(t *testing.T) {
+	// A FAT16 boot sector with a stray HFS+ signature in its reserved
+	// sectors: both are candidates, HFS+ first as it is checked first
+	image := make([]byte, 4096)
+	binary.LittleEndian.PutUint16(image[11:], 512)
+	image[13], image[16] = 4, 2
+	copy(image[54:], "FAT16   ")
+	image[510], image[511] = 0x55, 0xAA
+	copy(image[1024:], "H+\x00\x04")
+
+	candidates, err := DetectAll(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Type
+	for _, c := range candidates {
+		got = append(got, c.Type)
+	}
+	if want := []Type{HFSPlus, FAT16}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("DetectAll = %v, want %v", got, want)
+	}
+
+	// Without a version the signature is a weaker guess than the FAT label
+	image[1027] = 0
+	if typ, err := Detect(bytes.NewReader(image)); err != nil || typ != FAT16 {
+		t.Errorf("Detect = %v, %v; want %v", typ, err, FAT16)
+	}
+}
+
+func TestDetectRecognized(t *testing.T) {
+	tests := []struct {
+		offset int
+		magic  string
+		want   Type
+	}{
+		{0, "LUKS\xba\xbe\x00\x02", LUKS},
+		{0, "XFSB\x00\x00\x10\x00", XFS},
+		{0, "hsqs", Squashfs},
+		{3, "EXFAT   ", ExFAT},
+		{0x8000, "\x01CD001", ISO9660},
+		{0x10040, "_BHRfS_M", Btrfs},
+	}
+	for _, tt := range tests {
+		image := make([]byte, 0x11000)
+		copy(image[tt.offset:], tt.magic)
+		if got, err := Detect(bytes.NewReader(image)); err != nil || got != tt.want {
+			t.Errorf("Detect(%q at %d) = %v, %v; want %v", tt.magic, tt.offset, got, err, tt.want)
+		}
+	}
+}
+
+func TestDetectBackups(t *testing.T) {
+	// FAT32 with a zeroed boot sector and its backup in sector 6
+	fat := make([]byte, 64*1024)
+	backup := fat[6*512:]
+	binary.LittleEndian.PutUint16(backup[11:], 512)
+	copy(backup[82:], "FAT32   ")
+	backup[510], backup[511] = 0x55, 0xAA
+
+	// NTFS with only the backup boot sector at the end
+	ntfs := make([]byte, 64*1024)
+	copy(ntfs[len(ntfs)-512+3:], "NTFS    ")
+	binary.LittleEndian.PutUint16(ntfs[len(ntfs)-512+11:], 512)
+
+	// ext2 with 1 KiB blocks and the superblock copy in group 1
+	ext := make([]byte, 9*1024*1024)
+	sb := ext[8193*1024:]
+	binary.LittleEndian.PutUint16(sb[0x38:], 0xEF53)
+	binary.LittleEndian.PutUint16(sb[0x5A:], 1)
+
+	for _, tt := range []struct {
+		image []byte
+		want  Type
+	}{{fat, FAT32}, {ntfs, NTFS}, {ext, Ext2}} {
+		if got, err := Detect(bytes.NewReader(tt.image)); err != nil || got != tt.want {
+			t.Errorf("Detect = %v, %v; want %v", got, err, tt.want)
+		}
+	}
+}
+
+func TestDetectEmbedded(t *testing.T) {
+	// An HFS wrapper with 4 KiB allocation blocks from sector 16, holding
+	// an HFS+ volume from its third block
+	wrapper := make([]byte, 64*1024)
+	mdb := wrapper[1024:]
+	copy(mdb, "BD")
+	binary.BigEndian.PutUint32(mdb[0x14:], 4096)
+	binary.BigEndian.PutUint16(mdb[0x1C:], 16)
+	copy(mdb[0x7C:], "H+")
+	binary.BigEndian.PutUint16(mdb[0x7E:], 2)
+
+	// An APFS container behind 8 KiB of something else
+	apfs := make([]byte, 64*1024)
+	binary.LittleEndian.PutUint16(apfs[8192+24:], 1)
+	copy(apfs[8192+32:], "NXSB")
+
+	for _, tt := range []struct {
+		image  []byte
+		want   Type
+		offset int64
+	}{{wrapper, HFSPlus, 16384}, {apfs, APFS, 8192}} {
+		candidates, err := DetectAll(bytes.NewReader(tt.image))
+		if err != nil || len(candidates) == 0 {
+			t.Fatalf("DetectAll = %v, %v", candidates, err)
+		}
+		if c := candidates[0]; c.Type != tt.want || c.Offset != tt.offset {
+			t.Errorf("DetectAll = %v at %d, want %v at %d", c.Type, c.Offset, tt.want, tt.offset)
+		}
+	}
+}
@@ -1,51 +1,164 @@
 // Package apfs implements read-only APFS filesystem support.
-// Currently only detection and basic info are implemented.
+// It reads the newest checkpoint of a container, resolves objects through
+// the container and volume object maps, and walks the file-system B-tree
+// of one volume. Snapshots of that volume appear under the virtual
+// directory "@snapshots". Compressed files are decompressed transparently;
+// encrypted volumes are not supported.
 package apfs
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
+	"github.com/lvdlvd/rawhide/lzfse"
 )
 
 const (
 	nxsbMagic = 0x4253584E // "NXSB" little-endian
+	apsbMagic = 0x42535041 // "APSB" little-endian
+
+	// Object types (low 16 bits of o_type)
+	objTypeMask          = 0x0000FFFF
+	objTypeNXSuperblock  = 0x01
+	objTypeBtree         = 0x02
+	objTypeBtreeNode     = 0x03
+	objTypeSpaceman      = 0x05
+	objTypeSpacemanCAB   = 0x06
+	objTypeSpacemanCIB   = 0x07
+	objTypeOmap          = 0x0B
+	objTypeCheckpointMap = 0x0C
+	objTypeFS            = 0x0D
+	objPhysical          = 0x40000000 // Storage flag in o_type
+
+	// B-tree node flags
+	btnodeRoot        = 0x1
+	btnodeLeaf        = 0x2
+	btnodeFixedKVSize = 0x4
+
+	btreeNodeHeaderSize = 56 // obj_phys_t plus btree_node_phys_t fields
+	btreeInfoSize       = 40 // btree_info_t at the end of root nodes
+	maxTreeDepth        = 16
+
+	omapValDeleted = 0x1
+
+	// File-system record types (high 4 bits of j_key_t)
+	jTypeSnapMetadata = 1
+	jTypeInode        = 3
+	jTypeXattr        = 4
+	jTypeFileExtent   = 8
+	jTypeDirRec       = 9
+	objIDMask         = 0x0FFFFFFFFFFFFFFF
+	objTypeShift      = 60
+
+	rootDirInode = 2
+
+	incompatCaseInsensitive          = 0x1
+	incompatNormalizationInsensitive = 0x8
+	fsUnencrypted                    = 0x1
+
+	inoExtTypeDstream = 8
+	xattrDataStream   = 0x1 // Xattr value is a j_xattr_dstream_t
+	ufCompressed      = 0x20
+	fileExtentLenMask = 0x00FFFFFFFFFFFFFF
+	physExtentLenMask = 0x0FFFFFFFFFFFFFFF
+
+	// Directory entry types (DT_* in j_drec_val_t flags)
+	dtDir     = 4
+	dtSymlink = 10
+
+	// snapshotDir is the virtual root directory holding one directory per
+	// snapshot of the exposed volume
+	snapshotDir = "@snapshots"
 )
 
-// FS implements a read-only APFS filesystem (skeleton)
+// FS implements a read-only APFS filesystem. The container may hold
+// several volumes; one of them is exposed through fs.FS.
 type FS struct {
-	r         io.ReaderAt
-	size      int64
-	blockSize uint32
+	r          io.ReaderAt // The container, through the block cache
+	base       io.ReaderAt
+	size       int64
+	blockSize  uint32
 	blockCount uint64
-	uuid      [16]byte
+	uuid       [16]byte
+	xid        uint64 // Transaction ID of the checkpoint in use
+	omapTree   uint64 // Physical address of the container object map B-tree
+	descBase   uint64 // Checkpoint descriptor area
+	descBlocks uint32
+	spaceman   uint64 // Ephemeral object ID of the space manager
+	volumes    []volume
+	vol        *volume // Volume exposed through fs.FS
 }
 
 // containerSuperblock represents the APFS container superblock (nx_superblock_t)
 type containerSuperblock struct {
 	// Object header (obj_phys_t) - 32 bytes
-	checksum  uint64
-	oid       uint64
-	xid       uint64
-	objType   uint32
-	objFlags  uint32
+	checksum uint64
+	oid      uint64
+	xid      uint64
+	objType  uint32
+	objFlags uint32
 
 	// Container superblock fields
-	magic       uint32
-	blockSize   uint32
-	blockCount  uint64
-	features    uint64
+	magic            uint32
+	blockSize        uint32
+	blockCount       uint64
+	features         uint64
 	roCompatFeatures uint64
 	incompatFeatures uint64
+	uuid             [16]byte
+	xpDescBlocks     uint32
+	xpDescBase       uint64
+	spacemanOID      uint64
+	omapOID          uint64
+	fsOIDs           []uint64
+}
+
+// volume holds the parts of a volume superblock (apfs_superblock_t) we
+// use. A volume read from a snapshot's superblock copy gives the view of
+// the volume as of that snapshot.
+type volume struct {
+	index       int
+	xid         uint64 // Transaction ID used for object map lookups
+	name        string
 	uuid        [16]byte
+	role        uint16
+	incompat    uint64
+	fsFlags     uint64
+	omapTree    uint64 // Physical address of the volume object map B-tree
+	rootTree    uint64 // Object ID of the file-system tree root
+	rootPhys    bool   // rootTree and its children are physical addresses
+	numFiles    uint64
+	numDirs     uint64
+	numSymlinks uint64
+	snapTree    uint64 // Physical address of the snapshot metadata B-tree
+	extentRefs  uint64 // Physical address of the extent reference B-tree
+}
+
+func init() {
+	fsys.Register(detect.APFS, Open)
 }
 
-// Open opens an APFS filesystem from the given reader
+// Open opens an APFS container from the given reader and exposes its first volume
 func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
+	return OpenVolume(r, size, 0)
+}
+
+// OpenVolume opens an APFS container and exposes the volume with the
+// given index (in the order of the container's volume list)
+func OpenVolume(r io.ReaderAt, size int64, index int) (fsys.FS, error) {
 	// APFS container superblock starts at offset 0
 	header := make([]byte, 128)
 	if _, err := r.ReadAt(header, 0); err != nil {
@@ -58,20 +171,193 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 		return nil, nil // Not APFS
 	}
 
-	f := &FS{r: r, size: size}
-	f.blockSize = binary.LittleEndian.Uint32(header[36:40])
-	f.blockCount = binary.LittleEndian.Uint64(header[40:48])
-	copy(f.uuid[:], header[72:88])
+	blockSize := binary.LittleEndian.Uint32(header[36:40])
+	if blockSize < 4096 || blockSize > 65536 || blockSize&(blockSize-1) != 0 {
+		return nil, fsys.Corrupt("container superblock", 0, "invalid block size %d", blockSize)
+	}
+
+	f := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size, blockSize: blockSize}
+
+	sb, err := f.latestSuperblock()
+	if err != nil {
+		return nil, err
+	}
+	f.blockCount = sb.blockCount
+	f.uuid = sb.uuid
+	f.xid = sb.xid
+	f.descBase = sb.xpDescBase
+	f.descBlocks = sb.xpDescBlocks
+	f.spaceman = sb.spacemanOID
+
+	omap, err := f.readObject(sb.omapOID, objTypeOmap)
+	if err != nil {
+		return nil, fmt.Errorf("reading container object map: %w", err)
+	}
+	f.omapTree = binary.LittleEndian.Uint64(omap[48:56])
+
+	for _, oid := range sb.fsOIDs {
+		paddr, err := f.omapLookup(f.omapTree, oid, f.xid)
+		if err != nil {
+			return nil, fmt.Errorf("locating volume %d: %w", len(f.volumes), err)
+		}
+		v, err := f.readVolume(paddr)
+		if err != nil {
+			return nil, fmt.Errorf("reading volume %d: %w", len(f.volumes), err)
+		}
+		v.index = len(f.volumes)
+		v.xid = f.xid
+		f.volumes = append(f.volumes, v)
+	}
+
+	if index < 0 || index >= len(f.volumes) {
+		return nil, fmt.Errorf("volume %d not found (container has %d volumes)", index, len(f.volumes))
+	}
+	f.vol = &f.volumes[index]
 
 	return f, nil
 }
 
-func (f *FS) Type() string { return "APFS" }
-func (f *FS) Close() error { return nil }
-func (f *FS) BaseReader() io.ReaderAt { return f.r }
+// latestSuperblock returns the newest valid container superblock in the
+// checkpoint descriptor area, falling back to the copy in block 0
+func (f *FS) latestSuperblock() (*containerSuperblock, error) {
+	block0, err := f.readBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	sb0, err := parseContainerSuperblock(block0)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *containerSuperblock
+	if verifyChecksum(block0) {
+		best = sb0
+	}
+
+	// A set high bit means the descriptor area is a B-tree rather than
+	// contiguous blocks; only the copy in block 0 is used then
+	if sb0.xpDescBlocks&0x80000000 == 0 {
+		for i := uint64(0); i < uint64(sb0.xpDescBlocks); i++ {
+			data, err := f.readBlock(sb0.xpDescBase + i)
+			if err != nil {
+				continue
+			}
+			if binary.LittleEndian.Uint32(data[24:28])&objTypeMask != objTypeNXSuperblock || !verifyChecksum(data) {
+				continue
+			}
+			sb, err := parseContainerSuperblock(data)
+			if err != nil {
+				continue
+			}
+			if best == nil || sb.xid > best.xid {
+				best = sb
+			}
+		}
+	}
+
+	if best == nil {
+		best = sb0
+	}
+	return best, nil
+}
+
+// parseContainerSuperblock parses an nx_superblock_t block
+func parseContainerSuperblock(data []byte) (*containerSuperblock, error) {
+	if len(data) < 984 {
+		return nil, fsys.Corrupt("container superblock", -1, "too short")
+	}
+
+	sb := &containerSuperblock{
+		checksum:         binary.LittleEndian.Uint64(data[0:8]),
+		oid:              binary.LittleEndian.Uint64(data[8:16]),
+		xid:              binary.LittleEndian.Uint64(data[16:24]),
+		objType:          binary.LittleEndian.Uint32(data[24:28]),
+		objFlags:         binary.LittleEndian.Uint32(data[28:32]),
+		magic:            binary.LittleEndian.Uint32(data[32:36]),
+		blockSize:        binary.LittleEndian.Uint32(data[36:40]),
+		blockCount:       binary.LittleEndian.Uint64(data[40:48]),
+		features:         binary.LittleEndian.Uint64(data[48:56]),
+		roCompatFeatures: binary.LittleEndian.Uint64(data[56:64]),
+		incompatFeatures: binary.LittleEndian.Uint64(data[64:72]),
+		xpDescBlocks:     binary.LittleEndian.Uint32(data[104:108]),
+		xpDescBase:       binary.LittleEndian.Uint64(data[112:120]),
+		spacemanOID:      binary.LittleEndian.Uint64(data[152:160]),
+		omapOID:          binary.LittleEndian.Uint64(data[160:168]),
+	}
+	copy(sb.uuid[:], data[72:88])
+
+	if sb.magic != nxsbMagic {
+		return nil, fsys.Corrupt("container superblock", -1, "bad magic %#x", sb.magic)
+	}
+
+	// nx_fs_oid holds up to nx_max_file_systems volume object IDs
+	maxVolumes := int(binary.LittleEndian.Uint32(data[180:184]))
+	if maxVolumes > 100 {
+		maxVolumes = 100
+	}
+	for i := 0; i < maxVolumes; i++ {
+		if oid := binary.LittleEndian.Uint64(data[184+i*8:]); oid != 0 {
+			sb.fsOIDs = append(sb.fsOIDs, oid)
+		}
+	}
+
+	return sb, nil
+}
+
+// readVolume reads the volume superblock at paddr
+func (f *FS) readVolume(paddr uint64) (volume, error) {
+	data, err := f.readObject(paddr, objTypeFS)
+	if err != nil {
+		return volume{}, err
+	}
+	if magic := binary.LittleEndian.Uint32(data[32:36]); magic != apsbMagic {
+		return volume{}, f.corrupt("volume superblock", paddr, "bad magic %#x", magic)
+	}
+
+	v := volume{
+		incompat:    binary.LittleEndian.Uint64(data[56:64]),
+		rootTree:    binary.LittleEndian.Uint64(data[136:144]),
+		rootPhys:    binary.LittleEndian.Uint32(data[116:120])&objPhysical != 0,
+		numFiles:    binary.LittleEndian.Uint64(data[184:192]),
+		numDirs:     binary.LittleEndian.Uint64(data[192:200]),
+		numSymlinks: binary.LittleEndian.Uint64(data[200:208]),
+		snapTree:    binary.LittleEndian.Uint64(data[152:160]),
+		extentRefs:  binary.LittleEndian.Uint64(data[144:152]),
+		fsFlags:     binary.LittleEndian.Uint64(data[264:272]),
+		role:        binary.LittleEndian.Uint16(data[964:966]),
+	}
+	copy(v.uuid[:], data[240:256])
 
-// BlockSize returns the container block size
-func (f *FS) BlockSize() uint32 { return f.blockSize }
+	name := data[704:960]
+	if i := strings.IndexByte(string(name), 0); i >= 0 {
+		name = name[:i]
+	}
+	v.name = string(name)
+
+	omap, err := f.readObject(binary.LittleEndian.Uint64(data[128:136]), objTypeOmap)
+	if err != nil {
+		return volume{}, fmt.Errorf("reading volume object map: %w", err)
+	}
+	v.omapTree = binary.LittleEndian.Uint64(omap[48:56])
+
+	return v, nil
+}
+
+func (f *FS) Type() string            { return "APFS" }
+func (f *FS) Close() error            { return nil }
+func (f *FS) BaseReader() io.ReaderAt { return f.base }
+
+// Label returns the name of the volume
+func (f *FS) Label() string { return f.vol.name }
+
+// VolumeCount returns the number of volumes in the container
+func (f *FS) VolumeCount() int { return len(f.volumes) }
+
+// Volume opens another volume of the same container by index
+func (f *FS) Volume(index int) (fsys.FS, error) { return OpenVolume(f.base, f.size, index) }
+
+// BlockSize implements fsys.BlockSizer with the container block size
+func (f *FS) BlockSize() int64 { return int64(f.blockSize) }
 
 // BlockCount returns the total number of blocks
 func (f *FS) BlockCount() uint64 { return f.blockCount }
@@ -81,16 +367,61 @@ func (f *FS) UUID() [16]byte { return f.uuid }
 
 // Info returns filesystem information as a formatted string
 func (f *FS) Info() string {
-	uuid := f.uuid
-	return fmt.Sprintf("APFS Container\n"+
+	var b strings.Builder
+	fmt.Fprintf(&b, "APFS Container\n"+
 		"  Block size: %d bytes\n"+
 		"  Block count: %d\n"+
 		"  Container size: %d bytes (%.2f GB)\n"+
-		"  UUID: %08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
+		"  UUID: %s\n"+
+		"  Checkpoint XID: %d\n"+
+		"  Volumes: %d",
 		f.blockSize,
 		f.blockCount,
 		uint64(f.blockSize)*f.blockCount,
 		float64(uint64(f.blockSize)*f.blockCount)/(1024*1024*1024),
+		formatUUID(f.uuid),
+		f.xid,
+		len(f.volumes))
+
+	for i := range f.volumes {
+		v := &f.volumes[i]
+		marker := " "
+		if v == f.vol {
+			marker = "*"
+		}
+		fmt.Fprintf(&b, "\n  %s[%d] %q", marker, v.index, v.name)
+		if role := roleName(v.role); role != "" {
+			fmt.Fprintf(&b, " (%s)", role)
+		}
+		fmt.Fprintf(&b, "\n      UUID: %s\n      Files: %d, directories: %d, symlinks: %d",
+			formatUUID(v.uuid), v.numFiles, v.numDirs, v.numSymlinks)
+		if v.incompat&incompatCaseInsensitive != 0 {
+			b.WriteString("\n      Case-insensitive")
+		}
+		if v.encrypted() {
+			b.WriteString("\n      Encrypted")
+			continue
+		}
+
+		snaps, err := f.snapshots(v)
+		if err != nil {
+			fmt.Fprintf(&b, "\n      Snapshots: %v", err)
+			continue
+		}
+		if len(snaps) > 0 {
+			fmt.Fprintf(&b, "\n      Snapshots: %d", len(snaps))
+		}
+		for _, snap := range snaps {
+			fmt.Fprintf(&b, "\n        XID %-8d %s  %s", snap.XID, snap.CreateTime.UTC().Format("2006-01-02 15:04:05"), snap.Name)
+		}
+	}
+
+	return b.String()
+}
+
+// formatUUID formats a UUID in the usual 8-4-4-4-12 form
+func formatUUID(uuid [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
 		binary.BigEndian.Uint32(uuid[0:4]),
 		binary.BigEndian.Uint16(uuid[4:6]),
 		binary.BigEndian.Uint16(uuid[6:8]),
@@ -98,46 +429,1727 @@ func (f *FS) Info() string {
 		uuid[10], uuid[11], uuid[12], uuid[13], uuid[14], uuid[15])
 }
 
-var errNotImplemented = fmt.Errorf("APFS: not yet implemented")
+// roleName returns the name of a volume role (apfs_role)
+func roleName(role uint16) string {
+	switch role {
+	case 0x0001:
+		return "System"
+	case 0x0002:
+		return "User"
+	case 0x0004:
+		return "Recovery"
+	case 0x0008:
+		return "VM"
+	case 0x0010:
+		return "Preboot"
+	case 0x0020:
+		return "Installer"
+	case 0x0040:
+		return "Data"
+	case 0x0080:
+		return "Baseband"
+	case 0x00C0:
+		return "Update"
+	case 0x0100:
+		return "xART"
+	case 0x0140:
+		return "Hardware"
+	case 0x0180:
+		return "Backup"
+	default:
+		return ""
+	}
+}
+
+func (v *volume) encrypted() bool { return v.fsFlags&fsUnencrypted == 0 }
+
+// hashedNames reports whether directory record keys carry a name hash
+func (v *volume) hashedNames() bool {
+	return v.incompat&(incompatCaseInsensitive|incompatNormalizationInsensitive) != 0
+}
+
+// readBlock reads the block at physical address paddr
+func (f *FS) readBlock(paddr uint64) ([]byte, error) {
+	if f.blockCount != 0 && paddr >= f.blockCount {
+		return nil, fsys.Corrupt(fmt.Sprintf("block address %d", paddr), -1, "past the end of the container (%d blocks)", f.blockCount)
+	}
+	data := make([]byte, f.blockSize)
+	if _, err := f.r.ReadAt(data, int64(paddr)*int64(f.blockSize)); err != nil {
+		return nil, fmt.Errorf("reading block %d: %w", paddr, err)
+	}
+	return data, nil
+}
+
+// readObject reads the object at paddr, verifying its checksum and type
+func (f *FS) readObject(paddr uint64, objType uint32) ([]byte, error) {
+	data, err := f.readBlock(paddr)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyChecksum(data) {
+		return nil, f.corrupt("object", paddr, "bad checksum")
+	}
+	if t := binary.LittleEndian.Uint32(data[24:28]) & objTypeMask; t != objType {
+		return nil, f.corrupt("object", paddr, "type %#x, want %#x", t, objType)
+	}
+	return data, nil
+}
+
+// corrupt returns an ErrCorruptMetadata for the structure in block paddr
+func (f *FS) corrupt(structure string, paddr uint64, format string, args ...any) error {
+	return fsys.Corrupt(structure, int64(paddr)*int64(f.blockSize), format, args...)
+}
+
+// readEphemeral reads the ephemeral object oid of the current checkpoint.
+// Ephemeral objects live in the checkpoint data area; the checkpoint map
+// blocks in the descriptor area give their addresses and sizes.
+func (f *FS) readEphemeral(oid uint64, objType uint32) ([]byte, error) {
+	if f.descBlocks&0x80000000 != 0 {
+		return nil, fsys.Unsupported("APFS checkpoint descriptor B-trees")
+	}
+
+	for i := uint64(0); i < uint64(f.descBlocks); i++ {
+		data, err := f.readBlock(f.descBase + i)
+		if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(data[24:28])&objTypeMask != objTypeCheckpointMap ||
+			binary.LittleEndian.Uint64(data[16:24]) != f.xid || !verifyChecksum(data) {
+			continue
+		}
+
+		// checkpoint_map_phys_t: flags, count, then checkpoint_mapping_t entries
+		count := int(binary.LittleEndian.Uint32(data[36:40]))
+		for j := 0; j < count && 40+(j+1)*40 <= len(data); j++ {
+			m := data[40+j*40:]
+			if binary.LittleEndian.Uint64(m[24:32]) != oid {
+				continue
+			}
+			size := binary.LittleEndian.Uint32(m[8:12])
+			paddr := binary.LittleEndian.Uint64(m[32:40])
+			if size < f.blockSize || size%f.blockSize != 0 || size > 64*f.blockSize {
+				return nil, fsys.Corrupt(fmt.Sprintf("checkpoint mapping of object %d", oid), -1, "bad size %d", size)
+			}
+
+			obj := make([]byte, size)
+			if _, err := f.r.ReadAt(obj, int64(paddr)*int64(f.blockSize)); err != nil {
+				return nil, fmt.Errorf("reading ephemeral object %d: %w", oid, err)
+			}
+			if !verifyChecksum(obj) {
+				return nil, f.corrupt(fmt.Sprintf("ephemeral object %d", oid), paddr, "bad checksum")
+			}
+			if t := binary.LittleEndian.Uint32(obj[24:28]) & objTypeMask; t != objType {
+				return nil, f.corrupt(fmt.Sprintf("ephemeral object %d", oid), paddr, "type %#x, want %#x", t, objType)
+			}
+			return obj, nil
+		}
+	}
+	return nil, fsys.Corrupt(fmt.Sprintf("checkpoint %d", f.xid), -1, "no mapping for ephemeral object %d", oid)
+}
+
+// verifyChecksum checks the Fletcher-64 checksum stored in an object header
+func verifyChecksum(data []byte) bool {
+	return binary.LittleEndian.Uint64(data[0:8]) == fletcher64(data[8:])
+}
+
+// fletcher64 computes the APFS object checksum over data
+func fletcher64(data []byte) uint64 {
+	var sum1, sum2 uint64
+	for i := 0; i+4 <= len(data); i += 4 {
+		sum1 = (sum1 + uint64(binary.LittleEndian.Uint32(data[i:]))) % 0xFFFFFFFF
+		sum2 = (sum2 + sum1) % 0xFFFFFFFF
+	}
+	lo := 0xFFFFFFFF - (sum1+sum2)%0xFFFFFFFF
+	hi := 0xFFFFFFFF - (sum1+lo)%0xFFFFFFFF
+	return hi<<32 | lo
+}
+
+// btreeNode is a parsed B-tree node (btree_node_phys_t)
+type btreeNode struct {
+	paddr    uint64
+	data     []byte
+	flags    uint16
+	level    uint16
+	nkeys    int
+	tocStart int // Offset of the table of contents
+	keyStart int // Offset of the key area
+	valEnd   int // Offset the value area grows down from
+}
+
+// readNode reads and parses the B-tree node at paddr
+func (f *FS) readNode(paddr uint64) (*btreeNode, error) {
+	data, err := f.readBlock(paddr)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyChecksum(data) {
+		return nil, f.corrupt("B-tree node", paddr, "bad checksum")
+	}
+	if t := binary.LittleEndian.Uint32(data[24:28]) & objTypeMask; t != objTypeBtree && t != objTypeBtreeNode {
+		return nil, f.corrupt("B-tree node", paddr, "object type %#x is not a B-tree node", t)
+	}
+
+	n := &btreeNode{
+		paddr: paddr,
+		data:  data,
+		flags: binary.LittleEndian.Uint16(data[32:34]),
+		level: binary.LittleEndian.Uint16(data[34:36]),
+		nkeys: int(binary.LittleEndian.Uint32(data[36:40])),
+	}
+	tocOff := int(binary.LittleEndian.Uint16(data[40:42]))
+	tocLen := int(binary.LittleEndian.Uint16(data[42:44]))
+	n.tocStart = btreeNodeHeaderSize + tocOff
+	n.keyStart = n.tocStart + tocLen
+	n.valEnd = len(data)
+	if n.flags&btnodeRoot != 0 {
+		n.valEnd -= btreeInfoSize
+	}
+
+	entrySize := 8
+	if n.flags&btnodeFixedKVSize != 0 {
+		entrySize = 4
+	}
+	if n.keyStart > n.valEnd || n.nkeys*entrySize > tocLen {
+		return nil, f.corrupt("B-tree node", paddr, "table of contents overruns the node")
+	}
+	if (n.level == 0) != (n.flags&btnodeLeaf != 0) {
+		return nil, f.corrupt("B-tree node", paddr, "level %d inconsistent with flags %#x", n.level, n.flags)
+	}
+
+	return n, nil
+}
+
+// offset returns where the node is in the image
+func (n *btreeNode) offset() int64 {
+	return int64(n.paddr) * int64(len(n.data))
+}
+
+// entry returns the key and value of entry i. keySize and valSize give
+// the entry sizes for trees with fixed-size entries.
+func (n *btreeNode) entry(i, keySize, valSize int) (key, val []byte, err error) {
+	var kOff, kLen, vOff, vLen int
+	if n.flags&btnodeFixedKVSize != 0 {
+		e := n.data[n.tocStart+i*4:]
+		kOff = int(binary.LittleEndian.Uint16(e[0:2]))
+		vOff = int(binary.LittleEndian.Uint16(e[2:4]))
+		kLen, vLen = keySize, valSize
+		if n.level > 0 {
+			vLen = 8 // Index nodes hold child object IDs
+		}
+	} else {
+		e := n.data[n.tocStart+i*8:]
+		kOff = int(binary.LittleEndian.Uint16(e[0:2]))
+		kLen = int(binary.LittleEndian.Uint16(e[2:4]))
+		vOff = int(binary.LittleEndian.Uint16(e[4:6]))
+		vLen = int(binary.LittleEndian.Uint16(e[6:8]))
+	}
+
+	ks := n.keyStart + kOff
+	vs := n.valEnd - vOff
+	if ks+kLen > n.valEnd || vs < n.keyStart || vs+vLen > n.valEnd {
+		return nil, nil, fsys.Corrupt("B-tree node", n.offset(), "entry %d out of bounds", i)
+	}
+	return n.data[ks : ks+kLen], n.data[vs : vs+vLen], nil
+}
+
+// omapLookup resolves a virtual object ID to a physical address using the
+// object map B-tree rooted at tree, picking the newest mapping not newer
+// than xid
+func (f *FS) omapLookup(tree, oid, xid uint64) (uint64, error) {
+	paddr := tree
+	for depth := 0; depth < maxTreeDepth; depth++ {
+		node, err := f.readNode(paddr)
+		if err != nil {
+			return 0, err
+		}
+
+		// Keys are sorted by (oid, xid); find the last one not past ours
+		var val []byte
+		var keyOID uint64
+		for i := 0; i < node.nkeys; i++ {
+			key, v, err := node.entry(i, 16, 16)
+			if err != nil {
+				return 0, err
+			}
+			kOID := binary.LittleEndian.Uint64(key[0:8])
+			kXID := binary.LittleEndian.Uint64(key[8:16])
+			if kOID > oid || (kOID == oid && kXID > xid) {
+				break
+			}
+			val, keyOID = v, kOID
+		}
+		if val == nil {
+			break
+		}
+
+		if node.level == 0 {
+			if keyOID != oid || binary.LittleEndian.Uint32(val[0:4])&omapValDeleted != 0 {
+				break
+			}
+			return binary.LittleEndian.Uint64(val[8:16]), nil
+		}
+		paddr = binary.LittleEndian.Uint64(val[0:8])
+	}
+
+	return 0, fsys.Corrupt("object map", -1, "no mapping for object %d", oid)
+}
+
+// fsNode reads a node of a volume's file-system tree by object ID
+func (f *FS) fsNode(v *volume, oid uint64) (*btreeNode, error) {
+	paddr := oid
+	if !v.rootPhys {
+		var err error
+		if paddr, err = f.omapLookup(v.omapTree, oid, v.xid); err != nil {
+			return nil, err
+		}
+	}
+	return f.readNode(paddr)
+}
+
+// fsRecords calls fn with the key and value of every record in the
+// file-system tree of v that belongs to objID and has type typ, in key
+// order
+func (f *FS) fsRecords(v *volume, objID uint64, typ uint8, fn func(key, val []byte) error) error {
+	_, err := f.walkFSTree(v, v.rootTree, 0, objID, typ, fn)
+	return err
+}
+
+// walkFSTree visits the matching records in the subtree at oid. It
+// returns true once it has seen a key sorting after them.
+func (f *FS) walkFSTree(v *volume, oid uint64, depth int, objID uint64, typ uint8, fn func(key, val []byte) error) (bool, error) {
+	if depth >= maxTreeDepth {
+		return false, fsys.Corrupt("file-system tree", -1, "deeper than %d levels", maxTreeDepth)
+	}
+
+	node, err := f.fsNode(v, oid)
+	if err != nil {
+		return false, err
+	}
+
+	start := 0
+	if node.level > 0 {
+		// Matching records may begin in the last child whose first key
+		// sorts before them
+		for i := 0; i < node.nkeys; i++ {
+			key, _, err := node.entry(i, 0, 0)
+			if err != nil {
+				return false, err
+			}
+			if compareRecord(key, objID, typ) >= 0 {
+				break
+			}
+			start = i
+		}
+	}
+
+	for i := start; i < node.nkeys; i++ {
+		key, val, err := node.entry(i, 0, 0)
+		if err != nil {
+			return false, err
+		}
+		c := compareRecord(key, objID, typ)
+
+		if node.level == 0 {
+			if c < 0 {
+				continue
+			}
+			if c > 0 {
+				return true, nil
+			}
+			if err := fn(key, val); err != nil {
+				return true, err
+			}
+			continue
+		}
+
+		if c > 0 {
+			return true, nil
+		}
+		if len(val) < 8 {
+			return false, fsys.Corrupt("B-tree node", node.offset(), "short index entry")
+		}
+		done, err := f.walkFSTree(v, binary.LittleEndian.Uint64(val[0:8]), depth+1, objID, typ, fn)
+		if err != nil || done {
+			return done, err
+		}
+	}
+
+	return false, nil
+}
+
+// compareRecord compares the object ID and type of a file-system key (j_key_t)
+// with objID and typ
+func compareRecord(key []byte, objID uint64, typ uint8) int {
+	if len(key) < 8 {
+		return -1
+	}
+	hdr := binary.LittleEndian.Uint64(key[0:8])
+	kID, kType := hdr&objIDMask, uint8(hdr>>objTypeShift)
+	switch {
+	case kID < objID:
+		return -1
+	case kID > objID:
+		return 1
+	case kType < typ:
+		return -1
+	case kType > typ:
+		return 1
+	}
+	return 0
+}
+
+// inode holds the fields of an inode record (j_inode_val_t) we use
+type inode struct {
+	vol        *volume // Volume view the inode was read from
+	id         uint64
+	parentID   uint64
+	privateID  uint64 // Object ID of the data stream
+	createTime uint64 // Nanoseconds since 1970
+	modTime    uint64
+	changeTime uint64
+	accessTime uint64
+	nlink      uint32
+	bsdFlags   uint32
+	uid        uint32
+	gid        uint32
+	mode       uint16
+	size       uint64 // Logical size of the data stream
+	decmpfs    []byte // com.apple.decmpfs attribute of compressed files
+}
+
+// readInode reads the inode record for id in volume v
+func (f *FS) readInode(v *volume, id uint64) (*inode, error) {
+	var ino *inode
+	err := f.fsRecords(v, id, jTypeInode, func(key, val []byte) error {
+		if len(val) < 92 {
+			return fsys.Corrupt(fmt.Sprintf("inode %d", id), -1, "record too short")
+		}
+		ino = &inode{
+			vol:        v,
+			id:         id,
+			parentID:   binary.LittleEndian.Uint64(val[0:8]),
+			privateID:  binary.LittleEndian.Uint64(val[8:16]),
+			createTime: binary.LittleEndian.Uint64(val[16:24]),
+			modTime:    binary.LittleEndian.Uint64(val[24:32]),
+			changeTime: binary.LittleEndian.Uint64(val[32:40]),
+			accessTime: binary.LittleEndian.Uint64(val[40:48]),
+			nlink:      binary.LittleEndian.Uint32(val[56:60]),
+			bsdFlags:   binary.LittleEndian.Uint32(val[68:72]),
+			uid:        binary.LittleEndian.Uint32(val[72:76]),
+			gid:        binary.LittleEndian.Uint32(val[76:80]),
+			mode:       binary.LittleEndian.Uint16(val[80:82]),
+		}
+		ino.parseXfields(val[92:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ino == nil {
+		return nil, fs.ErrNotExist
+	}
+	if ino.bsdFlags&ufCompressed != 0 && ino.mode&0xF000 == 0x8000 {
+		if err := f.readDecmpfs(ino); err != nil {
+			return nil, fmt.Errorf("inode %d: %w", id, err)
+		}
+	}
+	return ino, nil
+}
+
+// parseXfields extracts the data stream size from an inode's extended
+// fields (xf_blob_t)
+func (ino *inode) parseXfields(blob []byte) {
+	if len(blob) < 4 {
+		return
+	}
+	n := int(binary.LittleEndian.Uint16(blob[0:2]))
+	dataOff := 4 + n*4
+	if dataOff > len(blob) {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		x := blob[4+i*4:]
+		xType, xSize := x[0], int(binary.LittleEndian.Uint16(x[2:4]))
+		if dataOff+xSize > len(blob) {
+			return
+		}
+		if xType == inoExtTypeDstream && xSize >= 8 {
+			ino.size = binary.LittleEndian.Uint64(blob[dataOff:])
+		}
+		dataOff += (xSize + 7) &^ 7 // Field data is 8-byte aligned
+	}
+}
+
+func (ino *inode) isDir() bool { return ino.mode&0xF000 == 0x4000 }
+
+// dirRecord is a parsed directory record (j_drec_val_t)
+type dirRecord struct {
+	name   string
+	fileID uint64
+	dtype  uint16
+}
+
+// readDirRecords returns the entries of directory parent in volume v sorted by name
+func (f *FS) readDirRecords(v *volume, parent uint64) ([]dirRecord, error) {
+	var records []dirRecord
+	err := f.fsRecords(v, parent, jTypeDirRec, func(key, val []byte) error {
+		name, err := drecName(v, key)
+		if err != nil {
+			return err
+		}
+		if len(val) < 18 {
+			return fsys.Corrupt(fmt.Sprintf("directory %d", parent), -1, "record for %q too short", name)
+		}
+		records = append(records, dirRecord{
+			name:   name,
+			fileID: binary.LittleEndian.Uint64(val[0:8]),
+			dtype:  binary.LittleEndian.Uint16(val[16:18]) & 0xF,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+	return records, nil
+}
+
+// drecName extracts the name from a directory record key. Keys carry a
+// name hash (j_drec_hashed_key_t) on case- or normalization-insensitive
+// volumes and only a length (j_drec_key_t) otherwise.
+func drecName(v *volume, key []byte) (string, error) {
+	var nameLen int
+	var name []byte
+	if v.hashedNames() {
+		if len(key) < 12 {
+			return "", fsys.Corrupt("directory record key", -1, "too short")
+		}
+		nameLen = int(binary.LittleEndian.Uint32(key[8:12]) & 0x3FF)
+		name = key[12:]
+	} else {
+		if len(key) < 10 {
+			return "", fsys.Corrupt("directory record key", -1, "too short")
+		}
+		nameLen = int(binary.LittleEndian.Uint16(key[8:10]))
+		name = key[10:]
+	}
+	if nameLen > len(name) {
+		return "", fsys.Corrupt("directory record key", -1, "name length %d exceeds the key", nameLen)
+	}
+	return strings.TrimRight(string(name[:nameLen]), "\x00"), nil
+}
+
+var (
+	errEncrypted   = fmt.Errorf("APFS: volume is %w", fsys.ErrEncrypted)
+	errNoVolume    = fmt.Errorf("APFS: container has no volumes")
+	errSnapshotDir = fmt.Errorf("APFS: %s is a virtual directory", snapshotDir)
+)
+
+// Snapshot describes a volume snapshot (j_snap_metadata_val_t)
+type Snapshot struct {
+	Name       string
+	XID        uint64
+	CreateTime time.Time
+	sblock     uint64 // Physical address of the volume superblock copy
+}
+
+// Snapshots returns the snapshots of the exposed volume, oldest first
+func (f *FS) Snapshots() ([]Snapshot, error) {
+	if f.vol == nil {
+		return nil, errNoVolume
+	}
+	return f.snapshots(f.vol)
+}
+
+// snapshots returns the snapshots of volume v, oldest first
+func (f *FS) snapshots(v *volume) ([]Snapshot, error) {
+	if v.snapTree == 0 {
+		return nil, nil
+	}
+
+	var snaps []Snapshot
+	err := f.walkPhysTree(v.snapTree, 0, func(key, val []byte) error {
+		if len(key) < 8 || uint8(binary.LittleEndian.Uint64(key[0:8])>>objTypeShift) != jTypeSnapMetadata {
+			return nil // Snapshot name records
+		}
+		if len(val) < 50 {
+			return fsys.Corrupt("snapshot metadata record", -1, "too short")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(val[48:50]))
+		if 50+nameLen > len(val) {
+			return fsys.Corrupt("snapshot metadata record", -1, "name length %d exceeds the record", nameLen)
+		}
+		snaps = append(snaps, Snapshot{
+			Name:       strings.TrimRight(string(val[50:50+nameLen]), "\x00"),
+			XID:        binary.LittleEndian.Uint64(key[0:8]) & objIDMask,
+			CreateTime: nsTime(binary.LittleEndian.Uint64(val[16:24])),
+			sblock:     binary.LittleEndian.Uint64(val[8:16]),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot metadata: %w", err)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].XID < snaps[j].XID })
+	return snaps, nil
+}
+
+// walkPhysTree calls fn for every record of the physical B-tree at paddr, in key order
+func (f *FS) walkPhysTree(paddr uint64, depth int, fn func(key, val []byte) error) error {
+	if depth >= maxTreeDepth {
+		return fsys.Corrupt("B-tree", -1, "deeper than %d levels", maxTreeDepth)
+	}
+
+	node, err := f.readNode(paddr)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < node.nkeys; i++ {
+		key, val, err := node.entry(i, 0, 0)
+		if err != nil {
+			return err
+		}
+		if node.level == 0 {
+			if err := fn(key, val); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(val) < 8 {
+			return fsys.Corrupt("B-tree node", node.offset(), "short index entry")
+		}
+		if err := f.walkPhysTree(binary.LittleEndian.Uint64(val[0:8]), depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotView returns the view of volume v as of snap, read from the
+// volume superblock copy the snapshot keeps
+func (f *FS) snapshotView(v *volume, snap Snapshot) (*volume, error) {
+	view, err := f.readVolume(snap.sblock)
+	if err != nil {
+		return nil, fmt.Errorf("reading superblock of snapshot %q: %w", snap.Name, err)
+	}
+	view.index = v.index
+	view.xid = snap.XID
+	return &view, nil
+}
+
+// snapshotVolume returns the view of the exposed volume as of the
+// snapshot with the given name or, failing that, the given XID
+func (f *FS) snapshotVolume(name string) (*volume, error) {
+	snaps, err := f.snapshots(f.vol)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snaps {
+		if snap.Name == name {
+			return f.snapshotView(f.vol, snap)
+		}
+	}
+	if xid, err := strconv.ParseUint(name, 10, 64); err == nil {
+		for _, snap := range snaps {
+			if snap.XID == xid {
+				return f.snapshotView(f.vol, snap)
+			}
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// AtSnapshot returns a filesystem exposing the volume as it was at the
+// snapshot with the given transaction ID
+func (f *FS) AtSnapshot(xid uint64) (*FS, error) {
+	snaps, err := f.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snaps {
+		if snap.XID == xid {
+			view, err := f.snapshotView(f.vol, snap)
+			if err != nil {
+				return nil, err
+			}
+			g := *f
+			g.vol = view
+			return &g, nil
+		}
+	}
+	return nil, fmt.Errorf("no snapshot with XID %d", xid)
+}
+
+// lookup resolves a path to its inode. Paths below snapshotDir resolve in
+// the named snapshot's view of the volume.
+func (f *FS) lookup(name string) (*inode, error) {
+	if f.vol == nil {
+		return nil, errNoVolume
+	}
+	if f.vol.encrypted() {
+		return nil, errEncrypted
+	}
+
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+
+	v := f.vol
+	if len(parts) > 0 && parts[0] == snapshotDir {
+		if len(parts) == 1 {
+			return nil, errSnapshotDir
+		}
+		var err error
+		if v, err = f.snapshotVolume(parts[1]); err != nil {
+			return nil, err
+		}
+		parts = parts[2:]
+	}
+
+	id := uint64(rootDirInode)
+	for _, part := range parts {
+		records, err := f.readDirRecords(v, id)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, r := range records {
+			if r.name == part || (v.incompat&incompatCaseInsensitive != 0 && strings.EqualFold(r.name, part)) {
+				id, found = r.fileID, true
+				break
+			}
+		}
+		if !found {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	return f.readInode(v, id)
+}
+
+// fileExtents returns the physical extents of an inode's data stream.
+// Holes (physical block 0) are left out and read back as zeros.
+func (f *FS) fileExtents(ino *inode) ([]fsys.Extent, error) {
+	var extents []fsys.Extent
+	blockSize := int64(f.blockSize)
+	size := int64(ino.size)
+
+	err := f.fsRecords(ino.vol, ino.privateID, jTypeFileExtent, func(key, val []byte) error {
+		if len(key) < 16 || len(val) < 16 {
+			return fsys.Corrupt(fmt.Sprintf("inode %d", ino.id), -1, "file extent record too short")
+		}
+		logical := int64(binary.LittleEndian.Uint64(key[8:16]))
+		length := int64(binary.LittleEndian.Uint64(val[0:8]) & fileExtentLenMask)
+		phys := binary.LittleEndian.Uint64(val[8:16])
+
+		if phys == 0 || logical >= size {
+			return nil
+		}
+		if logical+length > size {
+			length = size - logical
+		}
+		extents = append(extents, fsys.Extent{
+			Logical:  logical,
+			Physical: int64(phys) * blockSize,
+			Length:   length,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// FreeBlocks returns the free ranges of the container, read from the
+// allocation bitmaps of the space manager. Only the main device is
+// covered; the second tier of a Fusion container is not.
+func (f *FS) FreeBlocks() ([]fsys.Range, error) {
+	sm, err := f.readEphemeral(f.spaceman, objTypeSpaceman)
+	if err != nil {
+		return nil, fmt.Errorf("reading space manager: %w", err)
+	}
+
+	// spaceman_device_t of the main device
+	dev := sm[48:96]
+	blockCount := binary.LittleEndian.Uint64(dev[0:8])
+	cibCount := int(binary.LittleEndian.Uint32(dev[16:20]))
+	cabCount := int(binary.LittleEndian.Uint32(dev[20:24]))
+	addrOffset := int(binary.LittleEndian.Uint32(dev[32:36]))
+
+	// The device lists the chunk-info blocks directly, or, on large
+	// containers, blocks of chunk-info block addresses
+	n := cibCount
+	if cabCount > 0 {
+		n = cabCount
+	}
+	if addrOffset+8*n > len(sm) {
+		return nil, fsys.Corrupt("space manager", -1, "address table out of range")
+	}
+	var cibs []uint64
+	for i := 0; i < n; i++ {
+		addr := binary.LittleEndian.Uint64(sm[addrOffset+8*i:])
+		if cabCount == 0 {
+			cibs = append(cibs, addr)
+			continue
+		}
+		cab, err := f.readObject(addr, objTypeSpacemanCAB)
+		if err != nil {
+			return nil, fmt.Errorf("reading chunk-info address block: %w", err)
+		}
+		count := int(binary.LittleEndian.Uint32(cab[36:40]))
+		for j := 0; j < count && 40+(j+1)*8 <= len(cab); j++ {
+			cibs = append(cibs, binary.LittleEndian.Uint64(cab[40+j*8:]))
+		}
+	}
+
+	var ranges []fsys.Range
+	blockSize := int64(f.blockSize)
+	addFree := func(start, end uint64) {
+		if end > blockCount {
+			end = blockCount
+		}
+		if start >= end {
+			return
+		}
+		r := fsys.Range{Start: int64(start) * blockSize, End: int64(end) * blockSize}
+		if len(ranges) > 0 && ranges[len(ranges)-1].End == r.Start {
+			ranges[len(ranges)-1].End = r.End
+			return
+		}
+		ranges = append(ranges, r)
+	}
+
+	for _, addr := range cibs {
+		cib, err := f.readObject(addr, objTypeSpacemanCIB)
+		if err != nil {
+			return nil, fmt.Errorf("reading chunk-info block: %w", err)
+		}
+
+		// chunk_info_t entries: xid, first block, block count, free
+		// count and bitmap address (a set bit marks a used block)
+		count := int(binary.LittleEndian.Uint32(cib[36:40]))
+		for j := 0; j < count && 40+(j+1)*32 <= len(cib); j++ {
+			ci := cib[40+j*32:]
+			first := binary.LittleEndian.Uint64(ci[8:16])
+			nblocks := uint64(binary.LittleEndian.Uint32(ci[16:20]))
+			free := binary.LittleEndian.Uint32(ci[20:24])
+			bitmapAddr := binary.LittleEndian.Uint64(ci[24:32])
+
+			switch {
+			case free == 0:
+				continue
+			case bitmapAddr == 0:
+				// Chunks that were never allocated from have no bitmap
+				addFree(first, first+nblocks)
+				continue
+			}
+
+			bitmap, err := f.readBlock(bitmapAddr)
+			if err != nil {
+				return nil, fmt.Errorf("reading allocation bitmap: %w", err)
+			}
+			if nblocks > uint64(len(bitmap))*8 {
+				nblocks = uint64(len(bitmap)) * 8
+			}
+			for b := uint64(0); b < nblocks; b++ {
+				if bitmap[b/8]&(1<<(b%8)) == 0 {
+					addFree(first+b, first+b+1)
+				}
+			}
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return ranges, nil
+}
+
+// FileExtents returns the physical extents for a file
+func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "extents", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ino, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "extents", Path: name, Err: err}
+	}
+	if ino.isDir() {
+		return nil, fmt.Errorf("cannot get extents for directory")
+	}
+	if ino.decmpfs != nil {
+		return nil, fmt.Errorf("cannot get extents for compressed file")
+	}
+
+	extents, err := f.fileExtents(ino)
+	if err != nil {
+		return nil, err
+	}
+
+	var marked []fsys.Extent
+	for _, e := range extents {
+		parts, err := f.markShared(ino.vol, e)
+		if err != nil {
+			return nil, err
+		}
+		marked = append(marked, parts...)
+	}
+	return marked, nil
+}
+
+// markShared splits an extent at the boundaries of the physical extents
+// that other files also reference (clones, reference count above one)
+// and flags those parts as shared
+func (f *FS) markShared(v *volume, e fsys.Extent) ([]fsys.Extent, error) {
+	blockSize := int64(f.blockSize)
+	end := e.Physical + e.Length
+
+	var shared []fsys.Range
+	err := f.physExtents(v, uint64(e.Physical/blockSize), uint64((end+blockSize-1)/blockSize),
+		func(start, length uint64, refcnt int32) {
+			if refcnt > 1 {
+				shared = append(shared, fsys.Range{
+					Start: int64(start) * blockSize,
+					End:   int64(start+length) * blockSize,
+				})
+			}
+		})
+	if err != nil {
+		return nil, fmt.Errorf("reading extent references: %w", err)
+	}
+	if len(shared) == 0 {
+		return []fsys.Extent{e}, nil
+	}
+
+	var parts []fsys.Extent
+	add := func(start, stop int64, isShared bool) {
+		if start < stop {
+			parts = append(parts, fsys.Extent{
+				Logical:  e.Logical + start - e.Physical,
+				Physical: start,
+				Length:   stop - start,
+				Shared:   isShared,
+			})
+		}
+	}
+	pos := e.Physical
+	for _, r := range shared {
+		start, stop := max(r.Start, pos), min(r.End, end)
+		if start >= stop {
+			continue
+		}
+		add(pos, start, false)
+		add(start, stop, true)
+		pos = stop
+	}
+	add(pos, end, false)
+	return parts, nil
+}
+
+// physExtents calls fn for each record of v's extent reference tree
+// (j_phys_ext_val_t) overlapping blocks [lo, hi), in address order
+func (f *FS) physExtents(v *volume, lo, hi uint64, fn func(start, length uint64, refcnt int32)) error {
+	if v.extentRefs == 0 {
+		return nil
+	}
+	return f.walkPhysExtents(v.extentRefs, 0, lo, hi, fn)
+}
+
+// walkPhysExtents visits the records overlapping blocks [lo, hi) in the
+// subtree at paddr. Physical extents do not overlap, so the search starts
+// at the last key not past lo.
+func (f *FS) walkPhysExtents(paddr uint64, depth int, lo, hi uint64, fn func(start, length uint64, refcnt int32)) error {
+	if depth >= maxTreeDepth {
+		return fsys.Corrupt("extent reference tree", -1, "deeper than %d levels", maxTreeDepth)
+	}
+
+	node, err := f.readNode(paddr)
+	if err != nil {
+		return err
+	}
+
+	first := 0
+	for i := 0; i < node.nkeys; i++ {
+		key, _, err := node.entry(i, 0, 0)
+		if err != nil {
+			return err
+		}
+		if len(key) < 8 || binary.LittleEndian.Uint64(key)&objIDMask > lo {
+			break
+		}
+		first = i
+	}
+
+	for i := first; i < node.nkeys; i++ {
+		key, val, err := node.entry(i, 0, 0)
+		if err != nil {
+			return err
+		}
+		if len(key) < 8 {
+			return fsys.Corrupt("B-tree node", node.offset(), "short extent reference key")
+		}
+		start := binary.LittleEndian.Uint64(key) & objIDMask
+		if start >= hi {
+			break
+		}
+
+		if node.level > 0 {
+			if len(val) < 8 {
+				return fsys.Corrupt("B-tree node", node.offset(), "short index entry")
+			}
+			if err := f.walkPhysExtents(binary.LittleEndian.Uint64(val[0:8]), depth+1, lo, hi, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(val) < 20 {
+			return fsys.Corrupt("B-tree node", node.offset(), "short extent reference record")
+		}
+		length := binary.LittleEndian.Uint64(val[0:8]) & physExtentLenMask
+		if start+length > lo {
+			fn(start, length, int32(binary.LittleEndian.Uint32(val[16:20])))
+		}
+	}
+	return nil
+}
+
+// Transparent compression (decmpfs). A compressed file has an empty data
+// stream; its com.apple.decmpfs attribute holds a header and either the
+// whole compressed payload or a pointer to the com.apple.ResourceFork
+// attribute, which holds the payload in 64 KiB chunks.
+
+const (
+	decmpfsXattr      = "com.apple.decmpfs"
+	resourceForkXattr = "com.apple.ResourceFork"
+	decmpfsMagic      = 0x636D7066 // "fpmc" little-endian
+	decmpfsHeaderSize = 16
+	decmpfsChunkSize  = 64 * 1024
+
+	// Compression types; the resource fork variant follows each inline one
+	cmpZlibXattr  = 3
+	cmpZlibRsrc   = 4
+	cmpLZVNXattr  = 7
+	cmpLZVNRsrc   = 8
+	cmpRawXattr   = 9
+	cmpRawRsrc    = 10
+	cmpLZFSEXattr = 11
+	cmpLZFSERsrc  = 12
+
+	rsrcForkHeaderSize = 256
+)
+
+// xattr returns a reader over the value of extended attribute name of
+// object id, and its size
+func (f *FS) xattr(v *volume, id uint64, name string) (io.ReaderAt, int64, error) {
+	var r io.ReaderAt
+	var size int64
+	err := f.fsRecords(v, id, jTypeXattr, func(key, val []byte) error {
+		if r != nil || len(key) < 10 {
+			return nil
+		}
+		nameLen := int(binary.LittleEndian.Uint16(key[8:10]))
+		if 10+nameLen > len(key) || strings.TrimRight(string(key[10:10+nameLen]), "\x00") != name {
+			return nil
+		}
+		if len(val) < 4 {
+			return fsys.Corrupt("xattr "+name, -1, "record too short")
+		}
+		flags := binary.LittleEndian.Uint16(val[0:2])
+		xdata := val[4:]
+		if n := int(binary.LittleEndian.Uint16(val[2:4])); n < len(xdata) {
+			xdata = xdata[:n]
+		}
+
+		if flags&xattrDataStream == 0 {
+			r, size = bytes.NewReader(xdata), int64(len(xdata))
+			return nil
+		}
+
+		// j_xattr_dstream_t: the value lives in its own data stream
+		if len(xdata) < 16 {
+			return fsys.Corrupt("xattr "+name, -1, "data stream record too short")
+		}
+		stream := &inode{
+			vol:       v,
+			id:        id,
+			privateID: binary.LittleEndian.Uint64(xdata[0:8]),
+			size:      binary.LittleEndian.Uint64(xdata[8:16]),
+		}
+		extents, err := f.fileExtents(stream)
+		if err != nil {
+			return err
+		}
+		size = int64(stream.size)
+		r = fsys.NewExtentReaderAt(f.r, extents, size)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if r == nil {
+		return nil, 0, fs.ErrNotExist
+	}
+	return r, size, nil
+}
+
+// hiddenXattr reports whether an extended attribute of ino holds data
+// that is shown as the file itself, as macOS does not list those: the
+// target of a symlink, and the compressed data of a compressed file
+func hiddenXattr(ino *inode, name string) bool {
+	switch name {
+	case symlinkXattr, decmpfsXattr:
+		return true
+	case resourceForkXattr:
+		return ino.bsdFlags&ufCompressed != 0
+	}
+	return false
+}
+
+// ListXattr implements fsys.XattrFS
+func (f *FS) ListXattr(name string) ([]string, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == snapshotDir && f.vol != nil && !f.vol.encrypted() {
+		return nil, nil
+	}
+	ino, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	var names []string
+	err = f.fsRecords(ino.vol, ino.id, jTypeXattr, func(key, _ []byte) error {
+		if len(key) < 10 {
+			return nil
+		}
+		nameLen := int(binary.LittleEndian.Uint16(key[8:10]))
+		if 10+nameLen > len(key) {
+			return fsys.Corrupt(fmt.Sprintf("xattr of inode %d", ino.id), -1, "name overruns the key")
+		}
+		if n := strings.TrimRight(string(key[10:10+nameLen]), "\x00"); !hiddenXattr(ino, n) {
+			names = append(names, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetXattr implements fsys.XattrFS
+func (f *FS) GetXattr(name, attr string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == snapshotDir && f.vol != nil && !f.vol.encrypted() {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fsys.ErrNoXattr}
+	}
+	ino, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	if hiddenXattr(ino, attr) {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fsys.ErrNoXattr}
+	}
+	r, size, err := f.xattr(ino.vol, ino.id, attr)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fsys.ErrNoXattr
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	value := make([]byte, size)
+	if _, err := r.ReadAt(value, 0); err != nil && err != io.EOF {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	return value, nil
+}
+
+// readDecmpfs loads the decmpfs attribute of a compressed file and sets
+// the inode's size to the uncompressed size
+func (f *FS) readDecmpfs(ino *inode) error {
+	r, size, err := f.xattr(ino.vol, ino.id, decmpfsXattr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", decmpfsXattr, err)
+	}
+	if size < decmpfsHeaderSize || size > decmpfsChunkSize {
+		return fsys.Corrupt(fmt.Sprintf("%s of inode %d", decmpfsXattr, ino.id), -1, "bad size %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", decmpfsXattr, err)
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != decmpfsMagic {
+		return fsys.Corrupt(fmt.Sprintf("%s of inode %d", decmpfsXattr, ino.id), -1, "bad magic")
+	}
+	ino.decmpfs = buf
+	ino.size = binary.LittleEndian.Uint64(buf[8:16])
+	return nil
+}
+
+// compressedReader returns a reader over the uncompressed content of a
+// compressed file
+func (f *FS) compressedReader(ino *inode) (*decmpfsReader, error) {
+	typ := binary.LittleEndian.Uint32(ino.decmpfs[4:8])
+	d := &decmpfsReader{size: int64(ino.size), cached: -1}
+
+	switch typ {
+	case cmpZlibXattr, cmpLZVNXattr, cmpRawXattr, cmpLZFSEXattr:
+		payload := ino.decmpfs[decmpfsHeaderSize:]
+		d.src = bytes.NewReader(payload)
+		d.chunkSize = d.size
+		d.chunks = []fsys.Range{{Start: 0, End: int64(len(payload))}}
+
+	case cmpZlibRsrc, cmpLZVNRsrc, cmpRawRsrc, cmpLZFSERsrc:
+		r, size, err := f.xattr(ino.vol, ino.id, resourceForkXattr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", resourceForkXattr, err)
+		}
+		d.src = r
+		d.chunkSize = decmpfsChunkSize
+		nchunks := int((d.size + decmpfsChunkSize - 1) / decmpfsChunkSize)
+		if typ == cmpZlibRsrc {
+			d.chunks, err = zlibRsrcChunks(r, size, nchunks)
+		} else {
+			d.chunks, err = rsrcChunks(r, size, nchunks)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: %s: %w", ino.id, resourceForkXattr, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("inode %d: %w", ino.id, fsys.Unsupported("APFS compression type %d", typ))
+	}
+
+	switch typ {
+	case cmpZlibXattr, cmpZlibRsrc:
+		d.decode = decodeZlibChunk
+	case cmpLZVNXattr, cmpLZVNRsrc:
+		d.decode = decodeLZVNChunk
+	case cmpRawXattr, cmpRawRsrc:
+		d.decode = decodeRawChunk
+	case cmpLZFSEXattr, cmpLZFSERsrc:
+		d.decode = lzfse.Decode
+	}
+	return d, nil
+}
+
+// rsrcChunks reads the chunk table of an LZVN, LZFSE or uncompressed
+// resource fork: nchunks+1 little-endian offsets from the fork's start
+func rsrcChunks(r io.ReaderAt, size int64, nchunks int) ([]fsys.Range, error) {
+	table := make([]byte, 4*(nchunks+1))
+	if int64(len(table)) > size {
+		return nil, fsys.Corrupt("resource fork", -1, "chunk table truncated")
+	}
+	if _, err := r.ReadAt(table, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	chunks := make([]fsys.Range, nchunks)
+	for i := range chunks {
+		start := int64(binary.LittleEndian.Uint32(table[4*i:]))
+		end := int64(binary.LittleEndian.Uint32(table[4*i+4:]))
+		if start < int64(len(table)) || end < start || end > size {
+			return nil, fsys.Corrupt("resource fork", -1, "bad chunk %d at [%d, %d)", i, start, end)
+		}
+		chunks[i] = fsys.Range{Start: start, End: end}
+	}
+	return chunks, nil
+}
+
+// zlibRsrcChunks reads the chunk table of a zlib resource fork. It is a
+// classic resource fork: a big-endian header pointing at the data area,
+// which starts with a length, a chunk count and (offset, size) pairs
+// relative to the count.
+func zlibRsrcChunks(r io.ReaderAt, size int64, nchunks int) ([]fsys.Range, error) {
+	header := make([]byte, rsrcForkHeaderSize)
+	if size < rsrcForkHeaderSize {
+		return nil, fsys.Corrupt("resource fork", -1, "header truncated")
+	}
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	base := int64(binary.BigEndian.Uint32(header[0:4])) + 4
+
+	table := make([]byte, 4+8*nchunks)
+	if base+int64(len(table)) > size {
+		return nil, fsys.Corrupt("resource fork", -1, "chunk table truncated")
+	}
+	if _, err := r.ReadAt(table, base); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n := int(binary.LittleEndian.Uint32(table[0:4])); n != nchunks {
+		return nil, fsys.Corrupt("resource fork", -1, "%d chunks, want %d", n, nchunks)
+	}
+
+	chunks := make([]fsys.Range, nchunks)
+	for i := range chunks {
+		start := base + int64(binary.LittleEndian.Uint32(table[4+8*i:]))
+		end := start + int64(binary.LittleEndian.Uint32(table[8+8*i:]))
+		if end > size {
+			return nil, fsys.Corrupt("resource fork", -1, "bad chunk %d at [%d, %d)", i, start, end)
+		}
+		chunks[i] = fsys.Range{Start: start, End: end}
+	}
+	return chunks, nil
+}
+
+// storedChunk returns the n bytes following the marker byte of a chunk
+// that was stored uncompressed
+func storedChunk(chunk []byte, n int) ([]byte, error) {
+	if len(chunk)-1 < n {
+		return nil, fmt.Errorf("stored chunk has %d bytes, want %d", len(chunk)-1, n)
+	}
+	return chunk[1 : 1+n], nil
+}
+
+// decodeZlibChunk decompresses a zlib chunk; a low nibble of 0xF in the
+// first byte (never a valid zlib header) marks a stored chunk
+func decodeZlibChunk(chunk []byte, n int) ([]byte, error) {
+	if len(chunk) > 0 && chunk[0]&0x0F == 0x0F {
+		return storedChunk(chunk, n)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out := make([]byte, n)
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return nil, fmt.Errorf("zlib: %w", err)
+	}
+	return out, nil
+}
+
+// decodeLZVNChunk decompresses an LZVN chunk; a leading end-of-stream
+// opcode marks a stored chunk
+func decodeLZVNChunk(chunk []byte, n int) ([]byte, error) {
+	if len(chunk) > 0 && chunk[0] == 0x06 {
+		return storedChunk(chunk, n)
+	}
+	return lzfse.DecodeLZVN(chunk, n)
+}
+
+// decodeRawChunk returns an uncompressed chunk
+func decodeRawChunk(chunk []byte, n int) ([]byte, error) {
+	return storedChunk(chunk, n)
+}
+
+// decmpfsReader reads a compressed file, decompressing one chunk at a
+// time and keeping the last one
+type decmpfsReader struct {
+	src       io.ReaderAt
+	chunks    []fsys.Range // Compressed chunks within src
+	chunkSize int64        // Uncompressed size of every chunk but the last
+	size      int64
+	decode    func(chunk []byte, n int) ([]byte, error)
+
+	mu     sync.Mutex // Guards the cache
+	cached int
+	cache  []byte
+}
+
+// chunk returns uncompressed chunk i
+func (d *decmpfsReader) chunk(i int) ([]byte, error) {
+	d.mu.Lock()
+	if i == d.cached {
+		defer d.mu.Unlock()
+		return d.cache, nil
+	}
+	d.mu.Unlock()
+
+	n := d.chunkSize
+	if rest := d.size - int64(i)*d.chunkSize; rest < n {
+		n = rest
+	}
+
+	c := d.chunks[i]
+	buf := make([]byte, c.Size())
+	if _, err := d.src.ReadAt(buf, c.Start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	out, err := d.decode(buf, int(n))
+	if err != nil {
+		return nil, fsys.Corrupt(fmt.Sprintf("compressed chunk %d", i), -1, "%w", err)
+	}
+	if int64(len(out)) != n {
+		return nil, fsys.Corrupt(fmt.Sprintf("compressed chunk %d", i), -1, "decompressed to %d bytes, want %d", len(out), n)
+	}
+	d.mu.Lock()
+	d.cached, d.cache = i, out
+	d.mu.Unlock()
+	return out, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (d *decmpfsReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	total := 0
+	for total < len(p) && off < d.size {
+		i := int(off / d.chunkSize)
+		if i >= len(d.chunks) {
+			return total, fmt.Errorf("offset %d beyond last chunk", off)
+		}
+		data, err := d.chunk(i)
+		if err != nil {
+			return total, err
+		}
+		n := copy(p[total:], data[off-int64(i)*d.chunkSize:])
+		total += n
+		off += int64(n)
+	}
+	if total < len(p) {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+// fs.FS implementation
 
 // Open implements fs.FS
 func (f *FS) Open(name string) (fs.File, error) {
-	if name == "." {
-		return &apfsRoot{fs: f}, nil
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
-	return nil, &fs.PathError{Op: "open", Path: name, Err: errNotImplemented}
+
+	if name == snapshotDir && f.vol != nil && !f.vol.encrypted() {
+		return &apfsDir{fs: f, inode: f.snapshotDirInode(), name: snapshotDir, snapshots: true}, nil
+	}
+
+	ino, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if ino.isDir() {
+		return &apfsDir{fs: f, inode: ino, name: path.Base(name)}, nil
+	}
+	return &apfsFile{fs: f, inode: ino, name: path.Base(name)}, nil
 }
 
 // ReadDir implements fs.ReadDirFS
 func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotImplemented}
+	return fsys.ReadDirFile(f, name)
 }
 
 // Stat implements fs.StatFS
 func (f *FS) Stat(name string) (fs.FileInfo, error) {
-	if name == "." {
-		return &apfsRootInfo{fs: f}, nil
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// symlinkXattr holds the target of a symlink, NUL-terminated
+const symlinkXattr = "com.apple.fs.symlink"
+
+// ReadLink implements fsys.Symlinker
+func (f *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	ino, err := f.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if ino.mode&0xF000 != 0xA000 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	r, size, err := f.xattr(ino.vol, ino.id, symlinkXattr)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	target := make([]byte, size)
+	if _, err := r.ReadAt(target, 0); err != nil && err != io.EOF {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return strings.TrimRight(string(target), "\x00"), nil
+}
+
+// Lstat implements fsys.Symlinker; Stat does not follow symlinks either
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	return f.Stat(name)
+}
+
+// apfsFile implements fs.File for regular files, reading through the
+// file's extents, or decompressing it, on demand
+type apfsFile struct {
+	fs     *FS
+	inode  *inode
+	name   string
+	mu     sync.Mutex // Guards reader, so that ReadAt can be concurrent
+	reader io.ReaderAt
+	offset int64
+}
+
+func (f *apfsFile) Stat() (fs.FileInfo, error) {
+	return &apfsFileInfo{inode: f.inode, name: f.name}, nil
+}
+
+// dataReader returns the reader over the file's content, setting it up on first use
+func (f *apfsFile) dataReader() (io.ReaderAt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader != nil {
+		return f.reader, nil
+	}
+	if f.inode.decmpfs != nil {
+		r, err := f.fs.compressedReader(f.inode)
+		if err != nil {
+			return nil, err
+		}
+		f.reader = r
+		return r, nil
+	}
+	extents, err := f.fs.fileExtents(f.inode)
+	if err != nil {
+		return nil, err
+	}
+	f.reader = fsys.NewExtentReaderAt(f.fs.r, extents, int64(f.inode.size))
+	return f.reader, nil
+}
+
+func (f *apfsFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (f *apfsFile) ReadAt(b []byte, off int64) (int, error) {
+	r, err := f.dataReader()
+	if err != nil {
+		return 0, err
 	}
-	return nil, &fs.PathError{Op: "stat", Path: name, Err: errNotImplemented}
+	return r.ReadAt(b, off)
+}
+
+func (f *apfsFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reader = nil
+	return nil
+}
+
+// snapshotDirInode returns the synthetic inode of the snapshot directory
+func (f *FS) snapshotDirInode() *inode {
+	return &inode{vol: f.vol, mode: 0x4000 | 0555}
+}
+
+// apfsDir implements fs.File and fs.ReadDirFile for directories
+type apfsDir struct {
+	fs        *FS
+	inode     *inode
+	name      string
+	snapshots bool // The virtual snapshot directory
+	entries   []fs.DirEntry
+	offset    int
 }
 
-// apfsRoot represents the root directory
-type apfsRoot struct {
-	fs *FS
+func (d *apfsDir) Stat() (fs.FileInfo, error) {
+	return &apfsFileInfo{inode: d.inode, name: d.name}, nil
+}
+
+func (d *apfsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *apfsDir) Close() error {
+	d.entries = nil
+	return nil
+}
+
+func (d *apfsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n <= 0 {
+		entries := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return entries, nil
+	}
+
+	if d.offset >= len(d.entries) {
+		return nil, io.EOF
+	}
+
+	end := d.offset + n
+	if end > len(d.entries) {
+		end = len(d.entries)
+	}
+
+	entries := d.entries[d.offset:end]
+	d.offset = end
+	return entries, nil
 }
 
-func (r *apfsRoot) Stat() (fs.FileInfo, error) { return &apfsRootInfo{fs: r.fs}, nil }
-func (r *apfsRoot) Read([]byte) (int, error)   { return 0, errNotImplemented }
-func (r *apfsRoot) Close() error               { return nil }
+// load reads the directory entries. The live root also lists the
+// snapshot directory when the volume has snapshots.
+func (d *apfsDir) load() error {
+	if d.snapshots {
+		snaps, err := d.fs.snapshots(d.fs.vol)
+		if err != nil {
+			return err
+		}
+		d.entries = make([]fs.DirEntry, 0, len(snaps))
+		for _, snap := range snaps {
+			view, err := d.fs.snapshotView(d.fs.vol, snap)
+			if err != nil {
+				return err
+			}
+			d.entries = append(d.entries, &apfsDirEntry{
+				fs:     d.fs,
+				vol:    view,
+				record: dirRecord{name: snap.Name, fileID: rootDirInode, dtype: dtDir},
+			})
+		}
+		return nil
+	}
+
+	records, err := d.fs.readDirRecords(d.inode.vol, d.inode.id)
+	if err != nil {
+		return err
+	}
 
-// apfsRootInfo provides FileInfo for root
-type apfsRootInfo struct {
-	fs *FS
+	d.entries = make([]fs.DirEntry, 0, len(records)+1)
+	for _, r := range records {
+		d.entries = append(d.entries, &apfsDirEntry{fs: d.fs, vol: d.inode.vol, record: r})
+	}
+
+	if d.inode.vol == d.fs.vol && d.inode.id == rootDirInode {
+		snaps, err := d.fs.snapshots(d.fs.vol)
+		if err != nil {
+			return err
+		}
+		if len(snaps) > 0 {
+			d.entries = append(d.entries, &apfsDirEntry{
+				fs:     d.fs,
+				record: dirRecord{name: snapshotDir, dtype: dtDir},
+			})
+			sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+		}
+	}
+	return nil
 }
 
-func (i *apfsRootInfo) Name() string       { return "." }
-func (i *apfsRootInfo) Size() int64        { return 0 }
-func (i *apfsRootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
-func (i *apfsRootInfo) ModTime() time.Time { return time.Time{} }
-func (i *apfsRootInfo) IsDir() bool        { return true }
-func (i *apfsRootInfo) Sys() any           { return nil }
+// apfsDirEntry implements fs.DirEntry
+type apfsDirEntry struct {
+	fs     *FS
+	vol    *volume // Volume view the entry belongs to; nil for the snapshot directory
+	record dirRecord
+}
+
+func (e *apfsDirEntry) Name() string { return e.record.name }
+func (e *apfsDirEntry) IsDir() bool  { return e.record.dtype == dtDir }
+func (e *apfsDirEntry) Type() fs.FileMode {
+	switch e.record.dtype {
+	case dtDir:
+		return fs.ModeDir
+	case dtSymlink:
+		return fs.ModeSymlink
+	default:
+		return 0
+	}
+}
+
+func (e *apfsDirEntry) Info() (fs.FileInfo, error) {
+	if e.vol == nil {
+		return &apfsFileInfo{inode: e.fs.snapshotDirInode(), name: snapshotDir}, nil
+	}
+	ino, err := e.fs.readInode(e.vol, e.record.fileID)
+	if err != nil {
+		return nil, err
+	}
+	return &apfsFileInfo{inode: ino, name: e.record.name}, nil
+}
+
+// nsTime converts an APFS timestamp (nanoseconds since 1970), zero if unset
+func nsTime(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns))
+}
+
+// apfsFileInfo implements fs.FileInfo
+type apfsFileInfo struct {
+	inode *inode
+	name  string
+}
+
+func (i *apfsFileInfo) Name() string { return i.name }
+func (i *apfsFileInfo) Size() int64 {
+	if i.inode.isDir() {
+		return 0
+	}
+	return int64(i.inode.size)
+}
+func (i *apfsFileInfo) ModTime() time.Time    { return nsTime(i.inode.modTime) }
+func (i *apfsFileInfo) BirthTime() time.Time  { return nsTime(i.inode.createTime) }
+func (i *apfsFileInfo) AccessTime() time.Time { return nsTime(i.inode.accessTime) }
+func (i *apfsFileInfo) ChangeTime() time.Time { return nsTime(i.inode.changeTime) }
+func (i *apfsFileInfo) IsDir() bool           { return i.inode.isDir() }
+func (i *apfsFileInfo) Inode() uint64         { return i.inode.id }
+
+// Attributes is the APFS metadata of a file that fs.FileInfo has no place
+// for, returned by the Sys method of its FileInfo
+type Attributes struct {
+	ParentID   uint64 // Inode number of the directory the file is in
+	BSDFlags   uint32 // chflags flags, such as 0x02 immutable, 0x20 compressed and 0x8000 hidden
+	Compressed bool   // Whether the data is compressed with decmpfs
+}
+
+// Sys returns the file's *Attributes
+func (i *apfsFileInfo) Sys() any {
+	return &Attributes{ParentID: i.inode.parentID, BSDFlags: i.inode.bsdFlags, Compressed: i.inode.decmpfs != nil}
+}
+
+func (i *apfsFileInfo) Owner() (user, group string) {
+	return strconv.FormatUint(uint64(i.inode.uid), 10), strconv.FormatUint(uint64(i.inode.gid), 10)
+}
+
+// Links returns the link count of a file. Directories keep their number
+// of children in its place, so they report 0.
+func (i *apfsFileInfo) Links() uint64 {
+	if i.inode.isDir() {
+		return 0
+	}
+	return uint64(i.inode.nlink)
+}
+
+func (i *apfsFileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(i.inode.mode & 0777)
+	switch i.inode.mode & 0xF000 {
+	case 0x4000:
+		mode |= fs.ModeDir
+	case 0xA000:
+		mode |= fs.ModeSymlink
+	case 0x6000:
+		mode |= fs.ModeDevice
+	case 0x2000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x1000:
+		mode |= fs.ModeNamedPipe
+	case 0xC000:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
@@ -0,0 +1,292 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// omapLeaf builds a root leaf node of an object map B-tree holding the
+// given (oid, xid) -> paddr mappings, which must be sorted
+func omapLeaf(blockSize int, mappings [][3]uint64) []byte {
+	b := make([]byte, blockSize)
+	binary.LittleEndian.PutUint32(b[24:28], objPhysical|objTypeBtree)
+	binary.LittleEndian.PutUint16(b[32:34], btnodeRoot|btnodeLeaf|btnodeFixedKVSize)
+	binary.LittleEndian.PutUint32(b[36:40], uint32(len(mappings)))
+	binary.LittleEndian.PutUint16(b[42:44], uint16(len(mappings)*4))
+
+	keyStart := btreeNodeHeaderSize + len(mappings)*4
+	valEnd := blockSize - btreeInfoSize
+	for i, m := range mappings {
+		kOff, vOff := i*16, (i+1)*16
+		binary.LittleEndian.PutUint16(b[btreeNodeHeaderSize+i*4:], uint16(kOff))
+		binary.LittleEndian.PutUint16(b[btreeNodeHeaderSize+i*4+2:], uint16(vOff))
+		binary.LittleEndian.PutUint64(b[keyStart+kOff:], m[0])
+		binary.LittleEndian.PutUint64(b[keyStart+kOff+8:], m[1])
+		binary.LittleEndian.PutUint64(b[valEnd-vOff+8:], m[2])
+	}
+
+	binary.LittleEndian.PutUint64(b[0:8], fletcher64(b[8:]))
+	return b
+}
+
+func TestOmapLookup(t *testing.T) {
+	const blockSize = 4096
+	image := make([]byte, 2*blockSize)
+	copy(image[blockSize:], omapLeaf(blockSize, [][3]uint64{
+		{5, 3, 100},
+		{5, 6, 200},
+		{7, 1, 300},
+	}))
+	f := &FS{r: bytes.NewReader(image), blockSize: blockSize, blockCount: 2}
+
+	tests := []struct {
+		oid, xid uint64
+		want     uint64 // 0 if not found
+	}{
+		{5, 3, 100},
+		{5, 4, 100},
+		{5, 6, 200},
+		{5, 10, 200},
+		{5, 2, 0},
+		{4, 10, 0},
+		{6, 10, 0},
+		{7, 10, 300},
+	}
+	for _, tt := range tests {
+		got, err := f.omapLookup(1, tt.oid, tt.xid)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("omapLookup(%d, %d) = %d, want not found", tt.oid, tt.xid, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("omapLookup(%d, %d) = %d, %v, want %d", tt.oid, tt.xid, got, err, tt.want)
+		}
+	}
+}
+
+func TestOmapLookupBadChecksum(t *testing.T) {
+	const blockSize = 4096
+	image := make([]byte, 2*blockSize)
+	copy(image[blockSize:], omapLeaf(blockSize, [][3]uint64{{5, 3, 100}}))
+	image[blockSize+100] ^= 0xFF
+	f := &FS{r: bytes.NewReader(image), blockSize: blockSize, blockCount: 2}
+
+	if _, err := f.omapLookup(1, 5, 3); err == nil {
+		t.Errorf("omapLookup on corrupted node succeeded")
+	}
+}
+
+// putObject writes the header of an object of objType from transaction
+// xid at block paddr of image, over the body already there, with its
+// checksum
+func putObject(image []byte, blockSize int, paddr uint64, objType uint32, xid uint64) {
+	b := image[int(paddr)*blockSize:][:blockSize]
+	binary.LittleEndian.PutUint64(b[8:16], paddr)
+	binary.LittleEndian.PutUint64(b[16:24], xid)
+	binary.LittleEndian.PutUint32(b[24:28], objType)
+	binary.LittleEndian.PutUint64(b[0:8], fletcher64(b[8:]))
+}
+
+// spacemanImage builds a 40-block container whose checkpoint at
+// transaction 5 maps the space manager, object 1024, to block 3. The main
+// device's chunk-info block, at block 4, is listed by the space manager
+// or, with cab, by a chunk-info address block at block 6. The first chunk
+// of 32 blocks has blocks 10-12 and 20-21 free in its bitmap at block 5;
+// the second has never been allocated from and has no bitmap.
+func spacemanImage(blockSize int, cab bool) []byte {
+	image := make([]byte, 40*blockSize)
+	block := func(paddr int) []byte { return image[paddr*blockSize:][:blockSize] }
+
+	// An old checkpoint's map, with the space manager elsewhere, then the
+	// current one
+	for i, m := range [][2]uint64{{4, 30}, {5, 3}} {
+		cpm := block(1 + i)
+		binary.LittleEndian.PutUint32(cpm[36:40], 1)
+		binary.LittleEndian.PutUint32(cpm[40+8:], uint32(blockSize))
+		binary.LittleEndian.PutUint64(cpm[40+24:], 1024)
+		binary.LittleEndian.PutUint64(cpm[40+32:], m[1])
+		putObject(image, blockSize, uint64(1+i), objTypeCheckpointMap, m[0])
+	}
+
+	sm := block(3)
+	binary.LittleEndian.PutUint64(sm[48:56], 40)
+	binary.LittleEndian.PutUint32(sm[48+32:], 400)
+	if cab {
+		binary.LittleEndian.PutUint32(sm[48+20:], 1)
+		binary.LittleEndian.PutUint64(sm[400:], 6)
+		binary.LittleEndian.PutUint32(block(6)[36:40], 1)
+		binary.LittleEndian.PutUint64(block(6)[40:], 4)
+		putObject(image, blockSize, 6, objTypeSpacemanCAB, 5)
+	} else {
+		binary.LittleEndian.PutUint32(sm[48+16:], 1)
+		binary.LittleEndian.PutUint64(sm[400:], 4)
+	}
+	putObject(image, blockSize, 3, objTypeSpaceman, 5)
+
+	cib := block(4)
+	binary.LittleEndian.PutUint32(cib[36:40], 3)
+	for i, ci := range [][4]uint64{
+		{0, 32, 5, 5},    // First block, blocks, free blocks, bitmap
+		{32, 32, 32, 0},  // Past the end of the device from block 40
+		{64, 32, 0, 999}, // Full, so its bitmap is not read
+	} {
+		c := cib[40+32*i:]
+		binary.LittleEndian.PutUint64(c[8:16], ci[0])
+		binary.LittleEndian.PutUint32(c[16:20], uint32(ci[1]))
+		binary.LittleEndian.PutUint32(c[20:24], uint32(ci[2]))
+		binary.LittleEndian.PutUint64(c[24:32], ci[3])
+	}
+	putObject(image, blockSize, 4, objTypeSpacemanCIB, 5)
+
+	bitmap := block(5)
+	for b := range 32 {
+		if !(b >= 10 && b < 13 || b >= 20 && b < 22) {
+			bitmap[b/8] |= 1 << (b % 8)
+		}
+	}
+	return image
+}
+
+func TestFreeBlocks(t *testing.T) {
+	const blockSize = 4096
+	want := fmt.Sprint([]fsys.Range{{Start: 10 * blockSize, End: 13 * blockSize}, {Start: 20 * blockSize, End: 22 * blockSize}, {Start: 32 * blockSize, End: 40 * blockSize}})
+	for _, cab := range []bool{false, true} {
+		image := spacemanImage(blockSize, cab)
+		f := &FS{r: bytes.NewReader(image), blockSize: blockSize, blockCount: 40, xid: 5, descBase: 1, descBlocks: 2, spaceman: 1024}
+		free, err := f.FreeBlocks()
+		if err != nil {
+			t.Errorf("cab %v: %v", cab, err)
+			continue
+		}
+		if got := fmt.Sprint(free); got != want {
+			t.Errorf("cab %v: FreeBlocks = %s, want %s", cab, got, want)
+		}
+	}
+
+	// A checkpoint without the space manager, and a damaged chunk-info block
+	image := spacemanImage(blockSize, false)
+	f := &FS{r: bytes.NewReader(image), blockSize: blockSize, blockCount: 40, xid: 6, descBase: 1, descBlocks: 2, spaceman: 1024}
+	var corrupt *fsys.ErrCorruptMetadata
+	if _, err := f.FreeBlocks(); !errors.As(err, &corrupt) {
+		t.Errorf("FreeBlocks of checkpoint 6 = %v, want corrupt metadata", err)
+	}
+	image[4*blockSize+100] ^= 0xFF
+	f.xid = 5
+	if _, err := f.FreeBlocks(); !errors.As(err, &corrupt) {
+		t.Errorf("FreeBlocks with a bad chunk-info block = %v, want corrupt metadata", err)
+	}
+}
+
+// extentRefNode builds a node of an extent reference tree at level, with
+// variable-size entries. Each record is a starting block and, in a leaf,
+// the extent's length in blocks and reference count or, in an index node,
+// the child's physical address.
+func extentRefNode(blockSize, level int, root bool, records [][3]uint64) []byte {
+	b := make([]byte, blockSize)
+	objType, flags := uint32(objPhysical|objTypeBtreeNode), uint16(0)
+	valEnd := blockSize
+	if root {
+		objType, flags = objPhysical|objTypeBtree, btnodeRoot
+		valEnd -= btreeInfoSize
+	}
+	if level == 0 {
+		flags |= btnodeLeaf
+	}
+	binary.LittleEndian.PutUint32(b[24:28], objType)
+	binary.LittleEndian.PutUint16(b[32:34], flags)
+	binary.LittleEndian.PutUint16(b[34:36], uint16(level))
+	binary.LittleEndian.PutUint32(b[36:40], uint32(len(records)))
+	binary.LittleEndian.PutUint16(b[42:44], uint16(len(records)*8))
+
+	keyStart := btreeNodeHeaderSize + len(records)*8
+	vOff := 0
+	for i, r := range records {
+		vLen := 20
+		if level > 0 {
+			vLen = 8
+		}
+		vOff += vLen
+		toc := b[btreeNodeHeaderSize+i*8:]
+		binary.LittleEndian.PutUint16(toc[0:2], uint16(i*8))
+		binary.LittleEndian.PutUint16(toc[2:4], 8)
+		binary.LittleEndian.PutUint16(toc[4:6], uint16(vOff))
+		binary.LittleEndian.PutUint16(toc[6:8], uint16(vLen))
+		// Keys carry the record type in their top bits, as do lengths
+		// their kind
+		binary.LittleEndian.PutUint64(b[keyStart+i*8:], r[0]|2<<objTypeShift)
+		val := b[valEnd-vOff:]
+		if level > 0 {
+			binary.LittleEndian.PutUint64(val[0:8], r[1])
+			continue
+		}
+		binary.LittleEndian.PutUint64(val[0:8], r[1]|1<<objTypeShift)
+		binary.LittleEndian.PutUint64(val[8:16], 77)
+		binary.LittleEndian.PutUint32(val[16:20], uint32(r[2]))
+	}
+
+	binary.LittleEndian.PutUint64(b[0:8], fletcher64(b[8:]))
+	return b
+}
+
+func TestMarkShared(t *testing.T) {
+	const blockSize = 4096
+	// A root index at block 1 over leaves at blocks 2 and 3. Blocks
+	// 110-114 are shared with a clone, as are 200-219.
+	image := make([]byte, 4*blockSize)
+	copy(image[1*blockSize:], extentRefNode(blockSize, 1, true, [][3]uint64{{100, 2}, {200, 3}}))
+	copy(image[2*blockSize:], extentRefNode(blockSize, 0, false, [][3]uint64{{100, 10, 1}, {110, 5, 2}}))
+	copy(image[3*blockSize:], extentRefNode(blockSize, 0, false, [][3]uint64{{200, 20, 3}}))
+	f := &FS{r: bytes.NewReader(image), blockSize: blockSize, blockCount: 4}
+
+	// ext builds an extent from logical and physical blocks and a length
+	// in blocks
+	ext := func(logical, physical, length int64, shared bool) fsys.Extent {
+		return fsys.Extent{Logical: logical * blockSize, Physical: physical * blockSize, Length: length * blockSize, Shared: shared}
+	}
+	tests := []struct {
+		name       string
+		extentRefs uint64
+		e          fsys.Extent
+		want       []fsys.Extent
+	}{
+		{"no tree", 0, ext(0, 110, 5, false), []fsys.Extent{ext(0, 110, 5, false)}},
+		{"unshared", 1, ext(0, 100, 10, false), []fsys.Extent{ext(0, 100, 10, false)}},
+		{"past the tree", 1, ext(0, 300, 10, false), []fsys.Extent{ext(0, 300, 10, false)}},
+		{"all shared", 1, ext(8, 111, 3, false), []fsys.Extent{ext(8, 111, 3, true)}},
+		{"across both leaves", 1, ext(1, 105, 100, false), []fsys.Extent{
+			ext(1, 105, 5, false),
+			ext(6, 110, 5, true),
+			ext(11, 115, 85, false),
+			ext(96, 200, 5, true),
+		}},
+		// A partial last block still counts as shared
+		{"unaligned", 1, fsys.Extent{Physical: 112 * blockSize, Length: 3*blockSize - 100}, []fsys.Extent{
+			{Physical: 112 * blockSize, Length: 3*blockSize - 100, Shared: true},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := f.markShared(&volume{extentRefs: tt.extentRefs}, tt.e)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: markShared = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A damaged leaf is reported, not taken as unshared
+	image[3*blockSize+100] ^= 0xFF
+	var corrupt *fsys.ErrCorruptMetadata
+	if _, err := f.markShared(&volume{extentRefs: 1}, ext(0, 190, 20, false)); !errors.As(err, &corrupt) {
+		t.Errorf("markShared with a damaged leaf = %v, want a corrupt metadata error", err)
+	}
+}
@@ -2,14 +2,19 @@
 package ext
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/fs"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
 )
 
@@ -19,19 +24,29 @@ const (
 	extMagic         = 0xEF53
 
 	// Inode flags
-	inodeFlagExtents = 0x00080000
+	inodeFlagEncrypt    = 0x00000800
+	inodeFlagExtents    = 0x00080000
+	inodeFlagInlineData = 0x10000000
+
+	// Block group flags
+	bgBlockUninit = 0x0002
 
 	// Feature flags
+	featureIncompatRecover = 0x0004 // needs_recovery: the journal is to be replayed
 	featureIncompatExtents = 0x0040
 	featureIncompat64Bit   = 0x0080
+	featureROCompatBigalloc = 0x0200
 	featureCompatHasJournal = 0x0004
+	featureCompatSparseSuper2 = 0x0200
 )
 
 // FS implements a read-only ext2/3/4 filesystem
 type FS struct {
-	r         io.ReaderAt
+	r         io.ReaderAt // The image, through the block cache
+	base      io.ReaderAt
 	size      int64
 	sb        superblock
+	sbGroup   uint32 // block group holding the superblock copy in use (0 = primary)
 	blockSize uint32
 	typ       string
 }
@@ -80,17 +95,24 @@ type blockGroupDescriptor struct {
 	freeBlocksCount uint32
 	freeInodesCount uint32
 	usedDirsCount   uint32
+	flags           uint16
 }
 
 type inode struct {
 	mode        uint16
-	uid         uint16
+	uid         uint32
 	size        uint64
 	atime       uint32
 	ctime       uint32
 	mtime       uint32
 	dtime       uint32
-	gid         uint16
+	crtime      uint32 // 0 if the inode has no room for it
+	// Nanoseconds and epoch bits of the times, in large inodes
+	atimeExtra  uint32
+	ctimeExtra  uint32
+	mtimeExtra  uint32
+	crtimeExtra uint32
+	gid         uint32
 	linksCount  uint16
 	blocks      uint64
 	flags       uint32
@@ -98,39 +120,145 @@ type inode struct {
 	generation  uint32
 	fileACL     uint64
 	dirACL      uint32
+	offset      int64 // Where the inode is stored
+}
+
+// backupGroups lists the block groups that hold backup superblocks when
+// the sparse_super feature is enabled (1 and powers of 3, 5 and 7).
+// Without sparse_super every group has a copy, so these are valid either way.
+var backupGroups = []uint32{1, 3, 5, 7, 9, 25, 27, 49, 81, 125, 243, 343, 625, 729, 2187, 2401, 3125}
+
+func init() {
+	for _, t := range []detect.Type{detect.Ext2, detect.Ext3, detect.Ext4} {
+		fsys.Register(t, Open)
+	}
 }
 
-// Open opens an ext2/3/4 filesystem from the given reader
+// Open opens an ext2/3/4 filesystem from the given reader.
+// If the primary superblock is damaged, the backup copies are tried in order.
 func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
+	return OpenSuperblock(r, size, -1)
+}
+
+// OpenSuperblock opens an ext2/3/4 filesystem using the superblock copy
+// stored in the given block group (0 is the primary superblock).
+// A negative group selects the primary and falls back to the first valid
+// backup if the primary is damaged. When a backup copy is used, the block
+// group descriptors are read from the backup table that follows it.
+func OpenSuperblock(r io.ReaderAt, size int64, group int) (fsys.FS, error) {
+	if group > 0 {
+		fs, err := openBackup(r, size, uint32(group))
+		if err != nil {
+			return nil, err
+		}
+		if fs == nil {
+			return nil, fmt.Errorf("no valid backup superblock in group %d", group)
+		}
+		return fs, nil
+	}
+
 	sbData := make([]byte, superblockSize)
 	if _, err := r.ReadAt(sbData, superblockOffset); err != nil {
 		return nil, fmt.Errorf("reading superblock: %w", err)
 	}
 
+	fs := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size}
+	primaryErr := fs.parseSuperblock(sbData, superblockOffset)
+	if primaryErr == nil {
+		return fs, nil
+	}
+	if group == 0 {
+		return nil, primaryErr
+	}
+
+	for _, g := range backupGroups {
+		backup, err := openBackup(r, size, g)
+		if err != nil {
+			break // Past the end of the image
+		}
+		if backup != nil {
+			return backup, nil
+		}
+	}
+
 	magic := binary.LittleEndian.Uint16(sbData[0x38:0x3A])
 	if magic != extMagic {
 		return nil, nil // Not an ext filesystem
 	}
+	return nil, primaryErr
+}
 
-	fs := &FS{r: r, size: size}
-	if err := fs.parseSuperblock(sbData); err != nil {
-		return nil, err
+// openBackup looks for the backup superblock of the given block group.
+// The block size of a damaged filesystem is unknown, so every valid block
+// size is tried, assuming the default of 8*blocksize blocks per group.
+// It returns nil, nil if no valid copy is found, and an error only if
+// the candidate locations all lie beyond the end of the image.
+func openBackup(r io.ReaderAt, size int64, group uint32) (*FS, error) {
+	sbData := make([]byte, superblockSize)
+	inRange := false
+
+	for logBlockSize := uint32(0); logBlockSize <= 6; logBlockSize++ {
+		blockSize := int64(1024) << logBlockSize
+		blocksPerGroup := 8 * blockSize
+		firstDataBlock := int64(0)
+		if blockSize == 1024 {
+			firstDataBlock = 1
+		}
+
+		offset := (firstDataBlock + int64(group)*blocksPerGroup) * blockSize
+		if offset+superblockSize > size {
+			continue
+		}
+		inRange = true
+
+		if _, err := r.ReadAt(sbData, offset); err != nil {
+			continue
+		}
+		if binary.LittleEndian.Uint32(sbData[0x18:0x1C]) != logBlockSize ||
+			int64(binary.LittleEndian.Uint32(sbData[0x20:0x24])) != blocksPerGroup {
+			continue
+		}
+
+		fs := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size, sbGroup: group}
+		if err := fs.parseSuperblock(sbData, offset); err != nil {
+			continue
+		}
+		return fs, nil
 	}
 
-	return fs, nil
+	if !inRange {
+		return nil, fmt.Errorf("backup superblock for group %d is beyond end of image", group)
+	}
+	return nil, nil
 }
 
-func (f *FS) parseSuperblock(data []byte) error {
+// parseSuperblock decodes the superblock read from offset
+func (f *FS) parseSuperblock(data []byte, offset int64) error {
 	f.sb.inodesCount = binary.LittleEndian.Uint32(data[0x00:0x04])
 	f.sb.blocksCount = uint64(binary.LittleEndian.Uint32(data[0x04:0x08]))
 	f.sb.freeBlocksCount = uint64(binary.LittleEndian.Uint32(data[0x0C:0x10]))
 	f.sb.freeInodesCount = binary.LittleEndian.Uint32(data[0x10:0x14])
 	f.sb.firstDataBlock = binary.LittleEndian.Uint32(data[0x14:0x18])
 	f.sb.logBlockSize = binary.LittleEndian.Uint32(data[0x18:0x1C])
+	f.sb.logClusterSize = binary.LittleEndian.Uint32(data[0x1C:0x20])
 	f.sb.blocksPerGroup = binary.LittleEndian.Uint32(data[0x20:0x24])
+	f.sb.clustersPerGroup = binary.LittleEndian.Uint32(data[0x24:0x28])
 	f.sb.inodesPerGroup = binary.LittleEndian.Uint32(data[0x28:0x2C])
+	f.sb.mtime = binary.LittleEndian.Uint32(data[0x2C:0x30])
+	f.sb.wtime = binary.LittleEndian.Uint32(data[0x30:0x34])
+	f.sb.mntCount = binary.LittleEndian.Uint16(data[0x34:0x36])
+	f.sb.maxMntCount = int16(binary.LittleEndian.Uint16(data[0x36:0x38]))
 	f.sb.magic = binary.LittleEndian.Uint16(data[0x38:0x3A])
+	f.sb.state = binary.LittleEndian.Uint16(data[0x3A:0x3C])
+	f.sb.errors = binary.LittleEndian.Uint16(data[0x3C:0x3E])
+	f.sb.minorRevLevel = binary.LittleEndian.Uint16(data[0x3E:0x40])
+	f.sb.lastcheck = binary.LittleEndian.Uint32(data[0x40:0x44])
+	f.sb.checkinterval = binary.LittleEndian.Uint32(data[0x44:0x48])
+	f.sb.creatorOS = binary.LittleEndian.Uint32(data[0x48:0x4C])
 	f.sb.revLevel = binary.LittleEndian.Uint32(data[0x4C:0x50])
+	f.sb.defResuid = binary.LittleEndian.Uint16(data[0x50:0x52])
+	f.sb.defResgid = binary.LittleEndian.Uint16(data[0x52:0x54])
+	f.sb.blockGroupNr = binary.LittleEndian.Uint16(data[0x5A:0x5C])
 	f.sb.firstIno = binary.LittleEndian.Uint32(data[0x54:0x58])
 	f.sb.inodeSize = binary.LittleEndian.Uint16(data[0x58:0x5A])
 	f.sb.featureCompat = binary.LittleEndian.Uint32(data[0x5C:0x60])
@@ -139,12 +267,25 @@ func (f *FS) parseSuperblock(data []byte) error {
 	copy(f.sb.uuid[:], data[0x68:0x78])
 	copy(f.sb.volumeName[:], data[0x78:0x88])
 
+	if f.sb.magic != extMagic {
+		return fsys.Corrupt("superblock", offset, "invalid magic %04x", f.sb.magic)
+	}
+	if f.sb.logBlockSize > 6 {
+		return fsys.Corrupt("superblock", offset, "invalid block size: log %d", f.sb.logBlockSize)
+	}
+	if f.sb.blocksPerGroup == 0 || f.sb.inodesPerGroup == 0 || f.sb.blocksCount == 0 {
+		return fsys.Corrupt("superblock", offset, "invalid geometry")
+	}
+
 	f.blockSize = 1024 << f.sb.logBlockSize
 
 	// Default inode size for rev 0
 	if f.sb.revLevel == 0 {
 		f.sb.inodeSize = 128
 	}
+	if f.sb.inodeSize < 128 || f.sb.inodeSize&(f.sb.inodeSize-1) != 0 || uint32(f.sb.inodeSize) > f.blockSize {
+		return fsys.Corrupt("superblock", offset, "invalid inode size %d", f.sb.inodeSize)
+	}
 
 	// Descriptor size for 64-bit feature
 	if f.sb.featureIncompat&featureIncompat64Bit != 0 {
@@ -155,6 +296,7 @@ func (f *FS) parseSuperblock(data []byte) error {
 		// Get high 32 bits of block count
 		high := binary.LittleEndian.Uint32(data[0x150:0x154])
 		f.sb.blocksCount |= uint64(high) << 32
+		f.sb.freeBlocksCount |= uint64(binary.LittleEndian.Uint32(data[0x158:0x15C])) << 32
 	} else {
 		f.sb.descSize = 32
 	}
@@ -176,7 +318,29 @@ func (f *FS) parseSuperblock(data []byte) error {
 
 func (f *FS) Type() string  { return f.typ }
 func (f *FS) Close() error  { return nil }
-func (f *FS) BaseReader() io.ReaderAt { return f.r }
+func (f *FS) BaseReader() io.ReaderAt { return f.base }
+
+// Label returns the volume name from the superblock
+func (f *FS) Label() string { return strings.TrimRight(string(f.sb.volumeName[:]), "\x00") }
+
+// BlockSize implements fsys.BlockSizer: with bigalloc, space is allocated
+// in clusters of several blocks
+func (f *FS) BlockSize() int64 {
+	if f.sb.featureROCompat&featureROCompatBigalloc != 0 {
+		return 1024 << f.sb.logClusterSize
+	}
+	return int64(f.blockSize)
+}
+
+// NeedsRecovery implements fsys.Recoverer: the kernel sets needs_recovery
+// while the filesystem is mounted and clears it once the journal is empty
+func (f *FS) NeedsRecovery() (bool, error) {
+	return f.sb.featureIncompat&featureIncompatRecover != 0, nil
+}
+
+// SuperblockGroup returns the block group whose superblock copy is in use
+// (0 for the primary superblock)
+func (f *FS) SuperblockGroup() uint32 { return f.sbGroup }
 
 // FreeBlocks returns the list of free byte ranges in the ext filesystem.
 // Free blocks are identified by 0 bits in the block bitmaps.
@@ -272,19 +436,23 @@ func mergeRanges(ranges []fsys.Range) []fsys.Range {
 
 // FileExtents returns the physical extents for a file
 func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
+	// Directories are mapped as files are, their blocks holding the entries
+	var ino inode
+	var err error
 	if name == "." || name == "" {
-		return nil, fmt.Errorf("cannot get extents for root directory")
+		ino, err = f.readInode(rootInode)
+	} else {
+		_, ino, err = f.lookup(name)
 	}
-
-	inodeNum, ino, err := f.lookup(name)
 	if err != nil {
 		return nil, err
 	}
-	_ = inodeNum
-
-	// Check if it's a directory
-	if ino.mode&0xF000 == 0x4000 {
-		return nil, fmt.Errorf("cannot get extents for directory")
+	if _, ok := f.inlineData(ino); ok {
+		return nil, nil
+	}
+	// The blocks of an fscrypt file hold its ciphertext
+	if ino.flags&inodeFlagEncrypt != 0 && ino.mode&0xF000 == 0x8000 {
+		return nil, fmt.Errorf("%s: %w", name, fsys.ErrEncrypted)
 	}
 
 	fileSize := int64(ino.size)
@@ -294,36 +462,31 @@ func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
 	return f.getBlockPointerExtents(ino, fileSize)
 }
 
-// getExtentTreeExtents returns extents from an extent tree
+// getExtentTreeExtents returns extents from an extent tree. Uninitialized
+// extents, allocated but not yet written, read as zeros.
 func (f *FS) getExtentTreeExtents(ino inode, fileSize int64) ([]fsys.Extent, error) {
 	var extents []fsys.Extent
 	blockSize := int64(f.blockSize)
-	remaining := fileSize
 
-	err := f.walkExtentTree(ino.block[:], func(e extent) error {
-		if remaining <= 0 {
+	err := f.walkExtentTree(ino, func(e extent) error {
+		logical := int64(e.block) * blockSize
+		if logical >= fileSize {
 			return io.EOF
 		}
 
-		startBlock := uint64(e.startLo) | (uint64(e.startHi) << 32)
-		length := uint16(e.len)
-		if length > 0x8000 {
-			length -= 0x8000 // Uninitialized extent
-		}
-
-		logicalBlock := uint64(e.block)
-		extentBytes := int64(length) * blockSize
-		if extentBytes > remaining {
-			extentBytes = remaining
+		length := int64(e.len)
+		uninit := length > 0x8000
+		if uninit {
+			length -= 0x8000
 		}
+		startBlock := uint64(e.startLo) | (uint64(e.startHi) << 32)
 
 		extents = append(extents, fsys.Extent{
-			Logical:  int64(logicalBlock) * blockSize,
+			Logical:  logical,
 			Physical: int64(startBlock) * blockSize,
-			Length:   extentBytes,
+			Length:   min(length*blockSize, fileSize-logical),
+			Zero:     uninit,
 		})
-
-		remaining -= extentBytes
 		return nil
 	})
 
@@ -334,107 +497,85 @@ func (f *FS) getExtentTreeExtents(ino inode, fileSize int64) ([]fsys.Extent, err
 	return extents, nil
 }
 
-// getBlockPointerExtents returns extents from block pointers
+// getBlockPointerExtents returns extents from block pointers. A zero
+// pointer, to a data or an indirect block, leaves a hole.
 func (f *FS) getBlockPointerExtents(ino inode, fileSize int64) ([]fsys.Extent, error) {
 	var extents []fsys.Extent
 	blockSize := int64(f.blockSize)
-	blocksNeeded := (fileSize + blockSize - 1) / blockSize
-	logicalOffset := int64(0)
-	remaining := fileSize
-
-	var currentExtent *fsys.Extent
-
-	addBlock := func(blockNum uint64) {
-		if remaining <= 0 {
-			return
-		}
-		physOffset := int64(blockNum) * blockSize
-		extentLen := blockSize
-		if extentLen > remaining {
-			extentLen = remaining
-		}
-
-		// Try to extend current extent if contiguous
-		if currentExtent != nil &&
-			currentExtent.Physical+currentExtent.Length == physOffset {
-			currentExtent.Length += extentLen
-		} else {
-			if currentExtent != nil {
-				extents = append(extents, *currentExtent)
-			}
-			currentExtent = &fsys.Extent{
-				Logical:  logicalOffset,
-				Physical: physOffset,
-				Length:   extentLen,
+	blocks := (fileSize + blockSize - 1) / blockSize
+
+	addBlock := func(index int64, blockNum uint64) {
+		logical := index * blockSize
+		physical := int64(blockNum) * blockSize
+		length := min(blockSize, fileSize-logical)
+
+		// Extend the last extent if contiguous
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if last.Logical+last.Length == logical && last.Physical+last.Length == physical {
+				last.Length += length
+				return
 			}
 		}
-		logicalOffset += extentLen
-		remaining -= extentLen
+		extents = append(extents, fsys.Extent{
+			Logical:  logical,
+			Physical: physical,
+			Length:   length,
+		})
 	}
 
 	// Direct blocks (0-11)
-	for i := 0; i < 12 && logicalOffset/blockSize < blocksNeeded; i++ {
-		blockNum := binary.LittleEndian.Uint32(ino.block[i*4 : (i+1)*4])
-		if blockNum == 0 {
-			continue
-		}
-		addBlock(uint64(blockNum))
-	}
-
-	// Single indirect (12)
-	if logicalOffset/blockSize < blocksNeeded {
-		indirectBlock := binary.LittleEndian.Uint32(ino.block[48:52])
-		if indirectBlock != 0 {
-			if err := f.walkIndirectExtents(uint64(indirectBlock), 1, addBlock); err != nil {
-				return nil, err
-			}
-		}
-	}
-
-	// Double indirect (13)
-	if logicalOffset/blockSize < blocksNeeded {
-		doubleIndirectBlock := binary.LittleEndian.Uint32(ino.block[52:56])
-		if doubleIndirectBlock != 0 {
-			if err := f.walkIndirectExtents(uint64(doubleIndirectBlock), 2, addBlock); err != nil {
-				return nil, err
-			}
+	for i := int64(0); i < 12 && i < blocks; i++ {
+		if blockNum := binary.LittleEndian.Uint32(ino.block[i*4:]); blockNum != 0 {
+			addBlock(i, uint64(blockNum))
 		}
 	}
 
-	// Triple indirect (14)
-	if logicalOffset/blockSize < blocksNeeded {
-		tripleIndirectBlock := binary.LittleEndian.Uint32(ino.block[56:60])
-		if tripleIndirectBlock != 0 {
-			if err := f.walkIndirectExtents(uint64(tripleIndirectBlock), 3, addBlock); err != nil {
+	// Single, double and triple indirect (12-14), each mapping the
+	// blocks after those of the one before
+	perBlock := blockSize / 4
+	first, span := int64(12), perBlock
+	for level := 1; level <= 3 && first < blocks; level++ {
+		if ptr := binary.LittleEndian.Uint32(ino.block[44+level*4:]); ptr != 0 {
+			if err := f.walkIndirectExtents(uint64(ptr), level, first, blocks, addBlock); err != nil {
 				return nil, err
 			}
 		}
-	}
-
-	if currentExtent != nil {
-		extents = append(extents, *currentExtent)
+		first += span
+		span *= perBlock
 	}
 
 	return extents, nil
 }
 
-func (f *FS) walkIndirectExtents(block uint64, level int, addBlock func(uint64)) error {
+// walkIndirectExtents calls addBlock for each block an indirect block of
+// the given level maps, with its index in the file, which starts at first
+// for this indirect block, up to limit
+func (f *FS) walkIndirectExtents(block uint64, level int, first, limit int64, addBlock func(int64, uint64)) error {
 	blockData, err := f.readBlock(block)
 	if err != nil {
 		return err
 	}
 
-	pointersPerBlock := int(f.blockSize / 4)
-	for i := 0; i < pointersPerBlock; i++ {
-		ptr := binary.LittleEndian.Uint32(blockData[i*4 : (i+1)*4])
+	pointersPerBlock := int64(f.blockSize / 4)
+	span := int64(1) // File blocks each pointer maps
+	for range level - 1 {
+		span *= pointersPerBlock
+	}
+	for i := int64(0); i < pointersPerBlock; i++ {
+		index := first + i*span
+		if index >= limit {
+			break
+		}
+		ptr := binary.LittleEndian.Uint32(blockData[i*4:])
 		if ptr == 0 {
 			continue
 		}
 
 		if level == 1 {
-			addBlock(uint64(ptr))
+			addBlock(index, uint64(ptr))
 		} else {
-			if err := f.walkIndirectExtents(uint64(ptr), level-1, addBlock); err != nil {
+			if err := f.walkIndirectExtents(uint64(ptr), level-1, index, limit, addBlock); err != nil {
 				return err
 			}
 		}
@@ -448,6 +589,9 @@ func (f *FS) blockOffset(block uint64) int64 {
 }
 
 func (f *FS) readBlock(block uint64) ([]byte, error) {
+	if block >= f.sb.blocksCount {
+		return nil, fsys.Corrupt(fmt.Sprintf("block pointer %d", block), -1, "past the end of the filesystem (%d blocks)", f.sb.blocksCount)
+	}
 	data := make([]byte, f.blockSize)
 	offset := f.blockOffset(block)
 	if _, err := f.r.ReadAt(data, offset); err != nil {
@@ -457,8 +601,10 @@ func (f *FS) readBlock(block uint64) ([]byte, error) {
 }
 
 func (f *FS) readBlockGroupDescriptor(group uint32) (blockGroupDescriptor, error) {
-	// Block group descriptors start at block 1 (or 2 if block size is 1024)
-	descBlock := uint64(f.sb.firstDataBlock + 1)
+	// Block group descriptors start at the block after the superblock in use:
+	// block 1 (or 2 if block size is 1024) for the primary copy, or the
+	// second block of the group holding the backup copy
+	descBlock := uint64(f.sb.firstDataBlock) + uint64(f.sbGroup)*uint64(f.sb.blocksPerGroup) + 1
 	descOffset := f.blockOffset(descBlock) + int64(group)*int64(f.sb.descSize)
 
 	data := make([]byte, f.sb.descSize)
@@ -473,6 +619,7 @@ func (f *FS) readBlockGroupDescriptor(group uint32) (blockGroupDescriptor, error
 		freeBlocksCount: uint32(binary.LittleEndian.Uint16(data[0x0C:0x0E])),
 		freeInodesCount: uint32(binary.LittleEndian.Uint16(data[0x0E:0x10])),
 		usedDirsCount:   uint32(binary.LittleEndian.Uint16(data[0x10:0x12])),
+		flags:           binary.LittleEndian.Uint16(data[0x12:0x14]),
 	}
 
 	// 64-bit extensions
@@ -480,42 +627,61 @@ func (f *FS) readBlockGroupDescriptor(group uint32) (blockGroupDescriptor, error
 		bgd.blockBitmap |= uint64(binary.LittleEndian.Uint32(data[0x20:0x24])) << 32
 		bgd.inodeBitmap |= uint64(binary.LittleEndian.Uint32(data[0x24:0x28])) << 32
 		bgd.inodeTable |= uint64(binary.LittleEndian.Uint32(data[0x28:0x2C])) << 32
+		bgd.freeBlocksCount |= uint32(binary.LittleEndian.Uint16(data[0x2C:0x2E])) << 16
+		bgd.freeInodesCount |= uint32(binary.LittleEndian.Uint16(data[0x2E:0x30])) << 16
 	}
 
 	return bgd, nil
 }
 
-func (f *FS) readInode(inodeNum uint32) (inode, error) {
-	if inodeNum == 0 {
-		return inode{}, fmt.Errorf("invalid inode number 0")
+// inodeOffset returns where an inode is stored in the image
+func (f *FS) inodeOffset(inodeNum uint32) (int64, error) {
+	if inodeNum > f.sb.inodesCount {
+		return 0, fsys.Corrupt(fmt.Sprintf("inode number %d", inodeNum), -1, "past the last inode %d", f.sb.inodesCount)
 	}
-
 	group := (inodeNum - 1) / f.sb.inodesPerGroup
 	index := (inodeNum - 1) % f.sb.inodesPerGroup
 
 	bgd, err := f.readBlockGroupDescriptor(group)
 	if err != nil {
-		return inode{}, err
+		return 0, err
+	}
+	return f.blockOffset(bgd.inodeTable) + int64(index)*int64(f.sb.inodeSize), nil
+}
+
+func (f *FS) readInode(inodeNum uint32) (inode, error) {
+	if inodeNum == 0 {
+		return inode{}, fsys.Corrupt("inode number 0", -1, "inodes are numbered from 1")
 	}
 
-	inodeOffset := f.blockOffset(bgd.inodeTable) + int64(index)*int64(f.sb.inodeSize)
+	inodeOffset, err := f.inodeOffset(inodeNum)
+	if err != nil {
+		return inode{}, err
+	}
 	data := make([]byte, f.sb.inodeSize)
 	if _, err := f.r.ReadAt(data, inodeOffset); err != nil {
 		return inode{}, err
 	}
+	return parseInode(data, inodeOffset), nil
+}
 
+// parseInode decodes an inode stored at offset
+func parseInode(data []byte, inodeOffset int64) inode {
 	ino := inode{
 		mode:       binary.LittleEndian.Uint16(data[0x00:0x02]),
-		uid:        binary.LittleEndian.Uint16(data[0x02:0x04]),
+		uid:        uint32(binary.LittleEndian.Uint16(data[0x02:0x04])) | uint32(binary.LittleEndian.Uint16(data[0x78:0x7A]))<<16,
 		size:       uint64(binary.LittleEndian.Uint32(data[0x04:0x08])),
 		atime:      binary.LittleEndian.Uint32(data[0x08:0x0C]),
 		ctime:      binary.LittleEndian.Uint32(data[0x0C:0x10]),
 		mtime:      binary.LittleEndian.Uint32(data[0x10:0x14]),
 		dtime:      binary.LittleEndian.Uint32(data[0x14:0x18]),
-		gid:        binary.LittleEndian.Uint16(data[0x18:0x1A]),
+		gid:        uint32(binary.LittleEndian.Uint16(data[0x18:0x1A])) | uint32(binary.LittleEndian.Uint16(data[0x7A:0x7C]))<<16,
 		linksCount: binary.LittleEndian.Uint16(data[0x1A:0x1C]),
-		blocks:     uint64(binary.LittleEndian.Uint32(data[0x1C:0x20])),
+		blocks:     uint64(binary.LittleEndian.Uint32(data[0x1C:0x20])) | uint64(binary.LittleEndian.Uint16(data[0x74:0x76]))<<32,
 		flags:      binary.LittleEndian.Uint32(data[0x20:0x24]),
+		generation: binary.LittleEndian.Uint32(data[0x64:0x68]),
+		fileACL:    uint64(binary.LittleEndian.Uint32(data[0x68:0x6C])) | uint64(binary.LittleEndian.Uint16(data[0x76:0x78]))<<32,
+		offset:     inodeOffset,
 	}
 	copy(ino.block[:], data[0x28:0x64])
 
@@ -524,10 +690,27 @@ func (f *FS) readInode(inodeNum uint32) (inode, error) {
 		ino.size |= uint64(binary.LittleEndian.Uint32(data[0x6C:0x70])) << 32
 	}
 
-	return ino, nil
+	// Inodes over 128 bytes extend the times, as far as i_extra_isize says
+	if len(data) >= 0x82 {
+		end := 0x80 + int(binary.LittleEndian.Uint16(data[0x80:0x82]))
+		field := func(off int) uint32 {
+			if off+4 > end || off+4 > len(data) {
+				return 0
+			}
+			return binary.LittleEndian.Uint32(data[off : off+4])
+		}
+		ino.ctimeExtra = field(0x84)
+		ino.mtimeExtra = field(0x88)
+		ino.atimeExtra = field(0x8C)
+		ino.crtime = field(0x90)
+		ino.crtimeExtra = field(0x94)
+	}
+
+	return ino
 }
 
-// readInodeData reads all data blocks for an inode
+// readInodeData reads the data of an inode, up to maxSize bytes if not 0,
+// with holes and uninitialized extents read as zeros
 func (f *FS) readInodeData(ino inode, maxSize int64) ([]byte, error) {
 	if maxSize == 0 {
 		maxSize = int64(ino.size)
@@ -535,111 +718,56 @@ func (f *FS) readInodeData(ino inode, maxSize int64) ([]byte, error) {
 	if maxSize > int64(ino.size) {
 		maxSize = int64(ino.size)
 	}
-
-	if ino.flags&inodeFlagExtents != 0 {
-		return f.readExtents(ino, maxSize)
+	r, err := f.inodeReader(ino)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, maxSize)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
 	}
-	return f.readBlockPointers(ino, maxSize)
+	return data[:n], nil
 }
 
-// readBlockPointers reads data using traditional block pointers
-func (f *FS) readBlockPointers(ino inode, maxSize int64) ([]byte, error) {
-	var data []byte
-	blocksNeeded := (maxSize + int64(f.blockSize) - 1) / int64(f.blockSize)
-	blocksRead := int64(0)
-
-	// Direct blocks (0-11)
-	for i := 0; i < 12 && blocksRead < blocksNeeded; i++ {
-		blockNum := binary.LittleEndian.Uint32(ino.block[i*4 : (i+1)*4])
-		if blockNum == 0 {
-			continue
-		}
-		block, err := f.readBlock(uint64(blockNum))
-		if err != nil {
-			return nil, err
-		}
-		data = append(data, block...)
-		blocksRead++
+// inodeReader returns a reader of the data of an inode, with holes and
+// uninitialized extents read as zeros
+func (f *FS) inodeReader(ino inode) (io.ReaderAt, error) {
+	if data, ok := f.inlineData(ino); ok {
+		return bytes.NewReader(data), nil
 	}
 
-	// Single indirect (12)
-	if blocksRead < blocksNeeded {
-		indirectBlock := binary.LittleEndian.Uint32(ino.block[48:52])
-		if indirectBlock != 0 {
-			moreData, err := f.readIndirectBlocks(uint64(indirectBlock), 1, blocksNeeded-blocksRead)
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, moreData...)
-			blocksRead += int64(len(moreData)) / int64(f.blockSize)
-		}
+	var extents []fsys.Extent
+	var err error
+	if ino.flags&inodeFlagExtents != 0 {
+		extents, err = f.getExtentTreeExtents(ino, int64(ino.size))
+	} else {
+		extents, err = f.getBlockPointerExtents(ino, int64(ino.size))
 	}
-
-	// Double indirect (13)
-	if blocksRead < blocksNeeded {
-		doubleIndirectBlock := binary.LittleEndian.Uint32(ino.block[52:56])
-		if doubleIndirectBlock != 0 {
-			moreData, err := f.readIndirectBlocks(uint64(doubleIndirectBlock), 2, blocksNeeded-blocksRead)
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, moreData...)
-			blocksRead += int64(len(moreData)) / int64(f.blockSize)
-		}
+	if err != nil {
+		return nil, err
 	}
+	return fsys.NewExtentReaderAt(f.r, extents, int64(ino.size)), nil
+}
 
-	// Triple indirect (14)
-	if blocksRead < blocksNeeded {
-		tripleIndirectBlock := binary.LittleEndian.Uint32(ino.block[56:60])
-		if tripleIndirectBlock != 0 {
-			moreData, err := f.readIndirectBlocks(uint64(tripleIndirectBlock), 3, blocksNeeded-blocksRead)
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, moreData...)
-		}
+// inlineData returns the contents of a fast symlink, or of a file with
+// inline data that fits in the inode, which keep them in the block array
+// in place of block numbers
+func (f *FS) inlineData(ino inode) ([]byte, bool) {
+	if ino.size > uint64(len(ino.block)) {
+		return nil, false
 	}
-
-	if int64(len(data)) > maxSize {
-		data = data[:maxSize]
+	if ino.flags&inodeFlagInlineData != 0 {
+		return ino.block[:ino.size], true
 	}
-	return data, nil
-}
-
-func (f *FS) readIndirectBlocks(block uint64, level int, maxBlocks int64) ([]byte, error) {
-	blockData, err := f.readBlock(block)
-	if err != nil {
-		return nil, err
+	if ino.mode&0xF000 != 0xA000 {
+		return nil, false
 	}
-
-	var data []byte
-	pointersPerBlock := int(f.blockSize / 4)
-	blocksRead := int64(0)
-
-	for i := 0; i < pointersPerBlock && blocksRead < maxBlocks; i++ {
-		ptr := binary.LittleEndian.Uint32(blockData[i*4 : (i+1)*4])
-		if ptr == 0 {
-			continue
-		}
-
-		if level == 1 {
-			blk, err := f.readBlock(uint64(ptr))
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, blk...)
-			blocksRead++
-		} else {
-			moreData, err := f.readIndirectBlocks(uint64(ptr), level-1, maxBlocks-blocksRead)
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, moreData...)
-			blocksRead += int64(len(moreData)) / int64(f.blockSize)
-		}
+	dataBlocks := ino.blocks
+	if ino.fileACL != 0 {
+		dataBlocks -= min(dataBlocks, uint64(f.blockSize/512)) // The extended attribute block
 	}
-
-	return data, nil
+	return ino.block[:ino.size], dataBlocks == 0
 }
 
 // Extent tree structures
@@ -665,45 +793,17 @@ type extent struct {
 	startLo uint32
 }
 
-func (f *FS) readExtents(ino inode, maxSize int64) ([]byte, error) {
-	var data []byte
-
-	err := f.walkExtentTree(ino.block[:], func(e extent) error {
-		if int64(len(data)) >= maxSize {
-			return io.EOF
-		}
-
-		startBlock := uint64(e.startLo) | (uint64(e.startHi) << 32)
-		length := uint16(e.len)
-		if length > 0x8000 {
-			// Uninitialized extent
-			length -= 0x8000
-		}
-
-		for i := uint16(0); i < length; i++ {
-			if int64(len(data)) >= maxSize {
-				break
-			}
-			block, err := f.readBlock(startBlock + uint64(i))
-			if err != nil {
-				return err
-			}
-			data = append(data, block...)
-		}
-		return nil
-	})
-
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
+// maxExtentDepth is the deepest an extent tree can be
+const maxExtentDepth = 5
 
-	if int64(len(data)) > maxSize {
-		data = data[:maxSize]
-	}
-	return data, nil
+// walkExtentTree calls fn for the extents of ino in logical order
+func (f *FS) walkExtentTree(ino inode, fn func(extent) error) error {
+	return f.walkExtentNode(ino.block[:], ino.offset+0x28, -1, fn)
 }
 
-func (f *FS) walkExtentTree(data []byte, fn func(extent) error) error {
+// walkExtentNode walks the extent tree node in data, read from offset, which
+// must be at the given depth unless it is the root (depth -1)
+func (f *FS) walkExtentNode(data []byte, offset int64, depth int, fn func(extent) error) error {
 	hdr := extentHeader{
 		magic:   binary.LittleEndian.Uint16(data[0:2]),
 		entries: binary.LittleEndian.Uint16(data[2:4]),
@@ -712,7 +812,13 @@ func (f *FS) walkExtentTree(data []byte, fn func(extent) error) error {
 	}
 
 	if hdr.magic != 0xF30A {
-		return fmt.Errorf("invalid extent magic: %04x", hdr.magic)
+		return fsys.Corrupt("extent tree node", offset, "invalid magic %04x", hdr.magic)
+	}
+	if int(hdr.entries) > (len(data)-12)/12 {
+		return fsys.Corrupt("extent tree node", offset, "%d entries do not fit", hdr.entries)
+	}
+	if hdr.depth > maxExtentDepth || depth >= 0 && int(hdr.depth) != depth {
+		return fsys.Corrupt("extent tree node", offset, "invalid depth %d", hdr.depth)
 	}
 
 	if hdr.depth == 0 {
@@ -743,7 +849,7 @@ func (f *FS) walkExtentTree(data []byte, fn func(extent) error) error {
 			if err != nil {
 				return err
 			}
-			if err := f.walkExtentTree(blockData, fn); err != nil {
+			if err := f.walkExtentNode(blockData, f.blockOffset(leafBlock), int(hdr.depth)-1, fn); err != nil {
 				return err
 			}
 		}
@@ -761,12 +867,74 @@ type dirEntry struct {
 	name     string
 }
 
+// readDirectory returns all the entries of a directory
 func (f *FS) readDirectory(ino inode) ([]dirEntry, error) {
-	data, err := f.readInodeData(ino, 0)
+	d, err := f.newDirReader(ino)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	for {
+		batch, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if batch == nil {
+			return entries, nil
+		}
+		entries = append(entries, batch...)
+	}
+}
+
+// dirReadBlocks is how many directory blocks a dirReader reads at once
+const dirReadBlocks = 16
+
+// dirReader reads the entries of a directory a few blocks at a time
+type dirReader struct {
+	r         io.ReaderAt
+	size      int64
+	blockSize int64 // Entries do not cross blocks of this size
+	offset    int64 // Of the next block to read
+}
+
+// newDirReader returns a reader of the entries of a directory
+func (f *FS) newDirReader(ino inode) (*dirReader, error) {
+	r, err := f.inodeReader(ino)
 	if err != nil {
 		return nil, err
 	}
+	d := &dirReader{r: r, size: int64(ino.size), blockSize: int64(f.blockSize)}
+	if _, ok := f.inlineData(ino); ok {
+		d.blockSize = d.size
+	}
+	return d, nil
+}
+
+// next returns the entries of the next blocks that have any, or nil at
+// the end of the directory
+func (d *dirReader) next() ([]dirEntry, error) {
+	for d.offset < d.size {
+		buf := make([]byte, min(dirReadBlocks*d.blockSize, d.size-d.offset))
+		n, err := d.r.ReadAt(buf, d.offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		d.offset += int64(len(buf))
+
+		var entries []dirEntry
+		for start := 0; start < n; start += int(d.blockSize) {
+			entries = append(entries, parseDirBlock(buf[start:min(start+int(d.blockSize), n)])...)
+		}
+		if len(entries) > 0 {
+			return entries, nil
+		}
+	}
+	return nil, nil
+}
 
+// parseDirBlock returns the entries in a block of a directory, up to the
+// first with a bad record length
+func parseDirBlock(data []byte) []dirEntry {
 	var entries []dirEntry
 	offset := 0
 
@@ -803,35 +971,750 @@ func (f *FS) readDirectory(ino inode) ([]dirEntry, error) {
 		offset += int(recLen)
 	}
 
-	return entries, nil
+	return entries
 }
 
-// fs.FS implementation
-
-const rootInode = 2
-
-func (f *FS) Open(name string) (fs.File, error) {
-	if !fs.ValidPath(name) {
-		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+// bgInodeUninit marks a block group whose inode table was never written
+const bgInodeUninit = 0x0001
+
+// fileTypeModes are the file types of directory entries as inode modes
+var fileTypeModes = map[uint8]uint16{1: 0x8000, 2: 0x4000, 3: 0x2000, 4: 0x6000, 5: 0x1000, 6: 0xC000, 7: 0xA000}
+
+// Deleted implements fsys.DeletedLister. A deleted inode is free in the
+// inode bitmap but keeps its deletion time, and its block map or extent
+// tree where debugfs or ext2 deleted it: Linux clears those of ext3 and
+// ext4 files, whose data can then only be carved. Names are found in
+// the directory entries left in the slack of live ones, as removing an
+// entry that does not start a block merges it into the one before. The
+// ID of a file is its inode number.
+func (f *FS) Deleted() ([]fsys.DeletedEntry, error) {
+	free, err := f.FreeBlocks()
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.deletedNames()
+	if err != nil {
+		return nil, err
 	}
 
-	if name == "." {
-		ino, err := f.readInode(rootInode)
+	var found []fsys.DeletedEntry
+	size := int(f.sb.inodeSize)
+	for group := uint32(0); group < f.sb.groupCount; group++ {
+		bgd, err := f.readBlockGroupDescriptor(group)
 		if err != nil {
-			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			return nil, fmt.Errorf("reading block group descriptor %d: %w", group, err)
+		}
+		if bgd.flags&bgInodeUninit != 0 {
+			continue
+		}
+		bitmap, err := f.readBlock(bgd.inodeBitmap)
+		if err != nil {
+			return nil, fmt.Errorf("reading inode bitmap for group %d: %w", group, err)
+		}
+		table := make([]byte, int(f.sb.inodesPerGroup)*size)
+		if _, err := f.r.ReadAt(table, f.blockOffset(bgd.inodeTable)); err != nil {
+			return nil, fmt.Errorf("reading inode table for group %d: %w", group, err)
 		}
-		return &extDir{fs: f, inode: ino, inodeNum: rootInode, name: "."}, nil
-	}
 
-	inodeNum, ino, err := f.lookup(name)
-	if err != nil {
-		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		for i := 0; i < int(f.sb.inodesPerGroup); i++ {
+			if i/8 < len(bitmap) && bitmap[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			data := table[i*size : (i+1)*size]
+			ino := parseInode(data, f.blockOffset(bgd.inodeTable)+int64(i*size))
+			if ino.mode == 0 || ino.dtime == 0 || ino.linksCount != 0 {
+				continue
+			}
+			inodeNum := group*f.sb.inodesPerGroup + uint32(i) + 1
+			e := fsys.DeletedEntry{
+				ID:         strconv.FormatUint(uint64(inodeNum), 10),
+				Path:       "?",
+				IsDir:      ino.mode&0xF000 == 0x4000,
+				Size:       int64(ino.size),
+				ModTime:    extTime(ino.mtime, ino.mtimeExtra),
+				AccessTime: extTime(ino.atime, ino.atimeExtra),
+				DeleteTime: time.Unix(int64(ino.dtime), 0),
+			}
+			if name, ok := names[inodeNum]; ok && fileTypeModes[name.fileType] == ino.mode&0xF000 {
+				e.Path = name.name
+			}
+			if ino.crtime != 0 {
+				e.BirthTime = extTime(ino.crtime, ino.crtimeExtra)
+			}
+			extents, inline := f.deletedExtents(ino)
+			switch {
+			case inline:
+				e.Confidence = fsys.ConfidenceHigh
+			case len(extents) == 0:
+				e.Confidence = fsys.ConfidenceNone
+			default:
+				e.Extents = extents
+				e.Confidence = fsys.RateDeleted(free, extents, e.Size, false)
+			}
+			found = append(found, e)
+		}
 	}
+	return found, nil
+}
 
-	if ino.mode&0xF000 == 0x4000 {
-		return &extDir{fs: f, inode: ino, inodeNum: inodeNum, name: path.Base(name)}, nil
+// deletedExtents returns the extents of a deleted inode, none if they
+// cannot be read, or whether its data is in the inode itself
+func (f *FS) deletedExtents(ino inode) ([]fsys.Extent, bool) {
+	if _, ok := f.inlineData(ino); ok {
+		return nil, true
 	}
-
+	var extents []fsys.Extent
+	var err error
+	if ino.flags&inodeFlagExtents != 0 {
+		extents, err = f.getExtentTreeExtents(ino, int64(ino.size))
+	} else {
+		extents, err = f.getBlockPointerExtents(ino, int64(ino.size))
+	}
+	if err != nil {
+		return nil, false
+	}
+	return extents, false
+}
+
+// deletedNames returns the directory entries left in the slack of the
+// entries of live directories by inode number, named by their paths
+func (f *FS) deletedNames() (map[uint32]dirEntry, error) {
+	names := make(map[uint32]dirEntry)
+	seen := map[uint32]bool{rootInode: true}
+	var walk func(inodeNum uint32, dirPath string) error
+	walk = func(inodeNum uint32, dirPath string) error {
+		ino, err := f.readInode(inodeNum)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dirPath, err)
+		}
+		r, err := f.inodeReader(ino)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dirPath, err)
+		}
+		data := make([]byte, ino.size)
+		n, err := r.ReadAt(data, 0)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", dirPath, err)
+		}
+		data = data[:n]
+		blockSize := int(f.blockSize)
+		if _, ok := f.inlineData(ino); ok {
+			blockSize = len(data)
+		}
+
+		var subdirs []dirEntry
+		for start := 0; start < len(data); start += blockSize {
+			block := data[start:min(start+blockSize, len(data))]
+			for _, e := range parseDirBlock(block) {
+				if e.fileType == 2 && e.name != "." && e.name != ".." && !seen[e.inode] {
+					seen[e.inode] = true
+					subdirs = append(subdirs, e)
+				}
+			}
+			for _, e := range slackEntries(block, f.sb.inodesCount) {
+				if _, ok := names[e.inode]; !ok {
+					e.name = path.Join(dirPath, e.name)
+					names[e.inode] = e
+				}
+			}
+		}
+		for _, e := range subdirs {
+			if err := walk(e.inode, path.Join(dirPath, e.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return names, walk(rootInode, ".")
+}
+
+// slackEntries returns the plausible directory entries in the space past
+// the names of the entries of a directory block
+func slackEntries(data []byte, inodesCount uint32) []dirEntry {
+	var entries []dirEntry
+	for offset := 0; offset+8 <= len(data); {
+		recLen := int(binary.LittleEndian.Uint16(data[offset+4 : offset+6]))
+		if recLen < 8 || offset+recLen > len(data) {
+			break
+		}
+		used := (8 + int(data[offset+6]) + 3) &^ 3
+		for pos := offset + used; pos+8 <= offset+recLen; pos += 4 {
+			e := dirEntry{
+				inode:    binary.LittleEndian.Uint32(data[pos : pos+4]),
+				recLen:   binary.LittleEndian.Uint16(data[pos+4 : pos+6]),
+				nameLen:  data[pos+6],
+				fileType: data[pos+7],
+			}
+			end := pos + 8 + int(e.nameLen)
+			if e.inode == 0 || e.inode > inodesCount || e.nameLen == 0 || end > offset+recLen ||
+				int(e.recLen) < 8+int(e.nameLen) || fileTypeModes[e.fileType] == 0 {
+				continue
+			}
+			e.name = string(data[pos+8 : end])
+			if strings.ContainsAny(e.name, "/\x00") || e.name == "." || e.name == ".." {
+				continue
+			}
+			entries = append(entries, e)
+			pos = (end+3)&^3 - 4
+		}
+		offset += recLen
+	}
+	return entries
+}
+
+// OpenDeleted implements fsys.DeletedLister, reading the data a deleted
+// inode still maps
+func (f *FS) OpenDeleted(id string) (fsys.ReaderAtCloser, int64, error) {
+	inodeNum, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || inodeNum == 0 {
+		return nil, 0, fmt.Errorf("deleted inode %q: %w", id, fs.ErrNotExist)
+	}
+	ino, err := f.readInode(uint32(inodeNum))
+	if err != nil {
+		return nil, 0, err
+	}
+	if ino.mode == 0 || ino.dtime == 0 || ino.linksCount != 0 {
+		return nil, 0, fmt.Errorf("deleted inode %q: %w", id, fs.ErrNotExist)
+	}
+	extents, inline := f.deletedExtents(ino)
+	if inline {
+		data, _ := f.inlineData(ino)
+		return fsys.DefaultBudget.ReadAll(bytes.NewReader(data), int64(len(data)))
+	}
+	return fsys.NewExtentReaderAt(f.r, extents, int64(ino.size)), int64(ino.size), nil
+}
+
+// Check verifies the consistency of the metadata. It compares the backup
+// superblocks with the one in use, and the free counts in the superblock
+// and group descriptors with the bitmaps. It then walks the directory tree
+// to find blocks that the bitmap marks free or that two inodes claim,
+// inodes that the inode bitmap marks free, and link counts that do not
+// match the number of directory entries.
+func (f *FS) Check() ([]fsys.Problem, error) {
+	c := &checker{
+		fs:      f,
+		nodes:   make(map[uint32]*checkedInode),
+		refs:    make(map[uint32]int),
+		bitmaps: make(map[uint32][]byte),
+	}
+
+	c.compareSuperblocks()
+	if err := c.checkFreeCounts(); err != nil {
+		return nil, err
+	}
+
+	root, err := f.readInode(rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("reading root inode: %w", err)
+	}
+	c.visit(rootInode, root, "/")
+	c.checkLinks()
+	if err := c.checkClaims(); err != nil {
+		return nil, err
+	}
+
+	return c.problems, nil
+}
+
+// checker holds the state of a consistency check
+type checker struct {
+	fs       *FS
+	nodes    map[uint32]*checkedInode // Inodes reached from the root
+	refs     map[uint32]int           // Directory entries referring to each inode
+	claims   []claim                  // Data blocks of the inodes reached
+	bitmaps  map[uint32][]byte        // Inode bitmaps read so far, by group
+	problems []fsys.Problem
+}
+
+// checkedInode is what the check keeps of an inode it reached
+type checkedInode struct {
+	path       string // First path it was reached by
+	isDir      bool
+	linksCount uint16
+}
+
+// claim is a run of blocks, as byte offsets, that an inode uses
+type claim struct {
+	start, end int64
+	inodeNum   uint32
+}
+
+func (c *checker) report(kind, format string, args ...any) {
+	c.problems = append(c.problems, fsys.Problem{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// compareSuperblocks reports backup superblocks that are unreadable or
+// whose geometry differs from the copy in use. The free counts in the
+// backups are not kept up to date, so they are not compared.
+func (c *checker) compareSuperblocks() {
+	sb := c.fs.sb
+	if sb.featureCompat&featureCompatSparseSuper2 != 0 {
+		return // The backups are only in the two groups the superblock names
+	}
+	for _, g := range append([]uint32{0}, backupGroups...) {
+		if g >= sb.groupCount {
+			break
+		}
+		if g == c.fs.sbGroup {
+			continue
+		}
+		offset := int64(superblockOffset)
+		if g > 0 {
+			offset = c.fs.blockOffset(uint64(sb.firstDataBlock) + uint64(g)*uint64(sb.blocksPerGroup))
+		}
+		data := make([]byte, superblockSize)
+		if _, err := c.fs.r.ReadAt(data, offset); err != nil {
+			c.report("superblock", "group %d: reading superblock copy: %v", g, err)
+			continue
+		}
+		var other FS
+		if err := other.parseSuperblock(data, offset); err != nil {
+			c.report("superblock", "group %d: %v", g, err)
+			continue
+		}
+
+		var diff []string
+		o := other.sb
+		if o.blocksCount != sb.blocksCount {
+			diff = append(diff, "block count")
+		}
+		if o.inodesCount != sb.inodesCount {
+			diff = append(diff, "inode count")
+		}
+		if o.logBlockSize != sb.logBlockSize || o.blocksPerGroup != sb.blocksPerGroup {
+			diff = append(diff, "block size")
+		}
+		if o.inodesPerGroup != sb.inodesPerGroup || o.inodeSize != sb.inodeSize {
+			diff = append(diff, "inode size")
+		}
+		if o.featureCompat != sb.featureCompat || o.featureIncompat != sb.featureIncompat || o.featureROCompat != sb.featureROCompat {
+			diff = append(diff, "features")
+		}
+		if o.uuid != sb.uuid {
+			diff = append(diff, "UUID")
+		}
+		if len(diff) > 0 {
+			c.report("superblock", "group %d: superblock copy differs in %s", g, strings.Join(diff, ", "))
+		}
+	}
+}
+
+// checkFreeCounts compares the free block count of each group descriptor
+// with its block bitmap, and the superblock free counts with the sums over
+// the groups. The superblock counts lag behind while the filesystem is
+// mounted, so an image of a mounted filesystem can differ there.
+func (c *checker) checkFreeCounts() error {
+	sb := c.fs.sb
+	var freeBlocks uint64
+	var freeInodes uint32
+	for group := uint32(0); group < sb.groupCount; group++ {
+		bgd, err := c.fs.readBlockGroupDescriptor(group)
+		if err != nil {
+			return fmt.Errorf("reading block group descriptor %d: %w", group, err)
+		}
+		freeBlocks += uint64(bgd.freeBlocksCount)
+		freeInodes += bgd.freeInodesCount
+
+		if bgd.flags&bgBlockUninit != 0 {
+			continue // The bitmap is not written until the group is used
+		}
+		bitmap, err := c.fs.readBlock(bgd.blockBitmap)
+		if err != nil {
+			c.report("bitmap", "group %d: reading block bitmap: %v", group, err)
+			continue
+		}
+		firstBlock := uint64(sb.firstDataBlock) + uint64(group)*uint64(sb.blocksPerGroup)
+		blocks := min(uint64(sb.blocksPerGroup), sb.blocksCount-firstBlock, uint64(len(bitmap))*8)
+		var free uint32
+		for i := uint64(0); i < blocks; i++ {
+			if bitmap[i/8]&(1<<(i%8)) == 0 {
+				free++
+			}
+		}
+		if free != bgd.freeBlocksCount {
+			c.report("free-count", "group %d: block bitmap has %d free blocks but the descriptor says %d", group, free, bgd.freeBlocksCount)
+		}
+	}
+
+	if freeBlocks != sb.freeBlocksCount {
+		c.report("free-count", "superblock says %d free blocks but the groups have %d", sb.freeBlocksCount, freeBlocks)
+	}
+	if freeInodes != sb.freeInodesCount {
+		c.report("free-count", "superblock says %d free inodes but the groups have %d", sb.freeInodesCount, freeInodes)
+	}
+	return nil
+}
+
+// visit checks an inode reached at path p, and everything beneath it if
+// it is a directory
+func (c *checker) visit(inodeNum uint32, ino inode, p string) {
+	isDir := ino.mode&0xF000 == 0x4000
+	c.nodes[inodeNum] = &checkedInode{path: p, isDir: isDir, linksCount: ino.linksCount}
+
+	if !c.inodeAllocated(inodeNum) {
+		c.report("free-inode", "%s: inode %d is marked free in the inode bitmap", p, inodeNum)
+	}
+	c.claimBlocks(inodeNum, ino, p)
+	if !isDir {
+		return
+	}
+
+	entries, err := c.fs.readDirectory(ino)
+	if err != nil {
+		c.report("unreadable", "%s: reading directory: %v", p, err)
+		return
+	}
+	for _, e := range entries {
+		c.refs[e.inode]++
+		if e.name == "." || e.name == ".." || c.nodes[e.inode] != nil {
+			continue
+		}
+		entryPath := path.Join(p, e.name)
+		if e.inode > c.fs.sb.inodesCount {
+			c.report("bad-entry", "%s: refers to inode %d, past the last inode", entryPath, e.inode)
+			continue
+		}
+		child, err := c.fs.readInode(e.inode)
+		if err != nil {
+			c.report("unreadable", "%s: reading inode %d: %v", entryPath, e.inode, err)
+			continue
+		}
+		if child.linksCount == 0 || child.dtime != 0 {
+			c.report("bad-entry", "%s: refers to deleted inode %d", entryPath, e.inode)
+			continue
+		}
+		c.visit(e.inode, child, entryPath)
+	}
+}
+
+// inodeAllocated reports whether the inode bitmap marks an inode in use.
+// An unreadable bitmap counts as marking everything in use.
+func (c *checker) inodeAllocated(inodeNum uint32) bool {
+	group := (inodeNum - 1) / c.fs.sb.inodesPerGroup
+	bitmap, ok := c.bitmaps[group]
+	if !ok {
+		bgd, err := c.fs.readBlockGroupDescriptor(group)
+		if err == nil {
+			bitmap, err = c.fs.readBlock(bgd.inodeBitmap)
+		}
+		if err != nil {
+			c.report("bitmap", "group %d: reading inode bitmap: %v", group, err)
+		}
+		c.bitmaps[group] = bitmap
+	}
+	i := (inodeNum - 1) % c.fs.sb.inodesPerGroup
+	return int(i/8) >= len(bitmap) || bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// claimBlocks records the data blocks of an inode. Device, FIFO and socket
+// inodes have none, and neither do inodes with inline data or fast
+// symlinks, which keep their contents in the inode.
+func (c *checker) claimBlocks(inodeNum uint32, ino inode, p string) {
+	typ := ino.mode & 0xF000
+	if typ != 0x8000 && typ != 0x4000 && typ != 0xA000 || ino.flags&inodeFlagInlineData != 0 {
+		return
+	}
+	dataBlocks := ino.blocks
+	if ino.fileACL != 0 {
+		dataBlocks -= min(dataBlocks, uint64(c.fs.blockSize/512)) // The extended attribute block
+	}
+	if typ == 0xA000 && dataBlocks == 0 {
+		return
+	}
+
+	blockSize := int64(c.fs.blockSize)
+	add := func(start, count uint64) {
+		if start+count > c.fs.sb.blocksCount {
+			c.report("bad-block", "%s: blocks %d-%d are past the end of the filesystem", p, start, start+count-1)
+			return
+		}
+		c.claims = append(c.claims, claim{int64(start) * blockSize, int64(start+count) * blockSize, inodeNum})
+	}
+
+	if ino.flags&inodeFlagExtents != 0 {
+		err := c.fs.walkExtentTree(ino, func(e extent) error {
+			length := uint64(e.len)
+			if length > 0x8000 {
+				length -= 0x8000 // Uninitialized extent
+			}
+			add(uint64(e.startLo)|uint64(e.startHi)<<32, length)
+			return nil
+		})
+		if err != nil {
+			c.report("unreadable", "%s: reading extent tree: %v", p, err)
+		}
+		return
+	}
+
+	extents, err := c.fs.getBlockPointerExtents(ino, int64(ino.size))
+	if err != nil {
+		c.report("unreadable", "%s: reading block pointers: %v", p, err)
+		return
+	}
+	for _, e := range extents {
+		add(uint64(e.Physical/blockSize), uint64((e.Length+blockSize-1)/blockSize))
+	}
+}
+
+// checkLinks compares the link count of every inode reached with the
+// directory entries referring to it. A directory is referred to by its
+// own "." and by ".." in each subdirectory, besides its parent's entry.
+func (c *checker) checkLinks() {
+	nums := make([]uint32, 0, len(c.nodes))
+	for n := range c.nodes {
+		nums = append(nums, n)
+	}
+	slices.Sort(nums)
+	for _, n := range nums {
+		node := c.nodes[n]
+		if node.isDir && node.linksCount == 1 {
+			continue // dir_nlink: too many subdirectories to count
+		}
+		if refs := c.refs[n]; refs != int(node.linksCount) {
+			c.report("link-count", "%s: inode %d has link count %d but %d directory entries", node.path, n, node.linksCount, refs)
+		}
+	}
+}
+
+// checkClaims reports blocks that more than one inode claims, and claimed
+// blocks that the block bitmap marks free. Each inode is reported once
+// for each kind of problem.
+func (c *checker) checkClaims() error {
+	free, err := c.fs.FreeBlocks()
+	if err != nil {
+		return err
+	}
+	blockSize := int64(c.fs.blockSize)
+	slices.SortFunc(c.claims, func(a, b claim) int { return cmp.Compare(a.start, b.start) })
+
+	crossLinked := make(map[[2]uint32]bool)
+	markedFree := make(map[uint32]bool)
+	var last claim // The claim reaching furthest so far
+	i := 0
+	for _, cl := range c.claims {
+		if cl.start < last.end && cl.inodeNum != last.inodeNum {
+			pair := [2]uint32{min(cl.inodeNum, last.inodeNum), max(cl.inodeNum, last.inodeNum)}
+			if !crossLinked[pair] {
+				crossLinked[pair] = true
+				c.report("cross-link", "%s: block %d is also used by %s", c.nodes[cl.inodeNum].path, cl.start/blockSize, c.nodes[last.inodeNum].path)
+			}
+		}
+		if cl.end > last.end {
+			last = cl
+		}
+
+		for i < len(free) && free[i].End <= cl.start {
+			i++
+		}
+		if i < len(free) && free[i].Start < cl.end && !markedFree[cl.inodeNum] {
+			markedFree[cl.inodeNum] = true
+			c.report("free-in-use", "%s: block %d is marked free in the block bitmap", c.nodes[cl.inodeNum].path, max(cl.start, free[i].Start)/blockSize)
+		}
+	}
+	return nil
+}
+
+// Metadata returns the superblock in use and the group descriptors and,
+// if record is not negative, the inode it numbers
+func (f *FS) Metadata(record int64) (any, error) {
+	sb := f.sb
+	m := metadata{Superblock: superblockMeta{
+		Offset:           superblockOffset,
+		Group:            f.sbGroup,
+		InodesCount:      sb.inodesCount,
+		BlocksCount:      sb.blocksCount,
+		FreeBlocksCount:  sb.freeBlocksCount,
+		FreeInodesCount:  sb.freeInodesCount,
+		FirstDataBlock:   sb.firstDataBlock,
+		BlockSize:        f.blockSize,
+		ClusterSize:      1024 << sb.logClusterSize,
+		BlocksPerGroup:   sb.blocksPerGroup,
+		ClustersPerGroup: sb.clustersPerGroup,
+		InodesPerGroup:   sb.inodesPerGroup,
+		MountTime:        extTime(sb.mtime, 0).UTC(),
+		WriteTime:        extTime(sb.wtime, 0).UTC(),
+		MountCount:       sb.mntCount,
+		MaxMountCount:    sb.maxMntCount,
+		Magic:            sb.magic,
+		State:            sb.state,
+		Errors:           sb.errors,
+		LastCheck:        extTime(sb.lastcheck, 0).UTC(),
+		CheckInterval:    sb.checkinterval,
+		CreatorOS:        sb.creatorOS,
+		RevLevel:         sb.revLevel,
+		MinorRevLevel:    sb.minorRevLevel,
+		DefResuid:        sb.defResuid,
+		DefResgid:        sb.defResgid,
+		FirstIno:         sb.firstIno,
+		InodeSize:        sb.inodeSize,
+		BlockGroupNr:     sb.blockGroupNr,
+		FeatureCompat:    sb.featureCompat,
+		FeatureIncompat:  sb.featureIncompat,
+		FeatureROCompat:  sb.featureROCompat,
+		UUID:             fmt.Sprintf("%x-%x-%x-%x-%x", sb.uuid[0:4], sb.uuid[4:6], sb.uuid[6:8], sb.uuid[8:10], sb.uuid[10:16]),
+		VolumeName:       f.Label(),
+		DescSize:         sb.descSize,
+		GroupCount:       sb.groupCount,
+	}}
+	if f.sbGroup > 0 {
+		m.Superblock.Offset = f.blockOffset(uint64(sb.firstDataBlock) + uint64(f.sbGroup)*uint64(sb.blocksPerGroup))
+	}
+
+	for group := uint32(0); group < sb.groupCount; group++ {
+		bgd, err := f.readBlockGroupDescriptor(group)
+		if err != nil {
+			return nil, fmt.Errorf("reading block group descriptor %d: %w", group, err)
+		}
+		m.GroupDescriptors = append(m.GroupDescriptors, groupMeta{
+			Group:           group,
+			BlockBitmap:     bgd.blockBitmap,
+			InodeBitmap:     bgd.inodeBitmap,
+			InodeTable:      bgd.inodeTable,
+			FreeBlocksCount: bgd.freeBlocksCount,
+			FreeInodesCount: bgd.freeInodesCount,
+			UsedDirsCount:   bgd.usedDirsCount,
+			Flags:           bgd.flags,
+		})
+	}
+
+	if record >= 0 {
+		if record == 0 || record > int64(sb.inodesCount) {
+			return nil, fmt.Errorf("inode %d out of range 1-%d", record, sb.inodesCount)
+		}
+		num := uint32(record)
+		offset, err := f.inodeOffset(num)
+		if err != nil {
+			return nil, fmt.Errorf("locating inode %d: %w", num, err)
+		}
+		ino, err := f.readInode(num)
+		if err != nil {
+			return nil, fmt.Errorf("reading inode %d: %w", num, err)
+		}
+		m.Inode = &inodeMeta{
+			Number:     num,
+			Offset:     offset,
+			Mode:       fmt.Sprintf("%06o", ino.mode),
+			UID:        ino.uid,
+			GID:        ino.gid,
+			Size:       ino.size,
+			LinksCount: ino.linksCount,
+			Blocks:     ino.blocks,
+			Flags:      ino.flags,
+			AccessTime: extTime(ino.atime, ino.atimeExtra).UTC(),
+			ChangeTime: extTime(ino.ctime, ino.ctimeExtra).UTC(),
+			ModifyTime: extTime(ino.mtime, ino.mtimeExtra).UTC(),
+			CreateTime: extTime(ino.crtime, ino.crtimeExtra).UTC(),
+			DeleteTime: ino.dtime,
+			FileACL:    ino.fileACL,
+			Block:      fmt.Sprintf("%x", ino.block),
+		}
+	}
+
+	return m, nil
+}
+
+// metadata is what Metadata returns
+type metadata struct {
+	Superblock       superblockMeta `json:"superblock"`
+	GroupDescriptors []groupMeta    `json:"groupDescriptors"`
+	Inode            *inodeMeta     `json:"inode,omitempty"`
+}
+
+type superblockMeta struct {
+	Offset           int64     `json:"offset"`
+	Group            uint32    `json:"group"` // Block group of the copy in use
+	InodesCount      uint32    `json:"inodesCount"`
+	BlocksCount      uint64    `json:"blocksCount"`
+	FreeBlocksCount  uint64    `json:"freeBlocksCount"`
+	FreeInodesCount  uint32    `json:"freeInodesCount"`
+	FirstDataBlock   uint32    `json:"firstDataBlock"`
+	BlockSize        uint32    `json:"blockSize"`
+	ClusterSize      uint32    `json:"clusterSize"`
+	BlocksPerGroup   uint32    `json:"blocksPerGroup"`
+	ClustersPerGroup uint32    `json:"clustersPerGroup"`
+	InodesPerGroup   uint32    `json:"inodesPerGroup"`
+	MountTime        time.Time `json:"mountTime"`
+	WriteTime        time.Time `json:"writeTime"`
+	MountCount       uint16    `json:"mountCount"`
+	MaxMountCount    int16     `json:"maxMountCount"`
+	Magic            uint16    `json:"magic"`
+	State            uint16    `json:"state"`
+	Errors           uint16    `json:"errors"`
+	LastCheck        time.Time `json:"lastCheck"`
+	CheckInterval    uint32    `json:"checkInterval"`
+	CreatorOS        uint32    `json:"creatorOS"`
+	RevLevel         uint32    `json:"revLevel"`
+	MinorRevLevel    uint16    `json:"minorRevLevel"`
+	DefResuid        uint16    `json:"defResuid"`
+	DefResgid        uint16    `json:"defResgid"`
+	FirstIno         uint32    `json:"firstIno"`
+	InodeSize        uint16    `json:"inodeSize"`
+	BlockGroupNr     uint16    `json:"blockGroupNr"`
+	FeatureCompat    uint32    `json:"featureCompat"`
+	FeatureIncompat  uint32    `json:"featureIncompat"`
+	FeatureROCompat  uint32    `json:"featureROCompat"`
+	UUID             string    `json:"uuid"`
+	VolumeName       string    `json:"volumeName"`
+	DescSize         uint16    `json:"descSize"`
+	GroupCount       uint32    `json:"groupCount"`
+}
+
+type groupMeta struct {
+	Group           uint32 `json:"group"`
+	BlockBitmap     uint64 `json:"blockBitmap"`
+	InodeBitmap     uint64 `json:"inodeBitmap"`
+	InodeTable      uint64 `json:"inodeTable"`
+	FreeBlocksCount uint32 `json:"freeBlocksCount"`
+	FreeInodesCount uint32 `json:"freeInodesCount"`
+	UsedDirsCount   uint32 `json:"usedDirsCount"`
+	Flags           uint16 `json:"flags"`
+}
+
+type inodeMeta struct {
+	Number     uint32    `json:"number"`
+	Offset     int64     `json:"offset"`
+	Mode       string    `json:"mode"` // Octal, with the file type
+	UID        uint32    `json:"uid"`
+	GID        uint32    `json:"gid"`
+	Size       uint64    `json:"size"`
+	LinksCount uint16    `json:"linksCount"`
+	Blocks     uint64    `json:"blocks"` // In 512-byte sectors
+	Flags      uint32    `json:"flags"`
+	AccessTime time.Time `json:"accessTime"`
+	ChangeTime time.Time `json:"changeTime"`
+	ModifyTime time.Time `json:"modifyTime"`
+	CreateTime time.Time `json:"createTime"`
+	DeleteTime uint32    `json:"deleteTime"`
+	FileACL    uint64    `json:"fileACL"`
+	Block      string    `json:"block"` // The block map or extent tree root, in hex
+}
+
+// fs.FS implementation
+
+const rootInode = 2
+
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		ino, err := f.readInode(rootInode)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &extDir{fs: f, inode: ino, inodeNum: rootInode, name: "."}, nil
+	}
+
+	inodeNum, ino, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if ino.mode&0xF000 == 0x4000 {
+		return &extDir{fs: f, inode: ino, inodeNum: inodeNum, name: path.Base(name)}, nil
+	}
+
 	return &extFile{fs: f, inode: ino, inodeNum: inodeNum, name: path.Base(name)}, nil
 }
 
@@ -877,27 +1760,233 @@ func (f *FS) lookup(name string) (uint32, inode, error) {
 }
 
 func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.ReadDirFile(f, name)
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
 	file, err := f.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return file.Stat()
+}
 
-	dir, ok := file.(fs.ReadDirFile)
-	if !ok {
-		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+// ReadLink implements fsys.Symlinker
+func (f *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	_, ino, err := f.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if ino.mode&0xF000 != 0xA000 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
 	}
+	data, err := f.readInodeData(ino, 0)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(data), nil
+}
 
-	return dir.ReadDir(-1)
+// Lstat implements fsys.Symlinker; Stat does not follow symlinks either
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	return f.Stat(name)
 }
 
-func (f *FS) Stat(name string) (fs.FileInfo, error) {
-	file, err := f.Open(name)
+// Extended attributes
+
+// xattrMagic starts the attributes after the fixed part of a large inode,
+// and the attribute block
+const xattrMagic = 0xEA020000
+
+// xattrBlockHeaderSize is the size of the header of an attribute block,
+// which its entries follow
+const xattrBlockHeaderSize = 32
+
+// xattrPrefixes gives the name prefix of each name index of an entry; the
+// ACL indexes stand for a whole name
+var xattrPrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+	7: "system.",
+	8: "system.richacl",
+}
+
+// xattrs returns the extended attributes of an inode, those in the inode
+// and those in its attribute block. The system.data attribute, which holds
+// the rest of inline data, is left out.
+func (f *FS) xattrs(inodeNum uint32, ino inode) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	if f.sb.inodeSize > 0x82 {
+		data := make([]byte, f.sb.inodeSize)
+		if _, err := f.r.ReadAt(data, ino.offset); err != nil {
+			return nil, err
+		}
+		start := 0x80 + int(binary.LittleEndian.Uint16(data[0x80:0x82]))
+		if start+4 <= len(data) && binary.LittleEndian.Uint32(data[start:]) == xattrMagic {
+			err := f.parseXattrs(data[start+4:], 0, attrs, fmt.Sprintf("extended attributes of inode %d", inodeNum), ino.offset+int64(start))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ino.fileACL != 0 {
+		block, err := f.readBlock(ino.fileACL)
+		if err != nil {
+			return nil, err
+		}
+		where := fmt.Sprintf("extended attribute block %d of inode %d", ino.fileACL, inodeNum)
+		if binary.LittleEndian.Uint32(block) != xattrMagic {
+			return nil, fsys.Corrupt(where, f.blockOffset(ino.fileACL), "bad magic %#x", binary.LittleEndian.Uint32(block))
+		}
+		if err := f.parseXattrs(block, xattrBlockHeaderSize, attrs, where, f.blockOffset(ino.fileACL)); err != nil {
+			return nil, err
+		}
+	}
+	delete(attrs, "system.data")
+	return attrs, nil
+}
+
+// parseXattrs adds the attributes of the entries in area from start, whose
+// values are at offsets in area or in inodes of their own, to attrs. The
+// entries are 16 bytes and the name, padded to four bytes, and end with
+// four zero bytes.
+func (f *FS) parseXattrs(area []byte, start int, attrs map[string][]byte, where string, offset int64) error {
+	for off := start; off+4 <= len(area) && binary.LittleEndian.Uint32(area[off:]) != 0; {
+		if off+16 > len(area) {
+			return fsys.Corrupt(where, offset, "entry at %d overruns the attributes", off)
+		}
+		nameLen, index := int(area[off]), area[off+1]
+		valueOffset := int(binary.LittleEndian.Uint16(area[off+2:]))
+		valueInode := binary.LittleEndian.Uint32(area[off+4:])
+		valueSize := int(binary.LittleEndian.Uint32(area[off+8:]))
+		if off+16+nameLen > len(area) {
+			return fsys.Corrupt(where, offset, "name of entry at %d overruns the attributes", off)
+		}
+		name := string(area[off+16 : off+16+nameLen])
+		off += (16 + nameLen + 3) &^ 3
+
+		prefix, ok := xattrPrefixes[index]
+		if !ok {
+			continue // A namespace Linux does not show either
+		}
+		var value []byte
+		if valueInode != 0 {
+			// The ea_inode feature keeps large values in inodes
+			ino, err := f.readInode(valueInode)
+			if err != nil {
+				return fmt.Errorf("%s: value of %s%s: %w", where, prefix, name, err)
+			}
+			if value, err = f.readInodeData(ino, int64(valueSize)); err != nil {
+				return fmt.Errorf("%s: value of %s%s: %w", where, prefix, name, err)
+			}
+			if len(value) != valueSize {
+				return fsys.Corrupt(where, offset, "value of %s%s is %d bytes, want %d", prefix, name, len(value), valueSize)
+			}
+		} else {
+			if valueOffset+valueSize > len(area) {
+				return fsys.Corrupt(where, offset, "value of %s%s overruns the attributes", prefix, name)
+			}
+			value = area[valueOffset : valueOffset+valueSize]
+		}
+		if index == 2 || index == 3 {
+			var err error
+			if value, err = posixACL(value); err != nil {
+				return fsys.Corrupt(where, offset, "%s: %v", prefix, err)
+			}
+		}
+		attrs[prefix+name] = value
+	}
+	return nil
+}
+
+// ACL entry tags that are followed by a user or group ID
+const (
+	aclUser  = 0x02
+	aclGroup = 0x08
+)
+
+// posixACL converts an ACL from the compact form ext stores, where only
+// the entries of named users and groups have an ID, to the form of the
+// system.posix_acl_* attributes of Linux, where every entry has one
+func posixACL(stored []byte) ([]byte, error) {
+	if len(stored) < 4 || binary.LittleEndian.Uint32(stored) != 1 {
+		return nil, fmt.Errorf("not a version 1 ACL")
+	}
+	acl := binary.LittleEndian.AppendUint32(nil, 2)
+	for b := stored[4:]; len(b) > 0; {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("short ACL entry")
+		}
+		tag, perm := binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
+		id, n := uint32(0xFFFFFFFF), 4
+		if tag == aclUser || tag == aclGroup {
+			if len(b) < 8 {
+				return nil, fmt.Errorf("short ACL entry")
+			}
+			id, n = binary.LittleEndian.Uint32(b[4:]), 8
+		}
+		acl = binary.LittleEndian.AppendUint16(acl, tag)
+		acl = binary.LittleEndian.AppendUint16(acl, perm)
+		acl = binary.LittleEndian.AppendUint32(acl, id)
+		b = b[n:]
+	}
+	return acl, nil
+}
+
+// namedXattrs looks up a file and reads its extended attributes
+func (f *FS) namedXattrs(op, name string) (map[string][]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	inodeNum, ino := uint32(rootInode), inode{}
+	var err error
+	if name == "." {
+		ino, err = f.readInode(rootInode)
+	} else {
+		inodeNum, ino, err = f.lookup(name)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	attrs, err := f.xattrs(inodeNum, ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return attrs, nil
+}
+
+// ListXattr implements fsys.XattrFS
+func (f *FS) ListXattr(name string) ([]string, error) {
+	attrs, err := f.namedXattrs("listxattr", name)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	return file.Stat()
+	names := make([]string, 0, len(attrs))
+	for n := range attrs {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// GetXattr implements fsys.XattrFS
+func (f *FS) GetXattr(name, attr string) ([]byte, error) {
+	attrs, err := f.namedXattrs("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[attr]
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fsys.ErrNoXattr}
+	}
+	return value, nil
 }
 
 // extFile implements fs.File for regular files
@@ -917,6 +2006,9 @@ func (f *extFile) Stat() (fs.FileInfo, error) {
 
 func (f *extFile) Read(b []byte) (int, error) {
 	if !f.loaded {
+		if f.inode.flags&inodeFlagEncrypt != 0 && f.inode.mode&0xF000 == 0x8000 {
+			return 0, fmt.Errorf("inode %d: %w", f.inodeNum, fsys.ErrEncrypted)
+		}
 		var err error
 		f.data, err = f.fs.readInodeData(f.inode, 0)
 		if err != nil {
@@ -945,8 +2037,8 @@ type extDir struct {
 	inode    inode
 	inodeNum uint32
 	name     string
-	entries  []fs.DirEntry
-	offset   int
+	dir      *dirReader    // Set by the first ReadDir
+	pending  []fs.DirEntry // Entries read but not yet returned
 }
 
 func (d *extDir) Stat() (fs.FileInfo, error) {
@@ -958,43 +2050,44 @@ func (d *extDir) Read(b []byte) (int, error) {
 }
 
 func (d *extDir) Close() error {
-	d.entries = nil
+	d.dir, d.pending = nil, nil
 	return nil
 }
 
+// ReadDir reads the directory a few blocks at a time, as far as it needs
+// to for n entries
 func (d *extDir) ReadDir(n int) ([]fs.DirEntry, error) {
-	if d.entries == nil {
-		rawEntries, err := d.fs.readDirectory(d.inode)
+	if d.dir == nil {
+		dir, err := d.fs.newDirReader(d.inode)
 		if err != nil {
 			return nil, err
 		}
+		d.dir = dir
+	}
 
-		d.entries = make([]fs.DirEntry, 0, len(rawEntries))
-		for _, e := range rawEntries {
-			if e.name == "." || e.name == ".." {
-				continue
+	for n <= 0 || len(d.pending) < n {
+		batch, err := d.dir.next()
+		if err != nil {
+			return nil, err
+		}
+		if batch == nil {
+			break
+		}
+		for _, e := range batch {
+			if e.name != "." && e.name != ".." {
+				d.pending = append(d.pending, &extDirEntry{fs: d.fs, entry: e})
 			}
-			d.entries = append(d.entries, &extDirEntry{fs: d.fs, entry: e})
 		}
 	}
 
-	if n <= 0 {
-		entries := d.entries[d.offset:]
-		d.offset = len(d.entries)
-		return entries, nil
-	}
-
-	if d.offset >= len(d.entries) {
+	if n > 0 && len(d.pending) == 0 {
 		return nil, io.EOF
 	}
-
-	end := d.offset + n
-	if end > len(d.entries) {
-		end = len(d.entries)
+	entries := d.pending
+	if n > 0 && len(entries) > n {
+		entries = entries[:n:n]
 	}
-
-	entries := d.entries[d.offset:end]
-	d.offset = end
+	d.pending = d.pending[len(entries):]
 	return entries, nil
 }
 
@@ -1040,10 +2133,50 @@ type extFileInfo struct {
 
 func (i *extFileInfo) Name() string       { return i.name }
 func (i *extFileInfo) Size() int64        { return int64(i.inode.size) }
-func (i *extFileInfo) ModTime() time.Time { return time.Unix(int64(i.inode.mtime), 0) }
+func (i *extFileInfo) ModTime() time.Time { return extTime(i.inode.mtime, i.inode.mtimeExtra) }
 func (i *extFileInfo) IsDir() bool        { return i.inode.mode&0xF000 == 0x4000 }
-func (i *extFileInfo) Sys() any           { return nil }
 func (i *extFileInfo) Inode() uint64      { return uint64(i.inodeNum) }
+func (i *extFileInfo) Links() uint64      { return uint64(i.inode.linksCount) }
+
+// Attributes is the ext metadata of a file that fs.FileInfo has no place
+// for, returned by the Sys method of its FileInfo
+type Attributes struct {
+	Inode      uint32
+	Flags      uint32 // Inode flags as lsattr shows them, such as 0x10 immutable, 0x20 append only and 0x80000 extents
+	Generation uint32 // Inode generation, which NFS file handles carry
+	Blocks     uint64 // Space taken, in 512-byte sectors, or in blocks with the huge file flag 0x40000
+	FileACL    uint64 // Block of extended attributes, 0 if there is none
+}
+
+// Sys returns the file's *Attributes
+func (i *extFileInfo) Sys() any {
+	return &Attributes{
+		Inode:      i.inodeNum,
+		Flags:      i.inode.flags,
+		Generation: i.inode.generation,
+		Blocks:     i.inode.blocks,
+		FileACL:    i.inode.fileACL,
+	}
+}
+
+func (i *extFileInfo) Owner() (user, group string) {
+	return strconv.FormatUint(uint64(i.inode.uid), 10), strconv.FormatUint(uint64(i.inode.gid), 10)
+}
+
+func (i *extFileInfo) AccessTime() time.Time { return extTime(i.inode.atime, i.inode.atimeExtra) }
+func (i *extFileInfo) ChangeTime() time.Time { return extTime(i.inode.ctime, i.inode.ctimeExtra) }
+func (i *extFileInfo) BirthTime() time.Time {
+	if i.inode.crtime == 0 && i.inode.crtimeExtra == 0 {
+		return time.Time{}
+	}
+	return extTime(i.inode.crtime, i.inode.crtimeExtra)
+}
+
+// extTime converts an inode time: signed seconds, extended past 2038 by
+// the two low bits of the extra field, whose upper bits are nanoseconds
+func extTime(sec, extra uint32) time.Time {
+	return time.Unix(int64(int32(sec))+int64(extra&3)<<32, int64(extra>>2))
+}
 
 func (i *extFileInfo) Mode() fs.FileMode {
 	mode := fs.FileMode(i.inode.mode & 0777)
@@ -0,0 +1,154 @@
+package ext
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// TestReadDirPaging reads a directory of many blocks a few entries at a
+// time, as far as each call needs to
+func TestReadDirPaging(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "big"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := range 600 {
+		name := fmt.Sprintf("a file name long enough to fill blocks quickly %04d", i)
+		if err := os.WriteFile(filepath.Join(root, "big", name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	name := filepath.Join(dir, "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-b", "1024", "-d", root, name, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+	image, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	info, err := image.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filesystem, err := Open(image, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := filesystem.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d := f.(*extDir)
+	if d.inode.size <= dirReadBlocks*1024 {
+		t.Fatalf("the directory has %d bytes, too few for several reads", d.inode.size)
+	}
+
+	var got []string
+	for {
+		entries, err := d.ReadDir(7)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 || len(entries) > 7 {
+			t.Fatalf("ReadDir(7) returned %d entries", len(entries))
+		}
+		if len(got) == 0 && d.dir.offset >= int64(d.inode.size) {
+			t.Errorf("the first ReadDir(7) read all %d bytes of the directory", d.inode.size)
+		}
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+	}
+	if entries, err := d.ReadDir(7); len(entries) != 0 || err != io.EOF {
+		t.Errorf("ReadDir(7) at the end = %d entries, %v", len(entries), err)
+	}
+
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("read %d entries, want the %d files", len(got), len(want))
+	}
+}
+
+// TestEncryptedExtents checks that an fscrypt file is refused, rather than
+// its ciphertext read in place through its extents
+func TestEncryptedExtents(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"secret", "plain"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("ciphertext of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-d", root, name, "4M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+	// Extents and encryption
+	if out, err := exec.Command(debugfs, "-w", "-R", "set_inode_field /secret flags 0x80800", name).CombinedOutput(); err != nil {
+		t.Fatalf("debugfs: %v\n%s", err, out)
+	}
+	image, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	info, err := image.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filesystem, err := Open(image, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := filesystem.(*FS).FileExtents("secret"); !errors.Is(err, fsys.ErrEncrypted) {
+		t.Errorf("FileExtents(secret) = %v, want ErrEncrypted", err)
+	}
+	if r, _, err := fsys.OpenReaderAt(filesystem, "secret"); !errors.Is(err, fsys.ErrEncrypted) {
+		t.Errorf("OpenReaderAt(secret) = %v, want ErrEncrypted", err)
+		if r != nil {
+			r.Close()
+		}
+	}
+	r, size, err := fsys.OpenReaderAt(filesystem, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, 0); err != nil || string(data) != "ciphertext of plain" {
+		t.Errorf("OpenReaderAt(plain) read %q, %v", data, err)
+	}
+}
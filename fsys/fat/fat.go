@@ -1,25 +1,46 @@
-// Package fat implements read-only FAT12/16/32 filesystem support.
+// Package fat implements FAT12/16/32 filesystem support: reading, and
+// creating and replacing files in the image itself.
 package fat
 
 import (
+	"cmp"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math/bits"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
 
+	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
 )
 
-// FS implements a read-only FAT filesystem
+// maxCachedDirs bounds the number of parsed directories kept per FS
+const maxCachedDirs = 256
+
+// FS implements a FAT filesystem
 type FS struct {
-	r    io.ReaderAt
+	r    *fsys.CachedReaderAt // The image, through the block cache
+	base io.ReaderAt
 	size int64
 	bpb  bpb
 	fat  fatTable
 	typ  string
+
+	backupBoot bool // The primary boot sector is damaged; the backup copy is used
+
+	// dirCache holds parsed directories keyed by first cluster (0 = root)
+	dirCacheMu sync.Mutex
+	dirCache   map[uint32][]dirEntry
+
+	writeMu sync.Mutex // Held while the image is written
 }
 
 // bpb contains the BIOS Parameter Block fields we need
@@ -36,14 +57,40 @@ type bpb struct {
 	dataSectors       uint32
 	countOfClusters   uint32
 	isFAT32           bool
+	fsInfoSector      uint16 // FAT32 only
+	ntFlags           uint8  // Reserved byte used by Windows NT: bit 0 = dirty
+	extBootSig        uint8  // 0x29 if the volume ID and label fields are present
+	volumeID          uint32
+	volumeLabel       string
 }
 
 // fatTable provides access to the FAT
 type fatTable struct {
 	r           io.ReaderAt
 	startOffset int64
+	size        int64 // Bytes in one copy of the table
 	isFAT32     bool
 	isFAT12     bool
+	data        []byte     // In-memory copy of the table; if nil, entries are read from r
+	window      *fatWindow // Part of the table read last, for a table from bulk
+}
+
+// fatWindow is a run of the table read at once from the image
+type fatWindow struct {
+	start int64
+	data  []byte
+}
+
+// maxFATWindow bounds the run of the table a bulk reader reads at once. It
+// reads a block at first, and twice as much each time it reads on from
+// the end of the last run, so that a short chain reads little and a scan
+// of the whole table few large runs.
+const maxFATWindow = 1 << 20
+
+func init() {
+	for _, t := range []detect.Type{detect.FAT12, detect.FAT16, detect.FAT32} {
+		fsys.Register(t, Open)
+	}
 }
 
 // Open opens a FAT filesystem from the given reader
@@ -53,20 +100,26 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 		return nil, fmt.Errorf("reading boot sector: %w", err)
 	}
 
-	// Verify boot sector signature
+	// Verify boot sector signature, falling back to the FAT32 backup copy
+	backup := false
+	var offset int64
 	if header[510] != 0x55 || header[511] != 0xAA {
-		return nil, nil // Not a FAT filesystem
+		if header, offset = backupBootSector(r); header == nil {
+			return nil, nil // Not a FAT filesystem
+		}
+		backup = true
 	}
 
-	fs := &FS{r: r, size: size}
-	if err := fs.parseBPB(header); err != nil {
+	fs := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size, dirCache: make(map[uint32][]dirEntry), backupBoot: backup}
+	if err := fs.parseBPB(header, offset); err != nil {
 		return nil, err
 	}
 
 	// Set up FAT table access
 	fs.fat = fatTable{
-		r:           r,
+		r:           fs.r,
 		startOffset: int64(fs.bpb.reservedSectors) * int64(fs.bpb.bytesPerSector),
+		size:        int64(fs.bpb.fatSize) * int64(fs.bpb.bytesPerSector),
 		isFAT32:     fs.bpb.isFAT32,
 		isFAT12:     fs.bpb.countOfClusters < 4085,
 	}
@@ -74,7 +127,26 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 	return fs, nil
 }
 
-func (f *FS) parseBPB(header []byte) error {
+// backupBootSector returns the FAT32 backup boot sector, conventionally in
+// sector 6, and its offset, or nil if there is none. The sector size is
+// unknown when the primary is damaged, so each one is tried.
+func backupBootSector(r io.ReaderAt) ([]byte, int64) {
+	header := make([]byte, 512)
+	for ss := 512; ss <= 4096; ss *= 2 {
+		if _, err := r.ReadAt(header, int64(6*ss)); err != nil {
+			return nil, 0
+		}
+		if header[510] == 0x55 && header[511] == 0xAA && string(header[82:90]) == "FAT32   " &&
+			int(binary.LittleEndian.Uint16(header[11:13])) == ss {
+			return header, int64(6 * ss)
+		}
+	}
+	return nil, 0
+}
+
+// parseBPB decodes the BIOS parameter block of the boot sector read from
+// offset
+func (f *FS) parseBPB(header []byte, offset int64) error {
 	f.bpb.bytesPerSector = binary.LittleEndian.Uint16(header[11:13])
 	f.bpb.sectorsPerCluster = header[13]
 	f.bpb.reservedSectors = binary.LittleEndian.Uint16(header[14:16])
@@ -91,17 +163,43 @@ func (f *FS) parseBPB(header []byte) error {
 		f.bpb.totalSectors = totalSectors32
 	}
 
+	// The extended BPB follows the common fields at offset 36 (FAT12/16)
+	// or after the FAT32-specific fields at offset 64
+	extBPB := 36
 	if fatSize16 != 0 {
 		f.bpb.fatSize = uint32(fatSize16)
 		f.bpb.isFAT32 = false
 	} else {
 		f.bpb.fatSize = binary.LittleEndian.Uint32(header[36:40])
 		f.bpb.rootCluster = binary.LittleEndian.Uint32(header[44:48])
+		f.bpb.fsInfoSector = binary.LittleEndian.Uint16(header[48:50])
 		f.bpb.isFAT32 = true
+		extBPB = 64
+	}
+
+	f.bpb.ntFlags = header[extBPB+1]
+	f.bpb.extBootSig = header[extBPB+2]
+	if f.bpb.extBootSig == 0x29 {
+		f.bpb.volumeID = binary.LittleEndian.Uint32(header[extBPB+3 : extBPB+7])
+		f.bpb.volumeLabel = strings.TrimRight(string(header[extBPB+7:extBPB+18]), " ")
+	}
+
+	ss, spc := f.bpb.bytesPerSector, f.bpb.sectorsPerCluster
+	if ss < 512 || ss > 4096 || ss&(ss-1) != 0 {
+		return fsys.Corrupt("boot sector", offset, "invalid sector size %d", ss)
+	}
+	if spc == 0 || spc&(spc-1) != 0 {
+		return fsys.Corrupt("boot sector", offset, "invalid sectors per cluster %d", spc)
+	}
+	if f.bpb.numFATs == 0 || f.bpb.fatSize == 0 {
+		return fsys.Corrupt("boot sector", offset, "no FATs")
 	}
 
 	rootDirSectors := ((uint32(f.bpb.rootEntryCount) * 32) + uint32(f.bpb.bytesPerSector) - 1) / uint32(f.bpb.bytesPerSector)
 	f.bpb.firstDataSector = uint32(f.bpb.reservedSectors) + (uint32(f.bpb.numFATs) * f.bpb.fatSize) + rootDirSectors
+	if f.bpb.firstDataSector >= f.bpb.totalSectors {
+		return fsys.Corrupt("boot sector", offset, "the %d sectors end before the data area at sector %d", f.bpb.totalSectors, f.bpb.firstDataSector)
+	}
 	f.bpb.dataSectors = f.bpb.totalSectors - f.bpb.firstDataSector
 	f.bpb.countOfClusters = f.bpb.dataSectors / uint32(f.bpb.sectorsPerCluster)
 
@@ -121,7 +219,446 @@ func (f *FS) parseBPB(header []byte) error {
 
 func (f *FS) Type() string            { return f.typ }
 func (f *FS) Close() error            { return nil }
-func (f *FS) BaseReader() io.ReaderAt { return f.r }
+func (f *FS) BaseReader() io.ReaderAt { return f.base }
+
+// Info returns filesystem information as a formatted string
+func (f *FS) Info() string {
+	var sb strings.Builder
+	clusterSize := int64(f.clusterSize())
+
+	fmt.Fprintf(&sb, "%s Volume\n", f.typ)
+	if f.backupBoot {
+		fmt.Fprintf(&sb, "  Boot sector: backup copy (primary damaged)\n")
+	}
+	if label, err := f.rootVolumeLabel(); err == nil && label != "" {
+		fmt.Fprintf(&sb, "  Label: %s\n", label)
+	}
+	if f.bpb.extBootSig == 0x29 {
+		fmt.Fprintf(&sb, "  BPB label: %s\n", f.bpb.volumeLabel)
+		fmt.Fprintf(&sb, "  Serial number: %04X-%04X\n", f.bpb.volumeID>>16, f.bpb.volumeID&0xFFFF)
+	}
+	fmt.Fprintf(&sb, "  Bytes per sector: %d\n", f.bpb.bytesPerSector)
+	fmt.Fprintf(&sb, "  Cluster size: %d bytes\n", clusterSize)
+	fmt.Fprintf(&sb, "  FATs: %d (%d sectors each)\n", f.bpb.numFATs, f.bpb.fatSize)
+	fmt.Fprintf(&sb, "  Total clusters: %d\n", f.bpb.countOfClusters)
+
+	if free, source, err := f.freeClusterCount(); err == nil {
+		fmt.Fprintf(&sb, "  Free clusters: %d (%d bytes, %s)\n", free, int64(free)*clusterSize, source)
+	}
+
+	state := "clean"
+	if dirty, err := f.isDirty(); err != nil {
+		state = "unknown"
+	} else if dirty {
+		state = "dirty"
+	}
+	fmt.Fprintf(&sb, "  State: %s", state)
+
+	return sb.String()
+}
+
+// Label returns the volume label from the root directory, or from the
+// boot sector if the root directory has none
+func (f *FS) Label() string {
+	if label, err := f.rootVolumeLabel(); err == nil && label != "" {
+		return label
+	}
+	if f.bpb.extBootSig == 0x29 && f.bpb.volumeLabel != "NO NAME" {
+		return f.bpb.volumeLabel
+	}
+	return ""
+}
+
+// BlockSize implements fsys.BlockSizer with the cluster size
+func (f *FS) BlockSize() int64 { return int64(f.clusterSize()) }
+
+// rootVolumeLabel returns the volume label stored as an entry in the root directory
+func (f *FS) rootVolumeLabel() (string, error) {
+	data, err := f.readRootDirData()
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i+32 <= len(data); i += 32 {
+		entry := data[i : i+32]
+		if entry[0] == 0x00 {
+			break
+		}
+		if entry[0] == 0xE5 {
+			continue
+		}
+		attr := entry[11]
+		if attr != attrLFN && attr&attrVolumeID != 0 {
+			return strings.TrimRight(string(entry[0:11]), " "), nil
+		}
+	}
+	return "", nil
+}
+
+// freeClusterCount returns the number of free clusters, taken from the
+// FAT32 FSInfo sector when it holds a plausible value and counted from the
+// FAT otherwise. The second result names the source of the figure.
+func (f *FS) freeClusterCount() (uint32, string, error) {
+	if f.bpb.isFAT32 && f.bpb.fsInfoSector != 0 && f.bpb.fsInfoSector != 0xFFFF {
+		sector := make([]byte, 512)
+		offset := int64(f.bpb.fsInfoSector) * int64(f.bpb.bytesPerSector)
+		if _, err := f.r.ReadAt(sector, offset); err == nil &&
+			binary.LittleEndian.Uint32(sector[0:4]) == 0x41615252 &&
+			binary.LittleEndian.Uint32(sector[484:488]) == 0x61417272 {
+			free := binary.LittleEndian.Uint32(sector[488:492])
+			if free <= f.bpb.countOfClusters {
+				return free, "FSInfo", nil
+			}
+		}
+	}
+
+	var free uint32
+	table := f.fat.bulk()
+	for cluster := uint32(2); cluster < f.bpb.countOfClusters+2; cluster++ {
+		entry, err := table.next(cluster)
+		if err != nil {
+			return 0, "", fmt.Errorf("reading FAT entry %d: %w", cluster, err)
+		}
+		if entry == 0 {
+			free++
+		}
+	}
+	return free, "counted", nil
+}
+
+// isDirty reports whether the volume was not cleanly unmounted or had I/O
+// errors, using the flags in FAT entry 1 (FAT16/32) and the Windows NT
+// dirty bit in the extended BPB.
+func (f *FS) isDirty() (bool, error) {
+	if f.bpb.ntFlags&0x01 != 0 {
+		return true, nil
+	}
+	if f.fat.isFAT12 {
+		return false, nil // FAT12 has no clean shutdown flags
+	}
+
+	entry, err := f.fat.next(1)
+	if err != nil {
+		return false, err
+	}
+	if f.fat.isFAT32 {
+		// Bit 27: clean shutdown, bit 26: no hard errors
+		return entry&0x08000000 == 0 || entry&0x04000000 == 0, nil
+	}
+	// Bit 15: clean shutdown, bit 14: no hard errors
+	return entry&0x8000 == 0 || entry&0x4000 == 0, nil
+}
+
+// maxLostChainsReported limits the number of lost chains reported individually
+const maxLostChainsReported = 100
+
+// Metadata returns the BIOS parameter block. FAT has no numbered records
+// to decode.
+func (f *FS) Metadata(record int64) (any, error) {
+	if record >= 0 {
+		return nil, fmt.Errorf("%s has no numbered records", f.typ)
+	}
+	b := f.bpb
+	m := bpbMeta{
+		Type:              f.typ,
+		BackupBootSector:  f.backupBoot,
+		BytesPerSector:    b.bytesPerSector,
+		SectorsPerCluster: b.sectorsPerCluster,
+		ReservedSectors:   b.reservedSectors,
+		NumFATs:           b.numFATs,
+		RootEntryCount:    b.rootEntryCount,
+		TotalSectors:      b.totalSectors,
+		FATSize:           b.fatSize,
+		RootCluster:       b.rootCluster,
+		FSInfoSector:      b.fsInfoSector,
+		FirstDataSector:   b.firstDataSector,
+		DataSectors:       b.dataSectors,
+		CountOfClusters:   b.countOfClusters,
+		NTFlags:           b.ntFlags,
+		ExtBootSig:        b.extBootSig,
+	}
+	if b.extBootSig == 0x29 {
+		m.VolumeID = fmt.Sprintf("%04X-%04X", b.volumeID>>16, b.volumeID&0xFFFF)
+		m.VolumeLabel = b.volumeLabel
+	}
+	return m, nil
+}
+
+type bpbMeta struct {
+	Type              string `json:"type"`
+	BackupBootSector  bool   `json:"backupBootSector"` // The primary is damaged
+	BytesPerSector    uint16 `json:"bytesPerSector"`
+	SectorsPerCluster uint8  `json:"sectorsPerCluster"`
+	ReservedSectors   uint16 `json:"reservedSectors"`
+	NumFATs           uint8  `json:"numFATs"`
+	RootEntryCount    uint16 `json:"rootEntryCount"`
+	TotalSectors      uint32 `json:"totalSectors"`
+	FATSize           uint32 `json:"fatSize"` // In sectors
+	RootCluster       uint32 `json:"rootCluster,omitempty"`
+	FSInfoSector      uint16 `json:"fsInfoSector,omitempty"`
+	FirstDataSector   uint32 `json:"firstDataSector"`
+	DataSectors       uint32 `json:"dataSectors"`
+	CountOfClusters   uint32 `json:"countOfClusters"`
+	NTFlags           uint8  `json:"ntFlags"`
+	ExtBootSig        uint8  `json:"extBootSig"`
+	VolumeID          string `json:"volumeID,omitempty"`
+	VolumeLabel       string `json:"volumeLabel,omitempty"`
+}
+
+// Check verifies the consistency of the FAT. It compares the FAT copies,
+// follows every cluster chain reachable from the directory tree to find
+// loops and cross-linked or broken chains, and reports allocated clusters
+// that no file owns as lost chains.
+func (f *FS) Check() ([]fsys.Problem, error) {
+	if f.bpb.numFATs == 0 {
+		return nil, fmt.Errorf("no FAT copies")
+	}
+
+	fatBytes := int64(f.bpb.fatSize) * int64(f.bpb.bytesPerSector)
+	copies := make([][]byte, f.bpb.numFATs)
+	for i := range copies {
+		copies[i] = make([]byte, fatBytes)
+		if _, err := f.r.ReadAt(copies[i], f.fat.startOffset+int64(i)*fatBytes); err != nil {
+			return nil, fmt.Errorf("reading FAT copy %d: %w", i, err)
+		}
+	}
+
+	c := &checker{
+		fs:    f,
+		table: f.fat,
+		owner: make([]uint32, f.bpb.countOfClusters+2),
+	}
+	c.table.data = copies[0]
+
+	if err := c.compareCopies(copies); err != nil {
+		return nil, err
+	}
+	if err := c.walkDir(0, "/"); err != nil {
+		return nil, err
+	}
+	if err := c.findLost(); err != nil {
+		return nil, err
+	}
+
+	return c.problems, nil
+}
+
+// checker holds the state of a consistency check
+type checker struct {
+	fs       *FS
+	table    fatTable // Snapshot of the first FAT copy
+	owner    []uint32 // Per cluster: index+1 into paths of the owning file, 0 if unowned
+	paths    []string
+	problems []fsys.Problem
+}
+
+func (c *checker) report(kind, format string, args ...any) {
+	c.problems = append(c.problems, fsys.Problem{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// compareCopies reports entries that differ between the first FAT and each other copy
+func (c *checker) compareCopies(copies [][]byte) error {
+	for i := 1; i < len(copies); i++ {
+		other := c.table
+		other.data = copies[i]
+
+		var mismatches, first uint32
+		for cluster := uint32(2); cluster < c.fs.bpb.countOfClusters+2; cluster++ {
+			a, err := c.table.next(cluster)
+			if err != nil {
+				return fmt.Errorf("reading FAT entry %d: %w", cluster, err)
+			}
+			b, err := other.next(cluster)
+			if err != nil {
+				return fmt.Errorf("reading FAT copy %d entry %d: %w", i, cluster, err)
+			}
+			if a != b {
+				if mismatches == 0 {
+					first = cluster
+				}
+				mismatches++
+			}
+		}
+		if mismatches > 0 {
+			c.report("fat-mismatch", "FAT copy %d differs from copy 0 in %d entries (first at cluster %d)", i, mismatches, first)
+		}
+	}
+	return nil
+}
+
+// claimChain follows the cluster chain starting at start on behalf of
+// path, claiming each cluster. It stops at the end of the chain or at the
+// first loop, cross-link, or invalid entry, which is reported. The second
+// result is true if the chain ended with a proper end-of-chain marker.
+func (c *checker) claimChain(start uint32, path string) ([]uint32, bool, error) {
+	c.paths = append(c.paths, path)
+	id := uint32(len(c.paths))
+
+	var chain []uint32
+	claimed := false
+	end, err := c.fs.followChain(&c.table, start, func(cluster uint32) bool {
+		if o := c.owner[cluster]; o != 0 {
+			if o == id {
+				c.report("loop", "%s: chain loops back to cluster %d", path, cluster)
+			} else {
+				c.report("cross-link", "%s: cluster %d is also used by %s", path, cluster, c.paths[o-1])
+			}
+			claimed = true
+			return false
+		}
+		c.owner[cluster] = id
+		chain = append(chain, cluster)
+		return true
+	})
+	switch {
+	case err != nil:
+		return nil, false, err
+	case claimed:
+		return chain, false, nil
+	case c.table.isEOF(end):
+		return chain, true, nil
+	case end == 0 && len(chain) > 0:
+		c.report("bad-chain", "%s: chain runs into free cluster after cluster %d", path, chain[len(chain)-1])
+	case c.table.isBad(end) && len(chain) > 0:
+		c.report("bad-chain", "%s: chain runs into bad cluster after cluster %d", path, chain[len(chain)-1])
+	default:
+		c.report("bad-chain", "%s: chain refers to invalid cluster %d", path, end)
+	}
+	return chain, false, nil
+}
+
+// walkDir checks the directory starting at cluster (0 for the root) and
+// everything beneath it
+func (c *checker) walkDir(cluster uint32, dirPath string) error {
+	var data []byte
+	if cluster == 0 && !c.fs.bpb.isFAT32 {
+		var err error
+		if data, err = c.fs.readRootDirData(); err != nil {
+			return fmt.Errorf("reading root directory: %w", err)
+		}
+	} else {
+		if cluster == 0 {
+			cluster = c.fs.bpb.rootCluster
+		}
+		chain, _, err := c.claimChain(cluster, dirPath)
+		if err != nil {
+			return err
+		}
+		for _, cl := range chain {
+			clusterData, err := c.fs.readCluster(cl)
+			if err != nil {
+				return fmt.Errorf("reading %s cluster %d: %w", dirPath, cl, err)
+			}
+			data = append(data, clusterData...)
+		}
+	}
+
+	entries, err := c.fs.parseDirEntries(data)
+	if err != nil {
+		return err
+	}
+
+	clusterSize := int64(c.fs.clusterSize())
+	for _, e := range entries {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		entryPath := path.Join(dirPath, e.name)
+
+		if e.attr&attrDirectory != 0 {
+			if e.cluster < 2 {
+				c.report("bad-chain", "%s: directory has no clusters", entryPath)
+				continue
+			}
+			if err := c.walkDir(e.cluster, entryPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if e.cluster == 0 {
+			if e.size != 0 {
+				c.report("size-mismatch", "%s: size %d but no clusters allocated", entryPath, e.size)
+			}
+			continue
+		}
+
+		chain, complete, err := c.claimChain(e.cluster, entryPath)
+		if err != nil {
+			return err
+		}
+		expected := (int64(e.size) + clusterSize - 1) / clusterSize
+		if complete && int64(len(chain)) != expected {
+			c.report("size-mismatch", "%s: size %d needs %d clusters but chain has %d",
+				entryPath, e.size, expected, len(chain))
+		}
+	}
+
+	return nil
+}
+
+// findLost reports allocated clusters not owned by any file, grouped into chains
+func (c *checker) findLost() error {
+	end := c.fs.bpb.countOfClusters + 2
+	next := make(map[uint32]uint32)
+	pointedTo := make(map[uint32]bool)
+
+	for cluster := uint32(2); cluster < end; cluster++ {
+		if c.owner[cluster] != 0 {
+			continue
+		}
+		n, err := c.table.next(cluster)
+		if err != nil {
+			return fmt.Errorf("reading FAT entry %d: %w", cluster, err)
+		}
+		if n == 0 || c.table.isBad(n) {
+			continue
+		}
+		next[cluster] = n
+		pointedTo[n] = true
+	}
+
+	clusterSize := int64(c.fs.clusterSize())
+	visited := make(map[uint32]bool)
+	var chains, lostClusters int
+
+	follow := func(head uint32) {
+		length := 0
+		for cluster := head; ; {
+			if _, lost := next[cluster]; !lost || visited[cluster] {
+				break
+			}
+			visited[cluster] = true
+			length++
+			cluster = next[cluster]
+		}
+		chains++
+		lostClusters += length
+		if chains <= maxLostChainsReported {
+			c.report("lost-chain", "%d clusters (%d bytes) starting at cluster %d",
+				length, int64(length)*clusterSize, head)
+		}
+	}
+
+	// Chain heads are lost clusters no other lost cluster points to;
+	// anything left over afterwards is a headless loop
+	for cluster := uint32(2); cluster < end; cluster++ {
+		if _, lost := next[cluster]; lost && !pointedTo[cluster] {
+			follow(cluster)
+		}
+	}
+	for cluster := uint32(2); cluster < end; cluster++ {
+		if _, lost := next[cluster]; lost && !visited[cluster] {
+			follow(cluster)
+		}
+	}
+
+	if chains > maxLostChainsReported {
+		c.report("lost-chain", "%d lost chains in total (%d clusters, %d bytes)",
+			chains, lostClusters, int64(lostClusters)*clusterSize)
+	}
+	return nil
+}
 
 // FreeBlocks returns the list of free byte ranges in the FAT filesystem.
 // Free clusters are those with a FAT entry value of 0.
@@ -133,8 +670,9 @@ func (f *FS) FreeBlocks() ([]fsys.Range, error) {
 	var rangeStart int64
 
 	// Iterate through all data clusters (starting at cluster 2)
+	table := f.fat.bulk()
 	for cluster := uint32(2); cluster < f.bpb.countOfClusters+2; cluster++ {
-		entry, err := f.fat.next(cluster)
+		entry, err := table.next(cluster)
 		if err != nil {
 			return nil, fmt.Errorf("reading FAT entry %d: %w", cluster, err)
 		}
@@ -165,10 +703,12 @@ func (f *FS) FreeBlocks() ([]fsys.Range, error) {
 	return ranges, nil
 }
 
-// FileExtents returns the physical extents for a file
+// FileExtents returns the physical extents for a file. For directories,
+// including the root ("."), it returns the extents of the clusters holding
+// the raw directory entries.
 func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
 	if name == "." || name == "" {
-		return nil, fmt.Errorf("cannot get extents for directory")
+		return f.dirExtents(0)
 	}
 
 	entry, _, err := f.lookup(name)
@@ -177,78 +717,93 @@ func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
 	}
 
 	if entry.attr&attrDirectory != 0 {
-		return nil, fmt.Errorf("cannot get extents for directory")
+		if entry.cluster < 2 {
+			return f.dirExtents(0) // ".." entries pointing at the root
+		}
+		return f.dirExtents(entry.cluster)
 	}
 
 	return f.clusterChainExtents(entry.cluster, int64(entry.size))
 }
 
-// clusterChainExtents returns extents for a cluster chain
-func (f *FS) clusterChainExtents(startCluster uint32, fileSize int64) ([]fsys.Extent, error) {
-	if startCluster < 2 {
-		return nil, nil // Empty file
+// dirExtents returns the extents of the directory starting at cluster (0 for the root)
+func (f *FS) dirExtents(cluster uint32) ([]fsys.Extent, error) {
+	if cluster == 0 && !f.bpb.isFAT32 {
+		// FAT12/16: root directory is at fixed location
+		return []fsys.Extent{{
+			Logical:  0,
+			Physical: f.rootDirOffset(),
+			Length:   int64(f.bpb.rootEntryCount) * 32,
+		}}, nil
 	}
+	if cluster == 0 {
+		cluster = f.bpb.rootCluster
+	}
+
+	// Directories have no recorded size; bound the walk by the volume
+	// size so it stops at the end of the chain or on a loop
+	maxSize := int64(f.bpb.countOfClusters) * int64(f.clusterSize())
+	return f.clusterChainExtents(cluster, maxSize)
+}
 
+// clusterChainExtents returns extents for the first fileSize bytes of a
+// cluster chain, fewer if the chain ends early
+func (f *FS) clusterChainExtents(startCluster uint32, fileSize int64) ([]fsys.Extent, error) {
 	var extents []fsys.Extent
 	clusterSize := int64(f.clusterSize())
-	cluster := startCluster
 	logicalOffset := int64(0)
-	remaining := fileSize
-
-	// Track current extent for coalescing contiguous clusters
-	var currentExtent *fsys.Extent
-
-	for remaining > 0 {
-		physOffset := f.clusterToOffset(cluster)
-		extentLen := clusterSize
-		if extentLen > remaining {
-			extentLen = remaining
+	_, err := f.followChain(f.fat.bulk(), startCluster, func(cluster uint32) bool {
+		if logicalOffset >= fileSize {
+			return false
 		}
+		physOffset := f.clusterToOffset(cluster)
+		extentLen := min(clusterSize, fileSize-logicalOffset)
 
-		// Try to extend current extent if contiguous
-		if currentExtent != nil &&
-			currentExtent.Physical+currentExtent.Length == physOffset {
-			currentExtent.Length += extentLen
+		// Extend the last extent if contiguous
+		if n := len(extents); n > 0 && extents[n-1].Physical+extents[n-1].Length == physOffset {
+			extents[n-1].Length += extentLen
 		} else {
-			// Start new extent
-			if currentExtent != nil {
-				extents = append(extents, *currentExtent)
-			}
-			currentExtent = &fsys.Extent{
+			extents = append(extents, fsys.Extent{
 				Logical:  logicalOffset,
 				Physical: physOffset,
 				Length:   extentLen,
-			}
+			})
 		}
-
 		logicalOffset += extentLen
-		remaining -= extentLen
+		return logicalOffset < fileSize
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
 
-		if remaining <= 0 {
-			break
+// followChain calls visit with each cluster of the chain starting at start
+// in turn, taking the entries from t, until visit returns false or an entry
+// does not link to another cluster of the volume. It returns the value that
+// ended the walk: the cluster visit refused, or the entry after the last
+// cluster visited, an end-of-chain marker if the chain ended properly. A
+// start outside the volume is returned as is.
+func (f *FS) followChain(t *fatTable, start uint32, visit func(cluster uint32) bool) (uint32, error) {
+	cluster := start
+	for f.isCluster(cluster) {
+		if !visit(cluster) {
+			return cluster, nil
 		}
-
-		// Get next cluster
-		next, err := f.fat.next(cluster)
+		next, err := t.next(cluster)
 		if err != nil {
-			return nil, fmt.Errorf("reading FAT entry for cluster %d: %w", cluster, err)
-		}
-
-		if f.fat.isEOF(next) {
-			break
-		}
-		if next < 2 || next >= f.bpb.countOfClusters+2 {
-			break
+			return 0, fmt.Errorf("reading FAT entry for cluster %d: %w", cluster, err)
 		}
 		cluster = next
 	}
+	return cluster, nil
+}
 
-	if currentExtent != nil {
-		extents = append(extents, *currentExtent)
-	}
-
-	return extents, nil
+// isCluster reports whether n numbers a data cluster of the volume
+func (f *FS) isCluster(n uint32) bool {
+	return n >= 2 && n < f.bpb.countOfClusters+2
 }
+
 func (f *FS) clusterToOffset(cluster uint32) int64 {
 	return int64(f.bpb.firstDataSector)*int64(f.bpb.bytesPerSector) +
 		int64(cluster-2)*int64(f.bpb.sectorsPerCluster)*int64(f.bpb.bytesPerSector)
@@ -270,51 +825,39 @@ func (f *FS) readCluster(cluster uint32) ([]byte, error) {
 	return data, nil
 }
 
-// readClusterChain reads all clusters in a chain
+// readClusterChain reads all clusters in a chain, or the first maxSize
+// bytes of it if maxSize is positive
 func (f *FS) readClusterChain(startCluster uint32, maxSize int64) ([]byte, error) {
-	if startCluster < 2 {
-		return nil, fmt.Errorf("invalid start cluster: %d", startCluster)
+	if !f.isCluster(startCluster) {
+		return nil, fsys.Corrupt("cluster chain", -1, "invalid start cluster %d", startCluster)
 	}
 
 	var data []byte
-	cluster := startCluster
-	clusterSize := f.clusterSize()
-
-	for {
+	var readErr error
+	_, err := f.followChain(f.fat.bulk(), startCluster, func(cluster uint32) bool {
+		// Safety limit
+		if len(data) >= 1<<30 {
+			readErr = fsys.Corrupt("cluster chain", -1, "the chain from cluster %d is longer than 1 GiB, or loops", startCluster)
+			return false
+		}
 		clusterData, err := f.readCluster(cluster)
 		if err != nil {
-			return nil, fmt.Errorf("reading cluster %d: %w", cluster, err)
+			readErr = fmt.Errorf("reading cluster %d: %w", cluster, err)
+			return false
 		}
 		data = append(data, clusterData...)
-
-		if maxSize > 0 && int64(len(data)) >= maxSize {
-			break
-		}
-
-		next, err := f.fat.next(cluster)
-		if err != nil {
-			return nil, fmt.Errorf("reading FAT entry for cluster %d: %w", cluster, err)
-		}
-
-		if f.fat.isEOF(next) {
-			break
-		}
-		if next < 2 || next >= f.bpb.countOfClusters+2 {
-			break
-		}
-		cluster = next
-
-		// Safety limit
-		if len(data) > 1<<30 {
-			return nil, fmt.Errorf("cluster chain too long")
-		}
+		return maxSize <= 0 || int64(len(data)) < maxSize
+	})
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if maxSize > 0 && int64(len(data)) > maxSize {
 		data = data[:maxSize]
 	}
-
-	_ = clusterSize // silence unused warning
 	return data, nil
 }
 
@@ -328,10 +871,60 @@ func (t *fatTable) next(cluster uint32) (uint32, error) {
 	return t.nextFAT16(cluster)
 }
 
+// bulk returns a reader of the table for scanning it or walking chains,
+// which reads runs of the table at once rather than an entry at a time.
+// Unlike t it is not safe for concurrent use.
+func (t *fatTable) bulk() *fatTable {
+	b := *t
+	if b.data == nil {
+		b.window = &fatWindow{}
+	}
+	return &b
+}
+
+// read fills buf from the table starting at the given offset within it
+func (t *fatTable) read(buf []byte, offset int64) error {
+	if t.data != nil {
+		if offset+int64(len(buf)) > int64(len(t.data)) {
+			return io.ErrUnexpectedEOF
+		}
+		copy(buf, t.data[offset:])
+		return nil
+	}
+	if w := t.window; w != nil {
+		end := offset + int64(len(buf))
+		if offset < w.start || end > w.start+int64(len(w.data)) {
+			size := int64(fsys.CacheBlockSize)
+			if len(w.data) > 0 && offset >= w.start+int64(len(w.data)) && offset < w.start+2*int64(len(w.data)) {
+				size = min(2*int64(len(w.data)), maxFATWindow)
+			}
+			start := offset - offset%size
+			if end > min(start+size, t.size) {
+				// Across the end of a run, or past the end of the table
+				_, err := t.r.ReadAt(buf, t.startOffset+offset)
+				return err
+			}
+			data := w.data[:0]
+			if int64(cap(data)) < size {
+				data = make([]byte, size)
+			}
+			data = data[:min(size, t.size-start)]
+			if _, err := t.r.ReadAt(data, t.startOffset+start); err != nil {
+				w.data = nil
+				return err
+			}
+			w.start, w.data = start, data
+		}
+		copy(buf, w.data[offset-w.start:])
+		return nil
+	}
+	_, err := t.r.ReadAt(buf, t.startOffset+offset)
+	return err
+}
+
 func (t *fatTable) nextFAT12(cluster uint32) (uint32, error) {
-	offset := t.startOffset + int64(cluster)*3/2
 	buf := make([]byte, 2)
-	if _, err := t.r.ReadAt(buf, offset); err != nil {
+	if err := t.read(buf, int64(cluster)*3/2); err != nil {
 		return 0, err
 	}
 	val := binary.LittleEndian.Uint16(buf)
@@ -342,18 +935,16 @@ func (t *fatTable) nextFAT12(cluster uint32) (uint32, error) {
 }
 
 func (t *fatTable) nextFAT16(cluster uint32) (uint32, error) {
-	offset := t.startOffset + int64(cluster)*2
 	buf := make([]byte, 2)
-	if _, err := t.r.ReadAt(buf, offset); err != nil {
+	if err := t.read(buf, int64(cluster)*2); err != nil {
 		return 0, err
 	}
 	return uint32(binary.LittleEndian.Uint16(buf)), nil
 }
 
 func (t *fatTable) nextFAT32(cluster uint32) (uint32, error) {
-	offset := t.startOffset + int64(cluster)*4
 	buf := make([]byte, 4)
-	if _, err := t.r.ReadAt(buf, offset); err != nil {
+	if err := t.read(buf, int64(cluster)*4); err != nil {
 		return 0, err
 	}
 	return binary.LittleEndian.Uint32(buf) & 0x0FFFFFFF, nil
@@ -368,16 +959,29 @@ func (t *fatTable) isEOF(cluster uint32) bool {
 	return cluster >= 0xFFF8
 }
 
+// isBad reports whether the entry marks a bad cluster
+func (t *fatTable) isBad(cluster uint32) bool {
+	if t.isFAT12 {
+		return cluster == 0x0FF7
+	} else if t.isFAT32 {
+		return cluster == 0x0FFFFFF7
+	}
+	return cluster == 0xFFF7
+}
+
 // dirEntry represents a FAT directory entry
 type dirEntry struct {
-	name     string
-	ext      string
-	attr     uint8
-	cluster  uint32
-	size     uint32
-	modTime  time.Time
-	isLFN    bool
-	lfnParts []string
+	name       string
+	short      string // 8.3 name as stored, NAME.EXT
+	attr       uint8
+	cluster    uint32
+	size       uint32
+	modTime    time.Time
+	createTime time.Time // Zero if not recorded
+	accessTime time.Time // Date only; zero if not recorded
+	isLFN      bool
+	offset     int // Of the short entry in the directory
+	slots      int // Entries the name takes, long and short
 }
 
 const (
@@ -392,153 +996,1856 @@ const (
 
 // readRootDir reads the root directory
 func (f *FS) readRootDir() ([]dirEntry, error) {
-	if f.bpb.isFAT32 {
-		return f.readDir(f.bpb.rootCluster)
+	data, err := f.readRootDirData()
+	if err != nil {
+		return nil, err
+	}
+	return f.parseDirEntries(data)
+}
+
+// readRootDirData reads the raw root directory entries
+func (f *FS) readRootDirData() ([]byte, error) {
+	if f.bpb.isFAT32 {
+		return f.readClusterChain(f.bpb.rootCluster, 0)
+	}
+
+	// FAT12/16: root directory is at fixed location
+	data := make([]byte, int64(f.bpb.rootEntryCount)*32)
+	if _, err := f.r.ReadAt(data, f.rootDirOffset()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// rootDirOffset returns the image offset of the fixed FAT12/16 root directory
+func (f *FS) rootDirOffset() int64 {
+	return int64(f.bpb.reservedSectors)*int64(f.bpb.bytesPerSector) +
+		int64(f.bpb.numFATs)*int64(f.bpb.fatSize)*int64(f.bpb.bytesPerSector)
+}
+
+// dirEntries returns the parsed entries of the directory starting at the
+// given cluster (0 for the root directory), reading it at most once per FS.
+// The returned slice is shared and must not be modified.
+func (f *FS) dirEntries(cluster uint32) ([]dirEntry, error) {
+	if f.bpb.isFAT32 && cluster == f.bpb.rootCluster {
+		cluster = 0
+	}
+
+	f.dirCacheMu.Lock()
+	entries, ok := f.dirCache[cluster]
+	f.dirCacheMu.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	var err error
+	if cluster == 0 {
+		entries, err = f.readRootDir()
+	} else {
+		entries, err = f.readDir(cluster)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.dirCacheMu.Lock()
+	if len(f.dirCache) >= maxCachedDirs {
+		// Evict an arbitrary entry; directory walks rarely revisit old paths
+		for k := range f.dirCache {
+			delete(f.dirCache, k)
+			break
+		}
+	}
+	f.dirCache[cluster] = entries
+	f.dirCacheMu.Unlock()
+
+	return entries, nil
+}
+
+// readDir reads a directory at the given cluster
+func (f *FS) readDir(cluster uint32) ([]dirEntry, error) {
+	data, err := f.readClusterChain(cluster, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f.parseDirEntries(data)
+}
+
+func (f *FS) parseDirEntries(data []byte) ([]dirEntry, error) {
+	var entries []dirEntry
+	var lfn lfnSequence
+
+	for i := 0; i+32 <= len(data); i += 32 {
+		entry := data[i : i+32]
+
+		// End of directory
+		if entry[0] == 0x00 {
+			break
+		}
+
+		// Deleted entry
+		if entry[0] == 0xE5 {
+			lfn.reset()
+			continue
+		}
+
+		attr := entry[11]
+
+		// Long filename entry
+		if attr == attrLFN {
+			lfn.add(entry)
+			continue
+		}
+
+		// Skip volume label
+		if attr&attrVolumeID != 0 {
+			lfn.reset()
+			continue
+		}
+
+		de := f.parseEntry(entry, i)
+
+		// Use LFN if available, otherwise the 8.3 name in lower case (common
+		// for LFN-less entries)
+		if longName, ok := lfn.name(entry[0:11]); ok {
+			de.name = longName
+			de.isLFN = true
+			de.slots += len(lfn.parts)
+		} else {
+			de.name = strings.ToLower(de.short)
+		}
+
+		entries = append(entries, de)
+		lfn.reset()
+	}
+
+	return entries, nil
+}
+
+// parseEntry decodes the 8.3 entry at offset in a directory, leaving the
+// long name to the caller
+func (f *FS) parseEntry(entry []byte, offset int) dirEntry {
+	de := dirEntry{
+		attr:    entry[11],
+		offset:  offset,
+		slots:   1,
+		size:    binary.LittleEndian.Uint32(entry[28:32]),
+		cluster: uint32(binary.LittleEndian.Uint16(entry[26:28])),
+	}
+
+	if f.bpb.isFAT32 {
+		de.cluster |= uint32(binary.LittleEndian.Uint16(entry[20:22])) << 16
+	}
+
+	// Parse modification time
+	modTime := binary.LittleEndian.Uint16(entry[22:24])
+	modDate := binary.LittleEndian.Uint16(entry[24:26])
+	de.modTime = parseDOSDateTime(modDate, modTime)
+
+	// Creation time has an extra byte of 10ms units (0-199) for sub-2s resolution
+	if createDate := binary.LittleEndian.Uint16(entry[16:18]); createDate != 0 {
+		createTime := binary.LittleEndian.Uint16(entry[14:16])
+		tenths := time.Duration(entry[13]) * 10 * time.Millisecond
+		de.createTime = parseDOSDateTime(createDate, createTime).Add(tenths)
+	}
+	if accessDate := binary.LittleEndian.Uint16(entry[18:20]); accessDate != 0 {
+		de.accessTime = parseDOSDateTime(accessDate, 0)
+	}
+
+	de.short = strings.TrimRight(string(entry[0:8]), " ")
+	if entry[0] == 0x05 {
+		de.short = "\xE5" + de.short[1:]
+	}
+	if ext := strings.TrimRight(string(entry[8:11]), " "); ext != "" {
+		de.short += "." + ext
+	}
+	return de
+}
+
+// lfnSequence accumulates the long filename entries that precede a short
+// entry. Entries are stored by sequence number, so fragments written out of
+// order still assemble correctly. A sequence that is incomplete, has
+// inconsistent checksums, or does not match the checksum of the following
+// 8.3 name is orphaned and ignored.
+type lfnSequence struct {
+	parts    [][]uint16 // indexed by sequence number - 1
+	checksum byte
+}
+
+// reset discards any accumulated fragments
+func (s *lfnSequence) reset() {
+	s.parts = nil
+}
+
+// add records one long filename entry
+func (s *lfnSequence) add(entry []byte) {
+	seq := int(entry[0] & 0x1F)
+
+	// The entry flagged 0x40 is the last fragment and starts a new sequence
+	if entry[0]&0x40 != 0 {
+		s.parts = make([][]uint16, seq)
+		s.checksum = entry[13]
+	}
+
+	if seq == 0 || seq > len(s.parts) || entry[13] != s.checksum || s.parts[seq-1] != nil {
+		s.reset() // Orphaned or corrupt fragment
+		return
+	}
+	s.parts[seq-1] = lfnChars(entry)
+}
+
+// name returns the assembled long filename if the sequence is complete and
+// belongs to the given 11-byte 8.3 name
+func (s *lfnSequence) name(shortName []byte) (string, bool) {
+	if len(s.parts) == 0 || lfnChecksum(shortName) != s.checksum {
+		return "", false
+	}
+
+	var chars []uint16
+	for _, part := range s.parts {
+		if part == nil {
+			return "", false
+		}
+		chars = append(chars, part...)
+	}
+
+	// The name is NUL-terminated (unless it fills the last fragment)
+	// and padded with 0xFFFF
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	if len(chars) == 0 {
+		return "", false
+	}
+
+	return string(utf16.Decode(chars)), true
+}
+
+// lfnChecksum computes the checksum of an 11-byte 8.3 name as stored in
+// each of its long filename entries
+func lfnChecksum(shortName []byte) byte {
+	var sum byte
+	for _, c := range shortName[:11] {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// lfnCharOffsets are where the UTF-16 code units of a long filename entry are
+var lfnCharOffsets = []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// lfnChars returns the 13 UTF-16 code units stored in a long filename entry
+func lfnChars(entry []byte) []uint16 {
+	chars := make([]uint16, 0, 13)
+	for _, off := range lfnCharOffsets {
+		chars = append(chars, binary.LittleEndian.Uint16(entry[off:off+2]))
+	}
+	return chars
+}
+
+// Deleted implements fsys.DeletedLister. Deleted entries are looked for in
+// the directories reachable from the root, and in the first cluster of the
+// deleted directories among them. Deleting a file frees its cluster chain,
+// so its data is taken to run on from its first cluster, which is right
+// unless it was fragmented. The ID of an entry is its offset in the image.
+func (f *FS) Deleted() ([]fsys.DeletedEntry, error) {
+	free, err := f.FreeBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []fsys.DeletedEntry
+	seen := make(map[uint32]bool)
+	var walk func(data []byte, extents []fsys.Extent, dirPath string) error
+	walk = func(data []byte, extents []fsys.Extent, dirPath string) error {
+		for _, de := range f.parseDeletedEntries(data) {
+			e := fsys.DeletedEntry{
+				ID:         strconv.FormatInt(entryOffset(extents, de.offset), 10),
+				Path:       path.Join(dirPath, de.name),
+				IsDir:      de.attr&attrDirectory != 0,
+				Size:       int64(de.size),
+				ModTime:    de.modTime,
+				AccessTime: de.accessTime,
+				BirthTime:  de.createTime,
+				Extents:    f.deletedExtents(de),
+			}
+			if e.IsDir {
+				e.Size = 0
+				for _, x := range e.Extents {
+					e.Size += x.Length
+				}
+			}
+			e.Confidence = fsys.RateDeleted(free, e.Extents, e.Size, true)
+			found = append(found, e)
+
+			// A directory's entries were deleted before it
+			if !e.IsDir || e.Confidence < fsys.ConfidenceMedium || seen[de.cluster] {
+				continue
+			}
+			seen[de.cluster] = true
+			sub, err := f.readCluster(de.cluster)
+			if err != nil {
+				return err
+			}
+			if dot := dotName("."); string(sub[:11]) == string(dot[:]) {
+				if err := walk(sub, e.Extents, e.Path); err != nil {
+					return err
+				}
+			}
+		}
+
+		entries, err := f.parseDirEntries(data)
+		if err != nil {
+			return err
+		}
+		for _, de := range entries {
+			if de.attr&attrDirectory == 0 || de.name == "." || de.name == ".." || !f.isCluster(de.cluster) || seen[de.cluster] {
+				continue
+			}
+			seen[de.cluster] = true
+			sub, err := f.readClusterChain(de.cluster, 0)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path.Join(dirPath, de.name), err)
+			}
+			subExtents, err := f.dirExtents(de.cluster)
+			if err != nil {
+				return err
+			}
+			if err := walk(sub, subExtents, path.Join(dirPath, de.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	root, err := f.readRootDirData()
+	if err != nil {
+		return nil, err
+	}
+	rootExtents, err := f.dirExtents(0)
+	if err != nil {
+		return nil, err
+	}
+	return found, walk(root, rootExtents, ".")
+}
+
+// OpenDeleted implements fsys.DeletedLister, reading the clusters from the
+// first one of the deleted entry at the offset id. A directory reads as
+// the raw entries of its first cluster.
+func (f *FS) OpenDeleted(id string) (fsys.ReaderAtCloser, int64, error) {
+	off, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || off < 0 || off%32 != 0 || off+32 > f.size {
+		return nil, 0, fmt.Errorf("deleted entry %q: %w", id, fs.ErrNotExist)
+	}
+	entry := make([]byte, 32)
+	if _, err := f.r.ReadAt(entry, off); err != nil {
+		return nil, 0, err
+	}
+	if entry[0] != 0xE5 || entry[11] == attrLFN || entry[11]&attrVolumeID != 0 {
+		return nil, 0, fmt.Errorf("deleted entry %q: %w", id, fs.ErrNotExist)
+	}
+
+	de := f.parseEntry(entry, 0)
+	extents := f.deletedExtents(de)
+	size := int64(de.size)
+	if de.attr&attrDirectory != 0 {
+		size = 0
+		for _, e := range extents {
+			size += e.Length
+		}
+	}
+	return fsys.NewExtentReaderAt(f.r, extents, size), size, nil
+}
+
+// deletedExtents returns where the data of a deleted entry was, as far as
+// the volume goes: its size from its first cluster on, or the first
+// cluster of a directory
+func (f *FS) deletedExtents(de dirEntry) []fsys.Extent {
+	clusterSize := int64(f.clusterSize())
+	size := int64(de.size)
+	if de.attr&attrDirectory != 0 {
+		size = clusterSize
+	}
+	if !f.isCluster(de.cluster) || size == 0 {
+		return nil
+	}
+	left := int64(f.bpb.countOfClusters+2-de.cluster) * clusterSize
+	return []fsys.Extent{{Physical: f.clusterToOffset(de.cluster), Length: min(size, left)}}
+}
+
+// entryOffset returns where the byte at off of a directory with the given
+// extents is in the image
+func entryOffset(extents []fsys.Extent, off int) int64 {
+	for _, e := range extents {
+		if int64(off) >= e.Logical && int64(off) < e.Logical+e.Length {
+			return e.Physical + int64(off) - e.Logical
+		}
+	}
+	return -1
+}
+
+// parseDeletedEntries returns the deleted entries of a directory. Deleting
+// a file overwrites the first byte of its entries, which loses the first
+// character of the 8.3 name and the sequence numbers of the long name
+// entries before it, but not the checksum of the 8.3 name those carry:
+// the one first character that makes it agree restores the 8.3 name, and
+// the long name is kept if that is a character 8.3 names may have.
+// Otherwise the name starts with '_'.
+func (f *FS) parseDeletedEntries(data []byte) []dirEntry {
+	var entries []dirEntry
+	for i := 0; i+32 <= len(data); i += 32 {
+		entry := data[i : i+32]
+		if entry[0] == 0x00 {
+			break
+		}
+		if entry[0] != 0xE5 || entry[11] == attrLFN || entry[11]&attrVolumeID != 0 {
+			continue
+		}
+
+		// The long name entries are stored last part first, the first
+		// part just before the 8.3 entry
+		var chars []uint16
+		var checksum byte
+		for j := i - 32; j >= 0 && i-j <= 20*32; j -= 32 {
+			part := data[j : j+32]
+			if part[0] != 0xE5 || part[11] != attrLFN || j < i-32 && part[13] != checksum {
+				break
+			}
+			checksum = part[13]
+			chars = append(chars, lfnChars(part)...)
+			if slices.Contains(chars[len(chars)-13:], 0) {
+				break
+			}
+		}
+		if n := slices.Index(chars, 0); n >= 0 {
+			chars = chars[:n]
+		}
+
+		short := slices.Clone(entry)
+		short[0] = '_'
+		if len(chars) > 0 {
+			for c := 0; c < 0x100; c++ {
+				if short[0] = byte(c); lfnChecksum(short) == checksum {
+					break
+				}
+			}
+			if !isShortChar(short[0]) {
+				short[0], chars = '_', nil
+			}
+		}
+
+		de := f.parseEntry(short, i)
+		de.name = strings.ToLower(de.short)
+		if len(chars) > 0 {
+			de.name, de.isLFN = string(utf16.Decode(chars)), true
+		}
+		entries = append(entries, de)
+	}
+	return entries
+}
+
+func parseDOSDateTime(dosDate, dosTime uint16) time.Time {
+	year := int((dosDate>>9)&0x7F) + 1980
+	month := time.Month((dosDate >> 5) & 0x0F)
+	day := int(dosDate & 0x1F)
+	hour := int((dosTime >> 11) & 0x1F)
+	min := int((dosTime >> 5) & 0x3F)
+	sec := int((dosTime & 0x1F) * 2)
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+}
+
+// Writing
+
+// WriteFile creates or replaces the named file with data, writing the
+// image through w. The data goes to free clusters and the directory entry
+// is changed after it is written, so a replaced file keeps its old
+// contents until the entry points at the new ones; their clusters are
+// freed last. Without write permission in perm the file is read-only.
+func (f *FS) WriteFile(w io.WriterAt, name string, data []byte, perm fs.FileMode) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	defer f.forgetDirs()
+	if err := f.writeFile(w, name, data, perm); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) writeFile(w io.WriterAt, name string, data []byte, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fs.ErrInvalid
+	}
+	if int64(len(data)) > 1<<32-1 {
+		return fmt.Errorf("%d bytes is more than a FAT file can hold", len(data))
+	}
+	d, err := f.loadDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	old, exists := d.find(path.Base(name))
+	switch {
+	case exists && old.attr&attrDirectory != 0:
+		return errors.New("is a directory")
+	case !exists && !validLongName(path.Base(name)):
+		return fs.ErrInvalid
+	}
+	u, err := f.newUpdate(w)
+	if err != nil {
+		return err
+	}
+
+	clusterSize := f.clusterSize()
+	chain, err := u.alloc((len(data) + clusterSize - 1) / clusterSize)
+	if err != nil {
+		return err
+	}
+	if err := u.writeClusters(chain, data); err != nil {
+		return err
+	}
+	var first uint32
+	if len(chain) > 0 {
+		first = chain[0]
+	}
+
+	attr := byte(attrArchive)
+	if perm&0o200 == 0 {
+		attr |= attrReadOnly
+	}
+	now := time.Now()
+	if !exists {
+		return u.addEntry(d, path.Base(name), attr, first, uint32(len(data)), now)
+	}
+
+	// The old entry keeps its name, attributes and creation time
+	if err := u.flush(); err != nil {
+		return err
+	}
+	entry := slices.Clone(d.data[old.offset : old.offset+32])
+	entry[11] = entry[11]&^attrReadOnly | attr
+	f.setEntryCluster(entry, first)
+	binary.LittleEndian.PutUint32(entry[28:32], uint32(len(data)))
+	setModTime(entry, now)
+	if err := d.write(u, old.offset, entry); err != nil {
+		return err
+	}
+	if err := u.free(old.cluster); err != nil {
+		return err
+	}
+	return u.finish()
+}
+
+// Mkdir creates the named directory, writing the image through w. FAT
+// directories have no permissions, so perm is not used.
+func (f *FS) Mkdir(w io.WriterAt, name string, perm fs.FileMode) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	defer f.forgetDirs()
+	if err := f.mkdir(w, name); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) mkdir(w io.WriterAt, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fs.ErrInvalid
+	}
+	d, err := f.loadDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if _, exists := d.find(path.Base(name)); exists {
+		return fs.ErrExist
+	}
+	if !validLongName(path.Base(name)) {
+		return fs.ErrInvalid
+	}
+	u, err := f.newUpdate(w)
+	if err != nil {
+		return err
+	}
+	chain, err := u.alloc(1)
+	if err != nil {
+		return err
+	}
+
+	// The . and .. entries; .. of a directory in the root is cluster 0,
+	// even on FAT32
+	now := time.Now()
+	contents := make([]byte, 64)
+	copy(contents, f.newEntry(dotName("."), 0, attrDirectory, chain[0], 0, now))
+	copy(contents[32:], f.newEntry(dotName(".."), 0, attrDirectory, d.cluster, 0, now))
+	if err := u.writeClusters(chain, contents); err != nil {
+		return err
+	}
+	return u.addEntry(d, path.Base(name), attrDirectory, chain[0], 0, now)
+}
+
+// forgetDirs drops the parsed directories after the image is written
+func (f *FS) forgetDirs() {
+	f.dirCacheMu.Lock()
+	clear(f.dirCache)
+	f.dirCacheMu.Unlock()
+}
+
+// writeAt writes p to the image at off through w, dropping what the block
+// cache holds of the bytes
+func (f *FS) writeAt(w io.WriterAt, p []byte, off int64) error {
+	_, err := w.WriteAt(p, off)
+	f.r.Forget(off, int64(len(p)))
+	return err
+}
+
+// update is a change to the filesystem being written. It works on a copy
+// of the first FAT, which is written to every copy when flushed.
+type update struct {
+	f        *FS
+	w        io.WriterAt
+	table    fatTable
+	lo, hi   int64  // Bytes of the table changed since the last flush
+	nextFree uint32 // Clusters before this are in use
+}
+
+func (f *FS) newUpdate(w io.WriterAt) (*update, error) {
+	fatBytes := int64(f.bpb.fatSize) * int64(f.bpb.bytesPerSector)
+	u := &update{f: f, w: w, table: f.fat, lo: fatBytes, nextFree: 2}
+	u.table.data = make([]byte, fatBytes)
+	if _, err := f.r.ReadAt(u.table.data, f.fat.startOffset); err != nil {
+		return nil, fmt.Errorf("reading FAT: %w", err)
+	}
+	return u, nil
+}
+
+// set changes the FAT entry for cluster
+func (u *update) set(cluster, value uint32) {
+	t := u.table.data
+	var off, n int64
+	switch {
+	case u.table.isFAT12:
+		off, n = int64(cluster)*3/2, 2
+		v := binary.LittleEndian.Uint16(t[off:])
+		if cluster%2 == 0 {
+			v = v&0xF000 | uint16(value&0x0FFF)
+		} else {
+			v = v&0x000F | uint16(value<<4)
+		}
+		binary.LittleEndian.PutUint16(t[off:], v)
+	case u.table.isFAT32:
+		// The top four bits are reserved and kept
+		off, n = int64(cluster)*4, 4
+		v := binary.LittleEndian.Uint32(t[off:])
+		binary.LittleEndian.PutUint32(t[off:], v&0xF0000000|value&0x0FFFFFFF)
+	default:
+		off, n = int64(cluster)*2, 2
+		binary.LittleEndian.PutUint16(t[off:], uint16(value))
+	}
+	u.lo, u.hi = min(u.lo, off), max(u.hi, off+n)
+}
+
+// endOfChain returns the marker of the last cluster of a chain
+func (u *update) endOfChain() uint32 {
+	if u.table.isFAT12 {
+		return 0x0FFF
+	} else if u.table.isFAT32 {
+		return 0x0FFFFFFF
+	}
+	return 0xFFFF
+}
+
+// alloc takes n free clusters, lowest first, and links them into a chain
+func (u *update) alloc(n int) ([]uint32, error) {
+	chain := make([]uint32, 0, n)
+	end := u.f.bpb.countOfClusters + 2
+	for cluster := u.nextFree; len(chain) < n && cluster < end; cluster++ {
+		next, err := u.table.next(cluster)
+		if err != nil {
+			return nil, fmt.Errorf("reading FAT entry %d: %w", cluster, err)
+		}
+		if next == 0 {
+			chain = append(chain, cluster)
+		}
+	}
+	if len(chain) < n {
+		return nil, fmt.Errorf("no space left: %d clusters needed, %d free", n, len(chain))
+	}
+	for i, cluster := range chain {
+		next := u.endOfChain()
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+		u.set(cluster, next)
+	}
+	if n > 0 {
+		u.nextFree = chain[n-1] + 1
+	}
+	return chain, nil
+}
+
+// free releases the chain starting at start
+func (u *update) free(start uint32) error {
+	seen := make(map[uint32]bool)
+	_, err := u.f.followChain(&u.table, start, func(cluster uint32) bool {
+		if seen[cluster] {
+			return false
+		}
+		seen[cluster] = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for cluster := range seen {
+		u.set(cluster, 0)
+	}
+	return nil
+}
+
+// writeClusters writes data to a chain, zeroing the rest of its last cluster
+func (u *update) writeClusters(chain []uint32, data []byte) error {
+	clusterSize := u.f.clusterSize()
+	for i := 0; i < len(chain); {
+		// Contiguous clusters are written at once
+		j := i + 1
+		for j < len(chain) && chain[j] == chain[j-1]+1 {
+			j++
+		}
+		run := make([]byte, (j-i)*clusterSize)
+		copy(run, data[min(i*clusterSize, len(data)):])
+		if err := u.f.writeAt(u.w, run, u.f.clusterToOffset(chain[i])); err != nil {
+			return fmt.Errorf("writing cluster %d: %w", chain[i], err)
+		}
+		i = j
+	}
+	return nil
+}
+
+// flush writes the changed part of the FAT to every copy
+func (u *update) flush() error {
+	if u.lo >= u.hi {
+		return nil
+	}
+	fatBytes := int64(len(u.table.data))
+	for i := range int64(u.f.bpb.numFATs) {
+		if err := u.f.writeAt(u.w, u.table.data[u.lo:u.hi], u.table.startOffset+i*fatBytes+u.lo); err != nil {
+			return fmt.Errorf("writing FAT copy %d: %w", i, err)
+		}
+	}
+	u.lo, u.hi = fatBytes, 0
+	return nil
+}
+
+// finish flushes the FAT and, on FAT32, recounts the free clusters
+// recorded in the FSInfo sector
+func (u *update) finish() error {
+	if err := u.flush(); err != nil {
+		return err
+	}
+	f := u.f
+	if !f.bpb.isFAT32 || f.bpb.fsInfoSector == 0 || f.bpb.fsInfoSector == 0xFFFF {
+		return nil
+	}
+	sector := make([]byte, 512)
+	offset := int64(f.bpb.fsInfoSector) * int64(f.bpb.bytesPerSector)
+	if _, err := f.r.ReadAt(sector, offset); err != nil {
+		return fmt.Errorf("reading FSInfo: %w", err)
+	}
+	if binary.LittleEndian.Uint32(sector[0:4]) != 0x41615252 || binary.LittleEndian.Uint32(sector[484:488]) != 0x61417272 {
+		return nil
+	}
+	var free uint32
+	for cluster := uint32(2); cluster < f.bpb.countOfClusters+2; cluster++ {
+		if next, err := u.table.next(cluster); err == nil && next == 0 {
+			free++
+		}
+	}
+	binary.LittleEndian.PutUint32(sector[488:492], free)
+	binary.LittleEndian.PutUint32(sector[492:496], u.nextFree)
+	if err := f.writeAt(u.w, sector[488:496], offset+488); err != nil {
+		return fmt.Errorf("writing FSInfo: %w", err)
+	}
+	return nil
+}
+
+// dir is a directory being written: its raw entries and where they are
+type dir struct {
+	cluster uint32 // First cluster, 0 for the root
+	data    []byte
+	extents []fsys.Extent
+	entries []dirEntry
+}
+
+// loadDir reads the named directory for writing
+func (f *FS) loadDir(name string) (*dir, error) {
+	d := &dir{}
+	if name != "." {
+		e, _, err := f.lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if e.attr&attrDirectory == 0 {
+			return nil, fmt.Errorf("%s is not a directory", name)
+		}
+		d.cluster = e.cluster
+	}
+	var err error
+	if d.extents, err = f.dirExtents(d.cluster); err != nil {
+		return nil, err
+	}
+	if len(d.extents) == 0 {
+		return nil, fsys.Corrupt("directory", -1, "%s has no clusters", name)
+	}
+	last := d.extents[len(d.extents)-1]
+	d.data = make([]byte, last.Logical+last.Length)
+	if _, err := fsys.NewExtentReaderAt(f.r, d.extents, int64(len(d.data))).ReadAt(d.data, 0); err != nil {
+		return nil, fmt.Errorf("reading directory %s: %w", name, err)
+	}
+	d.entries, err = f.parseDirEntries(d.data)
+	return d, err
+}
+
+// find returns the entry of the directory with the given name
+func (d *dir) find(name string) (dirEntry, bool) {
+	for _, e := range d.entries {
+		if strings.EqualFold(e.name, name) {
+			return e, true
+		}
+	}
+	return dirEntry{}, false
+}
+
+// write writes the entries in p at offset off of the directory
+func (d *dir) write(u *update, off int, p []byte) error {
+	copy(d.data[off:], p)
+	for i := 0; i < len(p); i += 32 {
+		pos := int64(off + i)
+		for _, e := range d.extents {
+			if pos >= e.Logical && pos < e.Logical+e.Length {
+				if err := u.f.writeAt(u.w, p[i:i+32], e.Physical+pos-e.Logical); err != nil {
+					return fmt.Errorf("writing directory entry: %w", err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// freeSlots returns the offset of n free entries in a row, or -1. Every
+// entry after the first that is never used counts as free.
+func (d *dir) freeSlots(n int) int {
+	run := 0
+	for i := 0; i+32 <= len(d.data); i += 32 {
+		switch d.data[i] {
+		case 0x00:
+			if run+(len(d.data)-i)/32 >= n {
+				return i - 32*run
+			}
+			return -1
+		case 0xE5:
+			if run++; run == n {
+				return i + 32 - 32*n
+			}
+		default:
+			run = 0
+		}
+	}
+	return -1
+}
+
+// maxDirEntries is the most entries a directory may have
+const maxDirEntries = 65536
+
+// addEntry adds an entry for a new file or directory to d, with a long
+// name when the name is not a lower-case 8.3 one, extending the directory if it is
+// full. The FAT is flushed before the entry is written.
+func (u *update) addEntry(d *dir, name string, attr byte, cluster, size uint32, t time.Time) error {
+	short, flags, fits := shortName(name)
+	var lfn [][]byte
+	// Short names read back in lower case, so others keep a long name too
+	if !fits || name != strings.ToLower(name) || d.hasShortName(short) {
+		short = uniqueShortName(name, d)
+		lfn = longNameEntries(name, lfnChecksum(short[:]))
+	}
+	entries := append(slices.Concat(lfn...), u.f.newEntry(short, flags, attr, cluster, size, t)...)
+	n := len(entries) / 32
+
+	off := d.freeSlots(n)
+	if off < 0 {
+		if d.cluster == 0 && !u.f.bpb.isFAT32 {
+			return errors.New("root directory is full")
+		}
+		if len(d.data)/32+n > maxDirEntries {
+			return errors.New("directory is full")
+		}
+		if err := u.extend(d, n); err != nil {
+			return err
+		}
+		off = d.freeSlots(n)
+	}
+	if err := u.flush(); err != nil {
+		return err
+	}
+
+	// Writing over the first entry never used leaves the next one to
+	// end the directory
+	end := off + len(entries)
+	if marker := slices.IndexFunc(d.entriesFrom(off, end), func(e []byte) bool { return e[0] == 0 }); marker >= 0 && end < len(d.data) {
+		entries = append(entries, make([]byte, 32)...)
+	}
+	if err := d.write(u, off, entries); err != nil {
+		return err
+	}
+	return u.finish()
+}
+
+// entriesFrom returns the raw entries of the directory from start to end
+func (d *dir) entriesFrom(start, end int) [][]byte {
+	var entries [][]byte
+	for i := start; i < end; i += 32 {
+		entries = append(entries, d.data[i:i+32])
+	}
+	return entries
+}
+
+// extend adds zeroed clusters to a directory for n more entries
+func (u *update) extend(d *dir, n int) error {
+	clusterSize := u.f.clusterSize()
+	chain, err := u.alloc((32*n + clusterSize - 1) / clusterSize)
+	if err != nil {
+		return err
+	}
+	last := d.extents[len(d.extents)-1]
+	lastCluster := uint32((last.Physical+last.Length-int64(clusterSize)-u.f.clusterToOffset(2))/int64(clusterSize)) + 2
+	u.set(lastCluster, chain[0])
+	if err := u.writeClusters(chain, nil); err != nil {
+		return err
+	}
+	for _, cluster := range chain {
+		d.extents = append(d.extents, fsys.Extent{Logical: int64(len(d.data)), Physical: u.f.clusterToOffset(cluster), Length: int64(clusterSize)})
+		d.data = append(d.data, make([]byte, clusterSize)...)
+	}
+	return nil
+}
+
+// newEntry returns a short directory entry
+func (f *FS) newEntry(short [11]byte, flags, attr byte, cluster, size uint32, t time.Time) []byte {
+	entry := make([]byte, 32)
+	copy(entry, short[:])
+	entry[11] = attr
+	entry[12] = flags
+	date, tm, hundredths := dosDateTime(t)
+	entry[13] = hundredths
+	binary.LittleEndian.PutUint16(entry[14:16], tm)
+	binary.LittleEndian.PutUint16(entry[16:18], date)
+	setModTime(entry, t)
+	f.setEntryCluster(entry, cluster)
+	binary.LittleEndian.PutUint32(entry[28:32], size)
+	return entry
+}
+
+// setEntryCluster sets the first cluster of a short directory entry
+func (f *FS) setEntryCluster(entry []byte, cluster uint32) {
+	binary.LittleEndian.PutUint16(entry[26:28], uint16(cluster))
+	if f.bpb.isFAT32 {
+		binary.LittleEndian.PutUint16(entry[20:22], uint16(cluster>>16))
+	}
+}
+
+// setModTime sets the modification time and access date of a short
+// directory entry
+func setModTime(entry []byte, t time.Time) {
+	date, tm, _ := dosDateTime(t)
+	binary.LittleEndian.PutUint16(entry[18:20], date)
+	binary.LittleEndian.PutUint16(entry[22:24], tm)
+	binary.LittleEndian.PutUint16(entry[24:26], date)
+}
+
+// dosDateTime encodes t, in its own time zone as FAT records local time,
+// as a DOS date and time and the hundredths of a second the time leaves out
+func dosDateTime(t time.Time) (date, tm uint16, hundredths byte) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	} else if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, t.Location())
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	hundredths = byte(t.Second()%2*100 + t.Nanosecond()/10_000_000)
+	return date, tm, hundredths
+}
+
+// dotName returns the short name of the . or .. entry
+func dotName(name string) [11]byte {
+	short := [11]byte([]byte("           "))
+	copy(short[:], name)
+	return short
+}
+
+// NT case flags of a short entry, for names that are all lower case
+const (
+	lowerBase = 0x08
+	lowerExt  = 0x10
+)
+
+// shortName returns the 8.3 form of name and the case flags that give it
+// back as it is, if it has one
+func shortName(name string) ([11]byte, byte, bool) {
+	short := dotName("")
+	base, ext, hasExt := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || hasExt && ext == "" || strings.Contains(ext, ".") {
+		return short, 0, false
+	}
+	var flags byte
+	for i, part := range []string{base, ext} {
+		upper, lower := false, false
+		for j := 0; j < len(part); j++ {
+			c := part[j]
+			switch {
+			case c >= 'a' && c <= 'z':
+				lower = true
+				c -= 'a' - 'A'
+			case c >= 'A' && c <= 'Z':
+				upper = true
+			case !isShortChar(c):
+				return short, 0, false
+			}
+			short[i*8+j] = c
+		}
+		if upper && lower {
+			return short, 0, false
+		}
+		if lower {
+			flags |= []byte{lowerBase, lowerExt}[i]
+		}
+	}
+	return short, flags, true
+}
+
+// isShortChar reports whether c may be in an 8.3 name as it is
+func isShortChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'()-@^_`{}~", c) >= 0
+}
+
+// uniqueShortName returns a short name for a long one, its characters
+// that may be in an 8.3 name upper-cased and the others as underscores,
+// with a ~n tail that no other entry of d has
+func uniqueShortName(name string, d *dir) [11]byte {
+	clean := func(s string, n int) []byte {
+		var b []byte
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case len(b) == n:
+				return b
+			case r == ' ' || r == '.':
+			case r < 0x80 && isShortChar(byte(r)):
+				b = append(b, byte(r))
+			default:
+				b = append(b, '_')
+			}
+		}
+		return b
+	}
+	base, ext := strings.TrimLeft(name, "."), ""
+	if i := strings.LastIndexByte(base, '.'); i > 0 {
+		base, ext = base[:i], base[i+1:]
+	}
+	basis := clean(base, 8)
+	if len(basis) == 0 {
+		basis = []byte("_")
+	}
+
+	short := dotName("")
+	copy(short[8:], clean(ext, 3))
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		b := basis[:min(len(basis), 8-len(tail))]
+		copy(short[:8], append(append(slices.Clone(b), tail...), "        "...))
+		if !d.hasShortName(short) {
+			return short
+		}
+	}
+}
+
+// hasShortName reports whether an entry of d has the given 8.3 name
+func (d *dir) hasShortName(short [11]byte) bool {
+	return slices.ContainsFunc(d.entries, func(e dirEntry) bool {
+		return string(d.data[e.offset:e.offset+11]) == string(short[:])
+	})
+}
+
+// validLongName reports whether name may be the name of a FAT file
+func validLongName(name string) bool {
+	if name == "." || name == ".." || strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") ||
+		len(utf16.Encode([]rune(name))) > 255 {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			return false
+		}
 	}
+	return true
+}
 
-	// FAT12/16: root directory is at fixed location
-	rootStart := int64(f.bpb.reservedSectors)*int64(f.bpb.bytesPerSector) +
-		int64(f.bpb.numFATs)*int64(f.bpb.fatSize)*int64(f.bpb.bytesPerSector)
-	rootSize := int64(f.bpb.rootEntryCount) * 32
-
-	data := make([]byte, rootSize)
-	if _, err := f.r.ReadAt(data, rootStart); err != nil {
-		return nil, err
+// longNameEntries returns the long filename entries for name, in the order
+// they are stored: last fragment first
+func longNameEntries(name string, checksum byte) [][]byte {
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+	n := len(chars) / 13
+	entries := make([][]byte, n)
+	for i := range entries {
+		seq := n - i
+		entry := make([]byte, 32)
+		entry[0] = byte(seq)
+		if i == 0 {
+			entry[0] |= 0x40
+		}
+		entry[11] = attrLFN
+		entry[13] = checksum
+		for j, off := range lfnCharOffsets {
+			binary.LittleEndian.PutUint16(entry[off:], chars[(seq-1)*13+j])
+		}
+		entries[i] = entry
 	}
+	return entries
+}
 
-	return f.parseDirEntries(data)
+// Formatting
+
+// FormatOptions is the geometry of a new filesystem. Zero fields take the
+// defaults of Microsoft's format.
+type FormatOptions struct {
+	Type              string // FAT12, FAT16 or FAT32; by default from the size
+	SectorSize        int    // Bytes per sector, 512 by default
+	SectorsPerCluster int    // By default the smallest the type allows for the size
+	NumFATs           int    // 2 by default
+	RootEntries       int    // Of the FAT12/16 root directory, 512 by default
+	Label             string // Volume label, up to 11 characters
+	VolumeID          uint32 // Serial number, by default from the time
+	HiddenSectors     uint32 // Sectors before the volume, for one in a partition
 }
 
-// readDir reads a directory at the given cluster
-func (f *FS) readDir(cluster uint32) ([]dirEntry, error) {
-	data, err := f.readClusterChain(cluster, 0)
+// Format writes an empty filesystem of size bytes through w: the boot
+// sector, the FATs and the root directory. The data area is left as it is.
+func Format(w io.WriterAt, size int64, opts FormatOptions) error {
+	g, err := newGeometry(size, opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return f.parseDirEntries(data)
+
+	// The reserved sectors, FATs and root directory start out zeroed
+	ss := int64(g.sectorSize)
+	meta := make([]byte, (int64(g.reserved)+int64(g.numFATs)*int64(g.fatSize)+int64(g.rootSectors))*ss)
+	if g.typ == "FAT32" {
+		meta = append(meta, make([]byte, int(g.spc)*g.sectorSize)...) // Root directory cluster
+	}
+	boot := g.bootSector(opts)
+	copy(meta, boot)
+
+	fatStart := int64(g.reserved) * ss
+	fatBytes := int64(g.fatSize) * ss
+	for i := range int64(g.numFATs) {
+		t := fatTable{data: meta[fatStart+i*fatBytes : fatStart+(i+1)*fatBytes], isFAT12: g.typ == "FAT12", isFAT32: g.typ == "FAT32"}
+		u := &update{table: t}
+		u.set(0, 0x0FFFFF00|uint32(boot[21]))
+		u.set(1, u.endOfChain())
+		if g.typ == "FAT32" {
+			u.set(2, u.endOfChain())
+		}
+	}
+
+	root := fatStart + int64(g.numFATs)*fatBytes
+	if label := labelName(opts.Label); label != "NO NAME    " {
+		entry := make([]byte, 32)
+		copy(entry, label)
+		entry[11] = attrVolumeID
+		setModTime(entry, time.Now())
+		copy(meta[root:], entry)
+	}
+
+	if g.typ == "FAT32" {
+		info := meta[ss : 2*ss]
+		binary.LittleEndian.PutUint32(info[0:4], 0x41615252)
+		binary.LittleEndian.PutUint32(info[484:488], 0x61417272)
+		binary.LittleEndian.PutUint32(info[488:492], g.clusters-1)
+		binary.LittleEndian.PutUint32(info[492:496], 3)
+		binary.LittleEndian.PutUint32(info[508:512], 0xAA550000)
+		copy(meta[6*ss:8*ss], meta[0:2*ss]) // Backup boot sector and FSInfo
+	}
+
+	if _, err := w.WriteAt(meta, 0); err != nil {
+		return fmt.Errorf("writing the filesystem: %w", err)
+	}
+	return nil
 }
 
-func (f *FS) parseDirEntries(data []byte) ([]dirEntry, error) {
-	var entries []dirEntry
-	var lfnParts []string
+// geometry is the layout of a filesystem being formatted
+type geometry struct {
+	typ         string
+	sectorSize  int
+	spc         uint8
+	reserved    uint16
+	numFATs     uint8
+	rootEntries uint16
+	rootSectors uint32
+	totalSecs   uint32
+	fatSize     uint32
+	clusters    uint32
+}
 
-	for i := 0; i+32 <= len(data); i += 32 {
-		entry := data[i : i+32]
+// Cluster counts each type allows, from the FAT specification
+const (
+	minFAT16Clusters = 4085
+	minFAT32Clusters = 65525
+	maxFAT32Clusters = 0x0FFFFFF5
+)
 
-		// End of directory
-		if entry[0] == 0x00 {
-			break
+// newGeometry lays out a filesystem of size bytes
+func newGeometry(size int64, opts FormatOptions) (*geometry, error) {
+	g := &geometry{
+		typ:         opts.Type,
+		sectorSize:  cmp.Or(opts.SectorSize, 512),
+		numFATs:     uint8(cmp.Or(opts.NumFATs, 2)),
+		rootEntries: uint16(cmp.Or(opts.RootEntries, 512)),
+	}
+	ss := g.sectorSize
+	if ss < 512 || ss > 4096 || ss&(ss-1) != 0 {
+		return nil, fmt.Errorf("invalid sector size %d", ss)
+	}
+	if opts.NumFATs < 0 || opts.NumFATs > 255 || opts.RootEntries < 0 || opts.RootEntries > 0xFFF0 {
+		return nil, errors.New("invalid number of FATs or root entries")
+	}
+	if size/int64(ss) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("%d bytes is more than FAT can hold", size)
+	}
+	g.totalSecs = uint32(size / int64(ss))
+	if g.typ == "" {
+		switch {
+		case size >= 512<<20:
+			g.typ = "FAT32"
+		case size >= 16<<20:
+			g.typ = "FAT16"
+		default:
+			g.typ = "FAT12"
 		}
+	}
 
-		// Deleted entry
-		if entry[0] == 0xE5 {
-			lfnParts = nil
+	minClusters, maxClusters := uint32(1), uint32(minFAT16Clusters-1)
+	switch g.typ {
+	case "FAT12":
+		g.reserved = 1
+	case "FAT16":
+		g.reserved = 1
+		minClusters, maxClusters = minFAT16Clusters, minFAT32Clusters-1
+	case "FAT32":
+		g.reserved = 32
+		g.rootEntries = 0
+		minClusters, maxClusters = minFAT32Clusters, maxFAT32Clusters
+	default:
+		return nil, fmt.Errorf("unknown FAT type %q (use FAT12, FAT16 or FAT32)", g.typ)
+	}
+	g.rootSectors = (uint32(g.rootEntries)*32 + uint32(ss) - 1) / uint32(ss)
+
+	// The cluster size is the one Microsoft's format picks for the size,
+	// or the nearest that leaves a cluster count the type allows
+	want := opts.SectorsPerCluster
+	if want == 0 {
+		want = max(defaultClusterSize(g.typ, size)/ss, 1)
+	} else if want > 128 || want&(want-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster %d", want)
+	}
+	best, bestDistance := 0, 0
+	for spc := 1; spc <= 128 && spc*ss <= 64<<10; spc *= 2 {
+		if opts.SectorsPerCluster != 0 && spc != want {
 			continue
 		}
+		g.spc = uint8(spc)
+		if err := g.layOut(); err != nil {
+			return nil, err
+		}
+		distance := bits.Len(uint(max(spc/want, want/spc)))
+		if g.clusters >= minClusters && g.clusters <= maxClusters && (best == 0 || distance < bestDistance) {
+			best, bestDistance = spc, distance
+		}
+	}
+	if best == 0 {
+		best = want // For the error
+	}
+	g.spc = uint8(best)
+	if err := g.layOut(); err != nil {
+		return nil, err
+	}
+	switch {
+	case g.clusters > maxClusters:
+		return nil, fmt.Errorf("%d bytes is too large for %s: %d clusters of %d bytes, and it allows at most %d", size, g.typ, g.clusters, int(g.spc)*ss, maxClusters)
+	case g.clusters < minClusters:
+		return nil, fmt.Errorf("%d bytes is too small for %s: %d clusters of %d bytes, and it needs at least %d", size, g.typ, g.clusters, int(g.spc)*ss, minClusters)
+	}
+	return g, nil
+}
 
-		attr := entry[11]
+// defaultClusterSize returns the cluster size Microsoft's format gives a
+// volume of the type and size
+func defaultClusterSize(typ string, size int64) int {
+	var limits []int64 // Largest volume for each cluster size from 512 bytes
+	switch typ {
+	case "FAT16":
+		limits = []int64{0, 16 << 20, 128 << 20, 256 << 20, 512 << 20, 1 << 30, 2 << 30}
+	case "FAT32":
+		limits = []int64{260 << 20, 0, 0, 8 << 30, 16 << 30, 32 << 30}
+	default:
+		return 512
+	}
+	for i, limit := range limits {
+		if size <= limit {
+			return 512 << i
+		}
+	}
+	return 512 << len(limits)
+}
 
-		// Long filename entry
-		if attr == attrLFN {
-			lfn := parseLFNEntry(entry)
-			if entry[0]&0x40 != 0 {
-				lfnParts = nil // Start of new LFN sequence
+// layOut sizes the FATs for the sectors per cluster, and counts the
+// clusters that leaves
+func (g *geometry) layOut() error {
+	entryBits := map[string]uint64{"FAT12": 12, "FAT16": 16, "FAT32": 32}[g.typ]
+	g.fatSize = 1
+	for {
+		meta := uint64(g.reserved) + uint64(g.numFATs)*uint64(g.fatSize) + uint64(g.rootSectors)
+		if meta >= uint64(g.totalSecs) {
+			return fmt.Errorf("%d sectors leave no room for data", g.totalSecs)
+		}
+		g.clusters = uint32((uint64(g.totalSecs) - meta) / uint64(g.spc))
+		fatBytes := ((uint64(g.clusters)+2)*entryBits + 7) / 8
+		need := uint32((fatBytes + uint64(g.sectorSize) - 1) / uint64(g.sectorSize))
+		if need <= g.fatSize {
+			return nil
+		}
+		g.fatSize = need
+	}
+}
+
+// bootSector returns the boot sector of the filesystem, whose code halts
+func (g *geometry) bootSector(opts FormatOptions) []byte {
+	boot := make([]byte, g.sectorSize)
+	copy(boot[3:11], "RAWHIDE ")
+	binary.LittleEndian.PutUint16(boot[11:13], uint16(g.sectorSize))
+	boot[13] = g.spc
+	binary.LittleEndian.PutUint16(boot[14:16], g.reserved)
+	boot[16] = g.numFATs
+	binary.LittleEndian.PutUint16(boot[17:19], g.rootEntries)
+	if g.totalSecs < 0x10000 && g.typ != "FAT32" {
+		binary.LittleEndian.PutUint16(boot[19:21], uint16(g.totalSecs))
+	} else {
+		binary.LittleEndian.PutUint32(boot[32:36], g.totalSecs)
+	}
+	boot[21] = 0xF8                                 // Fixed disk
+	binary.LittleEndian.PutUint16(boot[24:26], 63)  // Sectors per track
+	binary.LittleEndian.PutUint16(boot[26:28], 255) // Heads
+	binary.LittleEndian.PutUint32(boot[28:32], opts.HiddenSectors)
+
+	extBPB := 36
+	if g.typ == "FAT32" {
+		binary.LittleEndian.PutUint32(boot[36:40], g.fatSize)
+		binary.LittleEndian.PutUint32(boot[44:48], 2) // Root directory cluster
+		binary.LittleEndian.PutUint16(boot[48:50], 1) // FSInfo sector
+		binary.LittleEndian.PutUint16(boot[50:52], 6) // Backup boot sector
+		extBPB = 64
+	} else {
+		binary.LittleEndian.PutUint16(boot[22:24], uint16(g.fatSize))
+	}
+	volumeID := opts.VolumeID
+	if volumeID == 0 {
+		volumeID = uint32(time.Now().UnixNano())
+	}
+	boot[extBPB] = 0x80 // Drive number
+	boot[extBPB+2] = 0x29
+	binary.LittleEndian.PutUint32(boot[extBPB+3:], volumeID)
+	copy(boot[extBPB+7:extBPB+18], labelName(opts.Label))
+	copy(boot[extBPB+18:extBPB+26], fmt.Sprintf("%-8s", g.typ))
+
+	// Jump to hlt; jmp $-1 after the extended BPB
+	code := extBPB + 26
+	boot[0], boot[1], boot[2] = 0xEB, byte(code-2), 0x90
+	copy(boot[code:], []byte{0xF4, 0xEB, 0xFD})
+	boot[510], boot[511] = 0x55, 0xAA
+	return boot
+}
+
+// labelName returns a volume label as stored, upper case and padded, or
+// NO NAME for none
+func labelName(label string) string {
+	if label == "" {
+		label = "NO NAME"
+	}
+	return fmt.Sprintf("%-11.11s", strings.ToUpper(label))
+}
+
+// Building
+
+// Image is a FAT filesystem made by Build of files of another filesystem.
+// Only its metadata is kept in memory; the data of the files is read from
+// them as the image is read.
+type Image struct {
+	meta  *sparseImage
+	size  int64
+	files []imageFile // In order of offset
+	src   fs.FS
+
+	mu   sync.Mutex
+	open map[string]openFile
+}
+
+// imageFile is where the data of a file of src is in an Image
+type imageFile struct {
+	offset, size int64
+	name         string
+}
+
+// openFile is a file of src an Image has open
+type openFile struct {
+	r io.ReaderAt
+	c io.Closer
+}
+
+// maxOpenFiles bounds the files of src an Image keeps open
+const maxOpenFiles = 32
+
+// buildNode is a file or directory of an Image being built
+type buildNode struct {
+	path     string // In src
+	info     fs.FileInfo
+	children []*buildNode
+	dir      *dir  // Entries of a directory
+	offsets  []int // Of the short entry of each child in dir
+	cluster  uint32
+}
+
+// Build makes a FAT filesystem of the named files and directories of src,
+// each in its root under its own name, and the files and directories below
+// them. Names FAT does not allow have their characters replaced.
+// Anything that is not a regular file or a directory, such as a symbolic
+// link to a directory, is left out. The filesystem is just large enough,
+// and its type and cluster size follow from its size unless opts sets
+// them.
+func Build(src fs.FS, names []string, opts FormatOptions) (*Image, error) {
+	root := &buildNode{dir: &dir{}}
+	if opts.Label != "" {
+		entry := make([]byte, 32)
+		copy(entry, labelName(opts.Label))
+		entry[11] = attrVolumeID
+		setModTime(entry, time.Now())
+		root.dir.data = entry
+	}
+	for _, name := range names {
+		info, err := fs.Stat(src, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := root.add(src, name, info, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cluster numbers in the entries are filled in once the clusters
+	// are laid out
+	var files, dirs []*buildNode
+	var walk func(n *buildNode) error
+	walk = func(n *buildNode) error {
+		if n.info != nil && !n.info.IsDir() {
+			files = append(files, n)
+			return nil
+		}
+		dirs = append(dirs, n)
+		if err := n.layOutEntries(n == root); err != nil {
+			return err
+		}
+		for _, c := range n.children {
+			if err := walk(c); err != nil {
+				return err
 			}
-			lfnParts = append([]string{lfn}, lfnParts...)
-			continue
 		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
 
-		// Skip volume label
-		if attr&attrVolumeID != 0 {
-			lfnParts = nil
+	g, size, err := buildGeometry(dirs, files, &opts)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{meta: &sparseImage{pages: make(map[int64][]byte)}, size: size, src: src, open: make(map[string]openFile)}
+	if err := Format(img.meta, size, opts); err != nil {
+		return nil, err
+	}
+	opened, err := Open(img.meta, size)
+	if err != nil {
+		return nil, err
+	}
+	f := opened.(*FS)
+	u, err := f.newUpdate(img.meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each directory and file is one run of clusters, in the order of the
+	// walk; FAT32 keeps its root directory in cluster 2
+	clusterSize := int64(g.spc) * int64(g.sectorSize)
+	next := uint32(2)
+	alloc := func(n *buildNode, bytes int64) {
+		count := uint32((bytes + clusterSize - 1) / clusterSize)
+		if count == 0 {
+			return
+		}
+		n.cluster = next
+		for c := next; c < next+count-1; c++ {
+			u.set(c, c+1)
+		}
+		u.set(next+count-1, u.endOfChain())
+		next += count
+	}
+	for _, n := range dirs {
+		if n != root || f.bpb.isFAT32 {
+			alloc(n, max(int64(len(n.dir.data)), 1))
+		}
+	}
+	for _, n := range files {
+		alloc(n, n.info.Size())
+		if n.cluster != 0 {
+			img.files = append(img.files, imageFile{offset: f.clusterToOffset(n.cluster), size: n.info.Size(), name: n.path})
+		}
+	}
+
+	for _, n := range dirs {
+		// .. of a directory in the root is cluster 0, even on FAT32
+		parent := n.cluster
+		if n == root {
+			parent = 0
+		}
+		for i, c := range n.children {
+			f.setEntryCluster(n.dir.data[n.offsets[i]:], c.cluster)
+			if c.info.IsDir() {
+				f.setEntryCluster(c.dir.data[0:], c.cluster)
+				f.setEntryCluster(c.dir.data[32:], parent)
+			}
+		}
+	}
+	for _, n := range dirs {
+		offset := f.rootDirOffset()
+		if n != root || f.bpb.isFAT32 {
+			offset = f.clusterToOffset(n.cluster)
+		}
+		if _, err := img.meta.WriteAt(n.dir.data, offset); err != nil {
+			return nil, err
+		}
+	}
+	u.nextFree = next
+	if err := u.finish(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// maxBuildDepth bounds how deep the directories Build copies are nested
+const maxBuildDepth = 256
+
+// add adds the file or directory of src at name, with info, to n, and what
+// is below a directory
+func (n *buildNode) add(src fs.FS, name string, info fs.FileInfo, depth int) error {
+	switch {
+	case info.Mode().IsRegular():
+		if info.Size() > 1<<32-1 {
+			return fmt.Errorf("%s: %d bytes is more than a FAT file can hold", name, info.Size())
+		}
+	case !info.IsDir():
+		return nil
+	}
+	child := &buildNode{path: name, info: info}
+	n.children = append(n.children, child)
+	if !info.IsDir() {
+		return nil
+	}
+	if depth > maxBuildDepth {
+		return fmt.Errorf("%s: directories nested too deep", name)
+	}
+
+	child.dir = &dir{data: make([]byte, 64)} // . and ..
+	entries, err := fs.ReadDir(src, name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type()&fs.ModeSymlink != 0 && e.IsDir() {
 			continue
 		}
+		sub := path.Join(name, e.Name())
+		info, err := fs.Stat(src, sub) // Following symbolic links
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && e.Type()&fs.ModeSymlink != 0 {
+			continue // Which may loop
+		}
+		if err := child.add(src, sub, info, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		de := dirEntry{
-			attr:    attr,
-			size:    binary.LittleEndian.Uint32(entry[28:32]),
-			cluster: uint32(binary.LittleEndian.Uint16(entry[26:28])),
+// layOutEntries writes the entries of the children of a directory, as
+// addEntry does but without their clusters, after the . and .. entries
+// of a directory other than the root
+func (n *buildNode) layOutEntries(isRoot bool) error {
+	var f FS // Clusters are set later
+	d := n.dir
+	if !isRoot {
+		now := n.info.ModTime()
+		copy(d.data, f.newEntry(dotName("."), 0, attrDirectory, 0, 0, now))
+		copy(d.data[32:], f.newEntry(dotName(".."), 0, attrDirectory, 0, 0, now))
+	}
+	for _, c := range n.children {
+		name := fatName(path.Base(c.path), d)
+		short, flags, fits := shortName(name)
+		var lfn [][]byte
+		if !fits || name != strings.ToLower(name) || d.hasShortName(short) {
+			short = uniqueShortName(name, d)
+			lfn = longNameEntries(name, lfnChecksum(short[:]))
+		}
+		attr := byte(attrArchive)
+		size := uint32(c.info.Size())
+		if c.info.IsDir() {
+			attr, size = attrDirectory, 0
+		} else if c.info.Mode().Perm()&0o200 == 0 {
+			attr |= attrReadOnly
 		}
+		d.data = append(d.data, slices.Concat(lfn...)...)
+		offset := len(d.data)
+		d.data = append(d.data, f.newEntry(short, flags, attr, 0, size, c.info.ModTime())...)
+		d.entries = append(d.entries, dirEntry{name: name, offset: offset})
+		n.offsets = append(n.offsets, offset)
+		if len(d.data)/32 > maxDirEntries {
+			return fmt.Errorf("%s: too many files for a FAT directory", n.path)
+		}
+	}
+	return nil
+}
 
-		if f.bpb.isFAT32 {
-			de.cluster |= uint32(binary.LittleEndian.Uint16(entry[20:22])) << 16
+// fatName returns name with the characters a FAT name may not have
+// replaced by underscores, and a number added if d has the name already
+func fatName(name string, d *dir) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			r = '_'
 		}
+		b.WriteRune(r)
+	}
+	clean := strings.TrimRight(b.String(), ". ")
+	if clean == "" {
+		clean = "_"
+	}
+	for name, i := clean, 2; ; i++ {
+		if _, exists := d.find(name); !exists && validLongName(name) {
+			return name
+		}
+		name = fmt.Sprintf("%s (%d)", clean, i)
+	}
+}
 
-		// Parse modification time
-		modTime := binary.LittleEndian.Uint16(entry[22:24])
-		modDate := binary.LittleEndian.Uint16(entry[24:26])
-		de.modTime = parseDOSDateTime(modDate, modTime)
+// buildGeometry finds the smallest filesystem that holds the directories
+// and files, returning its geometry and size. The fixed root directory of
+// FAT12 and FAT16 is made large enough for the entries of the root.
+func buildGeometry(dirs, files []*buildNode, opts *FormatOptions) (*geometry, int64, error) {
+	ss := int64(cmp.Or(opts.SectorSize, 512))
+	root := dirs[0]
+	rootEntries := int64(len(root.dir.data) / 32)
+	if want := (rootEntries + ss/32 - 1) / (ss / 32) * (ss / 32); want > int64(cmp.Or(opts.RootEntries, 512)) {
+		if want > 0xFFF0 {
+			want = 0xFFF0 // Too many for FAT12 and FAT16
+		}
+		opts.RootEntries = int(want)
+	}
 
-		// Use LFN if available, otherwise use 8.3 name
-		if len(lfnParts) > 0 {
-			de.name = strings.Join(lfnParts, "")
-			de.isLFN = true
-		} else {
-			name := strings.TrimRight(string(entry[0:8]), " ")
-			ext := strings.TrimRight(string(entry[8:11]), " ")
-			if entry[0] == 0x05 {
-				name = "\xE5" + name[1:]
+	var data int64
+	for _, n := range dirs {
+		data += int64(len(n.dir.data))
+	}
+	for _, n := range files {
+		data += n.info.Size()
+	}
+	size := max(data+data/16+1<<20, 2<<20)
+	switch opts.Type {
+	case "FAT16":
+		size = max(size, minFAT16Clusters*ss+1<<20)
+	case "FAT32":
+		size = max(size, minFAT32Clusters*ss+1<<20)
+	}
+	for range 64 {
+		g, err := newGeometry(size, *opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		clusterSize := int64(g.spc) * ss
+		var need int64
+		for _, n := range dirs {
+			if n != root || g.typ == "FAT32" {
+				need += max((int64(len(n.dir.data))+clusterSize-1)/clusterSize, 1)
 			}
-			de.name = name
-			de.ext = ext
-			if ext != "" {
-				de.name = name + "." + ext
+		}
+		for _, n := range files {
+			need += (n.info.Size() + clusterSize - 1) / clusterSize
+		}
+		if g.typ != "FAT32" && rootEntries > int64(g.rootEntries) {
+			return nil, 0, fmt.Errorf("%d entries do not fit in the %s root directory", rootEntries, g.typ)
+		}
+		if need <= int64(g.clusters) {
+			return g, size, nil
+		}
+		size += (need-int64(g.clusters))*clusterSize + size/64
+	}
+	return nil, 0, errors.New("no FAT geometry holds the files")
+}
+
+// Size returns the size of the image
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt implements io.ReaderAt, reading the metadata from memory and the
+// data of files from src
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), img.size-off))
+	img.meta.ReadAt(p[:n], off)
+	end := off + int64(n)
+
+	i, _ := slices.BinarySearchFunc(img.files, off, func(f imageFile, off int64) int {
+		return cmp.Compare(f.offset+f.size, off+1)
+	})
+	for ; i < len(img.files) && img.files[i].offset < end; i++ {
+		file := img.files[i]
+		start, stop := max(off, file.offset), min(end, file.offset+file.size)
+		if start >= stop {
+			continue
+		}
+		r, err := img.reader(file.name)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", file.name, err)
+		}
+		if m, err := r.ReadAt(p[start-off:stop-off], start-file.offset); m < int(stop-start) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
+			return 0, fmt.Errorf("reading %s: %w", file.name, err)
 		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
 
-		// Convert to lowercase for consistency (common for LFN-less entries)
-		if !de.isLFN {
-			de.name = strings.ToLower(de.name)
+// reader returns the named file of src, opening it if it is not open
+func (img *Image) reader(name string) (io.ReaderAt, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if f, ok := img.open[name]; ok {
+		return f.r, nil
+	}
+	if len(img.open) >= maxOpenFiles {
+		img.closeFiles()
+	}
+
+	var f openFile
+	if filesystem, ok := img.src.(fsys.FS); ok {
+		r, _, err := fsys.OpenReaderAt(filesystem, name)
+		if err != nil {
+			return nil, err
+		}
+		f = openFile{r, r}
+	} else {
+		file, err := img.src.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := file.(io.ReaderAt)
+		if !ok {
+			file.Close()
+			return nil, errors.New("file does not support random access")
 		}
+		f = openFile{r, file}
+	}
+	img.open[name] = f
+	return f.r, nil
+}
 
-		entries = append(entries, de)
-		lfnParts = nil
+// closeFiles closes the files of src that are open; img.mu is held
+func (img *Image) closeFiles() {
+	for name, f := range img.open {
+		f.c.Close()
+		delete(img.open, name)
 	}
+}
 
-	return entries, nil
+// Close closes the files of src the image has open
+func (img *Image) Close() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	img.closeFiles()
+	return nil
 }
 
-func parseLFNEntry(entry []byte) string {
-	// LFN entry contains Unicode characters at specific offsets
-	chars := make([]uint16, 13)
-	copy(chars[0:5], []uint16{
-		binary.LittleEndian.Uint16(entry[1:3]),
-		binary.LittleEndian.Uint16(entry[3:5]),
-		binary.LittleEndian.Uint16(entry[5:7]),
-		binary.LittleEndian.Uint16(entry[7:9]),
-		binary.LittleEndian.Uint16(entry[9:11]),
-	})
-	copy(chars[5:11], []uint16{
-		binary.LittleEndian.Uint16(entry[14:16]),
-		binary.LittleEndian.Uint16(entry[16:18]),
-		binary.LittleEndian.Uint16(entry[18:20]),
-		binary.LittleEndian.Uint16(entry[20:22]),
-		binary.LittleEndian.Uint16(entry[22:24]),
-		binary.LittleEndian.Uint16(entry[24:26]),
-	})
-	copy(chars[11:13], []uint16{
-		binary.LittleEndian.Uint16(entry[28:30]),
-		binary.LittleEndian.Uint16(entry[30:32]),
-	})
+// sparseImage is an image in memory of which only the pages written are
+// kept; the rest reads as zeros
+type sparseImage struct {
+	pages map[int64][]byte
+}
 
-	var result strings.Builder
-	for _, c := range chars {
-		if c == 0 || c == 0xFFFF {
-			break
+// sparsePageSize is the size of the pages of a sparseImage
+const sparsePageSize = 64 << 10
+
+// WriteAt implements io.WriterAt
+func (s *sparseImage) WriteAt(p []byte, off int64) (int, error) {
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		page, ok := s.pages[pos/sparsePageSize]
+		if !ok {
+			page = make([]byte, sparsePageSize)
+			s.pages[pos/sparsePageSize] = page
 		}
-		result.WriteRune(rune(c))
+		n += copy(page[pos%sparsePageSize:], p[n:])
 	}
-	return result.String()
+	return len(p), nil
 }
 
-func parseDOSDateTime(dosDate, dosTime uint16) time.Time {
-	year := int((dosDate>>9)&0x7F) + 1980
-	month := time.Month((dosDate >> 5) & 0x0F)
-	day := int(dosDate & 0x1F)
-	hour := int((dosTime >> 11) & 0x1F)
-	min := int((dosTime >> 5) & 0x3F)
-	sec := int((dosTime & 0x1F) * 2)
-	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+// ReadAt implements io.ReaderAt
+func (s *sparseImage) ReadAt(p []byte, off int64) (int, error) {
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		chunk := p[n:min(len(p), n+int(sparsePageSize-pos%sparsePageSize))]
+		if page, ok := s.pages[pos/sparsePageSize]; ok {
+			copy(chunk, page[pos%sparsePageSize:])
+		} else {
+			clear(chunk)
+		}
+		n += len(chunk)
+	}
+	return len(p), nil
 }
 
 // fs.FS implementation
@@ -575,7 +2882,7 @@ func (f *FS) lookup(name string) (dirEntry, uint32, error) {
 		parentCluster = f.bpb.rootCluster
 	}
 
-	entries, err = f.readRootDir()
+	entries, err = f.dirEntries(0)
 	if err != nil {
 		return dirEntry{}, 0, err
 	}
@@ -591,7 +2898,7 @@ func (f *FS) lookup(name string) (dirEntry, uint32, error) {
 					return dirEntry{}, 0, fs.ErrNotExist
 				}
 				parentCluster = e.cluster
-				entries, err = f.readDir(e.cluster)
+				entries, err = f.dirEntries(e.cluster)
 				if err != nil {
 					return dirEntry{}, 0, err
 				}
@@ -608,18 +2915,7 @@ func (f *FS) lookup(name string) (dirEntry, uint32, error) {
 }
 
 func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	file, err := f.Open(name)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	dir, ok := file.(fs.ReadDirFile)
-	if !ok {
-		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
-	}
-
-	return dir.ReadDir(-1)
+	return fsys.ReadDirFile(f, name)
 }
 
 func (f *FS) Stat(name string) (fs.FileInfo, error) {
@@ -631,42 +2927,58 @@ func (f *FS) Stat(name string) (fs.FileInfo, error) {
 	return file.Stat()
 }
 
-// fatFile implements fs.File for regular files
+// fatFile implements fs.File for regular files. Data is read on demand
+// through the file's cluster extents rather than loaded up front.
 type fatFile struct {
 	fs     *FS
 	entry  dirEntry
 	name   string
 	parent uint32
-	data   []byte
+	mu     sync.Mutex // Guards reader, so that ReadAt can be concurrent
+	reader *fsys.ExtentReaderAt
 	offset int64
-	loaded bool
 }
 
 func (f *fatFile) Stat() (fs.FileInfo, error) {
 	return &fatFileInfo{entry: f.entry, name: f.name}, nil
 }
 
-func (f *fatFile) Read(b []byte) (int, error) {
-	if !f.loaded {
-		var err error
-		f.data, err = f.fs.readClusterChain(f.entry.cluster, int64(f.entry.size))
+// extentReader returns the reader over the file's clusters, mapping the chain on first use
+func (f *fatFile) extentReader() (*fsys.ExtentReaderAt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader == nil {
+		extents, err := f.fs.clusterChainExtents(f.entry.cluster, int64(f.entry.size))
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		f.loaded = true
+		f.reader = fsys.NewExtentReaderAt(f.fs.r, extents, int64(f.entry.size))
 	}
+	return f.reader, nil
+}
 
-	if f.offset >= int64(len(f.data)) {
-		return 0, io.EOF
+func (f *fatFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
 	}
+	return n, err
+}
 
-	n := copy(b, f.data[f.offset:])
-	f.offset += int64(n)
-	return n, nil
+// ReadAt implements io.ReaderAt
+func (f *fatFile) ReadAt(b []byte, off int64) (int, error) {
+	r, err := f.extentReader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(b, off)
 }
 
 func (f *fatFile) Close() error {
-	f.data = nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reader = nil
 	return nil
 }
 
@@ -698,14 +3010,11 @@ func (d *fatDir) Close() error {
 
 func (d *fatDir) ReadDir(n int) ([]fs.DirEntry, error) {
 	if d.entries == nil {
-		var rawEntries []dirEntry
-		var err error
-
+		cluster := d.entry.cluster
 		if d.isRoot {
-			rawEntries, err = d.fs.readRootDir()
-		} else {
-			rawEntries, err = d.fs.readDir(d.entry.cluster)
+			cluster = 0
 		}
+		rawEntries, err := d.fs.dirEntries(cluster)
 		if err != nil {
 			return nil, err
 		}
@@ -764,11 +3073,29 @@ type fatFileInfo struct {
 	isDir bool
 }
 
-func (i *fatFileInfo) Name() string       { return i.name }
-func (i *fatFileInfo) Size() int64        { return int64(i.entry.size) }
-func (i *fatFileInfo) ModTime() time.Time { return i.entry.modTime }
-func (i *fatFileInfo) IsDir() bool        { return i.isDir || i.entry.attr&attrDirectory != 0 }
-func (i *fatFileInfo) Sys() any           { return nil }
+func (i *fatFileInfo) Name() string          { return i.name }
+func (i *fatFileInfo) Size() int64           { return int64(i.entry.size) }
+func (i *fatFileInfo) ModTime() time.Time    { return i.entry.modTime }
+func (i *fatFileInfo) BirthTime() time.Time  { return i.entry.createTime }
+func (i *fatFileInfo) AccessTime() time.Time { return i.entry.accessTime }
+func (i *fatFileInfo) ChangeTime() time.Time { return time.Time{} } // Not recorded
+func (i *fatFileInfo) IsDir() bool           { return i.isDir || i.entry.attr&attrDirectory != 0 }
+
+// Attributes is the FAT metadata of a file that fs.FileInfo has no place
+// for, returned by the Sys method of its FileInfo
+type Attributes struct {
+	Attr      uint8  // 0x01 read-only, 0x02 hidden, 0x04 system, 0x10 directory, 0x20 archive
+	ShortName string // 8.3 name as stored, NAME.EXT
+	Cluster   uint32 // First cluster, 0 for an empty file
+}
+
+// Sys returns the file's *Attributes, or nil for the root directory
+func (i *fatFileInfo) Sys() any {
+	if i.entry.short == "" {
+		return nil
+	}
+	return &Attributes{Attr: i.entry.attr, ShortName: i.entry.short, Cluster: i.entry.cluster}
+}
 
 func (i *fatFileInfo) Mode() fs.FileMode {
 	mode := fs.FileMode(0444)
@@ -0,0 +1,839 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// shortEntry builds an 8.3 directory entry
+func shortEntry(name string, attr uint8, cluster uint32, size uint32) []byte {
+	e := make([]byte, 32)
+	copy(e[0:11], name)
+	e[11] = attr
+	binary.LittleEndian.PutUint16(e[20:22], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[26:28], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:32], size)
+	return e
+}
+
+// lfnEntries builds the long filename entries for name in on-disk order
+// (last fragment first), as written by Windows and mkfs.vfat/mtools
+func lfnEntries(name string, shortName string) [][]byte {
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+		for len(chars)%13 != 0 {
+			chars = append(chars, 0xFFFF)
+		}
+	}
+
+	n := len(chars) / 13
+	sum := lfnChecksum([]byte(shortName))
+	offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+	entries := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		e := make([]byte, 32)
+		e[0] = byte(i + 1)
+		if i == n-1 {
+			e[0] |= 0x40
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		for j, off := range offsets {
+			binary.LittleEndian.PutUint16(e[off:off+2], chars[i*13+j])
+		}
+		entries[n-1-i] = e
+	}
+	return entries
+}
+
+func join(entries ...[]byte) []byte {
+	var data []byte
+	for _, e := range entries {
+		data = append(data, e...)
+	}
+	return data
+}
+
+func names(t *testing.T, data []byte) []string {
+	t.Helper()
+	f := &FS{}
+	entries, err := f.parseDirEntries(data)
+	if err != nil {
+		t.Fatalf("parseDirEntries: %v", err)
+	}
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.name)
+	}
+	return result
+}
+
+func TestLFNChecksum(t *testing.T) {
+	// Reference value computed with the algorithm from the FAT specification
+	if got := lfnChecksum([]byte("ALONGF~1TEX")); got != 0x7D {
+		t.Errorf("lfnChecksum = %#02x, want 0x7d", got)
+	}
+}
+
+func TestParseDirEntriesLFN(t *testing.T) {
+	long := lfnEntries("A long file name.text", "ALONGF~1TEX")
+	full := lfnEntries("exactly13char", "EXACTL~1   ")
+	emoji := lfnEntries("photo \U0001F4F7.jpg", "PHOTO~1 JPG")
+	longer := lfnEntries("A much longer file name for testing.text", "AMUCHL~1TEX")
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{
+			name: "windows layout",
+			data: join(append(long, shortEntry("ALONGF~1TEX", attrArchive, 3, 18))...),
+			want: []string{"A long file name.text"},
+		},
+		{
+			name: "name fills last fragment without terminator",
+			data: join(append(full, shortEntry("EXACTL~1   ", attrArchive, 3, 1))...),
+			want: []string{"exactly13char"},
+		},
+		{
+			name: "surrogate pair",
+			data: join(append(emoji, shortEntry("PHOTO~1 JPG", attrArchive, 3, 1))...),
+			want: []string{"photo \U0001F4F7.jpg"},
+		},
+		{
+			name: "fragments out of order",
+			data: join(longer[0], longer[2], longer[1], longer[3], shortEntry("AMUCHL~1TEX", attrArchive, 3, 18)),
+			want: []string{"A much longer file name for testing.text"},
+		},
+		{
+			name: "checksum mismatch falls back to 8.3 name",
+			data: join(append(long, shortEntry("OTHER   TXT", attrArchive, 3, 18))...),
+			want: []string{"other.txt"},
+		},
+		{
+			name: "missing fragment falls back to 8.3 name",
+			data: join(long[0], shortEntry("ALONGF~1TEX", attrArchive, 3, 18)),
+			want: []string{"alongf~1.tex"},
+		},
+		{
+			name: "orphaned entries before deleted entry",
+			data: join(
+				long[0], long[1],
+				append([]byte{0xE5}, shortEntry("LONGF~1 TEX", attrArchive, 3, 18)[1:]...),
+				shortEntry("README  TXT", attrArchive, 4, 3),
+			),
+			want: []string{"readme.txt"},
+		},
+		{
+			name: "orphaned entries before a new sequence",
+			data: join(append(append([][]byte{long[0]}, full...), shortEntry("EXACTL~1   ", attrArchive, 3, 1))...),
+			want: []string{"exactly13char"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := names(t, tt.data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("names = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("names[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// fat12Image builds a FAT12 volume of 512-byte clusters whose root
+// directory holds readme.txt, with the given data in a chain from cluster 2
+func fat12Image(data []byte) []byte {
+	const sector = 512
+	img := make([]byte, 64*sector)
+	boot := img[:sector]
+	binary.LittleEndian.PutUint16(boot[11:13], sector)
+	boot[13] = 1                                  // Sectors per cluster
+	binary.LittleEndian.PutUint16(boot[14:16], 1) // Reserved sectors
+	boot[16] = 1                                  // FATs
+	binary.LittleEndian.PutUint16(boot[17:19], 16)
+	binary.LittleEndian.PutUint16(boot[19:21], 64)
+	binary.LittleEndian.PutUint16(boot[22:24], 1) // Sectors per FAT
+	boot[510], boot[511] = 0x55, 0xAA
+
+	clusters := (len(data) + sector - 1) / sector
+	for i := 0; i < clusters; i++ {
+		next := uint16(3 + i)
+		if i == clusters-1 {
+			next = 0xFFF
+		}
+		setFAT12(img, 2+i, next)
+	}
+
+	copy(img[2*sector:], shortEntry("README  TXT", attrArchive, 2, uint32(len(data))))
+	copy(img[3*sector:], data)
+	return img
+}
+
+// setFAT12 sets the FAT entry of cluster in an image from fat12Image
+func setFAT12(img []byte, cluster int, next uint16) {
+	fat := img[512:1024]
+	off := cluster * 3 / 2
+	v := binary.LittleEndian.Uint16(fat[off:])
+	if cluster%2 == 0 {
+		v = v&0xF000 | next
+	} else {
+		v = v&0x000F | next<<4
+	}
+	binary.LittleEndian.PutUint16(fat[off:], v)
+}
+
+func TestConcurrentReads(t *testing.T) {
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	filesystem, err := Open(bytes.NewReader(fat12Image(data)), 64*512)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	shared, err := filesystem.Open("readme.txt")
+	if err != nil {
+		t.Fatalf("Open readme.txt: %v", err)
+	}
+	defer shared.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Goroutines share one file for ReadAt
+			off := int64(g * 600)
+			buf := make([]byte, 600)
+			if n, err := shared.(io.ReaderAt).ReadAt(buf, off); n != len(buf) || err != nil {
+				t.Errorf("ReadAt(%d) = %d, %v", off, n, err)
+			} else if !bytes.Equal(buf, data[off:off+600]) {
+				t.Errorf("ReadAt(%d) read the wrong data", off)
+			}
+
+			if _, err := filesystem.ReadDir("."); err != nil {
+				t.Errorf("ReadDir: %v", err)
+			}
+			f, err := filesystem.Open("readme.txt")
+			if err != nil {
+				t.Errorf("Open: %v", err)
+				return
+			}
+			defer f.Close()
+			if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("ReadAll = %d bytes, %v", len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSys(t *testing.T) {
+	img := fat12Image([]byte("hello"))
+	img[2*512+11] |= attrHidden
+	filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	info, err := fs.Stat(filesystem, "readme.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	want := Attributes{Attr: attrArchive | attrHidden, ShortName: "README.TXT", Cluster: 2}
+	if a, ok := info.Sys().(*Attributes); !ok || *a != want {
+		t.Errorf("Sys() = %+v, want %+v", info.Sys(), want)
+	}
+	if root, err := fs.Stat(filesystem, "."); err != nil || root.Sys() != nil {
+		t.Errorf("Sys() of the root = %v, %v, want nil", root, err)
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	data := bytes.Repeat([]byte("recover me "), 100)
+	img := fat12Image(data)
+	long := lfnEntries("Recover me.txt", "RECOVE~1TXT")
+	root := join(append(long, shortEntry("RECOVE~1TXT", attrArchive, 2, uint32(len(data))),
+		shortEntry("NOTES   TXT", attrArchive, 0, 0))...)
+	for i := 0; i < len(long)+2; i++ {
+		root[i*32] = 0xE5
+	}
+	copy(img[2*512:], root)
+	for cluster := 2; cluster <= 4; cluster++ {
+		setFAT12(img, cluster, 0)
+	}
+
+	filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	dl := filesystem.(fsys.DeletedLister)
+	found, err := dl.Deleted()
+	if err != nil {
+		t.Fatalf("Deleted: %v", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("Deleted found %d entries, want 2: %+v", len(found), found)
+	}
+	want := fsys.DeletedEntry{ID: fmt.Sprint(2*512 + len(long)*32), Path: "Recover me.txt", Size: int64(len(data)),
+		Confidence: fsys.ConfidenceMedium}
+	if e := found[0]; e.ID != want.ID || e.Path != want.Path || e.Size != want.Size || e.Confidence != want.Confidence {
+		t.Errorf("Deleted()[0] = %+v, want %+v", e, want)
+	}
+	if e := found[1]; e.Path != "_otes.txt" || e.Confidence != fsys.ConfidenceHigh {
+		t.Errorf("Deleted()[1] = %+v, want _otes.txt with high confidence", e)
+	}
+
+	r, size, err := dl.OpenDeleted(want.ID)
+	if err != nil {
+		t.Fatalf("OpenDeleted: %v", err)
+	}
+	got := make([]byte, size)
+	if _, err := r.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("OpenDeleted read %q, %v, want %q", got, err, data)
+	}
+	if _, _, err := dl.OpenDeleted("1024"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("OpenDeleted of a long name entry = %v, want ErrNotExist", err)
+	}
+
+	// A cluster in use again by another file
+	setFAT12(img, 3, 0xFFF)
+	filesystem, _ = Open(bytes.NewReader(img), int64(len(img)))
+	if found, err := filesystem.(fsys.DeletedLister).Deleted(); err != nil || found[0].Confidence != fsys.ConfidenceLow {
+		t.Errorf("Deleted with a reused cluster = %+v, %v, want low confidence", found, err)
+	}
+}
+
+func TestCorruptBootSector(t *testing.T) {
+	img := fat12Image([]byte("hello"))
+	binary.LittleEndian.PutUint16(img[11:13], 3)
+	_, err := Open(bytes.NewReader(img), int64(len(img)))
+	var corrupt *fsys.ErrCorruptMetadata
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Open = %v, want *fsys.ErrCorruptMetadata", err)
+	}
+	if corrupt.Structure != "boot sector" || corrupt.Offset != 0 {
+		t.Errorf("got %q at %d, want boot sector at 0", corrupt.Structure, corrupt.Offset)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	data := make([]byte, 1500) // Clusters 2-4
+
+	// check returns the problems found in img
+	check := func(img []byte) []string {
+		t.Helper()
+		filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		problems, err := filesystem.(*FS).Check()
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		var found []string
+		for _, p := range problems {
+			found = append(found, p.Kind+": "+p.Detail)
+		}
+		return found
+	}
+
+	if got := check(fat12Image(data)); len(got) != 0 {
+		t.Errorf("problems in a consistent volume: %q", got)
+	}
+
+	// A second file whose chain joins the first at cluster 3
+	img := fat12Image(data)
+	copy(img[2*512+32:], shortEntry("OTHER   TXT", attrArchive, 3, 1024))
+	want := []string{"cross-link: /other.txt: cluster 3 is also used by /readme.txt"}
+	if got := check(img); !slices.Equal(got, want) {
+		t.Errorf("cross-linked chain: got %q, want %q", got, want)
+	}
+
+	// The last cluster links back to the first
+	img = fat12Image(data)
+	setFAT12(img, 4, 2)
+	want = []string{"loop: /readme.txt: chain loops back to cluster 2"}
+	if got := check(img); !slices.Equal(got, want) {
+		t.Errorf("looping chain: got %q, want %q", got, want)
+	}
+	filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(filesystem, "readme.txt"); err != nil || len(got) != len(data) {
+		t.Errorf("reading the looping file = %d bytes, %v", len(got), err)
+	}
+}
+
+// imageWriter writes to an image held in memory
+type imageWriter []byte
+
+func (w imageWriter) WriteAt(p []byte, off int64) (int, error) {
+	return copy(w[off:], p), nil
+}
+
+func TestWrite(t *testing.T) {
+	img := fat12Image(make([]byte, 1500))
+	filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filesystem.(*FS)
+	w := imageWriter(img)
+
+	content := func(n int) []byte {
+		return bytes.Repeat([]byte{byte(n)}, n)
+	}
+	files := map[string][]byte{
+		"readme.txt":                    content(700), // Replaced, one cluster shorter
+		"EFI/BOOT/bootx64.efi":          content(1300),
+		"EFI/BOOT/A long file name.efi": content(10),
+		"empty":                         nil,
+	}
+	for _, dir := range []string{"EFI", "EFI/BOOT"} {
+		if err := f.Mkdir(w, dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		if err := f.WriteFile(w, name, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Enough names to take the directory past its first cluster
+	for i := range 20 {
+		name := fmt.Sprintf("EFI/Long name %d.txt", i)
+		files[name] = content(i)
+		if err := f.WriteFile(w, name, files[name], 0o444); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Mkdir(w, "EFI", 0o755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir of an existing directory = %v", err)
+	}
+	if err := f.WriteFile(w, "EFI/BOOT", nil, 0o644); err == nil {
+		t.Error("WriteFile over a directory succeeded")
+	}
+	if err := f.WriteFile(w, "big", make([]byte, 64*512), 0o644); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Errorf("WriteFile of more than the free space = %v", err)
+	}
+
+	// Everything reads back from the image opened afresh
+	filesystem, err = Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if got, err := fs.ReadFile(filesystem, name); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("reading %s = %d bytes, %v, want %d bytes", name, len(got), err, len(data))
+		}
+	}
+	if info, err := filesystem.Stat("EFI/Long name 3.txt"); err != nil || info.Mode().Perm() != 0o444 {
+		t.Errorf("Stat = %v, %v", info, err)
+	}
+	entries, err := filesystem.ReadDir("EFI/BOOT")
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	slices.Sort(got)
+	if want := []string{"A long file name.efi", "bootx64.efi"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("ReadDir = %q, %v, want %q", got, err, want)
+	}
+	problems, err := filesystem.(*FS).Check()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Check = %v, %v", problems, err)
+	}
+}
+
+func TestShortName(t *testing.T) {
+	tests := []struct {
+		name  string
+		short string
+		flags byte
+		fits  bool
+	}{
+		{"README.TXT", "README  TXT", 0, true},
+		{"readme.txt", "README  TXT", lowerBase | lowerExt, true},
+		{"BOOTX64.efi", "BOOTX64 EFI", lowerExt, true},
+		{"grub", "GRUB       ", lowerBase, true},
+		{"Makefile", "", 0, false},
+		{"a.tar.gz", "", 0, false},
+		{"toolongname.txt", "", 0, false},
+		{".hidden", "", 0, false},
+		{"with space", "", 0, false},
+	}
+	for _, tt := range tests {
+		short, flags, fits := shortName(tt.name)
+		if fits != tt.fits || fits && (string(short[:]) != tt.short || flags != tt.flags) {
+			t.Errorf("shortName(%q) = %q, %#x, %v", tt.name, short, flags, fits)
+		}
+	}
+
+	d := &dir{data: []byte("ATAR~1  GZ "), entries: []dirEntry{{}}}
+	if got := uniqueShortName("a.tar.gz", d); string(got[:]) != "ATAR~2  GZ " {
+		t.Errorf("uniqueShortName = %q", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tree := fstest.MapFS{
+		"readme.txt":            {Data: []byte("hello\n"), Mode: 0o644},
+		"A long file name.text": {Data: bytes.Repeat([]byte("rawhide "), 1000), Mode: 0o444},
+		"Sub Dir/nested.txt":    {Data: bytes.Repeat([]byte{1}, 5000), Mode: 0o644},
+		"EFI/BOOT/BOOTX64.EFI":  {Data: bytes.Repeat([]byte{2}, 70000), Mode: 0o644},
+		"EFI/BOOT/Empty Dir":    {Mode: fs.ModeDir | 0o755},
+	}
+	tests := []struct {
+		size        int64
+		opts        FormatOptions
+		typ         string
+		clusterSize int
+	}{
+		{1440 << 10, FormatOptions{Label: "floppy"}, "FAT12", 512},
+		{20 << 20, FormatOptions{}, "FAT16", 2048},
+		{8 << 20, FormatOptions{Type: "FAT16", SectorSize: 1024}, "FAT16", 1024},
+		{40 << 20, FormatOptions{Type: "FAT32", Label: "ESP", NumFATs: 1}, "FAT32", 512},
+		{600 << 20, FormatOptions{}, "FAT32", 4096},
+	}
+	for _, tt := range tests {
+		img := make([]byte, tt.size)
+		if err := Format(imageWriter(img), tt.size, tt.opts); err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		filesystem, err := Open(bytes.NewReader(img), tt.size)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		f := filesystem.(*FS)
+		if err := fsys.WriteTree(f, imageWriter(img), tree); err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+
+		if f.Type() != tt.typ || f.clusterSize() != tt.clusterSize {
+			t.Errorf("%s: got %s with %d byte clusters, want %d", tt.typ, f.Type(), f.clusterSize(), tt.clusterSize)
+		}
+		if got, want := f.Label(), strings.ToUpper(tt.opts.Label); got != want {
+			t.Errorf("%s: label %q, want %q", tt.typ, got, want)
+		}
+		if dirty, err := f.isDirty(); dirty || err != nil {
+			t.Errorf("%s: dirty %v, %v", tt.typ, dirty, err)
+		}
+		var paths []string
+		fs.WalkDir(f, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				t.Errorf("%s: %v", tt.typ, err)
+			}
+			paths = append(paths, path)
+			return nil
+		})
+		slices.Sort(paths)
+		want := []string{".", "A long file name.text", "EFI", "EFI/BOOT", "EFI/BOOT/BOOTX64.EFI", "EFI/BOOT/Empty Dir",
+			"Sub Dir", "Sub Dir/nested.txt", "readme.txt"}
+		if !slices.Equal(paths, want) {
+			t.Errorf("%s: walked %q, want %q", tt.typ, paths, want)
+		}
+		for name, file := range tree {
+			if file.Mode.IsDir() {
+				continue
+			}
+			if got, err := fs.ReadFile(f, name); err != nil || !bytes.Equal(got, file.Data) {
+				t.Errorf("%s: reading %s = %d bytes, %v", tt.typ, name, len(got), err)
+			}
+		}
+		if problems, err := f.Check(); err != nil || len(problems) != 0 {
+			t.Errorf("%s: Check = %v, %v", tt.typ, problems, err)
+		}
+
+		// The free count FAT32 keeps matches the FAT
+		free, source, err := f.freeClusterCount()
+		f.bpb.fsInfoSector = 0
+		counted, _, _ := f.freeClusterCount()
+		if err != nil || free != counted {
+			t.Errorf("%s: %d free clusters from %s, %d counted, %v", tt.typ, free, source, counted, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		size int64
+		opts FormatOptions
+	}{
+		{2 << 20, FormatOptions{Type: "FAT16"}},
+		{40 << 20, FormatOptions{Type: "FAT32", SectorsPerCluster: 8}},
+		{1 << 20, FormatOptions{Type: "FAT12", SectorsPerCluster: 3}},
+		{1 << 20, FormatOptions{Type: "exFAT"}},
+		{1024, FormatOptions{}},
+	} {
+		if err := Format(imageWriter(make([]byte, tt.size)), tt.size, tt.opts); err == nil {
+			t.Errorf("formatted %d bytes with %+v", tt.size, tt.opts)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tree := fstest.MapFS{
+		"evidence/readme.txt":       {Data: []byte("hello\n"), Mode: 0o644},
+		"evidence/A long name.text": {Data: bytes.Repeat([]byte("rawhide "), 1000), Mode: 0o444},
+		"evidence/what?.log":        {Data: bytes.Repeat([]byte{1}, 5000), Mode: 0o644},
+		"evidence/sub/big.bin":      {Data: bytes.Repeat([]byte{2, 3, 4}, 70000), Mode: 0o644},
+		"evidence/sub/empty":        {Mode: 0o644},
+		"evidence/pipe":             {Mode: fs.ModeNamedPipe},
+		"other.txt":                 {Data: []byte("other\n"), Mode: 0o644},
+	}
+	tests := []struct {
+		opts FormatOptions
+		typ  string
+	}{
+		{FormatOptions{}, "FAT12"},
+		{FormatOptions{Type: "FAT32", Label: "evidence"}, "FAT32"},
+	}
+	for _, tt := range tests {
+		img, err := Build(tree, []string{"evidence", "other.txt"}, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		filesystem, err := Open(img, img.Size())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		f := filesystem.(*FS)
+		if f.Type() != tt.typ {
+			t.Errorf("%s: got %s", tt.typ, f.Type())
+		}
+
+		want := map[string]string{
+			"evidence/readme.txt":       "evidence/readme.txt",
+			"evidence/A long name.text": "evidence/A long name.text",
+			"evidence/what_.log":        "evidence/what?.log",
+			"evidence/sub/big.bin":      "evidence/sub/big.bin",
+			"evidence/sub/empty":        "evidence/sub/empty",
+			"other.txt":                 "other.txt",
+		}
+		var paths []string
+		fs.WalkDir(f, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				t.Errorf("%s: %v", tt.typ, err)
+			}
+			if !d.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if len(paths) != len(want) {
+			t.Errorf("%s: walked %q", tt.typ, paths)
+		}
+		for name, from := range want {
+			if got, err := fs.ReadFile(f, name); err != nil || !bytes.Equal(got, tree[from].Data) {
+				t.Errorf("%s: reading %s = %d bytes, %v", tt.typ, name, len(got), err)
+			}
+		}
+		if info, err := fs.Stat(f, "evidence/A long name.text"); err != nil || info.Sys().(*Attributes).Attr&attrReadOnly == 0 {
+			t.Errorf("%s: read-only file is not read-only, %v", tt.typ, err)
+		}
+		if problems, err := f.Check(); err != nil || len(problems) != 0 {
+			t.Errorf("%s: Check = %v, %v", tt.typ, problems, err)
+		}
+		img.Close()
+	}
+}
+
+// TestBulkTable checks the entries read in windows of the table against
+// those read one at a time
+func TestBulkTable(t *testing.T) {
+	for _, typ := range []string{"FAT12", "FAT16", "FAT32"} {
+		size := int64(40 << 20)
+		if typ == "FAT12" {
+			size = 4 << 20
+		}
+		img := make([]byte, size)
+		if err := Format(imageWriter(img), size, FormatOptions{Type: typ}); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		filesystem, err := Open(bytes.NewReader(img), size)
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		f := filesystem.(*FS)
+		table := img[f.fat.startOffset : f.fat.startOffset+f.fat.size]
+		for i := range table {
+			table[i] = byte(i * 7 / 5)
+		}
+
+		// In order, and jumping about the table
+		end := f.bpb.countOfClusters + 2
+		for _, step := range []uint32{1, 4099} {
+			bulk := f.fat.bulk()
+			for i := uint32(0); i < end-2; i++ {
+				cluster := 2 + i*step%(end-2)
+				want, err := f.fat.next(cluster)
+				if err != nil {
+					t.Fatalf("%s: %v", typ, err)
+				}
+				if got, err := bulk.next(cluster); got != want || err != nil {
+					t.Fatalf("%s: entry %d = %#x, %v from the bulk reader, want %#x", typ, cluster, got, err, want)
+				}
+			}
+			if got := len(bulk.window.data); step == 1 && got < maxFATWindow && int64(got) < f.fat.size/2 {
+				t.Errorf("%s: read the table %d bytes at a time", typ, got)
+			}
+		}
+	}
+}
+
+// TestLabel covers where formatters keep the label: mkfs.vfat writes it to
+// both the BPB and the root directory, while Windows writes "NO NAME" to
+// the BPB and changes only the root directory entry on relabelling
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		bpb, root string
+		want      string
+	}{
+		{"RAWHIDE    ", "RAWHIDE    ", "RAWHIDE"},
+		{"NO NAME    ", "WINLABEL   ", "WINLABEL"},
+		{"OLDLABEL   ", "NEWLABEL   ", "NEWLABEL"},
+		{"BPBONLY    ", "", "BPBONLY"},
+		{"NO NAME    ", "", ""},
+	}
+	for _, tt := range tests {
+		img := fat12Image([]byte("hello"))
+		img[38] = 0x29 // Extended boot signature
+		copy(img[43:54], tt.bpb)
+		if tt.root != "" {
+			copy(img[2*512+32:], shortEntry(tt.root, attrVolumeID, 0, 0))
+		}
+		filesystem, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filesystem.(*FS).Label(); got != tt.want {
+			t.Errorf("BPB %q, root %q: Label() = %q, want %q", tt.bpb, tt.root, got, tt.want)
+		}
+		if _, err := filesystem.Stat("readme.txt"); err != nil {
+			t.Errorf("BPB %q, root %q: %v", tt.bpb, tt.root, err)
+		}
+	}
+}
+
+// TestMkfsImages reads volumes made by mkfs.vfat and filled by mtools
+func TestMkfsImages(t *testing.T) {
+	mkfs, err := exec.LookPath("mkfs.vfat")
+	if err != nil {
+		t.Skip("mkfs.vfat is not installed")
+	}
+	for _, tool := range []string{"mmd", "mcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s (mtools) is not installed", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("rawhide "), 1000)
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fatBits, sectorsPerCluster, kib int
+		label                           string
+		typ                             string
+	}{
+		{12, 2, 2048, "RAWHIDE", "FAT12"},
+		{16, 4, 16384, "RAWHIDE", "FAT16"},
+		{32, 1, 40960, "RAWHIDE", "FAT32"},
+		{32, 2, 81920, "", "FAT32"}, // "NO NAME" in the BPB
+	}
+	for i, tt := range tests {
+		name := filepath.Join(dir, fmt.Sprintf("%d.img", i))
+		args := []string{"-C", "-F", fmt.Sprint(tt.fatBits), "-s", fmt.Sprint(tt.sectorsPerCluster)}
+		if tt.label != "" {
+			args = append(args, "-n", tt.label)
+		}
+		run(t, mkfs, append(args, name, fmt.Sprint(tt.kib))...)
+		run(t, "mmd", "-i", name, "::/Sub Dir")
+		run(t, "mcopy", "-i", name, src, "::/A long file name.text")
+		run(t, "mcopy", "-i", name, src, "::/readme.txt")
+		run(t, "mcopy", "-i", name, src, "::/Sub Dir/nested.txt")
+
+		image, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer image.Close()
+		filesystem, err := Open(image, int64(tt.kib)<<10)
+		if err != nil {
+			t.Fatalf("FAT%d: %v", tt.fatBits, err)
+		}
+		f := filesystem.(*FS)
+		if f.Type() != tt.typ {
+			t.Errorf("FAT%d: type %s", tt.fatBits, f.Type())
+		}
+		if got := f.Label(); got != tt.label {
+			t.Errorf("FAT%d: label %q, want %q", tt.fatBits, got, tt.label)
+		}
+		if got, want := f.clusterSize(), tt.sectorsPerCluster*512; got != want {
+			t.Errorf("FAT%d: cluster size %d, want %d", tt.fatBits, got, want)
+		}
+
+		var listing []string
+		for _, d := range []string{".", "Sub Dir"} {
+			entries, err := f.ReadDir(d)
+			if err != nil {
+				t.Fatalf("FAT%d: ReadDir(%q): %v", tt.fatBits, d, err)
+			}
+			for _, e := range entries {
+				listing = append(listing, path.Join(d, e.Name()))
+			}
+		}
+		slices.Sort(listing)
+		want := []string{"A long file name.text", "Sub Dir", "Sub Dir/nested.txt", "readme.txt"}
+		if !slices.Equal(listing, want) {
+			t.Errorf("FAT%d: listing %q, want %q", tt.fatBits, listing, want)
+		}
+		for _, file := range want {
+			if file == "Sub Dir" {
+				continue
+			}
+			if got, err := fs.ReadFile(f, file); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("FAT%d: reading %s = %d bytes, %v", tt.fatBits, file, len(got), err)
+			}
+		}
+	}
+}
+
+// run runs a command, failing the test if it fails
+func run(t *testing.T, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s %q: %v\n%s", name, args, err, out)
+	}
+}
@@ -2,10 +2,26 @@
 package fsys
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"math"
+	"os"
+	"path"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/lvdlvd/rawhide/detect"
 )
 
 // Range represents a byte range [Start, End) where Start is inclusive
@@ -25,10 +41,18 @@ type Extent struct {
 	Logical  int64 // Offset within the file
 	Physical int64 // Offset within the image
 	Length   int64 // Length of this extent
+	Shared   bool  // Data is also referenced by other files (e.g. a clone)
+	Zero     bool  // Allocated but reads as zeros (e.g. an unwritten extent)
 }
 
 // FS represents a read-only filesystem that can be opened from a disk image.
 // It embeds io/fs.FS and adds image-specific functionality.
+//
+// Implementations are safe for concurrent use: their methods, those of the
+// optional interfaces, ReadAt on the files they open and the readers
+// OpenReaderAt returns may be called from several goroutines at once, so
+// state loaded on first use is guarded. Read, Seek and ReadDir, which move
+// a file's offset, are not safe on the same file.
 type FS interface {
 	fs.FS
 	fs.ReadDirFS
@@ -54,15 +78,1521 @@ type FreeBlocker interface {
 type ExtentMapper interface {
 	// FileExtents returns the list of extents that map a file's logical
 	// offsets to physical offsets in the image. Returns error if path
-	// doesn't exist or is a directory.
+	// doesn't exist or is a directory the filesystem cannot map; those
+	// that can map directories return the extents of the raw entries.
+	// Extents may leave gaps: holes in a sparse file, which read as zeros
+	// and have no space in the image. Space that is allocated but reads
+	// as zeros whatever the image holds there is an extent marked Zero.
 	FileExtents(path string) ([]Extent, error)
 }
 
+// BlockSizer is an optional interface for filesystems that allocate space
+// in blocks or clusters of one size
+type BlockSizer interface {
+	// BlockSize returns the size in bytes of the unit space is allocated in
+	BlockSize() int64
+}
+
+// Fragmentation describes how the data of a file, or of several files
+// added up, lies in the image
+type Fragmentation struct {
+	Files      int   // Files with data in the image
+	Fragmented int   // Files in more than one fragment
+	Fragments  int   // Runs of data, each not following on from the one before in the image
+	Bytes      int64 // Data in the image; holes have none
+	Span       int64 // From each file's first byte in the image to past its last, added up
+}
+
+// FragmentationOf returns the fragmentation of a file from its extents.
+// Zero extents count, as their space is allocated.
+func FragmentationOf(extents []Extent) Fragmentation {
+	var f Fragmentation
+	first, last, next := int64(math.MaxInt64), int64(0), int64(-1)
+	for _, e := range sortedExtents(extents) {
+		if e.Length <= 0 {
+			continue
+		}
+		if e.Physical != next {
+			f.Fragments++
+		}
+		next = e.Physical + e.Length
+		f.Bytes += e.Length
+		first, last = min(first, e.Physical), max(last, next)
+	}
+	if f.Fragments == 0 {
+		return f
+	}
+	f.Files, f.Span = 1, last-first
+	if f.Fragments > 1 {
+		f.Fragmented = 1
+	}
+	return f
+}
+
+// FileFragmentation returns the fragmentation of a file from the extents
+// its filesystem maps
+func FileFragmentation(filesystem FS, name string) (Fragmentation, error) {
+	em, ok := filesystem.(ExtentMapper)
+	if !ok {
+		return Fragmentation{}, fmt.Errorf("filesystem type %s cannot map file data: %w", filesystem.Type(), errors.ErrUnsupported)
+	}
+	extents, err := em.FileExtents(name)
+	if err != nil {
+		return Fragmentation{}, err
+	}
+	return FragmentationOf(extents), nil
+}
+
+// Add adds the files of o to f, to sum up a directory tree or a whole
+// filesystem
+func (f *Fragmentation) Add(o Fragmentation) {
+	f.Files += o.Files
+	f.Fragmented += o.Fragmented
+	f.Fragments += o.Fragments
+	f.Bytes += o.Bytes
+	f.Span += o.Span
+}
+
+// Score rates how scattered the data is, as the part of the span of the
+// files that holds other data: 0 if each file is in one piece, towards 1
+// as its fragments lie further apart
+func (f Fragmentation) Score() float64 {
+	if f.Span <= f.Bytes {
+		return 0
+	}
+	return 1 - float64(f.Bytes)/float64(f.Span)
+}
+
+// Checker is an optional interface for filesystems that can verify the
+// consistency of their own metadata
+type Checker interface {
+	// Check walks the filesystem metadata and returns the inconsistencies
+	// found. It returns an error only if the check itself could not run.
+	Check() ([]Problem, error)
+}
+
+// Problem describes a single inconsistency found by a Checker
+type Problem struct {
+	Kind   string // Short category, e.g. "cross-link" or "lost-chain"
+	Detail string // Human-readable description
+}
+
+// DeletedLister is an optional interface for filesystems that can find
+// deleted files whose metadata is still on disk, for undeleting them
+type DeletedLister interface {
+	// Deleted returns the deleted files found, in no particular order
+	Deleted() ([]DeletedEntry, error)
+
+	// OpenDeleted returns a reader of what is left of the data of the
+	// deleted file with the given ID, and its size
+	OpenDeleted(id string) (ReaderAtCloser, int64, error)
+}
+
+// DeletedEntry is a deleted file a DeletedLister found
+type DeletedEntry struct {
+	ID         string // Names the file to OpenDeleted, e.g. an inode number
+	Path       string // Where the file was, as far as is known; "?" stands for a lost name
+	IsDir      bool
+	Size       int64
+	ModTime    time.Time
+	AccessTime time.Time // Zero if not recorded
+	BirthTime  time.Time // Zero if not recorded
+	DeleteTime time.Time // Zero if not recorded
+	Extents    []Extent  // Where the data was, as far as is known
+	Confidence Confidence
+}
+
+// Confidence rates how likely it is that the data at a deleted file's
+// extents is still the file's
+type Confidence int
+
+const (
+	ConfidenceNone   Confidence = iota // The space is in use again, or the extents are lost
+	ConfidenceLow                      // Some of the space is in use again
+	ConfidenceMedium                   // The space is free, but the extents are a guess
+	ConfidenceHigh                     // The space is free and the extents are recorded
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceNone:
+		return "none"
+	case ConfidenceLow:
+		return "low"
+	case ConfidenceMedium:
+		return "medium"
+	case ConfidenceHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Confidence(%d)", int(c))
+}
+
+// RateDeleted rates the extents of a deleted file of the given size
+// against the free space of its filesystem, as FreeBlocks returns it. Zero
+// extents take no space and count as free. Extents that are guessed
+// rather than recorded rate medium at best; an empty file rates high.
+func RateDeleted(free []Range, extents []Extent, size int64, guessed bool) Confidence {
+	var total, inFree int64
+	for _, e := range extents {
+		if e.Zero {
+			continue
+		}
+		total += e.Length
+		end := e.Physical + e.Length
+		i := sort.Search(len(free), func(i int) bool { return free[i].End > e.Physical })
+		for ; i < len(free) && free[i].Start < end; i++ {
+			inFree += min(free[i].End, end) - max(free[i].Start, e.Physical)
+		}
+	}
+	switch {
+	case len(extents) == 0 && size > 0:
+		return ConfidenceNone
+	case len(extents) == 0:
+		return ConfidenceHigh // Nothing to recover
+	case inFree < total && inFree > 0:
+		return ConfidenceLow
+	case inFree < total:
+		return ConfidenceNone
+	case guessed:
+		return ConfidenceMedium
+	}
+	return ConfidenceHigh
+}
+
+// Journaler is an optional interface for filesystems that keep a
+// metadata journal
+type Journaler interface {
+	// JournalTransactions returns the committed transactions in the journal
+	// that may not have reached their home locations yet, oldest first
+	JournalTransactions() ([]Transaction, error)
+}
+
+// Recoverer is an optional interface for journaled filesystems that can
+// tell whether they were left needing recovery, without reading the
+// journal's transactions themselves
+type Recoverer interface {
+	// NeedsRecovery reports whether the journal holds changes that
+	// mounting the filesystem would replay
+	NeedsRecovery() (bool, error)
+}
+
+// Transaction is a group of blocks that the journal writes atomically
+type Transaction struct {
+	Offset int64 // Offset of the transaction within the image
+	Blocks []JournalBlock
+}
+
+// JournalBlock is a block recorded in a journal transaction
+type JournalBlock struct {
+	Target int64  // Offset within the image the block is written to
+	Data   []byte // New contents of the block
+}
+
+// MetadataDumper is an optional interface for filesystems and partition
+// tables that can decode their main on-disk structures, for debugging and
+// for comparing two images
+type MetadataDumper interface {
+	// Metadata returns the decoded structures as a value for
+	// encoding/json. If record is not negative, the numbered record it
+	// names, such as an inode or MFT record, is decoded too.
+	Metadata(record int64) (any, error)
+}
+
+// Labeler is an optional interface for filesystems with a volume name
+type Labeler interface {
+	// Label returns the volume name, or "" if there is none
+	Label() string
+}
+
+// FileWriter is an optional interface for filesystems that can create and
+// replace files in the image itself. Changes are written through w, which
+// must write the image the filesystem reads.
+type FileWriter interface {
+	// WriteFile creates or replaces the named file with data
+	WriteFile(w io.WriterAt, name string, data []byte, perm fs.FileMode) error
+
+	// Mkdir creates the named directory
+	Mkdir(w io.WriterAt, name string, perm fs.FileMode) error
+}
+
+// WriteTree copies the directories and regular files of src into dst,
+// writing the image through w. Directories dst has already are written
+// into, and files it has are replaced. Symbolic links to files are
+// followed.
+func WriteTree(dst FileWriter, w io.WriterAt, src fs.FS) error {
+	return fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := fs.Stat(src, name) // Following symbolic links
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir() && d.Type()&fs.ModeSymlink != 0:
+			return &fs.PathError{Op: "copy", Path: name, Err: errors.New("symbolic link to a directory")}
+		case info.IsDir():
+			if err := dst.Mkdir(w, name, info.Mode().Perm()); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+		case info.Mode().IsRegular():
+			data, err := fs.ReadFile(src, name)
+			if err != nil {
+				return err
+			}
+			return dst.WriteFile(w, name, data, info.Mode().Perm())
+		default:
+			return &fs.PathError{Op: "copy", Path: name, Err: errors.New("not a regular file or directory")}
+		}
+		return nil
+	})
+}
+
+// DiskOrder has the filesystems of this module list directories in the
+// order their entries are stored in, rather than sorted by name as
+// fs.ReadDirFS asks, for looking at how a directory is laid out. It is set
+// before filesystems are opened. ReadDir on an open directory gives the
+// stored order either way.
+var DiskOrder bool
+
+// ReadDirFile implements fs.ReadDirFS for filesystems whose directories
+// open as fs.ReadDirFiles: it reads the named directory through Open, and
+// sorts the entries by name unless DiskOrder is set
+func ReadDirFile(filesystem fs.FS, name string) ([]fs.DirEntry, error) {
+	file, err := filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dir, ok := file.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := dir.ReadDir(-1)
+	if !DiskOrder {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return entries, err
+}
+
+// ReaderAtCloser is random access to the data of a file
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// ReaderAtOpener is an optional interface for filesystems that provide
+// their own random access to file data, which OpenReaderAt then uses
+type ReaderAtOpener interface {
+	// OpenReaderAt returns a reader for the data of the named file and
+	// its size
+	OpenReaderAt(name string) (ReaderAtCloser, int64, error)
+}
+
+// OpenReaderAt returns random access to the data of a file, and its size.
+// It uses the filesystem's ReaderAtOpener if it has one, otherwise the
+// file's extents in the image where the filesystem can map them, and
+// reads files without extents, such as compressed ones, with
+// DefaultBudget.ReadAll.
+// Filesystems that can map directories expose their raw entries,
+// sized by the extents. The reader must be closed when no longer used.
+func OpenReaderAt(filesystem FS, name string) (ReaderAtCloser, int64, error) {
+	if o, ok := filesystem.(ReaderAtOpener); ok {
+		return o.OpenReaderAt(name)
+	}
+
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+
+	if em, ok := filesystem.(ExtentMapper); ok {
+		if br, ok := filesystem.(interface{ BaseReader() io.ReaderAt }); ok {
+			extents, err := em.FileExtents(name)
+			if errors.Is(err, ErrEncrypted) {
+				return nil, 0, err
+			}
+			if err == nil && len(extents) > 0 {
+				if info.IsDir() {
+					last := extents[len(extents)-1]
+					size = last.Logical + last.Length
+				}
+				return NewExtentReaderAt(br.BaseReader(), extents, size), size, nil
+			}
+		}
+	}
+
+	if info.IsDir() {
+		return nil, 0, fmt.Errorf("%s is a directory", name)
+	}
+
+	file, err := filesystem.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	return DefaultBudget.ReadAll(file, size)
+}
+
+// spillChunk is the least more of a budget ReadAll takes, if there is that
+// much left, when a file turns out to be larger than it said
+const spillChunk = 1 << 20
+
+// MemoryBudget bounds the memory the files read whole by ReadAll take up
+// at once. A file that does not fit in what is left of it is copied to a
+// temporary file instead.
+type MemoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	dir   string // Directory of the temporary files, "" for the default
+}
+
+// DefaultBudget is the budget OpenReaderAt reads files without extents
+// with
+var DefaultBudget = NewMemoryBudget(256 << 20)
+
+// NewMemoryBudget returns a budget of limit bytes
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: max(limit, 0)}
+}
+
+// SetLimit changes the memory files may take up; 0 copies every file to a
+// temporary file. Files already read keep their memory.
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = max(limit, 0)
+}
+
+// SetTempDir sets the directory of the temporary files, "" for the
+// default of os.CreateTemp
+func (b *MemoryBudget) SetTempDir(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dir = dir
+}
+
+// take reserves n bytes, reporting whether they fit
+func (b *MemoryBudget) take(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// takeUpTo reserves as much of n bytes as is left, returning how much
+func (b *MemoryBudget) takeUpTo(n int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n = max(min(n, b.limit-b.used), 0)
+	b.used += n
+	return n
+}
+
+// release returns n bytes taken
+func (b *MemoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// ReadAll reads r to its end into memory while the budget allows, and into
+// a temporary file from the point where it does not, returning a reader of
+// what was read and its size. size is what r is expected to hold. The
+// reader must be closed to give back the memory or remove the file.
+func (b *MemoryBudget) ReadAll(r io.Reader, size int64) (ReaderAtCloser, int64, error) {
+	var data []byte
+	var held int64
+	if size > 0 && b.take(size) {
+		data, held = make([]byte, 0, size), size
+	}
+	for {
+		if len(data) == cap(data) {
+			// Only take more of the budget if there is more to read
+			var probe [1]byte
+			if _, err := io.ReadFull(r, probe[:]); err == io.EOF {
+				break
+			} else if err != nil {
+				b.release(held)
+				return nil, 0, err
+			}
+			more := b.takeUpTo(max(int64(cap(data)), spillChunk))
+			if more == 0 {
+				b.release(held)
+				return b.spill(data, io.MultiReader(bytes.NewReader(probe[:]), r))
+			}
+			held += more
+			grown := make([]byte, len(data), int64(cap(data))+more)
+			copy(grown, data)
+			data = append(grown, probe[0])
+			continue
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.release(held)
+			return nil, 0, err
+		}
+	}
+	return &memReader{Reader: bytes.NewReader(data), budget: b, held: held}, int64(len(data)), nil
+}
+
+// spill copies head and the rest of r to a temporary file
+func (b *MemoryBudget) spill(head []byte, r io.Reader) (ReaderAtCloser, int64, error) {
+	b.mu.Lock()
+	dir := b.dir
+	b.mu.Unlock()
+	f, err := os.CreateTemp(dir, "rawhide-spill-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("file does not fit in memory: %w", err)
+	}
+	tf := &tempFile{f}
+	if _, err := f.Write(head); err != nil {
+		tf.Close()
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		tf.Close()
+		return nil, 0, err
+	}
+	return tf, int64(len(head)) + n, nil
+}
+
+// memReader is a file read into memory
+type memReader struct {
+	*bytes.Reader
+	budget *MemoryBudget
+	held   int64 // Bytes of budget taken, given back by the first Close
+}
+
+func (m *memReader) Close() error {
+	if held := atomic.SwapInt64(&m.held, 0); held != 0 {
+		m.budget.release(held)
+	}
+	return nil
+}
+
+// tempFile is a file read into a temporary file, which Close removes
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	if rerr := os.Remove(t.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Symlinker is an optional interface for filesystems with symbolic links
+type Symlinker interface {
+	// ReadLink returns the target of the named symbolic link
+	ReadLink(name string) (string, error)
+
+	// Lstat returns information about the named file, without following
+	// a symbolic link it names
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// ReadLink returns the target of a symbolic link, from the filesystem's
+// Symlinker if it has one, otherwise from the link's contents
+func ReadLink(filesystem FS, name string) (string, error) {
+	if sl, ok := filesystem.(Symlinker); ok {
+		return sl.ReadLink(name)
+	}
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := fs.ReadFile(filesystem, name)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// Lstat returns information about a file without following a symbolic
+// link it names. Filesystems without a Symlinker have no links to follow.
+func Lstat(filesystem FS, name string) (fs.FileInfo, error) {
+	if sl, ok := filesystem.(Symlinker); ok {
+		return sl.Lstat(name)
+	}
+	return filesystem.Stat(name)
+}
+
+// XattrFS is an optional interface for filesystems with extended
+// attributes. Names given to it that end in a symbolic link name the link
+// itself.
+type XattrFS interface {
+	// ListXattr returns the names of the named file's extended
+	// attributes, sorted
+	ListXattr(name string) ([]string, error)
+
+	// GetXattr returns the value of the extended attribute attr of the
+	// named file, or an error wrapping ErrNoXattr if it has none by that
+	// name
+	GetXattr(name, attr string) ([]byte, error)
+}
+
+// ErrNoXattr is returned for an extended attribute a file does not have
+var ErrNoXattr = errors.New("no such extended attribute")
+
+// ListXattr returns the names of a file's extended attributes, from the
+// filesystem's XattrFS if it has one; files of other filesystems have none
+func ListXattr(filesystem FS, name string) ([]string, error) {
+	if xf, ok := filesystem.(XattrFS); ok {
+		return xf.ListXattr(name)
+	}
+	if _, err := Lstat(filesystem, name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetXattr returns the value of an extended attribute of a file, from the
+// filesystem's XattrFS if it has one
+func GetXattr(filesystem FS, name, attr string) ([]byte, error) {
+	if xf, ok := filesystem.(XattrFS); ok {
+		return xf.GetXattr(name, attr)
+	}
+	if _, err := Lstat(filesystem, name); err != nil {
+		return nil, err
+	}
+	return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrNoXattr}
+}
+
+// IsSpecial reports whether a file mode is that of a device, named pipe
+// or socket, which has no data to read
+func IsSpecial(mode fs.FileMode) bool {
+	return mode&(fs.ModeDevice|fs.ModeCharDevice|fs.ModeNamedPipe|fs.ModeSocket|fs.ModeIrregular) != 0
+}
+
+// maxLinks bounds the symbolic links followed to resolve one path
+const maxLinks = 40
+
+// resolve follows the symbolic links in every element of name, taking
+// absolute targets to start at the root of the filesystem, and returns
+// the path without links and information about the file there
+func resolve(filesystem FS, name string) (string, fs.FileInfo, error) {
+	links := 0
+	done := "."
+	rest := strings.Split(name, "/")
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		if elem == "" || elem == "." {
+			continue
+		}
+		p := path.Join(done, elem)
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return "", nil, errors.New("link leaves the filesystem")
+		}
+		info, err := Lstat(filesystem, p)
+		if err != nil {
+			return "", nil, err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			done = p
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", nil, errors.New("too many levels of symbolic links")
+		}
+		target, err := ReadLink(filesystem, p)
+		if err != nil {
+			return "", nil, err
+		}
+		if strings.HasPrefix(target, "/") {
+			done = "."
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	info, err := filesystem.Stat(done)
+	if err != nil {
+		return "", nil, err
+	}
+	return done, info, nil
+}
+
+// WalkOptions select how Walk treats symbolic links and errors
+type WalkOptions struct {
+	// FollowLinks makes Walk follow symbolic links, the root's included,
+	// and descend into the directories they name, unless that would
+	// revisit a directory it is walking
+	FollowLinks bool
+
+	// Error is called with each error Walk meets below the root, such as
+	// an unreadable directory or a link it cannot follow, after which Walk
+	// carries on. If Error is nil, Walk returns them joined at the end.
+	Error func(err error)
+
+	// Context, if not nil, stops the walk when it is done; Walk then
+	// returns its error
+	Context context.Context
+}
+
+// WalkFunc is the function Walk calls for each file. name is the file's
+// path through the walk and at is where it is in the filesystem, which
+// differs from name below the links Walk follows; d describes the file
+// at. Returning fs.SkipDir or fs.SkipAll skips files as for fs.WalkDir,
+// and any other error stops the walk and is returned by it.
+type WalkFunc func(name, at string, d fs.DirEntry) error
+
+// Walk calls fn for root and the files below it, directories before
+// their contents, in lexical order, like fs.WalkDir. Unlike it, Walk does
+// not stop at errors below the root, and can follow symbolic links
+// without looping. Special files and links that are not followed are
+// passed to fn, but never opened.
+func Walk(filesystem FS, root string, opts WalkOptions, fn WalkFunc) error {
+	w := &walker{fs: filesystem, opts: opts, fn: fn}
+
+	at := root
+	info, err := Lstat(filesystem, root)
+	if err != nil {
+		return err
+	}
+	if opts.FollowLinks {
+		if at, info, err = resolve(filesystem, root); err != nil {
+			return &fs.PathError{Op: "walk", Path: root, Err: err}
+		}
+	}
+
+	err = w.walk(root, at, fs.FileInfoToDirEntry(info), nil)
+	if err == fs.SkipDir || err == fs.SkipAll {
+		err = nil
+	}
+	if err == nil {
+		err = errors.Join(w.errs...)
+	}
+	return err
+}
+
+// walker is the state of a Walk
+type walker struct {
+	fs   FS
+	opts WalkOptions
+	fn   WalkFunc
+	errs []error
+}
+
+func (w *walker) report(err error) {
+	if w.opts.Error != nil {
+		w.opts.Error(err)
+	} else {
+		w.errs = append(w.errs, err)
+	}
+}
+
+// walk calls fn for a file and walks what is below it if it is a
+// directory; dirs are the directories being walked, to detect loops
+func (w *walker) walk(name, at string, d fs.DirEntry, dirs []string) error {
+	if w.opts.Context != nil {
+		if err := w.opts.Context.Err(); err != nil {
+			return err
+		}
+	}
+	if err := w.fn(name, at, d); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fs.ReadDir(w.fs, at)
+	if err != nil {
+		w.report(err)
+	}
+	dirs = append(dirs, at)
+	for _, e := range entries {
+		childName, childAt := path.Join(name, e.Name()), path.Join(at, e.Name())
+		if w.opts.FollowLinks && e.Type()&fs.ModeSymlink != 0 {
+			target, info, err := resolve(w.fs, childAt)
+			switch {
+			case err != nil:
+				w.report(&fs.PathError{Op: "walk", Path: childName, Err: err})
+			case info.IsDir() && slices.Contains(dirs, target):
+				w.report(&fs.PathError{Op: "walk", Path: childName, Err: errors.New("symbolic link loop")})
+			default:
+				childAt, e = target, followedEntry{linkedInfo{info, e.Name()}}
+			}
+		}
+		if err := w.walk(childName, childAt, e, dirs); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// followedEntry is a symbolic link Walk followed
+type followedEntry struct {
+	info linkedInfo
+}
+
+func (e followedEntry) Name() string               { return e.info.name }
+func (e followedEntry) IsDir() bool                { return e.info.IsDir() }
+func (e followedEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e followedEntry) Info() (fs.FileInfo, error) { return e.info, nil }
+
+// linkedInfo describes the target of a symbolic link under the link's
+// name, with what the target's information has of FileInfo, LinksInfo,
+// TimesInfo and OwnerInfo
+type linkedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i linkedInfo) Name() string { return i.name }
+
+func (i linkedInfo) Inode() uint64 {
+	if fi, ok := i.FileInfo.(FileInfo); ok {
+		return fi.Inode()
+	}
+	return 0
+}
+
+func (i linkedInfo) Links() uint64 {
+	if li, ok := i.FileInfo.(LinksInfo); ok {
+		return li.Links()
+	}
+	return 0
+}
+
+func (i linkedInfo) BirthTime() time.Time {
+	if ti, ok := i.FileInfo.(TimesInfo); ok {
+		return ti.BirthTime()
+	}
+	return time.Time{}
+}
+
+func (i linkedInfo) AccessTime() time.Time {
+	if ti, ok := i.FileInfo.(TimesInfo); ok {
+		return ti.AccessTime()
+	}
+	return time.Time{}
+}
+
+func (i linkedInfo) ChangeTime() time.Time {
+	if ti, ok := i.FileInfo.(TimesInfo); ok {
+		return ti.ChangeTime()
+	}
+	return time.Time{}
+}
+
+func (i linkedInfo) Owner() (user, group string) {
+	if oi, ok := i.FileInfo.(OwnerInfo); ok {
+		return oi.Owner()
+	}
+	return "", ""
+}
+
+// CacheBlockSize is the size of the blocks a BlockCache keeps
+const CacheBlockSize = 4096
+
+// maxCachedRead is the largest read that goes through a BlockCache; bigger
+// ones are file data read in bulk, which would only evict metadata
+const maxCachedRead = 16 * CacheBlockSize
+
+// BlockCache keeps the blocks last read through its CachedReaderAts, up to
+// a total size, evicting the least recently used first. Filesystems read
+// their image through it, so that structures they read over and over,
+// such as FAT entries, group descriptors and MFT records, come from memory
+// rather than from the image and its decryption.
+type BlockCache struct {
+	mu        sync.Mutex
+	maxBlocks int
+	lru       *list.List // Of *cachedBlock, most recently used first
+	blocks    map[blockKey]*list.Element
+	readers   uint64 // Number of CachedReaderAts made, to tell them apart
+}
+
+// blockKey names a block of one of the readers of a cache
+type blockKey struct {
+	reader uint64
+	index  int64
+}
+
+// cachedBlock is a block and its contents, which are short at the end of
+// the reader
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// DefaultCache is the cache the filesystems in this module read through
+var DefaultCache = NewBlockCache(32 << 20)
+
+// NewBlockCache returns a cache that holds up to size bytes of blocks
+func NewBlockCache(size int64) *BlockCache {
+	c := &BlockCache{lru: list.New(), blocks: make(map[blockKey]*list.Element)}
+	c.SetSize(size)
+	return c
+}
+
+// SetSize changes the memory the cache may use, evicting blocks to fit;
+// 0 turns caching off
+func (c *BlockCache) SetSize(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBlocks = int(max(size, 0) / CacheBlockSize)
+	c.evict()
+}
+
+// evict drops the least recently used blocks over the limit; c.mu is held
+func (c *BlockCache) evict() {
+	for c.lru.Len() > c.maxBlocks {
+		b := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, b.key)
+	}
+}
+
+// Reader returns a reader of r that keeps the blocks it reads in the cache
+func (c *BlockCache) Reader(r io.ReaderAt) *CachedReaderAt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readers++
+	return &CachedReaderAt{cache: c, r: r, id: c.readers}
+}
+
+// CachedReaderAt reads an io.ReaderAt through a BlockCache
+type CachedReaderAt struct {
+	cache *BlockCache
+	r     io.ReaderAt
+	id    uint64
+}
+
+// NewCachedReaderAt returns a reader of r through DefaultCache
+func NewCachedReaderAt(r io.ReaderAt) *CachedReaderAt {
+	return DefaultCache.Reader(r)
+}
+
+// BaseReader returns the underlying reader
+func (c *CachedReaderAt) BaseReader() io.ReaderAt {
+	return c.r
+}
+
+// Forget drops the cached blocks of length bytes from off, so that reads
+// see what was written there since
+func (c *CachedReaderAt) Forget(off, length int64) {
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	for index := off / CacheBlockSize; index*CacheBlockSize < off+length; index++ {
+		if e, ok := c.cache.blocks[blockKey{c.id, index}]; ok {
+			c.cache.lru.Remove(e)
+			delete(c.cache.blocks, e.Value.(*cachedBlock).key)
+		}
+	}
+}
+
+// ReadAt implements io.ReaderAt
+func (c *CachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if len(p) > maxCachedRead {
+		return c.r.ReadAt(p, off)
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / CacheBlockSize
+		data, err := c.block(index)
+		if err != nil {
+			// The reader may not like reads past its end, so
+			// leave it to answer for the range asked for
+			return c.r.ReadAt(p, off)
+		}
+		within := int(pos - index*CacheBlockSize)
+		if within >= len(data) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[within:])
+		if n < len(p) && len(data) < CacheBlockSize {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// block returns the contents of a block, from the cache if it has them
+func (c *CachedReaderAt) block(index int64) ([]byte, error) {
+	key := blockKey{c.id, index}
+	c.cache.mu.Lock()
+	if e, ok := c.cache.blocks[key]; ok {
+		c.cache.lru.MoveToFront(e)
+		c.cache.mu.Unlock()
+		return e.Value.(*cachedBlock).data, nil
+	}
+	c.cache.mu.Unlock()
+
+	data := make([]byte, CacheBlockSize)
+	n, err := c.r.ReadAt(data, index*CacheBlockSize)
+	if err != nil && (err != io.EOF || n == 0) {
+		return nil, err
+	}
+	data = data[:n]
+
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	if _, ok := c.cache.blocks[key]; !ok && c.cache.maxBlocks > 0 {
+		c.cache.blocks[key] = c.cache.lru.PushFront(&cachedBlock{key, data})
+		c.cache.evict()
+	}
+	return data, nil
+}
+
+// ReadAheadReaderAt reads ahead of sequential reads of an io.ReaderAt. A
+// read that carries on where the previous one ended fetches a whole window
+// from the underlying reader, and once the reads reach it, the next window
+// is fetched in the background. Large windows make for fewer, longer reads
+// of a disk or network image, and whole runs of sectors to decrypt. Reads
+// elsewhere go straight through.
+type ReadAheadReaderAt struct {
+	r      io.ReaderAt
+	window int
+	mu     sync.Mutex
+	cur    *readAhead // Window being read from
+	next   *readAhead // Window being fetched
+	end    int64      // Where the last read ended
+}
+
+// readAhead is a window of data, short if reading it failed or hit the end
+type readAhead struct {
+	off  int64
+	data []byte
+	done chan struct{} // Closed when data is read
+}
+
+// NewReadAheadReaderAt returns a reader of r that reads ahead by window
+// bytes
+func NewReadAheadReaderAt(r io.ReaderAt, window int) *ReadAheadReaderAt {
+	return &ReadAheadReaderAt{r: r, window: window}
+}
+
+// fetch starts reading the window at off
+func (ra *ReadAheadReaderAt) fetch(off int64) *readAhead {
+	w := &readAhead{off: off, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		data := make([]byte, ra.window)
+		n, _ := ra.r.ReadAt(data, off)
+		w.data = data[:n]
+	}()
+	return w
+}
+
+// windowAt returns the window that holds pos, moving on to the fetched
+// one if it does, or nil; ra.mu is held
+func (ra *ReadAheadReaderAt) windowAt(pos int64) *readAhead {
+	if ra.cur != nil && pos >= ra.cur.off && pos < ra.cur.off+int64(len(ra.cur.data)) {
+		return ra.cur
+	}
+	if ra.next == nil || pos < ra.next.off || pos >= ra.next.off+int64(ra.window) {
+		return nil
+	}
+	<-ra.next.done
+	ra.cur, ra.next = ra.next, nil
+	if len(ra.cur.data) == ra.window {
+		ra.next = ra.fetch(ra.cur.off + int64(ra.window))
+	}
+	if pos >= ra.cur.off+int64(len(ra.cur.data)) {
+		return nil
+	}
+	return ra.cur
+}
+
+// ReadAt implements io.ReaderAt
+func (ra *ReadAheadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) >= ra.window {
+		return ra.r.ReadAt(p, off)
+	}
+
+	ra.mu.Lock()
+	if off == ra.end && ra.windowAt(off) == nil {
+		ra.next = ra.fetch(off)
+	}
+	n := 0
+	for n < len(p) {
+		w := ra.windowAt(off + int64(n))
+		if w == nil {
+			break
+		}
+		n += copy(p[n:], w.data[off+int64(n)-w.off:])
+	}
+	ra.end = off + int64(len(p))
+	ra.mu.Unlock()
+
+	// The windows end before the data, at an error or the end of the
+	// reader, which a direct read reports
+	if n < len(p) {
+		m, err := ra.r.ReadAt(p[n:], off+int64(n))
+		return n + m, err
+	}
+	return n, nil
+}
+
+// Close waits for a window being fetched; the underlying reader stays
+// open
+func (ra *ReadAheadReaderAt) Close() error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.next != nil {
+		<-ra.next.done
+		ra.next = nil
+	}
+	ra.cur = nil
+	return nil
+}
+
+// AlignedReaderAt reads an io.ReaderAt that only takes reads of whole
+// sectors into memory aligned to a sector, such as a device opened with
+// O_DIRECT. Other reads are rounded out to the sectors they touch and go
+// through a buffer.
+type AlignedReaderAt struct {
+	r     io.ReaderAt
+	align int
+}
+
+// NewAlignedReaderAt returns a reader of r in units of align bytes, which
+// is a power of two
+func NewAlignedReaderAt(r io.ReaderAt, align int) *AlignedReaderAt {
+	return &AlignedReaderAt{r: r, align: align}
+}
+
+// BaseReader returns the underlying reader
+func (a *AlignedReaderAt) BaseReader() io.ReaderAt {
+	return a.r
+}
+
+// ReadAt implements io.ReaderAt
+func (a *AlignedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	align := int64(a.align)
+	if off%align == 0 && int64(len(p))%align == 0 && a.aligned(p) {
+		return a.r.ReadAt(p, off)
+	}
+
+	start := off / align * align
+	end := (off + int64(len(p)) + align - 1) / align * align
+	buf := a.buffer(int(end - start))
+	n, err := a.r.ReadAt(buf, start)
+	skip := int(off - start)
+	if n <= skip {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n = copy(p, buf[skip:n])
+	if n == len(p) {
+		return n, nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// aligned reports whether p starts at an aligned address
+func (a *AlignedReaderAt) aligned(p []byte) bool {
+	return uintptr(unsafe.Pointer(&p[0]))&uintptr(a.align-1) == 0
+}
+
+// buffer returns n bytes of aligned memory
+func (a *AlignedReaderAt) buffer(n int) []byte {
+	buf := make([]byte, n+a.align)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(a.align-1)); rem != 0 {
+		skip = a.align - rem
+	}
+	return buf[skip : skip+n]
+}
+
+// ContextReaderAt stops reading an io.ReaderAt once a context is done, and
+// gives up on reads that take longer than a timeout, so that a hung image,
+// such as one on a network, cannot hold up the program. Without a timeout
+// it only checks the context before each read.
+//
+// A reader with a SetReadDeadline method that works is given the timeout
+// as a deadline. Otherwise each read runs in a goroutine of its own, into
+// a buffer of its own, and a read given up on keeps both until it returns,
+// which may be never; once maxHungReads of them are outstanding, reads
+// fail at once rather than leak more.
+type ContextReaderAt struct {
+	ctx      context.Context
+	r        io.ReaderAt
+	timeout  time.Duration
+	hung     atomic.Int32 // Reads given up on that have not returned
+	deadline atomic.Bool  // Whether a read is timed by r's read deadline
+}
+
+// maxHungReads is the most reads a ContextReaderAt gives up on that may
+// still be running
+const maxHungReads = 16
+
+// NewContextReaderAt returns a reader of r that stops when ctx is done and
+// fails reads that take longer than timeout, if not 0
+func NewContextReaderAt(ctx context.Context, r io.ReaderAt, timeout time.Duration) *ContextReaderAt {
+	return &ContextReaderAt{ctx: ctx, r: r, timeout: timeout}
+}
+
+// BaseReader returns the underlying reader
+func (c *ContextReaderAt) BaseReader() io.ReaderAt {
+	return c.r
+}
+
+// ReadAt implements io.ReaderAt. A read given up on fails with an error
+// wrapping os.ErrDeadlineExceeded, or with the context's error.
+func (c *ContextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if c.timeout <= 0 {
+		return c.r.ReadAt(p, off)
+	}
+
+	// The read deadline is r's, not the read's, so it only times one read
+	// at a time; others that overlap it are timed as those of readers
+	// without deadlines are, rather than pushing it later for a read that
+	// may never return
+	if d, ok := c.r.(interface{ SetReadDeadline(time.Time) error }); ok && c.deadline.CompareAndSwap(false, true) {
+		if d.SetReadDeadline(time.Now().Add(c.timeout)) == nil {
+			stop := context.AfterFunc(c.ctx, func() { d.SetReadDeadline(time.Now()) })
+			n, err := c.r.ReadAt(p, off)
+			stop()
+			d.SetReadDeadline(time.Time{})
+			c.deadline.Store(false)
+			if err != nil && c.ctx.Err() != nil {
+				return n, c.ctx.Err()
+			}
+			return n, err
+		}
+		c.deadline.Store(false)
+	}
+
+	if c.hung.Load() >= maxHungReads {
+		return 0, fmt.Errorf("reading %d bytes at offset %d: %d reads already hung: %w", len(p), off, maxHungReads, os.ErrDeadlineExceeded)
+	}
+
+	// The read goes into a buffer of its own, which it may still be
+	// filling after being given up on. Whichever of the read and the
+	// give-up comes second is the one to settle the count of hung reads.
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	var settled atomic.Bool
+	go func() {
+		n, err := c.r.ReadAt(buf, off)
+		done <- result{n, err}
+		if !settled.CompareAndSwap(false, true) {
+			c.hung.Add(-1)
+		}
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-c.ctx.Done():
+		err = c.ctx.Err()
+	case <-timer.C:
+		err = fmt.Errorf("reading %d bytes at offset %d: %w", len(p), off, os.ErrDeadlineExceeded)
+	}
+	if settled.CompareAndSwap(false, true) {
+		c.hung.Add(1)
+		return 0, err
+	}
+	res := <-done // Finished just now
+	return copy(p, buf[:res.n]), res.err
+}
+
+// FillReaderAt reads an io.ReaderAt whose reads may fail, such as a failing
+// disk, reading the sectors that cannot be read as zeros. A failed read is
+// tried again a sector at a time to find which ones those are.
+type FillReaderAt struct {
+	r          io.ReaderAt
+	sectorSize int
+	log        func(bad Range, err error)
+
+	mu  sync.Mutex
+	bad []Range // Sorted and merged
+}
+
+// NewFillReaderAt returns a reader of r that reads the sectors of
+// sectorSize bytes it fails to read as zeros, calling log, if not nil, with
+// each run of them
+func NewFillReaderAt(r io.ReaderAt, sectorSize int, log func(bad Range, err error)) *FillReaderAt {
+	return &FillReaderAt{r: r, sectorSize: sectorSize, log: log}
+}
+
+// BaseReader returns the underlying reader
+func (f *FillReaderAt) BaseReader() io.ReaderAt {
+	return f.r
+}
+
+// Unreadable returns the byte ranges read as zeros so far
+func (f *FillReaderAt) Unreadable() []Range {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.bad)
+}
+
+// ReadAt implements io.ReaderAt. It only fails at the end of the image,
+// or when a context stops the reads.
+func (f *FillReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.r.ReadAt(p, off)
+	if err == nil || err == io.EOF || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return n, err
+	}
+
+	// Try again from the sector the read failed in
+	sector := int64(f.sectorSize)
+	pos := off + int64(n)
+	pos -= pos % sector
+	n = int(max(pos-off, 0))
+	var badStart int64 = -1
+	var badErr error
+	for n < len(p) {
+		end := min((pos/sector+1)*sector, off+int64(len(p)))
+		chunk := p[n : n+int(end-max(pos, off))]
+		m, err := f.r.ReadAt(chunk, max(pos, off))
+		switch {
+		case err == nil || err == io.EOF && m == len(chunk):
+			f.flush(&badStart, pos, badErr)
+		case err == io.EOF:
+			f.flush(&badStart, pos, badErr)
+			return n + m, io.EOF
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			f.flush(&badStart, pos, badErr)
+			return n, err
+		default:
+			clear(chunk)
+			if badStart < 0 {
+				badStart, badErr = max(pos, off), err
+			}
+		}
+		n += len(chunk)
+		pos = end
+	}
+	f.flush(&badStart, pos, badErr)
+	return n, nil
+}
+
+// flush records the run of sectors from *start to end read as zeros, if
+// there is one, and logs it unless it was known already
+func (f *FillReaderAt) flush(start *int64, end int64, err error) {
+	if *start < 0 {
+		return
+	}
+	run := Range{Start: *start, End: end}
+	*start = -1
+
+	f.mu.Lock()
+	i := sort.Search(len(f.bad), func(i int) bool { return f.bad[i].End >= run.Start })
+	known := i < len(f.bad) && f.bad[i].Start <= run.Start && f.bad[i].End >= run.End
+	merged := run
+	j := i
+	for j < len(f.bad) && f.bad[j].Start <= merged.End {
+		merged.Start = min(merged.Start, f.bad[j].Start)
+		merged.End = max(merged.End, f.bad[j].End)
+		j++
+	}
+	f.bad = slices.Replace(f.bad, i, j, merged)
+	f.mu.Unlock()
+
+	if !known && f.log != nil {
+		f.log(run, err)
+	}
+}
+
+// HashingReaderAt logs a digest of each range read from an io.ReaderAt,
+// such as an image, as "offset length digest" lines, for a record of what
+// was read and a check that it did not change while being read. A range
+// read again is only logged again if it reads differently. It also hashes
+// every byte read, in the order read, and the whole image if it is read
+// from start to end.
+type HashingReaderAt struct {
+	r       io.ReaderAt
+	size    int64
+	newHash func() hash.Hash
+	log     io.Writer
+
+	mu       sync.Mutex
+	logErr   error            // First error writing the log
+	digests  map[Range][]byte // Of each range logged
+	all      hash.Hash        // Of every byte read, in order
+	bytes    int64            // Read in total
+	reads    int64            // Reads that read anything
+	image    hash.Hash        // Of the image from its start, nil once out of order
+	imagePos int64            // Bytes of the image hashed by image
+	pending  map[int64][]byte // Reads past imagePos, to hash when it reaches them
+	held     int64            // Bytes in pending
+}
+
+// maxHeldBytes bounds the reads a HashingReaderAt holds on to while
+// waiting for the ones before them in the image
+const maxHeldBytes = 64 << 20
+
+// NewHashingReaderAt returns a reader of the size bytes of r that logs a
+// digest made by newHash of each read to log
+func NewHashingReaderAt(r io.ReaderAt, size int64, newHash func() hash.Hash, log io.Writer) *HashingReaderAt {
+	return &HashingReaderAt{
+		r:       r,
+		size:    size,
+		newHash: newHash,
+		log:     log,
+		digests: make(map[Range][]byte),
+		all:     newHash(),
+		image:   newHash(),
+		pending: make(map[int64][]byte),
+	}
+}
+
+// BaseReader returns the underlying reader
+func (h *HashingReaderAt) BaseReader() io.ReaderAt {
+	return h.r
+}
+
+// ReadAt implements io.ReaderAt
+func (h *HashingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := h.r.ReadAt(p, off)
+	if n == 0 {
+		return n, err
+	}
+	data := p[:n]
+	d := h.newHash()
+	d.Write(data)
+	digest := d.Sum(nil)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.all.Write(data)
+	h.bytes += int64(n)
+	h.reads++
+	h.follow(data, off)
+
+	rng := Range{Start: off, End: off + int64(n)}
+	if prev, ok := h.digests[rng]; !ok {
+		h.digests[rng] = digest
+		h.logf("%d %d %x\n", off, n, digest)
+	} else if !bytes.Equal(prev, digest) {
+		h.digests[rng] = digest
+		h.logf("%d %d %x changed, was %x\n", off, n, digest, prev)
+	}
+	return n, err
+}
+
+// follow hashes data read at off into the digest of the image if it is the
+// next part of it, or holds on to it until it is; h.mu is held
+func (h *HashingReaderAt) follow(data []byte, off int64) {
+	if h.image == nil || off+int64(len(data)) <= h.imagePos {
+		return
+	}
+	if off > h.imagePos {
+		if _, ok := h.pending[off]; !ok {
+			h.pending[off] = bytes.Clone(data)
+			h.held += int64(len(data))
+		}
+		if h.held > maxHeldBytes {
+			h.image, h.pending, h.held = nil, nil, 0
+		}
+		return
+	}
+	h.image.Write(data[h.imagePos-off:])
+	h.imagePos = off + int64(len(data))
+
+	// Reads held on to that now follow on
+	for {
+		pos, held, ok := h.nextHeld()
+		if !ok {
+			return
+		}
+		delete(h.pending, pos)
+		h.held -= int64(len(held))
+		if end := pos + int64(len(held)); end > h.imagePos {
+			h.image.Write(held[h.imagePos-pos:])
+			h.imagePos = end
+		}
+	}
+}
+
+// nextHeld returns a read held on to that starts at or before imagePos;
+// h.mu is held
+func (h *HashingReaderAt) nextHeld() (int64, []byte, bool) {
+	for pos, held := range h.pending {
+		if pos <= h.imagePos {
+			return pos, held, true
+		}
+	}
+	return 0, nil, false
+}
+
+// logf writes a line to the log, keeping the first error; h.mu is held
+func (h *HashingReaderAt) logf(format string, args ...any) {
+	if _, err := fmt.Fprintf(h.log, format, args...); err != nil && h.logErr == nil {
+		h.logErr = err
+	}
+}
+
+// ImageDigest returns the digest of the whole image if it has been read
+// from start to end, or nil
+func (h *HashingReaderAt) ImageDigest() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.image == nil || h.imagePos < h.size || h.size <= 0 {
+		return nil
+	}
+	return h.image.Sum(nil)
+}
+
+// Finish logs the number of bytes read, their digest in the order read,
+// and the digest of the image if it was read whole, returning the first
+// error writing the log
+func (h *HashingReaderAt) Finish() error {
+	image := h.ImageDigest()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logf("# %d bytes in %d reads, digest in the order read %x\n", h.bytes, h.reads, h.all.Sum(nil))
+	if image != nil {
+		h.logf("# image of %d bytes, digest %x\n", h.size, image)
+	}
+	return h.logErr
+}
+
 // ExtentReaderAt wraps an io.ReaderAt and a list of extents to provide
 // a view of a file's data without loading it entirely into memory
 type ExtentReaderAt struct {
 	r       io.ReaderAt
-	extents []Extent
+	extents []Extent // Sorted by logical offset and coalesced
 	size    int64
 }
 
@@ -83,18 +1613,28 @@ func (e *ExtentReaderAt) Size() int64 {
 	return e.size
 }
 
+// Close implements io.Closer; the underlying reader stays open
+func (e *ExtentReaderAt) Close() error {
+	return nil
+}
+
 // ExtentWriterAt wraps an io.WriterAt and a list of extents to provide
 // write access to a file's data through an extent map
 type ExtentWriterAt struct {
 	w       io.WriterAt
-	extents []Extent
+	extents []Extent // Sorted by logical offset and coalesced
 	size    int64
 }
 
 // NewExtentWriterAt creates a new ExtentWriterAt using the provided extents.
 // Typically the extents are borrowed from an ExtentReaderAt via its Extents() method.
 func NewExtentWriterAt(w io.WriterAt, extents []Extent, size int64) *ExtentWriterAt {
-	return &ExtentWriterAt{w: w, extents: extents, size: size}
+	return &ExtentWriterAt{w: w, extents: coalesceExtents(sortedExtents(extents)), size: size}
+}
+
+// BaseWriter returns the underlying writer
+func (e *ExtentWriterAt) BaseWriter() io.WriterAt {
+	return e.w
 }
 
 // WriteAt implements io.WriterAt
@@ -112,24 +1652,18 @@ func (e *ExtentWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
 	for len(remaining) > 0 && off < e.size {
 		// Find extent containing this offset
 		var extent *Extent
-		for i := range e.extents {
-			if off >= e.extents[i].Logical && off < e.extents[i].Logical+e.extents[i].Length {
-				extent = &e.extents[i]
-				break
-			}
+		if i, ok := searchExtents(e.extents, off); ok {
+			extent = &e.extents[i]
 		}
 
+		// Holes have no space in the image, and data written to a zero
+		// extent would not read back, so refuse rather than drop it
 		if extent == nil {
-			// In a gap (sparse region) - skip to next extent or end
-			nextStart := e.size
-			for _, ext := range e.extents {
-				if ext.Logical > off && ext.Logical < nextStart {
-					nextStart = ext.Logical
-				}
-			}
-			// Cannot write to sparse regions - return error
 			return totalWritten, fmt.Errorf("cannot write to sparse region at offset %d", off)
 		}
+		if extent.Zero {
+			return totalWritten, fmt.Errorf("cannot write to unwritten extent at offset %d", off)
+		}
 
 		// Calculate how much we can write in this extent
 		offsetInExtent := off - extent.Logical
@@ -158,20 +1692,53 @@ func (e *ExtentWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
 // If the base reader is itself an ExtentReaderAt, the extents are composed
 // to create a flattened mapping directly to the underlying reader.
 func NewExtentReaderAt(r io.ReaderAt, extents []Extent, size int64) *ExtentReaderAt {
-	// Sort extents by logical offset
+	sorted := sortedExtents(extents)
+
+	// If r is already an ExtentReaderAt, compose the mappings
+	if inner, ok := r.(*ExtentReaderAt); ok {
+		composed := ComposeExtents(sorted, inner.extents)
+		return &ExtentReaderAt{r: inner.r, extents: coalesceExtents(composed), size: size}
+	}
+
+	return &ExtentReaderAt{r: r, extents: coalesceExtents(sorted), size: size}
+}
+
+// sortedExtents returns a copy of extents sorted by logical offset
+func sortedExtents(extents []Extent) []Extent {
 	sorted := make([]Extent, len(extents))
 	copy(sorted, extents)
 	sort.Slice(sorted, func(i, j int) bool {
 		return sorted[i].Logical < sorted[j].Logical
 	})
+	return sorted
+}
 
-	// If r is already an ExtentReaderAt, compose the mappings
-	if inner, ok := r.(*ExtentReaderAt); ok {
-		composed := ComposeExtents(sorted, inner.extents)
-		return &ExtentReaderAt{r: inner.r, extents: composed, size: size}
+// coalesceExtents merges, in place, sorted extents that continue each other
+// both logically and physically and have the same flags
+func coalesceExtents(extents []Extent) []Extent {
+	if len(extents) == 0 {
+		return extents
+	}
+	out := extents[:1]
+	for _, e := range extents[1:] {
+		last := &out[len(out)-1]
+		if last.Logical+last.Length == e.Logical && last.Physical+last.Length == e.Physical &&
+			last.Shared == e.Shared && last.Zero == e.Zero {
+			last.Length += e.Length
+			continue
+		}
+		out = append(out, e)
 	}
+	return out
+}
 
-	return &ExtentReaderAt{r: r, extents: sorted, size: size}
+// searchExtents returns the index of the extent in sorted, non-overlapping
+// extents that contains off, or of the first one after it and false
+func searchExtents(extents []Extent, off int64) (int, bool) {
+	i := sort.Search(len(extents), func(i int) bool {
+		return extents[i].Logical+extents[i].Length > off
+	})
+	return i, i < len(extents) && extents[i].Logical <= off
 }
 
 // ComposeExtents takes outer extents (which map logical offsets to "physical"
@@ -183,6 +1750,7 @@ func NewExtentReaderAt(r io.ReaderAt, extents []Extent, size int64) *ExtentReade
 // the composed result maps [0,100) -> [5000,5100).
 func ComposeExtents(outer, inner []Extent) []Extent {
 	var composed []Extent
+	inner = sortedExtents(inner)
 
 	for _, o := range outer {
 		// o.Physical is a logical offset in the inner coordinate space
@@ -192,56 +1760,41 @@ func ComposeExtents(outer, inner []Extent) []Extent {
 		innerLogical := o.Physical
 		outerLogical := o.Logical
 
-		for remaining > 0 {
-			// Find inner extent containing innerLogical
-			found := false
-			for _, i := range inner {
-				iEnd := i.Logical + i.Length
-
-				// Check if innerLogical falls within this inner extent
-				if innerLogical >= i.Logical && innerLogical < iEnd {
-					// Calculate how much of this inner extent we can use
-					offsetInInner := innerLogical - i.Logical
-					availableInInner := i.Length - offsetInInner
-					useLength := remaining
-					if useLength > availableInInner {
-						useLength = availableInInner
-					}
-
-					// Create composed extent
-					composed = append(composed, Extent{
-						Logical:  outerLogical,
-						Physical: i.Physical + offsetInInner,
-						Length:   useLength,
-					})
-
-					outerLogical += useLength
-					innerLogical += useLength
-					remaining -= useLength
-					found = true
-					break
-				}
-			}
+		for remaining > 0 {
+			// Find inner extent containing innerLogical
+			idx, found := searchExtents(inner, innerLogical)
+			if found {
+				i := inner[idx]
 
-			if !found {
-				// Gap in inner extents (sparse region) - skip this portion
-				// Find next inner extent start
-				nextStart := int64(-1)
-				for _, i := range inner {
-					if i.Logical > innerLogical {
-						if nextStart < 0 || i.Logical < nextStart {
-							nextStart = i.Logical
-						}
-					}
+				// Calculate how much of this inner extent we can use
+				offsetInInner := innerLogical - i.Logical
+				availableInInner := i.Length - offsetInInner
+				useLength := remaining
+				if useLength > availableInInner {
+					useLength = availableInInner
 				}
 
-				if nextStart < 0 {
+				// Create composed extent
+				composed = append(composed, Extent{
+					Logical:  outerLogical,
+					Physical: i.Physical + offsetInInner,
+					Length:   useLength,
+					Shared:   o.Shared || i.Shared,
+					Zero:     o.Zero || i.Zero,
+				})
+
+				outerLogical += useLength
+				innerLogical += useLength
+				remaining -= useLength
+			} else {
+				// Gap in inner extents (sparse region) - skip this portion
+				if idx == len(inner) {
 					// No more inner extents, we're done with this outer extent
 					break
 				}
 
-				// Skip the gap
-				gap := nextStart - innerLogical
+				// Skip the gap to the next inner extent
+				gap := inner[idx].Logical - innerLogical
 				if gap > remaining {
 					gap = remaining
 				}
@@ -302,6 +1855,14 @@ func (e *ExtentReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
 			toRead = remaining
 		}
 
+		if ext.Zero {
+			clear(p[totalRead : totalRead+toRead])
+			totalRead += toRead
+			remaining -= toRead
+			off += int64(toRead)
+			continue
+		}
+
 		// Read from the physical location
 		physOffset := ext.Physical + extentOffset
 		nr, err := e.r.ReadAt(p[totalRead:totalRead+toRead], physOffset)
@@ -326,29 +1887,733 @@ func (e *ExtentReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
 
 // findExtent finds the extent containing the given logical offset
 func (e *ExtentReaderAt) findExtent(off int64) (Extent, bool) {
-	for _, ext := range e.extents {
-		if off >= ext.Logical && off < ext.Logical+ext.Length {
-			return ext, true
-		}
+	if i, ok := searchExtents(e.extents, off); ok {
+		return e.extents[i], true
 	}
 	return Extent{}, false
 }
 
 // nextExtentStart returns the start of the next extent after the given offset
 func (e *ExtentReaderAt) nextExtentStart(off int64) int64 {
-	for _, ext := range e.extents {
-		if ext.Logical > off {
-			return ext.Logical
-		}
+	if i, _ := searchExtents(e.extents, off); i < len(e.extents) {
+		return e.extents[i].Logical
 	}
 	return e.size
 }
 
+// CopyOnWrite is a writable view of a reader that keeps what is written
+// apart, in memory or in a file in a directory, and never writes to the
+// reader. Bytes that have not been written read from the reader, and
+// bytes past its end read as zeros.
+type CopyOnWrite struct {
+	mu      sync.RWMutex
+	r       io.ReaderAt // Nil when there is nothing below
+	rSize   int64
+	size    int64
+	written []Range          // Sorted, and neither overlapping nor touching
+	mem     map[int64][]byte // Blocks holding written bytes, if in memory
+	file    *os.File         // Written bytes at their own offsets, if in a directory
+}
+
+// NewCopyOnWrite returns a writable view of size bytes of r, which may be
+// nil for an empty file. Written data is kept in memory if dir is "",
+// otherwise in a temporary file in dir that Close removes.
+func NewCopyOnWrite(r io.ReaderAt, size int64, dir string) (*CopyOnWrite, error) {
+	c := &CopyOnWrite{r: r, rSize: size, size: size}
+	if dir == "" {
+		c.mem = make(map[int64][]byte)
+		return c, nil
+	}
+	f, err := os.CreateTemp(dir, "rawhide-overlay-*")
+	if err != nil {
+		return nil, err
+	}
+	c.file = f
+	return c, nil
+}
+
+// BaseReader returns the reader below
+func (c *CopyOnWrite) BaseReader() io.ReaderAt {
+	return c.r
+}
+
+// Size returns the size, which grows with writes past the end
+func (c *CopyOnWrite) Size() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.size
+}
+
+// Written returns the byte ranges that have been written
+func (c *CopyOnWrite) Written() []Range {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.written)
+}
+
+// ReadAt implements io.ReaderAt
+func (c *CopyOnWrite) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), c.size-off))
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		chunk := p[done:n]
+		i := sort.Search(len(c.written), func(i int) bool { return c.written[i].End > pos })
+		var err error
+		if i < len(c.written) && c.written[i].Start <= pos {
+			chunk = chunk[:min(int64(len(chunk)), c.written[i].End-pos)]
+			err = c.readWritten(chunk, pos)
+		} else {
+			if i < len(c.written) {
+				chunk = chunk[:min(int64(len(chunk)), c.written[i].Start-pos)]
+			}
+			err = c.readBelow(chunk, pos)
+		}
+		if err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBelow reads bytes that have not been written
+func (c *CopyOnWrite) readBelow(p []byte, off int64) error {
+	n := 0
+	if c.r != nil && off < c.rSize {
+		n = int(min(int64(len(p)), c.rSize-off))
+		got, err := c.r.ReadAt(p[:n], off)
+		if got < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// readWritten reads bytes that have been written
+func (c *CopyOnWrite) readWritten(p []byte, off int64) error {
+	if c.file != nil {
+		_, err := c.file.ReadAt(p, off)
+		return err
+	}
+	for len(p) > 0 {
+		block := c.mem[off/CacheBlockSize]
+		n := copy(p, block[off%CacheBlockSize:])
+		p = p[n:]
+		off += int64(n)
+	}
+	return nil
+}
+
+// WriteAt implements io.WriterAt. Writing past the end grows the view.
+func (c *CopyOnWrite) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		if n, err := c.file.WriteAt(p, off); err != nil {
+			return n, err
+		}
+	} else if c.mem != nil {
+		for pos, data := off, p; len(data) > 0; {
+			index := pos / CacheBlockSize
+			block := c.mem[index]
+			if block == nil {
+				block = make([]byte, CacheBlockSize)
+				c.mem[index] = block
+			}
+			n := copy(block[pos%CacheBlockSize:], data)
+			data = data[n:]
+			pos += int64(n)
+		}
+	} else {
+		return 0, os.ErrClosed
+	}
+	c.addWritten(off, off+int64(len(p)))
+	c.size = max(c.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+// addWritten records [start, end) as written, merging it with the ranges
+// it overlaps or touches
+func (c *CopyOnWrite) addWritten(start, end int64) {
+	i := sort.Search(len(c.written), func(i int) bool { return c.written[i].End >= start })
+	j := i
+	for j < len(c.written) && c.written[j].Start <= end {
+		start = min(start, c.written[j].Start)
+		end = max(end, c.written[j].End)
+		j++
+	}
+	c.written = slices.Replace(c.written, i, j, Range{start, end})
+}
+
+// Close discards what was written. The reader below is not closed.
+func (c *CopyOnWrite) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mem = nil
+	c.written = nil
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	if rmErr := os.Remove(c.file.Name()); err == nil {
+		err = rmErr
+	}
+	c.file = nil
+	return err
+}
+
+// Overlay is a writable view of a filesystem that keeps its changes
+// apart, in memory or in a directory, and leaves the filesystem below
+// untouched. Removed files are hidden by whiteouts, and the data of
+// changed files is copied on write, so a small edit to a large file
+// stores only the blocks written. The changes are lost when the overlay
+// is closed.
+type Overlay struct {
+	lower FS
+	dir   string // Where written data is kept, "" for memory
+
+	mu    sync.RWMutex
+	nodes map[string]*overlayNode // Changes by path
+}
+
+// overlayNode is a change to one path
+type overlayNode struct {
+	removed bool // A whiteout: the path is gone
+	opaque  bool // A directory made in the overlay, which hides any below
+	mode    fs.FileMode
+	modTime time.Time
+	data    *CopyOnWrite   // Contents of a file
+	lower   ReaderAtCloser // What data reads from below, if anything
+}
+
+// NewOverlay returns a writable view of lower. Written data is kept in
+// memory if dir is "", otherwise in temporary files in dir. Closing the
+// overlay discards the changes but does not close lower.
+func NewOverlay(lower FS, dir string) *Overlay {
+	return &Overlay{lower: lower, dir: dir, nodes: make(map[string]*overlayNode)}
+}
+
+// Lower returns the filesystem below
+func (o *Overlay) Lower() FS {
+	return o.lower
+}
+
+// lowerHidden reports whether the changes hide name in the filesystem
+// below, by removing it, one of its parents, or replacing a parent with a
+// new directory
+func (o *Overlay) lowerHidden(name string) bool {
+	for p := name; ; p = path.Dir(p) {
+		if n := o.nodes[p]; n != nil && (n.removed || n.opaque) {
+			return true
+		}
+		if p == "." {
+			return false
+		}
+	}
+}
+
+// stat looks up name with o.mu held
+func (o *Overlay) stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if n := o.nodes[name]; n != nil && !n.removed {
+		return n.info(name), nil
+	}
+	if o.lowerHidden(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return o.lower.Stat(name)
+}
+
+func (n *overlayNode) info(name string) fs.FileInfo {
+	info := overlayInfo{name: path.Base(name), mode: n.mode, modTime: n.modTime}
+	if n.data != nil {
+		info.size = n.data.Size()
+	}
+	return info
+}
+
+// Stat implements fs.StatFS
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.stat(name)
+}
+
+// ReadDir implements fs.ReadDirFS, merging the changes into the
+// directory below
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.readDir(name)
+}
+
+func (o *Overlay) readDir(name string) ([]fs.DirEntry, error) {
+	info, err := o.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	var entries []fs.DirEntry
+	if !o.lowerHidden(name) {
+		lower, err := o.lower.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range lower {
+			if o.nodes[path.Join(name, e.Name())] == nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+	for p, n := range o.nodes {
+		if !n.removed && p != "." && path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(n.info(p)))
+		}
+	}
+	if !DiskOrder {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return entries, nil
+}
+
+// Open implements fs.FS
+func (o *Overlay) Open(name string) (fs.File, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	info, err := o.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &overlayDir{info: info, entries: entries}, nil
+	}
+	if n := o.nodes[name]; n != nil {
+		return &overlayFile{info: info, SectionReader: io.NewSectionReader(n.data, 0, info.Size())}, nil
+	}
+	return o.lower.Open(name)
+}
+
+// OpenReaderAt implements ReaderAtOpener
+func (o *Overlay) OpenReaderAt(name string) (ReaderAtCloser, int64, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if n := o.nodes[name]; n != nil && n.data != nil {
+		return overlayReader{n.data}, n.data.Size(), nil
+	}
+	if _, err := o.stat(name); err != nil {
+		return nil, 0, err
+	}
+	return OpenReaderAt(o.lower, name)
+}
+
+// ReadLink implements Symlinker
+func (o *Overlay) ReadLink(name string) (string, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if _, err := o.stat(name); err != nil {
+		return "", err
+	}
+	if n := o.nodes[name]; n != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return ReadLink(o.lower, name)
+}
+
+// Lstat implements Symlinker
+func (o *Overlay) Lstat(name string) (fs.FileInfo, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	info, err := o.stat(name)
+	if err != nil || o.nodes[name] != nil {
+		return info, err
+	}
+	return Lstat(o.lower, name)
+}
+
+// ListXattr implements XattrFS. Files the changes made have no extended
+// attributes.
+func (o *Overlay) ListXattr(name string) ([]string, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if _, err := o.stat(name); err != nil || o.nodes[name] != nil {
+		return nil, err
+	}
+	return ListXattr(o.lower, name)
+}
+
+// GetXattr implements XattrFS
+func (o *Overlay) GetXattr(name, attr string) ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if _, err := o.stat(name); err != nil {
+		return nil, err
+	}
+	if o.nodes[name] != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrNoXattr}
+	}
+	return GetXattr(o.lower, name, attr)
+}
+
+// Type returns the type of the filesystem below
+func (o *Overlay) Type() string {
+	return o.lower.Type()
+}
+
+// Close discards the changes
+func (o *Overlay) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	for _, n := range o.nodes {
+		errs = append(errs, n.close())
+	}
+	clear(o.nodes)
+	return errors.Join(errs...)
+}
+
+func (n *overlayNode) close() error {
+	var errs []error
+	if n.data != nil {
+		errs = append(errs, n.data.Close())
+	}
+	if n.lower != nil {
+		errs = append(errs, n.lower.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// parentDir checks, with o.mu held, that the parent of name is a directory
+func (o *Overlay) parentDir(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := o.stat(path.Dir(name))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("parent is not a directory")}
+	}
+	return nil
+}
+
+// OpenWriterAt returns the data of the named regular file for reading and
+// writing. Nothing is copied until it is written, a block at a time. The
+// data belongs to the overlay, which closes it.
+func (o *Overlay) OpenWriterAt(name string) (*CopyOnWrite, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n := o.nodes[name]; n != nil && n.data != nil {
+		return n.data, nil
+	}
+	info, err := o.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+	r, size, err := OpenReaderAt(o.lower, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := NewCopyOnWrite(r, size, o.dir)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	o.nodes[name] = &overlayNode{mode: info.Mode(), modTime: info.ModTime(), data: data, lower: r}
+	return data, nil
+}
+
+// WriteFile creates or replaces the named file with data
+func (o *Overlay) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.parentDir("write", name); err != nil {
+		return err
+	}
+	if info, err := o.stat(name); err == nil && !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "write", Path: name, Err: errors.New("not a regular file")}
+	}
+	contents, err := NewCopyOnWrite(nil, 0, o.dir)
+	if err != nil {
+		return err
+	}
+	if _, err := contents.WriteAt(data, 0); err != nil {
+		contents.Close()
+		return err
+	}
+	if n := o.nodes[name]; n != nil {
+		n.close()
+	}
+	o.nodes[name] = &overlayNode{mode: perm & fs.ModePerm, modTime: time.Now(), data: contents}
+	return nil
+}
+
+// Mkdir creates the named directory
+func (o *Overlay) Mkdir(name string, perm fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.parentDir("mkdir", name); err != nil {
+		return err
+	}
+	if _, err := o.stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	o.nodes[name] = &overlayNode{opaque: true, mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// Remove removes the named file or empty directory
+func (o *Overlay) Remove(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.parentDir("remove", name); err != nil {
+		return err
+	}
+	info, err := o.stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+
+	// Whiteouts below a removed directory are no longer needed
+	prefix := name + "/"
+	for p, n := range o.nodes {
+		if p == name || strings.HasPrefix(p, prefix) {
+			n.close()
+			delete(o.nodes, p)
+		}
+	}
+	if !o.lowerHidden(path.Dir(name)) {
+		if _, err := o.lower.Stat(name); err == nil {
+			o.nodes[name] = &overlayNode{removed: true}
+		}
+	}
+	return nil
+}
+
+// overlayInfo describes a file or directory changed in an Overlay
+type overlayInfo struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+}
+
+func (i overlayInfo) Name() string       { return i.name }
+func (i overlayInfo) Size() int64        { return i.size }
+func (i overlayInfo) Mode() fs.FileMode  { return i.mode }
+func (i overlayInfo) ModTime() time.Time { return i.modTime }
+func (i overlayInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i overlayInfo) Sys() any           { return nil }
+
+// overlayFile is an open file changed in an Overlay
+type overlayFile struct {
+	info fs.FileInfo
+	*io.SectionReader
+}
+
+func (f *overlayFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *overlayFile) Close() error               { return nil }
+
+// overlayDir is an open directory of an Overlay
+type overlayDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *overlayDir) Close() error               { return nil }
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(n, len(rest))]
+	d.pos += len(rest)
+	return rest, nil
+}
+
+// overlayReader reads a changed file without closing its data
+type overlayReader struct {
+	*CopyOnWrite
+}
+
+func (overlayReader) Close() error { return nil }
+
 // Opener is a function that attempts to open a filesystem from a reader.
 // It returns nil, nil if the filesystem type doesn't match.
 // It returns nil, error if the type matches but opening fails.
 type Opener func(r io.ReaderAt, size int64) (FS, error)
 
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[detect.Type]Opener)
+)
+
+// Register makes open the Opener that Open uses for images detected as
+// type t, replacing any registered before. The filesystem and partition
+// table packages register their types when imported; other packages can
+// add types that detect recognizes but nothing opens, or replace one.
+func Register(t detect.Type, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[t] = open
+}
+
+// Lookup returns the Opener registered for t, or nil
+func Lookup(t detect.Type) Opener {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	return openers[t]
+}
+
+// Open detects the filesystem or partition table in r and opens it with
+// the registered Opener, trying the less likely candidates in turn when
+// the most likely one fails to open
+func Open(r io.ReaderAt, size int64) (FS, error) {
+	return OpenWith(r, size, Lookup)
+}
+
+// OpenWith is like Open, with the Openers lookup returns, so that callers
+// can choose how some types are opened. A nil Opener means the type is
+// unsupported: if no candidate opens, a recognized but unsupported format
+// is returned as an FS whose Type names it and whose other methods fail
+// with an ErrUnsupportedFeature.
+func OpenWith(r io.ReaderAt, size int64, lookup func(detect.Type) Opener) (FS, error) {
+	candidates, err := detect.DetectAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("detecting filesystem: %w", err)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("unknown or unsupported filesystem")
+	}
+
+	var firstErr error
+	var noOpener bool // Whether firstErr is for a type without an Opener
+	for _, c := range candidates {
+		r, size := r, size
+		if c.Offset > 0 {
+			// The filesystem is embedded further into the image
+			size -= c.Offset
+			r = NewExtentReaderAt(r, []Extent{{Physical: c.Offset, Length: size}}, size)
+		}
+		var filesystem FS
+		err := Unsupported("filesystem type %s", c.Type)
+		open := lookup(c.Type)
+		if open != nil {
+			filesystem, err = open(r, size)
+		}
+		if err == nil && filesystem == nil {
+			err = fmt.Errorf("no %s signature", c.Type) // Openers return nil, nil on a mismatch
+		}
+		if err == nil {
+			return filesystem, nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("opening %s filesystem: %w", c.Type, err)
+			noOpener = open == nil
+		}
+	}
+
+	// Formats that are recognized but cannot be read can still be named
+	if noOpener {
+		return unsupportedFS{candidates[0].Type}, nil
+	}
+	return nil, firstErr
+}
+
+// unsupportedFS stands in for a filesystem that was recognized but cannot
+// be read; it only has a type
+type unsupportedFS struct {
+	t detect.Type
+}
+
+func (u unsupportedFS) err(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: Unsupported("filesystem type %s", u.t)}
+}
+
+// Open implements fs.FS
+func (u unsupportedFS) Open(name string) (fs.File, error) {
+	return nil, u.err("open", name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (u unsupportedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return nil, u.err("readdir", name)
+}
+
+// Stat implements fs.StatFS
+func (u unsupportedFS) Stat(name string) (fs.FileInfo, error) {
+	return nil, u.err("stat", name)
+}
+
+// Type returns the name of the recognized format
+func (u unsupportedFS) Type() string {
+	return u.t.String()
+}
+
+// Close implements FS
+func (u unsupportedFS) Close() error {
+	return nil
+}
+
+// Info explains that the contents cannot be listed
+func (u unsupportedFS) Info() string {
+	return fmt.Sprintf("%s is recognized, but its contents cannot be read.", u.t)
+}
+
 // ReadOnlyError is returned for any write operation
 type ReadOnlyError struct{}
 
@@ -356,6 +2621,50 @@ func (e ReadOnlyError) Error() string {
 	return "filesystem is read-only"
 }
 
+// ErrCorruptMetadata is returned when an on-disk structure cannot be
+// right, so the image is damaged there rather than something unsupported
+type ErrCorruptMetadata struct {
+	Structure string // What was being decoded, such as "superblock" or "inode 12"
+	Offset    int64  // Where it is, from the start of the filesystem, or -1 if not known
+	Err       error  // What is wrong with it
+}
+
+// Corrupt returns an ErrCorruptMetadata for structure at offset (-1 if not
+// known), with a description formatted as by fmt.Errorf
+func Corrupt(structure string, offset int64, format string, args ...any) error {
+	return &ErrCorruptMetadata{Structure: structure, Offset: offset, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *ErrCorruptMetadata) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("corrupt %s: %v", e.Structure, e.Err)
+	}
+	return fmt.Sprintf("corrupt %s at offset %d (0x%x): %v", e.Structure, e.Offset, e.Offset, e.Err)
+}
+
+func (e *ErrCorruptMetadata) Unwrap() error {
+	return e.Err
+}
+
+// ErrUnsupportedFeature is returned for an on-disk feature that is valid
+// but cannot be read, such as a kind of compression
+type ErrUnsupportedFeature struct {
+	Feature string
+}
+
+// Unsupported returns an ErrUnsupportedFeature naming the feature as
+// formatted by fmt.Sprintf
+func Unsupported(format string, args ...any) error {
+	return &ErrUnsupportedFeature{Feature: fmt.Sprintf(format, args...)}
+}
+
+func (e *ErrUnsupportedFeature) Error() string {
+	return "unsupported: " + e.Feature
+}
+
+// ErrEncrypted is returned for data that cannot be read without a key
+var ErrEncrypted = errors.New("encrypted")
+
 // FileInfo provides extended file information
 type FileInfo interface {
 	fs.FileInfo
@@ -363,3 +2672,40 @@ type FileInfo interface {
 	// Inode returns the inode number (0 for filesystems without inodes)
 	Inode() uint64
 }
+
+// LinksInfo is an optional extension of fs.FileInfo for filesystems that
+// count hard links
+type LinksInfo interface {
+	fs.FileInfo
+
+	// Links returns the number of directory entries for the file, or 0
+	// if the filesystem does not record it for this kind of file
+	Links() uint64
+}
+
+// TimesInfo is an optional extension of fs.FileInfo for filesystems that
+// record timestamps besides the modification time. A zero time means the
+// timestamp is not recorded.
+type TimesInfo interface {
+	fs.FileInfo
+
+	// BirthTime returns the creation time
+	BirthTime() time.Time
+
+	// AccessTime returns the last access time
+	AccessTime() time.Time
+
+	// ChangeTime returns the last time the metadata changed
+	ChangeTime() time.Time
+}
+
+// OwnerInfo is an optional extension of fs.FileInfo for filesystems that
+// record who owns a file
+type OwnerInfo interface {
+	fs.FileInfo
+
+	// Owner returns the owning user and group: numeric IDs on Unix
+	// filesystems, SIDs such as "S-1-5-32-544" on NTFS. An empty string
+	// means the owner is not recorded.
+	Owner() (user, group string)
+}
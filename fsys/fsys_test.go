@@ -2,9 +2,26 @@ package fsys
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unsafe"
+
+	"github.com/lvdlvd/rawhide/detect"
 )
 
 func TestComposeExtents(t *testing.T) {
@@ -90,6 +107,12 @@ func TestComposeExtents(t *testing.T) {
 				{Logical: 50, Physical: 2000, Length: 50},
 			},
 		},
+		{
+			name:     "zero propagates",
+			outer:    []Extent{{Logical: 0, Physical: 1000, Length: 100, Zero: true}, {Logical: 100, Physical: 2000, Length: 100}},
+			inner:    []Extent{{Logical: 1000, Physical: 5000, Length: 100}, {Logical: 2000, Physical: 6000, Length: 100, Zero: true}},
+			expected: []Extent{{Logical: 0, Physical: 5000, Length: 100, Zero: true}, {Logical: 100, Physical: 6000, Length: 100, Zero: true}},
+		},
 		{
 			name:     "empty outer",
 			outer:    []Extent{},
@@ -223,6 +246,49 @@ func TestExtentReaderAtDeepNesting(t *testing.T) {
 	}
 }
 
+func TestExtentReaderAtCoalesce(t *testing.T) {
+	baseData := make([]byte, 4096)
+	for i := range baseData {
+		baseData[i] = byte(i % 251)
+	}
+
+	// Single-byte extents, given in reverse, alternate between two places
+	// in the image and do not coalesce; the two after the hole do
+	var extents []Extent
+	for i := int64(999); i >= 0; i-- {
+		phys := i
+		if i%2 == 1 {
+			phys = 4000 - i
+		}
+		extents = append(extents, Extent{Logical: i, Physical: phys, Length: 1})
+	}
+	extents = append(extents, Extent{Logical: 2000, Physical: 0, Length: 10}, Extent{Logical: 2010, Physical: 10, Length: 10})
+	reader := NewExtentReaderAt(bytes.NewReader(baseData), extents, 2020)
+
+	if got := reader.Extents(); len(got) != 1001 || got[1000] != (Extent{Logical: 2000, Physical: 0, Length: 20}) {
+		t.Errorf("Extents() has %d extents, last %+v", len(got), got[len(got)-1])
+	}
+
+	buf := make([]byte, 2020)
+	if n, err := reader.ReadAt(buf, 0); n != len(buf) || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	for i, b := range buf {
+		var want byte
+		switch {
+		case i < 1000 && i%2 == 1:
+			want = baseData[4000-i]
+		case i < 1000:
+			want = baseData[i]
+		case i >= 2000:
+			want = baseData[i-2000]
+		}
+		if b != want {
+			t.Fatalf("buf[%d] = %d, want %d", i, b, want)
+		}
+	}
+}
+
 // bytesBuffer implements io.WriterAt for testing
 type bytesBuffer struct {
 	data []byte
@@ -355,3 +421,959 @@ func TestExtentWriterAtBorrowFromReader(t *testing.T) {
 		t.Errorf("Expected 'TEST' at physical offset 110, got %q", baseData[110:114])
 	}
 }
+
+func TestExtentSparse(t *testing.T) {
+	baseData := bytes.Repeat([]byte{0xff}, 1000)
+	base := &bytesBuffer{data: baseData}
+
+	// Data at [0,100), a hole at [100,200), and a zero extent at [200,300)
+	extents := []Extent{
+		{Logical: 0, Physical: 100, Length: 100},
+		{Logical: 200, Physical: 300, Length: 100, Zero: true},
+	}
+	reader := NewExtentReaderAt(base, extents, 300)
+	buf := make([]byte, 300)
+	if n, err := reader.ReadAt(buf, 0); n != 300 || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	want := append(bytes.Repeat([]byte{0xff}, 100), make([]byte, 200)...)
+	if !bytes.Equal(buf, want) {
+		t.Errorf("ReadAt = %x, want %x", buf, want)
+	}
+
+	writer := NewExtentWriterAt(base, reader.Extents(), reader.Size())
+	if n, err := writer.WriteAt([]byte("data"), 98); n != 2 || err == nil {
+		t.Errorf("WriteAt into a hole = %d, %v, want 2 and an error", n, err)
+	}
+	if n, err := writer.WriteAt([]byte("data"), 250); n != 0 || err == nil {
+		t.Errorf("WriteAt into a zero extent = %d, %v, want 0 and an error", n, err)
+	}
+	if !bytes.Equal(baseData[300:400], bytes.Repeat([]byte{0xff}, 100)) {
+		t.Errorf("WriteAt into a zero extent changed the image")
+	}
+}
+
+// stubFS is an empty FS of a given type
+type stubFS struct {
+	fstest.MapFS
+	t string
+}
+
+func (s stubFS) Type() string { return s.t }
+func (s stubFS) Close() error { return nil }
+
+func TestOpenWith(t *testing.T) {
+	// A disk with one partition, detected as an MBR
+	image := make([]byte, 100*512)
+	image[446+4] = 0x83
+	binary.LittleEndian.PutUint32(image[446+8:], 10)
+	binary.LittleEndian.PutUint32(image[446+12:], 50)
+	image[510], image[511] = 0x55, 0xAA
+	r := bytes.NewReader(image)
+
+	lookup := func(open Opener) func(detect.Type) Opener {
+		return func(t detect.Type) Opener {
+			if t != detect.MBR {
+				return nil
+			}
+			return open
+		}
+	}
+
+	filesystem, err := OpenWith(r, int64(len(image)), lookup(func(io.ReaderAt, int64) (FS, error) {
+		return stubFS{t: "stub"}, nil
+	}))
+	if err != nil || filesystem.Type() != "stub" {
+		t.Errorf("got %v, %v from the registered opener", filesystem, err)
+	}
+
+	// Without an opener the format is still named
+	filesystem, err = OpenWith(r, int64(len(image)), lookup(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unsupported *ErrUnsupportedFeature
+	if _, err := filesystem.Stat("."); !errors.As(err, &unsupported) || filesystem.Type() != "MBR" {
+		t.Errorf("got type %s and %v for an unsupported format", filesystem.Type(), err)
+	}
+
+	// Openers that fail or do not match give an error
+	failed := errors.New("damaged")
+	if _, err := OpenWith(r, int64(len(image)), lookup(func(io.ReaderAt, int64) (FS, error) {
+		return nil, failed
+	})); !errors.Is(err, failed) {
+		t.Errorf("got %v from a failing opener", err)
+	}
+	if _, err := OpenWith(r, int64(len(image)), lookup(func(io.ReaderAt, int64) (FS, error) {
+		return nil, nil
+	})); err == nil {
+		t.Error("no error from an opener that does not match")
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	filesystem := stubFS{MapFS: fstest.MapFS{"dir/file": {Data: []byte("hello, world")}}}
+	r, size, err := OpenReaderAt(filesystem, "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 5)
+	if n, err := r.ReadAt(buf, 7); err != nil || size != 12 || string(buf[:n]) != "world" {
+		t.Errorf("got %q, %v and size %d", buf[:n], err, size)
+	}
+	if _, _, err := OpenReaderAt(filesystem, "dir"); err == nil {
+		t.Error("opened a directory without extents")
+	}
+}
+
+// storedFS has one directory, whose entries are stored in the order of
+// names
+type storedFS struct{ names []string }
+
+func (s storedFS) Open(name string) (fs.File, error) { return storedDir(s), nil }
+
+type storedDir storedFS
+
+func (storedDir) Stat() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (storedDir) Read([]byte) (int, error)   { return 0, io.EOF }
+func (storedDir) Close() error               { return nil }
+
+func (d storedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	files := fstest.MapFS{}
+	for _, name := range d.names {
+		files[name] = &fstest.MapFile{}
+	}
+	var entries []fs.DirEntry
+	for _, name := range d.names {
+		info, _ := files.Stat(name)
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func TestReadDirFile(t *testing.T) {
+	stored := []string{"b", "C", "a"}
+	filesystem := storedFS{stored}
+	for _, diskOrder := range []bool{false, true} {
+		DiskOrder = diskOrder
+		entries, err := ReadDirFile(filesystem, "dir")
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		want := []string{"C", "a", "b"}
+		if diskOrder {
+			want = stored
+		}
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("DiskOrder %v: ReadDirFile = %q, %v, want %q", diskOrder, got, err, want)
+		}
+	}
+	DiskOrder = false
+}
+
+func TestMemoryBudget(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMemoryBudget(10)
+	b.SetTempDir(dir)
+	read := func(data string, size int64) ReaderAtCloser {
+		t.Helper()
+		r, n, err := b.ReadAll(strings.NewReader(data), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n)
+		if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != data {
+			t.Errorf("read back %q, %v, want %q", buf, err, data)
+		}
+		return r
+	}
+	spilled := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	first := read("abcdef", 6)
+	second := read("ghijkl", 6)
+	if _, ok := first.(*memReader); !ok || spilled() != 1 {
+		t.Errorf("first file in %T, %d spilled, want memory and 1", first, spilled())
+	}
+	second.Close()
+	if spilled() != 0 {
+		t.Error("Close left the temporary file")
+	}
+	first.Close()
+	first.Close()
+
+	// Sizes that are wrong only matter to where the data goes
+	if r := read("0123456789", 4); spilled() != 0 {
+		t.Error("file that fits the budget spilled")
+	} else {
+		r.Close()
+	}
+	read("0123456789abc", 0).Close()
+	if b.used != 0 {
+		t.Errorf("%d bytes of the budget still used", b.used)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	filesystem := stubFS{MapFS: fstest.MapFS{
+		"d/e/f":    {Data: []byte("hi")},
+		"d/e/up":   {Data: []byte(".."), Mode: fs.ModeSymlink},
+		"d/fifo":   {Mode: fs.ModeNamedPipe},
+		"dl":       {Data: []byte("/d"), Mode: fs.ModeSymlink},
+		"dangling": {Data: []byte("nowhere"), Mode: fs.ModeSymlink},
+	}}
+
+	walk := func(opts WalkOptions) (names []string, errs int) {
+		opts.Error = func(error) { errs++ }
+		err := Walk(filesystem, ".", opts, func(name, at string, d fs.DirEntry) error {
+			names = append(names, name+"="+at)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names, errs
+	}
+
+	names, errs := walk(WalkOptions{})
+	want := []string{".=.", "d=d", "d/e=d/e", "d/e/f=d/e/f", "d/e/up=d/e/up", "d/fifo=d/fifo", "dangling=dangling", "dl=dl"}
+	if !reflect.DeepEqual(names, want) || errs != 0 {
+		t.Errorf("walked %q with %d errors, want %q", names, errs, want)
+	}
+
+	// Following links, the two ways to the loop back up and the dangling
+	// link are errors
+	names, errs = walk(WalkOptions{FollowLinks: true})
+	want = []string{".=.", "d=d", "d/e=d/e", "d/e/f=d/e/f", "d/e/up=d/e/up", "d/fifo=d/fifo",
+		"dangling=dangling", "dl=d", "dl/e=d/e", "dl/e/f=d/e/f", "dl/e/up=d/e/up", "dl/fifo=d/fifo"}
+	if !reflect.DeepEqual(names, want) || errs != 3 {
+		t.Errorf("walked %q with %d errors, want %q with 3", names, errs, want)
+	}
+
+	// Without an error function the errors are returned
+	err := Walk(filesystem, ".", WalkOptions{FollowLinks: true}, func(string, string, fs.DirEntry) error { return nil })
+	if err == nil {
+		t.Error("no error from following a dangling link")
+	}
+
+	// A context cancelled during the walk stops it
+	ctx, cancel := context.WithCancel(context.Background())
+	var walked int
+	err = Walk(filesystem, ".", WalkOptions{Context: ctx}, func(string, string, fs.DirEntry) error {
+		if walked++; walked == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || walked != 2 {
+		t.Errorf("cancelled walk returned %v after %d files", err, walked)
+	}
+
+	if target, err := ReadLink(filesystem, "dl"); err != nil || target != "/d" {
+		t.Errorf("got %q, %v for the target of dl", target, err)
+	}
+}
+
+// countingReader counts the reads made of it
+type countingReader struct {
+	*bytes.Reader
+	reads int
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.Reader.ReadAt(p, off)
+}
+
+func TestCachedReaderAt(t *testing.T) {
+	data := make([]byte, 3*CacheBlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	base := &countingReader{Reader: bytes.NewReader(data)}
+	cache := NewBlockCache(2 * CacheBlockSize)
+	r := cache.Reader(base)
+
+	read := func(off int64, n int) ([]byte, error) {
+		buf := make([]byte, n)
+		m, err := r.ReadAt(buf, off)
+		return buf[:m], err
+	}
+
+	// A read across a block boundary reads both blocks once
+	for range 2 {
+		buf, err := read(CacheBlockSize-10, 20)
+		if err != nil || !bytes.Equal(buf, data[CacheBlockSize-10:CacheBlockSize+10]) {
+			t.Fatalf("got %x, %v", buf, err)
+		}
+	}
+	if base.reads != 2 {
+		t.Errorf("%d reads of the base for two blocks", base.reads)
+	}
+
+	// The short last block ends the data; reading it evicts block 0
+	buf, err := read(3*CacheBlockSize+90, 20)
+	if err != io.EOF || !bytes.Equal(buf, data[3*CacheBlockSize+90:]) {
+		t.Errorf("got %x, %v at the end", buf, err)
+	}
+	if _, err := read(int64(len(data)), 1); err != io.EOF {
+		t.Errorf("got %v past the end", err)
+	}
+	base.reads = 0
+	read(0, 1)
+	read(3*CacheBlockSize, 1)
+	if base.reads != 1 {
+		t.Errorf("%d reads of the base for an evicted block and a cached one", base.reads)
+	}
+
+	// Bulk reads go straight to the base
+	base.reads = 0
+	buf, err = read(0, maxCachedRead+1)
+	if err != io.EOF || base.reads != 1 || !bytes.Equal(buf, data) {
+		t.Errorf("bulk read: %d bytes, %v, %d reads", len(buf), err, base.reads)
+	}
+
+	// A forgotten block is read again, and only that one
+	base.reads = 0
+	r.Forget(3*CacheBlockSize+5, 1)
+	read(3*CacheBlockSize, 1)
+	read(0, 1)
+	if base.reads != 1 {
+		t.Errorf("%d reads of the base for a forgotten block and a cached one", base.reads)
+	}
+}
+
+func TestConcurrentReaderAt(t *testing.T) {
+	data := make([]byte, 8*CacheBlockSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	// A cache smaller than the data, so that goroutines evict each
+	// other's blocks, under extents that reverse the two halves
+	half := int64(len(data) / 2)
+	cache := NewBlockCache(3 * CacheBlockSize)
+	r := NewExtentReaderAt(cache.Reader(bytes.NewReader(data)), []Extent{
+		{Logical: 0, Physical: half, Length: half},
+		{Logical: half, Physical: 0, Length: half},
+	}, 2*half)
+	want := append(append([]byte{}, data[half:]...), data[:half]...)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1000)
+			for i := range 50 {
+				off := int64((g*50+i)*997) % (2*half - int64(len(buf)))
+				if n, err := r.ReadAt(buf, off); n != len(buf) || err != nil {
+					t.Errorf("ReadAt(%d) = %d, %v", off, n, err)
+					return
+				}
+				if !bytes.Equal(buf, want[off:off+int64(len(buf))]) {
+					t.Errorf("ReadAt(%d) read the wrong data", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// blockingReader blocks reads until released
+type blockingReader chan struct{}
+
+func (r blockingReader) ReadAt(p []byte, off int64) (int, error) {
+	<-r
+	return len(p), nil
+}
+
+func TestContextReaderAt(t *testing.T) {
+	data := []byte("hello, world")
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewContextReaderAt(ctx, bytes.NewReader(data), time.Second)
+	buf := make([]byte, 5)
+	if n, err := r.ReadAt(buf, 7); n != 5 || err != nil || string(buf) != "world" {
+		t.Errorf("ReadAt = %d, %v, %q", n, err, buf)
+	}
+	cancel()
+	if _, err := r.ReadAt(buf, 0); err != context.Canceled {
+		t.Errorf("ReadAt after cancel = %v", err)
+	}
+
+	stuck := make(blockingReader)
+	defer close(stuck)
+	r = NewContextReaderAt(context.Background(), stuck, 10*time.Millisecond)
+	if _, err := r.ReadAt(buf, 0); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadAt of a stuck reader = %v, want a timeout", err)
+	}
+
+	// Reads given up on are bounded, and forgotten once they return
+	for range maxHungReads - 1 {
+		r.ReadAt(buf, 0)
+	}
+	start := time.Now()
+	if _, err := r.ReadAt(buf, 0); !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) >= 10*time.Millisecond {
+		t.Errorf("ReadAt with %d reads hung = %v after %v, want a timeout at once", maxHungReads, err, time.Since(start))
+	}
+	for range maxHungReads {
+		stuck <- struct{}{}
+	}
+	for i := 0; r.hung.Load() != 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.hung.Load(); n != 0 {
+		t.Errorf("%d reads still counted as hung after returning", n)
+	}
+}
+
+// deadlineReader blocks reads at offset 0 until its read deadline, if it
+// has one, and returns those elsewhere at once
+type deadlineReader struct {
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (r *deadlineReader) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = t
+	return nil
+}
+
+func (r *deadlineReader) ReadAt(p []byte, off int64) (int, error) {
+	if off != 0 {
+		return len(p), nil
+	}
+	for {
+		r.mu.Lock()
+		passed := !r.deadline.IsZero() && time.Now().After(r.deadline)
+		r.mu.Unlock()
+		if passed {
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestContextReaderAtDeadline(t *testing.T) {
+	r := NewContextReaderAt(context.Background(), &deadlineReader{}, 10*time.Millisecond)
+	buf := make([]byte, 5)
+	if _, err := r.ReadAt(buf, 0); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadAt = %v, want a timeout", err)
+	}
+	if n := r.hung.Load(); n != 0 {
+		t.Errorf("%d reads hung, want none with a deadline", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewContextReaderAt(ctx, &deadlineReader{}, time.Hour)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := r.ReadAt(buf, 0); err != context.Canceled {
+		t.Errorf("ReadAt when canceled = %v", err)
+	}
+}
+
+func TestContextReaderAtOverlap(t *testing.T) {
+	// A stuck read times out however many reads overlap it
+	r := NewContextReaderAt(context.Background(), &deadlineReader{}, 20*time.Millisecond)
+	stuck := make(chan error, 1)
+	go func() {
+		_, err := r.ReadAt(make([]byte, 5), 0)
+		stuck <- err
+	}()
+	for !r.deadline.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 5)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := r.ReadAt(buf, 1); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	select {
+	case err := <-stuck:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("stuck ReadAt = %v, want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the stuck read did not time out while others were read")
+	}
+	close(done)
+	wg.Wait()
+	if n := failed.Load(); n != 0 {
+		t.Errorf("%d fast reads failed", n)
+	}
+}
+
+func TestReadAheadReaderAt(t *testing.T) {
+	data := make([]byte, 10500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	base := &countingReader{Reader: bytes.NewReader(data)}
+	r := NewReadAheadReaderAt(base, 1000)
+	defer r.Close()
+
+	// Sequential reads come from windows
+	var got []byte
+	buf := make([]byte, 300)
+	for off := int64(0); ; {
+		n, err := r.ReadAt(buf, off)
+		got = append(got, buf[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("sequential reads returned the wrong data")
+	}
+	if base.reads > 13 {
+		t.Errorf("%d reads of the base for 11 windows", base.reads)
+	}
+
+	// Other reads go straight through
+	r.Close()
+	base.reads = 0
+	for _, off := range []int64{5000, 100, 9000} {
+		if n, err := r.ReadAt(buf[:10], off); err != nil || !bytes.Equal(buf[:n], data[off:off+10]) {
+			t.Errorf("got %x, %v at %d", buf[:n], err, off)
+		}
+	}
+	if base.reads != 3 {
+		t.Errorf("%d reads of the base for 3 random reads", base.reads)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	below := []byte("0123456789")
+	for _, dir := range []string{"", t.TempDir()} {
+		c, err := NewCopyOnWrite(bytes.NewReader(below), int64(len(below)), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range []struct {
+			off  int64
+			data string
+		}{{2, "ab"}, {6, "cd"}, {4, "XY"}, {12, "end"}} {
+			if _, err := c.WriteAt([]byte(w.data), w.off); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Writing past the end grows the view, with zeros between
+		got := make([]byte, 16)
+		n, err := c.ReadAt(got, 0)
+		want := "01abXYcd89\x00\x00end"
+		if n != len(want) || err != io.EOF || string(got[:n]) != want {
+			t.Errorf("dir %q: read %q, %v, want %q", dir, got[:n], err, want)
+		}
+		if r := c.Written(); !reflect.DeepEqual(r, []Range{{2, 8}, {12, 15}}) {
+			t.Errorf("dir %q: written %v", dir, r)
+		}
+		if string(below) != "0123456789" {
+			t.Errorf("dir %q: the reader below was changed to %q", dir, below)
+		}
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	lower := stubFS{MapFS: fstest.MapFS{
+		"a":     {Data: []byte("hello world")},
+		"d/b":   {Data: []byte("bee")},
+		"d/e/c": {Data: []byte("sea")},
+		"gone":  {Data: []byte("x")},
+	}}
+	o := NewOverlay(lower, "")
+	defer o.Close()
+
+	w, err := o.OpenWriterAt("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("there"), 6)
+	if err := o.WriteFile("d/new", []byte("fresh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("d/e"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+	for _, name := range []string{"d/e/c", "d/e"} {
+		if err := o.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Mkdir("d/e", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteFile("nodir/f", nil, 0o644); err == nil {
+		t.Error("wrote a file in a missing directory")
+	}
+
+	if err := fstest.TestFS(o, "a", "d/b", "d/new", "d/e"); err != nil {
+		t.Error(err)
+	}
+	for name, want := range map[string]string{"a": "hello there", "d/new": "fresh", "d/b": "bee"} {
+		if got, err := fs.ReadFile(o, name); err != nil || string(got) != want {
+			t.Errorf("read %s: %q, %v, want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"gone", "d/e/c"} {
+		if _, err := o.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stat of removed %s: %v", name, err)
+		}
+	}
+	if got, _ := fs.ReadFile(lower, "a"); string(got) != "hello world" {
+		t.Errorf("lower a changed to %q", got)
+	}
+}
+
+// xattrFS is a stubFS whose files have the extended attributes in xattrs
+type xattrFS struct {
+	stubFS
+	xattrs map[string]map[string]string
+}
+
+func (x xattrFS) ListXattr(name string) ([]string, error) {
+	var names []string
+	for n := range x.xattrs[name] {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (x xattrFS) GetXattr(name, attr string) ([]byte, error) {
+	if v, ok := x.xattrs[name][attr]; ok {
+		return []byte(v), nil
+	}
+	return nil, ErrNoXattr
+}
+
+func TestXattr(t *testing.T) {
+	plain := stubFS{MapFS: fstest.MapFS{"a": {Data: []byte("x")}, "b": {Data: []byte("y")}}}
+	if names, err := ListXattr(plain, "a"); err != nil || names != nil {
+		t.Errorf("ListXattr without XattrFS = %q, %v", names, err)
+	}
+	if _, err := GetXattr(plain, "a", "user.x"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("GetXattr without XattrFS: %v", err)
+	}
+	if _, err := ListXattr(plain, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ListXattr of a missing file: %v", err)
+	}
+
+	// Through an overlay, files the changes replace lose their attributes
+	o := NewOverlay(xattrFS{plain, map[string]map[string]string{
+		"a": {"user.one": "1", "user.two": "2"},
+		"b": {"user.three": "3"},
+	}}, "")
+	defer o.Close()
+	if err := o.WriteFile("b", []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := ListXattr(o, "a"); err != nil || fmt.Sprint(names) != "[user.one user.two]" {
+		t.Errorf("ListXattr(a) = %q, %v", names, err)
+	}
+	if v, err := GetXattr(o, "a", "user.two"); err != nil || string(v) != "2" {
+		t.Errorf("GetXattr(a, user.two) = %q, %v", v, err)
+	}
+	if names, err := ListXattr(o, "b"); err != nil || len(names) != 0 {
+		t.Errorf("ListXattr of a replaced file = %q, %v", names, err)
+	}
+	if _, err := GetXattr(o, "b", "user.three"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("GetXattr of a replaced file: %v", err)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	tests := []struct {
+		name    string
+		extents []Extent
+		want    Fragmentation
+	}{
+		{"empty", nil, Fragmentation{}},
+		{"contiguous", []Extent{{Logical: 0, Physical: 1000, Length: 100}, {Logical: 100, Physical: 1100, Length: 100, Zero: true}},
+			Fragmentation{Files: 1, Fragments: 1, Bytes: 200, Span: 200}},
+		{"hole between", []Extent{{Logical: 0, Physical: 1000, Length: 100}, {Logical: 500, Physical: 1100, Length: 100}},
+			Fragmentation{Files: 1, Fragments: 1, Bytes: 200, Span: 200}},
+		{"apart", []Extent{{Logical: 100, Physical: 1000, Length: 100}, {Logical: 0, Physical: 1700, Length: 100}},
+			Fragmentation{Files: 1, Fragmented: 1, Fragments: 2, Bytes: 200, Span: 800}},
+	}
+	var total Fragmentation
+	for _, tt := range tests {
+		got := FragmentationOf(tt.extents)
+		if got != tt.want {
+			t.Errorf("%s: FragmentationOf = %+v, want %+v", tt.name, got, tt.want)
+		}
+		total.Add(got)
+	}
+	if want := (Fragmentation{Files: 3, Fragmented: 1, Fragments: 4, Bytes: 600, Span: 1200}); total != want {
+		t.Errorf("sum = %+v, want %+v", total, want)
+	}
+	if score := total.Score(); score != 0.5 {
+		t.Errorf("Score() = %v, want 0.5", score)
+	}
+}
+
+func TestRateDeleted(t *testing.T) {
+	free := []Range{{Start: 1000, End: 2000}, {Start: 3000, End: 4000}}
+	tests := []struct {
+		name    string
+		extents []Extent
+		size    int64
+		guessed bool
+		want    Confidence
+	}{
+		{"free", []Extent{{Physical: 1000, Length: 500}, {Logical: 500, Physical: 3500, Length: 500}}, 1000, false, ConfidenceHigh},
+		{"free but guessed", []Extent{{Physical: 1200, Length: 800}}, 800, true, ConfidenceMedium},
+		{"partly reused", []Extent{{Physical: 1500, Length: 1000}}, 1000, false, ConfidenceLow},
+		{"across two free ranges", []Extent{{Physical: 1500, Length: 2000}}, 2000, true, ConfidenceLow},
+		{"reused", []Extent{{Physical: 2000, Length: 1000}}, 1000, false, ConfidenceNone},
+		{"no extents", nil, 1000, false, ConfidenceNone},
+		{"empty", nil, 0, false, ConfidenceHigh},
+		{"unwritten", []Extent{{Physical: 2000, Length: 1000, Zero: true}}, 1000, false, ConfidenceHigh},
+	}
+	for _, tt := range tests {
+		if got := RateDeleted(free, tt.extents, tt.size, tt.guessed); got != tt.want {
+			t.Errorf("%s: RateDeleted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{Corrupt("superblock", 1024, "bad magic %#x", 0), "corrupt superblock at offset 1024 (0x400): bad magic 0x0"},
+		{Corrupt("object map", -1, "no mapping for object %d", 7), "corrupt object map: no mapping for object 7"},
+		{Unsupported("NTFS compression"), "unsupported: NTFS compression"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+
+	err := fmt.Errorf("inode 12: %w", Corrupt("extent tree", 4096, "%w", io.ErrUnexpectedEOF))
+	var corrupt *ErrCorruptMetadata
+	if !errors.As(err, &corrupt) || corrupt.Offset != 4096 {
+		t.Errorf("errors.As(%v) = %v", err, corrupt)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("%v does not wrap io.ErrUnexpectedEOF", err)
+	}
+	var unsupported *ErrUnsupportedFeature
+	if errors.As(err, &unsupported) {
+		t.Errorf("%v is an ErrUnsupportedFeature", err)
+	}
+	if err := fmt.Errorf("volume is %w", ErrEncrypted); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("%v is not ErrEncrypted", err)
+	}
+}
+
+// sectorReader fails reads that are not of whole sectors into aligned
+// memory, like a device opened with O_DIRECT
+type sectorReader struct {
+	data []byte
+}
+
+func (s sectorReader) ReadAt(p []byte, off int64) (int, error) {
+	if off%512 != 0 || len(p)%512 != 0 || uintptr(unsafe.Pointer(&p[0]))%512 != 0 {
+		return 0, errors.New("unaligned read")
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestAlignedReaderAt(t *testing.T) {
+	data := make([]byte, 8*512)
+	for i := range data {
+		data[i] = byte(i * 13 / 7)
+	}
+	r := NewAlignedReaderAt(sectorReader{data}, 512)
+
+	tests := []struct {
+		off, length int64
+	}{
+		{0, 512},
+		{1, 10},
+		{500, 600},
+		{1024, 2048},
+		{int64(len(data)) - 3, 3},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, tt.length)
+		if n, err := r.ReadAt(buf, tt.off); n != len(buf) || err != nil {
+			t.Errorf("ReadAt(%d, %d) = %d, %v", tt.off, tt.length, n, err)
+		} else if !bytes.Equal(buf, data[tt.off:tt.off+tt.length]) {
+			t.Errorf("ReadAt(%d, %d) read the wrong data", tt.off, tt.length)
+		}
+	}
+
+	buf := make([]byte, 100)
+	if n, err := r.ReadAt(buf, int64(len(data))-40); n != 40 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v, want 40, EOF", n, err)
+	}
+	if n, err := r.ReadAt(buf, int64(len(data))+5); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt after the end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+// badSectorReader fails reads that touch its bad 512-byte sectors
+type badSectorReader struct {
+	data []byte
+	bad  map[int64]bool
+}
+
+func (r badSectorReader) ReadAt(p []byte, off int64) (int, error) {
+	for pos := off / 512 * 512; pos < off+int64(len(p)); pos += 512 {
+		if r.bad[pos/512] {
+			n, _ := bytes.NewReader(r.data).ReadAt(p[:max(pos-off, 0)], off)
+			return n, errors.New("I/O error")
+		}
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestFillReaderAt(t *testing.T) {
+	data := make([]byte, 16*512+100)
+	for i := range data {
+		data[i] = byte(i%251 + 1)
+	}
+	var logged []Range
+	f := NewFillReaderAt(badSectorReader{data, map[int64]bool{3: true, 4: true, 9: true}}, 512, func(bad Range, err error) {
+		logged = append(logged, bad)
+	})
+
+	want := slices.Clone(data)
+	clear(want[3*512 : 5*512])
+	clear(want[9*512 : 10*512])
+	got := make([]byte, len(data))
+	if n, err := f.ReadAt(got, 0); n != len(data) || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("read the wrong data")
+	}
+
+	// Unaligned reads, and reads of bad sectors already known
+	got = make([]byte, 1000)
+	if n, err := f.ReadAt(got, 4*512+100); n != len(got) || err != nil || !bytes.Equal(got, want[4*512+100:][:1000]) {
+		t.Errorf("unaligned ReadAt = %d, %v, or the wrong data", n, err)
+	}
+	got = make([]byte, 1000)
+	if n, err := f.ReadAt(got, int64(len(data))-500); n != 500 || err != io.EOF || !bytes.Equal(got[:500], want[len(data)-500:]) {
+		t.Errorf("ReadAt past the end = %d, %v, want 500, EOF", n, err)
+	}
+
+	wantBad := []Range{{3 * 512, 5 * 512}, {9 * 512, 10 * 512}}
+	if !slices.Equal(f.Unreadable(), wantBad) {
+		t.Errorf("Unreadable() = %v, want %v", f.Unreadable(), wantBad)
+	}
+	if !slices.Equal(logged, wantBad) {
+		t.Errorf("logged %v, want each run once: %v", logged, wantBad)
+	}
+
+	// A stopped context is not a bad sector
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f = NewFillReaderAt(NewContextReaderAt(ctx, bytes.NewReader(data), 0), 512, nil)
+	if _, err := f.ReadAt(got, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadAt with a stopped context = %v, want context.Canceled", err)
+	}
+}
+
+func TestHashingReaderAt(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	var log bytes.Buffer
+	h := NewHashingReaderAt(bytes.NewReader(data), int64(len(data)), sha256.New, &log)
+	read := func(off, n int) {
+		t.Helper()
+		if _, err := h.ReadAt(make([]byte, n), int64(off)); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	// Read out of order, with a range read twice and reads past the end
+	read(4000, 3000)
+	read(0, 1000)
+	read(0, 1000)
+	read(500, 3600)
+	if h.ImageDigest() != nil {
+		t.Error("digest of an image only partly read")
+	}
+	read(7000, 5000)
+	want := sha256.Sum256(data)
+	if got := h.ImageDigest(); !bytes.Equal(got, want[:]) {
+		t.Errorf("image digest %x, want %x", got, want)
+	}
+
+	digest := func(b []byte) string { d := sha256.Sum256(b); return hex.EncodeToString(d[:]) }
+	wantLines := []string{
+		"4000 3000 " + digest(data[4000:7000]),
+		"0 1000 " + digest(data[:1000]),
+		"500 3600 " + digest(data[500:4100]),
+		"7000 3000 " + digest(data[7000:]),
+	}
+
+	// The range logged for the read at 0 is logged again when it changes
+	data[10] ^= 0xFF
+	read(0, 1000)
+	if err := h.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 7 || !slices.Equal(lines[:2], wantLines[:2]) || !slices.Equal(lines[2:4], wantLines[2:]) {
+		t.Fatalf("log:\n%s", log.String())
+	}
+	if !strings.HasPrefix(lines[4], "0 1000 "+digest(data[:1000])+" changed, was ") {
+		t.Errorf("log of a changed range: %s", lines[4])
+	}
+	if !strings.HasPrefix(lines[5], "# 12600 bytes in 6 reads") || lines[6] != "# image of 10000 bytes, digest "+hex.EncodeToString(want[:]) {
+		t.Errorf("summary: %q", lines[5:])
+	}
+}
@@ -1,42 +1,226 @@
 // Package hfsplus implements read-only HFS+ filesystem support.
-// Currently only detection and basic info are implemented.
+// Files and directories are found through the catalog B-tree; forks with
+// more than eight extents are completed from the extents overflow B-tree.
 package hfsplus
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf16"
 
+	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
 )
 
 const (
-	hfsPlusSig = 0x482B // 'H+'
-	hfsxSig    = 0x4858 // 'HX' (case-sensitive HFS+)
+	hfsPlusSig         = 0x482B // 'H+'
+	hfsxSig            = 0x4858 // 'HX' (case-sensitive HFS+)
 	volumeHeaderOffset = 1024
+
+	// Special catalog node IDs
+	rootParentID     = 1
+	rootFolderID     = 2
+	extentsFileID    = 3
+	catalogFileID    = 4
+	allocationFileID = 6
+	attributesFileID = 8
+
+	// B-tree node kinds
+	nodeKindLeaf   = -1
+	nodeKindIndex  = 0
+	nodeKindHeader = 1
+
+	nodeDescriptorSize = 14
+	maxTreeDepth       = 16
+
+	// keyCompareType in the catalog header of HFSX volumes
+	keyCompareBinary = 0xBC
+
+	// Catalog record types
+	recFolder       = 1
+	recFile         = 2
+	recFolderThread = 3
+	recFileThread   = 4
+
+	fileRecordSize   = 248
+	folderRecordSize = 88
+
+	forkTypeData     = 0x00
+	forkTypeResource = 0xFF
+
+	// Attributes file record types
+	attrInlineData = 0x10
+	attrForkData   = 0x20
+	attrExtents    = 0x30
+
+	// Hard links are files of this type and creator whose link target is
+	// "iNode<n>" in the private metadata folder, n being the special field
+	hardLinkFileType = 0x686C6E6B // 'hlnk'
+	hardLinkCreator  = 0x6866732B // 'hfs+'
+	privateDirName   = "\x00\x00\x00\x00HFS+ Private Data"
+	privateDirDirs   = ".HFS+ Private Directory Data\r"
+
+	// kHFSVolumeJournaledBit in the volume header attributes
+	volumeJournaledBit = 1 << 13
+
+	// UF_COMPRESSED in the owner flags: the data is in a decmpfs
+	// extended attribute or the resource fork
+	ufCompressed = 0x20
 )
 
-// FS implements a read-only HFS+ filesystem (skeleton)
+// FS implements a read-only HFS+ filesystem
 type FS struct {
-	r            io.ReaderAt
-	size         int64
-	signature    uint16
-	version      uint16
-	blockSize    uint32
-	totalBlocks  uint32
-	freeBlocks   uint32
-	createDate   uint32
-	modifyDate   uint32
-	backupDate   uint32
-	checkedDate  uint32
-	fileCount    uint32
-	folderCount  uint32
+	r           io.ReaderAt // The image, through the block cache
+	base        io.ReaderAt // The image, with the journal applied if replayed
+	size        int64
+	signature   uint16
+	version     uint16
+	blockSize   uint32
+	totalBlocks uint32
+	freeBlocks  uint32
+	createDate  uint32
+	modifyDate  uint32
+	backupDate  uint32
+	checkedDate uint32
+	fileCount   uint32
+	folderCount uint32
+
+	allocationFile forkData // The allocation bitmap, one bit per block
+	extentsTree    *btree
+	catalog        *btree
+	attributes     *btree     // nil if the volume has no attributes file
+	privateDirMu   sync.Mutex // Guards privateDir
+	privateDir     uint32     // CNID of the hard link folder, 0 if not looked up yet
+
+	journal  *journal // nil if the volume is not journaled
+	replayed bool     // Whether r overlays the committed journal transactions
+}
+
+// forkData holds an HFSPlusForkData structure
+type forkData struct {
+	logicalSize uint64
+	totalBlocks uint32
+	extents     []extentDescriptor // The initial (up to eight) extents
+}
+
+// extentDescriptor is a run of allocation blocks
+type extentDescriptor struct {
+	startBlock uint32
+	blockCount uint32
+}
+
+func parseForkData(b []byte) forkData {
+	fd := forkData{
+		logicalSize: binary.BigEndian.Uint64(b[0:8]),
+		totalBlocks: binary.BigEndian.Uint32(b[12:16]),
+	}
+	fd.extents = parseExtentRecord(b[16:80])
+	return fd
+}
+
+// parseExtentRecord parses an HFSPlusExtentRecord (eight extent
+// descriptors), stopping at the first empty one
+func parseExtentRecord(b []byte) []extentDescriptor {
+	var extents []extentDescriptor
+	for i := 0; i+8 <= len(b) && i < 64; i += 8 {
+		e := extentDescriptor{
+			startBlock: binary.BigEndian.Uint32(b[i:]),
+			blockCount: binary.BigEndian.Uint32(b[i+4:]),
+		}
+		if e.blockCount == 0 {
+			break
+		}
+		extents = append(extents, e)
+	}
+	return extents
+}
+
+func init() {
+	fsys.Register(detect.HFSPlus, Open)
 }
 
 // Open opens an HFS+ filesystem from the given reader
 func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
+	return OpenReplay(r, size, false)
+}
+
+// OpenReplay opens an HFS+ filesystem. If replay is set and the volume is
+// journaled, the committed journal transactions are applied to an overlay
+// of the image before any metadata is read.
+func OpenReplay(r io.ReaderAt, size int64, replay bool) (fsys.FS, error) {
+	header, err := readVolumeHeader(r)
+	if header == nil || err != nil {
+		return nil, err // Not HFS+
+	}
+
+	f := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size}
+	if err := f.parseVolumeHeader(header); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[4:8])&volumeJournaledBit != 0 {
+		journalInfoBlock := binary.BigEndian.Uint32(header[12:16])
+		f.journal, err = openJournal(r, int64(journalInfoBlock)*int64(f.blockSize))
+		if err != nil {
+			return nil, fmt.Errorf("opening journal: %w", err)
+		}
+	}
+
+	if replay && f.journal != nil {
+		txns, err := f.journal.transactions()
+		if err != nil {
+			return nil, fmt.Errorf("replaying journal: %w", err)
+		}
+		f.base = &journalOverlay{r: r, txns: txns}
+		f.r = fsys.NewCachedReaderAt(f.base)
+		f.replayed = true
+
+		// The volume header itself is usually part of the journal
+		if header, err = readVolumeHeader(f.r); err != nil {
+			return nil, err
+		}
+		if header == nil {
+			return nil, fsys.Corrupt("volume header", volumeHeaderOffset, "the journal replaces it with one with a bad signature")
+		}
+		if err := f.parseVolumeHeader(header); err != nil {
+			return nil, err
+		}
+	}
+
+	f.allocationFile = parseForkData(header[112:192])
+
+	// The extents overflow file never overflows itself; the catalog may
+	f.extentsTree, err = f.openBTree(parseForkData(header[192:272]), extentsFileID, "extents overflow file")
+	if err != nil {
+		return nil, fmt.Errorf("opening extents overflow file: %w", err)
+	}
+	f.catalog, err = f.openBTree(parseForkData(header[272:352]), catalogFileID, "catalog file")
+	if err != nil {
+		return nil, fmt.Errorf("opening catalog file: %w", err)
+	}
+	if attrFork := parseForkData(header[352:432]); attrFork.logicalSize != 0 {
+		f.attributes, err = f.openBTree(attrFork, attributesFileID, "attributes file")
+		if err != nil {
+			return nil, fmt.Errorf("opening attributes file: %w", err)
+		}
+	}
+
+	return f, nil
+}
+
+// readVolumeHeader reads the volume header, returning nil if the
+// signature is not HFS+ or HFSX
+func readVolumeHeader(r io.ReaderAt) ([]byte, error) {
 	// Volume header is at offset 1024
 	header := make([]byte, 512)
 	if _, err := r.ReadAt(header, volumeHeaderOffset); err != nil {
@@ -46,11 +230,14 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 	// Check signature (big-endian)
 	sig := binary.BigEndian.Uint16(header[0:2])
 	if sig != hfsPlusSig && sig != hfsxSig {
-		return nil, nil // Not HFS+
+		return nil, nil
 	}
+	return header, nil
+}
 
-	f := &FS{r: r, size: size}
-	f.signature = sig
+// parseVolumeHeader fills in the volume fields from the header
+func (f *FS) parseVolumeHeader(header []byte) error {
+	f.signature = binary.BigEndian.Uint16(header[0:2])
 	f.version = binary.BigEndian.Uint16(header[2:4])
 	// attributes at 4:8
 	// lastMountedVersion at 8:12
@@ -65,7 +252,10 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 	f.totalBlocks = binary.BigEndian.Uint32(header[44:48])
 	f.freeBlocks = binary.BigEndian.Uint32(header[48:52])
 
-	return f, nil
+	if f.blockSize < 512 || f.blockSize&(f.blockSize-1) != 0 {
+		return fsys.Corrupt("volume header", volumeHeaderOffset, "invalid block size %d", f.blockSize)
+	}
+	return nil
 }
 
 func (f *FS) Type() string {
@@ -75,8 +265,24 @@ func (f *FS) Type() string {
 	return "HFS+"
 }
 
-func (f *FS) Close() error { return nil }
-func (f *FS) BaseReader() io.ReaderAt { return f.r }
+func (f *FS) Close() error            { return nil }
+func (f *FS) BaseReader() io.ReaderAt { return f.base }
+
+// Label returns the volume name, which is the name of the root folder
+func (f *FS) Label() string {
+	var label string
+	f.children(rootParentID, func(name []uint16, e *catalogEntry) bool {
+		if e.isDir() && e.id() == rootFolderID {
+			label = decodeName(name)
+			return false
+		}
+		return true
+	})
+	return label
+}
+
+// BlockSize implements fsys.BlockSizer with the allocation block size
+func (f *FS) BlockSize() int64 { return int64(f.blockSize) }
 
 // hfsTime converts HFS+ timestamp (seconds since 1904-01-01) to time.Time
 func hfsTime(t uint32) time.Time {
@@ -96,11 +302,11 @@ func (f *FS) Info() string {
 	if f.signature == hfsxSig {
 		typeName = "HFSX (case-sensitive)"
 	}
-	
+
 	totalSize := uint64(f.blockSize) * uint64(f.totalBlocks)
 	freeSize := uint64(f.blockSize) * uint64(f.freeBlocks)
 	usedSize := totalSize - freeSize
-	
+
 	info := fmt.Sprintf("%s Volume\n"+
 		"  Version: %d\n"+
 		"  Block size: %d bytes\n"+
@@ -128,50 +334,1262 @@ func (f *FS) Info() string {
 	if !hfsTime(f.modifyDate).IsZero() {
 		info += fmt.Sprintf("\n  Modified: %s", hfsTime(f.modifyDate).Format(time.RFC3339))
 	}
-	
+	if f.journal != nil {
+		info += fmt.Sprintf("\n  Journal: %d bytes at offset %d", f.journal.size, f.journal.offset)
+		if f.journal.start != f.journal.end {
+			info += " (has pending transactions)"
+		}
+		if f.replayed {
+			info += ", replayed"
+		}
+	}
+
 	return info
 }
 
-var errNotImplemented = fmt.Errorf("HFS+: not yet implemented")
+// Journal info block flags
+const (
+	journalInFS          = 0x1
+	journalOnOtherDevice = 0x2
+)
+
+const (
+	journalMagic  = 0x4A4E4C78 // 'JNLx'
+	journalEndian = 0x12345678
+
+	journalHeaderChecksumSize = 44 // Bytes of the journal header covered by its checksum
+	blockListChecksumSize     = 32 // Bytes of a block list header covered by its checksum
+	blockInfoSize             = 16
+
+	// Flags in the first block_info of a block list
+	blockListFirstHeader = 0x2
+
+	killedBlock = ^uint64(0) // Block number of a block dropped from a transaction
+)
+
+// journal is the circular buffer of the HFS+ metadata journal. Its
+// structures are in the byte order of the host that wrote them.
+type journal struct {
+	r         io.ReaderAt
+	offset    int64 // Journal header offset within the image
+	size      int64
+	start     int64 // Oldest block list not yet checkpointed, relative to offset
+	end       int64 // Where the next block list will be written
+	blhdrSize int64
+	jhdrSize  int64
+	order     binary.ByteOrder
+}
+
+// openJournal reads the journal info block at jibOffset and the journal
+// header it points to. It returns nil if the journal is not in use.
+func openJournal(r io.ReaderAt, jibOffset int64) (*journal, error) {
+	jib := make([]byte, 52)
+	if _, err := r.ReadAt(jib, jibOffset); err != nil {
+		return nil, fmt.Errorf("reading journal info block: %w", err)
+	}
+	flags := binary.BigEndian.Uint32(jib[0:4])
+	if flags&journalOnOtherDevice != 0 {
+		return nil, fsys.Unsupported("HFS+ journal on another device")
+	}
+	if flags&journalInFS == 0 {
+		return nil, nil
+	}
+
+	j := &journal{
+		r:      r,
+		offset: int64(binary.BigEndian.Uint64(jib[36:44])),
+		size:   int64(binary.BigEndian.Uint64(jib[44:52])),
+	}
+
+	jh := make([]byte, journalHeaderChecksumSize)
+	if _, err := r.ReadAt(jh, j.offset); err != nil {
+		return nil, fmt.Errorf("reading journal header: %w", err)
+	}
+	switch {
+	case binary.BigEndian.Uint32(jh[0:4]) == journalMagic && binary.BigEndian.Uint32(jh[4:8]) == journalEndian:
+		j.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(jh[0:4]) == journalMagic && binary.LittleEndian.Uint32(jh[4:8]) == journalEndian:
+		j.order = binary.LittleEndian
+	default:
+		return nil, fsys.Corrupt("journal header", j.offset, "bad magic")
+	}
+
+	checksum := j.order.Uint32(jh[36:40])
+	j.order.PutUint32(jh[36:40], 0)
+	if journalChecksum(jh) != checksum {
+		return nil, fsys.Corrupt("journal header", j.offset, "bad checksum")
+	}
+
+	j.start = int64(j.order.Uint64(jh[8:16]))
+	j.end = int64(j.order.Uint64(jh[16:24]))
+	if size := int64(j.order.Uint64(jh[24:32])); size != j.size {
+		return nil, fsys.Corrupt("journal header", j.offset, "size %d, but the info block says %d", size, j.size)
+	}
+	j.blhdrSize = int64(j.order.Uint32(jh[32:36]))
+	j.jhdrSize = int64(j.order.Uint32(jh[40:44]))
+
+	if j.jhdrSize < journalHeaderChecksumSize || j.jhdrSize >= j.size ||
+		j.blhdrSize < blockListChecksumSize || j.blhdrSize > j.size-j.jhdrSize {
+		return nil, fsys.Corrupt("journal header", j.offset, "bad geometry")
+	}
+	if j.start < j.jhdrSize || j.start >= j.size || j.end < j.jhdrSize || j.end >= j.size {
+		return nil, fsys.Corrupt("journal header", j.offset, "start %d or end %d out of range", j.start, j.end)
+	}
+	return j, nil
+}
+
+// journalChecksum is the checksum of journal and block list headers
+func journalChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum = (sum << 8) ^ (sum + uint32(c))
+	}
+	return ^sum
+}
+
+// readAt reads from the circular buffer at pos, wrapping past its end,
+// and returns the position following the data
+func (j *journal) readAt(b []byte, pos int64) (int64, error) {
+	for len(b) > 0 {
+		n := min(int64(len(b)), j.size-pos)
+		if _, err := j.r.ReadAt(b[:n], j.offset+pos); err != nil {
+			return pos, err
+		}
+		b = b[n:]
+		if pos += n; pos == j.size {
+			pos = j.jhdrSize
+		}
+	}
+	return pos, nil
+}
+
+// transactions reads the block lists between start and end. Block lists
+// of one transaction follow a block list flagged as its first; journals
+// that never set the flag get one transaction per block list.
+func (j *journal) transactions() ([]fsys.Transaction, error) {
+	var txns []fsys.Transaction
+	grouped := false
+	var walked int64
+
+	for pos := j.start; pos != j.end; {
+		blhdr := make([]byte, j.blhdrSize)
+		next, err := j.readAt(blhdr, pos)
+		if err != nil {
+			return nil, fmt.Errorf("block list at %d: %w", pos, err)
+		}
+
+		numBlocks := int64(j.order.Uint16(blhdr[2:4]))
+		bytesUsed := int64(j.order.Uint32(blhdr[4:8]))
+		checksum := j.order.Uint32(blhdr[8:12])
+		j.order.PutUint32(blhdr[8:12], 0)
+		if journalChecksum(blhdr[:blockListChecksumSize]) != checksum {
+			return nil, fsys.Corrupt("journal block list", j.offset+pos, "bad checksum")
+		}
+		if numBlocks < 1 || blockInfoSize*(numBlocks+1) > j.blhdrSize ||
+			bytesUsed < j.blhdrSize || bytesUsed > j.size-j.jhdrSize {
+			return nil, fsys.Corrupt("journal block list", j.offset+pos, "bad header")
+		}
+		if walked += bytesUsed; walked > j.size-j.jhdrSize {
+			return nil, fsys.Corrupt("journal block list", j.offset+pos, "the block lists overrun the journal")
+		}
+
+		// binfo[0] carries flags; the blocks follow in binfo[1:]
+		flags := j.order.Uint32(blhdr[28:32])
+		if pos == j.start {
+			grouped = flags&blockListFirstHeader != 0
+		}
+		if !grouped || flags&blockListFirstHeader != 0 || len(txns) == 0 {
+			txns = append(txns, fsys.Transaction{Offset: j.offset + pos})
+		}
+		txn := &txns[len(txns)-1]
+
+		used := j.blhdrSize
+		for i := int64(1); i < numBlocks; i++ {
+			info := blhdr[blockInfoSize*(i+1):]
+			bnum := j.order.Uint64(info[0:8])
+			bsize := int64(j.order.Uint32(info[8:12]))
+			if used += bsize; used > bytesUsed {
+				return nil, fsys.Corrupt("journal block list", j.offset+pos, "blocks overrun the %d bytes used", bytesUsed)
+			}
+
+			data := make([]byte, bsize)
+			if next, err = j.readAt(data, next); err != nil {
+				return nil, fmt.Errorf("block list at %d: %w", pos, err)
+			}
+			if bnum == killedBlock {
+				continue
+			}
+			txn.Blocks = append(txn.Blocks, fsys.JournalBlock{
+				Target: int64(bnum) * j.jhdrSize,
+				Data:   data,
+			})
+		}
+
+		if pos += bytesUsed; pos >= j.size {
+			pos += j.jhdrSize - j.size
+		}
+	}
+	return txns, nil
+}
+
+// JournalTransactions implements fsys.Journaler
+func (f *FS) JournalTransactions() ([]fsys.Transaction, error) {
+	if f.journal == nil {
+		return nil, fmt.Errorf("volume is not journaled")
+	}
+	return f.journal.transactions()
+}
+
+// journalOverlay reads the image with journal transactions applied
+type journalOverlay struct {
+	r    io.ReaderAt
+	txns []fsys.Transaction
+}
+
+func (o *journalOverlay) ReadAt(b []byte, off int64) (int, error) {
+	n, err := o.r.ReadAt(b, off)
+	end := off + int64(n)
+
+	// Later transactions win
+	for _, txn := range o.txns {
+		for _, blk := range txn.Blocks {
+			lo := max(off, blk.Target)
+			hi := min(end, blk.Target+int64(len(blk.Data)))
+			if lo < hi {
+				copy(b[lo-off:hi-off], blk.Data[lo-blk.Target:hi-blk.Target])
+			}
+		}
+	}
+	return n, err
+}
+
+// FreeBlocks implements fsys.FreeBlocker by scanning the allocation file.
+// Bits are stored most significant first; a clear bit is a free block.
+func (f *FS) FreeBlocks() ([]fsys.Range, error) {
+	extents, err := f.forkExtents(f.allocationFile, allocationFileID, forkTypeData)
+	if err != nil {
+		return nil, fmt.Errorf("mapping allocation file: %w", err)
+	}
+	bitmap := fsys.NewExtentReaderAt(f.r, extents, int64(f.allocationFile.logicalSize))
+	if need := (int64(f.totalBlocks) + 7) / 8; int64(f.allocationFile.logicalSize) < need {
+		return nil, fsys.Corrupt("allocation file", -1, "%d bytes are too few for %d blocks",
+			f.allocationFile.logicalSize, f.totalBlocks)
+	}
+
+	var ranges []fsys.Range
+	blockSize := int64(f.blockSize)
+	var inFreeRange bool
+	var rangeStart int64
+
+	buf := make([]byte, f.blockSize)
+	for base := uint32(0); base < f.totalBlocks; base += 8 * f.blockSize {
+		n := min((f.totalBlocks-base+7)/8, f.blockSize)
+		if _, err := bitmap.ReadAt(buf[:n], int64(base/8)); err != nil {
+			return nil, fmt.Errorf("reading allocation file: %w", err)
+		}
+
+		for i := uint32(0); i < 8*n && base+i < f.totalBlocks; i++ {
+			isFree := buf[i/8]&(0x80>>(i%8)) == 0
+			offset := int64(base+i) * blockSize
+
+			if isFree && !inFreeRange {
+				rangeStart = offset
+				inFreeRange = true
+			} else if !isFree && inFreeRange {
+				ranges = append(ranges, fsys.Range{Start: rangeStart, End: offset})
+				inFreeRange = false
+			}
+		}
+	}
+	if inFreeRange {
+		ranges = append(ranges, fsys.Range{Start: rangeStart, End: int64(f.totalBlocks) * blockSize})
+	}
+
+	return ranges, nil
+}
+
+// forkExtents maps a fork to image extents. Extents beyond the eight in
+// the fork data are looked up in the extents overflow file.
+func (f *FS) forkExtents(fork forkData, fileID uint32, forkType uint8) ([]fsys.Extent, error) {
+	descs := fork.extents
+	var blocks uint32
+	for _, e := range descs {
+		blocks += e.blockCount
+	}
+
+	if blocks < fork.totalBlocks {
+		if f.extentsTree == nil || fileID == extentsFileID {
+			return nil, fsys.Corrupt(fmt.Sprintf("fork of file %d", fileID), -1, "needs overflow extents")
+		}
+		err := f.extentsTree.scan(
+			func(key []byte) bool { return compareExtentKey(key, fileID, forkType) < 0 },
+			func(key, val []byte) (bool, error) {
+				if c := compareExtentKey(key, fileID, forkType); c < 0 {
+					return true, nil
+				} else if c > 0 {
+					return false, nil
+				}
+				if binary.BigEndian.Uint32(key[8:12]) != blocks {
+					return false, fsys.Corrupt(fmt.Sprintf("fork of file %d", fileID), -1, "overflow extents start at block %d, want %d",
+						binary.BigEndian.Uint32(key[8:12]), blocks)
+				}
+				for _, e := range parseExtentRecord(val) {
+					descs = append(descs, e)
+					blocks += e.blockCount
+				}
+				return blocks < fork.totalBlocks, nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		if blocks < fork.totalBlocks {
+			return nil, fsys.Corrupt(fmt.Sprintf("fork of file %d", fileID), -1, "%d of %d blocks mapped", blocks, fork.totalBlocks)
+		}
+	}
+
+	return f.mapExtents(descs, int64(fork.logicalSize)), nil
+}
+
+// mapExtents maps the first size bytes of the runs of blocks of a fork to
+// image extents
+func (f *FS) mapExtents(descs []extentDescriptor, size int64) []fsys.Extent {
+	var extents []fsys.Extent
+	blockSize := int64(f.blockSize)
+	var logical int64
+	for _, e := range descs {
+		if logical >= size {
+			break
+		}
+		length := int64(e.blockCount) * blockSize
+		if logical+length > size {
+			length = size - logical
+		}
+		extents = append(extents, fsys.Extent{
+			Logical:  logical,
+			Physical: int64(e.startBlock) * blockSize,
+			Length:   length,
+		})
+		logical += length
+	}
+	return extents
+}
+
+// compareExtentKey orders an HFSPlusExtentKey against (fileID, forkType),
+// ignoring the start block
+func compareExtentKey(key []byte, fileID uint32, forkType uint8) int {
+	if len(key) < 12 {
+		return -1
+	}
+	id := binary.BigEndian.Uint32(key[4:8])
+	switch {
+	case id < fileID:
+		return -1
+	case id > fileID:
+		return 1
+	case key[2] < forkType:
+		return -1
+	case key[2] > forkType:
+		return 1
+	}
+	return 0
+}
+
+// btree is an HFS+ B-tree file (catalog or extents overflow)
+type btree struct {
+	name        string      // Of the file, for errors
+	r           io.ReaderAt // The tree's fork
+	extents     []fsys.Extent
+	nodeSize    uint32
+	root        uint32
+	depth       uint16
+	totalNodes  uint32
+	compareType uint8
+}
+
+// btreeNode is a parsed B-tree node
+type btreeNode struct {
+	num     uint32
+	data    []byte
+	fLink   uint32
+	kind    int8
+	height  uint8
+	offsets []int // Record offsets, plus the free space offset
+}
+
+// openBTree reads the header node of the B-tree stored in fork
+func (f *FS) openBTree(fork forkData, fileID uint32, name string) (*btree, error) {
+	extents, err := f.forkExtents(fork, fileID, forkTypeData)
+	if err != nil {
+		return nil, err
+	}
+	t := &btree{name: name, r: fsys.NewExtentReaderAt(f.r, extents, int64(fork.logicalSize)), extents: extents}
+
+	// Node 0 is the header node; its first record is the BTHeaderRec
+	head := make([]byte, nodeDescriptorSize+106)
+	if _, err := t.r.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("reading header node: %w", err)
+	}
+	if int8(head[8]) != nodeKindHeader {
+		return nil, t.corrupt(0, "bad header node kind %d", int8(head[8]))
+	}
+	h := head[nodeDescriptorSize:]
+	t.depth = binary.BigEndian.Uint16(h[0:2])
+	t.root = binary.BigEndian.Uint32(h[2:6])
+	t.nodeSize = uint32(binary.BigEndian.Uint16(h[18:20]))
+	t.totalNodes = binary.BigEndian.Uint32(h[22:26])
+	t.compareType = h[37]
+
+	if t.nodeSize < 512 || t.nodeSize&(t.nodeSize-1) != 0 {
+		return nil, t.corrupt(0, "invalid node size %d", t.nodeSize)
+	}
+	return t, nil
+}
+
+// corrupt returns an ErrCorruptMetadata for node num, located in the image
+// through the tree's extents
+func (t *btree) corrupt(num uint32, format string, args ...any) error {
+	logical, offset := int64(num)*int64(t.nodeSize), int64(-1)
+	for _, e := range t.extents {
+		if logical >= e.Logical && logical < e.Logical+e.Length {
+			offset = e.Physical + logical - e.Logical
+			break
+		}
+	}
+	return fsys.Corrupt(fmt.Sprintf("%s node %d", t.name, num), offset, format, args...)
+}
+
+// readNode reads and parses node num
+func (t *btree) readNode(num uint32) (*btreeNode, error) {
+	if num >= t.totalNodes {
+		return nil, fsys.Corrupt(fmt.Sprintf("%s node number %d", t.name, num), -1, "past the last node %d", t.totalNodes-1)
+	}
+	data := make([]byte, t.nodeSize)
+	if _, err := t.r.ReadAt(data, int64(num)*int64(t.nodeSize)); err != nil {
+		return nil, fmt.Errorf("reading node %d: %w", num, err)
+	}
+
+	n := &btreeNode{
+		num:    num,
+		data:   data,
+		fLink:  binary.BigEndian.Uint32(data[0:4]),
+		kind:   int8(data[8]),
+		height: data[9],
+	}
+	numRecords := int(binary.BigEndian.Uint16(data[10:12]))
+	if 2*(numRecords+1) > len(data)-nodeDescriptorSize {
+		return nil, t.corrupt(num, "too many records")
+	}
+
+	// Record offsets are stored backwards from the end of the node
+	for i := 0; i <= numRecords; i++ {
+		off := int(binary.BigEndian.Uint16(data[len(data)-2*(i+1):]))
+		if off < nodeDescriptorSize || off > len(data)-2*(numRecords+1) ||
+			(i > 0 && off < n.offsets[i-1]) {
+			return nil, t.corrupt(num, "bad record offset %d", off)
+		}
+		n.offsets = append(n.offsets, off)
+	}
+	return n, nil
+}
+
+// record returns the key and data of record i. Keys start with their
+// 16-bit length; the data follows, aligned to two bytes.
+func (n *btreeNode) record(i int) (key, val []byte, err error) {
+	rec := n.data[n.offsets[i]:n.offsets[i+1]]
+	if len(rec) < 2 {
+		return nil, nil, fsys.Corrupt(fmt.Sprintf("B-tree node %d", n.num), -1, "record %d too short", i)
+	}
+	keyEnd := 2 + int(binary.BigEndian.Uint16(rec[0:2]))
+	if keyEnd > len(rec) {
+		return nil, nil, fsys.Corrupt(fmt.Sprintf("B-tree node %d", n.num), -1, "record %d key overruns the record", i)
+	}
+	valStart := (keyEnd + 1) &^ 1
+	if valStart > len(rec) {
+		valStart = len(rec)
+	}
+	return rec[:keyEnd], rec[valStart:], nil
+}
+
+// scan visits leaf records in key order, starting in the leaf that holds
+// the first key for which before returns false. fn returns whether to go on.
+func (t *btree) scan(before func(key []byte) bool, fn func(key, val []byte) (bool, error)) error {
+	num := t.root
+	for depth := 0; ; depth++ {
+		if depth >= maxTreeDepth {
+			return fsys.Corrupt(t.name, -1, "B-tree deeper than %d levels", maxTreeDepth)
+		}
+		if num == 0 {
+			return nil // Empty tree
+		}
+		node, err := t.readNode(num)
+		if err != nil {
+			return err
+		}
+		if node.kind == nodeKindLeaf {
+			break
+		}
+		if node.kind != nodeKindIndex || len(node.offsets) < 2 {
+			return t.corrupt(num, "unexpected kind %d", node.kind)
+		}
+
+		// Follow the last child whose first key sorts before the target
+		next := uint32(0)
+		for i := 0; i < len(node.offsets)-1; i++ {
+			key, val, err := node.record(i)
+			if err != nil {
+				return err
+			}
+			if len(val) < 4 {
+				return t.corrupt(num, "short index record")
+			}
+			if i > 0 && !before(key) {
+				break
+			}
+			next = binary.BigEndian.Uint32(val[0:4])
+		}
+		num = next
+	}
+
+	// Walk the leaves along their forward links
+	for visited := uint32(0); num != 0; visited++ {
+		if visited > t.totalNodes {
+			return fsys.Corrupt(t.name, -1, "B-tree leaf chain loops")
+		}
+		node, err := t.readNode(num)
+		if err != nil {
+			return err
+		}
+		if node.kind != nodeKindLeaf {
+			return t.corrupt(num, "expected a leaf, got kind %d", node.kind)
+		}
+		for i := 0; i < len(node.offsets)-1; i++ {
+			key, val, err := node.record(i)
+			if err != nil {
+				return err
+			}
+			more, err := fn(key, val)
+			if err != nil || !more {
+				return err
+			}
+		}
+		num = node.fLink
+	}
+	return nil
+}
+
+// catalogEntry is a file or folder record from the catalog
+type catalogEntry struct {
+	name   string
+	parent uint32
+	rec    []byte // HFSPlusCatalogFile or HFSPlusCatalogFolder
+}
+
+func (e *catalogEntry) isDir() bool { return int16(binary.BigEndian.Uint16(e.rec[0:2])) == recFolder }
+func (e *catalogEntry) id() uint32  { return binary.BigEndian.Uint32(e.rec[8:12]) }
+func (e *catalogEntry) createDate() uint32 {
+	return binary.BigEndian.Uint32(e.rec[12:16])
+}
+func (e *catalogEntry) modDate() uint32          { return binary.BigEndian.Uint32(e.rec[16:20]) }
+func (e *catalogEntry) attributeModDate() uint32 { return binary.BigEndian.Uint32(e.rec[20:24]) }
+func (e *catalogEntry) accessDate() uint32       { return binary.BigEndian.Uint32(e.rec[24:28]) }
+func (e *catalogEntry) ownerID() uint32          { return binary.BigEndian.Uint32(e.rec[32:36]) }
+func (e *catalogEntry) groupID() uint32          { return binary.BigEndian.Uint32(e.rec[36:40]) }
+func (e *catalogEntry) backupDate() uint32       { return binary.BigEndian.Uint32(e.rec[28:32]) }
+func (e *catalogEntry) adminFlags() uint8        { return e.rec[40] }
+func (e *catalogEntry) ownerFlags() uint8        { return e.rec[41] }
+func (e *catalogEntry) fileMode() uint16         { return binary.BigEndian.Uint16(e.rec[42:44]) }
+func (e *catalogEntry) special() uint32          { return binary.BigEndian.Uint32(e.rec[44:48]) }
+
+// dataFork returns the data fork of a file record
+func (e *catalogEntry) dataFork() forkData {
+	return parseForkData(e.rec[88:168])
+}
+
+// isHardLink reports whether the file is a hard link to an iNode file
+func (e *catalogEntry) isHardLink() bool {
+	return !e.isDir() &&
+		binary.BigEndian.Uint32(e.rec[48:52]) == hardLinkFileType &&
+		binary.BigEndian.Uint32(e.rec[52:56]) == hardLinkCreator
+}
+
+// catalogKeyParent returns the parent ID of an HFSPlusCatalogKey
+func catalogKeyParent(key []byte) uint32 {
+	if len(key) < 6 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(key[2:6])
+}
+
+// catalogKeyName returns the UTF-16 name of an HFSPlusCatalogKey
+func catalogKeyName(key []byte) ([]uint16, error) {
+	if len(key) < 8 {
+		return nil, fsys.Corrupt("catalog key", -1, "too short")
+	}
+	n := int(binary.BigEndian.Uint16(key[6:8]))
+	if 8+2*n > len(key) {
+		return nil, fsys.Corrupt("catalog key", -1, "name overruns the key")
+	}
+	name := make([]uint16, n)
+	for i := range name {
+		name[i] = binary.BigEndian.Uint16(key[8+2*i:])
+	}
+	return name, nil
+}
+
+// decodeName converts a catalog name to a string. HFS+ stores the POSIX
+// '/' as ':', so a '/' in the catalog shows as ':'.
+func decodeName(name []uint16) string {
+	return strings.ReplaceAll(string(utf16.Decode(name)), "/", ":")
+}
+
+// encodeName is the inverse of decodeName
+func encodeName(name string) []uint16 {
+	return utf16.Encode([]rune(strings.ReplaceAll(name, ":", "/")))
+}
+
+// children calls fn for each file and folder record in folder parent, in
+// catalog order. fn returns whether to go on.
+func (f *FS) children(parent uint32, fn func(name []uint16, e *catalogEntry) bool) error {
+	return f.catalog.scan(
+		func(key []byte) bool { return catalogKeyParent(key) < parent },
+		func(key, val []byte) (bool, error) {
+			switch p := catalogKeyParent(key); {
+			case p < parent:
+				return true, nil
+			case p > parent:
+				return false, nil
+			}
+			if len(val) < 2 {
+				return false, fsys.Corrupt(fmt.Sprintf("catalog record in folder %d", parent), -1, "too short")
+			}
+			switch int16(binary.BigEndian.Uint16(val[0:2])) {
+			case recFolder:
+				if len(val) < folderRecordSize {
+					return false, fsys.Corrupt(fmt.Sprintf("catalog record in folder %d", parent), -1, "short folder record")
+				}
+			case recFile:
+				if len(val) < fileRecordSize {
+					return false, fsys.Corrupt(fmt.Sprintf("catalog record in folder %d", parent), -1, "short file record")
+				}
+			default:
+				return true, nil // Thread records
+			}
+			name, err := catalogKeyName(key)
+			if err != nil {
+				return false, err
+			}
+			return fn(name, &catalogEntry{name: decodeName(name), parent: parent, rec: val}), nil
+		})
+}
+
+// compareNames orders two catalog names the way the catalog does:
+// binary on HFSX volumes, and with Unicode case folding on HFS+
+func (f *FS) compareNames(a, b []uint16) int {
+	if f.catalog.compareType != keyCompareBinary {
+		a, b = foldName(a), foldName(b)
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// foldName case-folds a name for comparison, following Apple's
+// FastUnicodeCompare: letters are lowercased, ignorable formatting
+// characters are dropped and NUL sorts after everything else
+func foldName(name []uint16) []uint16 {
+	folded := make([]uint16, 0, len(name))
+	for _, c := range name {
+		switch {
+		case c == 0:
+			folded = append(folded, 0xFFFF)
+		case c >= 0x200C && c <= 0x200F, c >= 0x202A && c <= 0x202E,
+			c >= 0x206A && c <= 0x206F, c == 0xFEFF:
+			// Ignorable
+		case c >= 0xD800 && c <= 0xDFFF:
+			folded = append(folded, c) // Surrogates compare as is
+		default:
+			folded = append(folded, uint16(unicode.ToLower(rune(c))))
+		}
+	}
+	return folded
+}
+
+// lookupChild finds the entry called name in folder parent
+func (f *FS) lookupChild(parent uint32, name string) (*catalogEntry, error) {
+	want := encodeName(name)
+	var found *catalogEntry
+	err := f.children(parent, func(n []uint16, e *catalogEntry) bool {
+		if f.compareNames(n, want) == 0 {
+			found = e
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fs.ErrNotExist
+	}
+	return found, nil
+}
+
+// rootEntry returns the root folder's record, the only child of the
+// root's parent
+func (f *FS) rootEntry() (*catalogEntry, error) {
+	var root *catalogEntry
+	err := f.children(rootParentID, func(_ []uint16, e *catalogEntry) bool {
+		if e.isDir() && e.id() == rootFolderID {
+			root = e
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, fsys.Corrupt("catalog file", -1, "no root folder")
+	}
+	root.name = "."
+	return root, nil
+}
+
+// lookup resolves a path to its catalog entry, following hard links
+func (f *FS) lookup(name string) (*catalogEntry, error) {
+	entry, err := f.rootEntry()
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		return entry, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if !entry.isDir() {
+			return nil, fs.ErrNotExist
+		}
+		if entry, err = f.lookupChild(entry.id(), part); err != nil {
+			return nil, err
+		}
+	}
+	return f.resolveHardLink(entry)
+}
+
+// resolveHardLink returns the iNode file a hard link points to, under the
+// link's name, or the entry itself if it is not a hard link
+func (f *FS) resolveHardLink(e *catalogEntry) (*catalogEntry, error) {
+	if !e.isHardLink() {
+		return e, nil
+	}
+	privateDir, err := f.privateDirID()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := f.lookupChild(privateDir, fmt.Sprintf("iNode%d", e.special()))
+	if err != nil {
+		return nil, fmt.Errorf("hard link %q: %w", e.name, err)
+	}
+	return &catalogEntry{name: e.name, parent: e.parent, rec: target.rec}, nil
+}
+
+// privateDirID returns the CNID of the hard link folder, looking it up on
+// first use
+func (f *FS) privateDirID() (uint32, error) {
+	f.privateDirMu.Lock()
+	defer f.privateDirMu.Unlock()
+	if f.privateDir == 0 {
+		dir, err := f.lookupChild(rootFolderID, privateDirName)
+		if err != nil {
+			return 0, fmt.Errorf("hard link folder: %w", err)
+		}
+		f.privateDir = dir.id()
+	}
+	return f.privateDir, nil
+}
+
+// hiddenName reports whether a root entry is HFS+ metadata that is not
+// shown in listings
+func hiddenName(parent uint32, name string) bool {
+	return parent == rootFolderID && (name == privateDirName || name == privateDirDirs)
+}
+
+// FileExtents returns the physical extents of a file's data fork
+func (f *FS) FileExtents(name string) ([]fsys.Extent, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "extents", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "extents", Path: name, Err: err}
+	}
+	if entry.isDir() {
+		return nil, fmt.Errorf("cannot get extents for directory")
+	}
+
+	return f.forkExtents(entry.dataFork(), entry.id(), forkTypeData)
+}
+
+// fs.FS implementation
 
 // Open implements fs.FS
 func (f *FS) Open(name string) (fs.File, error) {
-	if name == "." {
-		return &hfsRoot{fs: f}, nil
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
-	return nil, &fs.PathError{Op: "open", Path: name, Err: errNotImplemented}
+
+	entry, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if name != "." {
+		entry.name = path.Base(name)
+	}
+
+	if entry.isDir() {
+		return &hfsDir{fs: f, entry: entry}, nil
+	}
+	return &hfsFile{fs: f, entry: entry}, nil
 }
 
 // ReadDir implements fs.ReadDirFS
 func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotImplemented}
+	return fsys.ReadDirFile(f, name)
 }
 
 // Stat implements fs.StatFS
 func (f *FS) Stat(name string) (fs.FileInfo, error) {
-	if name == "." {
-		return &hfsRootInfo{fs: f}, nil
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// ReadLink implements fsys.Symlinker; a symlink's target is its data fork
+func (f *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := f.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if entry.isDir() || entry.fileMode()&0xF000 != 0xA000 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
 	}
-	return nil, &fs.PathError{Op: "stat", Path: name, Err: errNotImplemented}
+	file := &hfsFile{fs: f, entry: entry}
+	target := make([]byte, entry.dataFork().logicalSize)
+	if _, err := file.ReadAt(target, 0); err != nil && err != io.EOF {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(target), nil
 }
 
-// hfsRoot represents the root directory
-type hfsRoot struct {
-	fs *FS
+// Lstat implements fsys.Symlinker; Stat does not follow symlinks either
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	return f.Stat(name)
 }
 
-func (r *hfsRoot) Stat() (fs.FileInfo, error) { return &hfsRootInfo{fs: r.fs}, nil }
-func (r *hfsRoot) Read([]byte) (int, error)   { return 0, errNotImplemented }
-func (r *hfsRoot) Close() error               { return nil }
+// Extended attributes, which macOS also names the resource fork and the
+// Finder information by
+const (
+	finderInfoXattr   = "com.apple.FinderInfo"
+	resourceForkXattr = "com.apple.ResourceFork"
+	decmpfsXattr      = "com.apple.decmpfs"
+)
 
-// hfsRootInfo provides FileInfo for root
-type hfsRootInfo struct {
-	fs *FS
+// resourceFork returns the resource fork of a file record
+func (e *catalogEntry) resourceFork() forkData {
+	return parseForkData(e.rec[168:248])
 }
 
-func (i *hfsRootInfo) Name() string       { return "." }
-func (i *hfsRootInfo) Size() int64        { return 0 }
-func (i *hfsRootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
-func (i *hfsRootInfo) ModTime() time.Time { return hfsTime(i.fs.modifyDate) }
-func (i *hfsRootInfo) IsDir() bool        { return true }
-func (i *hfsRootInfo) Sys() any           { return nil }
+// xattrs returns functions reading the values of the extended attributes
+// of a file, by name: those in the attributes file, and the Finder
+// information and resource fork when they are not empty, as macOS shows
+// them. As in macOS the attributes holding the data of a compressed file
+// are left out.
+func (f *FS) xattrs(e *catalogEntry) (map[string]func() ([]byte, error), error) {
+	attrs := make(map[string]func() ([]byte, error))
+	id := e.id()
+	where := fmt.Sprintf("attributes of file %d", id)
+	if f.attributes != nil {
+		forks := make(map[string]*forkData)
+		err := f.attributes.scan(
+			func(key []byte) bool { return attrKeyFileID(key) < id },
+			func(key, val []byte) (bool, error) {
+				switch fileID := attrKeyFileID(key); {
+				case fileID < id:
+					return true, nil
+				case fileID > id:
+					return false, nil
+				}
+				if len(key) < 14 || 14+2*int(binary.BigEndian.Uint16(key[12:14])) > len(key) || len(val) < 4 {
+					return false, fsys.Corrupt(where, -1, "short record")
+				}
+				name := make([]uint16, binary.BigEndian.Uint16(key[12:14]))
+				for i := range name {
+					name[i] = binary.BigEndian.Uint16(key[14+2*i:])
+				}
+				attr := string(utf16.Decode(name))
+
+				switch binary.BigEndian.Uint32(val[0:4]) {
+				case attrInlineData:
+					if len(val) < 16 || 16+int(binary.BigEndian.Uint32(val[12:16])) > len(val) {
+						return false, fsys.Corrupt(where, -1, "%s overruns its record", attr)
+					}
+					value := val[16 : 16+binary.BigEndian.Uint32(val[12:16])]
+					attrs[attr] = func() ([]byte, error) { return value, nil }
+				case attrForkData:
+					if len(val) < 88 {
+						return false, fsys.Corrupt(where, -1, "short fork record of %s", attr)
+					}
+					fork := parseForkData(val[8:88])
+					forks[attr] = &fork
+				case attrExtents:
+					fork := forks[attr]
+					if fork == nil || len(val) < 72 {
+						return false, fsys.Corrupt(where, -1, "stray extents record of %s", attr)
+					}
+					fork.extents = append(fork.extents, parseExtentRecord(val[8:72])...)
+				}
+				return true, nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		for attr, fork := range forks {
+			attrs[attr] = func() ([]byte, error) {
+				var blocks uint32
+				for _, d := range fork.extents {
+					blocks += d.blockCount
+				}
+				if blocks < fork.totalBlocks {
+					return nil, fsys.Corrupt(where, -1, "%d of %d blocks of %s mapped", blocks, fork.totalBlocks, attr)
+				}
+				return f.readExtents(f.mapExtents(fork.extents, int64(fork.logicalSize)), int64(fork.logicalSize))
+			}
+		}
+	}
+
+	if info := e.rec[48:80]; !bytes.Equal(info, make([]byte, 32)) {
+		attrs[finderInfoXattr] = func() ([]byte, error) { return info, nil }
+	}
+	if !e.isDir() && e.resourceFork().logicalSize != 0 {
+		attrs[resourceForkXattr] = func() ([]byte, error) {
+			fork := e.resourceFork()
+			extents, err := f.forkExtents(fork, id, forkTypeResource)
+			if err != nil {
+				return nil, err
+			}
+			return f.readExtents(extents, int64(fork.logicalSize))
+		}
+	}
+	if e.ownerFlags()&ufCompressed != 0 {
+		delete(attrs, decmpfsXattr)
+		delete(attrs, resourceForkXattr)
+	}
+	return attrs, nil
+}
+
+// attrKeyFileID returns the file ID of an HFSPlusAttrKey, which is
+// followed by the start block of an extents record and the name
+func attrKeyFileID(key []byte) uint32 {
+	if len(key) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(key[4:8])
+}
+
+// readExtents reads size bytes mapped by extents
+func (f *FS) readExtents(extents []fsys.Extent, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := fsys.NewExtentReaderAt(f.r, extents, size).ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// namedXattrs looks up a file and the readers of its extended attributes
+func (f *FS) namedXattrs(op, name string) (map[string]func() ([]byte, error), error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	attrs, err := f.xattrs(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return attrs, nil
+}
+
+// ListXattr implements fsys.XattrFS
+func (f *FS) ListXattr(name string) ([]string, error) {
+	attrs, err := f.namedXattrs("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(attrs))
+	for n := range attrs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetXattr implements fsys.XattrFS
+func (f *FS) GetXattr(name, attr string) ([]byte, error) {
+	attrs, err := f.namedXattrs("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	read, ok := attrs[attr]
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fsys.ErrNoXattr}
+	}
+	value, err := read()
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	return value, nil
+}
+
+// hfsFile implements fs.File for regular files, reading the data fork
+// through its extents on demand
+type hfsFile struct {
+	fs     *FS
+	entry  *catalogEntry
+	mu     sync.Mutex // Guards reader, so that ReadAt can be concurrent
+	reader *fsys.ExtentReaderAt
+	offset int64
+}
+
+func (f *hfsFile) Stat() (fs.FileInfo, error) {
+	return &hfsFileInfo{entry: f.entry}, nil
+}
+
+// extentReader returns the reader over the data fork, mapping it on first use
+func (f *hfsFile) extentReader() (*fsys.ExtentReaderAt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader == nil {
+		if f.entry.ownerFlags()&ufCompressed != 0 {
+			return nil, fsys.Unsupported("HFS+ compression")
+		}
+		fork := f.entry.dataFork()
+		extents, err := f.fs.forkExtents(fork, f.entry.id(), forkTypeData)
+		if err != nil {
+			return nil, err
+		}
+		f.reader = fsys.NewExtentReaderAt(f.fs.r, extents, int64(fork.logicalSize))
+	}
+	return f.reader, nil
+}
+
+func (f *hfsFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (f *hfsFile) ReadAt(b []byte, off int64) (int, error) {
+	r, err := f.extentReader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(b, off)
+}
+
+func (f *hfsFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reader = nil
+	return nil
+}
+
+// hfsDir implements fs.File and fs.ReadDirFile for folders
+type hfsDir struct {
+	fs      *FS
+	entry   *catalogEntry
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *hfsDir) Stat() (fs.FileInfo, error) {
+	return &hfsFileInfo{entry: d.entry}, nil
+}
+
+func (d *hfsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: fs.ErrInvalid}
+}
+
+func (d *hfsDir) Close() error { return nil }
+
+// load reads the folder's entries from the catalog
+func (d *hfsDir) load() error {
+	if d.entries != nil {
+		return nil
+	}
+
+	var children []*catalogEntry
+	err := d.fs.children(d.entry.id(), func(_ []uint16, e *catalogEntry) bool {
+		if !hiddenName(e.parent, e.name) {
+			children = append(children, e)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	d.entries = make([]fs.DirEntry, 0, len(children))
+	for _, e := range children {
+		resolved, err := d.fs.resolveHardLink(e)
+		if err != nil {
+			return err
+		}
+		d.entries = append(d.entries, &hfsDirEntry{entry: resolved})
+	}
+	sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	return nil
+}
+
+func (d *hfsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	if n <= 0 {
+		entries := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return entries, nil
+	}
+
+	if d.offset >= len(d.entries) {
+		return nil, io.EOF
+	}
+
+	end := d.offset + n
+	if end > len(d.entries) {
+		end = len(d.entries)
+	}
+	entries := d.entries[d.offset:end]
+	d.offset = end
+	return entries, nil
+}
+
+// hfsDirEntry implements fs.DirEntry
+type hfsDirEntry struct {
+	entry *catalogEntry
+}
+
+func (e *hfsDirEntry) Name() string               { return e.entry.name }
+func (e *hfsDirEntry) IsDir() bool                { return e.entry.isDir() }
+func (e *hfsDirEntry) Type() fs.FileMode          { return e.info().Mode().Type() }
+func (e *hfsDirEntry) Info() (fs.FileInfo, error) { return e.info(), nil }
+func (e *hfsDirEntry) info() *hfsFileInfo         { return &hfsFileInfo{entry: e.entry} }
+
+// hfsFileInfo implements fs.FileInfo
+type hfsFileInfo struct {
+	entry *catalogEntry
+}
+
+func (i *hfsFileInfo) Name() string { return i.entry.name }
+func (i *hfsFileInfo) Size() int64 {
+	if i.entry.isDir() {
+		return 0
+	}
+	return int64(i.entry.dataFork().logicalSize)
+}
+func (i *hfsFileInfo) ModTime() time.Time    { return hfsTime(i.entry.modDate()) }
+func (i *hfsFileInfo) BirthTime() time.Time  { return hfsTime(i.entry.createDate()) }
+func (i *hfsFileInfo) AccessTime() time.Time { return hfsTime(i.entry.accessDate()) }
+func (i *hfsFileInfo) ChangeTime() time.Time { return hfsTime(i.entry.attributeModDate()) }
+func (i *hfsFileInfo) IsDir() bool           { return i.entry.isDir() }
+func (i *hfsFileInfo) Inode() uint64         { return uint64(i.entry.id()) }
+
+// Attributes is the HFS+ metadata of a file that fs.FileInfo has no place
+// for, returned by the Sys method of its FileInfo
+type Attributes struct {
+	CatalogID     uint32
+	BSDFlags      uint32    // chflags flags: the owner's, such as 0x02 immutable, in the low byte, the administrator's in the third
+	Type, Creator string    // Four-character codes of a file, such as "TEXT" and "ttxt"; empty for a folder or if unset
+	FinderFlags   uint16    // Such as 0x4000 invisible and 0x0400 custom icon
+	FinderInfo    [32]byte  // The Finder information as stored, the flags above included
+	BackupTime    time.Time // Zero if never backed up
+	TextEncoding  uint32    // Encoding of the name in classic Mac OS
+}
+
+// Sys returns the file's *Attributes, from its catalog record
+func (i *hfsFileInfo) Sys() any {
+	e := i.entry
+	a := &Attributes{
+		CatalogID:    e.id(),
+		BSDFlags:     uint32(e.adminFlags())<<16 | uint32(e.ownerFlags()),
+		FinderFlags:  binary.BigEndian.Uint16(e.rec[56:58]),
+		BackupTime:   hfsTime(e.backupDate()),
+		TextEncoding: binary.BigEndian.Uint32(e.rec[80:84]),
+	}
+	copy(a.FinderInfo[:], e.rec[48:80])
+	if !e.isDir() {
+		a.Type, a.Creator = fourCC(e.rec[48:52]), fourCC(e.rec[52:56])
+	}
+	return a
+}
+
+// fourCC returns a four-character code, "" if it is unset
+func fourCC(b []byte) string {
+	if binary.BigEndian.Uint32(b) == 0 {
+		return ""
+	}
+	return string(b)
+}
+
+func (i *hfsFileInfo) Owner() (user, group string) {
+	return strconv.FormatUint(uint64(i.entry.ownerID()), 10), strconv.FormatUint(uint64(i.entry.groupID()), 10)
+}
+
+// Mode returns the BSD mode from the catalog record; records written by
+// classic Mac OS carry none and get default permissions
+func (i *hfsFileInfo) Mode() fs.FileMode {
+	m := i.entry.fileMode()
+	if m&0xF000 == 0 {
+		if i.entry.isDir() {
+			return fs.ModeDir | 0755
+		}
+		return 0644
+	}
+
+	mode := fs.FileMode(m & 0777)
+	switch m & 0xF000 {
+	case 0x4000:
+		mode |= fs.ModeDir
+	case 0xA000:
+		mode |= fs.ModeSymlink
+	case 0x6000:
+		mode |= fs.ModeDevice
+	case 0x2000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x1000:
+		mode |= fs.ModeNamedPipe
+	case 0xC000:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
@@ -0,0 +1,266 @@
+package hfsplus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+func TestCompareNames(t *testing.T) {
+	hfs := &FS{catalog: &btree{}}
+	hfsx := &FS{catalog: &btree{compareType: keyCompareBinary}}
+
+	tests := []struct {
+		a, b     string
+		folded   int // sign of the HFS+ comparison
+		unfolded int // sign of the HFSX comparison
+	}{
+		{"hello.txt", "hello.txt", 0, 0},
+		{"Hello.TXT", "hello.txt", 0, -1},
+		{"a", "B", -1, 1},
+		{"abc", "ab", 1, 1},
+		{"a\u200db", "ab", 0, 1},
+		{"\x00\x00\x00\x00HFS+ Private Data", "zzz", 1, -1},
+	}
+	sign := func(c int) int {
+		switch {
+		case c < 0:
+			return -1
+		case c > 0:
+			return 1
+		}
+		return 0
+	}
+	for _, tt := range tests {
+		a, b := utf16.Encode([]rune(tt.a)), utf16.Encode([]rune(tt.b))
+		if got := sign(hfs.compareNames(a, b)); got != tt.folded {
+			t.Errorf("HFS+ compareNames(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.folded)
+		}
+		if got := sign(hfsx.compareNames(a, b)); got != tt.unfolded {
+			t.Errorf("HFSX compareNames(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.unfolded)
+		}
+	}
+}
+
+func TestNameSlashes(t *testing.T) {
+	stored := utf16.Encode([]rune("a/b"))
+	if got := decodeName(stored); got != "a:b" {
+		t.Errorf("decodeName = %q, want %q", got, "a:b")
+	}
+	if got := string(utf16.Decode(encodeName("a:b"))); got != "a/b" {
+		t.Errorf("encodeName = %q, want %q", got, "a/b")
+	}
+}
+
+// journalImage builds a journal at offset 0 of an 8 KiB image holding
+// the given block lists, the first one starting at start. Each block list
+// holds one 512-byte block for every entry of its bnum list.
+func journalImage(order binary.ByteOrder, start int64, lists [][]uint64, flags []uint32) *journal {
+	const size, jhdrSize, blhdrSize = 8192, 512, 512
+	image := make([]byte, size)
+	j := &journal{r: bytes.NewReader(image), size: size, start: start, end: start,
+		blhdrSize: blhdrSize, jhdrSize: jhdrSize, order: order}
+
+	write := func(b []byte) {
+		for _, c := range b {
+			image[j.end] = c
+			if j.end++; j.end == size {
+				j.end = jhdrSize
+			}
+		}
+	}
+	for i, bnums := range lists {
+		hdr := make([]byte, blhdrSize)
+		order.PutUint16(hdr[2:4], uint16(len(bnums)+1))
+		order.PutUint32(hdr[4:8], uint32(blhdrSize+512*len(bnums)))
+		order.PutUint32(hdr[28:32], flags[i])
+		for k, bnum := range bnums {
+			order.PutUint64(hdr[32+16*k:], bnum)
+			order.PutUint32(hdr[40+16*k:], 512)
+		}
+		order.PutUint32(hdr[8:12], journalChecksum(hdr[:blockListChecksumSize]))
+		write(hdr)
+		for _, bnum := range bnums {
+			write(bytes.Repeat([]byte{byte(bnum)}, 512))
+		}
+	}
+	return j
+}
+
+func TestJournalTransactions(t *testing.T) {
+	// Three block lists from 6144 wrap around the end of the buffer; the
+	// second continues the first transaction and holds a killed block
+	j := journalImage(binary.LittleEndian, 6144,
+		[][]uint64{{2, 3}, {killedBlock, 4}, {5}},
+		[]uint32{blockListFirstHeader, 0, blockListFirstHeader})
+
+	txns, err := j.transactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]int64
+	for _, txn := range txns {
+		var targets []int64
+		for _, b := range txn.Blocks {
+			if len(b.Data) != 512 || b.Data[0] != byte(b.Target/512) || b.Data[511] != byte(b.Target/512) {
+				t.Errorf("block for %d has wrong data", b.Target)
+			}
+			targets = append(targets, b.Target)
+		}
+		got = append(got, targets)
+	}
+	want := [][]int64{{1024, 1536, 2048}, {2560}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transactions = %v, want %v", got, want)
+	}
+
+	// Without first-header flags every block list is a transaction
+	j = journalImage(binary.BigEndian, 512, [][]uint64{{2}, {3}}, []uint32{0, 0})
+	if txns, err = j.transactions(); err != nil || len(txns) != 2 {
+		t.Errorf("unflagged journal: %d transactions, %v; want 2", len(txns), err)
+	}
+}
+
+// attrRecord builds a leaf record of the attributes file
+func attrRecord(fileID, startBlock uint32, name string, val []byte) []byte {
+	n := utf16.Encode([]rune(name))
+	rec := binary.BigEndian.AppendUint16(nil, uint16(12+2*len(n)))
+	rec = binary.BigEndian.AppendUint16(rec, 0)
+	rec = binary.BigEndian.AppendUint32(rec, fileID)
+	rec = binary.BigEndian.AppendUint32(rec, startBlock)
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(n)))
+	for _, c := range n {
+		rec = binary.BigEndian.AppendUint16(rec, c)
+	}
+	return append(rec, val...)
+}
+
+func TestXattrs(t *testing.T) {
+	const blockSize = 512
+	img := make([]byte, 8*blockSize)
+	copy(img[4*blockSize:], bytes.Repeat([]byte{'a'}, blockSize))
+	copy(img[6*blockSize:], bytes.Repeat([]byte{'b'}, blockSize))
+
+	// A value inline, and one in a fork of two blocks, the second in an
+	// extents record
+	inline := binary.BigEndian.AppendUint32(make([]byte, 12), 5)
+	binary.BigEndian.PutUint32(inline, attrInlineData)
+	inline = append(inline, "hello"...)
+	fork := make([]byte, 88)
+	binary.BigEndian.PutUint32(fork, attrForkData)
+	binary.BigEndian.PutUint64(fork[8:], 600)
+	binary.BigEndian.PutUint32(fork[20:], 2)
+	binary.BigEndian.PutUint32(fork[24:], 4)
+	binary.BigEndian.PutUint32(fork[28:], 1)
+	more := make([]byte, 72)
+	binary.BigEndian.PutUint32(more, attrExtents)
+	binary.BigEndian.PutUint32(more[8:], 6)
+	binary.BigEndian.PutUint32(more[12:], 1)
+	records := [][]byte{
+		attrRecord(20, 0, "user.other", inline),
+		attrRecord(21, 0, "com.apple.quarantine", inline),
+		attrRecord(21, 0, "user.big", fork),
+		attrRecord(21, 1, "user.big", more),
+		attrRecord(22, 0, "user.other", inline),
+	}
+
+	tree := make([]byte, 2*blockSize)
+	leaf := tree[blockSize:]
+	leaf[8], leaf[9] = 0xFF, 1 // Leaf node at height 1
+	binary.BigEndian.PutUint16(leaf[10:], uint16(len(records)))
+	off := nodeDescriptorSize
+	for i, rec := range records {
+		binary.BigEndian.PutUint16(leaf[blockSize-2*(i+1):], uint16(off))
+		off += copy(leaf[off:], rec)
+	}
+	binary.BigEndian.PutUint16(leaf[blockSize-2*(len(records)+1):], uint16(off))
+
+	f := &FS{r: bytes.NewReader(img), blockSize: blockSize, attributes: &btree{
+		name: "attributes file", r: bytes.NewReader(tree), nodeSize: blockSize, root: 1, totalNodes: 2,
+	}}
+	rec := make([]byte, fileRecordSize)
+	binary.BigEndian.PutUint16(rec, recFile)
+	binary.BigEndian.PutUint32(rec[8:], 21)
+	copy(rec[48:], "TEXTttxt")
+
+	attrs, err := f.xattrs(&catalogEntry{name: "f", rec: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"com.apple.FinderInfo": "TEXTttxt" + string(make([]byte, 24)),
+		"com.apple.quarantine": "hello",
+		"user.big":             strings.Repeat("a", 512) + strings.Repeat("b", 88),
+	}
+	if len(attrs) != len(want) {
+		t.Errorf("got %d attributes, want %d", len(attrs), len(want))
+	}
+	for name, value := range want {
+		read, ok := attrs[name]
+		if !ok {
+			t.Errorf("no %s", name)
+			continue
+		}
+		if got, err := read(); err != nil || string(got) != value {
+			t.Errorf("%s = %.20q (%d bytes), %v", name, got, len(got), err)
+		}
+	}
+}
+
+func TestFreeBlocks(t *testing.T) {
+	const blockSize, totalBlocks = 512, 5000
+	// The allocation file's 625 bytes are in blocks 20 and 10, in that
+	// order, so the bitmap is read in two pieces from two extents
+	img := make([]byte, 32*blockSize)
+	alloc := func(from, to int) {
+		for b := from; b < to; b++ {
+			i := b / 8
+			if i < blockSize {
+				i += 20 * blockSize
+			} else {
+				i += 10*blockSize - blockSize
+			}
+			img[i] |= 0x80 >> (b % 8)
+		}
+	}
+	alloc(0, 30)
+	alloc(100, 101)
+	alloc(4096, 4100)
+	// Bits past the last block are ignored
+	alloc(totalBlocks, 5120)
+
+	f := &FS{r: bytes.NewReader(img), blockSize: blockSize, totalBlocks: totalBlocks, allocationFile: forkData{
+		logicalSize: 625, totalBlocks: 2, extents: []extentDescriptor{{20, 1}, {10, 1}},
+	}}
+	free, err := f.FreeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fsys.Range{
+		{Start: 30 * blockSize, End: 100 * blockSize},
+		{Start: 101 * blockSize, End: 4096 * blockSize},
+		{Start: 4100 * blockSize, End: totalBlocks * blockSize},
+	}
+	if !slices.Equal(free, want) {
+		t.Errorf("FreeBlocks = %v, want %v", free, want)
+	}
+
+	// An allocation file short of a bit per block, or needing overflow
+	// extents with no extents file
+	f.allocationFile.logicalSize = 600
+	if _, err := f.FreeBlocks(); err == nil {
+		t.Error("FreeBlocks with a short allocation file succeeded")
+	}
+	f.allocationFile = forkData{logicalSize: 625, totalBlocks: 2, extents: []extentDescriptor{{20, 1}}}
+	var corrupt *fsys.ErrCorruptMetadata
+	if _, err := f.FreeBlocks(); !errors.As(err, &corrupt) {
+		t.Errorf("FreeBlocks with unmapped allocation blocks = %v, want a corrupt metadata error", err)
+	}
+}
@@ -3,15 +3,21 @@ package ntfs
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/fs"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf16"
 
+	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
 )
 
@@ -35,14 +41,37 @@ const (
 	attrIndexAllocation = 0xA0
 	attrBitmap          = 0xB0
 	attrReparsePoint    = 0xC0
+	attrEA              = 0xE0
 	attrEnd             = 0xFFFFFFFF
 
+	// Reparse point tags of links
+	reparseTagMountPoint = 0xA0000003 // Junction
+	reparseTagSymlink    = 0xA000000C
+
+	fileAttrReparsePoint = 0x400
+
+	// $VOLUME_INFORMATION flag Windows sets while the volume is mounted
+	volumeIsDirty = 0x0001
+
+	// $LogFile restart area: the flag a clean shutdown leaves, and the
+	// client list index meaning no client has the log open
+	restartVolumeIsClean = 0x0002
+	logFileNoClient      = 0xFFFF
+
+	// Attribute flags
+	attrFlagCompressed = 0x00FF
+	attrFlagEncrypted  = 0x4000
+
 	// File name types
 	fileNamePOSIX = 0
 	fileNameWin32 = 1
 	fileNameDOS   = 2
 	fileNameBoth  = 3
 
+	// Index entry flags
+	indexEntrySubnode = 0x01 // Ends with the VCN of the index block of the entries before it
+	indexEntryLast    = 0x02 // Ends a node, with no file name
+
 	// Special MFT entries
 	mftRecordMFT     = 0
 	mftRecordMFTMirr = 1
@@ -60,7 +89,8 @@ const (
 
 // FS implements a read-only NTFS filesystem
 type FS struct {
-	r               io.ReaderAt
+	r               io.ReaderAt // The image, through the block cache
+	base            io.ReaderAt
 	size            int64
 	bytesPerSector  uint16
 	sectorsPerCluster uint8
@@ -68,8 +98,22 @@ type FS struct {
 	mftRecordSize   int32
 	indexRecordSize int32
 	clusterSize     int
-	mftData         []byte
-	mftLoaded       bool
+
+	// The MFT and $Secure are loaded on first use, each under its mutex;
+	// mftData is set before mftLoaded and not changed after
+	mftMu        sync.Mutex
+	mftData      []byte
+	mftExtents   []fsys.Extent // Where the MFT is in the image
+	mftLoaded    atomic.Bool
+	secureMu     sync.Mutex
+	secure       map[uint32][]byte // Security descriptors in $Secure by ID
+	secureLoaded bool
+
+	records *recordCache // MFT records parsed, with their attributes
+}
+
+func init() {
+	fsys.Register(detect.NTFS, Open)
 }
 
 // Open opens an NTFS filesystem from the given reader
@@ -79,24 +123,59 @@ func Open(r io.ReaderAt, size int64) (fsys.FS, error) {
 		return nil, fmt.Errorf("reading boot sector: %w", err)
 	}
 
-	// Check NTFS signature
+	// Check NTFS signature, falling back to the backup boot sector
+	offset := int64(0)
 	if !bytes.Equal(header[3:11], []byte(ntfsMagic)) {
-		return nil, nil // Not NTFS
+		if header = backupBootSector(r, size); header == nil {
+			return nil, nil // Not NTFS
+		}
+		offset = size - int64(binary.LittleEndian.Uint16(header[0x0B:0x0D]))
 	}
 
-	fs := &FS{r: r, size: size}
-	if err := fs.parseBootSector(header); err != nil {
+	fs := &FS{r: fsys.NewCachedReaderAt(r), base: r, size: size, records: newRecordCache(recordCacheSize)}
+	if err := fs.parseBootSector(header, offset); err != nil {
 		return nil, err
 	}
 
 	return fs, nil
 }
 
-func (f *FS) parseBootSector(header []byte) error {
+// backupBootSector returns the copy of the boot sector NTFS keeps in the
+// last sector of the volume, or nil if there is none. The sector size is
+// unknown when the primary is damaged, so each one is tried.
+func backupBootSector(r io.ReaderAt, size int64) []byte {
+	header := make([]byte, 512)
+	for ss := int64(512); ss <= 4096 && ss <= size; ss *= 2 {
+		if _, err := r.ReadAt(header, size-ss); err != nil {
+			continue
+		}
+		if bytes.Equal(header[3:11], []byte(ntfsMagic)) && int64(binary.LittleEndian.Uint16(header[0x0B:0x0D])) == ss {
+			return header
+		}
+	}
+	return nil
+}
+
+// parseBootSector decodes the boot sector read from offset
+func (f *FS) parseBootSector(header []byte, offset int64) error {
 	f.bytesPerSector = binary.LittleEndian.Uint16(header[0x0B:0x0D])
 	f.sectorsPerCluster = header[0x0D]
 	f.mftCluster = binary.LittleEndian.Uint64(header[0x30:0x38])
 
+	if ss := f.bytesPerSector; ss < 256 || ss > 4096 || ss&(ss-1) != 0 {
+		return fsys.Corrupt("boot sector", offset, "invalid sector size %d", ss)
+	}
+	if spc := f.sectorsPerCluster; spc == 0 || spc&(spc-1) != 0 {
+		return fsys.Corrupt("boot sector", offset, "invalid sectors per cluster %d", spc)
+	}
+	validSize := func(b byte) bool {
+		size := int8(b)
+		return size > 0 || size <= -8 && size >= -16 // 256 bytes to 64 KiB
+	}
+	if !validSize(header[0x40]) || !validSize(header[0x44]) {
+		return fsys.Corrupt("boot sector", offset, "invalid MFT or index record size")
+	}
+
 	// MFT record size
 	mftRecordSizeByte := int8(header[0x40])
 	if mftRecordSizeByte > 0 {
@@ -120,7 +199,77 @@ func (f *FS) parseBootSector(header []byte) error {
 
 func (f *FS) Type() string  { return "NTFS" }
 func (f *FS) Close() error  { return nil }
-func (f *FS) BaseReader() io.ReaderAt { return f.r }
+func (f *FS) BaseReader() io.ReaderAt { return f.base }
+
+// Label returns the volume name, kept in the $Volume file
+func (f *FS) Label() string {
+	name, err := f.unnamedAttribute(mftRecordVolume, attrVolumeName)
+	if err != nil || len(name) < 2 {
+		return ""
+	}
+	chars := make([]uint16, len(name)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(name[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
+
+// BlockSize implements fsys.BlockSizer with the cluster size
+func (f *FS) BlockSize() int64 { return int64(f.clusterSize) }
+
+// NeedsRecovery implements fsys.Recoverer. Windows marks the volume dirty
+// in $Volume while it is mounted, and the restart area of $LogFile clean
+// when it was shut down with nothing left in the log to redo.
+func (f *FS) NeedsRecovery() (bool, error) {
+	if err := f.loadMFT(); err != nil {
+		return false, fmt.Errorf("loading MFT: %w", err)
+	}
+	info, err := f.unnamedAttribute(mftRecordVolume, attrVolumeInfo)
+	if err != nil {
+		return false, fmt.Errorf("reading $Volume: %w", err)
+	}
+	if len(info) >= 12 && binary.LittleEndian.Uint16(info[10:12])&volumeIsDirty != 0 {
+		return true, nil
+	}
+
+	rec, err := f.readMFTRecord(mftRecordLogFile)
+	if err != nil {
+		return false, fmt.Errorf("reading $LogFile: %w", err)
+	}
+	attrs, err := f.parseAttributes(rec)
+	if err != nil {
+		return false, err
+	}
+	var extents []fsys.Extent
+	for _, attr := range attrs {
+		if attr.attrType == attrData && attr.name == "" {
+			if extents, err = f.dataRunsToExtents(attr); err != nil {
+				return false, fmt.Errorf("$LogFile: %w", err)
+			}
+			break
+		}
+	}
+	if len(extents) == 0 {
+		return false, fsys.Corrupt("$LogFile", f.recordOffset(mftRecordLogFile), "no data")
+	}
+
+	// The fields needed are in the first sector of the restart page, clear
+	// of the words the fixup array replaces
+	page := make([]byte, 512)
+	if _, err := f.r.ReadAt(page, extents[0].Physical); err != nil {
+		return false, fmt.Errorf("reading $LogFile: %w", err)
+	}
+	if string(page[0:4]) != "RSTR" {
+		return false, nil // Emptied by chkdsk or never used
+	}
+	area := int(binary.LittleEndian.Uint16(page[0x18:0x1A]))
+	if area+0x10 > len(page)-2 {
+		return false, fsys.Corrupt("$LogFile restart page", extents[0].Physical, "restart area at %d", area)
+	}
+	inUse := binary.LittleEndian.Uint16(page[area+0x0C:])
+	flags := binary.LittleEndian.Uint16(page[area+0x0E:])
+	return inUse != logFileNoClient && flags&restartVolumeIsClean == 0, nil
+}
 
 // FreeBlocks returns the list of free byte ranges in the NTFS filesystem.
 // Free clusters are identified by 0 bits in the $Bitmap file.
@@ -242,36 +391,49 @@ func (f *FS) dataRunsToExtents(attr attribute) ([]fsys.Extent, error) {
 		// that the file is too small / inline
 		return nil, fmt.Errorf("file data is resident in MFT (inline storage)")
 	}
+	if attr.flags&attrFlagEncrypted != 0 {
+		return nil, fmt.Errorf("EFS: %w", fsys.ErrEncrypted)
+	}
+	if attr.flags&attrFlagCompressed != 0 {
+		return nil, fsys.Unsupported("NTFS compression")
+	}
 
+	// Sparse runs are left as holes, and the part of the data beyond the
+	// initialized size, which reads as zeros, is marked Zero
 	var extents []fsys.Extent
 	clusterSize := int64(f.clusterSize)
 	logicalOffset := int64(0)
 	fileSize := int64(attr.realSize)
-	remaining := fileSize
+	initSize := min(int64(attr.initSize), fileSize)
 
 	for _, run := range attr.dataRuns {
-		if run.sparse {
-			// Sparse run - no physical location, just advance logical offset
-			logicalOffset += int64(run.length) * clusterSize
-			continue
-		}
-
-		runBytes := int64(run.length) * clusterSize
-		if runBytes > remaining {
-			runBytes = remaining
-		}
-
-		extents = append(extents, fsys.Extent{
-			Logical:  logicalOffset,
-			Physical: int64(run.offset) * clusterSize,
-			Length:   runBytes,
-		})
-
-		logicalOffset += int64(run.length) * clusterSize
-		remaining -= runBytes
-		if remaining <= 0 {
+		if logicalOffset >= fileSize {
 			break
 		}
+		runBytes := min(int64(run.length)*clusterSize, fileSize-logicalOffset)
+		if !run.sparse {
+			physical := int64(run.offset) * clusterSize
+			if logicalOffset < initSize {
+				n := min(runBytes, initSize-logicalOffset)
+				extents = append(extents, fsys.Extent{
+					Logical:  logicalOffset,
+					Physical: physical,
+					Length:   n,
+				})
+				logicalOffset += n
+				physical += n
+				runBytes -= n
+			}
+			if runBytes > 0 {
+				extents = append(extents, fsys.Extent{
+					Logical:  logicalOffset,
+					Physical: physical,
+					Length:   runBytes,
+					Zero:     true,
+				})
+			}
+		}
+		logicalOffset += runBytes
 	}
 
 	return extents, nil
@@ -306,6 +468,56 @@ type mftRecord struct {
 	nextAttrID    uint16
 	recordNumber  uint32
 	data          []byte
+
+	attrsOnce sync.Once
+	attrs     []attribute // Parsed by the first parseAttributes
+}
+
+// recordCacheSize is how many parsed MFT records an FS keeps, so that
+// walking a tree does not parse a directory's record for every file in it
+const recordCacheSize = 4096
+
+// recordCache keeps the MFT records last read, evicting the least
+// recently used first
+type recordCache struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List // Of *mftRecord, most recently used first
+	records map[uint64]*list.Element
+}
+
+func newRecordCache(max int) *recordCache {
+	return &recordCache{max: max, lru: list.New(), records: make(map[uint64]*list.Element)}
+}
+
+// get returns a record if it is in the cache
+func (c *recordCache) get(recordNum uint64) (*mftRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.records[recordNum]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*mftRecord), true
+}
+
+// add puts a record in the cache, returning the one there already if
+// another read got to it first
+func (c *recordCache) add(rec *mftRecord) *mftRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recordNum := uint64(rec.recordNumber)
+	if e, ok := c.records[recordNum]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*mftRecord)
+	}
+	c.records[recordNum] = c.lru.PushFront(rec)
+	for c.lru.Len() > c.max {
+		old := c.lru.Remove(c.lru.Back()).(*mftRecord)
+		delete(c.records, uint64(old.recordNumber))
+	}
+	return rec
 }
 
 // attribute represents an NTFS attribute
@@ -340,7 +552,7 @@ type dataRun struct {
 
 func (f *FS) readMFTRecord(recordNum uint64) (*mftRecord, error) {
 	// For record 0, read directly from mftCluster
-	if recordNum == 0 || !f.mftLoaded {
+	if recordNum == 0 || !f.mftLoaded.Load() {
 		offset := f.clusterOffset(f.mftCluster) + int64(recordNum)*int64(f.mftRecordSize)
 		data := make([]byte, f.mftRecordSize)
 		if _, err := f.r.ReadAt(data, offset); err != nil {
@@ -349,17 +561,25 @@ func (f *FS) readMFTRecord(recordNum uint64) (*mftRecord, error) {
 		return f.parseMFTRecord(data, recordNum)
 	}
 
-	// For other records, use MFT data
+	// For other records, use MFT data, through the cache
+	if rec, ok := f.records.get(recordNum); ok {
+		return rec, nil
+	}
 	offset := int64(recordNum) * int64(f.mftRecordSize)
 	if offset+int64(f.mftRecordSize) > int64(len(f.mftData)) {
-		return nil, fmt.Errorf("MFT record %d out of range", recordNum)
+		return nil, fsys.Corrupt(fmt.Sprintf("MFT record number %d", recordNum), -1, "past the end of the MFT (%d records)", len(f.mftData)/int(f.mftRecordSize))
+	}
+	rec, err := f.parseMFTRecord(f.mftData[offset:offset+int64(f.mftRecordSize)], recordNum)
+	if err != nil {
+		return nil, err
 	}
-	return f.parseMFTRecord(f.mftData[offset:offset+int64(f.mftRecordSize)], recordNum)
+	return f.records.add(rec), nil
 }
 
 func (f *FS) parseMFTRecord(data []byte, recordNum uint64) (*mftRecord, error) {
+	structure := fmt.Sprintf("MFT record %d", recordNum)
 	if len(data) < 42 {
-		return nil, fmt.Errorf("MFT record too small")
+		return nil, fsys.Corrupt(structure, f.recordOffset(recordNum), "too small")
 	}
 
 	rec := &mftRecord{
@@ -380,7 +600,7 @@ func (f *FS) parseMFTRecord(data []byte, recordNum uint64) (*mftRecord, error) {
 
 	// Check signature
 	if string(rec.signature[:]) != "FILE" {
-		return nil, fmt.Errorf("invalid MFT record signature: %q", rec.signature)
+		return nil, fsys.Corrupt(structure, f.recordOffset(recordNum), "invalid signature %q", rec.signature)
 	}
 
 	// Apply fixup array
@@ -388,12 +608,27 @@ func (f *FS) parseMFTRecord(data []byte, recordNum uint64) (*mftRecord, error) {
 	copy(rec.data, data)
 
 	if err := f.applyFixup(rec.data, rec.usaOffset, rec.usaCount); err != nil {
-		return nil, err
+		return nil, fsys.Corrupt(structure, f.recordOffset(recordNum), "%w", err)
 	}
 
 	return rec, nil
 }
 
+// recordOffset returns where an MFT record is in the image, or -1 if the
+// MFT does not map it
+func (f *FS) recordOffset(recordNum uint64) int64 {
+	logical := int64(recordNum) * int64(f.mftRecordSize)
+	if recordNum == 0 || !f.mftLoaded.Load() {
+		return f.clusterOffset(f.mftCluster) + logical
+	}
+	for _, e := range f.mftExtents {
+		if logical >= e.Logical && logical < e.Logical+e.Length {
+			return e.Physical + logical - e.Logical
+		}
+	}
+	return -1
+}
+
 func (f *FS) applyFixup(data []byte, usaOffset, usaCount uint16) error {
 	if usaCount < 2 {
 		return nil
@@ -423,7 +658,14 @@ func (f *FS) applyFixup(data []byte, usaOffset, usaCount uint16) error {
 	return nil
 }
 
+// parseAttributes returns the attributes of a record, parsed on the first
+// call. They are shared by every reader of the record and not changed.
 func (f *FS) parseAttributes(rec *mftRecord) ([]attribute, error) {
+	rec.attrsOnce.Do(func() { rec.attrs = f.parseRecordAttributes(rec) })
+	return rec.attrs, nil
+}
+
+func (f *FS) parseRecordAttributes(rec *mftRecord) []attribute {
 	var attrs []attribute
 	offset := int(rec.attrOffset)
 
@@ -495,7 +737,7 @@ func (f *FS) parseAttributes(rec *mftRecord) ([]attribute, error) {
 		offset += int(length)
 	}
 
-	return attrs, nil
+	return attrs
 }
 
 func (f *FS) parseDataRuns(data []byte) []dataRun {
@@ -551,9 +793,15 @@ func (f *FS) parseDataRuns(data []byte) []dataRun {
 }
 
 func (f *FS) readAttributeData(attr *attribute) ([]byte, error) {
+	if attr.flags&attrFlagEncrypted != 0 {
+		return nil, fmt.Errorf("EFS: %w", fsys.ErrEncrypted)
+	}
 	if !attr.nonResident {
 		return attr.value, nil
 	}
+	if attr.flags&attrFlagCompressed != 0 {
+		return nil, fsys.Unsupported("NTFS compression")
+	}
 
 	var data []byte
 	for _, run := range attr.dataRuns {
@@ -574,13 +822,19 @@ func (f *FS) readAttributeData(attr *attribute) ([]byte, error) {
 	if uint64(len(data)) > attr.realSize {
 		data = data[:attr.realSize]
 	}
+	// Past the initialized size the data reads as zeros
+	if attr.initSize < uint64(len(data)) {
+		clear(data[attr.initSize:])
+	}
 
 	return data, nil
 }
 
 // loadMFT loads the entire MFT into memory for faster access
 func (f *FS) loadMFT() error {
-	if f.mftLoaded {
+	f.mftMu.Lock()
+	defer f.mftMu.Unlock()
+	if f.mftLoaded.Load() {
 		return nil
 	}
 
@@ -600,17 +854,525 @@ func (f *FS) loadMFT() error {
 			if err != nil {
 				return err
 			}
-			f.mftLoaded = true
+			f.mftExtents, _ = f.dataRunsToExtents(attr)
+			f.mftLoaded.Store(true)
 			return nil
 		}
 	}
 
-	return fmt.Errorf("MFT $DATA attribute not found")
+	return fsys.Corrupt("MFT record 0", f.recordOffset(0), "no $DATA attribute")
+}
+
+// Check verifies the consistency of the metadata. It compares the boot
+// sector with its backup at the end of the volume and the start of the MFT
+// with $MFTMirr, then checks the signature and update sequence (fixups) of
+// every MFT record, and that the records in use are marked in the $MFT
+// bitmap.
+func (f *FS) Check() ([]fsys.Problem, error) {
+	if err := f.loadMFT(); err != nil {
+		return nil, fmt.Errorf("loading MFT: %w", err)
+	}
+
+	var problems []fsys.Problem
+	report := func(kind, format string, args ...any) {
+		problems = append(problems, fsys.Problem{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	boot := make([]byte, 512)
+	if _, err := f.r.ReadAt(boot, 0); err != nil {
+		return nil, fmt.Errorf("reading boot sector: %w", err)
+	}
+	if backup := backupBootSector(f.r, f.size); backup == nil {
+		report("boot-sector", "no backup boot sector at the end of the volume")
+	} else if !bytes.Equal(boot, backup) {
+		report("boot-sector", "boot sector differs from its backup at the end of the volume")
+	}
+
+	mirror, err := f.unnamedAttribute(mftRecordMFTMirr, attrData)
+	if err != nil {
+		report("mft-mirror", "reading $MFTMirr: %v", err)
+	} else if n := min(len(mirror), len(f.mftData)); !bytes.Equal(mirror[:n], f.mftData[:n]) {
+		for i := 0; i < n; i += int(f.mftRecordSize) {
+			end := min(i+int(f.mftRecordSize), n)
+			if !bytes.Equal(mirror[i:end], f.mftData[i:end]) {
+				report("mft-mirror", "MFT record %d differs from its copy in $MFTMirr", i/int(f.mftRecordSize))
+			}
+		}
+	}
+
+	bitmap, err := f.unnamedAttribute(mftRecordMFT, attrBitmap)
+	if err != nil {
+		report("mft-bitmap", "reading the $MFT bitmap: %v", err)
+	}
+
+	size := int(f.mftRecordSize)
+	for num := 0; (num+1)*size <= len(f.mftData); num++ {
+		data := f.mftData[num*size : (num+1)*size]
+		switch string(data[0:4]) {
+		case "FILE":
+		case "BAAD":
+			report("bad-record", "MFT record %d is marked bad", num)
+			continue
+		default:
+			continue // Never used
+		}
+
+		usaOffset := binary.LittleEndian.Uint16(data[4:6])
+		usaCount := binary.LittleEndian.Uint16(data[6:8])
+		if err := f.applyFixup(bytes.Clone(data), usaOffset, usaCount); err != nil {
+			report("fixup", "MFT record %d: %v", num, err)
+		}
+		// NTFS 3.1 records, whose update sequence follows the field, store
+		// their own number
+		if usaOffset >= 0x30 {
+			if stored := binary.LittleEndian.Uint32(data[0x2C:0x30]); stored != uint32(num) {
+				report("record-number", "MFT record %d says it is record %d", num, stored)
+			}
+		}
+
+		inUse := binary.LittleEndian.Uint16(data[22:24])&mftFlagInUse != 0
+		if inUse && bitmap != nil && (num/8 >= len(bitmap) || bitmap[num/8]&(1<<(num%8)) == 0) {
+			report("mft-bitmap", "MFT record %d is in use but free in the $MFT bitmap", num)
+		}
+	}
+
+	return problems, nil
+}
+
+// Deleted implements fsys.DeletedLister. The MFT record of a deleted file
+// is marked free but keeps its attributes, runs and all, until it is used
+// again. Paths are built from the parent references of the $FILE_NAMEs, as
+// far as the parents are still the directories referred to. The ID of a
+// file is its record number.
+func (f *FS) Deleted() ([]fsys.DeletedEntry, error) {
+	if err := f.loadMFT(); err != nil {
+		return nil, fmt.Errorf("loading MFT: %w", err)
+	}
+	free, err := f.FreeBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []fsys.DeletedEntry
+	dirs := make(map[uint64]string) // Paths of the parents named so far
+	size := int(f.mftRecordSize)
+	for num := 0; (num+1)*size <= len(f.mftData); num++ {
+		data := f.mftData[num*size : (num+1)*size]
+		if string(data[0:4]) != "FILE" || binary.LittleEndian.Uint16(data[22:24])&mftFlagInUse != 0 ||
+			binary.LittleEndian.Uint64(data[32:40]) != 0 {
+			continue // Never used, in use, or an extension of another record
+		}
+		rec, err := f.parseMFTRecord(data, uint64(num))
+		if err != nil {
+			continue
+		}
+		if e, ok := f.deletedEntry(rec, free, dirs); ok {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+// deletedEntry describes a deleted file from its MFT record, if it has a
+// name. Resident data is as safe as the record itself.
+func (f *FS) deletedEntry(rec *mftRecord, free []fsys.Range, dirs map[uint64]string) (fsys.DeletedEntry, bool) {
+	fn, ok := f.recordFileName(rec)
+	if !ok {
+		return fsys.DeletedEntry{}, false
+	}
+	e := fsys.DeletedEntry{
+		ID:         strconv.FormatUint(uint64(rec.recordNumber), 10),
+		Path:       path.Join(f.parentPath(fn, dirs, 0), fn.name),
+		IsDir:      rec.flags&mftFlagDirectory != 0,
+		ModTime:    fn.modTime,
+		AccessTime: fn.accessTime,
+		BirthTime:  fn.creationTime,
+		Confidence: fsys.ConfidenceHigh,
+	}
+	attrs, _ := f.parseAttributes(rec)
+	for _, attr := range attrs {
+		switch {
+		case attr.attrType == attrStandardInfo && !attr.nonResident && len(attr.value) >= 32:
+			e.BirthTime = windowsFileTimeToTime(binary.LittleEndian.Uint64(attr.value[0:8]))
+			e.ModTime = windowsFileTimeToTime(binary.LittleEndian.Uint64(attr.value[8:16]))
+			e.AccessTime = windowsFileTimeToTime(binary.LittleEndian.Uint64(attr.value[24:32]))
+		case attr.attrType == attrData && attr.name == "" && !attr.nonResident:
+			e.Size = int64(attr.valueLength)
+		case attr.attrType == attrData && attr.name == "" && attr.startVCN == 0:
+			e.Size = int64(attr.realSize)
+			e.Extents, _ = f.dataRunsToExtents(attr)
+			e.Confidence = fsys.RateDeleted(free, e.Extents, e.Size, false)
+		}
+	}
+	return e, true
+}
+
+// recordFileName returns the $FILE_NAME of a record with its long name
+func (f *FS) recordFileName(rec *mftRecord) (*fileNameAttr, bool) {
+	var found *fileNameAttr
+	attrs, _ := f.parseAttributes(rec)
+	for _, attr := range attrs {
+		if attr.attrType != attrFileName || attr.nonResident {
+			continue
+		}
+		if fn, err := parseFileNameAttr(attr.value); err == nil && (found == nil || found.nameType == fileNameDOS) {
+			found = fn
+		}
+	}
+	return found, found != nil
+}
+
+// parentPath returns the path of the directory a $FILE_NAME is in, "?" for
+// a parent that cannot be read or has been reused for another file. A
+// parent deleted since had its sequence number increased on deletion.
+func (f *FS) parentPath(fn *fileNameAttr, dirs map[uint64]string, depth int) string {
+	if fn.parentRef == mftRecordRoot {
+		return "."
+	}
+	if p, ok := dirs[fn.parentRef]; ok {
+		return p
+	}
+	p := "?"
+	rec, err := f.readMFTRecord(fn.parentRef)
+	if err == nil {
+		seq := fn.parentSeq
+		if rec.flags&mftFlagInUse == 0 {
+			seq++
+		}
+		if parent, ok := f.recordFileName(rec); ok && rec.sequenceNum == seq && rec.flags&mftFlagDirectory != 0 && depth < 256 {
+			p = path.Join(f.parentPath(parent, dirs, depth+1), parent.name)
+		}
+	}
+	dirs[fn.parentRef] = p
+	return p
+}
+
+// OpenDeleted implements fsys.DeletedLister, reading the unnamed $DATA of
+// the free MFT record id
+func (f *FS) OpenDeleted(id string) (fsys.ReaderAtCloser, int64, error) {
+	if err := f.loadMFT(); err != nil {
+		return nil, 0, fmt.Errorf("loading MFT: %w", err)
+	}
+	num, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("deleted record %q: %w", id, fs.ErrNotExist)
+	}
+	rec, err := f.readMFTRecord(num)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec.flags&mftFlagInUse != 0 {
+		return nil, 0, fmt.Errorf("deleted record %q: %w", id, fs.ErrNotExist)
+	}
+	attrs, _ := f.parseAttributes(rec)
+	for _, attr := range attrs {
+		if attr.attrType != attrData || attr.name != "" {
+			continue
+		}
+		if !attr.nonResident {
+			return fsys.DefaultBudget.ReadAll(bytes.NewReader(attr.value), int64(len(attr.value)))
+		}
+		extents, err := f.dataRunsToExtents(attr)
+		if err != nil {
+			return nil, 0, err
+		}
+		return fsys.NewExtentReaderAt(f.r, extents, int64(attr.realSize)), int64(attr.realSize), nil
+	}
+	return fsys.NewExtentReaderAt(f.r, nil, 0), 0, nil
+}
+
+// unnamedAttribute returns the contents of the unnamed attribute of the
+// given type in an MFT record
+func (f *FS) unnamedAttribute(recordNum uint64, attrType uint32) ([]byte, error) {
+	rec, err := f.readMFTRecord(recordNum)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := f.parseAttributes(rec)
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.attrType == attrType && attr.name == "" {
+			return f.readAttributeData(&attr)
+		}
+	}
+	return nil, fmt.Errorf("attribute %#x not found", attrType)
+}
+
+// securityDescriptor returns the security descriptor of an MFT record:
+// its own $SECURITY_DESCRIPTOR attribute on NTFS 1.x, or the one in
+// $Secure that $STANDARD_INFORMATION refers to by ID on NTFS 3.x
+func (f *FS) securityDescriptor(recordNum uint64) ([]byte, error) {
+	if sd, err := f.unnamedAttribute(recordNum, attrSecurityDesc); err == nil {
+		return sd, nil
+	}
+	si, err := f.unnamedAttribute(recordNum, attrStandardInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(si) < 0x38 {
+		return nil, fmt.Errorf("no security ID in $STANDARD_INFORMATION")
+	}
+	if err := f.loadSecure(); err != nil {
+		return nil, fmt.Errorf("loading $Secure: %w", err)
+	}
+	id := binary.LittleEndian.Uint32(si[0x34:0x38])
+	sd, ok := f.secure[id]
+	if !ok {
+		return nil, fmt.Errorf("security ID %d not in $Secure", id)
+	}
+	return sd, nil
+}
+
+// loadSecure reads the descriptors from the $SDS stream of $Secure. The
+// stream is made of 256 KiB blocks, each followed by a mirror copy, that
+// hold entries aligned to 16 bytes with a 20-byte header: hash, ID, offset
+// of the entry in the stream and length including the header.
+func (f *FS) loadSecure() error {
+	f.secureMu.Lock()
+	defer f.secureMu.Unlock()
+	if f.secureLoaded {
+		return nil
+	}
+	f.secureLoaded = true
+	f.secure = make(map[uint32][]byte)
+
+	rec, err := f.readMFTRecord(mftRecordSecure)
+	if err != nil {
+		return err
+	}
+	attrs, err := f.parseAttributes(rec)
+	if err != nil {
+		return err
+	}
+	var sds []byte
+	for _, attr := range attrs {
+		if attr.attrType == attrData && attr.name == "$SDS" {
+			if sds, err = f.readAttributeData(&attr); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	const blockSize = 0x40000
+	for base := 0; base < len(sds); base += 2 * blockSize {
+		end := min(base+blockSize, len(sds))
+		for pos := base; pos+20 <= end; {
+			id := binary.LittleEndian.Uint32(sds[pos+4 : pos+8])
+			offset := binary.LittleEndian.Uint64(sds[pos+8 : pos+16])
+			length := int(binary.LittleEndian.Uint32(sds[pos+16 : pos+20]))
+			if offset != uint64(pos) || length < 20 || pos+length > end {
+				break
+			}
+			f.secure[id] = sds[pos+20 : pos+length]
+			pos += (length + 15) &^ 15
+		}
+	}
+	return nil
+}
+
+// descriptorOwner returns the owner and group SIDs of a self-relative
+// security descriptor
+func descriptorOwner(sd []byte) (user, group string) {
+	if len(sd) < 20 {
+		return "", ""
+	}
+	sid := func(off uint32) string {
+		if off == 0 || int(off) >= len(sd) {
+			return ""
+		}
+		return formatSID(sd[off:])
+	}
+	return sid(binary.LittleEndian.Uint32(sd[4:8])), sid(binary.LittleEndian.Uint32(sd[8:12]))
+}
+
+// formatSID formats a binary SID as "S-1-5-21-...", or returns "" if b
+// does not hold one
+func formatSID(b []byte) string {
+	if len(b) < 8 || len(b) < 8+4*int(b[1]) {
+		return ""
+	}
+	var auth uint64
+	for _, c := range b[2:8] {
+		auth = auth<<8 | uint64(c)
+	}
+	s := fmt.Sprintf("S-%d-%d", b[0], auth)
+	for i := range int(b[1]) {
+		s += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return s
+}
+
+// Metadata returns the boot sector and, if record is not negative, that
+// MFT record with its attributes
+func (f *FS) Metadata(record int64) (any, error) {
+	header := make([]byte, 512)
+	if _, err := f.r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading boot sector: %w", err)
+	}
+	offset := int64(0)
+	if !bytes.Equal(header[3:11], []byte(ntfsMagic)) {
+		if header = backupBootSector(f.r, f.size); header == nil {
+			return nil, fmt.Errorf("no valid boot sector")
+		}
+		offset = f.size - int64(f.bytesPerSector)
+	}
+
+	m := metadata{BootSector: bootSectorMeta{
+		Offset:            offset,
+		OEMID:             string(header[3:11]),
+		BytesPerSector:    f.bytesPerSector,
+		SectorsPerCluster: f.sectorsPerCluster,
+		MediaDescriptor:   header[0x15],
+		TotalSectors:      binary.LittleEndian.Uint64(header[0x28:0x30]),
+		MFTCluster:        f.mftCluster,
+		MFTMirrCluster:    binary.LittleEndian.Uint64(header[0x38:0x40]),
+		MFTRecordSize:     f.mftRecordSize,
+		IndexRecordSize:   f.indexRecordSize,
+		SerialNumber:      fmt.Sprintf("%016X", binary.LittleEndian.Uint64(header[0x48:0x50])),
+	}}
+
+	if record >= 0 {
+		if err := f.loadMFT(); err != nil {
+			return nil, fmt.Errorf("loading MFT: %w", err)
+		}
+		rec, err := f.readMFTRecord(uint64(record))
+		if err != nil {
+			return nil, fmt.Errorf("reading MFT record %d: %w", record, err)
+		}
+		attrs, err := f.parseAttributes(rec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MFT record %d: %w", record, err)
+		}
+
+		rm := &mftRecordMeta{
+			Number:         uint64(record),
+			LSN:            rec.lsn,
+			SequenceNumber: rec.sequenceNum,
+			LinkCount:      rec.linkCount,
+			Flags:          rec.flags,
+			UsedSize:       rec.usedSize,
+			AllocatedSize:  rec.allocatedSize,
+			BaseRecord:     rec.baseRecord & 0x0000FFFFFFFFFFFF,
+			NextAttrID:     rec.nextAttrID,
+		}
+		for _, attr := range attrs {
+			am := attributeMeta{
+				Type:        attr.attrType,
+				TypeName:    attrTypeNames[attr.attrType],
+				Name:        attr.name,
+				NonResident: attr.nonResident,
+				Flags:       attr.flags,
+				ID:          attr.attrID,
+				Length:      attr.length,
+			}
+			if attr.nonResident {
+				am.StartVCN = attr.startVCN
+				am.EndVCN = attr.endVCN
+				am.AllocatedSize = attr.allocatedSize
+				am.RealSize = attr.realSize
+				am.InitializedSize = attr.initSize
+				for _, run := range attr.dataRuns {
+					am.Runs = append(am.Runs, runMeta{Length: run.length, LCN: run.offset, Sparse: run.sparse})
+				}
+			} else {
+				am.Value = fmt.Sprintf("%x", attr.value)
+			}
+			if attr.attrType == attrFileName && !attr.nonResident {
+				if fn, err := parseFileNameAttr(attr.value); err == nil {
+					am.FileName = fn.name
+					am.ParentRecord = fn.parentRef
+				}
+			}
+			rm.Attributes = append(rm.Attributes, am)
+		}
+		m.MFTRecord = rm
+	}
+
+	return m, nil
+}
+
+// attrTypeNames names the standard attribute types
+var attrTypeNames = map[uint32]string{
+	attrStandardInfo:    "$STANDARD_INFORMATION",
+	attrAttributeList:   "$ATTRIBUTE_LIST",
+	attrFileName:        "$FILE_NAME",
+	attrObjectID:        "$OBJECT_ID",
+	attrSecurityDesc:    "$SECURITY_DESCRIPTOR",
+	attrVolumeName:      "$VOLUME_NAME",
+	attrVolumeInfo:      "$VOLUME_INFORMATION",
+	attrData:            "$DATA",
+	attrIndexRoot:       "$INDEX_ROOT",
+	attrIndexAllocation: "$INDEX_ALLOCATION",
+	attrBitmap:          "$BITMAP",
+	attrReparsePoint:    "$REPARSE_POINT",
+	0x100:               "$LOGGED_UTILITY_STREAM",
+}
+
+// metadata is what Metadata returns
+type metadata struct {
+	BootSector bootSectorMeta `json:"bootSector"`
+	MFTRecord  *mftRecordMeta `json:"mftRecord,omitempty"`
+}
+
+type bootSectorMeta struct {
+	Offset            int64  `json:"offset"`
+	OEMID             string `json:"oemID"`
+	BytesPerSector    uint16 `json:"bytesPerSector"`
+	SectorsPerCluster uint8  `json:"sectorsPerCluster"`
+	MediaDescriptor   uint8  `json:"mediaDescriptor"`
+	TotalSectors      uint64 `json:"totalSectors"`
+	MFTCluster        uint64 `json:"mftCluster"`
+	MFTMirrCluster    uint64 `json:"mftMirrCluster"`
+	MFTRecordSize     int32  `json:"mftRecordSize"`
+	IndexRecordSize   int32  `json:"indexRecordSize"`
+	SerialNumber      string `json:"serialNumber"`
+}
+
+type mftRecordMeta struct {
+	Number         uint64          `json:"number"`
+	LSN            uint64          `json:"lsn"`
+	SequenceNumber uint16          `json:"sequenceNumber"`
+	LinkCount      uint16          `json:"linkCount"`
+	Flags          uint16          `json:"flags"`
+	UsedSize       uint32          `json:"usedSize"`
+	AllocatedSize  uint32          `json:"allocatedSize"`
+	BaseRecord     uint64          `json:"baseRecord"`
+	NextAttrID     uint16          `json:"nextAttrID"`
+	Attributes     []attributeMeta `json:"attributes"`
+}
+
+type attributeMeta struct {
+	Type            uint32    `json:"type"`
+	TypeName        string    `json:"typeName,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	NonResident     bool      `json:"nonResident"`
+	Flags           uint16    `json:"flags"`
+	ID              uint16    `json:"id"`
+	Length          uint32    `json:"length"`
+	Value           string    `json:"value,omitempty"` // Resident value, in hex
+	FileName        string    `json:"fileName,omitempty"`
+	ParentRecord    uint64    `json:"parentRecord,omitempty"`
+	StartVCN        uint64    `json:"startVCN,omitempty"`
+	EndVCN          uint64    `json:"endVCN,omitempty"`
+	AllocatedSize   uint64    `json:"allocatedSize,omitempty"`
+	RealSize        uint64    `json:"realSize,omitempty"`
+	InitializedSize uint64    `json:"initializedSize,omitempty"`
+	Runs            []runMeta `json:"runs,omitempty"`
+}
+
+type runMeta struct {
+	Length uint64 `json:"length"` // In clusters
+	LCN    int64  `json:"lcn"`
+	Sparse bool   `json:"sparse,omitempty"`
 }
 
 // fileNameAttr represents parsed $FILE_NAME attribute
 type fileNameAttr struct {
 	parentRef      uint64
+	parentSeq      uint16 // Sequence number in the parent reference
 	creationTime   time.Time
 	modTime        time.Time
 	mftModTime     time.Time
@@ -618,22 +1380,33 @@ type fileNameAttr struct {
 	allocatedSize  uint64
 	realSize       uint64
 	flags          uint32
+	reparseTag     uint32
 	nameType       uint8
 	name           string
 }
 
+// isLink reports whether the file is a symbolic link or junction
+func (fn *fileNameAttr) isLink() bool {
+	return fn.flags&fileAttrReparsePoint != 0 &&
+		(fn.reparseTag == reparseTagSymlink || fn.reparseTag == reparseTagMountPoint)
+}
+
 func parseFileNameAttr(data []byte) (*fileNameAttr, error) {
 	if len(data) < 66 {
-		return nil, fmt.Errorf("$FILE_NAME too small")
+		return nil, fsys.Corrupt("$FILE_NAME attribute", -1, "too small")
 	}
 
 	fn := &fileNameAttr{
 		parentRef:     binary.LittleEndian.Uint64(data[0:8]) & 0x0000FFFFFFFFFFFF,
+		parentSeq:     binary.LittleEndian.Uint16(data[6:8]),
 		allocatedSize: binary.LittleEndian.Uint64(data[40:48]),
 		realSize:      binary.LittleEndian.Uint64(data[48:56]),
 		flags:         binary.LittleEndian.Uint32(data[56:60]),
 		nameType:      data[65],
 	}
+	if fn.flags&fileAttrReparsePoint != 0 {
+		fn.reparseTag = binary.LittleEndian.Uint32(data[60:64])
+	}
 
 	fn.creationTime = windowsFileTimeToTime(binary.LittleEndian.Uint64(data[8:16]))
 	fn.modTime = windowsFileTimeToTime(binary.LittleEndian.Uint64(data[16:24]))
@@ -642,7 +1415,7 @@ func parseFileNameAttr(data []byte) (*fileNameAttr, error) {
 
 	nameLen := int(data[64])
 	if len(data) < 66+nameLen*2 {
-		return nil, fmt.Errorf("$FILE_NAME name truncated")
+		return nil, fsys.Corrupt("$FILE_NAME attribute", -1, "name truncated")
 	}
 
 	utf16Chars := make([]uint16, nameLen)
@@ -670,6 +1443,7 @@ type indexEntry struct {
 	contentLength uint16
 	flags         uint32
 	fileName      *fileNameAttr
+	subnode       uint64 // With indexEntrySubnode, the VCN of the index block of the entries before this one
 }
 
 func (f *FS) readDirectory(recordNum uint64) ([]indexEntry, error) {
@@ -716,7 +1490,7 @@ func (f *FS) readDirectory(recordNum uint64) ([]indexEntry, error) {
 
 func (f *FS) parseIndexRoot(data []byte) ([]indexEntry, error) {
 	if len(data) < 32 {
-		return nil, fmt.Errorf("$INDEX_ROOT too small")
+		return nil, fsys.Corrupt("$INDEX_ROOT attribute", -1, "too small")
 	}
 
 	// Index root header
@@ -781,9 +1555,13 @@ func (f *FS) parseIndexEntries(data []byte) ([]indexEntry, error) {
 		if entry.entryLength == 0 {
 			break
 		}
+		if entry.flags&indexEntrySubnode != 0 && entry.entryLength >= 24 && offset+int(entry.entryLength) <= len(data) {
+			entry.subnode = binary.LittleEndian.Uint64(data[offset+int(entry.entryLength)-8:])
+		}
 
-		// Last entry flag
-		if entry.flags&2 != 0 {
+		// The last entry has no name, but may have a subnode
+		if entry.flags&indexEntryLast != 0 {
+			entries = append(entries, entry)
 			break
 		}
 
@@ -876,27 +1654,189 @@ func (f *FS) lookup(name string) (uint64, *mftRecord, *fileNameAttr, error) {
 }
 
 func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.ReadDirFile(f, name)
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
 	file, err := f.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return file.Stat()
+}
 
-	dir, ok := file.(fs.ReadDirFile)
-	if !ok {
-		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+// ReadLink implements fsys.Symlinker for symbolic links and junctions.
+// Relative targets have their separators turned into slashes; absolute
+// ones, such as C:\Users, name a path on Windows and are left as they are.
+func (f *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := f.loadMFT(); err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
 	}
+	recordNum, _, _, err := f.lookup(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	data, err := f.unnamedAttribute(recordNum, attrReparsePoint)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := parseReparseLink(data)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
 
-	return dir.ReadDir(-1)
+// Lstat implements fsys.Symlinker; Stat does not follow links either
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	return f.Stat(name)
 }
 
-func (f *FS) Stat(name string) (fs.FileInfo, error) {
-	file, err := f.Open(name)
+// eas returns the extended attributes in the $EA attribute of an MFT
+// record, none if it has no $EA. The attribute is a list of
+// FILE_FULL_EA_INFORMATION entries: the offset of the next entry, flags,
+// the lengths of the name and the value, the name and a NUL, and the value.
+func (f *FS) eas(recordNum uint64) (map[string][]byte, error) {
+	rec, err := f.readMFTRecord(recordNum)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	return file.Stat()
+	attrs, err := f.parseAttributes(rec)
+	if err != nil {
+		return nil, err
+	}
+	eas := make(map[string][]byte)
+	for _, attr := range attrs {
+		if attr.attrType != attrEA || attr.name != "" {
+			continue
+		}
+		data, err := f.readAttributeData(&attr)
+		if err != nil {
+			return nil, fmt.Errorf("$EA: %w", err)
+		}
+		for off := 0; off < len(data); {
+			e := data[off:]
+			if len(e) < 8 {
+				return nil, fsys.Corrupt(fmt.Sprintf("$EA of MFT record %d", recordNum), -1, "entry at %d too short", off)
+			}
+			next := int(binary.LittleEndian.Uint32(e[0:4]))
+			nameLen, valueLen := int(e[5]), int(binary.LittleEndian.Uint16(e[6:8]))
+			if 8+nameLen+1+valueLen > len(e) {
+				return nil, fsys.Corrupt(fmt.Sprintf("$EA of MFT record %d", recordNum), -1, "entry at %d overruns the attribute", off)
+			}
+			eas[string(e[8:8+nameLen])] = e[8+nameLen+1 : 8+nameLen+1+valueLen]
+			if next == 0 {
+				break
+			}
+			off += next
+		}
+	}
+	return eas, nil
+}
+
+// namedEAs looks up a file and reads its extended attributes
+func (f *FS) namedEAs(op, name string) (map[string][]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := f.loadMFT(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	recordNum := uint64(mftRecordRoot)
+	if name != "." {
+		var err error
+		if recordNum, _, _, err = f.lookup(name); err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	eas, err := f.eas(recordNum)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return eas, nil
+}
+
+// ListXattr implements fsys.XattrFS with the extended attributes of $EA,
+// such as the $LXUID and $LXMOD WSL keeps Linux metadata in
+func (f *FS) ListXattr(name string) ([]string, error) {
+	eas, err := f.namedEAs("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(eas))
+	for n := range eas {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetXattr implements fsys.XattrFS. Windows keeps the names of extended
+// attributes in upper case, and matches them ignoring case.
+func (f *FS) GetXattr(name, attr string) ([]byte, error) {
+	eas, err := f.namedEAs("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	for n, value := range eas {
+		if strings.EqualFold(n, attr) {
+			return value, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fsys.ErrNoXattr}
+}
+
+// parseReparseLink returns the target of a symbolic link or junction from
+// its reparse point data: the print name, or the substitute name without
+// its \??\ prefix if there is none
+func parseReparseLink(data []byte) (string, error) {
+	if len(data) < 16 {
+		return "", fsys.Corrupt("reparse point", -1, "too short")
+	}
+	tag := binary.LittleEndian.Uint32(data[0:4])
+	var buf []byte
+	relative := false
+	switch tag {
+	case reparseTagSymlink:
+		if len(data) < 20 {
+			return "", fsys.Corrupt("reparse point", -1, "too short for a symbolic link")
+		}
+		relative = binary.LittleEndian.Uint32(data[16:20])&1 != 0 // SYMLINK_FLAG_RELATIVE
+		buf = data[20:]
+	case reparseTagMountPoint:
+		buf = data[16:]
+	default:
+		return "", fmt.Errorf("reparse tag %#x is not a link", tag)
+	}
+
+	name := func(off, length uint16) (string, error) {
+		if int(off)+int(length) > len(buf) {
+			return "", fsys.Corrupt("reparse point", -1, "name out of bounds")
+		}
+		chars := make([]uint16, length/2)
+		for i := range chars {
+			chars[i] = binary.LittleEndian.Uint16(buf[int(off)+2*i:])
+		}
+		return string(utf16.Decode(chars)), nil
+	}
+	target, err := name(binary.LittleEndian.Uint16(data[12:14]), binary.LittleEndian.Uint16(data[14:16]))
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		if target, err = name(binary.LittleEndian.Uint16(data[8:10]), binary.LittleEndian.Uint16(data[10:12])); err != nil {
+			return "", err
+		}
+		target = strings.TrimPrefix(target, `\??\`)
+	}
+	if relative {
+		target = strings.ReplaceAll(target, `\`, "/")
+	}
+	return target, nil
 }
 
 // ntfsFile implements fs.File for regular files
@@ -936,6 +1876,7 @@ func (f *ntfsFile) Stat() (fs.FileInfo, error) {
 		fileNameAttr: f.fileNameAttr,
 		isDir:        false,
 		recordNum:    f.recordNum,
+		fs:           f.fs,
 	}, nil
 }
 
@@ -979,8 +1920,7 @@ type ntfsDir struct {
 	recordNum    uint64
 	name         string
 	fileNameAttr *fileNameAttr
-	entries      []fs.DirEntry
-	offset       int
+	iter         *indexIterator // Set by the first ReadDir
 }
 
 func (d *ntfsDir) Stat() (fs.FileInfo, error) {
@@ -989,6 +1929,7 @@ func (d *ntfsDir) Stat() (fs.FileInfo, error) {
 		fileNameAttr: d.fileNameAttr,
 		isDir:        true,
 		recordNum:    d.recordNum,
+		fs:           d.fs,
 	}, nil
 }
 
@@ -997,60 +1938,150 @@ func (d *ntfsDir) Read(b []byte) (int, error) {
 }
 
 func (d *ntfsDir) Close() error {
-	d.entries = nil
+	d.iter = nil
 	return nil
 }
 
+// ReadDir returns the entries in index order, reading the index blocks of
+// the directory as it gets to them. DOS names, which the files also have
+// a long name for, are left out.
 func (d *ntfsDir) ReadDir(n int) ([]fs.DirEntry, error) {
-	if d.entries == nil {
-		indexEntries, err := d.fs.readDirectory(d.recordNum)
+	if d.iter == nil {
+		iter, err := d.fs.newIndexIterator(d.recordNum)
 		if err != nil {
 			return nil, err
 		}
+		d.iter = iter
+	}
 
-		// Use map to deduplicate (prefer Win32/Both names over DOS names)
-		seen := make(map[string]*ntfsDirEntry)
-		for _, entry := range indexEntries {
-			if entry.fileName == nil {
-				continue
-			}
-			name := entry.fileName.name
-			// Skip . and ..
-			if name == "." || name == ".." {
-				continue
+	var entries []fs.DirEntry
+	for n <= 0 || len(entries) < n {
+		entry, ok, err := d.iter.next()
+		if err != nil {
+			return entries, err
+		}
+		if !ok {
+			break
+		}
+		if fn := entry.fileName; fn == nil || fn.nameType == fileNameDOS || fn.name == "." || fn.name == ".." {
+			continue
+		}
+		entries = append(entries, &ntfsDirEntry{fs: d.fs, entry: entry})
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// indexIterator walks the B-tree of a directory's $I30 index in order,
+// reading each index block when it gets to it
+type indexIterator struct {
+	f         *FS
+	recordNum uint64
+	alloc     io.ReaderAt // $INDEX_ALLOCATION, nil when the index fits in $INDEX_ROOT
+	vcnSize   int64       // Bytes per VCN of an index block
+	stack     []indexNode // The nodes from the root down to the one being read
+	visited   map[uint64]bool
+}
+
+// indexNode is a node of an index being walked
+type indexNode struct {
+	entries   []indexEntry // Entries not yet returned
+	descended bool         // Whether the subnode of entries[0] has been walked
+}
+
+// newIndexIterator returns an iterator over the index of directory
+// recordNum, starting at its $INDEX_ROOT
+func (f *FS) newIndexIterator(recordNum uint64) (*indexIterator, error) {
+	rec, err := f.readMFTRecord(recordNum)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := f.parseAttributes(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &indexIterator{f: f, recordNum: recordNum, vcnSize: int64(f.clusterSize), visited: make(map[uint64]bool)}
+	if f.indexRecordSize < int32(f.clusterSize) {
+		it.vcnSize = 512
+	}
+	var root []indexEntry
+	for _, attr := range attrs {
+		if attr.name != "$I30" {
+			continue
+		}
+		switch attr.attrType {
+		case attrIndexRoot:
+			if root, err = f.parseIndexRoot(attr.value); err != nil {
+				return nil, err
 			}
-			// Skip DOS-only names if we have a better name
-			existing, exists := seen[strings.ToLower(name)]
-			if exists && existing.entry.fileName.nameType != fileNameDOS && entry.fileName.nameType == fileNameDOS {
-				continue
+		case attrIndexAllocation:
+			extents, err := f.dataRunsToExtents(attr)
+			if err != nil {
+				return nil, err
 			}
-			seen[strings.ToLower(name)] = &ntfsDirEntry{fs: d.fs, entry: entry}
+			it.alloc = fsys.NewExtentReaderAt(f.r, extents, int64(attr.realSize))
 		}
+	}
+	it.stack = []indexNode{{entries: root}}
+	return it, nil
+}
 
-		d.entries = make([]fs.DirEntry, 0, len(seen))
-		for _, e := range seen {
-			d.entries = append(d.entries, e)
+// next returns the next entry of the index, or false at its end. An entry
+// comes after the entries of its subnode.
+func (it *indexIterator) next() (indexEntry, bool, error) {
+	for len(it.stack) > 0 {
+		node := &it.stack[len(it.stack)-1]
+		if len(node.entries) == 0 {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		entry := node.entries[0]
+		if entry.flags&indexEntrySubnode != 0 && !node.descended {
+			node.descended = true
+			entries, err := it.readBlock(entry.subnode)
+			if err != nil {
+				return indexEntry{}, false, err
+			}
+			it.stack = append(it.stack, indexNode{entries: entries})
+			continue
+		}
+		node.entries, node.descended = node.entries[1:], false
+		if entry.flags&indexEntryLast == 0 {
+			return entry, true, nil
 		}
 	}
+	return indexEntry{}, false, nil
+}
 
-	if n <= 0 {
-		entries := d.entries[d.offset:]
-		d.offset = len(d.entries)
-		return entries, nil
+// readBlock returns the entries of the index block at vcn
+func (it *indexIterator) readBlock(vcn uint64) ([]indexEntry, error) {
+	structure := fmt.Sprintf("index block %d of MFT record %d", vcn, it.recordNum)
+	if it.alloc == nil {
+		return nil, fsys.Corrupt(structure, -1, "no $INDEX_ALLOCATION")
 	}
-
-	if d.offset >= len(d.entries) {
-		return nil, io.EOF
+	if it.visited[vcn] {
+		return nil, fsys.Corrupt(structure, -1, "in the index twice")
 	}
+	it.visited[vcn] = true
 
-	end := d.offset + n
-	if end > len(d.entries) {
-		end = len(d.entries)
+	block := make([]byte, it.f.indexRecordSize)
+	if _, err := it.alloc.ReadAt(block, int64(vcn)*it.vcnSize); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", structure, err)
 	}
-
-	entries := d.entries[d.offset:end]
-	d.offset = end
-	return entries, nil
+	if !bytes.Equal(block[0:4], []byte("INDX")) {
+		return nil, fsys.Corrupt(structure, -1, "invalid signature %q", block[0:4])
+	}
+	if err := it.f.applyFixup(block, binary.LittleEndian.Uint16(block[4:6]), binary.LittleEndian.Uint16(block[6:8])); err != nil {
+		return nil, fsys.Corrupt(structure, -1, "%w", err)
+	}
+	entriesOffset := 24 + int64(binary.LittleEndian.Uint32(block[24:28]))
+	if entriesOffset >= int64(len(block)) {
+		return nil, fsys.Corrupt(structure, -1, "entries at offset %d", entriesOffset)
+	}
+	return it.f.parseIndexEntries(block[entriesOffset:])
 }
 
 // ntfsDirEntry implements fs.DirEntry
@@ -1061,12 +2092,16 @@ type ntfsDirEntry struct {
 
 func (e *ntfsDirEntry) Name() string { return e.entry.fileName.name }
 
+// IsDir reports false for junctions, which are links to directories
 func (e *ntfsDirEntry) IsDir() bool {
-	return e.entry.fileName.flags&0x10000000 != 0 // FILE_ATTR_DIRECTORY
+	return e.entry.fileName.flags&0x10000000 != 0 && !e.entry.fileName.isLink() // FILE_ATTR_DIRECTORY
 }
 
 func (e *ntfsDirEntry) Type() fs.FileMode {
-	if e.IsDir() {
+	switch {
+	case e.entry.fileName.isLink():
+		return fs.ModeSymlink
+	case e.IsDir():
 		return fs.ModeDir
 	}
 	return 0
@@ -1080,6 +2115,7 @@ func (e *ntfsDirEntry) Info() (fs.FileInfo, error) {
 		fileNameAttr: e.entry.fileName,
 		isDir:        e.IsDir(),
 		recordNum:    recordNum,
+		fs:           e.fs,
 	}, nil
 }
 
@@ -1090,12 +2126,47 @@ type ntfsFileInfo struct {
 	fileNameAttr *fileNameAttr
 	isDir        bool
 	recordNum    uint64
+	fs           *FS
 }
 
 func (i *ntfsFileInfo) Name() string { return i.name }
 func (i *ntfsFileInfo) Size() int64  { return i.size }
-func (i *ntfsFileInfo) IsDir() bool  { return i.isDir }
-func (i *ntfsFileInfo) Sys() any     { return nil }
+func (i *ntfsFileInfo) IsDir() bool  { return i.isDir && !i.isLink() }
+
+// Attributes is the NTFS metadata of a file that fs.FileInfo has no place
+// for, returned by the Sys method of its FileInfo
+type Attributes struct {
+	Record       uint64 // MFT record number
+	Sequence     uint16 // Sequence number of the record, which references to it carry
+	Flags        uint32 // FILE_ATTRIBUTE_* flags, such as 0x2 hidden, 0x4 system and 0x800 compressed
+	ReparseTag   uint32 // Tag of a reparse point, 0 for other files
+	Owner, Group string // SIDs from the security descriptor, "" if it cannot be read
+}
+
+// Sys returns the file's *Attributes, read from its MFT record. The flags
+// are those of $STANDARD_INFORMATION, or of the $FILE_NAME in the index if
+// it cannot be read.
+func (i *ntfsFileInfo) Sys() any {
+	a := &Attributes{Record: i.recordNum}
+	if i.fileNameAttr != nil {
+		a.Flags, a.ReparseTag = i.fileNameAttr.flags, i.fileNameAttr.reparseTag
+	}
+	if rec, err := i.fs.readMFTRecord(i.recordNum); err == nil {
+		a.Sequence = rec.sequenceNum
+	}
+	if si, err := i.fs.unnamedAttribute(i.recordNum, attrStandardInfo); err == nil && len(si) >= 0x24 {
+		a.Flags = binary.LittleEndian.Uint32(si[0x20:0x24])
+	}
+	a.Owner, a.Group = i.Owner()
+	return a
+}
+
+func (i *ntfsFileInfo) isLink() bool {
+	return i.fileNameAttr != nil && i.fileNameAttr.isLink()
+}
+
+// Inode returns the MFT record number
+func (i *ntfsFileInfo) Inode() uint64 { return i.recordNum }
 
 func (i *ntfsFileInfo) ModTime() time.Time {
 	if i.fileNameAttr != nil {
@@ -1104,7 +2175,42 @@ func (i *ntfsFileInfo) ModTime() time.Time {
 	return time.Time{}
 }
 
+func (i *ntfsFileInfo) BirthTime() time.Time {
+	if i.fileNameAttr != nil {
+		return i.fileNameAttr.creationTime
+	}
+	return time.Time{}
+}
+
+func (i *ntfsFileInfo) AccessTime() time.Time {
+	if i.fileNameAttr != nil {
+		return i.fileNameAttr.accessTime
+	}
+	return time.Time{}
+}
+
+// ChangeTime returns the time the MFT record changed
+func (i *ntfsFileInfo) ChangeTime() time.Time {
+	if i.fileNameAttr != nil {
+		return i.fileNameAttr.mftModTime
+	}
+	return time.Time{}
+}
+
+// Owner returns the owner and group SIDs from the file's security
+// descriptor
+func (i *ntfsFileInfo) Owner() (user, group string) {
+	sd, err := i.fs.securityDescriptor(i.recordNum)
+	if err != nil {
+		return "", ""
+	}
+	return descriptorOwner(sd)
+}
+
 func (i *ntfsFileInfo) Mode() fs.FileMode {
+	if i.isLink() {
+		return fs.ModeSymlink | 0777
+	}
 	mode := fs.FileMode(0444)
 	if i.isDir {
 		mode |= fs.ModeDir | 0111
@@ -0,0 +1,162 @@
+package ntfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// noSubnode marks an index entry without a subnode
+const noSubnode = -1
+
+// entryBytes builds an index entry of $I30 for name, ending with the VCN
+// of its subnode unless that is noSubnode. An empty name makes the last
+// entry of a node.
+func entryBytes(name string, subnode int64) []byte {
+	var content []byte
+	flags := uint32(0)
+	if name == "" {
+		flags |= indexEntryLast
+	} else {
+		chars := utf16.Encode([]rune(name))
+		content = make([]byte, 66+2*len(chars))
+		content[64] = byte(len(chars))
+		content[65] = fileNameWin32
+		for i, c := range chars {
+			binary.LittleEndian.PutUint16(content[66+2*i:], c)
+		}
+	}
+	length := (16 + len(content) + 7) &^ 7
+	if subnode != noSubnode {
+		flags |= indexEntrySubnode
+		length += 8
+	}
+	e := make([]byte, length)
+	binary.LittleEndian.PutUint16(e[8:10], uint16(length))
+	binary.LittleEndian.PutUint16(e[10:12], uint16(len(content)))
+	binary.LittleEndian.PutUint32(e[12:16], flags)
+	copy(e[16:], content)
+	if subnode != noSubnode {
+		binary.LittleEndian.PutUint64(e[length-8:], uint64(subnode))
+	}
+	return e
+}
+
+// indexBlock builds an INDX block of 4 KiB holding entries, without a
+// fixup array
+func indexBlock(entries ...[]byte) []byte {
+	block := make([]byte, 4096)
+	copy(block, "INDX")
+	binary.LittleEndian.PutUint32(block[24:28], 0x28) // Entries at 24+0x28
+	copy(block[24+0x28:], bytes.Join(entries, nil))
+	return block
+}
+
+// testDir returns a directory whose index has root for $INDEX_ROOT and
+// blocks for $INDEX_ALLOCATION, one to a 4 KiB cluster
+func testDir(t *testing.T, root [][]byte, blocks ...[]byte) *ntfsDir {
+	t.Helper()
+	f := &FS{clusterSize: 4096, indexRecordSize: 4096, records: newRecordCache(recordCacheSize)}
+	entries, err := f.parseIndexEntries(bytes.Join(root, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := &indexIterator{f: f, recordNum: 42, alloc: bytes.NewReader(bytes.Join(blocks, nil)), vcnSize: 4096,
+		stack: []indexNode{{entries: entries}}, visited: make(map[uint64]bool)}
+	return &ntfsDir{fs: f, recordNum: 42, name: "dir", iter: it}
+}
+
+func TestReadDirPaging(t *testing.T) {
+	// a b c in block 0 come before d in the root, and e f in block 1
+	// after it, under the last entry of the root
+	d := testDir(t,
+		[][]byte{entryBytes("d", 0), entryBytes("", 1)},
+		indexBlock(entryBytes("a", noSubnode), entryBytes("b", noSubnode), entryBytes("c", noSubnode), entryBytes("", noSubnode)),
+		indexBlock(entryBytes("e", noSubnode), entryBytes("f", noSubnode), entryBytes("", noSubnode)),
+	)
+
+	var pages [][]string
+	for {
+		entries, err := d.ReadDir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		pages = append(pages, names)
+		if len(pages) == 1 && d.iter.visited[1] {
+			t.Error("the first ReadDir(2) read the index block of e and f")
+		}
+	}
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}}
+	if !slices.EqualFunc(pages, want, slices.Equal) {
+		t.Errorf("ReadDir(2) pages = %v, want %v", pages, want)
+	}
+}
+
+func TestReadDirSubnodeLoop(t *testing.T) {
+	// Block 0 gives itself as the subnode of its first entry
+	d := testDir(t,
+		[][]byte{entryBytes("", 0)},
+		indexBlock(entryBytes("a", 0), entryBytes("", noSubnode)),
+	)
+	_, err := d.ReadDir(-1)
+	var corrupt *fsys.ErrCorruptMetadata
+	if !errors.As(err, &corrupt) {
+		t.Errorf("ReadDir of an index that loops = %v, want corrupt metadata", err)
+	}
+}
+
+func TestRecordCache(t *testing.T) {
+	c := newRecordCache(2)
+	record := func(n uint32) *mftRecord { return &mftRecord{recordNumber: n} }
+	one, two := record(1), record(2)
+	c.add(one)
+	c.add(two)
+
+	// Reading 1 leaves 2 the least recently used, which 3 evicts
+	if rec, ok := c.get(1); !ok || rec != one {
+		t.Fatalf("get(1) = %v, %v", rec, ok)
+	}
+	c.add(record(3))
+	if _, ok := c.get(2); ok {
+		t.Error("record 2 was not evicted")
+	}
+	for _, n := range []uint64{1, 3} {
+		if _, ok := c.get(n); !ok {
+			t.Errorf("record %d was evicted", n)
+		}
+	}
+	if c.lru.Len() != 2 || len(c.records) != 2 {
+		t.Errorf("the cache holds %d records, %d in its map, want 2", c.lru.Len(), len(c.records))
+	}
+
+	// A record read twice at once is cached once, the first kept
+	if rec := c.add(record(1)); rec != one {
+		t.Error("add of a cached record replaced it")
+	}
+}
+
+func TestDataRunsEncrypted(t *testing.T) {
+	f := &FS{clusterSize: 4096}
+	attr := attribute{attrType: attrData, nonResident: true, realSize: 4096, initSize: 4096,
+		dataRuns: []dataRun{{length: 1, offset: 100}}}
+	if _, err := f.dataRunsToExtents(attr); err != nil {
+		t.Fatal(err)
+	}
+	attr.flags = attrFlagEncrypted
+	if _, err := f.dataRunsToExtents(attr); !errors.Is(err, fsys.ErrEncrypted) {
+		t.Errorf("extents of EFS data = %v, want ErrEncrypted", err)
+	}
+}
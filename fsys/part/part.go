@@ -1,14 +1,23 @@
 // Package part provides partition table parsing.
-// It treats partition tables (MBR, GPT) as a filesystem where
-// partitions appear as files that can be read or recursed into.
+// It treats partition tables (MBR, GPT, BSD disklabels and Sun VTOCs) as
+// a filesystem where partitions appear as files that can be read or
+// recursed into, and writes new MBR and GPT tables.
 package part
 
 import (
+	"cmp"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf16"
 
@@ -18,40 +27,109 @@ import (
 
 // Partition represents a single partition entry
 type Partition struct {
-	Index    int      // Partition index (0-based)
-	Name     string   // Display name (e.g., "p0", "p1")
-	Type     byte     // MBR partition type or 0 for GPT
-	TypeGUID [16]byte // GPT type GUID
-	StartLBA uint64
-	SizeLBA  uint64
-	Bootable bool
-	Label    string // GPT partition label (if available)
+	Index      int         // Partition index (0-based)
+	Name       string      // Display name (e.g., "p0", "p1", "a" or "s0")
+	Table      detect.Type // Partition table the entry comes from
+	Type       byte        // MBR type, BSD fstype or Sun tag; 0 for GPT
+	TypeGUID   [16]byte    // GPT type GUID
+	StartLBA   uint64
+	SizeLBA    uint64
+	SectorSize int64 // Bytes per LBA
+	Bootable   bool
+	Label      string      // GPT partition label (if available)
+	Content    detect.Type // Filesystem or partition table detected inside
 }
 
 // SizeBytes returns the partition size in bytes
 func (p *Partition) SizeBytes() int64 {
-	return int64(p.SizeLBA) * 512
+	return int64(p.SizeLBA) * p.SectorSize
 }
 
 // StartOffset returns the starting byte offset
 func (p *Partition) StartOffset() int64 {
-	return int64(p.StartLBA) * 512
+	return int64(p.StartLBA) * p.SectorSize
 }
 
+// maxNestingDepth limits how deep partition tables inside partitions
+// are followed
+const maxNestingDepth = 4
+
+// maxSectorSize is the largest logical sector size probed for a GPT
+const maxSectorSize = 4096
+
 // FS implements fsys.FS for partition tables
 type FS struct {
 	r          io.ReaderAt
 	size       int64
-	tableType  detect.Type // MBR or GPT
+	tableType  detect.Type // MBR, GPT, BSDLabel or SunVTOC
 	partitions []*Partition
+	mbr        []*Partition // For a GPT, the entries of the protective or hybrid MBR
+	mbrErr     error        // For a GPT, why the MBR could not be read
+	sectorSize int64        // Logical sector size of MBR and GPT LBAs
+	metadata   []fsys.Range // Table structures outside the partitions, such as EBRs and GPT copies
+
+	// The GPT's usable area, outside of which are its primary and backup copies
+	firstUsableLBA, lastUsableLBA uint64
+
+	offset     int64              // Offset of this table's disk within the outermost image
+	depth      int                // Number of partition tables this one is nested in
+	nestedMu   sync.Mutex         // Guards nested, filled in on first use
+	nested     map[*Partition]*FS // Partition tables found inside partitions (nil if none)
+	lbaSetting int                // Sector size requested for nested tables, 0 for automatic
+
+	innerMu sync.Mutex
+	inner   map[innerKey]fsys.FS // Filesystems opened in partitions by OpenInner
+}
+
+// innerKey identifies a filesystem opened in a partition by the partition
+// and the options it was opened with
+type innerKey struct {
+	part *Partition
+	opts any
+}
+
+func init() {
+	for _, t := range []detect.Type{detect.MBR, detect.GPT, detect.BSDLabel, detect.SunVTOC} {
+		fsys.Register(t, func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			pfs, err := Open(r, size, t)
+			if err != nil {
+				return nil, err
+			}
+			return pfs, nil
+		})
+	}
 }
 
 // Open opens a partition table from a reader
 func Open(r io.ReaderAt, size int64, tableType detect.Type) (*FS, error) {
+	return OpenSectorSize(r, size, tableType, 0)
+}
+
+// OpenSectorSize opens a partition table whose LBAs count sectors of
+// sectorSize bytes. With sectorSize 0 a GPT's sector size is found from
+// the location of its header, and MBRs assume 512 bytes.
+func OpenSectorSize(r io.ReaderAt, size int64, tableType detect.Type, sectorSize int) (*FS, error) {
+	if sectorSize != 0 && (sectorSize < 512 || sectorSize&(sectorSize-1) != 0) {
+		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
+	}
+	return openNested(r, size, tableType, sectorSize, 0, 0)
+}
+
+// openNested opens a partition table found at offset within the
+// outermost image, depth tables deep
+func openNested(r io.ReaderAt, size int64, tableType detect.Type, sectorSize int, offset int64, depth int) (*FS, error) {
 	pfs := &FS{
-		r:         r,
-		size:      size,
-		tableType: tableType,
+		r:          r,
+		size:       size,
+		tableType:  tableType,
+		sectorSize: int64(sectorSize),
+		offset:     offset,
+		depth:      depth,
+		nested:     make(map[*Partition]*FS),
+		lbaSetting: sectorSize,
+	}
+	if pfs.sectorSize == 0 {
+		pfs.sectorSize = 512
 	}
 
 	var err error
@@ -60,6 +138,10 @@ func Open(r io.ReaderAt, size int64, tableType detect.Type) (*FS, error) {
 		err = pfs.parseMBR()
 	case detect.GPT:
 		err = pfs.parseGPT()
+	case detect.BSDLabel:
+		err = pfs.parseBSDLabel()
+	case detect.SunVTOC:
+		err = pfs.parseSunVTOC()
 	default:
 		return nil, fmt.Errorf("unknown partition table type: %v", tableType)
 	}
@@ -68,22 +150,53 @@ func Open(r io.ReaderAt, size int64, tableType detect.Type) (*FS, error) {
 		return nil, err
 	}
 
+	// Extended partitions hold EBRs, which would look like MBRs
+	for _, p := range pfs.partitions {
+		if !isExtended(p.Type) || p.Table != detect.MBR {
+			p.Content, _ = detect.Detect(pfs.section(p))
+		}
+	}
+
 	return pfs, nil
 }
 
+// section returns a reader for the contents of partition p
+func (pfs *FS) section(p *Partition) *io.SectionReader {
+	return io.NewSectionReader(pfs.r, p.StartOffset(), p.SizeBytes())
+}
+
 // parseMBR parses an MBR partition table
 func (pfs *FS) parseMBR() error {
+	primary, err := pfs.readMBR()
+	if err != nil {
+		return err
+	}
+	pfs.partitions = primary
+
+	// Logical partitions live in the (first) extended partition
+	for _, p := range pfs.partitions {
+		if isExtended(p.Type) {
+			return pfs.parseEBRChain(p.StartLBA)
+		}
+	}
+
+	return nil
+}
+
+// readMBR returns the primary partitions of the MBR in sector 0
+func (pfs *FS) readMBR() ([]*Partition, error) {
 	header := make([]byte, 512)
 	if _, err := pfs.r.ReadAt(header, 0); err != nil {
-		return fmt.Errorf("reading MBR: %w", err)
+		return nil, fmt.Errorf("reading MBR: %w", err)
 	}
 
 	// Check signature
 	if header[510] != 0x55 || header[511] != 0xAA {
-		return fmt.Errorf("invalid MBR signature")
+		return nil, fsys.Corrupt("MBR", 0, "invalid signature")
 	}
 
 	// Parse 4 partition entries at offset 446
+	var partitions []*Partition
 	for i := 0; i < 4; i++ {
 		entry := header[446+i*16 : 446+(i+1)*16]
 
@@ -99,43 +212,126 @@ func (pfs *FS) parseMBR() error {
 			continue
 		}
 
-		pfs.partitions = append(pfs.partitions, &Partition{
-			Index:    len(pfs.partitions),
-			Name:     fmt.Sprintf("p%d", len(pfs.partitions)),
-			Type:     partType,
-			StartLBA: uint64(lbaStart),
-			SizeLBA:  uint64(lbaSize),
-			Bootable: entry[0] == 0x80,
+		partitions = append(partitions, &Partition{
+			Index:      len(partitions),
+			Name:       fmt.Sprintf("p%d", len(partitions)),
+			Table:      detect.MBR,
+			Type:       partType,
+			StartLBA:   uint64(lbaStart),
+			SizeLBA:    uint64(lbaSize),
+			SectorSize: pfs.sectorSize,
+			Bootable:   entry[0] == 0x80,
 		})
 	}
 
-	return nil
+	return partitions, nil
 }
 
-// parseGPT parses a GPT partition table
-func (pfs *FS) parseGPT() error {
-	// GPT header is at LBA 1 (offset 512)
-	header := make([]byte, 512)
-	if _, err := pfs.r.ReadAt(header, 512); err != nil {
-		return fmt.Errorf("reading GPT header: %w", err)
+// maxLogicalPartitions bounds the EBR chain in case it loops
+const maxLogicalPartitions = 128
+
+// isExtended reports whether an MBR partition type is an extended
+// partition holding a chain of EBRs
+func isExtended(partType byte) bool {
+	return partType == 0x05 || partType == 0x0F || partType == 0x85
+}
+
+// parseEBRChain follows the chain of extended boot records starting at
+// extStart. Each EBR's first entry is a logical partition relative to the
+// EBR, and its second entry links to the next EBR relative to extStart.
+// Logical partitions are numbered from p4, after the primary slots.
+func (pfs *FS) parseEBRChain(extStart uint64) error {
+	ebr := make([]byte, 512)
+	ebrLBA := extStart
+	index := 4
+	for n := 0; ; n++ {
+		if n >= maxLogicalPartitions {
+			return fsys.Corrupt("EBR chain", int64(extStart)*pfs.sectorSize, "longer than %d entries", maxLogicalPartitions)
+		}
+		if _, err := pfs.r.ReadAt(ebr, int64(ebrLBA)*pfs.sectorSize); err != nil {
+			return fmt.Errorf("reading EBR at LBA %d: %w", ebrLBA, err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xAA {
+			return fsys.Corrupt(fmt.Sprintf("EBR at LBA %d", ebrLBA), int64(ebrLBA)*pfs.sectorSize, "invalid signature")
+		}
+		pfs.metadata = append(pfs.metadata, pfs.sectors(ebrLBA, 1))
+
+		entry := ebr[446:462]
+		lbaStart := binary.LittleEndian.Uint32(entry[8:12])
+		lbaSize := binary.LittleEndian.Uint32(entry[12:16])
+		if entry[4] != 0 && lbaStart != 0 && lbaSize != 0 {
+			pfs.partitions = append(pfs.partitions, &Partition{
+				Index:      index,
+				Name:       fmt.Sprintf("p%d", index),
+				Table:      detect.MBR,
+				Type:       entry[4],
+				StartLBA:   ebrLBA + uint64(lbaStart),
+				SizeLBA:    uint64(lbaSize),
+				SectorSize: pfs.sectorSize,
+				Bootable:   entry[0] == 0x80,
+			})
+			index++
+		}
+
+		next := ebr[462:478]
+		nextStart := binary.LittleEndian.Uint32(next[8:12])
+		if !isExtended(next[4]) || nextStart == 0 {
+			return nil
+		}
+		ebrLBA = extStart + uint64(nextStart)
 	}
+}
 
-	// Check signature
-	if string(header[0:8]) != "EFI PART" {
-		return fmt.Errorf("invalid GPT signature")
+// parseGPT parses a GPT partition table. The header is at LBA 1, which
+// gives the sector size when it is not set.
+func (pfs *FS) parseGPT() error {
+	header := make([]byte, 512)
+	if pfs.lbaSetting == 0 {
+		for ss := int64(512); ; ss *= 2 {
+			if ss > maxSectorSize {
+				return fsys.Corrupt("GPT header", -1, "invalid signature")
+			}
+			if _, err := pfs.r.ReadAt(header, ss); err != nil {
+				return fmt.Errorf("reading GPT header: %w", err)
+			}
+			if string(header[0:8]) == "EFI PART" {
+				pfs.sectorSize = ss
+				break
+			}
+		}
+	} else {
+		if _, err := pfs.r.ReadAt(header, pfs.sectorSize); err != nil {
+			return fmt.Errorf("reading GPT header: %w", err)
+		}
+		if string(header[0:8]) != "EFI PART" {
+			return fsys.Corrupt("GPT header", pfs.sectorSize, "invalid signature at LBA 1 with %d-byte sectors", pfs.sectorSize)
+		}
 	}
 
 	// Parse header fields
+	pfs.mbr, pfs.mbrErr = pfs.readMBR()
+
+	pfs.firstUsableLBA = binary.LittleEndian.Uint64(header[40:48])
+	pfs.lastUsableLBA = binary.LittleEndian.Uint64(header[48:56])
 	partitionEntryLBA := binary.LittleEndian.Uint64(header[72:80])
 	numPartitionEntries := binary.LittleEndian.Uint32(header[80:84])
 	partitionEntrySize := binary.LittleEndian.Uint32(header[84:88])
 
 	if partitionEntrySize < 128 {
-		return fmt.Errorf("invalid partition entry size: %d", partitionEntrySize)
+		return fsys.Corrupt("GPT header", pfs.sectorSize, "invalid partition entry size %d", partitionEntrySize)
 	}
 
+	// The backup entry array conventionally sits just before the backup
+	// header in the last sector
+	arraySectors := (uint64(numPartitionEntries)*uint64(partitionEntrySize) + uint64(pfs.sectorSize) - 1) / uint64(pfs.sectorSize)
+	alternateLBA := binary.LittleEndian.Uint64(header[32:40])
+	pfs.metadata = append(pfs.metadata,
+		pfs.sectors(1, 1),
+		pfs.sectors(partitionEntryLBA, arraySectors),
+		pfs.sectors(alternateLBA-min(alternateLBA, arraySectors), arraySectors+1))
+
 	// Read partition entries
-	entryOffset := int64(partitionEntryLBA) * 512
+	entryOffset := int64(partitionEntryLBA) * pfs.sectorSize
 	for i := uint32(0); i < numPartitionEntries; i++ {
 		entry := make([]byte, partitionEntrySize)
 		if _, err := pfs.r.ReadAt(entry, entryOffset+int64(i)*int64(partitionEntrySize)); err != nil {
@@ -156,12 +352,186 @@ func (pfs *FS) parseGPT() error {
 		name := decodeUTF16LE(entry[56:128])
 
 		pfs.partitions = append(pfs.partitions, &Partition{
-			Index:    len(pfs.partitions),
-			Name:     fmt.Sprintf("p%d", len(pfs.partitions)),
-			TypeGUID: typeGUID,
-			StartLBA: startLBA,
-			SizeLBA:  endLBA - startLBA + 1,
-			Label:    name,
+			Index:      len(pfs.partitions),
+			Name:       fmt.Sprintf("p%d", len(pfs.partitions)),
+			Table:      detect.GPT,
+			TypeGUID:   typeGUID,
+			StartLBA:   startLBA,
+			SizeLBA:    endLBA - startLBA + 1,
+			SectorSize: pfs.sectorSize,
+			Label:      name,
+		})
+	}
+
+	return nil
+}
+
+const (
+	bsdDiskMagic     = 0x82564557
+	bsdLabelSize     = 148 // Label header, followed by 16-byte partition entries
+	bsdRawPartition  = 2   // 'c', conventionally the whole slice or disk
+	bsdMaxPartitions = (512 - bsdLabelSize) / 16
+
+	sunVTOCSanity  = 0x600DDEEE
+	sunMagic       = 0xDABE
+	sunTagBackup   = 5 // Slice covering the whole disk
+	sunSPARCParts  = 8
+	sunX86MaxParts = 16
+)
+
+// parseBSDLabel parses a BSD disklabel in sector 1. Partition offsets are
+// absolute on some systems and relative to the slice on others; the raw
+// partition 'c' tells which, as it starts where the slice does.
+func (pfs *FS) parseBSDLabel() error {
+	label := make([]byte, 512)
+	if _, err := pfs.r.ReadAt(label, 512); err != nil {
+		return fmt.Errorf("reading disklabel: %w", err)
+	}
+	if binary.LittleEndian.Uint32(label[0:4]) != bsdDiskMagic ||
+		binary.LittleEndian.Uint32(label[132:136]) != bsdDiskMagic {
+		return fsys.Corrupt("disklabel", 512, "invalid magic")
+	}
+
+	secSize := binary.LittleEndian.Uint32(label[40:44])
+	if secSize < 512 || secSize%512 != 0 {
+		return fsys.Unsupported("disklabel sector size %d", secSize)
+	}
+	scale := uint64(secSize / 512)
+
+	numParts := int(binary.LittleEndian.Uint16(label[138:140]))
+	if numParts > bsdMaxPartitions {
+		return fsys.Corrupt("disklabel", 512, "%d partitions, at most %d fit a sector", numParts, bsdMaxPartitions)
+	}
+
+	// The checksum makes all 16-bit words of the label XOR to zero
+	var sum uint16
+	for i := 0; i < bsdLabelSize+16*numParts; i += 2 {
+		sum ^= binary.LittleEndian.Uint16(label[i : i+2])
+	}
+	if sum != 0 {
+		return fsys.Corrupt("disklabel", 512, "bad checksum")
+	}
+
+	var base uint64
+	if numParts > bsdRawPartition {
+		raw := label[bsdLabelSize+16*bsdRawPartition:]
+		base = uint64(binary.LittleEndian.Uint32(raw[4:8]))
+	}
+
+	for i := 0; i < numParts; i++ {
+		entry := label[bsdLabelSize+16*i : bsdLabelSize+16*(i+1)]
+		size := uint64(binary.LittleEndian.Uint32(entry[0:4]))
+		offset := uint64(binary.LittleEndian.Uint32(entry[4:8]))
+		if size == 0 || offset < base {
+			continue
+		}
+
+		pfs.partitions = append(pfs.partitions, &Partition{
+			Index:      i,
+			Name:       string(rune('a' + i)),
+			Table:      detect.BSDLabel,
+			Type:       entry[12],
+			StartLBA:   (offset - base) * scale,
+			SizeLBA:    size * scale,
+			SectorSize: 512,
+		})
+	}
+
+	return nil
+}
+
+// parseSunVTOC parses a Sun VTOC, either a SPARC disk label in sector 0
+// (big-endian, slices in cylinders) or an x86 VTOC in sector 1
+// (little-endian, slices in sectors)
+func (pfs *FS) parseSunVTOC() error {
+	label := make([]byte, 1024)
+	if _, err := pfs.r.ReadAt(label, 0); err != nil {
+		return fmt.Errorf("reading VTOC: %w", err)
+	}
+
+	if binary.BigEndian.Uint16(label[508:510]) == sunMagic {
+		return pfs.parseSunSPARC(label[:512])
+	}
+	if binary.LittleEndian.Uint32(label[512+12:512+16]) == sunVTOCSanity {
+		return pfs.parseSunX86(label[512:])
+	}
+	return fsys.Corrupt("VTOC", -1, "invalid magic")
+}
+
+// parseSunSPARC parses a SPARC disk label
+func (pfs *FS) parseSunSPARC(label []byte) error {
+	var sum uint16
+	for i := 0; i < 512; i += 2 {
+		sum ^= binary.BigEndian.Uint16(label[i : i+2])
+	}
+	if sum != 0 {
+		return fsys.Corrupt("Sun disk label", 0, "bad checksum")
+	}
+
+	// Slices start on a cylinder boundary
+	tracks := uint64(binary.BigEndian.Uint16(label[436:438]))
+	sectors := uint64(binary.BigEndian.Uint16(label[438:440]))
+	vtoc := binary.BigEndian.Uint32(label[188:192]) == sunVTOCSanity
+
+	for i := 0; i < sunSPARCParts; i++ {
+		entry := label[444+8*i : 444+8*(i+1)]
+		cylinder := uint64(binary.BigEndian.Uint32(entry[0:4]))
+		size := uint64(binary.BigEndian.Uint32(entry[4:8]))
+		if size == 0 {
+			continue
+		}
+
+		// The tags are only valid in labels with a VTOC
+		var tag byte
+		if vtoc {
+			tag = byte(binary.BigEndian.Uint16(label[142+4*i : 144+4*i]))
+		}
+		pfs.partitions = append(pfs.partitions, &Partition{
+			Index:      i,
+			Name:       fmt.Sprintf("s%d", i),
+			Table:      detect.SunVTOC,
+			Type:       tag,
+			StartLBA:   cylinder * tracks * sectors,
+			SizeLBA:    size,
+			SectorSize: 512,
+		})
+	}
+
+	return nil
+}
+
+// parseSunX86 parses an x86 Solaris VTOC
+func (pfs *FS) parseSunX86(vtoc []byte) error {
+	secSize := uint32(binary.LittleEndian.Uint16(vtoc[28:30]))
+	if secSize == 0 {
+		secSize = 512
+	}
+	if secSize%512 != 0 {
+		return fsys.Unsupported("VTOC sector size %d", secSize)
+	}
+	scale := uint64(secSize / 512)
+
+	numParts := int(binary.LittleEndian.Uint16(vtoc[30:32]))
+	if numParts > sunX86MaxParts {
+		return fsys.Unsupported("VTOC with %d slices (at most %d)", numParts, sunX86MaxParts)
+	}
+
+	for i := 0; i < numParts; i++ {
+		entry := vtoc[72+12*i : 72+12*(i+1)]
+		start := uint64(binary.LittleEndian.Uint32(entry[4:8]))
+		size := uint64(binary.LittleEndian.Uint32(entry[8:12]))
+		if size == 0 {
+			continue
+		}
+
+		pfs.partitions = append(pfs.partitions, &Partition{
+			Index:      i,
+			Name:       fmt.Sprintf("s%d", i),
+			Table:      detect.SunVTOC,
+			Type:       byte(binary.LittleEndian.Uint16(entry[0:2])),
+			StartLBA:   start * scale,
+			SizeLBA:    size * scale,
+			SectorSize: 512,
 		})
 	}
 
@@ -205,7 +575,50 @@ func (pfs *FS) Type() string {
 
 // Close releases resources
 func (pfs *FS) Close() error {
-	return nil
+	pfs.innerMu.Lock()
+	defer pfs.innerMu.Unlock()
+	var errs []error
+	for _, inner := range pfs.inner {
+		errs = append(errs, inner.Close())
+	}
+	pfs.inner = nil
+	return errors.Join(errs...)
+}
+
+// OpenInner returns the filesystem in the partition at name, such as p1 or
+// p1/p0, opening it with open the first time it is asked for with the same
+// opts, which must be comparable. The filesystem is kept until pfs is
+// closed, so that the metadata read to open it, such as an NTFS MFT, is not
+// read again for every use.
+func (pfs *FS) OpenInner(name string, opts any, open func(r io.ReaderAt, size int64) (fsys.FS, error)) (fsys.FS, error) {
+	_, part := pfs.resolve(cleanPath(name))
+	if part == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	pfs.innerMu.Lock()
+	defer pfs.innerMu.Unlock()
+	key := innerKey{part, opts}
+	if inner, ok := pfs.inner[key]; ok {
+		return inner, nil
+	}
+
+	// Read through the partition's extents, which writers can map back
+	// to the image
+	r, size, err := fsys.OpenReaderAt(pfs, name)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := open(r, size)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if pfs.inner == nil {
+		pfs.inner = make(map[innerKey]fsys.FS)
+	}
+	pfs.inner[key] = inner
+	return inner, nil
 }
 
 // BaseReader returns the underlying ReaderAt
@@ -220,7 +633,19 @@ func (pfs *FS) Info() string {
 	sb.WriteString(fmt.Sprintf("%-6s %-19s %12s %12s %s\n",
 		"NAME", "TYPE", "START", "SIZE", "LABEL"))
 
-	for _, p := range pfs.partitions {
+	writePartitionRows(&sb, pfs.partitions)
+
+	// A hybrid MBR offers a second view of the disk
+	if pfs.isHybrid() {
+		sb.WriteString("\nHybrid MBR:\n")
+		writePartitionRows(&sb, pfs.mbr)
+	}
+
+	return sb.String()
+}
+
+func writePartitionRows(sb *strings.Builder, partitions []*Partition) {
+	for _, p := range partitions {
 		typeStr := PartitionTypeString(p)
 		label := p.Label
 		if label == "" && p.Bootable {
@@ -233,8 +658,101 @@ func (pfs *FS) Info() string {
 			formatSize(p.SizeBytes()),
 			label))
 	}
+}
 
-	return sb.String()
+// isHybrid reports whether the MBR of a GPT disk lists partitions besides
+// the protective one
+func (pfs *FS) isHybrid() bool {
+	for _, p := range pfs.mbr {
+		if p.Type != mbrTypeProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// mbrTypeProtective is the MBR partition type covering a GPT disk
+const mbrTypeProtective = 0xEE
+
+// Check implements fsys.Checker. It reports MBR and GPT partitions that
+// overlap or extend past the image, and on a GPT disk a missing
+// protective MBR or hybrid MBR entries that disagree with the GPT.
+func (pfs *FS) Check() ([]fsys.Problem, error) {
+	if pfs.tableType != detect.MBR && pfs.tableType != detect.GPT {
+		return nil, nil
+	}
+
+	var problems []fsys.Problem
+
+	for i, p := range pfs.partitions {
+		if p.StartOffset()+p.SizeBytes() > pfs.size {
+			problems = append(problems, fsys.Problem{Kind: "beyond-end",
+				Detail: fmt.Sprintf("%s %s ends past the end of the image", p.Name, describeSpan(p))})
+		}
+		// Logical partitions lie within their extended partition
+		if isExtended(p.Type) && p.Table == detect.MBR {
+			continue
+		}
+		for _, q := range pfs.partitions[i+1:] {
+			if !(isExtended(q.Type) && q.Table == detect.MBR) && overlaps(p, q) {
+				problems = append(problems, fsys.Problem{Kind: "overlap",
+					Detail: fmt.Sprintf("%s %s overlaps %s %s", p.Name, describeSpan(p), q.Name, describeSpan(q))})
+			}
+		}
+	}
+
+	if pfs.tableType != detect.GPT {
+		return problems, nil
+	}
+	if pfs.mbrErr != nil {
+		problems = append(problems, fsys.Problem{Kind: "no-protective-mbr", Detail: pfs.mbrErr.Error()})
+		return problems, nil
+	}
+
+	protective := false
+	for _, m := range pfs.mbr {
+		if m.Type == mbrTypeProtective {
+			protective = true
+			continue
+		}
+
+		var match, overlap *Partition
+		for _, p := range pfs.partitions {
+			if p.StartOffset() == m.StartOffset() && p.SizeBytes() == m.SizeBytes() {
+				match = p
+				break
+			}
+			if overlap == nil && overlaps(p, m) {
+				overlap = p
+			}
+		}
+		switch {
+		case match != nil:
+		case overlap != nil:
+			problems = append(problems, fsys.Problem{Kind: "hybrid-mismatch",
+				Detail: fmt.Sprintf("MBR entry %d %s overlaps GPT %s %s without matching it",
+					m.Index, describeSpan(m), overlap.Name, describeSpan(overlap))})
+		default:
+			problems = append(problems, fsys.Problem{Kind: "hybrid-mismatch",
+				Detail: fmt.Sprintf("MBR entry %d %s has no GPT partition", m.Index, describeSpan(m))})
+		}
+	}
+	if !protective {
+		problems = append(problems, fsys.Problem{Kind: "no-protective-mbr",
+			Detail: "MBR has no protective (0xEE) entry for the GPT"})
+	}
+
+	return problems, nil
+}
+
+// overlaps reports whether two partitions share any bytes
+func overlaps(p, q *Partition) bool {
+	return p.StartOffset() < q.StartOffset()+q.SizeBytes() && q.StartOffset() < p.StartOffset()+p.SizeBytes()
+}
+
+// describeSpan formats a partition's extent in its table's sectors
+func describeSpan(p *Partition) string {
+	return fmt.Sprintf("(sectors %d-%d)", p.StartLBA, p.StartLBA+p.SizeLBA-1)
 }
 
 func truncate(s string, maxLen int) string {
@@ -266,66 +784,225 @@ func formatSize(bytes int64) string {
 	}
 }
 
-// FreeBlocks returns the list of free byte ranges (gaps between partitions)
-func (pfs *FS) FreeBlocks() ([]fsys.Range, error) {
-	// Sort partitions by start (they should be, but ensure it)
-	type partRange struct {
-		start int64
-		end   int64
+// Metadata returns the MBR entries of sector 0 and, on a GPT disk, the
+// GPT header and its entries, along with the partitions found. Partition
+// tables have no numbered records to decode.
+func (pfs *FS) Metadata(record int64) (any, error) {
+	if record >= 0 {
+		return nil, fmt.Errorf("%s has no numbered records", pfs.tableType)
 	}
-	var usedRanges []partRange
+	m := tableMeta{Table: pfs.tableType.String(), SectorSize: pfs.sectorSize}
 
-	for _, p := range pfs.partitions {
-		usedRanges = append(usedRanges, partRange{
-			start: p.StartOffset(),
-			end:   p.StartOffset() + p.SizeBytes(),
-		})
+	if pfs.tableType == detect.MBR || pfs.tableType == detect.GPT {
+		sector := make([]byte, 512)
+		if _, err := pfs.r.ReadAt(sector, 0); err != nil {
+			return nil, fmt.Errorf("reading MBR: %w", err)
+		}
+		for i := 0; i < 4; i++ {
+			entry := sector[446+i*16 : 446+(i+1)*16]
+			if entry[4] == 0 {
+				continue
+			}
+			m.MBR = append(m.MBR, mbrEntryMeta{
+				Index:    i,
+				Status:   entry[0],
+				Type:     entry[4],
+				StartLBA: binary.LittleEndian.Uint32(entry[8:12]),
+				SizeLBA:  binary.LittleEndian.Uint32(entry[12:16]),
+			})
+		}
 	}
 
-	// Sort by start
-	for i := 0; i < len(usedRanges); i++ {
-		for j := i + 1; j < len(usedRanges); j++ {
-			if usedRanges[j].start < usedRanges[i].start {
-				usedRanges[i], usedRanges[j] = usedRanges[j], usedRanges[i]
-			}
+	if pfs.tableType == detect.GPT {
+		gpt, err := pfs.gptMetadata()
+		if err != nil {
+			return nil, err
 		}
+		m.GPT = gpt
 	}
 
-	var freeRanges []fsys.Range
+	for _, p := range pfs.partitions {
+		pm := partitionMeta{
+			Name:     p.Name,
+			Table:    p.Table.String(),
+			Type:     p.Type,
+			StartLBA: p.StartLBA,
+			SizeLBA:  p.SizeLBA,
+			Bootable: p.Bootable,
+			Label:    p.Label,
+			Content:  p.Content.String(),
+		}
+		if !isZeroGUID(p.TypeGUID) {
+			pm.TypeGUID = formatGUID(p.TypeGUID)
+		}
+		m.Partitions = append(m.Partitions, pm)
+	}
 
-	// Reserved area at start
-	var reservedEnd int64
-	if pfs.tableType == detect.MBR {
-		reservedEnd = 512 // Just the MBR
-	} else {
-		reservedEnd = 34 * 512 // GPT header + entries
+	return m, nil
+}
+
+// gptMetadata decodes the primary GPT header and its used entries
+func (pfs *FS) gptMetadata() (*gptMeta, error) {
+	header := make([]byte, 92)
+	if _, err := pfs.r.ReadAt(header, pfs.sectorSize); err != nil {
+		return nil, fmt.Errorf("reading GPT header: %w", err)
+	}
+	var diskGUID [16]byte
+	copy(diskGUID[:], header[56:72])
+	g := &gptMeta{
+		Revision:       fmt.Sprintf("%d.%d", binary.LittleEndian.Uint16(header[10:12]), binary.LittleEndian.Uint16(header[8:10])),
+		HeaderSize:     binary.LittleEndian.Uint32(header[12:16]),
+		HeaderCRC32:    binary.LittleEndian.Uint32(header[16:20]),
+		CurrentLBA:     binary.LittleEndian.Uint64(header[24:32]),
+		BackupLBA:      binary.LittleEndian.Uint64(header[32:40]),
+		FirstUsableLBA: binary.LittleEndian.Uint64(header[40:48]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(header[48:56]),
+		DiskGUID:       formatGUID(diskGUID),
+		EntriesLBA:     binary.LittleEndian.Uint64(header[72:80]),
+		NumEntries:     binary.LittleEndian.Uint32(header[80:84]),
+		EntrySize:      binary.LittleEndian.Uint32(header[84:88]),
+		EntriesCRC32:   binary.LittleEndian.Uint32(header[88:92]),
 	}
 
-	// Find gaps
-	currentPos := reservedEnd
-	for _, r := range usedRanges {
-		if r.start > currentPos {
-			freeRanges = append(freeRanges, fsys.Range{Start: currentPos, End: r.start})
+	entry := make([]byte, g.EntrySize)
+	for i := uint32(0); i < g.NumEntries; i++ {
+		offset := int64(g.EntriesLBA)*pfs.sectorSize + int64(i)*int64(g.EntrySize)
+		if _, err := pfs.r.ReadAt(entry, offset); err != nil {
+			return nil, fmt.Errorf("reading GPT entry %d: %w", i, err)
 		}
-		if r.end > currentPos {
-			currentPos = r.end
+		var typeGUID, uniqueGUID [16]byte
+		copy(typeGUID[:], entry[0:16])
+		copy(uniqueGUID[:], entry[16:32])
+		if isZeroGUID(typeGUID) {
+			continue
 		}
+		g.Entries = append(g.Entries, gptEntryMeta{
+			Index:      i,
+			TypeGUID:   formatGUID(typeGUID),
+			UniqueGUID: formatGUID(uniqueGUID),
+			FirstLBA:   binary.LittleEndian.Uint64(entry[32:40]),
+			LastLBA:    binary.LittleEndian.Uint64(entry[40:48]),
+			Attributes: binary.LittleEndian.Uint64(entry[48:56]),
+			Name:       decodeUTF16LE(entry[56:128]),
+		})
+	}
+	return g, nil
+}
+
+// tableMeta is what Metadata returns
+type tableMeta struct {
+	Table      string          `json:"table"`
+	SectorSize int64           `json:"sectorSize"`
+	MBR        []mbrEntryMeta  `json:"mbr,omitempty"`
+	GPT        *gptMeta        `json:"gpt,omitempty"`
+	Partitions []partitionMeta `json:"partitions"`
+}
+
+type mbrEntryMeta struct {
+	Index    int    `json:"index"`
+	Status   uint8  `json:"status"`
+	Type     uint8  `json:"type"`
+	StartLBA uint32 `json:"startLBA"`
+	SizeLBA  uint32 `json:"sizeLBA"`
+}
+
+type gptMeta struct {
+	Revision       string         `json:"revision"`
+	HeaderSize     uint32         `json:"headerSize"`
+	HeaderCRC32    uint32         `json:"headerCRC32"`
+	CurrentLBA     uint64         `json:"currentLBA"`
+	BackupLBA      uint64         `json:"backupLBA"`
+	FirstUsableLBA uint64         `json:"firstUsableLBA"`
+	LastUsableLBA  uint64         `json:"lastUsableLBA"`
+	DiskGUID       string         `json:"diskGUID"`
+	EntriesLBA     uint64         `json:"entriesLBA"`
+	NumEntries     uint32         `json:"numEntries"`
+	EntrySize      uint32         `json:"entrySize"`
+	EntriesCRC32   uint32         `json:"entriesCRC32"`
+	Entries        []gptEntryMeta `json:"entries"`
+}
+
+type gptEntryMeta struct {
+	Index      uint32 `json:"index"`
+	TypeGUID   string `json:"typeGUID"`
+	UniqueGUID string `json:"uniqueGUID"`
+	FirstLBA   uint64 `json:"firstLBA"`
+	LastLBA    uint64 `json:"lastLBA"`
+	Attributes uint64 `json:"attributes"`
+	Name       string `json:"name"`
+}
+
+type partitionMeta struct {
+	Name     string `json:"name"`
+	Table    string `json:"table"`
+	Type     uint8  `json:"type,omitempty"` // MBR type, BSD fstype or Sun tag
+	TypeGUID string `json:"typeGUID,omitempty"`
+	StartLBA uint64 `json:"startLBA"`
+	SizeLBA  uint64 `json:"sizeLBA"`
+	Bootable bool   `json:"bootable,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Content  string `json:"content"`
+}
+
+// FreeBlocks returns the byte ranges of the disk outside all partitions
+// and table structures. The space an extended partition leaves between its
+// logical partitions is free, and so is the free space of nested tables.
+func (pfs *FS) FreeBlocks() ([]fsys.Range, error) {
+	used := append([]fsys.Range{pfs.sectors(0, 1)}, pfs.metadata...)
+	if pfs.tableType == detect.BSDLabel || pfs.tableType == detect.SunVTOC {
+		used = append(used, fsys.Range{Start: 0, End: min(2*512, pfs.size)}) // Boot sector and label
 	}
 
-	// Space after last partition
-	if currentPos < pfs.size {
-		endLimit := pfs.size
-		if pfs.tableType == detect.GPT {
-			endLimit = pfs.size - 33*512 // Backup GPT
+	for _, p := range pfs.partitions {
+		start := min(p.StartOffset(), pfs.size)
+		end := min(p.StartOffset()+p.SizeBytes(), pfs.size)
+		switch {
+		case p.Table == detect.MBR && isExtended(p.Type):
+			continue // Its EBRs and logical partitions are listed separately
+		case p.StartLBA == 0 && end >= pfs.size:
+			continue // A BSD 'c' or Sun backup slice aliasing the whole table
+		}
+		sub := pfs.nestedTable(p)
+		if sub == nil {
+			used = append(used, fsys.Range{Start: start, End: end})
+			continue
 		}
-		if currentPos < endLimit {
-			freeRanges = append(freeRanges, fsys.Range{Start: currentPos, End: endLimit})
+		free, err := sub.FreeBlocks()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
 		}
+		pos := start
+		for _, r := range free {
+			used = append(used, fsys.Range{Start: pos, End: min(start+r.Start, end)})
+			pos = min(start+r.End, end)
+		}
+		used = append(used, fsys.Range{Start: pos, End: end})
 	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
 
+	var freeRanges []fsys.Range
+	var pos int64
+	for _, r := range used {
+		if r.Start > pos {
+			freeRanges = append(freeRanges, fsys.Range{Start: pos, End: r.Start})
+		}
+		pos = max(pos, r.End)
+	}
+	if pos < pfs.size {
+		freeRanges = append(freeRanges, fsys.Range{Start: pos, End: pfs.size})
+	}
 	return freeRanges, nil
 }
 
+// sectors returns the byte range of count sectors from lba, clipped to
+// the disk
+func (pfs *FS) sectors(lba, count uint64) fsys.Range {
+	last := uint64(pfs.size / pfs.sectorSize)
+	lba = min(lba, last)
+	count = min(count, last-lba)
+	return fsys.Range{Start: int64(lba) * pfs.sectorSize, End: min(int64(lba+count)*pfs.sectorSize, pfs.size)}
+}
+
 // FileExtents returns the physical extents for a partition
 func (pfs *FS) FileExtents(name string) ([]fsys.Extent, error) {
 	name = cleanPath(name)
@@ -334,18 +1011,62 @@ func (pfs *FS) FileExtents(name string) ([]fsys.Extent, error) {
 		return nil, fmt.Errorf("cannot get extents for root")
 	}
 
-	part := pfs.findPartition(name)
+	table, part := pfs.resolve(name)
 	if part == nil {
 		return nil, fmt.Errorf("partition not found: %s", name)
 	}
 
 	return []fsys.Extent{{
 		Logical:  0,
-		Physical: part.StartOffset(),
+		Physical: table.offset + part.StartOffset(),
 		Length:   part.SizeBytes(),
 	}}, nil
 }
 
+// nestedTable returns the partition table inside partition p, or nil if
+// it holds none. MBR slices of BSD and Solaris usually hold a disklabel
+// or VTOC.
+func (pfs *FS) nestedTable(p *Partition) *FS {
+	pfs.nestedMu.Lock()
+	defer pfs.nestedMu.Unlock()
+	if sub, ok := pfs.nested[p]; ok {
+		return sub
+	}
+	pfs.nested[p] = nil
+
+	// A partition starting with its table, such as a BSD 'c' or Sun
+	// backup slice, holds the same table again
+	if !p.Content.IsPartitionTable() || p.StartLBA == 0 || pfs.depth+1 >= maxNestingDepth {
+		return nil
+	}
+	sub, err := openNested(pfs.section(p), p.SizeBytes(), p.Content, pfs.lbaSetting, pfs.offset+p.StartOffset(), pfs.depth+1)
+	if err != nil {
+		return nil // Not usable as a table; still readable as a partition
+	}
+	pfs.nested[p] = sub
+	return sub
+}
+
+// resolve finds the partition at a slash-separated path such as p1/p0,
+// descending into nested partition tables, and the table that lists it
+func (pfs *FS) resolve(name string) (*FS, *Partition) {
+	table := pfs
+	parts := strings.Split(name, "/")
+	for i, elem := range parts {
+		part := table.findPartition(elem)
+		if part == nil {
+			return nil, nil
+		}
+		if i == len(parts)-1 {
+			return table, part
+		}
+		if table = table.nestedTable(part); table == nil {
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
 // Partitions returns the list of partitions
 func (pfs *FS) Partitions() []*Partition {
 	return pfs.partitions
@@ -361,32 +1082,51 @@ func (pfs *FS) Open(name string) (fs.File, error) {
 	}
 
 	// Find partition
-	part := pfs.findPartition(name)
+	table, part := pfs.resolve(name)
 	if part == nil {
 		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
 	}
 
+	// A partition holding a partition table is a directory
+	if sub := table.nestedTable(part); sub != nil {
+		return &rootDir{pfs: sub, part: part}, nil
+	}
+
 	// Return partition as a file
-	return &partitionFile{pfs: pfs, part: part}, nil
+	return &partitionFile{pfs: table, part: part}, nil
 }
 
-// ReadDir implements fs.ReadDirFS
+// ReadDir implements fs.ReadDirFS. Partitions are listed in the order of
+// the table, which is that of their numbers, rather than by name.
 func (pfs *FS) ReadDir(name string) ([]fs.DirEntry, error) {
 	name = cleanPath(name)
 
 	// Root directory - list partitions
 	if name == "." || name == "" {
-		entries := make([]fs.DirEntry, 0, len(pfs.partitions))
-		for _, p := range pfs.partitions {
-			entries = append(entries, &partitionEntry{part: p})
-		}
-		return entries, nil
+		return pfs.entries(), nil
+	}
+
+	table, part := pfs.resolve(name)
+	if part == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if sub := table.nestedTable(part); sub != nil {
+		return sub.entries(), nil
 	}
 
 	// Partitions are files, not directories
 	return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
 }
 
+// entries returns the directory entries of the partitions in the table
+func (pfs *FS) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(pfs.partitions))
+	for _, p := range pfs.partitions {
+		entries = append(entries, &partitionEntry{part: p, dir: pfs.nestedTable(p) != nil})
+	}
+	return entries
+}
+
 // Stat implements fs.StatFS
 func (pfs *FS) Stat(name string) (fs.FileInfo, error) {
 	name = cleanPath(name)
@@ -397,12 +1137,12 @@ func (pfs *FS) Stat(name string) (fs.FileInfo, error) {
 	}
 
 	// Find partition
-	part := pfs.findPartition(name)
+	table, part := pfs.resolve(name)
 	if part == nil {
 		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
 	}
 
-	return &partitionInfo{part: part}, nil
+	return &partitionInfo{part: part, dir: table.nestedTable(part) != nil}, nil
 }
 
 func (pfs *FS) findPartition(name string) *Partition {
@@ -423,9 +1163,11 @@ func cleanPath(name string) string {
 	return name
 }
 
-// rootDir represents the root directory
+// rootDir represents the root directory, or a partition holding a
+// nested partition table
 type rootDir struct {
 	pfs    *FS
+	part   *Partition // The partition holding the table, nil for the root
 	offset int
 }
 
@@ -438,6 +1180,9 @@ func (d *rootDir) Close() error {
 }
 
 func (d *rootDir) Stat() (fs.FileInfo, error) {
+	if d.part != nil {
+		return &partitionInfo{part: d.part, dir: true}, nil
+	}
 	return &rootInfo{pfs: d.pfs}, nil
 }
 
@@ -458,10 +1203,7 @@ func (d *rootDir) ReadDir(n int) ([]fs.DirEntry, error) {
 		end = len(d.pfs.partitions)
 	}
 
-	entries := make([]fs.DirEntry, 0, end-d.offset)
-	for i := d.offset; i < end; i++ {
-		entries = append(entries, &partitionEntry{part: d.pfs.partitions[i]})
-	}
+	entries := d.pfs.entries()[d.offset:end]
 	d.offset = end
 	return entries, nil
 }
@@ -478,26 +1220,41 @@ func (i *rootInfo) ModTime() time.Time { return time.Time{} }
 func (i *rootInfo) IsDir() bool        { return true }
 func (i *rootInfo) Sys() any           { return nil }
 
-// partitionEntry represents a partition as a directory entry (file)
+// partitionEntry represents a partition as a directory entry: a file, or
+// a directory if it holds a nested partition table
 type partitionEntry struct {
 	part *Partition
+	dir  bool
 }
 
-func (e *partitionEntry) Name() string               { return e.part.Name }
-func (e *partitionEntry) IsDir() bool                { return false }
-func (e *partitionEntry) Type() fs.FileMode          { return 0 }
-func (e *partitionEntry) Info() (fs.FileInfo, error) { return &partitionInfo{part: e.part}, nil }
+func (e *partitionEntry) Name() string { return e.part.Name }
+func (e *partitionEntry) IsDir() bool  { return e.dir }
+func (e *partitionEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+func (e *partitionEntry) Info() (fs.FileInfo, error) {
+	return &partitionInfo{part: e.part, dir: e.dir}, nil
+}
 
 // partitionInfo provides FileInfo for a partition
 type partitionInfo struct {
 	part *Partition
+	dir  bool
 }
 
-func (i *partitionInfo) Name() string       { return i.part.Name }
-func (i *partitionInfo) Size() int64        { return i.part.SizeBytes() }
-func (i *partitionInfo) Mode() fs.FileMode  { return 0444 }
+func (i *partitionInfo) Name() string { return i.part.Name }
+func (i *partitionInfo) Size() int64  { return i.part.SizeBytes() }
+func (i *partitionInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
 func (i *partitionInfo) ModTime() time.Time { return time.Time{} }
-func (i *partitionInfo) IsDir() bool        { return false }
+func (i *partitionInfo) IsDir() bool        { return i.dir }
 func (i *partitionInfo) Sys() any           { return i.part }
 func (i *partitionInfo) Inode() uint64      { return uint64(i.part.Index) }
 
@@ -533,6 +1290,13 @@ func (f *partitionFile) Close() error {
 
 // PartitionTypeString returns a human-readable partition type
 func PartitionTypeString(p *Partition) string {
+	switch p.Table {
+	case detect.BSDLabel:
+		return bsdTypeString(p.Type)
+	case detect.SunVTOC:
+		return sunTagString(p.Type)
+	}
+
 	if p.Type != 0 {
 		// MBR type
 		switch p.Type {
@@ -552,10 +1316,18 @@ func PartitionTypeString(p *Partition) string {
 			return "Linux"
 		case 0x8E:
 			return "Linux LVM"
-		case 0xEE:
+		case mbrTypeProtective:
 			return "GPT Protective"
 		case 0xEF:
 			return "EFI System"
+		case 0xA5:
+			return "FreeBSD"
+		case 0xA6:
+			return "OpenBSD"
+		case 0xA9:
+			return "NetBSD"
+		case 0xBF:
+			return "Solaris"
 		default:
 			return fmt.Sprintf("0x%02X", p.Type)
 		}
@@ -610,3 +1382,345 @@ func formatGUID(guid [16]byte) string {
 		guid[8], guid[9],
 		guid[10], guid[11], guid[12], guid[13], guid[14], guid[15])
 }
+
+// bsdTypeString names a BSD disklabel fstype
+func bsdTypeString(t byte) string {
+	switch t {
+	case 0:
+		return "Unused"
+	case 1:
+		return "BSD swap"
+	case 7:
+		return "BSD 4.2 (UFS)"
+	case 8:
+		return "MSDOS"
+	case 9:
+		return "BSD LFS"
+	case 11:
+		return "HPFS"
+	case 12:
+		return "ISO9660"
+	case 13:
+		return "Boot"
+	case 14:
+		return "Vinum"
+	case 15:
+		return "RAID"
+	case 17:
+		return "ext2"
+	case 18:
+		return "NTFS"
+	case 27:
+		return "ZFS"
+	default:
+		return fmt.Sprintf("fstype %d", t)
+	}
+}
+
+// sunTagString names a Sun VTOC slice tag
+func sunTagString(t byte) string {
+	switch t {
+	case 0:
+		return "Unassigned"
+	case 1:
+		return "Sun boot"
+	case 2:
+		return "Sun root"
+	case 3:
+		return "Sun swap"
+	case 4:
+		return "Sun usr"
+	case sunTagBackup:
+		return "Sun backup"
+	case 6:
+		return "Sun stand"
+	case 7:
+		return "Sun var"
+	case 8:
+		return "Sun home"
+	case 9:
+		return "Sun alt sector"
+	case 10:
+		return "Sun cache"
+	case 11:
+		return "Sun reserved"
+	default:
+		return fmt.Sprintf("tag %d", t)
+	}
+}
+
+// parseGUID reads a GUID written as formatGUID writes it
+func parseGUID(s string) ([16]byte, error) {
+	var guid [16]byte
+	hex := strings.ReplaceAll(s, "-", "")
+	if len(s) != 36 || len(hex) != 32 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return guid, fmt.Errorf("bad GUID %q", s)
+	}
+	for i := range guid {
+		n, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return guid, fmt.Errorf("bad GUID %q", s)
+		}
+		guid[i] = byte(n)
+	}
+	// The first three groups are little-endian
+	slices.Reverse(guid[0:4])
+	slices.Reverse(guid[4:6])
+	slices.Reverse(guid[6:8])
+	return guid, nil
+}
+
+// partitionTypes are the MBR types and GPT type GUIDs LookupType knows by
+// name
+var partitionTypes = map[string]struct {
+	mbr byte
+	gpt string
+}{
+	"efi":   {0xEF, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+	"fat12": {0x01, "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"},
+	"fat16": {0x0E, "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"},
+	"fat32": {0x0C, "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"},
+	"ntfs":  {0x07, "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"},
+	"linux": {0x83, "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+	"swap":  {0x82, "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"},
+	"lvm":   {0x8E, "E6D6D379-F507-44C2-A23C-238F2A3DF928"},
+	"raid":  {0xFD, "A19D880F-05FC-4D3B-A006-743F0F84911E"},
+	"apfs":  {0xAF, "7C3457EF-0000-11AA-AA11-00306543ECAC"},
+	"hfs":   {0xAF, "48465300-0000-11AA-AA11-00306543ECAC"},
+}
+
+// LookupType returns the MBR type and GPT type GUID of a partition type
+// given by name (efi, fat12, fat16, fat32, ntfs, linux, swap, lvm, raid,
+// apfs or hfs), as an MBR type such as 0x83, or as a GUID. An MBR type
+// has no GUID, and a GUID no MBR type.
+func LookupType(name string) (byte, [16]byte, error) {
+	if t, ok := partitionTypes[strings.ToLower(name)]; ok {
+		guid, err := parseGUID(t.gpt)
+		return t.mbr, guid, err
+	}
+	if n, err := strconv.ParseUint(name, 0, 8); err == nil && n != 0 {
+		return byte(n), [16]byte{}, nil
+	}
+	guid, err := parseGUID(name)
+	if err != nil || isZeroGUID(guid) {
+		return 0, guid, fmt.Errorf("unknown partition type %q", name)
+	}
+	return 0, guid, nil
+}
+
+// NewPartition is a partition for Create to lay out
+type NewPartition struct {
+	Size     int64    // Bytes, rounded up to whole sectors
+	Type     byte     // MBR partition type
+	TypeGUID [16]byte // GPT partition type
+	GUID     [16]byte // GPT unique partition GUID, random when zero
+	Label    string   // GPT partition name
+	Bootable bool     // MBR active flag
+}
+
+// CreateOptions describes the table Create writes
+type CreateOptions struct {
+	Table      detect.Type // detect.MBR or detect.GPT
+	SectorSize int64       // Bytes per LBA, 512 when 0
+	Align      int64       // Partitions start at multiples of this many bytes, 1 MiB when 0
+	Size       int64       // Bytes of the disk, just enough for the partitions when 0
+	DiskGUID   [16]byte    // GPT disk GUID, or MBR disk signature in its first 4 bytes; random when zero
+}
+
+const (
+	defaultAlign   = 1 << 20
+	gptEntries     = 128 // Entries of a GPT array, however many are used
+	gptEntrySize   = 128
+	gptHeaderSize  = 92
+	gptRevision    = 0x00010000
+	maxGPTLabelLen = 36 // UTF-16 code units
+)
+
+// Create lays parts out one after another, each at the next multiple of
+// the alignment, and writes a partition table for them to w. It returns
+// the partitions as Open would read them and the size of the disk, which
+// the caller extends w to. Only the table is written, with the space
+// before the first partition zeroed; the partitions are left as they are.
+func Create(w io.WriterAt, parts []NewPartition, opts CreateOptions) ([]*Partition, int64, error) {
+	ss := cmp.Or(opts.SectorSize, 512)
+	align := cmp.Or(opts.Align, defaultAlign)
+	if ss < 512 || ss > maxSectorSize || ss&(ss-1) != 0 {
+		return nil, 0, fmt.Errorf("bad sector size %d", ss)
+	}
+	if align <= 0 || align%ss != 0 {
+		return nil, 0, fmt.Errorf("alignment %d is not a multiple of the %d-byte sector", align, ss)
+	}
+	if opts.Size%ss != 0 {
+		return nil, 0, fmt.Errorf("disk size %d is not a multiple of the %d-byte sector", opts.Size, ss)
+	}
+
+	// The GPT header and entry array follow the MBR, and their backups end
+	// the disk
+	var first, trailer uint64 = 1, 0
+	switch opts.Table {
+	case detect.MBR:
+		if len(parts) > 4 {
+			return nil, 0, fmt.Errorf("an MBR holds 4 partitions, not %d", len(parts))
+		}
+	case detect.GPT:
+		if len(parts) > gptEntries {
+			return nil, 0, fmt.Errorf("a GPT holds %d partitions, not %d", gptEntries, len(parts))
+		}
+		trailer = uint64(gptEntries*gptEntrySize/ss) + 1
+		first = 1 + trailer
+	default:
+		return nil, 0, fmt.Errorf("cannot create a %s table (use MBR or GPT)", opts.Table)
+	}
+
+	var partitions []*Partition
+	next, step := first, uint64(align/ss)
+	for i, np := range parts {
+		if np.Size <= 0 {
+			return nil, 0, fmt.Errorf("partition %d: size %d", i, np.Size)
+		}
+		p := &Partition{
+			Index:      i,
+			Name:       fmt.Sprintf("p%d", i),
+			Table:      opts.Table,
+			StartLBA:   (next + step - 1) / step * step,
+			SizeLBA:    uint64((np.Size + ss - 1) / ss),
+			SectorSize: ss,
+		}
+		if opts.Table == detect.MBR {
+			if np.Type == 0 {
+				return nil, 0, fmt.Errorf("partition %d has no MBR type", i)
+			}
+			p.Type, p.Bootable = np.Type, np.Bootable
+		} else {
+			if isZeroGUID(np.TypeGUID) {
+				return nil, 0, fmt.Errorf("partition %d has no GPT type", i)
+			}
+			if len(utf16.Encode([]rune(np.Label))) > maxGPTLabelLen {
+				return nil, 0, fmt.Errorf("partition %d: label %q is longer than %d characters", i, np.Label, maxGPTLabelLen)
+			}
+			p.TypeGUID, p.Label = np.TypeGUID, np.Label
+		}
+		partitions = append(partitions, p)
+		next = p.StartLBA + p.SizeLBA
+	}
+
+	sectors := next + trailer
+	if opts.Size != 0 {
+		if uint64(opts.Size/ss) < sectors {
+			return nil, 0, fmt.Errorf("the partitions need %d bytes, more than the disk's %d", int64(sectors)*ss, opts.Size)
+		}
+		sectors = uint64(opts.Size / ss)
+	}
+	if opts.Table == detect.MBR && next > 1<<32 {
+		return nil, 0, fmt.Errorf("the partitions end past sector 2^32, beyond an MBR")
+	}
+
+	diskGUID := opts.DiskGUID
+	if isZeroGUID(diskGUID) {
+		diskGUID = randomGUID()
+	}
+	firstStart := first
+	if len(partitions) > 0 {
+		firstStart = partitions[0].StartLBA
+	}
+	head := make([]byte, int64(firstStart)*ss)
+	mbr := head[:512]
+	copy(mbr[440:444], diskGUID[:4])
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	if opts.Table == detect.MBR {
+		for i, p := range partitions {
+			putMBREntry(mbr[446+16*i:], p.Type, p.Bootable, p.StartLBA, p.SizeLBA)
+		}
+		if _, err := w.WriteAt(head, 0); err != nil {
+			return nil, 0, err
+		}
+		return partitions, int64(sectors) * ss, nil
+	}
+
+	putMBREntry(mbr[446:], mbrTypeProtective, false, 1, min(sectors-1, 1<<32-1))
+	array := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range partitions {
+		guid := parts[i].GUID
+		if isZeroGUID(guid) {
+			guid = randomGUID()
+		}
+		entry := array[i*gptEntrySize:]
+		copy(entry[0:16], p.TypeGUID[:])
+		copy(entry[16:32], guid[:])
+		binary.LittleEndian.PutUint64(entry[32:], p.StartLBA)
+		binary.LittleEndian.PutUint64(entry[40:], p.StartLBA+p.SizeLBA-1)
+		for j, c := range utf16.Encode([]rune(p.Label)) {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+
+	// The backup header points at the backup array, before it at the end
+	backupArray := sectors - trailer
+	copy(head[ss:], gptHeader(1, sectors-1, first, backupArray-1, 2, diskGUID, array))
+	copy(head[2*ss:], array)
+	tail := make([]byte, int64(trailer)*ss)
+	copy(tail, array)
+	copy(tail[int64(trailer-1)*ss:], gptHeader(sectors-1, 1, first, backupArray-1, backupArray, diskGUID, array))
+	if _, err := w.WriteAt(head, 0); err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.WriteAt(tail, int64(backupArray)*ss); err != nil {
+		return nil, 0, err
+	}
+	return partitions, int64(sectors) * ss, nil
+}
+
+// gptHeader returns a GPT header at LBA self for the entry array at LBA
+// entries
+func gptHeader(self, alternate, firstUsable, lastUsable, entries uint64, diskGUID [16]byte, array []byte) []byte {
+	h := make([]byte, gptHeaderSize)
+	copy(h[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(h[8:], gptRevision)
+	binary.LittleEndian.PutUint32(h[12:], gptHeaderSize)
+	binary.LittleEndian.PutUint64(h[24:], self)
+	binary.LittleEndian.PutUint64(h[32:], alternate)
+	binary.LittleEndian.PutUint64(h[40:], firstUsable)
+	binary.LittleEndian.PutUint64(h[48:], lastUsable)
+	copy(h[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(h[72:], entries)
+	binary.LittleEndian.PutUint32(h[80:], gptEntries)
+	binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(array))
+	binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+	return h
+}
+
+// putMBREntry fills in a 16-byte MBR partition entry
+func putMBREntry(entry []byte, partType byte, bootable bool, start, size uint64) {
+	if bootable {
+		entry[0] = 0x80
+	}
+	copy(entry[1:4], chs(start))
+	entry[4] = partType
+	copy(entry[5:8], chs(start+size-1))
+	binary.LittleEndian.PutUint32(entry[8:], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(size))
+}
+
+// chs returns the cylinder-head-sector address of an LBA on a disk of 255
+// heads and 63 sectors a track, as an MBR entry holds it, or the largest
+// address for an LBA beyond 1023 cylinders
+func chs(lba uint64) []byte {
+	const heads, sectors = 255, 63
+	c := lba / (heads * sectors)
+	if c > 1023 {
+		return []byte{0xFE, 0xFF, 0xFF}
+	}
+	h, s := lba/sectors%heads, lba%sectors+1
+	return []byte{byte(h), byte(s) | byte(c>>8)<<6, byte(c)}
+}
+
+// randomGUID returns a random (version 4) GUID
+func randomGUID() [16]byte {
+	var guid [16]byte
+	rand.Read(guid[:])
+	guid[7] = guid[7]&0x0F | 0x40 // Version, in the little-endian third group
+	guid[8] = guid[8]&0x3F | 0x80 // Variant
+	return guid
+}
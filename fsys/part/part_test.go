@@ -0,0 +1,676 @@
+package part
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lvdlvd/rawhide/detect"
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// putEntry writes an MBR partition entry at off
+func putEntry(b []byte, off int, partType byte, start, size uint32) {
+	b[off+4] = partType
+	binary.LittleEndian.PutUint32(b[off+8:], start)
+	binary.LittleEndian.PutUint32(b[off+12:], size)
+}
+
+func TestFreeBlocksExtended(t *testing.T) {
+	// A 1000-sector disk with a primary partition at 10-99 and an extended
+	// partition at 200-899 holding logicals at 210-299 and 400-499
+	image := make([]byte, 1000*512)
+	sig := func(lba int) { image[lba*512+510], image[lba*512+511] = 0x55, 0xAA }
+	putEntry(image, 446, 0x83, 10, 90)
+	putEntry(image, 462, 0x05, 200, 700)
+	sig(0)
+	putEntry(image[200*512:], 446, 0x83, 10, 90)
+	putEntry(image[200*512:], 462, 0x05, 150, 200)
+	sig(200)
+	putEntry(image[350*512:], 446, 0x83, 50, 100)
+	sig(350)
+
+	pfs, err := Open(bytes.NewReader(image), int64(len(image)), detect.MBR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, err := pfs.FreeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]int64
+	for _, r := range free {
+		got = append(got, [2]int64{r.Start / 512, r.End / 512})
+	}
+	want := [][2]int64{{1, 10}, {100, 200}, {201, 210}, {300, 350}, {351, 400}, {500, 1000}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("free sectors = %v, want %v", got, want)
+	}
+}
+
+func TestEBRChain(t *testing.T) {
+	// EBRs in an extended partition at 200-899 of a 1000-sector disk. Each
+	// holds a logical partition relative to itself and links to the next
+	// EBR relative to the extended partition.
+	type ebr struct {
+		lba                  int
+		start, size          uint32
+		next                 uint32
+		noSignature, ext0x0F bool
+	}
+	tests := []struct {
+		name string
+		ebrs []ebr
+		want string // Logical partitions as name:start+size
+		bad  bool   // Whether the chain is corrupt
+	}{
+		{"single", []ebr{{lba: 200, start: 10, size: 90}}, "p4:210+90", false},
+		{"chain", []ebr{{lba: 200, start: 10, size: 90, next: 150}, {lba: 350, start: 50, size: 100, next: 500}, {lba: 700, start: 1, size: 199}},
+			"p4:210+90 p5:400+100 p6:701+199", false},
+		{"0x0F link", []ebr{{lba: 200, start: 10, size: 90, next: 150, ext0x0F: true}, {lba: 350, start: 50, size: 100}}, "p4:210+90 p5:400+100", false},
+		// An EBR with no logical partition still links on, and does not
+		// use up a number
+		{"empty EBR", []ebr{{lba: 200, next: 100}, {lba: 300, start: 10, size: 50}}, "p4:310+50", false},
+		{"loop", []ebr{{lba: 200, start: 10, size: 90, next: 150}, {lba: 350, start: 50, size: 50, next: 250}, {lba: 450, start: 1, size: 9, next: 150}}, "", true},
+		{"self loop", []ebr{{lba: 200, start: 10, size: 90, next: 150}, {lba: 350, start: 50, size: 100, next: 150}}, "", true},
+		{"bad signature", []ebr{{lba: 200, start: 10, size: 90, next: 150}, {lba: 350, start: 50, size: 100, noSignature: true}}, "", true},
+	}
+	for _, tt := range tests {
+		image := make([]byte, 1000*512)
+		putEntry(image, 446, 0x83, 10, 90)
+		putEntry(image, 462, 0x05, 200, 700)
+		image[510], image[511] = 0x55, 0xAA
+		for _, e := range tt.ebrs {
+			b := image[e.lba*512:]
+			if e.size != 0 {
+				putEntry(b, 446, 0x83, e.start, e.size)
+			}
+			if e.next != 0 {
+				putEntry(b, 462, 0x05, e.next, 100)
+				if e.ext0x0F {
+					b[462+4] = 0x0F
+				}
+			}
+			if !e.noSignature {
+				b[510], b[511] = 0x55, 0xAA
+			}
+		}
+
+		pfs, err := Open(bytes.NewReader(image), int64(len(image)), detect.MBR)
+		var corrupt *fsys.ErrCorruptMetadata
+		if tt.bad {
+			if !errors.As(err, &corrupt) {
+				t.Errorf("%s: Open = %v, want corrupt metadata", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, p := range pfs.Partitions()[2:] {
+			got = append(got, fmt.Sprintf("%s:%d+%d", p.Name, p.StartLBA, p.SizeLBA))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: logical partitions %v, want %s", tt.name, got, tt.want)
+		}
+		if problems, _ := pfs.Check(); len(problems) != 0 {
+			t.Errorf("%s: Check = %v", tt.name, problems)
+		}
+	}
+}
+
+// putBSDLabel writes a disklabel with partitions of {size, offset} in
+// secSize sectors into sector 1 of b, with its checksum
+func putBSDLabel(b []byte, secSize uint32, parts [][2]uint32) {
+	label := b[512:1024]
+	binary.LittleEndian.PutUint32(label[0:], bsdDiskMagic)
+	binary.LittleEndian.PutUint32(label[40:], secSize)
+	binary.LittleEndian.PutUint32(label[132:], bsdDiskMagic)
+	binary.LittleEndian.PutUint16(label[138:], uint16(len(parts)))
+	for i, p := range parts {
+		entry := label[bsdLabelSize+16*i:]
+		binary.LittleEndian.PutUint32(entry[0:], p[0])
+		binary.LittleEndian.PutUint32(entry[4:], p[1])
+		entry[12] = 7 // 4.2BSD
+	}
+	var sum uint16
+	for i := 0; i < bsdLabelSize+16*len(parts); i += 2 {
+		sum ^= binary.LittleEndian.Uint16(label[i:])
+	}
+	binary.LittleEndian.PutUint16(label[136:], sum)
+}
+
+func TestBSDLabel(t *testing.T) {
+	// Disklabels in an MBR slice (type 0xA5) at 100-899 of a 1000-sector
+	// disk, with offsets relative to the slice or to the disk
+	tests := []struct {
+		name    string
+		secSize uint32
+		parts   [][2]uint32
+		want    string // Partitions as name:start+size, in 512-byte sectors
+		bad     bool
+	}{
+		{"relative", 512, [][2]uint32{{100, 16}, {200, 116}, {800, 0}}, "a:16+100 b:116+200 c:0+800", false},
+		{"absolute", 512, [][2]uint32{{100, 116}, {200, 216}, {800, 100}}, "a:16+100 b:116+200 c:0+800", false},
+		// Partitions starting before the slice are not in it
+		{"outside the slice", 512, [][2]uint32{{100, 116}, {50, 20}, {800, 100}, {0, 0}, {300, 400}}, "a:16+100 c:0+800 e:300+300", false},
+		{"2048-byte sectors", 2048, [][2]uint32{{25, 4}, {0, 0}, {200, 0}}, "a:16+100 c:0+800", false},
+		{"no raw partition", 512, [][2]uint32{{100, 16}}, "a:16+100", false},
+		{"1000-byte sectors", 1000, [][2]uint32{{100, 16}}, "", true},
+	}
+	for _, tt := range tests {
+		image := make([]byte, 1000*512)
+		putEntry(image, 446, 0xA5, 100, 800)
+		image[510], image[511] = 0x55, 0xAA
+		putBSDLabel(image[100*512:], tt.secSize, tt.parts)
+
+		mbr, err := Open(bytes.NewReader(image), int64(len(image)), detect.MBR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := mbr.Partitions()[0]; p.Content != detect.BSDLabel {
+			t.Errorf("%s: slice holds %v", tt.name, p.Content)
+		}
+		label, err := Open(mbr.section(mbr.Partitions()[0]), 800*512, detect.BSDLabel)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: Open succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, p := range label.Partitions() {
+			got = append(got, fmt.Sprintf("%s:%d+%d", p.Name, p.StartLBA, p.SizeLBA))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: partitions %v, want %s", tt.name, got, tt.want)
+		}
+
+		// Through the MBR, the label's partitions are in the slice's directory
+		if info, err := fs.Stat(mbr, "p0/a"); err != nil || info.Size() != 100*512 {
+			t.Errorf("%s: p0/a: %v", tt.name, err)
+		}
+	}
+
+	// Labels whose checksum does not match, or with more partitions than
+	// fit, are refused
+	for _, damage := range []func(label []byte){
+		func(label []byte) { label[bsdLabelSize]++ },
+		func(label []byte) { binary.LittleEndian.PutUint16(label[138:], bsdMaxPartitions+1) },
+	} {
+		image := make([]byte, 16*512)
+		putBSDLabel(image, 512, [][2]uint32{{8, 0}})
+		damage(image[512:])
+		var corrupt *fsys.ErrCorruptMetadata
+		if _, err := Open(bytes.NewReader(image), int64(len(image)), detect.BSDLabel); !errors.As(err, &corrupt) {
+			t.Errorf("Open of a damaged label = %v, want corrupt metadata", err)
+		}
+	}
+}
+
+// putSunLabel writes a SPARC disk label with slices of {cylinder, size}
+// and tags into sector 0 of b, with its checksum
+func putSunLabel(b []byte, tracks, sectors uint16, slices [][2]uint32, tags []uint16) {
+	label := b[:512]
+	binary.BigEndian.PutUint32(label[188:], sunVTOCSanity)
+	for i, tag := range tags {
+		binary.BigEndian.PutUint16(label[142+4*i:], tag)
+	}
+	binary.BigEndian.PutUint16(label[436:], tracks)
+	binary.BigEndian.PutUint16(label[438:], sectors)
+	for i, s := range slices {
+		binary.BigEndian.PutUint32(label[444+8*i:], s[0])
+		binary.BigEndian.PutUint32(label[448+8*i:], s[1])
+	}
+	binary.BigEndian.PutUint16(label[508:], sunMagic)
+	var sum uint16
+	for i := 0; i < 510; i += 2 {
+		sum ^= binary.BigEndian.Uint16(label[i:])
+	}
+	binary.BigEndian.PutUint16(label[510:], sum)
+}
+
+// putSunX86VTOC writes an x86 VTOC with slices of {tag, start, size} into
+// sector 1 of b
+func putSunX86VTOC(b []byte, secSize uint16, slices [][3]uint32) {
+	vtoc := b[512:1024]
+	binary.LittleEndian.PutUint32(vtoc[12:], sunVTOCSanity)
+	binary.LittleEndian.PutUint16(vtoc[28:], secSize)
+	binary.LittleEndian.PutUint16(vtoc[30:], uint16(len(slices)))
+	for i, s := range slices {
+		entry := vtoc[72+12*i:]
+		binary.LittleEndian.PutUint16(entry[0:], uint16(s[0]))
+		binary.LittleEndian.PutUint32(entry[4:], s[1])
+		binary.LittleEndian.PutUint32(entry[8:], s[2])
+	}
+}
+
+func TestSunVTOC(t *testing.T) {
+	// 1000-sector disks, SPARC ones with 10-sector cylinders
+	tests := []struct {
+		name  string
+		label func(b []byte)
+		want  string // Slices as name:tag:start+size
+		bad   bool
+	}{
+		{"SPARC", func(b []byte) {
+			putSunLabel(b, 2, 5, [][2]uint32{{0, 100}, {10, 200}, {0, 1000}}, []uint16{2, 3, sunTagBackup})
+		}, "s0:2:0+100 s1:3:100+200 s2:5:0+1000", false},
+		{"SPARC gap", func(b []byte) {
+			putSunLabel(b, 2, 5, [][2]uint32{{1, 100}, {0, 0}, {0, 1000}, {0, 0}, {0, 0}, {0, 0}, {0, 0}, {90, 100}}, []uint16{2, 0, sunTagBackup})
+		}, "s0:2:10+100 s2:5:0+1000 s7:0:900+100", false},
+		// A slice running past the end of the disk is listed as it is
+		{"SPARC out of range", func(b []byte) {
+			putSunLabel(b, 2, 5, [][2]uint32{{0, 100}, {95, 100}}, []uint16{2, 4})
+		}, "s0:2:0+100 s1:4:950+100", false},
+		{"SPARC bad checksum", func(b []byte) {
+			putSunLabel(b, 2, 5, [][2]uint32{{0, 100}}, nil)
+			b[444]++
+		}, "", true},
+		{"x86", func(b []byte) {
+			putSunX86VTOC(b, 512, [][3]uint32{{2, 16, 484}, {3, 500, 400}, {sunTagBackup, 0, 1000}})
+		}, "s0:2:16+484 s1:3:500+400 s2:5:0+1000", false},
+		{"x86 2048-byte sectors", func(b []byte) {
+			putSunX86VTOC(b, 2048, [][3]uint32{{2, 4, 121}, {0, 0, 0}, {sunTagBackup, 0, 250}})
+		}, "s0:2:16+484 s2:5:0+1000", false},
+		{"x86 out of range", func(b []byte) {
+			putSunX86VTOC(b, 512, [][3]uint32{{2, 16, 484}, {3, 900, 400}})
+		}, "s0:2:16+484 s1:3:900+400", false},
+		{"x86 too many slices", func(b []byte) {
+			putSunX86VTOC(b, 512, make([][3]uint32, sunX86MaxParts+1))
+		}, "", true},
+	}
+	for _, tt := range tests {
+		image := make([]byte, 1000*512)
+		for i := range image {
+			image[i] = byte(i / 512)
+		}
+		tt.label(image)
+
+		if typ, _ := detect.Detect(bytes.NewReader(image)); typ != detect.SunVTOC && !tt.bad {
+			t.Errorf("%s: detected as %v", tt.name, typ)
+		}
+		pfs, err := Open(bytes.NewReader(image), int64(len(image)), detect.SunVTOC)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: Open succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, p := range pfs.Partitions() {
+			got = append(got, fmt.Sprintf("%s:%d:%d+%d", p.Name, p.Type, p.StartLBA, p.SizeLBA))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: slices %v, want %s", tt.name, got, tt.want)
+		}
+
+		// Reading a slice stops at the end of the disk
+		for _, p := range pfs.Partitions() {
+			data, err := fs.ReadFile(pfs, p.Name)
+			if want := min(p.SizeBytes(), int64(len(image))-p.StartOffset()); err != nil || int64(len(data)) != want {
+				t.Errorf("%s: read %d bytes of %s, want %d: %v", tt.name, len(data), p.Name, want, err)
+			} else if !bytes.Equal(data[:512], image[p.StartOffset():][:512]) {
+				t.Errorf("%s: %s does not start at sector %d", tt.name, p.Name, p.StartLBA)
+			}
+		}
+	}
+}
+
+// innerFS is a filesystem opened in a partition, counting its Closes
+type innerFS struct {
+	fstest.MapFS
+	size   int64
+	closed int
+}
+
+func (f *innerFS) Type() string { return "inner" }
+func (f *innerFS) Close() error { f.closed++; return nil }
+
+func TestOpenInner(t *testing.T) {
+	image := make([]byte, 1000*512)
+	putEntry(image, 446, 0x83, 10, 90)
+	putEntry(image, 462, 0x83, 100, 200)
+	image[510], image[511] = 0x55, 0xAA
+	pfs, err := Open(bytes.NewReader(image), int64(len(image)), detect.MBR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opened []*innerFS
+	open := func(r io.ReaderAt, size int64) (fsys.FS, error) {
+		f := &innerFS{size: size}
+		opened = append(opened, f)
+		return f, nil
+	}
+	a, err := pfs.OpenInner("p0", "opts", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := pfs.OpenInner("p0", "opts", open); b != a || len(opened) != 1 {
+		t.Errorf("p0 opened %d times, want once", len(opened))
+	}
+	if b, _ := pfs.OpenInner("p0", "other", open); b == a || len(opened) != 2 {
+		t.Errorf("p0 with other options shared the first filesystem")
+	}
+	if c, _ := pfs.OpenInner("p1", "opts", open); c == a || c.(*innerFS).size != 200*512 {
+		t.Errorf("p1 shared p0's filesystem or got the wrong size")
+	}
+	if _, err := pfs.OpenInner("p7", "opts", open); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("OpenInner(p7) = %v, want ErrNotExist", err)
+	}
+
+	failing := func(io.ReaderAt, int64) (fsys.FS, error) { return nil, errors.New("no filesystem") }
+	if _, err := pfs.OpenInner("p1", "failing", failing); err == nil {
+		t.Error("OpenInner succeeded with a failing open")
+	}
+
+	if err := pfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range opened {
+		if f.closed != 1 {
+			t.Errorf("filesystem %d closed %d times, want once", i, f.closed)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	esp, _, _ := LookupType("efi")
+	linux, _, _ := LookupType("linux")
+	_, linuxGUID, _ := LookupType("linux")
+	_, espGUID, _ := LookupType("EFI")
+	parts := []NewPartition{
+		{Size: 1 << 20, Type: esp, TypeGUID: espGUID, Label: "EFI system", Bootable: true},
+		{Size: 3<<20 + 100, Type: linux, TypeGUID: linuxGUID, Label: "root"},
+	}
+
+	for _, tt := range []struct {
+		table      detect.Type
+		sectorSize int64
+		size       int64
+	}{
+		{detect.MBR, 512, 0},
+		{detect.GPT, 512, 0},
+		{detect.GPT, 4096, 16 << 20},
+	} {
+		img := imageWriter(make([]byte, 32<<20))
+		created, size, err := Create(img, parts, CreateOptions{Table: tt.table, SectorSize: tt.sectorSize, Size: tt.size})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.table, err)
+		}
+		// The second partition starts at the next MiB after the first
+		if created[0].StartOffset() != 1<<20 || created[1].StartOffset() != 2<<20 || created[1].SizeBytes() != 3<<20+tt.sectorSize {
+			t.Errorf("%s: partitions at %d and %d", tt.table, created[0].StartOffset(), created[1].StartOffset())
+		}
+		want := 5<<20 + tt.sectorSize
+		if tt.table == detect.GPT {
+			want = max(tt.size, want+(16<<10+tt.sectorSize))
+		}
+		if size != want {
+			t.Errorf("%s: size %d", tt.table, size)
+		}
+
+		pfs, err := Open(bytes.NewReader(img[:size]), size, tt.table)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.table, err)
+		}
+		if pfs.sectorSize != tt.sectorSize {
+			t.Errorf("%s: read with %d-byte sectors", tt.table, pfs.sectorSize)
+		}
+		for i, p := range pfs.Partitions() {
+			if fmt.Sprint(*p) != fmt.Sprint(*created[i]) {
+				t.Errorf("%s: read %+v, want %+v", tt.table, *p, *created[i])
+			}
+		}
+		if problems, err := pfs.Check(); len(problems) != 0 || err != nil {
+			t.Errorf("%s: Check = %v, %v", tt.table, problems, err)
+		}
+		if tt.table == detect.GPT {
+			checkGPT(t, img[:size], tt.sectorSize)
+		}
+	}
+
+	if _, _, err := Create(imageWriter(make([]byte, 1<<20)), make([]NewPartition, 5), CreateOptions{Table: detect.MBR}); err == nil {
+		t.Error("Create made an MBR of 5 partitions")
+	}
+	if _, _, err := Create(imageWriter(make([]byte, 1<<20)), parts, CreateOptions{Table: detect.GPT, Size: 4 << 20}); err == nil {
+		t.Error("Create put 4 MiB of partitions on a 4 MiB disk")
+	}
+	if _, _, err := Create(imageWriter(make([]byte, 1<<20)), parts[:1], CreateOptions{Table: detect.GPT, Align: 1000}); err == nil {
+		t.Error("Create aligned to 1000 bytes")
+	}
+}
+
+func TestSectorSize(t *testing.T) {
+	// An MBR disk of 4096-byte sectors, with a primary partition at
+	// 10-99 and a logical one at 210-299 behind an EBR at 200
+	mbr := make([]byte, 1000*4096)
+	putEntry(mbr, 446, 0x83, 10, 90)
+	putEntry(mbr, 462, 0x05, 200, 700)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	putEntry(mbr[200*4096:], 446, 0x83, 10, 90)
+	mbr[200*4096+510], mbr[200*4096+511] = 0x55, 0xAA
+	for i := range mbr[10*4096 : 100*4096] {
+		mbr[10*4096+i] = byte(i / 4096)
+	}
+
+	gpt := func(ss int64) []byte {
+		img := imageWriter(make([]byte, 16<<20))
+		_, size, err := Create(img, []NewPartition{{Size: 1 << 20, TypeGUID: [16]byte{1}}}, CreateOptions{Table: detect.GPT, SectorSize: ss})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img[:size]
+	}
+	gpt512, gpt4096 := gpt(512), gpt(4096)
+
+	tests := []struct {
+		name       string
+		image      []byte
+		table      detect.Type
+		sectorSize int   // Passed to OpenSectorSize
+		want       int64 // Sector size read with, or 0 if the table is refused
+		starts     []int64
+	}{
+		// With 512-byte sectors, the EBR is not where the MBR points
+		{"MBR 4096 read as 512", mbr, detect.MBR, 0, 0, nil},
+		{"MBR 4096", mbr, detect.MBR, 4096, 4096, []int64{10 * 4096, 200 * 4096, 210 * 4096}},
+		{"GPT 512", gpt512, detect.GPT, 0, 512, []int64{1 << 20}},
+		{"GPT 4096", gpt4096, detect.GPT, 0, 4096, []int64{1 << 20}},
+		{"GPT 4096 set", gpt4096, detect.GPT, 4096, 4096, []int64{1 << 20}},
+		{"GPT 4096 read as 512", gpt4096, detect.GPT, 512, 0, nil},
+		{"GPT 512 read as 4096", gpt512, detect.GPT, 4096, 0, nil},
+		{"not a power of two", gpt512, detect.GPT, 1000, 0, nil},
+		{"too small", gpt512, detect.GPT, 256, 0, nil},
+	}
+	for _, tt := range tests {
+		pfs, err := OpenSectorSize(bytes.NewReader(tt.image), int64(len(tt.image)), tt.table, tt.sectorSize)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("%s: OpenSectorSize succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if pfs.sectorSize != tt.want {
+			t.Errorf("%s: read with %d-byte sectors", tt.name, pfs.sectorSize)
+		}
+		var starts []int64
+		for _, p := range pfs.Partitions() {
+			starts = append(starts, p.StartOffset())
+			if p.SectorSize != tt.want {
+				t.Errorf("%s: %s has %d-byte sectors", tt.name, p.Name, p.SectorSize)
+			}
+		}
+		if !slices.Equal(starts, tt.starts) {
+			t.Errorf("%s: partitions at %v, want %v", tt.name, starts, tt.starts)
+		}
+	}
+
+	// The partitions of the 4096-byte MBR are read where they are
+	pfs, err := OpenSectorSize(bytes.NewReader(mbr), int64(len(mbr)), detect.MBR, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(pfs, "p0")
+	if err != nil || len(data) != 90*4096 || data[4096] != 1 || data[len(data)-1] != 89 {
+		t.Errorf("p0 read wrongly: %d bytes, %v", len(data), err)
+	}
+	if problems, err := pfs.Check(); len(problems) != 0 || err != nil {
+		t.Errorf("Check = %v, %v", problems, err)
+	}
+}
+
+func TestHybridMBR(t *testing.T) {
+	// A GPT with partitions at sectors 2048-4095 and 4096-10239, under
+	// various MBRs
+	img := imageWriter(make([]byte, 16<<20))
+	parts := []NewPartition{{Size: 1 << 20, TypeGUID: [16]byte{1}}, {Size: 3 << 20, TypeGUID: [16]byte{2}}}
+	_, size, err := Create(img, parts, CreateOptions{Table: detect.GPT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpt := img[:size]
+
+	type entry struct {
+		partType    byte
+		start, size uint32
+	}
+	protective := entry{mbrTypeProtective, 1, 2047}
+	tests := []struct {
+		name    string
+		entries []entry // nil for no MBR signature
+		hybrid  bool
+		want    []string // Kinds of the problems found
+	}{
+		{"protective", []entry{{mbrTypeProtective, 1, uint32(size/512 - 1)}}, false, nil},
+		{"matching", []entry{protective, {0x0C, 2048, 2048}}, true, nil},
+		{"matching both", []entry{protective, {0x0C, 2048, 2048}, {0x83, 4096, 6144}}, true, nil},
+		{"overlapping", []entry{protective, {0x0C, 2048, 4096}}, true, []string{"hybrid-mismatch"}},
+		{"missing", []entry{protective, {0x83, 20000, 1000}}, true, []string{"hybrid-mismatch"}},
+		{"no protective entry", []entry{{0x0C, 2048, 2048}}, true, []string{"no-protective-mbr"}},
+		{"no MBR", nil, false, []string{"no-protective-mbr"}},
+	}
+	for _, tt := range tests {
+		image := slices.Clone(gpt)
+		clear(image[446:512])
+		for i, e := range tt.entries {
+			putEntry(image, 446+16*i, e.partType, e.start, e.size)
+		}
+		if tt.entries != nil {
+			image[510], image[511] = 0x55, 0xAA
+		}
+
+		pfs, err := Open(bytes.NewReader(image), int64(len(image)), detect.GPT)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if pfs.isHybrid() != tt.hybrid {
+			t.Errorf("%s: isHybrid = %v", tt.name, pfs.isHybrid())
+		}
+		if strings.Contains(pfs.Info(), "Hybrid MBR") != tt.hybrid {
+			t.Errorf("%s: Info shows the MBR: %v", tt.name, !tt.hybrid)
+		}
+		problems, err := pfs.Check()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var kinds []string
+		for _, p := range problems {
+			kinds = append(kinds, p.Kind)
+		}
+		if !slices.Equal(kinds, tt.want) {
+			t.Errorf("%s: Check = %v, want %v", tt.name, problems, tt.want)
+		}
+
+		// The MBR is the other view of a hybrid disk
+		if tt.hybrid {
+			mbr, err := Open(bytes.NewReader(image), int64(len(image)), detect.MBR)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if n := len(mbr.Partitions()); n != len(tt.entries) {
+				t.Errorf("%s: MBR view has %d partitions, want %d", tt.name, n, len(tt.entries))
+			}
+		}
+	}
+}
+
+// checkGPT checks the CRCs of both headers of a GPT and that they point
+// at each other
+func checkGPT(t *testing.T, img []byte, ss int64) {
+	t.Helper()
+	last := uint64(len(img))/uint64(ss) - 1
+	for _, lba := range []uint64{1, last} {
+		h := slices.Clone(img[int64(lba)*ss:][:92])
+		self, alternate := binary.LittleEndian.Uint64(h[24:]), binary.LittleEndian.Uint64(h[32:])
+		if self != lba || alternate != 1+last-lba {
+			t.Errorf("header at LBA %d says it is at %d with its other copy at %d", lba, self, alternate)
+		}
+		entries := int64(binary.LittleEndian.Uint64(h[72:])) * ss
+		if crc := binary.LittleEndian.Uint32(h[88:]); crc != crc32.ChecksumIEEE(img[entries:entries+128*128]) {
+			t.Errorf("header at LBA %d: bad entry array CRC", lba)
+		}
+		crc := binary.LittleEndian.Uint32(h[16:])
+		clear(h[16:20])
+		if crc != crc32.ChecksumIEEE(h) {
+			t.Errorf("header at LBA %d: bad CRC", lba)
+		}
+	}
+}
+
+func TestLookupType(t *testing.T) {
+	tests := []struct {
+		name string
+		mbr  byte
+		gpt  string
+		ok   bool
+	}{
+		{"efi", 0xEF, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", true},
+		{"Linux", 0x83, "0FC63DAF-8483-4772-8E79-3D69D8477DE4", true},
+		{"0x0c", 0x0C, "00000000-0000-0000-0000-000000000000", true},
+		{"0fc63daf-8483-4772-8e79-3d69d8477de4", 0, "0FC63DAF-8483-4772-8E79-3D69D8477DE4", true},
+		{"0", 0, "", false},
+		{"0x100", 0, "", false},
+		{"bogus", 0, "", false},
+		{"0FC63DAF-8483-4772-8E79-3D69D8477DE", 0, "", false},
+	}
+	for _, tt := range tests {
+		mbr, gpt, err := LookupType(tt.name)
+		if (err == nil) != tt.ok || tt.ok && (mbr != tt.mbr || formatGUID(gpt) != tt.gpt) {
+			t.Errorf("LookupType(%q) = %#x, %s, %v", tt.name, mbr, formatGUID(gpt), err)
+		}
+	}
+}
+
+// imageWriter writes into a byte slice
+type imageWriter []byte
+
+func (w imageWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(w)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(w[off:], p), nil
+}
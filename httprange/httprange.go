@@ -0,0 +1,327 @@
+// Package httprange reads a file on an HTTP(S) server as an io.ReaderAt,
+// fetching the parts read with Range requests. The file is read in chunks,
+// the chunks of one read are fetched in parallel, and the chunks last read
+// are kept in memory, so that an image on a web server or in cloud storage
+// (an S3 presigned URL, say) can be browsed without downloading it.
+package httprange
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChunkSize is the size of the pieces a file is fetched in
+const ChunkSize = 1 << 20
+
+// DefaultCacheSize is the memory a Reader keeps chunks in unless told
+// otherwise
+const DefaultCacheSize = 64 << 20
+
+const (
+	maxParallel = 8 // Requests a Reader has open at once
+	maxAttempts = 3 // Tries at a chunk before a read fails
+	retryDelay  = 500 * time.Millisecond
+)
+
+// Reader reads a file on an HTTP server. It is safe for concurrent use,
+// and reads of a chunk already being fetched wait for it.
+type Reader struct {
+	client    *http.Client
+	ownClient bool // Whether Close may close the client's idle connections
+	url       string
+	size      int64
+	validator string // ETag or Last-Modified of the file, for If-Range
+	sem       chan struct{}
+
+	mu        sync.Mutex
+	maxChunks int
+	lru       *list.List // Of *chunk, most recently used first
+	chunks    map[int64]*list.Element
+}
+
+// chunk is a piece of the file, fetched or being fetched
+type chunk struct {
+	index int64
+	data  []byte
+	err   error
+	done  chan struct{} // Closed when data or err is set
+}
+
+// IsURL reports whether name is an HTTP or HTTPS URL rather than a file name
+func IsURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// Open returns a reader of the file at url, with a client of its own. The
+// server must answer Range requests; the first chunk is fetched to learn
+// the size of the file, as URLs signed for GET may not allow HEAD.
+func Open(rawURL string) (*Reader, error) {
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	r, err := OpenClient(client, rawURL)
+	if err != nil {
+		client.CloseIdleConnections()
+		return nil, err
+	}
+	r.ownClient = true
+	return r, nil
+}
+
+// OpenClient is Open with the requests made by client, which Close leaves
+// alone
+func OpenClient(client *http.Client, rawURL string) (*Reader, error) {
+	r := &Reader{
+		client: client,
+		url:    rawURL,
+		sem:    make(chan struct{}, maxParallel),
+		lru:    list.New(),
+		chunks: make(map[int64]*list.Element),
+	}
+	r.SetCacheSize(DefaultCacheSize)
+
+	resp, size, err := r.get(0, ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	r.size = size
+	if r.validator = resp.Header.Get("ETag"); r.validator == "" || strings.HasPrefix(r.validator, "W/") {
+		r.validator = resp.Header.Get("Last-Modified")
+	}
+
+	c := &chunk{index: 0, done: make(chan struct{})}
+	c.data, c.err = readChunk(resp, min(size, ChunkSize))
+	close(c.done)
+	if c.err != nil {
+		return nil, c.err
+	}
+	r.mu.Lock()
+	r.add(c)
+	r.mu.Unlock()
+	return r, nil
+}
+
+// parseContentRange returns the first and last byte and the size of the
+// file from a Content-Range header, bytes first-last/size
+func parseContentRange(contentRange string) (first, last, size int64, err error) {
+	rng, total, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "/")
+	firstArg, lastArg, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("bad Content-Range %q", contentRange)
+	}
+	first, err1 := strconv.ParseInt(firstArg, 10, 64)
+	last, err2 := strconv.ParseInt(lastArg, 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, 0, fmt.Errorf("bad Content-Range %q", contentRange)
+	}
+	size, err = strconv.ParseInt(total, 10, 64)
+	if err != nil || size <= last {
+		return 0, 0, 0, fmt.Errorf("server does not give the size of the file (Content-Range %q)", contentRange)
+	}
+	return first, last, size, nil
+}
+
+// Size returns the size of the file
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// SetCacheSize changes the memory kept chunks may use, evicting chunks to
+// fit; 0 keeps none beyond the reads they are fetched for
+func (r *Reader) SetCacheSize(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxChunks = int(max(size, 0) / ChunkSize)
+	r.evict()
+}
+
+// evict drops the least recently used chunks over the limit; r.mu is held
+func (r *Reader) evict() {
+	for r.lru.Len() > r.maxChunks {
+		c := r.lru.Remove(r.lru.Back()).(*chunk)
+		delete(r.chunks, c.index)
+	}
+}
+
+// add puts a chunk in the cache; r.mu is held
+func (r *Reader) add(c *chunk) {
+	r.chunks[c.index] = r.lru.PushFront(c)
+	r.evict()
+}
+
+// ReadAt implements io.ReaderAt. The chunks a read spans that are not in
+// memory are fetched in parallel.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), r.size)
+
+	// Start every fetch before waiting for the first
+	var chunks []*chunk
+	for index := off / ChunkSize; index*ChunkSize < end; index++ {
+		chunks = append(chunks, r.chunk(index))
+	}
+
+	n := 0
+	for _, c := range chunks {
+		<-c.done
+		if c.err != nil {
+			return n, c.err
+		}
+		pos := off + int64(n)
+		n += copy(p[n:end-off], c.data[pos-c.index*ChunkSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk returns chunk index from memory, or starts fetching it
+func (r *Reader) chunk(index int64) *chunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.chunks[index]; ok {
+		r.lru.MoveToFront(e)
+		return e.Value.(*chunk)
+	}
+
+	c := &chunk{index: index, done: make(chan struct{})}
+	r.add(c)
+	go r.fetch(c)
+	return c
+}
+
+// fetch reads a chunk from the server, trying again after a network or
+// server error. A chunk that cannot be read is dropped, so that a later
+// read tries again.
+func (r *Reader) fetch(c *chunk) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+
+	start := c.index * ChunkSize
+	length := min(r.size-start, ChunkSize)
+	for attempt := 1; ; attempt++ {
+		c.data, c.err = r.fetchRange(start, length)
+		var se *statusError
+		if c.err == nil || attempt == maxAttempts || errors.As(c.err, &se) && se.code < 500 {
+			break
+		}
+		time.Sleep(retryDelay * time.Duration(attempt))
+	}
+
+	if c.err != nil {
+		c.err = fmt.Errorf("reading at offset %d: %w", start, c.err)
+		r.mu.Lock()
+		if e, ok := r.chunks[c.index]; ok && e.Value == c {
+			r.lru.Remove(e)
+			delete(r.chunks, c.index)
+		}
+		r.mu.Unlock()
+	}
+	close(c.done)
+}
+
+// fetchRange reads length bytes from start
+func (r *Reader) fetchRange(start, length int64) ([]byte, error) {
+	resp, _, err := r.get(start, length)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readChunk(resp, length)
+}
+
+// get requests length bytes from start, fewer at the end of the file, and
+// checks that the server sent just those, of the same version of the
+// file. It returns the size of the file the server gave.
+func (r *Reader) get(start, length int64) (*http.Response, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if r.validator != "" {
+		req.Header.Set("If-Range", r.validator)
+	}
+	// The URL is left out of errors, as it may be signed
+	resp, err := r.client.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		err := &statusError{resp.StatusCode, "server answered " + resp.Status}
+		switch {
+		case resp.StatusCode == http.StatusOK && r.validator != "":
+			err.msg = "file changed on the server while being read"
+		case resp.StatusCode == http.StatusOK:
+			err.msg = "server does not support range requests"
+		}
+		return nil, 0, err
+	}
+
+	// A proxy or server that sends some other range would corrupt reads
+	first, last, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, &statusError{resp.StatusCode, err.Error()}
+	}
+	var msg string
+	switch {
+	case r.size != 0 && size != r.size:
+		msg = fmt.Sprintf("file changed on the server while being read (size %d, was %d)", size, r.size)
+	case first != start || last != min(start+length, size)-1:
+		msg = fmt.Sprintf("server sent bytes %d-%d of %d for %d-%d", first, last, size, start, start+length-1)
+	}
+	if msg != "" {
+		resp.Body.Close()
+		return nil, 0, &statusError{resp.StatusCode, msg}
+	}
+	return resp, size, nil
+}
+
+// statusError is an unexpected answer from the server, which is only
+// tried again for a server error
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// readChunk reads the body of a response to a request for length bytes
+func readChunk(resp *http.Response, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close drops the cached chunks, and the idle connections to the server
+// of a client the reader made itself
+func (r *Reader) Close() error {
+	r.SetCacheSize(0)
+	if r.ownClient {
+		r.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package httprange
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server serves data with range requests, counting the requests
+func server(data []byte, etag *atomic.Value, requests *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if etag != nil {
+			w.Header().Set("ETag", etag.Load().(string))
+		}
+		http.ServeContent(w, req, "disk.img", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestReadAt(t *testing.T) {
+	data := make([]byte, 5*ChunkSize+100)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	var requests atomic.Int64
+	srv := server(data, nil, &requests)
+	defer srv.Close()
+
+	r, err := Open(srv.URL + "/disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("Size() = %d, want %d", r.Size(), len(data))
+	}
+
+	tests := []struct {
+		off, length int64
+	}{
+		{0, 512},
+		{ChunkSize - 10, 20},
+		{ChunkSize / 2, 3 * ChunkSize},
+		{int64(len(data)) - 50, 50},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, tt.length)
+		if n, err := r.ReadAt(buf, tt.off); n != len(buf) || err != nil {
+			t.Errorf("ReadAt(%d, %d) = %d, %v", tt.off, tt.length, n, err)
+		} else if !bytes.Equal(buf, data[tt.off:tt.off+tt.length]) {
+			t.Errorf("ReadAt(%d, %d) read the wrong data", tt.off, tt.length)
+		}
+	}
+
+	// Each chunk read, all but the fifth, was fetched once
+	if got := requests.Load(); got != 5 {
+		t.Errorf("%d requests, want 5", got)
+	}
+
+	buf := make([]byte, 200)
+	if n, err := r.ReadAt(buf, int64(len(data))-100); n != 100 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v, want 100, EOF", n, err)
+	}
+	if n, err := r.ReadAt(buf, int64(len(data))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	data := make([]byte, 4*ChunkSize)
+	for i := range data {
+		data[i] = byte(i / 511)
+	}
+	var requests atomic.Int64
+	srv := server(data, nil, &requests)
+	defer srv.Close()
+
+	r, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			off := int64(g) * ChunkSize / 3
+			buf := make([]byte, ChunkSize)
+			if n, err := r.ReadAt(buf, off); n != len(buf) || err != nil {
+				t.Errorf("ReadAt(%d) = %d, %v", off, n, err)
+			} else if !bytes.Equal(buf, data[off:off+ChunkSize]) {
+				t.Errorf("ReadAt(%d) read the wrong data", off)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Reads of a chunk being fetched wait for it
+	if got := requests.Load(); got != 4 {
+		t.Errorf("%d requests, want 4", got)
+	}
+}
+
+func TestNoRanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+
+	_, err := Open(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "range requests") {
+		t.Errorf("Open = %v, want an error about range requests", err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var requests atomic.Int64
+	srv := server(data, &etag, &requests)
+	defer srv.Close()
+
+	r, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	etag.Store(`"v2"`)
+	buf := make([]byte, 10)
+	if _, err := r.ReadAt(buf, ChunkSize); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("ReadAt = %v, want an error about the file changing", err)
+	}
+}
+
+func TestWrongRange(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Always the first chunk, whatever was asked for
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", ChunkSize-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:ChunkSize])
+	}))
+	defer srv.Close()
+
+	r, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 10)
+	if _, err := r.ReadAt(buf, ChunkSize); err == nil || !strings.Contains(err.Error(), "server sent bytes") {
+		t.Errorf("ReadAt = %v, want an error about the range sent", err)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header             string
+		first, last, total int64
+		ok                 bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, true},
+		{"bytes 100-199/200", 100, 199, 200, true},
+		{"bytes 0-99/*", 0, 0, 0, false},
+		{"bytes 0-199/100", 0, 0, 0, false},
+		{"bytes 50-10/100", 0, 0, 0, false},
+		{"items 0-99/1000", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		first, last, total, err := parseContentRange(tt.header)
+		if (err == nil) != tt.ok || tt.ok && (first != tt.first || last != tt.last || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v", tt.header, first, last, total, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package imagefs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	blkSSZGet    = 0x1268                                     // BLKSSZGET
+	blkGetSize64 = 0x80001272 | unsafe.Sizeof(uintptr(0))<<16 // BLKGETSIZE64, _IOR(0x12, 114, size_t)
+)
+
+// deviceSize returns the size of a block device
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if err := ioctl(f, blkGetSize64, unsafe.Pointer(&size)); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// deviceSectorSize returns the logical sector size of a block device,
+// which reads with O_DIRECT must be aligned to
+func deviceSectorSize(f *os.File) (int, error) {
+	var size int32
+	if err := ioctl(f, blkSSZGet, unsafe.Pointer(&size)); err != nil {
+		return 0, err
+	}
+	return int(size), nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openDirect opens a file or device for reading around the page cache
+func openDirect(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+}
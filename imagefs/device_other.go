@@ -0,0 +1,24 @@
+//go:build !linux
+
+package imagefs
+
+import (
+	"errors"
+	"os"
+)
+
+// deviceSize returns the size of a block device; openPath falls back on
+// seeking to its end
+func deviceSize(f *os.File) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// deviceSectorSize returns the logical sector size of a block device
+func deviceSectorSize(f *os.File) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// openDirect opens a file or device for reading around the page cache
+func openDirect(path string) (*os.File, error) {
+	return nil, errors.New("direct I/O is only supported on Linux")
+}
@@ -0,0 +1,508 @@
+// Package imagefs opens disk images the way the rawhide command does: it
+// decrypts them if given a key, detects the partition table or filesystem
+// in them, and opens it as an fsys.FS. Images nested inside a filesystem,
+// such as a partition or a disk image file, are opened the same way with
+// OpenFile, so other programs can browse images without running rawhide.
+//
+//	img, err := imagefs.OpenImage("disk.img", imagefs.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer img.Close()
+//	p1, err := imagefs.OpenFile(img.FS, "p1", imagefs.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer imagefs.CloseFile(img.FS, p1)
+//	data, err := fs.ReadFile(p1, "Windows/System32/config/SYSTEM")
+package imagefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/lvdlvd/rawhide/detect"
+	"github.com/lvdlvd/rawhide/fsys"
+	"github.com/lvdlvd/rawhide/fsys/apfs"
+	"github.com/lvdlvd/rawhide/fsys/ext"
+	"github.com/lvdlvd/rawhide/fsys/hfsplus"
+	"github.com/lvdlvd/rawhide/fsys/part"
+	"github.com/lvdlvd/rawhide/httprange"
+	"github.com/lvdlvd/rawhide/mapping"
+	"github.com/lvdlvd/rawhide/nbd"
+	"github.com/lvdlvd/rawhide/xts"
+
+	// Filesystems without options, opened by the Openers they register
+	_ "github.com/lvdlvd/rawhide/fsys/fat"
+	_ "github.com/lvdlvd/rawhide/fsys/ntfs"
+)
+
+// Options select how an image is opened where it offers a choice; each is
+// ignored by the formats it does not apply to. The zero value opens images
+// as the rawhide command does without flags.
+type Options struct {
+	Key             []byte // XTS-AES key the image is encrypted with, nil if it is not
+	SectorSize      int    // XTS sector size, 512 if 0
+	SuperblockGroup int    // ext superblock copy by block group, 0 for the primary with fallback to the backups, or PrimarySuperblock
+	Volume          int    // APFS volume index
+	Replay          bool   // Whether the HFS+ journal is applied
+	LBASize         int    // Partition table sector size, 0 for automatic
+	Table           string // Partition table to trust on a disk with both MBR and GPT, "" for GPT
+
+	// ReadTimeout fails reads of the image that take longer, 0 for no
+	// limit; only OpenImageContext and OpenImage apply it
+	ReadTimeout time.Duration
+
+	// Direct reads an image file or device with O_DIRECT, around the page
+	// cache, on Linux; only OpenImageContext and OpenImage apply it
+	Direct bool
+
+	// Mmap reads an image file by mapping it into memory, which saves a
+	// system call for each of the small reads of metadata, where the
+	// system can map it; it is ignored with Direct and for devices, and
+	// only OpenImageContext and OpenImage apply it
+	Mmap bool
+
+	// Mapping takes the path given to OpenImageContext or OpenImage for a
+	// table of the pieces the image is made of, read by package mapping
+	Mapping bool
+
+	// FillErrors, if not nil, has the sectors of the image that cannot be
+	// read read as zeros, and is called with each run of them; only
+	// OpenImageContext and OpenImage apply it
+	FillErrors func(bad fsys.Range, err error)
+
+	// WrapSource, if not nil, wraps the image as read from its file,
+	// device or URL, to watch what is read from it, as an
+	// fsys.HashingReaderAt does; only OpenImageContext and OpenImage apply
+	// it
+	WrapSource func(r io.ReaderAt, size int64) io.ReaderAt
+}
+
+// PrimarySuperblock is the SuperblockGroup that uses the primary ext
+// superblock even if it is damaged, without falling back to a backup
+const PrimarySuperblock = -1
+
+// Image is an image file, NBD export or file on a web server with the
+// filesystem or partition table in it
+type Image struct {
+	FS     fsys.FS
+	Size   int64
+	closer io.Closer
+	fill   *fsys.FillReaderAt // With Options.FillErrors
+}
+
+// Unreadable returns the byte ranges of the image read as zeros so far
+// because they could not be read, with Options.FillErrors
+func (img *Image) Unreadable() []fsys.Range {
+	if img.fill == nil {
+		return nil
+	}
+	return img.fill.Unreadable()
+}
+
+// Close closes the filesystem and the image
+func (img *Image) Close() error {
+	err := img.FS.Close()
+	if cerr := img.closer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// OpenImage opens an image file, the remote export an NBD URL names
+// (nbd://host[:port]/export or nbd+unix:///export?socket=path), or the
+// file an HTTP or HTTPS URL names, read with range requests
+func OpenImage(path string, opts Options) (*Image, error) {
+	return OpenImageContext(context.Background(), path, opts)
+}
+
+// OpenImageContext is OpenImage with reads of the image, by the filesystem
+// and everything opened from it, failing once ctx is done
+func OpenImageContext(ctx context.Context, path string, opts Options) (*Image, error) {
+	var r io.ReaderAt
+	var size int64
+	var closer io.Closer
+	var err error
+	if opts.Mapping {
+		var m *mapping.Reader
+		m, err = mapping.Open(path, func(name string) (io.ReaderAt, int64, io.Closer, error) {
+			return openPath(name, opts)
+		})
+		if err == nil {
+			r, size, closer = m, m.Size(), m
+		}
+	} else {
+		r, size, closer, err = openPath(path, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+
+	// An NBD client times out on its connection itself, so that a read
+	// given up on does not keep it busy
+	timeout := opts.ReadTimeout
+	if client, ok := r.(*nbd.Client); ok && timeout > 0 {
+		client.SetReadTimeout(timeout)
+		timeout = 0
+	}
+	if opts.WrapSource != nil {
+		r = opts.WrapSource(r, size)
+	}
+	if ctx.Done() != nil || timeout > 0 {
+		r = fsys.NewContextReaderAt(ctx, r, timeout)
+	}
+	var fill *fsys.FillReaderAt
+	if opts.FillErrors != nil {
+		fill = fsys.NewFillReaderAt(r, 512, opts.FillErrors)
+		r = fill
+	}
+
+	filesystem, err := Open(r, size, opts)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return &Image{FS: filesystem, Size: size, closer: closer, fill: fill}, nil
+}
+
+// openPath opens an image file, NBD export or HTTP(S) URL for reading.
+// A block device has no size to stat, so it is asked for it.
+func openPath(path string, opts Options) (io.ReaderAt, int64, io.Closer, error) {
+	if nbd.IsURL(path) {
+		client, err := nbd.OpenURL(path)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return client, client.Size(), client, nil
+	}
+	if httprange.IsURL(path) {
+		r, err := httprange.Open(path)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return r, r.Size(), r, nil
+	}
+
+	open := os.Open
+	if opts.Direct {
+		open = openDirect
+	}
+	file, err := open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+	size := info.Size()
+	isDevice := info.Mode()&os.ModeDevice != 0
+	if isDevice {
+		if size, err = deviceSize(file); err != nil || size == 0 {
+			size, err = file.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			file.Close()
+			return nil, 0, nil, fmt.Errorf("getting the size of %s: %w", path, err)
+		}
+	}
+	if opts.Mmap && !opts.Direct && !isDevice {
+		if m, err := newMmapReader(file, size); err == nil {
+			return m, size, m, nil
+		}
+	}
+	if !opts.Direct {
+		return file, size, file, nil
+	}
+
+	// Direct reads are of whole sectors of the device, or of pages of the
+	// filesystem a file is on
+	align := 4096
+	if sectorSize, err := deviceSectorSize(file); isDevice && err == nil {
+		align = sectorSize
+	}
+	return fsys.NewAlignedReaderAt(file, align), size, file, nil
+}
+
+// OpenFile opens the image in a file of a filesystem, such as a partition
+// of a partition table or a disk image stored in a filesystem. The
+// filesystem in a partition is opened once for each set of options and
+// shared until the partition table is closed; CloseFile leaves it open.
+func OpenFile(parent fsys.FS, name string, opts Options) (fsys.FS, error) {
+	if pfs, ok := parent.(*part.FS); ok {
+		filesystem, err := pfs.OpenInner(name, opts.key(), func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			return Open(r, size, opts)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return filesystem, nil
+	}
+
+	r, size, err := fsys.OpenReaderAt(parent, name)
+	if err != nil {
+		return nil, fmt.Errorf("accessing %s: %w", name, err)
+	}
+	filesystem, err := Open(r, size, opts)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return filesystem, nil
+}
+
+// CloseFile closes a filesystem OpenFile opened in parent, unless it is in a
+// partition, where the partition table shares it and closes it itself
+func CloseFile(parent, filesystem fsys.FS) error {
+	if _, shared := parent.(*part.FS); shared {
+		return nil
+	}
+	return filesystem.Close()
+}
+
+// Open decrypts the first size bytes of r if opts has a key, then detects
+// the filesystem or partition table in them and opens it, trying the less
+// likely candidates in turn when the most likely one fails to open. The
+// options apply to the types in this module; other types are opened by
+// the Opener registered in fsys.
+func Open(r io.ReaderAt, size int64, opts Options) (fsys.FS, error) {
+	if opts.Key != nil {
+		sectorSize := opts.SectorSize
+		if sectorSize == 0 {
+			sectorSize = 512
+		}
+		cipher, err := xts.New(opts.Key, sectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("setting up decryption: %w", err)
+		}
+		r = xts.NewReaderAt(r, cipher, size)
+	}
+
+	// Detection falls back to the group 1 copy of a damaged primary ext
+	// superblock; when that is damaged too, selecting another copy
+	// explicitly implies ext
+	if opts.SuperblockGroup > 0 {
+		if t, err := detect.Detect(r); err == nil && t == detect.Unknown {
+			return ext.OpenSuperblock(r, size, opts.extGroup())
+		}
+	}
+
+	return fsys.OpenWith(r, size, opts.opener)
+}
+
+// key returns opts in a comparable form, to tell filesystems opened with
+// different options apart
+func (opts Options) key() any {
+	return fmt.Sprintf("%+v", opts)
+}
+
+// extGroup returns the group argument of ext.OpenSuperblock, which is
+// negative for the fallback and 0 for the primary only
+func (opts Options) extGroup() int {
+	switch opts.SuperblockGroup {
+	case 0:
+		return -1
+	case PrimarySuperblock:
+		return 0
+	}
+	return opts.SuperblockGroup
+}
+
+// opener returns the Opener for images detected as type t, with the
+// options that apply to it, or the one registered in fsys
+func (opts Options) opener(t detect.Type) fsys.Opener {
+	switch {
+	case t.IsPartitionTable():
+		// A GPT disk's MBR may be a hybrid with a view of its own
+		if t == detect.MBR || t == detect.GPT {
+			switch opts.Table {
+			case "":
+			case "mbr":
+				t = detect.MBR
+			case "gpt":
+				t = detect.GPT
+			default:
+				return func(io.ReaderAt, int64) (fsys.FS, error) {
+					return nil, fmt.Errorf("unknown partition table %q (use mbr or gpt)", opts.Table)
+				}
+			}
+		}
+		return func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			pfs, err := part.OpenSectorSize(r, size, t, opts.LBASize)
+			if err != nil {
+				return nil, err
+			}
+			return pfs, nil
+		}
+	case t.IsExt():
+		return func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			return ext.OpenSuperblock(r, size, opts.extGroup())
+		}
+	case t == detect.APFS:
+		return func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			return apfs.OpenVolume(r, size, opts.Volume)
+		}
+	case t == detect.HFSPlus:
+		return func(r io.ReaderAt, size int64) (fsys.FS, error) {
+			return hfsplus.OpenReplay(r, size, opts.Replay)
+		}
+	}
+	return fsys.Lookup(t)
+}
+
+const (
+	wordBits = 32 << (^uint(0) >> 63)
+
+	// mmapChunkSize is the size of the pieces of an image file mapped at
+	// once: 64 MiB on 32-bit systems, 1 GiB on 64-bit ones
+	mmapChunkSize = 1 << (26 + (wordBits-32)/8)
+
+	// maxMappedChunks bounds the pieces mapped at once, which only matters
+	// for the address space of a 32-bit system
+	maxMappedChunks = 8 << ((wordBits - 32) / 2)
+)
+
+// mmapReader reads a file through pieces of it mapped into memory as they
+// are read. It reads the file itself where a piece cannot be mapped, or
+// faults, as when the file shrinks.
+type mmapReader struct {
+	file *os.File
+	size int64
+
+	mu     sync.Mutex
+	chunks map[int64]*mappedChunk
+	tick   uint64 // Counts reads, to find the piece read least recently
+}
+
+// mappedChunk is a piece of a file mapped into memory
+type mappedChunk struct {
+	index   int64
+	data    []byte
+	readers int    // Reads copying from it, while which it stays mapped
+	used    uint64 // Tick of the last read
+}
+
+// newMmapReader returns a reader of the size bytes of file, or an error if
+// it cannot be mapped
+func newMmapReader(file *os.File, size int64) (*mmapReader, error) {
+	if size == 0 {
+		return nil, errors.New("empty file")
+	}
+	m := &mmapReader{file: file, size: size, chunks: make(map[int64]*mappedChunk)}
+	c, err := m.acquire(0)
+	if err != nil {
+		return nil, err
+	}
+	m.release(c)
+	return m, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (m *mmapReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), m.size)
+
+	old := debug.SetPanicOnFault(true)
+	defer debug.SetPanicOnFault(old)
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); !ok {
+				panic(r)
+			}
+			n, err = m.file.ReadAt(p, off)
+		}
+	}()
+
+	for pos := off; pos < end; {
+		k, err := m.copyChunk(p[pos-off:end-off], pos)
+		if err != nil {
+			k, err := m.file.ReadAt(p[pos-off:end-off], pos)
+			return int(pos-off) + k, err
+		}
+		pos += int64(k)
+	}
+	if n = int(end - off); n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// BaseReader returns the file, which writers of the image open for writing
+func (m *mmapReader) BaseReader() io.ReaderAt { return m.file }
+
+// copyChunk copies to p from the piece with the byte at pos
+func (m *mmapReader) copyChunk(p []byte, pos int64) (int, error) {
+	index := pos / mmapChunkSize
+	c, err := m.acquire(index)
+	if err != nil {
+		return 0, err
+	}
+	defer m.release(c)
+	return copy(p, c.data[pos-index*mmapChunkSize:]), nil
+}
+
+// acquire returns piece index, mapping it if it is not, for a read
+func (m *mmapReader) acquire(index int64) (*mappedChunk, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick++
+	if c, ok := m.chunks[index]; ok {
+		c.readers++
+		c.used = m.tick
+		return c, nil
+	}
+
+	if len(m.chunks) >= maxMappedChunks {
+		var oldest *mappedChunk
+		for _, c := range m.chunks {
+			if c.readers == 0 && (oldest == nil || c.used < oldest.used) {
+				oldest = c
+			}
+		}
+		if oldest == nil {
+			return nil, errors.New("every mapped piece is being read")
+		}
+		munmap(oldest.data)
+		delete(m.chunks, oldest.index)
+	}
+
+	start := index * mmapChunkSize
+	data, err := mmap(m.file, start, int(min(m.size-start, mmapChunkSize)))
+	if err != nil {
+		return nil, err
+	}
+	c := &mappedChunk{index: index, data: data, readers: 1, used: m.tick}
+	m.chunks[index] = c
+	return c, nil
+}
+
+// release ends a read of a piece
+func (m *mmapReader) release(c *mappedChunk) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.readers--
+}
+
+// Close unmaps the pieces mapped and closes the file
+func (m *mmapReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for index, c := range m.chunks {
+		munmap(c.data)
+		delete(m.chunks, index)
+	}
+	return m.file.Close()
+}
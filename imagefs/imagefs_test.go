@@ -0,0 +1,209 @@
+package imagefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lvdlvd/rawhide/fsys"
+	"github.com/lvdlvd/rawhide/fsys/part"
+	"github.com/lvdlvd/rawhide/xts"
+)
+
+// mapFS makes an fstest.MapFS an fsys.FS
+type mapFS struct{ fstest.MapFS }
+
+func (mapFS) Type() string { return "map" }
+func (mapFS) Close() error { return nil }
+
+// mbrImage returns a 1000-sector disk with one partition at 100-199
+func mbrImage() []byte {
+	image := make([]byte, 1000*512)
+	image[446+4] = 0x83
+	binary.LittleEndian.PutUint32(image[446+8:], 100)
+	binary.LittleEndian.PutUint32(image[446+12:], 100)
+	image[510], image[511] = 0x55, 0xAA
+	return image
+}
+
+func TestOpenFile(t *testing.T) {
+	parent := mapFS{fstest.MapFS{"dir/disk.img": {Data: mbrImage()}}}
+	disk, err := OpenFile(parent, "dir/disk.img", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	if disk.Type() != "MBR" {
+		t.Errorf("type %s, want MBR", disk.Type())
+	}
+	info, err := disk.Stat("p0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 100*512 {
+		t.Errorf("p0 is %d bytes, want %d", info.Size(), 100*512)
+	}
+
+	if _, err := OpenFile(parent, "dir", Options{}); err == nil {
+		t.Error("opened a directory as an image")
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	cipher, err := xts.New(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := mbrImage()
+	if err := cipher.EncryptSectors(image, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(bytes.NewReader(image), int64(len(image)), Options{}); err == nil {
+		t.Error("detected a filesystem in encrypted data")
+	}
+	disk, err := Open(bytes.NewReader(image), int64(len(image)), Options{Key: key, SectorSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Type() != "MBR" {
+		t.Errorf("type %s, want MBR", disk.Type())
+	}
+}
+
+func TestOpenTypeTable(t *testing.T) {
+	image := mbrImage()
+	_, err := Open(bytes.NewReader(image), int64(len(image)), Options{Table: "apm"})
+	var unsupported *fsys.ErrUnsupportedFeature
+	if err == nil || errors.As(err, &unsupported) {
+		t.Errorf("got %v for an unknown partition table option", err)
+	}
+}
+
+func TestOpenBackupSuperblock(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	// 1 KiB blocks give 8 MiB groups, so group 1 has a backup
+	name := filepath.Join(t.TempDir(), "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-b", "1024", name, "16M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+	image, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image[1080], image[1081] = 0, 0 // The primary superblock's magic
+
+	filesystem, err := Open(bytes.NewReader(image), int64(len(image)), Options{})
+	if err != nil {
+		t.Fatalf("opening with the primary superblock zeroed: %v", err)
+	}
+	defer filesystem.Close()
+	if _, err := filesystem.Stat("lost+found"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Open(bytes.NewReader(image), int64(len(image)), Options{SuperblockGroup: PrimarySuperblock}); err == nil {
+		t.Error("opened the zeroed primary superblock")
+	}
+}
+
+func TestOpenFileShared(t *testing.T) {
+	// A partition holding a partition table of its own
+	image := mbrImage()
+	copy(image[100*512:], mbrImage()[:512])
+	disk, err := Open(bytes.NewReader(image), int64(len(image)), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	first, err := OpenFile(disk, "p0", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Type() != "MBR" {
+		t.Errorf("type %s, want MBR", first.Type())
+	}
+	if _, ok := first.(*part.FS).BaseReader().(*fsys.ExtentReaderAt); !ok {
+		t.Errorf("partition read through %T, want the extents writers map back to the image", first.(*part.FS).BaseReader())
+	}
+	if again, err := OpenFile(disk, "p0", Options{}); err != nil || again != first {
+		t.Errorf("OpenFile(p0) again = %v, %v, want the filesystem opened first", again, err)
+	}
+	if other, err := OpenFile(disk, "p0", Options{LBASize: 512}); err != nil || other == first {
+		t.Errorf("OpenFile(p0) with other options = %v, %v, want a filesystem of its own", other, err)
+	}
+}
+
+// closeCounter is a filesystem counting its Closes
+type closeCounter struct {
+	mapFS
+	closed int
+}
+
+func (c *closeCounter) Close() error { c.closed++; return nil }
+
+func TestCloseFile(t *testing.T) {
+	disk, err := Open(bytes.NewReader(mbrImage()), 1000*512, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	inPartition, inFile := &closeCounter{}, &closeCounter{}
+	CloseFile(disk, inPartition)
+	CloseFile(mapFS{}, inFile)
+	if inPartition.closed != 0 {
+		t.Error("CloseFile closed a filesystem the partition table shares")
+	}
+	if inFile.closed != 1 {
+		t.Errorf("CloseFile closed a filesystem in a file %d times, want once", inFile.closed)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.img")
+	image := mbrImage()
+	if err := os.WriteFile(name, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := OpenImage(name, Options{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.FS.Stat("p0"); err != nil {
+		t.Error(err)
+	}
+
+	r, _, closer, err := openPath(name, Options{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	if _, ok := r.(*mmapReader); !ok {
+		t.Skipf("file read with %T", r)
+	}
+	buf := make([]byte, 100)
+	if n, err := r.ReadAt(buf, int64(len(image))-50); n != 50 || err != io.EOF || !bytes.Equal(buf[:n], image[len(image)-50:]) {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+
+	// Pages gone from under the mapping are read from the file instead
+	if err := os.Truncate(name, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.ReadAt(buf, 8192); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past the end of the truncated file = %d, %v", n, err)
+	}
+}
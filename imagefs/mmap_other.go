@@ -0,0 +1,19 @@
+//go:build !unix
+
+package imagefs
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap maps length bytes of a file from off for reading; openPath falls
+// back on reading the file
+func mmap(f *os.File, off int64, length int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// munmap unmaps what mmap mapped
+func munmap(data []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package imagefs
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps length bytes of a file from off, which is a multiple of the
+// page size, for reading
+func mmap(f *os.File, off int64, length int) ([]byte, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var merr error
+	if err := conn.Control(func(fd uintptr) {
+		data, merr = syscall.Mmap(int(fd), off, length, syscall.PROT_READ, syscall.MAP_SHARED)
+	}); err != nil {
+		return nil, err
+	}
+	return data, merr
+}
+
+// munmap unmaps what mmap mapped
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
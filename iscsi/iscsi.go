@@ -0,0 +1,825 @@
+// Package iscsi implements a minimal iSCSI target. It serves the same
+// exports as the nbd package, each as a target with a single disk, for
+// initiators that cannot speak NBD such as Windows and ESXi.
+package iscsi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lvdlvd/rawhide/nbd"
+)
+
+// Opcodes of initiator and target PDUs
+const (
+	opNopOut     = uint8(0x00)
+	opSCSICmd    = uint8(0x01)
+	opTaskMgmt   = uint8(0x02)
+	opLogin      = uint8(0x03)
+	opText       = uint8(0x04)
+	opDataOut    = uint8(0x05)
+	opLogout     = uint8(0x06)
+	opNopIn      = uint8(0x20)
+	opSCSIResp   = uint8(0x21)
+	opTaskResp   = uint8(0x22)
+	opLoginResp  = uint8(0x23)
+	opTextResp   = uint8(0x24)
+	opDataIn     = uint8(0x25)
+	opLogoutResp = uint8(0x26)
+	opR2T        = uint8(0x31)
+	opReject     = uint8(0x3f)
+
+	flagFinal     = uint8(0x80)
+	flagImmediate = uint8(0x40) // In byte 0 of initiator PDUs
+	flagOverflow  = uint8(0x04)
+	flagUnderflow = uint8(0x02)
+	flagStatus    = uint8(0x01) // In Data-In: the PDU carries the status
+
+	// Login stages
+	stageSecurity    = 0
+	stageOperational = 1
+	stageFullFeature = 3
+
+	bhsSize  = 48
+	noTag    = ^uint32(0)
+	cmdSlots = 32 // Commands an initiator may have outstanding
+
+	// Our limits, declared or negotiated during login
+	maxRecvDataSegment = 256 * 1024
+	maxBurst           = 256 * 1024
+	maxFirstBurst      = 64 * 1024
+
+	rejectNotSupported = uint8(0x04)
+)
+
+// SCSI status, sense keys and opcodes
+const (
+	statusGood           = uint8(0x00)
+	statusCheckCondition = uint8(0x02)
+
+	senseMediumError    = uint8(0x03)
+	senseIllegalRequest = uint8(0x05)
+	senseDataProtect    = uint8(0x07)
+
+	scsiTestUnitReady  = uint8(0x00)
+	scsiRequestSense   = uint8(0x03)
+	scsiRead6          = uint8(0x08)
+	scsiWrite6         = uint8(0x0a)
+	scsiInquiry        = uint8(0x12)
+	scsiModeSense6     = uint8(0x1a)
+	scsiStartStop      = uint8(0x1b)
+	scsiAllowRemoval   = uint8(0x1e)
+	scsiReadCapacity10 = uint8(0x25)
+	scsiRead10         = uint8(0x28)
+	scsiWrite10        = uint8(0x2a)
+	scsiVerify10       = uint8(0x2f)
+	scsiSyncCache10    = uint8(0x35)
+	scsiModeSense10    = uint8(0x5a)
+	scsiRead16         = uint8(0x88)
+	scsiWrite16        = uint8(0x8a)
+	scsiSyncCache16    = uint8(0x91)
+	scsiServiceIn16    = uint8(0x9e) // Service action 0x10 is READ CAPACITY(16)
+	scsiReportLuns     = uint8(0xa0)
+
+	blockSize = 512
+)
+
+// IQNPrefix starts the name of every target; the export name follows it
+const IQNPrefix = "iqn.2024-01.io.github.lvdlvd.rawhide:"
+
+// Server represents the iSCSI target
+type Server struct {
+	addr      string
+	exports   map[string]*nbd.Export // By target name
+	exportsMu sync.RWMutex
+	listener  net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *log.Logger
+
+	tsihMu sync.Mutex
+	tsih   uint16 // Last session handle handed out
+}
+
+// conn is an initiator connection, which carries a single session
+type conn struct {
+	server    *Server
+	rw        net.Conn
+	export    *nbd.Export // nil in discovery sessions
+	discovery bool
+
+	statSN   uint32
+	expCmdSN uint32
+	nextTTT  uint32
+
+	// Negotiated during login
+	maxRecvData uint32 // Longest data segment the initiator accepts
+	maxBurst    uint32
+
+	pending []*pdu // PDUs that arrived while waiting for write data
+}
+
+// pdu is a protocol data unit: a basic header segment and its data
+type pdu struct {
+	bhs  [bhsSize]byte
+	data []byte
+}
+
+func (p *pdu) opcode() uint8 { return p.bhs[0] & 0x3f }
+func (p *pdu) itt() uint32   { return binary.BigEndian.Uint32(p.bhs[16:20]) }
+
+// NewServer creates a target listening on addr (host:port)
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:    addr,
+		exports: make(map[string]*nbd.Export),
+		done:    make(chan struct{}),
+		logger:  log.New(os.Stderr, "iscsi: ", log.LstdFlags),
+	}
+}
+
+// SetLogger sets a custom logger
+func (s *Server) SetLogger(l *log.Logger) {
+	s.logger = l
+}
+
+// TargetName returns the target name under which an export is served:
+// IQNPrefix and the export name, lowercased, with the characters IQNs do
+// not allow replaced by '-'
+func TargetName(export string) string {
+	name := []byte(strings.ToLower(export))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			name[i] = '-'
+		}
+	}
+	return IQNPrefix + string(name)
+}
+
+// AddExport adds an export, served as a target named by TargetName
+func (s *Server) AddExport(exp *nbd.Export) error {
+	s.exportsMu.Lock()
+	defer s.exportsMu.Unlock()
+
+	name := TargetName(exp.Name)
+	if _, exists := s.exports[name]; exists {
+		return fmt.Errorf("target %q already exists", name)
+	}
+	s.exports[name] = exp
+	return nil
+}
+
+// targetNames returns the names of all targets, sorted
+func (s *Server) targetNames() []string {
+	s.exportsMu.RLock()
+	defer s.exportsMu.RUnlock()
+	names := make([]string, 0, len(s.exports))
+	for name := range s.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serve starts the target and blocks until Close
+func (s *Server) Serve() error {
+	if len(s.exports) == 0 {
+		return errors.New("no exports defined")
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.listener = listener
+	s.logger.Printf("Listening on %s", listener.Addr())
+	for _, name := range s.targetNames() {
+		exp := s.exports[name]
+		roStr := ""
+		if exp.ReadOnly || exp.Writer == nil {
+			roStr = " (read-only)"
+		}
+		s.logger.Printf("Target %s: %d bytes%s", name, exp.Size, roStr)
+	}
+
+	for {
+		rw, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+				s.logger.Printf("Accept error: %v", err)
+				continue
+			}
+		}
+		go s.handleConnection(rw)
+	}
+}
+
+// Close shuts down the server
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+	return nil
+}
+
+func (s *Server) handleConnection(rw net.Conn) {
+	defer rw.Close()
+	s.logger.Printf("New connection from %s", rw.RemoteAddr())
+
+	c := &conn{
+		server:      s,
+		rw:          rw,
+		maxRecvData: 8192, // The defaults until negotiated otherwise
+		maxBurst:    maxBurst,
+	}
+	if err := c.login(); err != nil {
+		s.logger.Printf("Login failed: %v", err)
+		return
+	}
+	if err := c.serve(); err != nil && !errors.Is(err, io.EOF) {
+		s.logger.Printf("Connection error: %v", err)
+	}
+	s.logger.Printf("Connection from %s closed", rw.RemoteAddr())
+}
+
+// readPDU reads the next PDU, skipping any additional header segments
+func (c *conn) readPDU() (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(c.rw, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	ahsLen := int(p.bhs[4]) * 4
+	dataLen := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+	if dataLen > maxRecvDataSegment {
+		return nil, fmt.Errorf("data segment of %d bytes exceeds the limit", dataLen)
+	}
+	if _, err := io.CopyN(io.Discard, c.rw, int64(ahsLen)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, (dataLen+3)&^3)
+	if _, err := io.ReadFull(c.rw, buf); err != nil {
+		return nil, err
+	}
+	p.data = buf[:dataLen]
+	return p, nil
+}
+
+// nextPDU returns the PDUs put aside while waiting for write data before
+// reading new ones
+func (c *conn) nextPDU() (*pdu, error) {
+	if len(c.pending) > 0 {
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		return p, nil
+	}
+	return c.readPDU()
+}
+
+// send writes a PDU, filling in its data segment length and padding
+func (c *conn) send(bhs []byte, data []byte) error {
+	bhs[5], bhs[6], bhs[7] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	msg := make([]byte, 0, bhsSize+len(data)+3)
+	msg = append(append(msg, bhs...), data...)
+	msg = append(msg, make([]byte, (4-len(data)%4)%4)...)
+	_, err := c.rw.Write(msg)
+	return err
+}
+
+// response starts the header of a target PDU, with the sequence numbers
+// filled in. Responses that carry a status consume a StatSN.
+func (c *conn) response(opcode uint8, itt uint32, status bool) []byte {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opcode
+	bhs[1] = flagFinal
+	binary.BigEndian.PutUint32(bhs[16:20], itt)
+	binary.BigEndian.PutUint32(bhs[24:28], c.statSN)
+	if status {
+		c.statSN++
+	}
+	binary.BigEndian.PutUint32(bhs[28:32], c.expCmdSN)
+	binary.BigEndian.PutUint32(bhs[32:36], c.expCmdSN+cmdSlots-1)
+	return bhs
+}
+
+// command notes the CmdSN of a request, which the next one follows unless
+// the request is immediate
+func (c *conn) command(p *pdu) {
+	if p.bhs[0]&flagImmediate == 0 {
+		c.expCmdSN = binary.BigEndian.Uint32(p.bhs[24:28]) + 1
+	}
+}
+
+// login negotiates the session up to the full feature phase
+func (c *conn) login() error {
+	first := true
+	for {
+		p, err := c.readPDU()
+		if err != nil {
+			return err
+		}
+		if p.opcode() != opLogin {
+			return fmt.Errorf("unexpected opcode 0x%02x during login", p.opcode())
+		}
+
+		transit := p.bhs[1]&flagFinal != 0
+		csg := (p.bhs[1] >> 2) & 3
+		nsg := p.bhs[1] & 3
+		if first {
+			c.statSN = binary.BigEndian.Uint32(p.bhs[28:32])
+			c.expCmdSN = binary.BigEndian.Uint32(p.bhs[24:28])
+		}
+
+		var reply []string
+		keys := parseKeys(p.data)
+		if first {
+			if keys["SessionType"] == "Discovery" {
+				c.discovery = true
+			} else {
+				name := keys["TargetName"]
+				c.server.exportsMu.RLock()
+				c.export = c.server.exports[name]
+				c.server.exportsMu.RUnlock()
+				if c.export == nil {
+					c.loginResponse(p, false, 0x02, 0x03, nil) // Not found
+					return fmt.Errorf("unknown target %q", name)
+				}
+				reply = append(reply, "TargetPortalGroupTag=1")
+			}
+			if c.discovery {
+				c.server.logger.Printf("Discovery session from %s", keys["InitiatorName"])
+			} else {
+				c.server.logger.Printf("Login from %s to %s", keys["InitiatorName"], keys["TargetName"])
+			}
+			first = false
+		}
+		for _, kv := range splitKeys(p.data) {
+			if r := c.negotiate(kv[0], kv[1]); r != "" {
+				reply = append(reply, kv[0]+"="+r)
+			}
+		}
+		if csg == stageOperational {
+			reply = append(reply, "MaxRecvDataSegmentLength="+strconv.Itoa(maxRecvDataSegment))
+		}
+
+		if err := c.loginResponse(p, transit, 0, 0, reply); err != nil {
+			return err
+		}
+		if transit && nsg == stageFullFeature {
+			return nil
+		}
+	}
+}
+
+// loginResponse answers a login request, echoing its stages
+func (c *conn) loginResponse(p *pdu, transit bool, statusClass, statusDetail uint8, keys []string) error {
+	bhs := c.response(opLoginResp, p.itt(), true)
+	bhs[1] = p.bhs[1] & 0x0f // CSG and NSG
+	if transit {
+		bhs[1] |= flagFinal
+	}
+	copy(bhs[8:14], p.bhs[8:14]) // ISID
+	if transit && p.bhs[1]&3 == stageFullFeature {
+		c.server.tsihMu.Lock()
+		c.server.tsih++
+		if c.server.tsih == 0 {
+			c.server.tsih++
+		}
+		binary.BigEndian.PutUint16(bhs[14:16], c.server.tsih)
+		c.server.tsihMu.Unlock()
+	}
+	bhs[36], bhs[37] = statusClass, statusDetail
+	return c.send(bhs, joinKeys(keys))
+}
+
+// negotiate answers a login key offered by the initiator, or returns ""
+// for keys that are declarations
+func (c *conn) negotiate(key, value string) string {
+	n, _ := strconv.ParseUint(value, 10, 32)
+	switch key {
+	case "InitiatorName", "InitiatorAlias", "SessionType", "TargetName":
+		return ""
+	case "AuthMethod":
+		for _, m := range strings.Split(value, ",") {
+			if m == "None" {
+				return "None"
+			}
+		}
+		return "Reject"
+	case "HeaderDigest", "DataDigest":
+		return "None"
+	case "MaxRecvDataSegmentLength":
+		c.maxRecvData = uint32(max(n, 512))
+		return ""
+	case "MaxBurstLength":
+		c.maxBurst = uint32(min(max(n, 512), maxBurst))
+		return strconv.Itoa(int(c.maxBurst))
+	case "FirstBurstLength":
+		return strconv.Itoa(int(min(max(n, 512), maxFirstBurst)))
+	case "ImmediateData":
+		return value // Writes take their first data from the command either way
+	case "InitialR2T", "DataPDUInOrder", "DataSequenceInOrder":
+		return "Yes"
+	case "IFMarker", "OFMarker":
+		return "No"
+	case "ErrorRecoveryLevel", "DefaultTime2Retain":
+		return "0"
+	case "DefaultTime2Wait":
+		return value
+	case "MaxConnections", "MaxOutstandingR2T":
+		return "1"
+	default:
+		return "NotUnderstood"
+	}
+}
+
+// serve handles requests in the full feature phase, one at a time
+func (c *conn) serve() error {
+	for {
+		p, err := c.nextPDU()
+		if err != nil {
+			return err
+		}
+
+		switch p.opcode() {
+		case opNopOut:
+			c.command(p)
+			if p.itt() == noTag {
+				continue // Answers a ping, which we never send
+			}
+			bhs := c.response(opNopIn, p.itt(), true)
+			copy(bhs[8:16], p.bhs[8:16]) // LUN
+			binary.BigEndian.PutUint32(bhs[20:24], noTag)
+			err = c.send(bhs, p.data)
+		case opSCSICmd:
+			c.command(p)
+			err = c.scsiCommand(p)
+		case opTaskMgmt:
+			// Commands are done by the time this arrives: nothing to abort
+			c.command(p)
+			err = c.send(c.response(opTaskResp, p.itt(), true), nil)
+		case opText:
+			c.command(p)
+			err = c.text(p)
+		case opLogout:
+			c.command(p)
+			return c.send(c.response(opLogoutResp, p.itt(), true), nil)
+		case opDataOut:
+			c.server.logger.Printf("Unsolicited data for task 0x%08x", p.itt())
+		default:
+			c.server.logger.Printf("Unsupported opcode 0x%02x", p.opcode())
+			bhs := c.response(opReject, noTag, true)
+			bhs[2] = rejectNotSupported
+			err = c.send(bhs, p.bhs[:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// text answers a text request, listing the targets for SendTargets
+func (c *conn) text(p *pdu) error {
+	var reply []string
+	if which, ok := parseKeys(p.data)["SendTargets"]; ok {
+		addr := c.rw.LocalAddr().String() + ",1"
+		for _, name := range c.server.targetNames() {
+			if which == "All" && c.discovery || which == name || which == "" && !c.discovery && c.server.exports[name] == c.export {
+				reply = append(reply, "TargetName="+name, "TargetAddress="+addr)
+			}
+		}
+	}
+	bhs := c.response(opTextResp, p.itt(), true)
+	binary.BigEndian.PutUint32(bhs[20:24], noTag)
+	return c.send(bhs, joinKeys(reply))
+}
+
+// scsiCommand runs a SCSI command against the session's disk
+func (c *conn) scsiCommand(p *pdu) error {
+	cdb := p.bhs[32:48]
+	expLen := binary.BigEndian.Uint32(p.bhs[20:24])
+	exp := c.export
+	if exp == nil {
+		return c.checkCondition(p, senseIllegalRequest, 0x25, 0) // Logical unit not supported
+	}
+	lun := binary.BigEndian.Uint64(p.bhs[8:16])
+	if lun != 0 && cdb[0] != scsiInquiry && cdb[0] != scsiReportLuns {
+		return c.checkCondition(p, senseIllegalRequest, 0x25, 0)
+	}
+	blocks := uint64(exp.Size+blockSize-1) / blockSize
+
+	switch cdb[0] {
+	case scsiTestUnitReady, scsiStartStop, scsiAllowRemoval, scsiVerify10:
+		return c.status(p, statusGood, nil, 0)
+	case scsiRequestSense:
+		return c.dataIn(p, fixedSense(0, 0, 0), expLen)
+	case scsiInquiry:
+		return c.inquiry(p, lun, expLen)
+	case scsiReadCapacity10:
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data[0:4], uint32(min(blocks-1, 0xffffffff)))
+		binary.BigEndian.PutUint32(data[4:8], blockSize)
+		return c.dataIn(p, data, expLen)
+	case scsiServiceIn16:
+		if cdb[1]&0x1f != 0x10 {
+			return c.checkCondition(p, senseIllegalRequest, 0x24, 0) // Invalid field in CDB
+		}
+		data := make([]byte, 32)
+		binary.BigEndian.PutUint64(data[0:8], blocks-1)
+		binary.BigEndian.PutUint32(data[8:12], blockSize)
+		return c.dataIn(p, data, expLen)
+	case scsiModeSense6, scsiModeSense10:
+		return c.modeSense(p, expLen)
+	case scsiReportLuns:
+		data := make([]byte, 16) // One LUN, number 0
+		binary.BigEndian.PutUint32(data[0:4], 8)
+		return c.dataIn(p, data, expLen)
+	case scsiSyncCache10, scsiSyncCache16:
+		if err := exp.Sync(); err != nil {
+			c.server.logger.Printf("Sync error: %v", err)
+			return c.checkCondition(p, senseMediumError, 0x0c, 0) // Write error
+		}
+		return c.status(p, statusGood, nil, 0)
+	case scsiRead6, scsiRead10, scsiRead16:
+		lba, count, _ := transfer(cdb)
+		if lba+count > blocks {
+			return c.checkCondition(p, senseIllegalRequest, 0x21, 0) // LBA out of range
+		}
+		data := make([]byte, count*blockSize)
+		n, err := exp.Reader.ReadAt(data, int64(lba*blockSize))
+		if err != nil && err != io.EOF {
+			c.server.logger.Printf("Read error at block %d: %v", lba, err)
+			return c.checkCondition(p, senseMediumError, 0x11, 0) // Unrecovered read error
+		}
+		clear(data[n:])
+		return c.dataIn(p, data, expLen)
+	case scsiWrite6, scsiWrite10, scsiWrite16:
+		return c.write(p, blocks, expLen)
+	default:
+		return c.checkCondition(p, senseIllegalRequest, 0x20, 0) // Invalid command operation code
+	}
+}
+
+// transfer decodes the LBA, block count and FUA bit of a read or write CDB
+func transfer(cdb []byte) (lba, count uint64, fua bool) {
+	switch cdb[0] {
+	case scsiRead6, scsiWrite6:
+		lba = uint64(cdb[1]&0x1f)<<16 | uint64(cdb[2])<<8 | uint64(cdb[3])
+		count = uint64(cdb[4])
+		if count == 0 {
+			count = 256
+		}
+		return lba, count, false
+	case scsiRead10, scsiWrite10:
+		return uint64(binary.BigEndian.Uint32(cdb[2:6])), uint64(binary.BigEndian.Uint16(cdb[7:9])), cdb[1]&0x08 != 0
+	default:
+		return binary.BigEndian.Uint64(cdb[2:10]), uint64(binary.BigEndian.Uint32(cdb[10:14])), cdb[1]&0x08 != 0
+	}
+}
+
+// write collects the data of a write command, soliciting what did not come
+// with the command through R2Ts, and writes it to the disk
+func (c *conn) write(p *pdu, blocks uint64, expLen uint32) error {
+	exp := c.export
+	lba, count, fua := transfer(p.bhs[32:48])
+	if exp.ReadOnly || exp.Writer == nil {
+		return c.checkCondition(p, senseDataProtect, 0x27, 0) // Write protected
+	}
+	if lba+count > blocks {
+		return c.checkCondition(p, senseIllegalRequest, 0x21, 0)
+	}
+	if uint64(expLen) != count*blockSize {
+		return c.checkCondition(p, senseIllegalRequest, 0x24, 0)
+	}
+
+	data := make([]byte, expLen)
+	received := uint32(copy(data, p.data))
+	for r2tSN := uint32(0); received < expLen; r2tSN++ {
+		ttt := c.nextTTT
+		c.nextTTT = (c.nextTTT + 1) % noTag
+		length := min(expLen-received, c.maxBurst)
+
+		bhs := c.response(opR2T, p.itt(), false)
+		copy(bhs[8:16], p.bhs[8:16])
+		binary.BigEndian.PutUint32(bhs[20:24], ttt)
+		binary.BigEndian.PutUint32(bhs[36:40], r2tSN)
+		binary.BigEndian.PutUint32(bhs[40:44], received)
+		binary.BigEndian.PutUint32(bhs[44:48], length)
+		if err := c.send(bhs, nil); err != nil {
+			return err
+		}
+
+		// Collect the Data-Out PDUs answering it, keeping other requests
+		// for later
+		for done := false; !done; {
+			d, err := c.readPDU()
+			if err != nil {
+				return err
+			}
+			if d.opcode() != opDataOut || d.itt() != p.itt() {
+				c.pending = append(c.pending, d)
+				continue
+			}
+			offset := binary.BigEndian.Uint32(d.bhs[40:44])
+			if uint64(offset)+uint64(len(d.data)) > uint64(len(data)) {
+				return fmt.Errorf("data for task 0x%08x beyond the transfer length", p.itt())
+			}
+			copy(data[offset:], d.data)
+			done = d.bhs[1]&flagFinal != 0
+		}
+		received += length
+	}
+
+	// The last block may run past the end of an export of odd size
+	offset := int64(lba * blockSize)
+	data = data[:min(int64(len(data)), exp.Size-offset)]
+	if _, err := exp.Writer.WriteAt(data, offset); err != nil {
+		c.server.logger.Printf("Write error at block %d: %v", lba, err)
+		return c.checkCondition(p, senseMediumError, 0x0c, 0)
+	}
+	if fua {
+		if err := exp.Sync(); err != nil {
+			c.server.logger.Printf("Sync error: %v", err)
+			return c.checkCondition(p, senseMediumError, 0x0c, 0)
+		}
+	}
+	return c.status(p, statusGood, nil, 0)
+}
+
+// inquiry answers INQUIRY with the standard data or a vital product page
+func (c *conn) inquiry(p *pdu, lun uint64, expLen uint32) error {
+	cdb := p.bhs[32:48]
+	allocLen := uint32(binary.BigEndian.Uint16(cdb[3:5]))
+	h := fnv.New64a()
+	h.Write([]byte(c.export.Name))
+	id := h.Sum64()
+
+	var data []byte
+	switch {
+	case cdb[1]&0x01 == 0: // Standard data
+		data = make([]byte, 36)
+		data[2] = 0x05 // SPC-3
+		data[3] = 0x02 // Response data format
+		data[4] = byte(len(data) - 5)
+		copy(data[8:16], "RAWHIDE ")
+		copy(data[16:32], "VIRTUAL DISK    ")
+		copy(data[32:36], "1.0 ")
+	case cdb[2] == 0x00: // Supported pages
+		data = []byte{0, 0x00, 0, 3, 0x00, 0x80, 0x83}
+	case cdb[2] == 0x80: // Unit serial number
+		serial := fmt.Sprintf("%016x", id)
+		data = append([]byte{0, 0x80, 0, byte(len(serial))}, serial...)
+	case cdb[2] == 0x83: // Device identification: a T10 vendor ID and an EUI-64
+		vendor := fmt.Sprintf("RAWHIDE %016x", id)
+		data = []byte{0, 0x83, 0, 0}
+		data = append(data, 0x02, 0x01, 0, byte(len(vendor)))
+		data = append(data, vendor...)
+		data = append(data, 0x01, 0x02, 0, 8)
+		data = binary.BigEndian.AppendUint64(data, id)
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	default:
+		return c.checkCondition(p, senseIllegalRequest, 0x24, 0)
+	}
+	if lun != 0 {
+		data[0] = 0x7f // No logical unit here
+	}
+	return c.dataIn(p, data[:min(uint32(len(data)), allocLen)], expLen)
+}
+
+// modeSense answers MODE SENSE(6) and (10) with the caching page, and the
+// write protection of the disk in the header
+func (c *conn) modeSense(p *pdu, expLen uint32) error {
+	cdb := p.bhs[32:48]
+	page := cdb[2] & 0x3f
+	if page != 0x08 && page != 0x3f {
+		return c.checkCondition(p, senseIllegalRequest, 0x24, 0)
+	}
+	caching := make([]byte, 20)
+	caching[0], caching[1] = 0x08, 0x12
+
+	var wp byte
+	if c.export.ReadOnly || c.export.Writer == nil {
+		wp = 0x80
+	}
+	var data []byte
+	var allocLen uint32
+	if cdb[0] == scsiModeSense6 {
+		data = append([]byte{byte(3 + len(caching)), 0, wp, 0}, caching...)
+		allocLen = uint32(cdb[4])
+	} else {
+		data = append([]byte{0, byte(6 + len(caching)), 0, wp, 0, 0, 0, 0}, caching...)
+		allocLen = uint32(binary.BigEndian.Uint16(cdb[7:9]))
+	}
+	return c.dataIn(p, data[:min(uint32(len(data)), allocLen)], expLen)
+}
+
+// dataIn returns the data of a command in Data-In PDUs, the last carrying
+// the status
+func (c *conn) dataIn(p *pdu, data []byte, expLen uint32) error {
+	var flags uint8
+	var residual uint32
+	if uint32(len(data)) > expLen {
+		flags, residual = flagOverflow, uint32(len(data))-expLen
+		data = data[:expLen]
+	} else if uint32(len(data)) < expLen {
+		flags, residual = flagUnderflow, expLen-uint32(len(data))
+	}
+	if len(data) == 0 {
+		return c.status(p, statusGood, nil, residual)
+	}
+
+	for offset, dataSN := 0, uint32(0); offset < len(data); dataSN++ {
+		end := min(offset+int(c.maxRecvData), len(data))
+		last := end == len(data)
+		bhs := c.response(opDataIn, p.itt(), last)
+		bhs[1] = 0
+		if last {
+			bhs[1] = flagFinal | flagStatus | flags
+			binary.BigEndian.PutUint32(bhs[44:48], residual)
+		}
+		copy(bhs[8:16], p.bhs[8:16])
+		binary.BigEndian.PutUint32(bhs[20:24], noTag)
+		binary.BigEndian.PutUint32(bhs[36:40], dataSN)
+		binary.BigEndian.PutUint32(bhs[40:44], uint32(offset))
+		if err := c.send(bhs, data[offset:end]); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+// status sends the SCSI response that ends a command
+func (c *conn) status(p *pdu, status uint8, sense []byte, residual uint32) error {
+	bhs := c.response(opSCSIResp, p.itt(), true)
+	bhs[3] = status
+	if residual > 0 {
+		bhs[1] |= flagUnderflow
+		binary.BigEndian.PutUint32(bhs[44:48], residual)
+	}
+	var data []byte
+	if sense != nil {
+		data = binary.BigEndian.AppendUint16(nil, uint16(len(sense)))
+		data = append(data, sense...)
+	}
+	return c.send(bhs, data)
+}
+
+// checkCondition fails a command with the given sense
+func (c *conn) checkCondition(p *pdu, key, asc, ascq uint8) error {
+	return c.status(p, statusCheckCondition, fixedSense(key, asc, ascq), 0)
+}
+
+// fixedSense builds sense data in the fixed format
+func fixedSense(key, asc, ascq uint8) []byte {
+	sense := make([]byte, 18)
+	sense[0] = 0x70 // Current error
+	sense[2] = key
+	sense[7] = 10 // Additional length
+	sense[12], sense[13] = asc, ascq
+	return sense
+}
+
+// splitKeys splits text data into its key=value pairs, in order
+func splitKeys(data []byte) [][2]string {
+	var kvs [][2]string
+	for _, field := range strings.Split(string(data), "\x00") {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			kvs = append(kvs, [2]string{k, v})
+		}
+	}
+	return kvs
+}
+
+// parseKeys returns the key=value pairs of text data as a map
+func parseKeys(data []byte) map[string]string {
+	keys := make(map[string]string)
+	for _, kv := range splitKeys(data) {
+		keys[kv[0]] = kv[1]
+	}
+	return keys
+}
+
+// joinKeys builds text data from key=value pairs
+func joinKeys(kvs []string) []byte {
+	var data []byte
+	for _, kv := range kvs {
+		data = append(append(data, kv...), 0)
+	}
+	return data
+}
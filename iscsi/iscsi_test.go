@@ -0,0 +1,151 @@
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/lvdlvd/rawhide/nbd"
+)
+
+// writerAt is a writable in-memory disk
+type writerAt []byte
+
+func (w writerAt) WriteAt(p []byte, off int64) (int, error) { return copy(w[off:], p), nil }
+
+// initiator drives one side of a connection in tests
+type initiator struct {
+	t     *testing.T
+	c     net.Conn
+	cmdSN uint32
+	itt   uint32
+}
+
+// request sends a PDU and returns the reply
+func (in *initiator) request(bhs []byte, data []byte) *pdu {
+	in.t.Helper()
+	in.itt++
+	binary.BigEndian.PutUint32(bhs[16:20], in.itt)
+	binary.BigEndian.PutUint32(bhs[24:28], in.cmdSN)
+	in.cmdSN++
+	(&conn{rw: in.c}).send(bhs, data)
+	return in.reply()
+}
+
+func (in *initiator) reply() *pdu {
+	in.t.Helper()
+	p, err := (&conn{rw: in.c}).readPDU()
+	if err != nil {
+		in.t.Fatal(err)
+	}
+	return p
+}
+
+// login logs in to a target, or starts a discovery session without one
+func (in *initiator) login(target string) *pdu {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opLogin | flagImmediate
+	bhs[1] = flagFinal | stageSecurity<<2 | stageFullFeature
+	keys := []string{"InitiatorName=iqn.2024-01.test:init", "AuthMethod=None", "SessionType=Discovery"}
+	if target != "" {
+		keys = []string{"InitiatorName=iqn.2024-01.test:init", "AuthMethod=None", "TargetName=" + target}
+	}
+	in.cmdSN-- // Immediate
+	return in.request(bhs, joinKeys(keys))
+}
+
+// scsi sends a command with the given CDB and expected transfer length
+func (in *initiator) scsi(cdb []byte, expLen uint32, write bool) *pdu {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opSCSICmd
+	bhs[1] = flagFinal | 0x40 // Read
+	if write {
+		bhs[1] = flagFinal | 0x20
+	}
+	binary.BigEndian.PutUint32(bhs[20:24], expLen)
+	copy(bhs[32:48], cdb)
+	return in.request(bhs, nil)
+}
+
+func TestTarget(t *testing.T) {
+	disk := make([]byte, 8*blockSize)
+	for i := range disk {
+		disk[i] = byte(i / blockSize)
+	}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	if err := server.AddExport(&nbd.Export{Name: "Disk/0", Reader: bytes.NewReader(disk), Writer: writerAt(disk), Size: int64(len(disk))}); err != nil {
+		t.Fatal(err)
+	}
+	target := IQNPrefix + "disk-0"
+
+	// Discovery lists the target
+	client, side := net.Pipe()
+	go server.handleConnection(side)
+	in := &initiator{t: t, c: client}
+	if p := in.login(""); p.opcode() != opLoginResp || p.bhs[36] != 0 {
+		t.Fatalf("discovery login = %x", p.bhs)
+	}
+	bhs := make([]byte, bhsSize)
+	bhs[0], bhs[1] = opText, flagFinal
+	if p := in.request(bhs, joinKeys([]string{"SendTargets=All"})); parseKeys(p.data)["TargetName"] != target {
+		t.Errorf("SendTargets = %q", p.data)
+	}
+	client.Close()
+
+	client, side = net.Pipe()
+	defer client.Close()
+	go server.handleConnection(side)
+	in = &initiator{t: t, c: client}
+	if p := in.login(IQNPrefix + "nope"); p.bhs[36] != 0x02 {
+		t.Fatalf("login to unknown target = %x", p.bhs)
+	}
+
+	client, side = net.Pipe()
+	defer client.Close()
+	go server.handleConnection(side)
+	in = &initiator{t: t, c: client}
+	if p := in.login(target); p.bhs[36] != 0 || p.bhs[1]&flagFinal == 0 {
+		t.Fatalf("login = %x", p.bhs)
+	}
+
+	p := in.scsi([]byte{scsiReadCapacity10}, 8, false)
+	if p.opcode() != opDataIn || binary.BigEndian.Uint32(p.data[0:4]) != 7 || binary.BigEndian.Uint32(p.data[4:8]) != blockSize {
+		t.Errorf("READ CAPACITY = %x %x", p.bhs, p.data)
+	}
+
+	// READ(10) of blocks 2 and 3
+	if p = in.scsi([]byte{scsiRead10, 0, 0, 0, 0, 2, 0, 0, 2}, 2*blockSize, false); !bytes.Equal(p.data, disk[2*blockSize:4*blockSize]) || p.bhs[1]&flagStatus == 0 {
+		t.Errorf("READ(10) = %x, %d bytes", p.bhs[:4], len(p.data))
+	}
+
+	// WRITE(10) of block 5, with the data solicited by an R2T
+	p = in.scsi([]byte{scsiWrite10, 0, 0, 0, 0, 5, 0, 0, 1}, blockSize, true)
+	if p.opcode() != opR2T || binary.BigEndian.Uint32(p.bhs[44:48]) != blockSize {
+		t.Fatalf("WRITE(10) reply = %x", p.bhs)
+	}
+	out := make([]byte, bhsSize)
+	out[0], out[1] = opDataOut, flagFinal
+	copy(out[16:24], p.bhs[16:24]) // ITT and TTT
+	(&conn{rw: in.c}).send(out, bytes.Repeat([]byte{0xaa}, blockSize))
+	if p = in.reply(); p.opcode() != opSCSIResp || p.bhs[3] != statusGood {
+		t.Errorf("WRITE(10) status = %x", p.bhs)
+	}
+	if disk[5*blockSize] != 0xaa || disk[6*blockSize] != 6 {
+		t.Error("WRITE(10) did not write block 5 alone")
+	}
+
+	// Reading past the end fails
+	if p = in.scsi([]byte{scsiRead10, 0, 0, 0, 0, 7, 0, 0, 2}, 2*blockSize, false); p.opcode() != opSCSIResp || p.bhs[3] != statusCheckCondition {
+		t.Errorf("READ(10) past the end = %x", p.bhs)
+	}
+}
+
+func TestTargetName(t *testing.T) {
+	if got, want := TargetName("vms/Win 10.img"), IQNPrefix+"vms-win-10.img"; got != want {
+		t.Errorf("TargetName = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,595 @@
+// Package lzfse implements decompression of Apple's LZFSE and LZVN formats.
+//
+// LZFSE streams are a sequence of blocks, each starting with a "bvx" magic:
+// raw blocks, LZVN blocks and FSE-entropy-coded LZ77 blocks, terminated by
+// an end-of-stream block. LZVN is also used on its own by APFS and HFS+
+// compressed files.
+//
+// Only the v2 (compressed header) FSE block is supported; v1 blocks are
+// never produced by Apple's encoder.
+package lzfse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	magicEnd          = 0x24787662 // "bvx$"
+	magicUncompressed = 0x2d787662 // "bvx-"
+	magicV1           = 0x31787662 // "bvx1"
+	magicV2           = 0x32787662 // "bvx2"
+	magicLZVN         = 0x6e787662 // "bvxn"
+
+	lSymbols       = 20
+	mSymbols       = 20
+	dSymbols       = 64
+	literalSymbols = 256
+
+	lStates       = 64
+	mStates       = 64
+	dStates       = 256
+	literalStates = 1024
+
+	matchesPerBlock  = 10000
+	literalsPerBlock = 4 * matchesPerBlock
+
+	v2HeaderSize = 32 // Magic, raw size and three packed 64-bit fields
+)
+
+// ErrCorrupt is returned when the compressed data is malformed
+var ErrCorrupt = errors.New("lzfse: corrupt input")
+
+// Extra bits and base values of the L, M and D symbols
+var (
+	lExtraBits = [lSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8}
+	lBaseValue = [lSymbols]int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 20, 28, 60}
+	mExtraBits = [mSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11}
+	mBaseValue = [mSymbols]int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 24, 56, 312}
+
+	// D symbols come in groups of four sharing a number of extra bits
+	dExtraBits, dBaseValue = distanceTables()
+)
+
+func distanceTables() (extra [dSymbols]uint8, base [dSymbols]int32) {
+	for i := 1; i < dSymbols; i++ {
+		extra[i] = uint8(i / 4)
+		base[i] = base[i-1] + 1<<extra[i-1]
+	}
+	return extra, base
+}
+
+// Decode decompresses an LZFSE stream. sizeHint, if known, is used to
+// preallocate the output.
+func Decode(src []byte, sizeHint int) ([]byte, error) {
+	dst := make([]byte, 0, sizeHint)
+	for {
+		if len(src) < 4 {
+			return nil, fmt.Errorf("%w: truncated block header", ErrCorrupt)
+		}
+
+		var err error
+		switch magic := binary.LittleEndian.Uint32(src); magic {
+		case magicEnd:
+			return dst, nil
+
+		case magicUncompressed:
+			if len(src) < 8 {
+				return nil, fmt.Errorf("%w: truncated block header", ErrCorrupt)
+			}
+			n := int(binary.LittleEndian.Uint32(src[4:8]))
+			if n > len(src)-8 {
+				return nil, fmt.Errorf("%w: truncated raw block", ErrCorrupt)
+			}
+			dst = append(dst, src[8:8+n]...)
+			src = src[8+n:]
+
+		case magicLZVN:
+			if len(src) < 12 {
+				return nil, fmt.Errorf("%w: truncated block header", ErrCorrupt)
+			}
+			nRaw := int(binary.LittleEndian.Uint32(src[4:8]))
+			nPayload := int(binary.LittleEndian.Uint32(src[8:12]))
+			if nPayload > len(src)-12 {
+				return nil, fmt.Errorf("%w: truncated LZVN block", ErrCorrupt)
+			}
+			if dst, err = decodeLZVN(dst, src[12:12+nPayload], nRaw); err != nil {
+				return nil, err
+			}
+			src = src[12+nPayload:]
+
+		case magicV2:
+			var n int
+			if dst, n, err = decodeV2(dst, src); err != nil {
+				return nil, err
+			}
+			src = src[n:]
+
+		case magicV1:
+			return nil, fmt.Errorf("lzfse: v1 blocks are not supported")
+
+		default:
+			return nil, fmt.Errorf("%w: bad block magic %#x", ErrCorrupt, magic)
+		}
+	}
+}
+
+// DecodeLZVN decompresses a bare LZVN stream producing size bytes
+func DecodeLZVN(src []byte, size int) ([]byte, error) {
+	return decodeLZVN(make([]byte, 0, size), src, size)
+}
+
+// decodeLZVN appends n bytes decoded from the LZVN stream src to dst.
+// Matches may refer back into data already in dst.
+func decodeLZVN(dst, src []byte, n int) ([]byte, error) {
+	end := len(dst) + n
+	dist := 0 // Previous match distance
+	i := 0
+
+	for len(dst) < end {
+		if i >= len(src) {
+			return nil, fmt.Errorf("%w: LZVN stream truncated", ErrCorrupt)
+		}
+		op := int(src[i])
+
+		// Opcodes, by their first byte:
+		//   small distance    LLMMMDDD DDDDDDDD
+		//   medium distance   101LLMMM DDDDDDMM DDDDDDDD
+		//   large distance    LLMMM111 DDDDDDDD DDDDDDDD
+		//   previous distance LLMMM110
+		//   small match       1111MMMM
+		//   large match       11110000 MMMMMMMM
+		//   small literal     1110LLLL
+		//   large literal     11100000 LLLLLLLL
+		// L literal bytes follow the opcode, then the match is copied.
+		var lits, match, need int
+		switch {
+		case op == 0x06: // End of stream
+			return nil, fmt.Errorf("%w: LZVN stream ended %d bytes early", ErrCorrupt, end-len(dst))
+		case op == 0x0E || op == 0x16: // Nop
+			i++
+			continue
+		case op&0xF0 == 0x70 || op&0xF0 == 0xD0 || (op < 0x40 && op&7 == 6):
+			return nil, fmt.Errorf("%w: undefined LZVN opcode %#02x", ErrCorrupt, op)
+		case op == 0xE0:
+			need = 2
+		case op&0xF0 == 0xE0:
+			lits, need = op&0xF, 1
+		case op == 0xF0:
+			need = 2
+		case op&0xF0 == 0xF0:
+			match, need = op&0xF, 1
+		case op&0xE0 == 0xA0:
+			need = 3
+		case op&7 == 7:
+			need = 3
+		case op&7 == 6:
+			need = 1
+		default:
+			need = 2
+		}
+		if i+need > len(src) {
+			return nil, fmt.Errorf("%w: LZVN stream truncated", ErrCorrupt)
+		}
+
+		switch {
+		case op == 0xE0:
+			lits = int(src[i+1]) + 16
+		case op == 0xF0:
+			match = int(src[i+1]) + 16
+		case op >= 0xE0:
+		case op&0xE0 == 0xA0:
+			v := int(binary.LittleEndian.Uint16(src[i+1:]))
+			lits = op >> 3 & 3
+			match = (op&7)<<2 | v&3 + 3
+			dist = v >> 2
+		case op&7 == 7:
+			lits, match = op>>6, op>>3&7+3
+			dist = int(binary.LittleEndian.Uint16(src[i+1:]))
+		case op&7 == 6:
+			lits, match = op>>6, op>>3&7+3
+		default:
+			lits, match = op>>6, op>>3&7+3
+			dist = (op&7)<<8 | int(src[i+1])
+		}
+		i += need
+
+		if i+lits > len(src) {
+			return nil, fmt.Errorf("%w: LZVN stream truncated", ErrCorrupt)
+		}
+		if len(dst)+lits+match > end {
+			return nil, fmt.Errorf("%w: LZVN output overrun", ErrCorrupt)
+		}
+		dst = append(dst, src[i:i+lits]...)
+		i += lits
+
+		if match > 0 {
+			if dist == 0 || dist > len(dst) {
+				return nil, fmt.Errorf("%w: LZVN match distance %d out of range", ErrCorrupt, dist)
+			}
+			dst = copyMatch(dst, dist, match)
+		}
+	}
+	return dst, nil
+}
+
+// copyMatch appends n bytes copied from dist bytes back, allowing overlap
+func copyMatch(dst []byte, dist, n int) []byte {
+	for k := 0; k < n; k++ {
+		dst = append(dst, dst[len(dst)-dist])
+	}
+	return dst
+}
+
+// v2Header is the decoded header of an LZFSE v2 block
+type v2Header struct {
+	nRaw          int
+	nLiterals     int
+	nLiteralBytes int
+	nMatches      int
+	nLMDBytes     int
+	literalBits   int
+	literalStates [4]int
+	lmdBits       int
+	lState        int
+	mState        int
+	dState        int
+	headerSize    int
+	lFreq         []uint16
+	mFreq         []uint16
+	dFreq         []uint16
+	literalFreq   []uint16
+}
+
+// field extracts n bits at offset off from v
+func field(v uint64, off, n uint) int {
+	return int(v >> off & (1<<n - 1))
+}
+
+// parseV2Header decodes a v2 block header, including its frequency tables
+func parseV2Header(block []byte) (*v2Header, error) {
+	if len(block) < v2HeaderSize {
+		return nil, fmt.Errorf("%w: truncated block header", ErrCorrupt)
+	}
+	v0 := binary.LittleEndian.Uint64(block[8:16])
+	v1 := binary.LittleEndian.Uint64(block[16:24])
+	v2 := binary.LittleEndian.Uint64(block[24:32])
+
+	h := &v2Header{
+		nRaw:          int(binary.LittleEndian.Uint32(block[4:8])),
+		nLiterals:     field(v0, 0, 20),
+		nLiteralBytes: field(v0, 20, 20),
+		nMatches:      field(v0, 40, 20),
+		literalBits:   field(v0, 60, 3) - 7,
+		literalStates: [4]int{field(v1, 0, 10), field(v1, 10, 10), field(v1, 20, 10), field(v1, 30, 10)},
+		nLMDBytes:     field(v1, 40, 20),
+		lmdBits:       field(v1, 60, 3) - 7,
+		headerSize:    field(v2, 0, 32),
+		lState:        field(v2, 32, 10),
+		mState:        field(v2, 42, 10),
+		dState:        field(v2, 52, 10),
+	}
+	if h.headerSize < v2HeaderSize || h.headerSize > len(block) {
+		return nil, fmt.Errorf("%w: bad header size %d", ErrCorrupt, h.headerSize)
+	}
+	if h.nLiterals > literalsPerBlock || h.nMatches > matchesPerBlock {
+		return nil, fmt.Errorf("%w: block too large", ErrCorrupt)
+	}
+
+	// Frequency tables are packed with a variable-length code, least
+	// significant bit first; an empty table area means all zero
+	freq := make([]uint16, lSymbols+mSymbols+dSymbols+literalSymbols)
+	src := block[v2HeaderSize:h.headerSize]
+	var accum uint32
+	accumBits := 0
+	for i := 0; i < len(freq) && h.headerSize > v2HeaderSize; i++ {
+		for len(src) > 0 && accumBits+8 <= 32 {
+			accum |= uint32(src[0]) << accumBits
+			accumBits += 8
+			src = src[1:]
+		}
+		value, n := decodeFreq(accum)
+		if n > accumBits {
+			return nil, fmt.Errorf("%w: truncated frequency tables", ErrCorrupt)
+		}
+		freq[i] = value
+		accum >>= n
+		accumBits -= n
+	}
+	if len(src) != 0 || accumBits >= 8 {
+		return nil, fmt.Errorf("%w: bad frequency tables", ErrCorrupt)
+	}
+
+	h.lFreq = freq[:lSymbols]
+	h.mFreq = freq[lSymbols : lSymbols+mSymbols]
+	h.dFreq = freq[lSymbols+mSymbols : lSymbols+mSymbols+dSymbols]
+	h.literalFreq = freq[lSymbols+mSymbols+dSymbols:]
+	return h, nil
+}
+
+// decodeFreq decodes one frequency value from the low bits of accum,
+// returning it and the number of bits used
+func decodeFreq(accum uint32) (uint16, int) {
+	nbitsTable := [32]int8{
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+	}
+	valueTable := [32]int8{
+		0, 2, 1, 4, 0, 3, 1, -1, 0, 2, 1, 5, 0, 3, 1, -1,
+		0, 2, 1, 6, 0, 3, 1, -1, 0, 2, 1, 7, 0, 3, 1, -1,
+	}
+
+	b := accum & 31
+	switch n := int(nbitsTable[b]); n {
+	case 8:
+		return uint16(8 + accum>>4&0xF), n
+	case 14:
+		return uint16(24 + accum>>4&0x3FF), n
+	default:
+		return uint16(valueTable[b]), n
+	}
+}
+
+// decodeV2 appends the output of the v2 block at the start of block to
+// dst. It returns the extended dst and the size of the block.
+func decodeV2(dst, block []byte) ([]byte, int, error) {
+	h, err := parseV2Header(block)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload := block[h.headerSize:]
+	if h.nLiteralBytes+h.nLMDBytes > len(payload) {
+		return nil, 0, fmt.Errorf("%w: truncated block payload", ErrCorrupt)
+	}
+
+	literals, err := decodeLiterals(h, payload[:h.nLiteralBytes])
+	if err != nil {
+		return nil, 0, err
+	}
+	dst, err = decodeLMD(dst, h, literals, payload[h.nLiteralBytes:h.nLiteralBytes+h.nLMDBytes])
+	if err != nil {
+		return nil, 0, err
+	}
+	return dst, h.headerSize + h.nLiteralBytes + h.nLMDBytes, nil
+}
+
+// decodeLiterals decodes the block's literal bytes, which are coded with
+// four interleaved FSE states
+func decodeLiterals(h *v2Header, payload []byte) ([]byte, error) {
+	table, err := newDecoderTable(literalStates, h.literalFreq)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newBitReader(payload, h.literalBits)
+	if err != nil {
+		return nil, err
+	}
+
+	states := h.literalStates
+	literals := make([]byte, (h.nLiterals+3)&^3)
+	for i := 0; i < len(literals); i += 4 {
+		if err := in.refill(); err != nil {
+			return nil, err
+		}
+		for j := range states {
+			if states[j] >= len(table) {
+				return nil, fmt.Errorf("%w: bad literal state", ErrCorrupt)
+			}
+			e := table[states[j]]
+			states[j] = int(e.delta) + int(in.pull(int(e.k)))
+			literals[i+j] = e.symbol
+		}
+	}
+	if in.err != nil {
+		return nil, in.err
+	}
+	return literals[:h.nLiterals], nil
+}
+
+// decodeLMD executes the block's (literal length, match length, distance)
+// triples, appending h.nRaw bytes to dst
+func decodeLMD(dst []byte, h *v2Header, literals, payload []byte) ([]byte, error) {
+	lTable, err := newValueDecoderTable(lStates, h.lFreq, lExtraBits[:], lBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+	mTable, err := newValueDecoderTable(mStates, h.mFreq, mExtraBits[:], mBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+	dTable, err := newValueDecoderTable(dStates, h.dFreq, dExtraBits[:], dBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+	in, err := newBitReader(payload, h.lmdBits)
+	if err != nil {
+		return nil, err
+	}
+
+	end := len(dst) + h.nRaw
+	lState, mState, dState := h.lState, h.mState, h.dState
+	dist := -1 // A zero distance repeats the previous one
+	for i := 0; i < h.nMatches; i++ {
+		if err := in.refill(); err != nil {
+			return nil, err
+		}
+		lits, err := valueDecode(&lState, lTable, in)
+		if err != nil {
+			return nil, err
+		}
+		match, err := valueDecode(&mState, mTable, in)
+		if err != nil {
+			return nil, err
+		}
+		d, err := valueDecode(&dState, dTable, in)
+		if err != nil {
+			return nil, err
+		}
+		if in.err != nil {
+			return nil, in.err
+		}
+		if d != 0 {
+			dist = d
+		}
+
+		if lits > len(literals) {
+			return nil, fmt.Errorf("%w: literal overrun", ErrCorrupt)
+		}
+		if len(dst)+lits+match > end {
+			return nil, fmt.Errorf("%w: output overrun", ErrCorrupt)
+		}
+		dst = append(dst, literals[:lits]...)
+		literals = literals[lits:]
+
+		if match > 0 {
+			if dist <= 0 || dist > len(dst) {
+				return nil, fmt.Errorf("%w: match distance %d out of range", ErrCorrupt, dist)
+			}
+			dst = copyMatch(dst, dist, match)
+		}
+	}
+	if len(dst) != end {
+		return nil, fmt.Errorf("%w: block decoded to %d bytes, want %d", ErrCorrupt, len(dst)-end+h.nRaw, h.nRaw)
+	}
+	return dst, nil
+}
+
+// decoderEntry is one state of an FSE literal decoding table
+type decoderEntry struct {
+	k      uint8 // Number of bits to read for the next state
+	symbol uint8
+	delta  int16 // Base of the next state
+}
+
+// newDecoderTable builds the FSE decoding table for the given
+// normalized symbol frequencies
+func newDecoderTable(nstates int, freq []uint16) ([]decoderEntry, error) {
+	t := make([]decoderEntry, 0, nstates)
+	err := forEachState(nstates, freq, func(symbol, k, delta int) {
+		t = append(t, decoderEntry{k: uint8(k), symbol: uint8(symbol), delta: int16(delta)})
+	})
+	return t, err
+}
+
+// valueDecoderEntry is one state of an FSE decoding table whose symbols
+// stand for a base value plus extra bits
+type valueDecoderEntry struct {
+	totalBits uint8 // State bits plus value bits
+	valueBits uint8
+	delta     int16
+	base      int32
+}
+
+// newValueDecoderTable builds the FSE decoding table for L, M or D symbols
+func newValueDecoderTable(nstates int, freq []uint16, extraBits []uint8, base []int32) ([]valueDecoderEntry, error) {
+	t := make([]valueDecoderEntry, 0, nstates)
+	err := forEachState(nstates, freq, func(symbol, k, delta int) {
+		t = append(t, valueDecoderEntry{
+			totalBits: uint8(k) + extraBits[symbol],
+			valueBits: extraBits[symbol],
+			delta:     int16(delta),
+			base:      base[symbol],
+		})
+	})
+	return t, err
+}
+
+// forEachState calls fn for every decoder state in order with the state's
+// symbol, the number of bits to read and the base of the next state
+func forEachState(nstates int, freq []uint16, fn func(symbol, k, delta int)) error {
+	nclz := bits.LeadingZeros32(uint32(nstates))
+	total := 0
+	for symbol, f16 := range freq {
+		f := int(f16)
+		if f == 0 {
+			continue
+		}
+		if total += f; total > nstates {
+			return fmt.Errorf("%w: frequencies exceed %d states", ErrCorrupt, nstates)
+		}
+
+		// k is the shift that puts f<<k in [nstates, 2*nstates)
+		k := bits.LeadingZeros32(uint32(f)) - nclz
+		j0 := (2*nstates)>>k - f
+		for j := 0; j < f; j++ {
+			if j < j0 {
+				fn(symbol, k, (f+j)<<k-nstates)
+			} else {
+				fn(symbol, k-1, (j-j0)<<(k-1))
+			}
+		}
+	}
+	return nil
+}
+
+// valueDecode decodes one L, M or D value and advances the state
+func valueDecode(state *int, t []valueDecoderEntry, in *bitReader) (int, error) {
+	if *state >= len(t) {
+		return 0, fmt.Errorf("%w: bad FSE state", ErrCorrupt)
+	}
+	e := t[*state]
+	v := in.pull(int(e.totalBits))
+	*state = int(e.delta) + int(v>>e.valueBits)
+	return int(e.base) + int(v&(1<<e.valueBits-1)), nil
+}
+
+// bitReader reads an FSE bit stream, which is consumed backwards from the
+// end of its buffer, most significant bits first
+type bitReader struct {
+	buf   []byte
+	accum uint64
+	nbits int
+	err   error
+}
+
+// newBitReader starts reading buf. extra is the (non-positive) number of
+// unused bits in the final byte, as recorded in the block header.
+func newBitReader(buf []byte, extra int) (*bitReader, error) {
+	in := &bitReader{}
+	n := 7
+	if extra != 0 {
+		n = 8
+	}
+	if len(buf) < n {
+		return nil, fmt.Errorf("%w: truncated bit stream", ErrCorrupt)
+	}
+	var b [8]byte
+	copy(b[:], buf[len(buf)-n:])
+	in.accum = binary.LittleEndian.Uint64(b[:])
+	in.buf = buf[:len(buf)-n]
+	in.nbits = 8*n + extra
+	if in.nbits < 56 || in.nbits >= 64 || in.accum>>in.nbits != 0 {
+		return nil, fmt.Errorf("%w: bad bit stream header", ErrCorrupt)
+	}
+	return in, nil
+}
+
+// refill tops up the accumulator to at least 56 bits
+func (in *bitReader) refill() error {
+	nbytes := (63 - in.nbits) >> 3
+	if nbytes > len(in.buf) {
+		return fmt.Errorf("%w: bit stream underrun", ErrCorrupt)
+	}
+	for i := 1; i <= nbytes; i++ {
+		in.accum = in.accum<<8 | uint64(in.buf[len(in.buf)-i])
+	}
+	in.buf = in.buf[:len(in.buf)-nbytes]
+	in.nbits += 8 * nbytes
+	return nil
+}
+
+// pull removes and returns the top n bits of the accumulator
+func (in *bitReader) pull(n int) uint64 {
+	if n > in.nbits {
+		in.err = fmt.Errorf("%w: bit stream underrun", ErrCorrupt)
+		in.nbits = 0
+		in.accum = 0
+		return 0
+	}
+	in.nbits -= n
+	v := in.accum >> in.nbits
+	in.accum &= 1<<in.nbits - 1
+	return v
+}
@@ -0,0 +1,95 @@
+package lzfse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testText = strings.Repeat("the quick brown fox jumps over the lazy dog; the quick brown fox jumps again\n", 3)
+
+// Streams of testText in the formats the decoder handles
+var (
+	testLZVN = mustHex(
+		"e00f74686520717569636b2062726f776e20666f78206a756d7073206f766572" +
+			"20081fe96c617a7920646f673b100e382dfce6616761696e0a384df080060000" +
+			"0000000000")
+
+	// A single v2 block
+	testLZFSE = mustHex(
+		"62767832e700000030004002000500505f9ba71712100040a7000000366c1008" +
+			"4f00004770040070c4217074040000471cf11c0000bf01f01bf01bc06f000000" +
+			"0000000000000000002f010000d700000000007c22000000000000700d000000" +
+			"0000000000c0a3707d7dfd125cbf04d72fc1f5f5f5f54bf03d5c5fbf04d7d72f" +
+			"c1f5f5f5f5350000000000000000000000000000000000000000000000000000" +
+			"0000000000000000000000000000000000ccca12e33e168a05e42bd6366c0884" +
+			"4b56fa68229fae646733070000000000000000201083d4a8c66a0462767824")
+
+	// A raw block, an LZVN block and a v2 block
+	testMixed = mustHex(
+		"6276782d1400000074686520717569636b2062726f776e20666f78206276786e" +
+			"6400000046000000e0086a756d7073206f76657220746865206c617a7920646f" +
+			"673b100ee000717569636b2062726f776e20666f7820182de6616761696e0a38" +
+			"20f000384df70600000000000000627678326f0000003000400200040050e0c0" +
+			"f2b5790e0070a400000036b0c00687c021700800c0218700870000c023008f02" +
+			"0000f028008fc2a30000000000000000000000002f010000d700000000007c22" +
+			"000000000000700d0000000000000000c0a3707d7dfd125cbf04d72fc1f5f5f5" +
+			"f54bf03d5c5fbf04d7d72fc1f5f5f5f535000000000000000000000000000000" +
+			"000000000000000000000000000000000000000000000000000000006b52e8c0" +
+			"71599b9486f433dcadb84852fa68229fae646733073a000000000000000040a0" +
+			"3000110c62767824")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeLZVN(t *testing.T) {
+	got, err := DecodeLZVN(testLZVN, len(testText))
+	if err != nil {
+		t.Fatalf("DecodeLZVN: %v", err)
+	}
+	if string(got) != testText {
+		t.Errorf("DecodeLZVN = %q, want %q", got, testText)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  []byte
+	}{
+		{"v2", testLZFSE},
+		{"mixed", testMixed},
+	} {
+		got, err := Decode(tt.src, 0)
+		if err != nil {
+			t.Errorf("%s: Decode: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, []byte(testText)) {
+			t.Errorf("%s: Decode = %q, want %q", tt.name, got, testText)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, src := range [][]byte{testLZFSE, testMixed} {
+		for n := 0; n < len(src); n++ {
+			if _, err := Decode(src[:n], 0); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Decode of %d/%d bytes: got %v, want ErrCorrupt", n, len(src), err)
+			}
+		}
+	}
+	for n := 0; n < len(testLZVN)-8; n++ {
+		if _, err := DecodeLZVN(testLZVN[:n], len(testText)); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("DecodeLZVN of %d/%d bytes: got %v, want ErrCorrupt", n, len(testLZVN), err)
+		}
+	}
+}
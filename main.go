@@ -2,35 +2,118 @@
 //
 // Usage:
 //
-//	rawhide [-K key] [-sz size] <image> [command] [args...]
-//	rawhide <image> ls [-l] [path]                    - list directory or file info
-//	rawhide <image> cat <path>                        - copy file to stdout
-//	rawhide <image> fscat|fs [-K key] <path> [cmd]    - recurse into nested image
-//	rawhide <image> freecat|fc                        - copy free space to stdout
+//	rawhide [-K key] [-sz size] [-sb group] [-vol index] [-j] [-lba-size n] [-table mbr|gpt] [-cache MiB] [-mem MiB] [-timeout d] [-direct] [-mmap] [-map] [-disk-order] [-fill-errors] [-hash-log file [-hash-algo name]] [-config file] [-profile name] <image> [command] [args...]
+//	rawhide <image> ls [-l] [-n] [-T] [-u|-U] [-tz zone] [-R] [-t|-S] [-r] [-d] [path...] - list directory or file info
+//	rawhide <image> ls -deleted [-l] [path...]        - list deleted files by ID, with -l how likely their data is intact
+//	rawhide <image> stat <path>                       - show file metadata and timestamps
+//	rawhide <image> xattr <path> [name]               - list extended attributes, or write the value of one to stdout
+//	rawhide <image> cat [-progress] [-limit-rate n] <path...> - copy files to stdout
+//	rawhide <image> cat -o <template> <path...> - copy each file to a host file named by the template, {name} or {path} in it
+//	rawhide <image> cat -deleted <id...>              - copy what is left of deleted files to stdout
+//	rawhide <image> find [path] [-a] [-L] [-name|-iname pattern] [-type f|d|l] [-size [+-]n[ckMG]] [-mtime [+-]n] [-print0] - find files
+//	rawhide <image> du [-a] [-d depth] [-h] [path]   - show logical and on-disk size of each directory
+//	rawhide <image> frag [-a] [-s] [-h] [path]       - show how fragmented each file's data is in the image
+//	rawhide <image> diff [-hash] [-a] [-in path] [-K key] ... <image2> [path] - list the files added, removed and changed in another image
+//	rawhide <image> manifest create [-algo name] [-a] [-j n] [path] - write the path, size, times and digest of every file as JSON
+//	rawhide <image> manifest verify [-a] <manifest.json> [path] - list the files added, removed and changed since a manifest
+//	rawhide <image> tree [-a] [-d depth] [path]       - show the directory hierarchy
+//	rawhide <image> grep [-i] [-x] [-l] [-a] [-free] <pattern> [path] - find a regexp or bytes in files or free space
+//	rawhide <image> strings [-n length] [-a] [-free] [path] - print text in files or free space
+//	rawhide <image> hash [-algo md5|sha1|sha256|blake3] [-a] [-L] [-j n] [path] - print a digest of every file
+//	rawhide <image> timeline [-a] [-csv] [-md5] [path] - print timestamps as a mactime body file or CSV
+//	rawhide <image> dd [-bs n] [-skip n] [-count n] [path] - copy a byte range of a file or the image to stdout
+//	rawhide <image> xxd [-e] <path> [offset] [length] - hex dump a file, with -e showing where its extents are
+//	rawhide <image> xxd -image [offset] [length]      - hex dump the image
+//	rawhide <image> extents [-image] <path>           - print the physical layout of a file
+//	rawhide <image> extract [-a] [-L] [-j n] [-progress] [-limit-rate n] <src> <dstdir> - copy a file or directory tree to the host
+//	rawhide <image> tar [-a] [-j n] [-progress] [-limit-rate n] [path] - write a file or directory tree to stdout as a tar archive
+//	rawhide <image> zip [-a] [path]                   - write a file or directory tree to stdout as a zip archive
+//	rawhide <image> put [-p] <file|-> <path>         - create or replace a file in a FAT image, in place
+//	rawhide <image> mkfs [-t FAT12|FAT16|FAT32] [-size n] [-s n] [-ss n] [-f n] [-r n] [-n label] [-from dir] - make a FAT image
+//	rawhide <image> mkimage [-t mbr|gpt] [-ss n] [-align n] [-size n] <file[,type=t][,label=l][,size=n][,boot]>... - make a disk image of partition images
+//	rawhide <image> write <path> < data              - overwrite a file in place, in the blocks it already has
+//	rawhide <image> fscat|fs [-K key] [-sb group] [-vol index] [-j] [-lba-size n] [-table mbr|gpt] <path> [cmd] - recurse into nested image
+//	rawhide <image> fscat|fs -auto [-K key] <path> [cmd] - recurse through partition tables and encryption to the filesystem inside
+//	rawhide <image> inventory [-depth n] [-min size]  - list the partitions, volumes and nested images
+//	rawhide <image> fsck|verify                       - check filesystem consistency
+//	rawhide <image> journal                           - list pending journal transactions
+//	rawhide <image> dumpmeta [-record n]              - dump the on-disk structures as JSON
+//	rawhide <image> scan [path]                       - find filesystem signatures in a file or free space
+//	rawhide <image> carve [-o dir] [-max size] [-types list] [path] - recover files from free space or a file by signature
+//	rawhide <image> entropy [-bs size] [-free] [-png file] [path] - show the entropy of each block as CSV or a heatmap
+//	rawhide <image> freecat|fc [-progress] [-limit-rate n] - copy free space to stdout
 //	rawhide <image> freefscat|ffs [cmd] [args]        - probe free space as image
-//	rawhide <image> nbd [-rw] <path> [-socket path]   - expose file as NBD block device
-//	rawhide <image> freenbd|fnbd [-rw] [-socket path] - expose free space as NBD device
+//	rawhide <image> freefscat|ffs -scan [-at offset] [cmd] - open a filesystem found anywhere in the free space
+//	rawhide <image> nbd [-rw [-inplace | -overlay dir]] [-idle-timeout d] <path> [-socket path] - expose file as NBD block device
+//	rawhide <image> nbd [-n label] [-rw [-overlay dir]] [-idle-timeout d] [-socket path] <dir | path...> - expose a directory, or several files, as a FAT image made of them
+//	rawhide <image> nbdall [-rw [-inplace | -overlay dir]] [-idle-timeout d] [-socket path] [pattern...] - expose every partition or matching file as NBD devices
+//	rawhide <image> freenbd|fnbd [-rw [-inplace | -overlay dir]] [-idle-timeout d] [-socket path] - expose free space as NBD device
+//	rawhide <image> iscsi [-rw [-inplace | -overlay dir]] [-addr host:port] [pattern...] - expose every partition or matching file as iSCSI targets
+//	rawhide <image> serve [-addr host:port]           - serve files and directory listings over HTTP
+//	rawhide <image> 9p [-addr host:port | -socket path] - serve the filesystem over 9P2000.L
+//
+// The image can be a file, an NBD URL, nbd://host[:port]/export or
+// nbd+unix:///export?socket=path, or an http:// or https:// URL of a server
+// that answers range requests. With -map it is a table stitching the image
+// together from pieces of other files.
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/lvdlvd/rawhide/blake3"
+	"github.com/lvdlvd/rawhide/carve"
+	"github.com/lvdlvd/rawhide/config"
 	"github.com/lvdlvd/rawhide/detect"
 	"github.com/lvdlvd/rawhide/fsys"
-	"github.com/lvdlvd/rawhide/fsys/apfs"
-	"github.com/lvdlvd/rawhide/fsys/ext"
 	"github.com/lvdlvd/rawhide/fsys/fat"
-	"github.com/lvdlvd/rawhide/fsys/hfsplus"
-	"github.com/lvdlvd/rawhide/fsys/ntfs"
 	"github.com/lvdlvd/rawhide/fsys/part"
+	"github.com/lvdlvd/rawhide/imagefs"
+	"github.com/lvdlvd/rawhide/iscsi"
 	"github.com/lvdlvd/rawhide/nbd"
+	"github.com/lvdlvd/rawhide/ninep"
+	"github.com/lvdlvd/rawhide/pax"
 	"github.com/lvdlvd/rawhide/xts"
 )
 
@@ -43,83 +126,289 @@ type cryptoParams struct {
 func main() {
 	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
 		fmt.Fprintf(os.Stderr, "fscat: %v\n", err)
-		os.Exit(1)
+		if hint := errorHint(err); hint != "" {
+			fmt.Fprintf(os.Stderr, "fscat: %s\n", hint)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit codes for the kinds of errors the filesystems report, so scripts
+// can tell a damaged image from one rawhide cannot read yet
+const (
+	exitError       = 1
+	exitCorrupt     = 3
+	exitUnsupported = 4
+	exitEncrypted   = 5
+)
+
+// exitCode returns the exit code for err
+func exitCode(err error) int {
+	var corrupt *fsys.ErrCorruptMetadata
+	var unsupported *fsys.ErrUnsupportedFeature
+	switch {
+	case errors.Is(err, fsys.ErrEncrypted):
+		return exitEncrypted
+	case errors.As(err, &unsupported):
+		return exitUnsupported
+	case errors.As(err, &corrupt):
+		return exitCorrupt
 	}
+	return exitError
+}
+
+// errorHint suggests what to try next after err, or returns ""
+func errorHint(err error) string {
+	switch exitCode(err) {
+	case exitCorrupt:
+		return "the image is damaged; run fsck for a full report, or try -sb for a backup ext superblock"
+	case exitUnsupported:
+		return "the image uses a feature rawhide does not read; dd and xxd can still copy the raw bytes"
+	case exitEncrypted:
+		return "the data is encrypted; give an XTS key with -K if the whole image is encrypted"
+	}
+	return ""
 }
 
 func run(args []string, stdout, stderr io.Writer) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: rawhide [-K key] [-sz size] <image> [command] [args...]")
+		return fmt.Errorf("usage: rawhide [-K key] [-sz size] [-sb group] [-vol index] [-j] [-lba-size n] [-table mbr|gpt] [-cache MiB] [-mem MiB] [-timeout d] [-direct] [-mmap] [-map] [-disk-order] [-fill-errors] [-hash-log file [-hash-algo name]] [-config file] [-profile name] <image> [command] [args...]")
 	}
 
-	// Parse encryption flags
 	flagSet := flag.NewFlagSet("rawhide", flag.ContinueOnError)
-	keyHex := flagSet.String("K", "", "XTS-AES key in hexadecimal")
-	sectorSize := flagSet.Int("sz", 512, "Sector size for XTS encryption")
+	opts := addOpenFlags(flagSet)
+	cacheSize := flagSet.Int("cache", 32, "MiB of image blocks to keep in memory for filesystem metadata (0 = none)")
+	memLimit := flagSet.Int("mem", 256, "MiB of memory for files without extents, read whole, past which they go to temporary files")
+	flagSet.DurationVar(&opts.ReadTimeout, "timeout", 0, "fail reads of the image that take longer than this, such as `30s` (0 = no limit)")
+	flagSet.BoolVar(&opts.Direct, "direct", false, "read the image with O_DIRECT, around the page cache (Linux)")
+	flagSet.BoolVar(&opts.Mmap, "mmap", false, "read an image file by mapping it into memory, where the system can")
+	flagSet.BoolVar(&opts.Mapping, "map", false, "take the image argument for a table of the pieces the image is made of")
+	flagSet.BoolVar(&fsys.DiskOrder, "disk-order", false, "list directories in the order their entries are stored in, rather than by name")
+	fillErrors := flagSet.Bool("fill-errors", false, "read the sectors of the image that cannot be read as zeros, and list them at the end")
+	hashLog := flagSet.String("hash-log", "", "write a digest of everything read from the image to `file`")
+	hashAlgo := flagSet.String("hash-algo", "sha256", "digest of -hash-log: md5, sha1, sha256 or blake3")
+	configPath := flagSet.String("config", "", "read default flags and profiles from `file` (default fscat.toml in the user's configuration directory)")
+	profileName := flagSet.String("profile", "", "use the flags of the named profile of the settings file")
 	if err := flagSet.Parse(args); err != nil {
 		return err
 	}
-
 	if flagSet.NArg() < 1 {
-		return fmt.Errorf("usage: rawhide [-K key] [-sz size] <image> [command] [args...]")
+		return fmt.Errorf("usage: rawhide [-K key] [-sz size] [-sb group] [-vol index] [-j] [-lba-size n] [-table mbr|gpt] [-cache MiB] [-mem MiB] [-timeout d] [-direct] [-mmap] [-map] [-disk-order] [-fill-errors] [-hash-log file [-hash-algo name]] [-config file] [-profile name] <image> [command] [args...]")
 	}
 
 	imagePath := flagSet.Arg(0)
 	cmdArgs := flagSet.Args()[1:]
 
-	// Parse crypto params
-	var crypto *cryptoParams
-	if *keyHex != "" {
-		key, err := hex.DecodeString(*keyHex)
+	settings, err := loadSettings(*configPath, *profileName, imagePath, stderr)
+	if err != nil {
+		return err
+	}
+	if err := applySettings(flagSet, settings); err != nil {
+		return err
+	}
+	commandFlags = settings
+	fsys.DefaultCache.SetSize(int64(*cacheSize) << 20)
+	fsys.DefaultBudget.SetLimit(int64(*memLimit) << 20)
+
+	// mkfs and mkimage make the image rather than reading it
+	if len(cmdArgs) > 0 && cmdArgs[0] == "mkfs" {
+		return runMkfs(imagePath, cmdArgs[1:])
+	}
+	if len(cmdArgs) > 0 && cmdArgs[0] == "mkimage" {
+		return runMkimage(imagePath, cmdArgs[1:])
+	}
+
+	// An interrupt stops reads of the image, and with them the command;
+	// a second one kills the program
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *fillErrors {
+		opts.FillErrors = func(bad fsys.Range, err error) {
+			fmt.Fprintf(stderr, "fscat: reading bytes %d-%d as zeros: %v\n", bad.Start, bad.End-1, err)
+		}
+	}
+	var hashing *fsys.HashingReaderAt
+	if *hashLog != "" {
+		newHash, ok := hashAlgorithms[*hashAlgo]
+		if !ok {
+			return fmt.Errorf("unknown digest %q: use md5, sha1, sha256 or blake3", *hashAlgo)
+		}
+		logFile, err := os.Create(*hashLog)
 		if err != nil {
-			return fmt.Errorf("invalid key hex: %w", err)
+			return err
 		}
-		crypto = &cryptoParams{
-			key:        key,
-			sectorSize: *sectorSize,
+		defer logFile.Close()
+		log := bufio.NewWriter(logFile)
+		fmt.Fprintf(log, "# rawhide read log of %s, %s, %s\n", imagePath, *hashAlgo, time.Now().UTC().Format(time.RFC3339))
+		fmt.Fprintf(log, "# offset length digest\n")
+		opts.WrapSource = func(r io.ReaderAt, size int64) io.ReaderAt {
+			hashing = fsys.NewHashingReaderAt(r, size, newHash, log)
+			return hashing
 		}
+		defer func() {
+			if hashing == nil {
+				return
+			}
+			err := hashing.Finish()
+			if ferr := log.Flush(); err == nil {
+				err = ferr
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "fscat: writing %s: %v\n", *hashLog, err)
+			}
+			if digest := hashing.ImageDigest(); digest != nil {
+				fmt.Fprintf(stderr, "fscat: %s of the image: %x\n", *hashAlgo, digest)
+			}
+		}()
 	}
 
-	// Open image file
-	file, err := os.Open(imagePath)
+	img, err := imagefs.OpenImageContext(ctx, imagePath, *opts)
 	if err != nil {
-		return fmt.Errorf("opening image: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer img.Close()
 
-	info, err := file.Stat()
+	err = runCommand(ctx, img.FS, cmdArgs, stdout, stderr)
+	if *fillErrors {
+		reportUnreadable(img.Unreadable(), stderr)
+	}
+	return err
+}
+
+// loadSettings reads the settings file, at path or where
+// config.DefaultPath says, which need not exist then, and returns the
+// settings for the image: those of the whole file followed by those of the
+// profile named, or else of the first profile for the image
+func loadSettings(path, profileName, imagePath string, stderr io.Writer) ([]settingsSource, error) {
+	given := path != ""
+	if !given {
+		var err error
+		if path, err = config.DefaultPath(); err != nil && profileName == "" {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("-profile: %w", err)
+		}
+	}
+	cfg, err := config.Load(path)
+	if errors.Is(err, fs.ErrNotExist) && !given && profileName == "" {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("stat image: %w", err)
+		return nil, err
 	}
+	settings := []settingsSource{{path, cfg.Settings}}
 
-	// Wrap with decryption if needed
-	var reader io.ReaderAt = file
-	size := info.Size()
-	if crypto != nil {
-		reader, err = wrapWithDecryption(reader, size, crypto)
+	profile := cfg.Profile(profileName)
+	if profileName != "" && profile == nil {
+		return nil, fmt.Errorf("%s has no profile %s", path, profileName)
+	}
+	if profile == nil {
+		profile, err = cfg.Find(imagePath, func() (string, error) {
+			// URLs, and images mkfs and mkimage are yet to make, have none
+			if strings.Contains(imagePath, "://") {
+				return "", nil
+			}
+			f, err := os.Open(imagePath)
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", nil
+			} else if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return config.HeadDigest(f)
+		})
 		if err != nil {
-			return fmt.Errorf("setting up decryption: %w", err)
+			return nil, fmt.Errorf("picking a profile of %s: %w", path, err)
+		}
+		if profile != nil {
+			fmt.Fprintf(stderr, "fscat: using profile %s of %s\n", profile.Name, path)
 		}
 	}
-
-	// Detect filesystem type
-	fsType, err := detect.Detect(reader)
-	if err != nil {
-		return fmt.Errorf("detecting filesystem: %w", err)
+	if profile != nil {
+		settings = append(settings, settingsSource{fmt.Sprintf("%s: profile %s", path, profile.Name), profile.Settings})
 	}
+	return settings, nil
+}
+
+// settingsSource is settings and where they come from, for errors
+type settingsSource struct {
+	name string
+	config.Settings
+}
 
-	if fsType == detect.Unknown {
-		return fmt.Errorf("unknown or unsupported filesystem")
+// applySettings sets the flags the settings give and the command line does
+// not, later settings over earlier ones
+func applySettings(flagSet *flag.FlagSet, settings []settingsSource) error {
+	given := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, src := range settings {
+		for _, s := range src.Flags {
+			if s.Name == "config" || s.Name == "profile" || flagSet.Lookup(s.Name) == nil {
+				return fmt.Errorf("%s: unknown flag -%s", src.name, s.Name)
+			}
+			if given[s.Name] {
+				continue
+			}
+			if err := flagSet.Set(s.Name, s.Value); err != nil {
+				return fmt.Errorf("%s: -%s %q: %w", src.name, s.Name, s.Value, err)
+			}
+		}
 	}
+	return nil
+}
 
-	// Open filesystem
-	filesystem, err := openFilesystem(reader, size, fsType)
-	if err != nil {
-		return fmt.Errorf("opening filesystem: %w", err)
+// commandFlags are the settings parseFlags gives the commands their flags
+// from, set by run
+var commandFlags []settingsSource
+
+// parseFlags parses the arguments of a command, then sets the flags the
+// settings give the command and args do not. The command is the first word
+// of the name of flagSet, so that [manifest] gives the flags of manifest
+// create and manifest verify, each taking those it has.
+func parseFlags(flagSet *flag.FlagSet, args []string) error {
+	if err := flagSet.Parse(args); err != nil {
+		return err
 	}
-	defer filesystem.Close()
+	command, sub, _ := strings.Cut(flagSet.Name(), " ")
+	given := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, src := range commandFlags {
+		for _, s := range src.Commands[command] {
+			if flagSet.Lookup(s.Name) == nil {
+				if sub != "" {
+					continue
+				}
+				return fmt.Errorf("%s: [%s]: unknown flag -%s", src.name, command, s.Name)
+			}
+			if given[s.Name] {
+				continue
+			}
+			if err := flagSet.Set(s.Name, s.Value); err != nil {
+				return fmt.Errorf("%s: [%s]: -%s %q: %w", src.name, command, s.Name, s.Value, err)
+			}
+		}
+	}
+	return nil
+}
 
-	return runCommand(filesystem, cmdArgs, stdout, stderr)
+// reportUnreadable lists the ranges of the image -fill-errors read as zeros
+func reportUnreadable(bad []fsys.Range, stderr io.Writer) {
+	if len(bad) == 0 {
+		return
+	}
+	var total int64
+	for _, r := range bad {
+		total += r.Size()
+	}
+	fmt.Fprintf(stderr, "fscat: %d bytes in %d ranges could not be read and were read as zeros:\n", total, len(bad))
+	for _, r := range bad {
+		fmt.Fprintf(stderr, "  bytes %d-%d (%d sectors)\n", r.Start, r.End-1, r.Size()/512)
+	}
 }
 
 // wrapWithDecryption wraps a reader with XTS decryption
@@ -132,7 +421,7 @@ func wrapWithDecryption(r io.ReaderAt, size int64, crypto *cryptoParams) (*xts.R
 }
 
 // runCommand executes a command against a filesystem
-func runCommand(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+func runCommand(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
 	// Default command is info
 	if len(args) == 0 {
 		return runInfo(filesystem, stdout)
@@ -143,67 +432,126 @@ func runCommand(filesystem fsys.FS, args []string, stdout, stderr io.Writer) err
 
 	switch command {
 	case "ls":
-		return runLs(filesystem, cmdArgs, stdout)
+		return runLs(filesystem, cmdArgs, stdout, stderr)
+	case "stat":
+		return runStat(filesystem, cmdArgs, stdout)
+	case "xattr":
+		return runXattr(filesystem, cmdArgs, stdout)
 	case "cat":
-		return runCat(filesystem, cmdArgs, stdout)
+		return runCat(filesystem, cmdArgs, stdout, stderr)
+	case "extract":
+		return runExtract(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "find":
+		return runFind(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "du":
+		return runDu(filesystem, cmdArgs, stdout, stderr)
+	case "frag":
+		return runFrag(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "diff":
+		return runDiff(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "manifest":
+		return runManifest(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "tree":
+		return runTree(filesystem, cmdArgs, stdout, stderr)
+	case "grep":
+		return runGrep(filesystem, cmdArgs, stdout, stderr)
+	case "strings":
+		return runStrings(filesystem, cmdArgs, stdout, stderr)
+	case "dd":
+		return runDd(filesystem, cmdArgs, stdout)
+	case "extents":
+		return runExtents(filesystem, cmdArgs, stdout)
+	case "xxd":
+		return runXxd(filesystem, cmdArgs, stdout)
+	case "timeline":
+		return runTimeline(filesystem, cmdArgs, stdout, stderr)
+	case "hash":
+		return runHash(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "tar":
+		return runTar(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "zip":
+		return runZip(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "put":
+		return runPut(filesystem, cmdArgs)
+	case "write":
+		return runWrite(filesystem, cmdArgs, os.Stdin, stderr)
 	case "fscat", "fs":
-		return runFscat(filesystem, cmdArgs, stdout, stderr)
+		return runFscat(ctx, filesystem, cmdArgs, stdout, stderr)
+	case "fsck", "verify":
+		return runFsck(filesystem, stdout)
+	case "journal":
+		return runJournal(filesystem, stdout)
+	case "dumpmeta":
+		return runDumpmeta(filesystem, cmdArgs, stdout)
+	case "inventory":
+		return runInventory(filesystem, cmdArgs, stdout, stderr)
+	case "scan":
+		return runScan(filesystem, cmdArgs, stdout)
+	case "carve":
+		return runCarve(filesystem, cmdArgs, stdout)
+	case "entropy":
+		return runEntropy(filesystem, cmdArgs, stdout)
 	case "freecat", "fc":
-		return runFreeCat(filesystem, stdout)
+		return runFreeCat(filesystem, cmdArgs, stdout, stderr)
 	case "freefscat", "ffs":
-		return runFreeFscat(filesystem, cmdArgs, stdout, stderr)
+		return runFreeFscat(ctx, filesystem, cmdArgs, stdout, stderr)
 	case "nbd":
 		return runNbd(filesystem, cmdArgs, stdout, stderr)
+	case "nbdall":
+		return runNbdAll(filesystem, cmdArgs, stdout, stderr)
 	case "freenbd", "fnbd":
 		return runFreeNbd(filesystem, cmdArgs, stdout, stderr)
+	case "serve":
+		return runServe(filesystem, cmdArgs, stdout, stderr)
+	case "9p":
+		return runNinep(filesystem, cmdArgs, stdout, stderr)
+	case "iscsi":
+		return runIscsi(filesystem, cmdArgs, stdout, stderr)
 	default:
-		return fmt.Errorf("unknown command: %s (use ls, cat, fscat|fs, freecat|fc, freefscat|ffs, nbd, freenbd|fnbd)", command)
+		return fmt.Errorf("unknown command: %s (use ls, stat, xattr, cat, find, du, frag, diff, manifest, tree, grep, strings, hash, timeline, dd, xxd, extents, extract, tar, zip, put, write, fscat|fs, fsck|verify, journal, dumpmeta, inventory, scan, carve, entropy, freecat|fc, freefscat|ffs, nbd, nbdall, freenbd|fnbd, serve, 9p, iscsi)", command)
 	}
 }
 
-// getReaderForPath returns a ReaderAt and size for a file path using extent mapping
-func getReaderForPath(filesystem fsys.FS, path string) (io.ReaderAt, int64, error) {
-	info, err := filesystem.Stat(path)
+// globPaths returns the paths matching a pattern with the wildcards of
+// path.Match, such as "Users/*/NTUSER.DAT", or the path itself if it has
+// none, whether or not it exists
+func globPaths(filesystem fsys.FS, pattern string) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	paths, err := fs.Glob(filesystem, pattern)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	if info.IsDir() {
-		return nil, 0, fmt.Errorf("%s is a directory", path)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no matching files", pattern)
 	}
+	return paths, nil
+}
 
-	fileSize := info.Size()
+// hasGlobMeta reports whether a path has wildcards for path.Match
+func hasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
 
-	// Try extent-based access first
-	if em, ok := filesystem.(fsys.ExtentMapper); ok {
-		if br, ok := filesystem.(interface{ BaseReader() io.ReaderAt }); ok {
-			extents, err := em.FileExtents(path)
-			if err == nil && len(extents) > 0 {
-				return fsys.NewExtentReaderAt(br.BaseReader(), extents, fileSize), fileSize, nil
-			}
+// globBase returns the directory of a pattern above its first wildcard
+func globBase(pattern string) string {
+	dir := "."
+	for _, elem := range strings.Split(pattern, "/") {
+		if hasGlobMeta(elem) {
+			break
 		}
+		dir = path.Join(dir, elem)
 	}
-
-	// Fall back to reading into memory
-	file, err := filesystem.Open(path)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer file.Close()
-
-	data, err := io.ReadAll(file.(io.Reader))
-	if err != nil {
-		return nil, 0, err
-	}
-	return bytes.NewReader(data), int64(len(data)), nil
+	return dir
 }
 
 // runFscat handles the fscat command for nested images
-func runFscat(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
-	// Parse encryption flags
+func runFscat(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
 	flagSet := flag.NewFlagSet("fscat", flag.ContinueOnError)
-	keyHex := flagSet.String("K", "", "XTS-AES key in hexadecimal")
-	sectorSize := flagSet.Int("sz", 512, "Sector size for XTS encryption")
-	if err := flagSet.Parse(args); err != nil {
+	opts := addOpenFlags(flagSet)
+	auto := flagSet.Bool("auto", false, "descend on through the partition table, and the key with -K, to the one filesystem inside")
+	if err := parseFlags(flagSet, args); err != nil {
 		return err
 	}
 
@@ -213,201 +561,665 @@ func runFscat(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error
 
 	innerPath := flagSet.Arg(0)
 	remainingArgs := flagSet.Args()[1:]
-
-	// Parse crypto params
-	var crypto *cryptoParams
-	if *keyHex != "" {
-		key, err := hex.DecodeString(*keyHex)
-		if err != nil {
-			return fmt.Errorf("invalid key hex: %w", err)
-		}
-		crypto = &cryptoParams{
-			key:        key,
-			sectorSize: *sectorSize,
-		}
+	if *auto {
+		return runFscatAuto(ctx, filesystem, innerPath, *opts, remainingArgs, stdout, stderr)
 	}
 
-	reader, fileSize, err := getReaderForPath(filesystem, innerPath)
+	innerFS, err := imagefs.OpenFile(filesystem, innerPath, *opts)
 	if err != nil {
-		return fmt.Errorf("accessing %s: %w", innerPath, err)
+		return err
 	}
+	defer imagefs.CloseFile(filesystem, innerFS)
 
-	// Wrap with decryption if needed
-	if crypto != nil {
-		reader, err = wrapWithDecryption(reader, fileSize, crypto)
+	// Recursively execute the command (default = info)
+	return runCommand(ctx, innerFS, remainingArgs, stdout, stderr)
+}
+
+// maxAutoDepth bounds how many images fscat -auto descends through
+const maxAutoDepth = 8
+
+// runFscatAuto opens the image in name, then keeps opening the partition of
+// each partition table that holds something, as long as there is just one,
+// printing each step with the arguments that reach it. The key is only
+// used for images that cannot be opened without it, at whatever level.
+func runFscatAuto(ctx context.Context, filesystem fsys.FS, name string, opts imagefs.Options, args []string, stdout, stderr io.Writer) error {
+	// The images after the first are in partitions, closed with the
+	// partition tables holding them
+	var first fsys.FS
+	parent := filesystem
+	defer func() {
+		if first != nil {
+			imagefs.CloseFile(parent, first)
+		}
+	}()
+
+	addr := "fs"
+	for depth := 0; ; depth++ {
+		inner, keyed, err := openAuto(filesystem, name, opts)
+		if keyed {
+			addr += " -K <key>"
+		}
+		addr += " " + shellQuote(name)
 		if err != nil {
-			return fmt.Errorf("setting up decryption for %s: %w", innerPath, err)
+			return err
 		}
-	}
+		if depth == 0 {
+			first = inner
+		}
+		filesystem = inner
+		fmt.Fprintf(stderr, "fscat: %s  %s\n", inner.Type(), addr)
 
-	// Detect filesystem type
-	fsType, err := detect.Detect(reader)
-	if err != nil {
-		return fmt.Errorf("detecting filesystem in %s: %w", innerPath, err)
+		pfs, ok := filesystem.(*part.FS)
+		if !ok || depth+1 >= maxAutoDepth {
+			break
+		}
+		var found []string
+		for _, p := range pfs.Partitions() {
+			switch {
+			case p.Content != detect.Unknown:
+				found = append(found, fmt.Sprintf("%s (%s)", p.Name, p.Content))
+			case opts.Key != nil && p.SizeLBA > 0 && probeEncrypted(pfs, p.Name, opts):
+				found = append(found, fmt.Sprintf("%s (encrypted)", p.Name))
+			}
+		}
+		if len(found) != 1 {
+			if len(found) > 1 {
+				fmt.Fprintf(stderr, "fscat: stopping at the %s: %s hold images\n", filesystem.Type(), strings.Join(found, ", "))
+			}
+			break
+		}
+		name, _, _ = strings.Cut(found[0], " ")
+		addr += " fs"
 	}
 
-	if fsType == detect.Unknown {
-		return fmt.Errorf("unknown or unsupported filesystem in %s", innerPath)
+	return runCommand(ctx, filesystem, args, stdout, stderr)
+}
+
+// openAuto opens the image in name without the key of opts, then with it
+// if that fails, reporting whether the key was used
+func openAuto(parent fsys.FS, name string, opts imagefs.Options) (fsys.FS, bool, error) {
+	plain := opts
+	plain.Key = nil
+	filesystem, err := imagefs.OpenFile(parent, name, plain)
+	if err == nil || opts.Key == nil {
+		return filesystem, false, err
 	}
+	if filesystem, kerr := imagefs.OpenFile(parent, name, opts); kerr == nil {
+		return filesystem, true, nil
+	}
+	return nil, false, err
+}
 
-	// Open the inner filesystem
-	innerFS, err := openFilesystem(reader, fileSize, fsType)
+// probeEncrypted reports whether the image in name opens with the key of
+// opts and not without it. What it opens is closed again rather than kept
+// with the partition table, as most partitions probed are not used.
+func probeEncrypted(parent fsys.FS, name string, opts imagefs.Options) bool {
+	r, size, err := fsys.OpenReaderAt(parent, name)
 	if err != nil {
-		return fmt.Errorf("opening filesystem in %s: %w", innerPath, err)
+		return false
 	}
-	defer innerFS.Close()
-
-	// Recursively execute the command (default = info)
-	return runCommand(innerFS, remainingArgs, stdout, stderr)
+	defer r.Close()
+	plain := opts
+	plain.Key = nil
+	if filesystem, err := imagefs.Open(r, size, plain); err == nil {
+		filesystem.Close()
+		return false
+	}
+	filesystem, err := imagefs.Open(r, size, opts)
+	if err != nil {
+		return false
+	}
+	filesystem.Close()
+	return true
 }
 
-// runFreeCat copies free space to stdout
-func runFreeCat(filesystem fsys.FS, out io.Writer) error {
-	fb, ok := filesystem.(fsys.FreeBlocker)
-	if !ok {
-		return fmt.Errorf("filesystem type %s does not support free block listing", filesystem.Type())
+// runInventory opens every partition, APFS volume and filesystem image
+// inside a file it can find, recursively, and prints them as a tree with
+// the rawhide arguments that reach each one
+func runInventory(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	depth := flagSet.Int("depth", 4, "levels of nesting to open")
+	minArg := flagSet.String("min", "1M", "smallest file to look for an image in")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
 	}
-
-	ranges, err := fb.FreeBlocks()
+	if flagSet.NArg() > 0 {
+		return fmt.Errorf("usage: inventory [-depth n] [-min size]")
+	}
+	minSize, err := parseByteCount(*minArg)
 	if err != nil {
-		return fmt.Errorf("getting free blocks: %w", err)
+		return err
 	}
 
-	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
-	if !ok {
-		return fmt.Errorf("filesystem does not expose base reader")
-	}
+	inv := &inventory{out: stdout, stderr: stderr, maxDepth: *depth, minSize: minSize}
+	inv.volumes(filesystem, -1, "rawhide", "<image>", 0)
+	return nil
+}
 
-	// Convert ranges to extents
-	extents := make([]fsys.Extent, len(ranges))
-	var totalSize int64
-	for i, r := range ranges {
-		extents[i] = fsys.Extent{
-			Logical:  totalSize,
-			Physical: r.Start,
-			Length:   r.Size(),
+// inventory holds the settings of runInventory
+type inventory struct {
+	out, stderr io.Writer
+	maxDepth    int
+	minSize     int64 // Smaller files are not looked into; partitions always are
+}
+
+// volumes prints filesystem, or each volume if it is an APFS container
+// with several, and what they hold. The volume is reached by the arguments
+// in prefix, then any -vol flag, then path. size is -1 if unknown.
+func (inv *inventory) volumes(filesystem fsys.FS, size int64, prefix, path string, depth int) {
+	c, ok := filesystem.(interface {
+		VolumeCount() int
+		Volume(index int) (fsys.FS, error)
+	})
+	if !ok || c.VolumeCount() < 2 {
+		inv.volume(filesystem, size, prefix+" "+path, depth)
+		return
+	}
+	for i := 0; i < c.VolumeCount(); i++ {
+		addr := fmt.Sprintf("%s -vol %d %s", prefix, i, path)
+		vol, err := c.Volume(i)
+		if err != nil {
+			inv.line(depth, filesystem.Type(), size, "", addr, err)
+			continue
 		}
-		totalSize += r.Size()
+		inv.volume(vol, size, addr, depth)
+		vol.Close()
 	}
-
-	reader := fsys.NewExtentReaderAt(br.BaseReader(), extents, totalSize)
-	return streamToWriter(reader, totalSize, out)
 }
 
-// runFreeFscat probes free space as a filesystem image
-func runFreeFscat(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
-	fb, ok := filesystem.(fsys.FreeBlocker)
-	if !ok {
-		return fmt.Errorf("filesystem type %s does not support free block listing", filesystem.Type())
+// volume prints a volume reached by addr, then looks for volumes in its
+// partitions or files
+func (inv *inventory) volume(filesystem fsys.FS, size int64, addr string, depth int) {
+	label := ""
+	if l, ok := filesystem.(fsys.Labeler); ok {
+		label = l.Label()
+	}
+	inv.line(depth, filesystem.Type(), size, label, addr, nil)
+	if depth >= inv.maxDepth {
+		return
 	}
 
-	ranges, err := fb.FreeBlocks()
+	_, isTable := filesystem.(*part.FS)
+	err := fs.WalkDir(filesystem, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintf(inv.stderr, "inventory: %s: %v\n", addr, err)
+			return nil
+		}
+		if name == "." {
+			return nil
+		}
+		if isSystemFile(d.Name()) {
+			return fs.SkipDir // Or skips the file
+		}
+		switch {
+		case isTable:
+			// A partition holding a partition table is a directory; it is
+			// opened like the others, so that its table is shown
+			inv.child(filesystem, name, addr, depth+1)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		case d.Type().IsRegular():
+			if info, err := d.Info(); err == nil && info.Size() >= inv.minSize {
+				inv.child(filesystem, name, addr, depth+1)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("getting free blocks: %w", err)
+		fmt.Fprintf(inv.stderr, "inventory: %s: %v\n", addr, err)
 	}
+}
 
-	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
-	if !ok {
-		return fmt.Errorf("filesystem does not expose base reader")
-	}
+// child prints the volume in a partition or file of parent, if any, and
+// what it holds
+func (inv *inventory) child(parent fsys.FS, name, parentAddr string, depth int) {
+	addr := parentAddr + " fs " + shellQuote(name)
 
-	// Convert ranges to extents
-	extents := make([]fsys.Extent, len(ranges))
-	var totalSize int64
-	for i, r := range ranges {
-		extents[i] = fsys.Extent{
-			Logical:  totalSize,
-			Physical: r.Start,
-			Length:   r.Size(),
+	// The partition table has looked for content already, and knows that
+	// extended partitions only hold the logical partitions it lists
+	if info, err := parent.Stat(name); err == nil {
+		if p, ok := info.Sys().(*part.Partition); ok && p.Content == detect.Unknown {
+			inv.line(depth, part.PartitionTypeString(p)+" partition", info.Size(), "", addr, nil)
+			return
 		}
-		totalSize += r.Size()
 	}
 
-	reader := fsys.NewExtentReaderAt(br.BaseReader(), extents, totalSize)
-
-	// Detect filesystem type
-	fsType, err := detect.Detect(reader)
+	r, size, err := fsys.OpenReaderAt(parent, name)
 	if err != nil {
-		return fmt.Errorf("detecting filesystem in free space: %w", err)
+		inv.line(depth, "unknown", -1, "", addr, err)
+		return
 	}
-
-	if fsType == detect.Unknown {
-		return fmt.Errorf("no recognizable filesystem in free space")
+	defer r.Close()
+	candidates, err := detect.DetectAll(r)
+	if err != nil || len(candidates) == 0 {
+		return // Not an image
 	}
 
-	// Open the filesystem
-	innerFS, err := openFilesystem(reader, totalSize, fsType)
+	filesystem, err := imagefs.Open(r, size, imagefs.Options{})
 	if err != nil {
-		return fmt.Errorf("opening filesystem in free space: %w", err)
+		inv.line(depth, candidates[0].Type.String(), size, "", addr, err)
+		return
 	}
-	defer innerFS.Close()
-
-	return runCommand(innerFS, args, stdout, stderr)
+	defer filesystem.Close()
+	inv.volumes(filesystem, size, parentAddr+" fs", shellQuote(name), depth)
 }
 
-// runNbd exposes a file as an NBD block device
-func runNbd(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
-	flagSet := flag.NewFlagSet("nbd", flag.ContinueOnError)
-	socketPath := flagSet.String("socket", "/tmp/nbd.sock", "Unix socket path")
-	exportName := flagSet.String("name", "export", "Export name for NBD clients")
-	readWrite := flagSet.Bool("rw", false, "Enable read-write access")
-	keyHex := flagSet.String("K", "", "XTS-AES key in hexadecimal")
-	sectorSize := flagSet.Int("sz", 512, "Sector size for XTS encryption")
-	if err := flagSet.Parse(args); err != nil {
-		return err
+// line prints one volume of the inventory
+func (inv *inventory) line(depth int, typ string, size int64, label, addr string, err error) {
+	s := strings.Repeat("  ", depth) + typ
+	if size >= 0 {
+		s += " " + formatSize(size)
+	}
+	if label != "" {
+		s += fmt.Sprintf(" %q", label)
+	}
+	s += "  " + addr
+	if err != nil {
+		s += ": " + err.Error()
 	}
+	fmt.Fprintln(inv.out, s)
+}
 
-	if flagSet.NArg() < 1 {
-		return fmt.Errorf("nbd requires a path argument")
+// shellQuote quotes a path for a POSIX shell if it needs it
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+		return s
 	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	// Parse crypto params
-	var crypto *cryptoParams
-	if *keyHex != "" {
-		key, err := hex.DecodeString(*keyHex)
-		if err != nil {
-			return fmt.Errorf("invalid key hex: %w", err)
-		}
-		crypto = &cryptoParams{
-			key:        key,
-			sectorSize: *sectorSize,
-		}
+// runFsck checks filesystem metadata consistency and reports the problems found
+func runFsck(filesystem fsys.FS, out io.Writer) error {
+	checker, ok := filesystem.(fsys.Checker)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not support consistency checks", filesystem.Type())
 	}
 
-	path := flagSet.Arg(0)
-	reader, size, err := getReaderForPath(filesystem, path)
+	problems, err := checker.Check()
 	if err != nil {
-		return err
+		return fmt.Errorf("checking filesystem: %w", err)
 	}
 
-	// Wrap with decryption if needed
-	if crypto != nil {
-		reader, err = wrapWithDecryption(reader, size, crypto)
-		if err != nil {
-			return fmt.Errorf("setting up decryption: %w", err)
-		}
+	for _, p := range problems {
+		fmt.Fprintf(out, "%s: %s\n", p.Kind, p.Detail)
 	}
-
-	var writer io.WriterAt
-	if *readWrite {
-		writer, err = getWriterForReader(reader)
-		if err != nil {
-			return fmt.Errorf("cannot enable write access: %w", err)
-		}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
 	}
 
-	return serveNbd(*socketPath, *exportName, reader, writer, size, stdout, stderr)
+	fmt.Fprintf(out, "%s: no problems found\n", filesystem.Type())
+	return nil
 }
 
-// runFreeNbd exposes free space as an NBD block device
-func runFreeNbd(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
-	flagSet := flag.NewFlagSet("freenbd", flag.ContinueOnError)
-	socketPath := flagSet.String("socket", "/tmp/nbd.sock", "Unix socket path")
-	exportName := flagSet.String("name", "freespace", "Export name for NBD clients")
-	readWrite := flagSet.Bool("rw", false, "Enable read-write access")
-	if err := flagSet.Parse(args); err != nil {
+// runDumpmeta writes the decoded on-disk structures as JSON
+func runDumpmeta(filesystem fsys.FS, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("dumpmeta", flag.ContinueOnError)
+	record := flagSet.Int64("record", -1, "also decode inode or MFT record `n`")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 0 {
+		return fmt.Errorf("usage: dumpmeta [-record n]")
+	}
+	d, ok := filesystem.(fsys.MetadataDumper)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not support metadata dumps", filesystem.Type())
+	}
+
+	m, err := d.Metadata(*record)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// runJournal lists the transactions pending in the filesystem journal
+func runJournal(filesystem fsys.FS, out io.Writer) error {
+	j, ok := filesystem.(fsys.Journaler)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not support journal inspection", filesystem.Type())
+	}
+
+	txns, err := j.JournalTransactions()
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	for i, txn := range txns {
+		fmt.Fprintf(out, "transaction %d at offset %d: %d blocks\n", i, txn.Offset, len(txn.Blocks))
+		for _, b := range txn.Blocks {
+			fmt.Fprintf(out, "  offset %d, %d bytes\n", b.Target, len(b.Data))
+		}
+	}
+	if len(txns) == 0 {
+		fmt.Fprintln(out, "no pending transactions")
+	}
+	return nil
+}
+
+// runScan lists the offsets at which filesystems appear to start, within
+// a file or, without one, within the free space. Matches in free space are
+// reported at their offset in the image.
+func runScan(filesystem fsys.FS, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: scan [path]")
+	}
+
+	var reader io.ReaderAt
+	var size int64
+	var ranges []fsys.Range
+	var err error
+	if len(args) == 1 {
+		var r fsys.ReaderAtCloser
+		r, size, err = fsys.OpenReaderAt(filesystem, args[0])
+		if err == nil {
+			defer r.Close()
+			reader = r
+		}
+	} else {
+		reader, size, ranges, err = freeSpaceReader(filesystem)
+	}
+	if err != nil {
+		return err
+	}
+
+	matches, err := detect.Scan(reader, size)
+	if err != nil {
+		return fmt.Errorf("scanning: %w", err)
+	}
+	for _, m := range matches {
+		fmt.Fprintf(out, "%12d %s\n", imageOffset(ranges, m.Offset), m.Type)
+	}
+	return nil
+}
+
+// freeSpaceReader returns a reader of the free space of a filesystem, all
+// its free ranges one after the other
+func freeSpaceReader(filesystem fsys.FS) (io.ReaderAt, int64, []fsys.Range, error) {
+	fb, ok := filesystem.(fsys.FreeBlocker)
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("filesystem type %s does not support free block listing", filesystem.Type())
+	}
+	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("filesystem does not expose base reader")
+	}
+	ranges, err := fb.FreeBlocks()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("getting free blocks: %w", err)
+	}
+	var extents []fsys.Extent
+	var size int64
+	for _, r := range ranges {
+		extents = append(extents, fsys.Extent{Logical: size, Physical: r.Start, Length: r.Size()})
+		size += r.Size()
+	}
+	return fsys.NewExtentReaderAt(br.BaseReader(), extents, size), size, ranges, nil
+}
+
+// imageOffset translates an offset in the reader of freeSpaceReader to
+// the image. Without ranges the offset is returned as is.
+func imageOffset(ranges []fsys.Range, offset int64) int64 {
+	for _, r := range ranges {
+		if offset < r.Size() {
+			return offset + r.Start
+		}
+		offset -= r.Size()
+	}
+	return offset
+}
+
+// runEntropy prints the Shannon entropy of each block of a file, the image
+// or the free space as CSV, or draws it as a PNG heatmap. Encrypted and
+// compressed data is close to 8 bits per byte.
+func runEntropy(filesystem fsys.FS, args []string, stdout io.Writer) error {
+	flagSet := flag.NewFlagSet("entropy", flag.ContinueOnError)
+	bsArg := flagSet.String("bs", "64k", "block size")
+	free := flagSet.Bool("free", false, "measure the free space instead of the image")
+	pngFile := flagSet.String("png", "", "draw a heatmap to `file` instead of writing CSV")
+	width := flagSet.Int("width", 256, "blocks per row of the heatmap")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 || (*free && flagSet.NArg() > 0) {
+		return fmt.Errorf("usage: entropy [-bs size] [-free] [-png file [-width n]] [path]")
+	}
+	bs, err := parseByteCount(*bsArg)
+	if err != nil {
+		return err
+	}
+	if bs < 1 || bs > 1<<30 || *width < 1 {
+		return fmt.Errorf("bad block size or width")
+	}
+
+	var reader io.ReaderAt
+	size := int64(-1) // Unknown: up to EOF
+	var ranges []fsys.Range
+	switch {
+	case *free:
+		reader, size, ranges, err = freeSpaceReader(filesystem)
+	case flagSet.NArg() == 1:
+		var r fsys.ReaderAtCloser
+		r, size, err = fsys.OpenReaderAt(filesystem, flagSet.Arg(0))
+		if err == nil {
+			defer r.Close()
+			reader = r
+		}
+	default:
+		br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+		if !ok {
+			return fmt.Errorf("filesystem does not expose base reader")
+		}
+		reader = br.BaseReader()
+		if s, ok := reader.(interface{ Size() int64 }); ok {
+			size = s.Size()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(stdout)
+	if *pngFile == "" {
+		fmt.Fprintln(out, "offset,entropy")
+	}
+	var values []float64
+	buf := make([]byte, bs)
+	for off := int64(0); size < 0 || off < size; off += bs {
+		n := int64(len(buf))
+		if size >= 0 {
+			n = min(n, size-off)
+		}
+		got, err := reader.ReadAt(buf[:n], off)
+		if got > 0 {
+			e := entropy(buf[:got])
+			if *pngFile != "" {
+				values = append(values, e)
+			} else {
+				fmt.Fprintf(out, "%d,%.4f\n", imageOffset(ranges, off), e)
+			}
+		}
+		if err == io.EOF || got == 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if *pngFile == "" {
+		return out.Flush()
+	}
+	return writeHeatmap(*pngFile, values, *width)
+}
+
+// entropy returns the Shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// heatStops are the colors of the heatmap: black for empty blocks, blue
+// for text and code, green for media and red for encrypted or compressed
+// data
+var heatStops = []struct {
+	entropy float64
+	c       color.NRGBA
+}{
+	{0, color.NRGBA{0, 0, 0, 255}},
+	{4, color.NRGBA{0, 0, 255, 255}},
+	{6, color.NRGBA{0, 200, 0, 255}},
+	{7.5, color.NRGBA{255, 255, 0, 255}},
+	{8, color.NRGBA{255, 0, 0, 255}},
+}
+
+// writeHeatmap draws one pixel per block, width blocks to a row
+func writeHeatmap(name string, values []float64, width int) error {
+	width = max(min(width, len(values)), 1)
+	img := image.NewNRGBA(image.Rect(0, 0, width, (len(values)+width-1)/width))
+	for i, e := range values {
+		c := heatStops[len(heatStops)-1].c
+		for j := 1; j < len(heatStops); j++ {
+			if lo, hi := heatStops[j-1], heatStops[j]; e <= hi.entropy {
+				t := (e - lo.entropy) / (hi.entropy - lo.entropy)
+				mix := func(a, b uint8) uint8 { return uint8(float64(a) + t*(float64(b)-float64(a))) }
+				c = color.NRGBA{mix(lo.c.R, hi.c.R), mix(lo.c.G, hi.c.G), mix(lo.c.B, hi.c.B), 255}
+				break
+			}
+		}
+		img.SetNRGBA(i%width, i/width, c)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runCarve recovers files from the free space, or a file, by their
+// signatures, writing them to a directory with a CSV report
+func runCarve(filesystem fsys.FS, args []string, stdout io.Writer) error {
+	flagSet := flag.NewFlagSet("carve", flag.ContinueOnError)
+	outDir := flagSet.String("o", "carved", "`directory` to write the files to")
+	maxArg := flagSet.String("max", "64M", "largest file to recover")
+	typesArg := flagSet.String("types", "", "comma-separated types to recover (default: all)")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: carve [-o dir] [-max size] [-types list] [path]")
+	}
+	maxSize, err := parseByteCount(*maxArg)
+	if err != nil {
+		return err
+	}
+	types := carve.Types
+	if *typesArg != "" {
+		types = nil
+		for _, name := range strings.Split(*typesArg, ",") {
+			i := slices.IndexFunc(carve.Types, func(t *carve.Type) bool { return t.Name == name })
+			if i < 0 {
+				var names []string
+				for _, t := range carve.Types {
+					names = append(names, t.Name)
+				}
+				return fmt.Errorf("unknown type %q (use %s)", name, strings.Join(names, ", "))
+			}
+			types = append(types, carve.Types[i])
+		}
+	}
+
+	var reader io.ReaderAt
+	var size int64
+	var ranges []fsys.Range
+	if flagSet.NArg() == 1 {
+		var r fsys.ReaderAtCloser
+		r, size, err = fsys.OpenReaderAt(filesystem, flagSet.Arg(0))
+		if err == nil {
+			defer r.Close()
+			reader = r
+		}
+	} else {
+		reader, size, ranges, err = freeSpaceReader(filesystem)
+	}
+	if err != nil {
+		return err
+	}
+
+	matches, err := carve.Scan(reader, size, maxSize, types)
+	if err != nil {
+		return fmt.Errorf("carving: %w", err)
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return err
+	}
+	report, err := os.Create(filepath.Join(*outDir, "report.csv"))
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	cw := csv.NewWriter(report)
+	cw.Write([]string{"offset", "size", "type", "file"})
+
+	var total int64
+	for _, m := range matches {
+		offset := imageOffset(ranges, m.Offset)
+		name := fmt.Sprintf("%012d%s", offset, m.Type.Ext)
+		if err := writeCarved(filepath.Join(*outDir, name), io.NewSectionReader(reader, m.Offset, m.Size)); err != nil {
+			return err
+		}
+		cw.Write([]string{strconv.FormatInt(offset, 10), strconv.FormatInt(m.Size, 10), m.Type.Name, name})
+		fmt.Fprintf(stdout, "%12d %10d %-6s %s\n", offset, m.Size, m.Type.Name, name)
+		total += m.Size
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Recovered %d files, %d bytes to %s\n", len(matches), total, *outDir)
+	return report.Close()
+}
+
+// writeCarved writes a recovered file
+func writeCarved(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runFreeCat copies free space to stdout
+func runFreeCat(filesystem fsys.FS, args []string, out, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("freecat", flag.ContinueOnError)
+	progressOpts := addProgressFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
 		return err
 	}
+	if flagSet.NArg() > 0 {
+		return fmt.Errorf("usage: freecat [-progress] [-limit-rate n]")
+	}
 
 	fb, ok := filesystem.(fsys.FreeBlocker)
 	if !ok {
@@ -436,214 +1248,3982 @@ func runFreeNbd(filesystem fsys.FS, args []string, stdout, stderr io.Writer) err
 		totalSize += r.Size()
 	}
 
+	prog, err := progressOpts.start(stderr, func() int64 { return totalSize })
+	if err != nil {
+		return err
+	}
 	reader := fsys.NewExtentReaderAt(br.BaseReader(), extents, totalSize)
+	sparse, finish := sparseOutput(out)
+	err = streamToWriter(reader, totalSize, prog.writer(sparse))
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+	prog.finish()
+	return err
+}
+
+// runFreeFscat probes free space as a filesystem image, or with -scan
+// looks for filesystems starting anywhere in it, such as those of deleted
+// partitions
+func runFreeFscat(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("freefscat", flag.ContinueOnError)
+	scan := flagSet.Bool("scan", false, "look for filesystems at any offset in the free space, not only at its start")
+	at := flagSet.Int64("at", -1, "with -scan, open the filesystem found at this `offset` in the image")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if *at >= 0 && !*scan {
+		return fmt.Errorf("freefscat: -at needs -scan")
+	}
 
-	var writer io.WriterAt
-	if *readWrite {
-		writer, err = getWriterForReader(reader)
+	reader, totalSize, ranges, err := freeSpaceReader(filesystem)
+	if err != nil {
+		return err
+	}
+	if !*scan {
+		innerFS, err := imagefs.Open(reader, totalSize, imagefs.Options{})
 		if err != nil {
-			return fmt.Errorf("cannot enable write access: %w", err)
+			return fmt.Errorf("free space: %w", err)
 		}
+		defer innerFS.Close()
+		return runCommand(ctx, innerFS, flagSet.Args(), stdout, stderr)
 	}
 
-	return serveNbd(*socketPath, *exportName, reader, writer, totalSize, stdout, stderr)
+	innerFS, err := openFreeScan(reader, totalSize, ranges, *at, stderr)
+	if err != nil {
+		return err
+	}
+	defer innerFS.Close()
+	return runCommand(ctx, innerFS, flagSet.Args(), stdout, stderr)
 }
 
-// getWriterForReader creates a writer that uses the same extent map as the reader.
-// It requires the underlying base reader to be an *os.File so it can be re-opened for writing.
-// getWriterForReader creates a writer that uses the same extent map and encryption as the reader.
-// It unwraps XTS and extent layers to find the base file, then rebuilds the write chain.
-func getWriterForReader(reader io.ReaderAt) (io.WriterAt, error) {
-	// Unwrap layers to find base file and collect XTS cipher if present
-	var xtsCipher *xts.Cipher
-	var xtsSize int64
-	current := reader
+// openFreeScan opens the filesystem detect.Scan finds in the free space at
+// offset at of the image, or if at is negative the only one it finds that
+// opens. Each filesystem found is printed to stderr.
+func openFreeScan(reader io.ReaderAt, size int64, ranges []fsys.Range, at int64, stderr io.Writer) (fsys.FS, error) {
+	matches, err := detect.Scan(reader, size)
+	if err != nil {
+		return nil, fmt.Errorf("scanning free space: %w", err)
+	}
 
-	// Check for XTS layer first
-	if xtsReader, ok := current.(*xts.ReaderAt); ok {
-		xtsCipher = xtsReader.Cipher()
-		xtsSize = xtsReader.Size()
-		current = xtsReader.BaseReader()
+	var found fsys.FS
+	var offsets []string
+	for _, m := range matches {
+		offset := imageOffset(ranges, m.Offset)
+		if at >= 0 && offset != at {
+			continue
+		}
+		if group := extBackupGroup(reader, m); group > 0 {
+			fmt.Fprintf(stderr, "fscat: free space at %d: %s superblock copy of block group %d, skipped\n", offset, m.Type, group)
+			continue
+		}
+		// The filesystem may run on past the end of the free space, into
+		// blocks that have been reused since
+		length := size - m.Offset
+		r := fsys.NewExtentReaderAt(reader, []fsys.Extent{{Physical: m.Offset, Length: length}}, length)
+		filesystem, err := imagefs.Open(r, length, imagefs.Options{})
+		if err != nil {
+			fmt.Fprintf(stderr, "fscat: free space at %d: %s: %v\n", offset, m.Type, err)
+			continue
+		}
+		fmt.Fprintf(stderr, "fscat: free space at %d: %s\n", offset, filesystem.Type())
+		offsets = append(offsets, strconv.FormatInt(offset, 10))
+		if found != nil {
+			filesystem.Close()
+			continue
+		}
+		found = filesystem
 	}
 
-	// Check for extent layer
-	var extents []fsys.Extent
-	var extentSize int64
-	if extReader, ok := current.(*fsys.ExtentReaderAt); ok {
-		extents = extReader.Extents()
-		extentSize = extReader.Size()
-		current = extReader.BaseReader()
+	switch {
+	case found == nil && at >= 0:
+		return nil, fmt.Errorf("no filesystem opens at offset %d of the free space", at)
+	case found == nil:
+		return nil, fmt.Errorf("no filesystem found in the free space")
+	case len(offsets) > 1:
+		found.Close()
+		return nil, fmt.Errorf("%d filesystems found in the free space, at %s; pick one with -at", len(offsets), strings.Join(offsets, ", "))
 	}
+	return found, nil
+}
 
-	// Now we should have the base file
-	baseFile, ok := current.(*os.File)
-	if !ok {
-		return nil, fmt.Errorf("base reader is not a file (nested read-write not supported through memory buffers)")
+// extBackupGroup returns the block group of the ext superblock of a match
+// of detect.Scan, which is past 0 for the copies in later groups of a
+// filesystem that starts earlier, or 0
+func extBackupGroup(r io.ReaderAt, m detect.Match) int {
+	if !m.Type.IsExt() {
+		return 0
+	}
+	var group [2]byte
+	if _, err := r.ReadAt(group[:], m.Offset+1024+0x5A); err != nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(group[:]))
+}
+
+// runNbd exposes a file as an NBD block device
+func runNbd(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("nbd", flag.ContinueOnError)
+	socketPath := flagSet.String("socket", "/tmp/nbd.sock", "Unix socket path")
+	exportName := flagSet.String("name", "export", "Export name for NBD clients")
+	writes := addWriteFlags(flagSet)
+	idleTimeout := flagSet.Duration("idle-timeout", 0, "Stop after this long without connections, e.g. 10m (0 = never)")
+	keyHex := flagSet.String("K", "", "XTS-AES key in hexadecimal")
+	sectorSize := flagSet.Int("sz", 512, "Sector size for XTS encryption")
+	label := flagSet.String("n", "", "Volume label of the FAT image made of a directory or several files")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() < 1 {
+		return fmt.Errorf("nbd requires a path argument")
+	}
+
+	// Parse crypto params
+	var crypto *cryptoParams
+	if *keyHex != "" {
+		key, err := hex.DecodeString(*keyHex)
+		if err != nil {
+			return fmt.Errorf("invalid key hex: %w", err)
+		}
+		crypto = &cryptoParams{
+			key:        key,
+			sectorSize: *sectorSize,
+		}
+	}
+
+	var reader io.ReaderAt
+	var size int64
+	var err error
+	path := flagSet.Arg(0)
+	if info, err := filesystem.Stat(path); err == nil && info.IsDir() || flagSet.NArg() > 1 {
+		img, err := buildFATImage(filesystem, flagSet.Args(), *label)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		reader, size = img, img.Size()
+		fmt.Fprintf(stdout, "Exposing a %s FAT image of %s\n", formatSize(size), strings.Join(flagSet.Args(), " "))
+	} else {
+		file, fileSize, err := fsys.OpenReaderAt(filesystem, path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader, size = file, fileSize
+	}
+
+	// Wrap with decryption if needed
+	if crypto != nil {
+		reader, err = wrapWithDecryption(reader, size, crypto)
+		if err != nil {
+			return fmt.Errorf("setting up decryption: %w", err)
+		}
+	}
+
+	exp, err := writes.export(*exportName, reader, size)
+	if err != nil {
+		return err
+	}
+	defer writes.close()
+	writes.describe(stdout)
+	return serveNbd(*socketPath, *idleTimeout, []*nbd.Export{exp}, stdout, stderr)
+}
+
+// buildFATImage makes a FAT image of the files and directories at paths:
+// of what is in the directory if it is the only path, otherwise of them
+// all, each in the root
+func buildFATImage(filesystem fsys.FS, paths []string, label string) (*fat.Image, error) {
+	names := paths
+	if len(paths) == 1 {
+		entries, err := filesystem.ReadDir(paths[0])
+		if err != nil {
+			return nil, err
+		}
+		names = nil
+		for _, e := range entries {
+			if !isSystemFile(e.Name()) {
+				names = append(names, path.Join(paths[0], e.Name()))
+			}
+		}
+	}
+	img, err := fat.Build(filesystem, names, fat.FormatOptions{Label: label})
+	if err != nil {
+		return nil, fmt.Errorf("making a FAT image: %w", err)
+	}
+	return img, nil
+}
+
+// runNbdAll exposes every file matching the patterns, by default every
+// partition or top-level file, as an NBD export named after its path
+func runNbdAll(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("nbdall", flag.ContinueOnError)
+	socketPath := flagSet.String("socket", "/tmp/nbd.sock", "Unix socket path")
+	writes := addWriteFlags(flagSet)
+	idleTimeout := flagSet.Duration("idle-timeout", 0, "Stop after this long without connections, e.g. 10m (0 = never)")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	exports, err := globExports(filesystem, flagSet.Args(), writes)
+	defer writes.close()
+	if err != nil {
+		return err
+	}
+	writes.describe(stdout)
+	return serveNbd(*socketPath, *idleTimeout, exports, stdout, stderr)
+}
+
+// globExports makes an export, named after its path, of every file matching
+// the patterns, by default every partition or top-level file
+func globExports(filesystem fsys.FS, patterns []string, writes *writeOptions) ([]*nbd.Export, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	var exports []*nbd.Export
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(filesystem, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+		for _, path := range matches {
+			info, err := filesystem.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() || seen[path] {
+				continue
+			}
+			seen[path] = true
+
+			reader, size, err := fsys.OpenReaderAt(filesystem, path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			exp, err := writes.export(path, reader, size)
+			if err != nil {
+				return nil, err
+			}
+			exports = append(exports, exp)
+		}
+	}
+	if len(exports) == 0 {
+		return nil, fmt.Errorf("no files match %v", patterns)
+	}
+	return exports, nil
+}
+
+// runIscsi exposes every partition or matching file as an iSCSI target
+func runIscsi(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("iscsi", flag.ContinueOnError)
+	addr := flagSet.String("addr", ":3260", "TCP address to listen on")
+	writes := addWriteFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	exports, err := globExports(filesystem, flagSet.Args(), writes)
+	defer writes.close()
+	if err != nil {
+		return err
+	}
+	server := iscsi.NewServer(*addr)
+	server.SetLogger(log.New(stderr, "iscsi: ", log.LstdFlags))
+	for _, exp := range exports {
+		if err := server.AddExport(exp); err != nil {
+			return err
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		<-sigChan
+		fmt.Fprintln(stderr, "\nShutting down...")
+		server.Close()
+	}()
+
+	fmt.Fprintf(stdout, "iSCSI target starting on %s\n", *addr)
+	for _, exp := range exports {
+		rwStr := "read-only"
+		if exp.Writer != nil {
+			rwStr = "read-write"
+		}
+		fmt.Fprintf(stdout, "Target: %s (%d bytes, %s)\n", iscsi.TargetName(exp.Name), exp.Size, rwStr)
+	}
+	writes.describe(stdout)
+	fmt.Fprintf(stdout, "Discover with: sudo iscsiadm -m discovery -t sendtargets -p <host>\n")
+	fmt.Fprintf(stdout, "Press Ctrl+C to stop\n")
+
+	return server.Serve()
+}
+
+// runFreeNbd exposes free space as an NBD block device
+func runFreeNbd(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("freenbd", flag.ContinueOnError)
+	socketPath := flagSet.String("socket", "/tmp/nbd.sock", "Unix socket path")
+	exportName := flagSet.String("name", "freespace", "Export name for NBD clients")
+	writes := addWriteFlags(flagSet)
+	idleTimeout := flagSet.Duration("idle-timeout", 0, "Stop after this long without connections, e.g. 10m (0 = never)")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	fb, ok := filesystem.(fsys.FreeBlocker)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not support free block listing", filesystem.Type())
+	}
+
+	ranges, err := fb.FreeBlocks()
+	if err != nil {
+		return fmt.Errorf("getting free blocks: %w", err)
+	}
+
+	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+	if !ok {
+		return fmt.Errorf("filesystem does not expose base reader")
+	}
+
+	// Convert ranges to extents
+	extents := make([]fsys.Extent, len(ranges))
+	var totalSize int64
+	for i, r := range ranges {
+		extents[i] = fsys.Extent{
+			Logical:  totalSize,
+			Physical: r.Start,
+			Length:   r.Size(),
+		}
+		totalSize += r.Size()
+	}
+
+	reader := fsys.NewExtentReaderAt(br.BaseReader(), extents, totalSize)
+
+	exp, err := writes.export(*exportName, reader, totalSize)
+	if err != nil {
+		return err
+	}
+	defer writes.close()
+	writes.describe(stdout)
+	return serveNbd(*socketPath, *idleTimeout, []*nbd.Export{exp}, stdout, stderr)
+}
+
+// writeOptions are the flags the NBD and iSCSI commands share for write
+// access, and the overlays made for it
+type writeOptions struct {
+	readWrite *bool
+	inPlace   *bool
+	overlay   *string
+	cows      []*fsys.CopyOnWrite
+}
+
+func addWriteFlags(flagSet *flag.FlagSet) *writeOptions {
+	return &writeOptions{
+		readWrite: flagSet.Bool("rw", false, "Enable read-write access, to a copy-on-write overlay unless -inplace"),
+		inPlace:   flagSet.Bool("inplace", false, "With -rw, write to the image itself"),
+		overlay:   flagSet.String("overlay", "", "With -rw, keep written data in this directory instead of memory"),
+	}
+}
+
+// export makes an export of reader. With -rw it is writable: in place
+// with -inplace, otherwise through an overlay that leaves the image
+// untouched. An encrypted export keeps the overlay below the encryption,
+// so that no plaintext is written to the overlay directory.
+func (opts *writeOptions) export(name string, reader io.ReaderAt, size int64) (*nbd.Export, error) {
+	exp := &nbd.Export{Name: name, Reader: reader, Size: size}
+	switch {
+	case !*opts.readWrite:
+	case *opts.inPlace:
+		if *opts.overlay != "" {
+			return nil, fmt.Errorf("-overlay cannot be used with -inplace")
+		}
+		writer, err := getWriterForReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot enable write access to %s: %w", name, err)
+		}
+		exp.Writer = writer
+	default:
+		below := reader
+		xtsReader, encrypted := reader.(*xts.ReaderAt)
+		if encrypted {
+			below = xtsReader.BaseReader()
+		}
+		cow, err := fsys.NewCopyOnWrite(below, size, *opts.overlay)
+		if err != nil {
+			return nil, fmt.Errorf("overlay for %s: %w", name, err)
+		}
+		opts.cows = append(opts.cows, cow)
+		exp.Reader, exp.Writer = cow, cow
+		if encrypted {
+			exp.Reader = xts.NewReaderAt(cow, xtsReader.Cipher(), xtsReader.Size())
+			exp.Writer = xts.NewWriterAt(cow, xtsReader.Cipher(), xtsReader.Size())
+		}
+	}
+	return exp, nil
+}
+
+// describe tells where writes go when they do not change the image
+func (opts *writeOptions) describe(stdout io.Writer) {
+	if !*opts.readWrite || *opts.inPlace {
+		return
+	}
+	where := "memory"
+	if *opts.overlay != "" {
+		where = *opts.overlay
+	}
+	fmt.Fprintf(stdout, "Writes go to an overlay in %s and are discarded on exit (-inplace writes to the image)\n", where)
+}
+
+// close discards what was written to the overlays
+func (opts *writeOptions) close() {
+	for _, cow := range opts.cows {
+		cow.Close()
+	}
+}
+
+// runMkfs writes an empty FAT filesystem to the image, a new file of
+// -size bytes or, without -size, an existing file or device, and copies a
+// host directory into it
+func runMkfs(imagePath string, args []string) error {
+	flagSet := flag.NewFlagSet("mkfs", flag.ContinueOnError)
+	typ := flagSet.String("t", "", "`type`: FAT12, FAT16 or FAT32 (by default from the size)")
+	sizeArg := flagSet.String("size", "", "create the image with this many bytes, with an optional k, M, G or T suffix")
+	spc := flagSet.Int("s", 0, "sectors per cluster (by default from the size)")
+	sectorSize := flagSet.Int("ss", 512, "bytes per sector")
+	numFATs := flagSet.Int("f", 2, "number of FATs")
+	rootEntries := flagSet.Int("r", 512, "entries of the FAT12/16 root directory")
+	label := flagSet.String("n", "", "volume label")
+	from := flagSet.String("from", "", "copy the files and directories of this host `dir` in")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 0 {
+		return fmt.Errorf("mkfs takes no arguments after its flags")
+	}
+
+	var f *os.File
+	var size int64
+	var err error
+	if *sizeArg != "" {
+		if size, err = parseByteCount(*sizeArg); err != nil {
+			return err
+		}
+		if f, err = os.OpenFile(imagePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644); err != nil {
+			return fmt.Errorf("%w (without -size, mkfs formats an existing image)", err)
+		}
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			os.Remove(imagePath)
+			return err
+		}
+	} else {
+		if f, err = os.OpenFile(imagePath, os.O_RDWR, 0); err != nil {
+			return err
+		}
+		if size, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = mkfs(f, size, *from, fat.FormatOptions{
+		Type:              strings.ToUpper(*typ),
+		SectorSize:        *sectorSize,
+		SectorsPerCluster: *spc,
+		NumFATs:           *numFATs,
+		RootEntries:       *rootEntries,
+		Label:             *label,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && *sizeArg != "" {
+		os.Remove(imagePath)
+	}
+	return err
+}
+
+// mkfs formats f and copies the host directory from into it
+func mkfs(f *os.File, size int64, from string, opts fat.FormatOptions) error {
+	if err := fat.Format(f, size, opts); err != nil {
+		return err
+	}
+	if from == "" {
+		return f.Sync()
+	}
+	filesystem, err := fat.Open(f, size)
+	if err != nil {
+		return err
+	}
+	if err := fsys.WriteTree(filesystem.(fsys.FileWriter), f, os.DirFS(from)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// runMkimage writes a new disk image of the given partition images, laid
+// out one after another behind an MBR or GPT
+func runMkimage(imagePath string, args []string) error {
+	flagSet := flag.NewFlagSet("mkimage", flag.ContinueOnError)
+	table := flagSet.String("t", "gpt", "partition table: mbr or gpt")
+	sectorSize := flagSet.Int("ss", 512, "bytes per sector")
+	alignArg := flagSet.String("align", "1M", "start partitions at multiples of this many bytes")
+	sizeArg := flagSet.String("size", "", "bytes of the disk (default: just enough for the partitions)")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() == 0 {
+		return fmt.Errorf("usage: mkimage [-t mbr|gpt] [-ss n] [-align n] [-size n] <file[,type=t][,label=l][,size=n][,boot]>...")
+	}
+
+	opts := part.CreateOptions{SectorSize: int64(*sectorSize)}
+	switch strings.ToLower(*table) {
+	case "mbr":
+		opts.Table = detect.MBR
+	case "gpt":
+		opts.Table = detect.GPT
+	default:
+		return fmt.Errorf("unknown partition table %q (use mbr or gpt)", *table)
+	}
+	var err error
+	if opts.Align, err = parseByteCount(*alignArg); err != nil {
+		return err
+	}
+	if *sizeArg != "" {
+		if opts.Size, err = parseByteCount(*sizeArg); err != nil {
+			return err
+		}
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var parts []part.NewPartition
+	for _, arg := range flagSet.Args() {
+		f, np, err := openPartitionImage(arg)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		parts = append(parts, np)
+	}
+
+	out, err := os.OpenFile(imagePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = mkimage(out, files, parts, opts)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(imagePath)
+	}
+	return err
+}
+
+// openPartitionImage opens the partition image of a mkimage argument,
+// file[,type=t][,label=l][,size=n][,boot], and returns the partition for
+// it. Without a type, the type follows the filesystem in the image.
+func openPartitionImage(arg string) (*os.File, part.NewPartition, error) {
+	name, options, _ := strings.Cut(arg, ",")
+	var np part.NewPartition
+	var typ string
+	for _, opt := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		var err error
+		switch key {
+		case "":
+		case "type":
+			typ = value
+		case "label":
+			np.Label = value
+		case "size":
+			np.Size, err = parseByteCount(value)
+		case "boot":
+			np.Bootable = true
+		default:
+			err = fmt.Errorf("unknown option %q (use type, label, size or boot)", key)
+		}
+		if err != nil {
+			return nil, np, fmt.Errorf("%s: %w", arg, err)
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, np, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, np, err
+	}
+	if np.Size != 0 && np.Size < info.Size() {
+		f.Close()
+		return nil, np, fmt.Errorf("%s: size %d is less than the image's %d bytes", arg, np.Size, info.Size())
+	}
+	np.Size = max(np.Size, info.Size())
+
+	if typ == "" {
+		content, _ := detect.Detect(f)
+		switch {
+		case content.IsFAT():
+			typ = strings.ToLower(content.String())
+		case content == detect.NTFS || content == detect.ExFAT:
+			typ = "ntfs"
+		case content.IsExt() || content == detect.XFS || content == detect.Btrfs:
+			typ = "linux"
+		case content == detect.APFS:
+			typ = "apfs"
+		case content == detect.HFSPlus:
+			typ = "hfs"
+		default:
+			f.Close()
+			return nil, np, fmt.Errorf("%s: cannot tell the partition type of %s content (give type=)", arg, content)
+		}
+	}
+	if np.Type, np.TypeGUID, err = part.LookupType(typ); err != nil {
+		f.Close()
+		return nil, np, fmt.Errorf("%s: %w", arg, err)
+	}
+	return f, np, nil
+}
+
+// mkimage writes the partition table for parts to out, and the partition
+// images files into their partitions
+func mkimage(out *os.File, files []*os.File, parts []part.NewPartition, opts part.CreateOptions) error {
+	partitions, size, err := part.Create(out, parts, opts)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	for i, p := range partitions {
+		if err := copyNonZero(out, p.StartOffset(), files[i]); err != nil {
+			return fmt.Errorf("%s: %w", files[i].Name(), err)
+		}
+	}
+	return out.Sync()
+}
+
+// copyNonZero copies r to w at off, skipping the blocks of zeros a new file
+// reads as already, so that it stays sparse
+func copyNonZero(w io.WriterAt, off int64, r io.Reader) error {
+	buf := make([]byte, 1<<20)
+	zeros := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zeros[:n]) {
+			if _, werr := w.WriteAt(buf[:n], off); werr != nil {
+				return werr
+			}
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// runPut copies a host file, or stdin for -, into the image itself,
+// creating or replacing the file at path
+func runPut(filesystem fsys.FS, args []string) error {
+	flagSet := flag.NewFlagSet("put", flag.ContinueOnError)
+	parents := flagSet.Bool("p", false, "Create the missing directories of the path")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("put requires a host file (- for stdin) and a path")
+	}
+	src, name := flagSet.Arg(0), flagSet.Arg(1)
+
+	fw, ok := filesystem.(fsys.FileWriter)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not support writing files", filesystem.Type())
+	}
+	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+	if !ok {
+		return fmt.Errorf("filesystem does not expose base reader")
+	}
+	writer, err := getWriterForReader(br.BaseReader())
+	if err != nil {
+		return fmt.Errorf("cannot write to the image: %w", err)
+	}
+
+	var data []byte
+	perm := fs.FileMode(0o644)
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		var info fs.FileInfo
+		if info, err = os.Stat(src); err == nil {
+			perm = info.Mode().Perm()
+			data, err = os.ReadFile(src)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if *parents {
+		for i := range name {
+			if name[i] != '/' {
+				continue
+			}
+			if _, err := filesystem.Stat(name[:i]); errors.Is(err, fs.ErrNotExist) {
+				if err := fw.Mkdir(writer, name[:i], 0o755); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return fw.WriteFile(writer, name, data, perm)
+}
+
+// runWrite overwrites a file in the image itself with what it reads from
+// in, in the blocks the file already has: its size, allocation and
+// timestamps are left alone, and a shorter input leaves the rest of the
+// file zeroed. Nothing is written unless every byte of the input has a
+// block of the file's own to go to.
+func runWrite(filesystem fsys.FS, args []string, in io.Reader, stderr io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("write requires a path; the new contents are read from stdin")
+	}
+	name := args[0]
+
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+	em, ok := filesystem.(fsys.ExtentMapper)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not map extents", filesystem.Type())
+	}
+	br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+	if !ok {
+		return fmt.Errorf("filesystem does not expose base reader")
+	}
+
+	// A byte more than the file holds tells an input that is too long
+	size := info.Size()
+	data, err := io.ReadAll(io.LimitReader(in, size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > size {
+		return fmt.Errorf("the input is longer than the %d bytes of %s, and write cannot grow a file", size, name)
+	}
+
+	// Replaying the journal could put back what is overwritten
+	if j, ok := filesystem.(fsys.Journaler); ok {
+		txs, err := j.JournalTransactions()
+		if err != nil {
+			return fmt.Errorf("reading the journal: %w", err)
+		}
+		if len(txs) > 0 {
+			return fmt.Errorf("the journal has %d transactions not yet written to the filesystem; mount and unmount it first", len(txs))
+		}
+	}
+	if r, ok := filesystem.(fsys.Recoverer); ok {
+		dirty, err := r.NeedsRecovery()
+		if err != nil {
+			return fmt.Errorf("reading the journal: %w", err)
+		}
+		if dirty {
+			return fmt.Errorf("the filesystem was not unmounted cleanly and its journal is yet to be replayed; mount and unmount it first")
+		}
+	}
+
+	// The blocks of an encrypted file hold its ciphertext, which the
+	// input would replace
+	extents, err := em.FileExtents(name)
+	if errors.Is(err, fsys.ErrEncrypted) {
+		return fmt.Errorf("%s is encrypted, and write cannot encrypt the input: %w", name, fsys.ErrEncrypted)
+	}
+	if err != nil {
+		return fmt.Errorf("mapping %s: %w", name, err)
+	}
+	if len(extents) == 0 && size > 0 {
+		return fmt.Errorf("%s has no blocks of its own, its data being stored in its metadata", name)
+	}
+	extents = slices.Clone(extents)
+	slices.SortFunc(extents, func(a, b fsys.Extent) int { return cmp.Compare(a.Logical, b.Logical) })
+	// Every block below the size is written, with zeros past the input
+	var covered int64
+	for _, e := range extents {
+		if e.Logical >= size {
+			break
+		}
+		if e.Shared {
+			return fmt.Errorf("%s shares its blocks at offset %d with another file, which writing them would change too", name, e.Logical)
+		}
+		if e.Logical >= int64(len(data)) {
+			continue
+		}
+		switch {
+		case e.Logical > covered:
+			return fmt.Errorf("%s has a hole at offset %d, which write cannot fill", name, covered)
+		case e.Zero:
+			return fmt.Errorf("%s has unwritten blocks at offset %d, which write cannot fill", name, e.Logical)
+		}
+		covered = max(covered, e.Logical+e.Length)
+	}
+	if covered < int64(len(data)) {
+		return fmt.Errorf("%s has a hole at offset %d, which write cannot fill", name, covered)
+	}
+
+	writer, err := getWriterForReader(br.BaseReader())
+	if err != nil {
+		return fmt.Errorf("cannot write to the image: %w", err)
+	}
+	zeros := make([]byte, 1<<20)
+	for _, e := range extents {
+		if e.Zero || e.Logical >= size {
+			continue
+		}
+		for off := e.Logical; off < min(e.Logical+e.Length, size); {
+			chunk := zeros[:min(int64(len(zeros)), e.Logical+e.Length-off, size-off)]
+			if off < int64(len(data)) {
+				chunk = data[off:min(int64(len(data)), off+int64(len(chunk)))]
+			}
+			if _, err := writer.WriteAt(chunk, e.Physical+off-e.Logical); err != nil {
+				return fmt.Errorf("writing %s at offset %d: %w", name, off, err)
+			}
+			off += int64(len(chunk))
+		}
+	}
+
+	// Read back what was written, past the block cache
+	got := make([]byte, len(data))
+	if _, err := fsys.NewExtentReaderAt(br.BaseReader(), extents, size).ReadAt(got, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("reading back %s: %w", name, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("%s does not read back as written", name)
+	}
+	if rest := size - int64(len(data)); rest > 0 {
+		fmt.Fprintf(stderr, "fscat: wrote %d bytes; the other %d bytes of %s are zeros, as its size is unchanged\n", len(data), rest, name)
+	}
+	return nil
+}
+
+// getWriterForReader creates a writer that uses the same extent map as the reader.
+// It requires the underlying base reader to be an *os.File so it can be re-opened for writing.
+// getWriterForReader creates a writer that uses the same extent map and encryption as the reader.
+// It unwraps XTS and extent layers to find the base file, then rebuilds the write chain.
+func getWriterForReader(reader io.ReaderAt) (io.WriterAt, error) {
+	// Unwrap layers to find base file and collect XTS cipher if present
+	var xtsCipher *xts.Cipher
+	var xtsSize int64
+	current := reader
+
+	// Check for XTS layer first
+	if xtsReader, ok := current.(*xts.ReaderAt); ok {
+		xtsCipher = xtsReader.Cipher()
+		xtsSize = xtsReader.Size()
+		current = xtsReader.BaseReader()
+	}
+
+	// Check for extent layer
+	var extents []fsys.Extent
+	var extentSize int64
+	if extReader, ok := current.(*fsys.ExtentReaderAt); ok {
+		extents = extReader.Extents()
+		extentSize = extReader.Size()
+		current = extReader.BaseReader()
+	}
+
+	// Reads of the image may be cut short by an interrupt, filled with
+	// zeros or logged; writes are not. Writes through the page cache need
+	// no alignment.
+	for {
+		switch current.(type) {
+		case *fsys.ContextReaderAt, *fsys.FillReaderAt, *fsys.HashingReaderAt, *fsys.AlignedReaderAt:
+			current = current.(interface{ BaseReader() io.ReaderAt }).BaseReader()
+			continue
+		}
+		break
+	}
+
+	// An image file read through memory mappings is written as a file
+	if _, ok := current.(*fsys.ExtentReaderAt); !ok {
+		if m, ok := current.(interface{ BaseReader() io.ReaderAt }); ok {
+			if f, ok := m.BaseReader().(*os.File); ok {
+				current = f
+			}
+		}
+	}
+
+	// Now we should have the base file
+	baseFile, ok := current.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("base reader is not a file (nested read-write not supported through memory buffers)")
+	}
+
+	// Re-open the file in read-write mode
+	rwFile, err := os.OpenFile(baseFile.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening file for writing: %w", err)
+	}
+
+	// Rebuild the write chain
+	var writer io.WriterAt = rwFile
+
+	// Add extent layer if present
+	if len(extents) > 0 {
+		writer = fsys.NewExtentWriterAt(writer, extents, extentSize)
+	}
+
+	// Add XTS layer if present
+	if xtsCipher != nil {
+		size := xtsSize
+		if size == 0 {
+			size = extentSize
+		}
+		writer = xts.NewWriterAt(writer, xtsCipher, size)
+	}
+
+	return writer, nil
+}
+
+// readAheadWindow is how far cat and read-only NBD exports read ahead of
+// sequential reads
+const readAheadWindow = 1 << 20
+
+// serveNbd starts an NBD server with the given exports
+func serveNbd(socketPath string, idleTimeout time.Duration, exports []*nbd.Export, stdout, stderr io.Writer) error {
+	server := nbd.NewServer(socketPath)
+	server.SetIdleTimeout(idleTimeout)
+
+	for _, exp := range exports {
+		// Reading ahead of a client streaming an export is safe as
+		// long as the client cannot change the data behind it
+		if exp.Writer == nil {
+			exp.Reader = fsys.NewReadAheadReaderAt(exp.Reader, readAheadWindow)
+		}
+		if err := server.AddExport(exp); err != nil {
+			return err
+		}
+	}
+
+	// Handle shutdown signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Fprintln(stderr, "\nShutting down...")
+		server.Close()
+	}()
+
+	// Dump the request counts of every export on SIGUSR1
+	statsChan := make(chan os.Signal, 1)
+	hasStats := notifyStats(statsChan)
+	defer signal.Stop(statsChan)
+	go func() {
+		for range statsChan {
+			server.WriteStats(stderr)
+		}
+	}()
+
+	fmt.Fprintf(stdout, "NBD server starting on unix:%s\n", socketPath)
+	for _, exp := range exports {
+		rwStr := "read-only"
+		if exp.Writer != nil {
+			rwStr = "read-write"
+		}
+		fmt.Fprintf(stdout, "Export: %s (%d bytes, %s)\n", exp.Name, exp.Size, rwStr)
+	}
+	fmt.Fprintf(stdout, "Connect with: sudo nbd-client -N %s -unix %s /dev/nbdX\n", exports[0].Name, socketPath)
+	if hasStats {
+		fmt.Fprintf(stdout, "Press Ctrl+C to stop, send SIGUSR1 (kill -USR1 %d) for request counts\n", os.Getpid())
+	} else {
+		fmt.Fprintln(stdout, "Press Ctrl+C to stop")
+	}
+
+	return server.Serve()
+}
+
+// runServe serves the filesystem over HTTP until interrupted
+func runServe(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flagSet.String("addr", ":8080", "Address to listen on")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: serve [-addr host:port]")
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:  &fsHandler{fs: filesystem},
+		ErrorLog: log.New(stderr, "serve: ", log.LstdFlags),
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		<-sigChan
+		fmt.Fprintln(stderr, "\nShutting down...")
+		server.Close()
+	}()
+
+	fmt.Fprintf(stdout, "Serving %s filesystem on http://%s/\n", filesystem.Type(), listener.Addr())
+	fmt.Fprintf(stdout, "Press Ctrl+C to stop\n")
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// fsHandler serves the files of a filesystem over HTTP, and lists
+// directories as HTML or, with ?format=json or an Accept header asking for
+// it, as JSON
+type fsHandler struct {
+	fs fsys.FS // Safe for concurrent use, so requests are served at once
+}
+
+// dirEntryJSON describes a directory entry in a JSON listing
+type dirEntryJSON struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"`
+}
+
+var dirTemplate = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body><h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td align="right">{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table></body></html>
+`))
+
+func (h *fsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := h.fs.Stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if info.IsDir() {
+		entries, err := h.fs.ReadDir(name)
+		var listing []dirEntryJSON
+		for _, entry := range entries {
+			einfo, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			listing = append(listing, dirEntryJSON{
+				Name:    entry.Name(),
+				Dir:     entry.IsDir(),
+				Size:    einfo.Size(),
+				Mode:    einfo.Mode().String(),
+				ModTime: einfo.ModTime(),
+				Inode:   inodeOf(einfo),
+			})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.serveDir(w, r, listing)
+		return
+	}
+
+	reader, size, err := fsys.OpenReaderAt(h.fs, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// ServeContent answers conditional and range requests from these
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x-%x"`, inodeOf(info), info.ModTime().UnixNano(), size))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), io.NewSectionReader(reader, 0, size))
+}
+
+// serveDir writes a directory listing as JSON or HTML
+func (h *fsHandler) serveDir(w http.ResponseWriter, r *http.Request, listing []dirEntryJSON) {
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if listing == nil {
+			listing = []dirEntryJSON{}
+		}
+		json.NewEncoder(w).Encode(listing)
+		return
+	}
+
+	// Relative links only resolve inside the directory with a trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	type htmlEntry struct {
+		dirEntryJSON
+		Href string
+	}
+	data := struct {
+		Path    string
+		Entries []htmlEntry
+	}{Path: r.URL.Path}
+	for _, e := range listing {
+		href := (&url.URL{Path: e.Name}).String()
+		if e.Dir {
+			href += "/"
+		}
+		data.Entries = append(data.Entries, htmlEntry{e, href})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dirTemplate.Execute(w, data)
+}
+
+// inodeOf returns the inode number of a file, or 0 if the filesystem has none
+func inodeOf(info fs.FileInfo) uint64 {
+	if fi, ok := info.(fsys.FileInfo); ok {
+		return fi.Inode()
+	}
+	return 0
+}
+
+// runNinep serves the filesystem over 9P2000.L until interrupted
+func runNinep(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("9p", flag.ContinueOnError)
+	addr := flagSet.String("addr", ":564", "TCP address to listen on")
+	socketPath := flagSet.String("socket", "", "Unix socket path to listen on instead of TCP")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: 9p [-addr host:port | -socket path]")
+	}
+
+	var listener net.Listener
+	var err error
+	mountOpts := "trans=tcp,port=" + (*addr)[strings.LastIndex(*addr, ":")+1:]
+	if *socketPath != "" {
+		if err := os.Remove(*socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove existing socket: %w", err)
+		}
+		listener, err = net.Listen("unix", *socketPath)
+		defer os.Remove(*socketPath)
+		mountOpts = "trans=unix"
+	} else {
+		listener, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	server := ninep.NewServer(filesystem, func(name string) (io.ReaderAt, int64, error) {
+		return fsys.OpenReaderAt(filesystem, name)
+	})
+	server.SetLogger(log.New(stderr, "9p: ", log.LstdFlags))
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		<-sigChan
+		fmt.Fprintln(stderr, "\nShutting down...")
+		server.Close()
+	}()
+
+	fmt.Fprintf(stdout, "9P server for %s filesystem on %s:%s\n", filesystem.Type(), listener.Addr().Network(), listener.Addr())
+	fmt.Fprintf(stdout, "Mount with: sudo mount -t 9p -o %s,version=9p2000.L,ro <host> /mnt\n", mountOpts)
+	fmt.Fprintf(stdout, "Press Ctrl+C to stop\n")
+
+	return server.Serve(listener)
+}
+
+// addOpenFlags registers the flags that set the options images are
+// opened with
+func addOpenFlags(flagSet *flag.FlagSet) *imagefs.Options {
+	opts := &imagefs.Options{}
+	flagSet.Func("K", "XTS-AES key in hexadecimal", func(s string) error {
+		key, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid key hex: %w", err)
+		}
+		opts.Key = key
+		return nil
+	})
+	flagSet.IntVar(&opts.SectorSize, "sz", 512, "Sector size for XTS encryption")
+	flagSet.Func("sb", "ext superblock copy to use by block group (0 = primary, -1 = automatic, the default)", func(s string) error {
+		group, err := strconv.Atoi(s)
+		switch {
+		case err != nil || group < -1:
+			return fmt.Errorf("bad superblock group %q", s)
+		case group == -1:
+			opts.SuperblockGroup = 0
+		case group == 0:
+			opts.SuperblockGroup = imagefs.PrimarySuperblock
+		default:
+			opts.SuperblockGroup = group
+		}
+		return nil
+	})
+	flagSet.IntVar(&opts.Volume, "vol", 0, "APFS volume index within the container")
+	flagSet.BoolVar(&opts.Replay, "j", false, "Apply committed HFS+ journal transactions before reading")
+	flagSet.IntVar(&opts.LBASize, "lba-size", 0, "Partition table sector size in bytes (0 = automatic)")
+	flagSet.StringVar(&opts.Table, "table", "", "Partition table to use when both MBR and GPT are present (mbr or gpt)")
+	return opts
+}
+
+func runLs(filesystem fsys.FS, args []string, out, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flagSet.Bool("l", false, "use long listing format")
+	all := flagSet.Bool("a", false, "show all files including system files")
+	access := flagSet.Bool("u", false, "with -l, show access time instead of modification time")
+	birth := flagSet.Bool("U", false, "with -l, show creation time instead of modification time")
+	owner := flagSet.Bool("n", false, "like -l, with the numeric user and group IDs, or SIDs on NTFS")
+	fullTime := flagSet.Bool("T", false, "like -l, with full timestamps to the nanosecond and their UTC offset")
+	tz := flagSet.String("tz", "", "show times in this zone: UTC, Local or a name such as Europe/Amsterdam")
+	recursive := flagSet.Bool("R", false, "list subdirectories recursively")
+	byTime := flagSet.Bool("t", false, "sort by time, newest first")
+	bySize := flagSet.Bool("S", false, "sort by size, largest first")
+	reverse := flagSet.Bool("r", false, "reverse the order")
+	dirItself := flagSet.Bool("d", false, "list a directory itself, not its contents")
+	deleted := flagSet.Bool("deleted", false, "list the deleted files the filesystem can find, by ID")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	var loc *time.Location
+	if *tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(*tz); err != nil {
+			return fmt.Errorf("-tz: %w", err)
+		}
+	}
+	*long = *long || *owner || *fullTime
+
+	// timeOf returns the time shown by -l and sorted on by -t
+	timeOf := func(info fs.FileInfo) time.Time {
+		if !*access && !*birth {
+			return info.ModTime()
+		}
+		ti, ok := info.(fsys.TimesInfo)
+		switch {
+		case !ok:
+			return time.Time{}
+		case *access:
+			return ti.AccessTime()
+		default:
+			return ti.BirthTime()
+		}
+	}
+
+	// formatTime formats a time shown by -l
+	formatTime := func(t time.Time) string {
+		layout := "Jan _2 15:04"
+		if *fullTime {
+			layout = "2006-01-02T15:04:05.000000000-07:00"
+		}
+		if t.IsZero() {
+			return fmt.Sprintf("%*s", len(layout), "-")
+		}
+		if loc != nil {
+			t = t.In(loc)
+		}
+		return t.Format(layout)
+	}
+	listTime := func(info fs.FileInfo) string { return formatTime(timeOf(info)) }
+
+	patterns := flagSet.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	if *deleted {
+		return listDeleted(filesystem, patterns, *long, *access, *birth, formatTime, out)
+	}
+	var roots []string
+	for _, pattern := range patterns {
+		paths, err := globPaths(filesystem, pattern)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, paths...)
+	}
+
+	longLine := func(info fs.FileInfo, name string) string {
+		if p, ok := info.Sys().(*part.Partition); ok {
+			return formatPartition(info, p, name)
+		}
+		if !*owner {
+			return fmt.Sprintf("%s %12d %s %s", info.Mode(), info.Size(), listTime(info), name)
+		}
+		user, group := "-", "-"
+		if oi, ok := info.(fsys.OwnerInfo); ok {
+			u, g := oi.Owner()
+			user, group = cmp.Or(u, user), cmp.Or(g, group)
+		}
+		return fmt.Sprintf("%s %-8s %-8s %12d %s %s", info.Mode(), user, group, info.Size(), listTime(info), name)
+	}
+
+	// lsEntry is a directory entry, with its info if the listing needs it
+	type lsEntry struct {
+		fs.DirEntry
+		info fs.FileInfo
+	}
+
+	// sortEntries orders the entries of a directory like coreutils ls:
+	// newest or largest first for -t and -S with ties by name, otherwise
+	// in the order of ReadDir, by name unless -disk-order, all reversed
+	// by -r
+	sortEntries := func(entries []lsEntry) {
+		switch {
+		case *byTime:
+			slices.SortStableFunc(entries, func(a, b lsEntry) int {
+				return cmp.Or(timeOf(b.info).Compare(timeOf(a.info)), strings.Compare(a.Name(), b.Name()))
+			})
+		case *bySize:
+			slices.SortStableFunc(entries, func(a, b lsEntry) int {
+				return cmp.Or(cmp.Compare(b.info.Size(), a.info.Size()), strings.Compare(a.Name(), b.Name()))
+			})
+		}
+		if *reverse {
+			slices.Reverse(entries)
+		}
+	}
+
+	var list func(dir string, header bool) error
+	list = func(dir string, header bool) error {
+		dirEntries, err := filesystem.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var entries []lsEntry
+		for _, entry := range dirEntries {
+			// Skip system files unless -a
+			if !*all && isSystemFile(entry.Name()) {
+				continue
+			}
+			e := lsEntry{DirEntry: entry}
+			if *long || *byTime || *bySize {
+				if e.info, err = entry.Info(); err != nil {
+					fmt.Fprintf(stderr, "ls: %s: %v\n", path.Join(dir, entry.Name()), err)
+					continue
+				}
+			}
+			entries = append(entries, e)
+		}
+		sortEntries(entries)
+
+		if header || *recursive {
+			fmt.Fprintf(out, "%s:\n", dir)
+		}
+		for _, e := range entries {
+			if *long {
+				fmt.Fprintln(out, longLine(e.info, e.Name()))
+			} else if e.IsDir() {
+				fmt.Fprintln(out, e.Name()+"/")
+			} else {
+				fmt.Fprintln(out, e.Name())
+			}
+		}
+
+		if *recursive {
+			for _, e := range entries {
+				if !e.IsDir() {
+					continue
+				}
+				fmt.Fprintln(out)
+				child := path.Join(dir, e.Name())
+				if err := list(child, true); err != nil {
+					fmt.Fprintf(stderr, "ls: %s: %v\n", child, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	// As in coreutils, files come first, then directories, which have a
+	// header when more than one path matched
+	var dirs []string
+	for _, root := range roots {
+		info, err := filesystem.Stat(root)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && !*dirItself {
+			dirs = append(dirs, root)
+		} else if *long {
+			fmt.Fprintln(out, longLine(info, root))
+		} else {
+			fmt.Fprintln(out, root)
+		}
+	}
+	for i, dir := range dirs {
+		if i > 0 || len(dirs) < len(roots) {
+			fmt.Fprintln(out)
+		}
+		if err := list(dir, len(roots) > 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatPartition formats a long listing line for a partition: its start
+// sector and type, and the filesystem found in it, in place of a time
+func formatPartition(info fs.FileInfo, p *part.Partition, name string) string {
+	content := "-"
+	if p.Content != detect.Unknown {
+		content = p.Content.String()
+	}
+	line := fmt.Sprintf("%s %12d %12d %-19s %-13s %s",
+		info.Mode(), info.Size(), p.StartLBA, part.PartitionTypeString(p), content, name)
+	if p.Label != "" {
+		line += " (" + p.Label + ")"
+	}
+	return line
+}
+
+func isSystemFile(name string) bool {
+	// NTFS system files
+	if len(name) > 0 && name[0] == '$' {
+		return true
+	}
+	return false
+}
+
+// runStat prints the metadata of a single file or directory
+func runStat(filesystem fsys.FS, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: stat <path>")
+	}
+
+	info, err := filesystem.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05.999999999")
+	}
+
+	fmt.Fprintf(out, "  File: %s\n", args[0])
+	fmt.Fprintf(out, "  Size: %d\n", info.Size())
+	fmt.Fprintf(out, "  Mode: %s\n", info.Mode())
+	if fi, ok := info.(fsys.FileInfo); ok {
+		fmt.Fprintf(out, " Inode: %d\n", fi.Inode())
+	}
+	if li, ok := info.(fsys.LinksInfo); ok && li.Links() > 0 {
+		fmt.Fprintf(out, " Links: %d\n", li.Links())
+	}
+
+	var accessTime, changeTime, birthTime time.Time
+	if ti, ok := info.(fsys.TimesInfo); ok {
+		accessTime, changeTime, birthTime = ti.AccessTime(), ti.ChangeTime(), ti.BirthTime()
+	}
+	fmt.Fprintf(out, "Access: %s\n", formatTime(accessTime))
+	fmt.Fprintf(out, "Modify: %s\n", formatTime(info.ModTime()))
+	fmt.Fprintf(out, "Change: %s\n", formatTime(changeTime))
+	fmt.Fprintf(out, " Birth: %s\n", formatTime(birthTime))
+
+	if em, ok := filesystem.(fsys.ExtentMapper); ok && !info.IsDir() {
+		if extents, err := em.FileExtents(args[0]); err == nil {
+			fmt.Fprintf(out, "Extents: %d\n", len(extents))
+			for _, e := range extents {
+				flags := ""
+				if e.Shared {
+					flags += " shared"
+				}
+				if e.Zero {
+					flags += " zero"
+				}
+				fmt.Fprintf(out, "  logical %#x physical %#x length %#x%s\n", e.Logical, e.Physical, e.Length, flags)
+			}
+		}
+	}
+	return nil
+}
+
+// runXattr lists the extended attributes of a file with their values,
+// quoted if they are text and in hex if not, or writes the value of one
+func runXattr(filesystem fsys.FS, args []string, out io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: xattr <path> [name]")
+	}
+	if len(args) == 2 {
+		value, err := fsys.GetXattr(filesystem, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(value)
+		return err
+	}
+
+	names, err := fsys.ListXattr(filesystem, args[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := fsys.GetXattr(filesystem, args[0], name)
+		if err != nil {
+			return err
+		}
+		if isText(bytes.TrimSuffix(value, []byte{0})) {
+			fmt.Fprintf(out, "%s=%s\n", name, strconv.Quote(string(value)))
+		} else {
+			fmt.Fprintf(out, "%s=0x%x\n", name, value)
+		}
+	}
+	return nil
+}
+
+// isText reports whether b is UTF-8 text without control characters
+// other than tabs and newlines
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveXattrs returns the extended attributes of a file for its header
+// in an archive
+func archiveXattrs(filesystem fsys.FS, name string) (map[string]string, error) {
+	names, err := fsys.ListXattr(filesystem, name)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	xattrs := make(map[string]string, len(names))
+	for _, n := range names {
+		value, err := fsys.GetXattr(filesystem, name, n)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[n] = string(value)
+	}
+	return xattrs, nil
+}
+
+func runCat(filesystem fsys.FS, args []string, out, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("cat", flag.ContinueOnError)
+	progressOpts := addProgressFlags(flagSet)
+	deleted := flagSet.Bool("deleted", false, "copy the deleted files with the IDs ls -deleted gives")
+	output := flagSet.String("o", "", "write each file to a file of its own named by a `template`, with {name} and {path} replaced")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 {
+		return fmt.Errorf("cat requires a path argument")
+	}
+	if *deleted {
+		outputs, err := newCatOutputs(*output, flagSet.NArg(), out)
+		if err != nil {
+			return err
+		}
+		return catDeleted(filesystem, flagSet.Args(), progressOpts, outputs, stderr)
+	}
+
+	// Each argument can be a pattern, and the files are concatenated
+	var paths []string
+	for _, pattern := range flagSet.Args() {
+		matches, err := globPaths(filesystem, pattern)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+	outputs, err := newCatOutputs(*output, len(paths), out)
+	if err != nil {
+		return err
+	}
+
+	prog, err := progressOpts.start(stderr, func() int64 {
+		var total int64
+		for _, name := range paths {
+			if info, err := filesystem.Stat(name); err == nil {
+				total += info.Size()
+			}
+		}
+		return total
+	})
+	if err != nil {
+		return err
+	}
+	defer prog.finish()
+
+	// What was written before a failure is given its full size too
+	for _, path := range paths {
+		var reader fsys.ReaderAtCloser
+		var size int64
+		if reader, size, err = fsys.OpenReaderAt(filesystem, path); err != nil {
+			break
+		}
+		ra := fsys.NewReadAheadReaderAt(reader, readAheadWindow)
+		err = outputs.write(path, ra, size, prog)
+		ra.Close()
+		reader.Close()
+		if err != nil {
+			break
+		}
+	}
+	if ferr := outputs.finish(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// catOutputs is where cat copies files: all of them concatenated to
+// stdout, or with -o each to a host file of its own
+type catOutputs struct {
+	template string
+	sparse   io.Writer
+	finishFn func() error
+	written  map[string]string // Path in the image of each file written, by host file
+}
+
+// newCatOutputs checks an -o template for count files; one without
+// {name} or {path} can only take one
+func newCatOutputs(template string, count int, stdout io.Writer) (*catOutputs, error) {
+	c := &catOutputs{template: template, written: make(map[string]string)}
+	if template == "" {
+		c.sparse, c.finishFn = sparseOutput(stdout)
+		return c, nil
+	}
+	if count > 1 && !strings.Contains(template, "{name}") && !strings.Contains(template, "{path}") {
+		return nil, fmt.Errorf("-o %s would write all %d files to one file; put {name} or {path} in it", template, count)
+	}
+	return c, nil
+}
+
+// write copies size bytes of r, the file name in the image
+func (c *catOutputs) write(name string, r io.ReaderAt, size int64, prog *progress) error {
+	if c.template == "" {
+		return streamToWriter(r, size, prog.writer(c.sparse))
+	}
+
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	target := strings.NewReplacer("{name}", path.Base(clean), "{path}", filepath.FromSlash(clean)).Replace(c.template)
+	if prev, ok := c.written[target]; ok {
+		return fmt.Errorf("-o would write both %s and %s to %s", prev, name, target)
+	}
+	c.written[target] = name
+	if dir := filepath.Dir(target); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	sparse, finish := sparseOutput(f)
+	err = streamToWriter(r, size, prog.writer(sparse))
+	if err == nil {
+		err = finish()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+	return nil
+}
+
+// finish ends the output to stdout; the host files are done as written
+func (c *catOutputs) finish() error {
+	if c.finishFn == nil {
+		return nil
+	}
+	return c.finishFn()
+}
+
+// deletedLister returns the filesystem as a DeletedLister, if it is one
+func deletedLister(filesystem fsys.FS) (fsys.DeletedLister, error) {
+	dl, ok := filesystem.(fsys.DeletedLister)
+	if !ok {
+		return nil, fmt.Errorf("filesystem type %s does not support listing deleted files", filesystem.Type())
+	}
+	return dl, nil
+}
+
+// listDeleted prints the ID and path of the deleted files at or below the
+// given paths, in order of path, with -l their type, the confidence that
+// their data is intact, size and time too
+func listDeleted(filesystem fsys.FS, paths []string, long, access, birth bool, formatTime func(time.Time) string, out io.Writer) error {
+	dl, err := deletedLister(filesystem)
+	if err != nil {
+		return err
+	}
+	found, err := dl.Deleted()
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(found, func(a, b fsys.DeletedEntry) int { return strings.Compare(a.Path, b.Path) })
+
+	for _, e := range found {
+		if !slices.ContainsFunc(paths, func(p string) bool {
+			p = path.Clean(p)
+			return p == "." || e.Path == p || strings.HasPrefix(e.Path, p+"/")
+		}) {
+			continue
+		}
+		if !long {
+			fmt.Fprintf(out, "%s\t%s\n", e.ID, e.Path)
+			continue
+		}
+		t, typ := e.ModTime, "-"
+		switch {
+		case access:
+			t = e.AccessTime
+		case birth:
+			t = e.BirthTime
+		}
+		if e.IsDir {
+			typ = "d"
+		}
+		fmt.Fprintf(out, "%s %-6s %12d %s %s\t%s\n", typ, e.Confidence, e.Size, formatTime(t), e.ID, e.Path)
+	}
+	return nil
+}
+
+// catDeleted copies the data left of deleted files to outputs, with -o
+// the ID standing for their name and path
+func catDeleted(filesystem fsys.FS, ids []string, progressOpts *progressOptions, outputs *catOutputs, stderr io.Writer) error {
+	dl, err := deletedLister(filesystem)
+	if err != nil {
+		return err
+	}
+	var readers []fsys.ReaderAtCloser
+	var sizes []int64
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	for _, id := range ids {
+		r, size, err := dl.OpenDeleted(id)
+		if err != nil {
+			return err
+		}
+		readers, sizes = append(readers, r), append(sizes, size)
+	}
+
+	prog, err := progressOpts.start(stderr, func() int64 {
+		var total int64
+		for _, size := range sizes {
+			total += size
+		}
+		return total
+	})
+	if err != nil {
+		return err
+	}
+	defer prog.finish()
+	for i, r := range readers {
+		if err = outputs.write(ids[i], r, sizes[i], prog); err != nil {
+			break
+		}
+	}
+	if ferr := outputs.finish(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// runFind lists the files below a path that match all the given tests,
+// like find(1)
+func runFind(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	// As in find(1) the path comes before the tests; / is the root too
+	root := "."
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		root, args = path.Clean(strings.TrimPrefix(args[0], "/")), args[1:]
+	}
+
+	flagSet := flag.NewFlagSet("find", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	follow := flagSet.Bool("L", false, "follow symbolic links")
+	namePattern := flagSet.String("name", "", "match the base name against a glob `pattern`")
+	inamePattern := flagSet.String("iname", "", "like -name, ignoring case")
+	fileType := flagSet.String("type", "", "match the file type: f, d or l")
+	sizeArg := flagSet.String("size", "", "match the size: [+-]n[c|k|M|G], in 512-byte blocks by default")
+	mtimeArg := flagSet.String("mtime", "", "match the days since the last modification: [+-]n")
+	print0 := flagSet.Bool("print0", false, "end names with NUL instead of newline")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 0 {
+		return fmt.Errorf("usage: find [path] [-a] [-L] [-name pattern] [-iname pattern] [-type f|d|l] [-size [+-]n[ckMG]] [-mtime [+-]n] [-print0]")
+	}
+
+	var tests []func(fs.FileInfo) bool
+	for _, p := range []struct {
+		pattern string
+		fold    bool
+	}{{*namePattern, false}, {*inamePattern, true}} {
+		if p.pattern == "" {
+			continue
+		}
+		pattern, fold := p.pattern, p.fold
+		if fold {
+			pattern = strings.ToLower(pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p.pattern, err)
+		}
+		tests = append(tests, func(info fs.FileInfo) bool {
+			name := info.Name()
+			if fold {
+				name = strings.ToLower(name)
+			}
+			ok, _ := path.Match(pattern, name)
+			return ok
+		})
+	}
+	if *fileType != "" {
+		var want fs.FileMode
+		switch *fileType {
+		case "f":
+		case "d":
+			want = fs.ModeDir
+		case "l":
+			want = fs.ModeSymlink
+		default:
+			return fmt.Errorf("bad type %q: use f, d or l", *fileType)
+		}
+		tests = append(tests, func(info fs.FileInfo) bool { return info.Mode().Type() == want })
+	}
+	if *sizeArg != "" {
+		// Sizes count whole units, rounded up, as in find(1)
+		arg, unit := *sizeArg, int64(512)
+		if i := strings.IndexAny(arg, "ckMG"); i >= 0 && i == len(arg)-1 {
+			unit = map[byte]int64{'c': 1, 'k': 1 << 10, 'M': 1 << 20, 'G': 1 << 30}[arg[i]]
+			arg = arg[:i]
+		}
+		cmp, err := parseFindNumber(arg)
+		if err != nil {
+			return fmt.Errorf("bad size %q: %w", *sizeArg, err)
+		}
+		tests = append(tests, func(info fs.FileInfo) bool { return cmp((info.Size() + unit - 1) / unit) })
+	}
+	if *mtimeArg != "" {
+		cmp, err := parseFindNumber(*mtimeArg)
+		if err != nil {
+			return fmt.Errorf("bad mtime %q: %w", *mtimeArg, err)
+		}
+		now := time.Now()
+		tests = append(tests, func(info fs.FileInfo) bool {
+			return cmp(int64(now.Sub(info.ModTime()) / (24 * time.Hour)))
+		})
+	}
+
+	end := "\n"
+	if *print0 {
+		end = "\x00"
+	}
+	out := bufio.NewWriter(stdout)
+	opts := fsys.WalkOptions{FollowLinks: *follow, Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "find: %v\n", err)
+	}}
+	err := fsys.Walk(filesystem, root, opts, func(name, at string, d fs.DirEntry) error {
+		if name != root && !*all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			fmt.Fprintf(stderr, "find: %s: %v\n", name, err)
+			return nil
+		}
+		for _, test := range tests {
+			if !test(info) {
+				return nil
+			}
+		}
+		_, err = fmt.Fprint(out, name, end)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// parseFindNumber parses a find(1) number, n, +n or -n, into a test for
+// exactly, more than or less than n
+func parseFindNumber(s string) (func(int64) bool, error) {
+	sign := ""
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		sign, s = s[:1], s[1:]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("negative number")
+	}
+	switch sign {
+	case "+":
+		return func(v int64) bool { return v > n }, nil
+	case "-":
+		return func(v int64) bool { return v < n }, nil
+	}
+	return func(v int64) bool { return v == n }, nil
+}
+
+// hashAlgorithms are the digests the hash command computes
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"blake3": blake3.New,
+}
+
+// runHash prints a digest of every regular file below a path, in the
+// format of sha256sum(1) so that its -c can check extracted copies
+func runHash(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("hash", flag.ContinueOnError)
+	algo := flagSet.String("algo", "sha256", "digest: md5, sha1, sha256 or blake3")
+	all := flagSet.Bool("a", false, "include system files")
+	follow := flagSet.Bool("L", false, "follow symbolic links")
+	jobs := flagSet.Int("j", defaultJobs, "files to read at once")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: hash [-algo md5|sha1|sha256|blake3] [-a] [-L] [-j n] [path]")
+	}
+	newHash, ok := hashAlgorithms[*algo]
+	if !ok {
+		return fmt.Errorf("unknown digest %q: use md5, sha1, sha256 or blake3", *algo)
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = flagSet.Arg(0)
+	}
+
+	var failed int
+	opts := fsys.WalkOptions{FollowLinks: *follow, Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "hash: %v\n", err)
+		failed++
+	}}
+	pool := newOrderedPool(*jobs)
+	err := fsys.Walk(filesystem, root, opts, func(name, at string, d fs.DirEntry) error {
+		if name != root && !*all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return pool.Go(func() func() error {
+			var sum []byte
+			reader, size, err := fsys.OpenReaderAt(filesystem, at)
+			if err == nil {
+				h := newHash()
+				err = streamToWriter(reader, size, h)
+				reader.Close()
+				sum = h.Sum(nil)
+			}
+			return func() error {
+				if err != nil {
+					fmt.Fprintf(stderr, "hash: %s: %v\n", name, err)
+					failed++
+					return nil
+				}
+				_, err := fmt.Fprintf(stdout, "%x  %s\n", sum, name)
+				return err
+			}
+		})
+	})
+	if werr := pool.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+// runDu prints the logical and on-disk size of each directory below a path,
+// like du(1)
+func runDu(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("du", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	maxDepth := flagSet.Int("d", -1, "print directories only down to `depth` below the path")
+	human := flagSet.Bool("h", false, "print sizes in human-readable units")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: du [-a] [-d depth] [-h] [path]")
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = flagSet.Arg(0)
+	}
+
+	du := &duWalker{filesystem: filesystem, all: *all, maxDepth: *maxDepth, stderr: stderr,
+		out: bufio.NewWriter(stdout), human: *human, seen: make(map[uint64]bool), unit: 1}
+	if bs, ok := filesystem.(fsys.BlockSizer); ok {
+		du.unit = max(bs.BlockSize(), 1)
+	}
+	info, err := filesystem.Stat(root)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		du.dir(root, 0)
+	} else {
+		logical, disk := du.file(root, info)
+		du.print(logical, disk, root)
+	}
+	if err := du.out.Flush(); err != nil {
+		return err
+	}
+	if du.failed > 0 {
+		return fmt.Errorf("%d errors", du.failed)
+	}
+	return nil
+}
+
+// duWalker sums file sizes for runDu
+type duWalker struct {
+	filesystem fsys.FS
+	all        bool
+	maxDepth   int
+	human      bool
+	out        *bufio.Writer
+	stderr     io.Writer
+	seen       map[uint64]bool // Inodes counted, so hard links count once
+	unit       int64           // Extents take whole blocks or clusters of this size
+	failed     int
+}
+
+// dir sums the sizes below a directory, printing it after its children.
+// The blocks of the directory itself count on disk.
+func (du *duWalker) dir(name string, depth int) (logical, disk int64) {
+	disk, _ = du.allocated(name)
+	entries, err := du.filesystem.ReadDir(name)
+	if err != nil {
+		fmt.Fprintf(du.stderr, "du: %v\n", err)
+		du.failed++
+	}
+	for _, e := range entries {
+		if !du.all && isSystemFile(e.Name()) {
+			continue
+		}
+		child := path.Join(name, e.Name())
+		var l, d int64
+		if e.IsDir() {
+			l, d = du.dir(child, depth+1)
+		} else if info, err := e.Info(); err != nil {
+			fmt.Fprintf(du.stderr, "du: %s: %v\n", child, err)
+			du.failed++
+		} else {
+			l, d = du.file(child, info)
+		}
+		logical += l
+		disk += d
+	}
+	if du.maxDepth < 0 || depth <= du.maxDepth {
+		du.print(logical, disk, name)
+	}
+	return logical, disk
+}
+
+// file returns the logical and on-disk size of a file: the space its
+// extents take, in whole blocks, less than its size if it has holes. Files whose data the
+// filesystem cannot map, such as compressed ones, count their size.
+func (du *duWalker) file(name string, info fs.FileInfo) (logical, disk int64) {
+	if fi, ok := info.(fsys.FileInfo); ok && fi.Inode() != 0 {
+		if du.seen[fi.Inode()] {
+			return 0, 0
+		}
+		du.seen[fi.Inode()] = true
+	}
+	if !info.Mode().IsRegular() {
+		return 0, 0
+	}
+
+	logical, disk = info.Size(), info.Size()
+	if n, ok := du.allocated(name); ok {
+		disk = n
+	}
+	return logical, disk
+}
+
+// allocated returns the space the extents of a file or directory take,
+// each rounded up to whole blocks or clusters, or false if the filesystem
+// cannot map it
+func (du *duWalker) allocated(name string) (int64, bool) {
+	em, ok := du.filesystem.(fsys.ExtentMapper)
+	if !ok {
+		return 0, false
+	}
+	extents, err := em.FileExtents(name)
+	if err != nil {
+		return 0, false
+	}
+	var n int64
+	for _, e := range extents {
+		n += (e.Length + du.unit - 1) / du.unit * du.unit
+	}
+	return n, true
+}
+
+func (du *duWalker) print(logical, disk int64, name string) {
+	if du.human {
+		fmt.Fprintf(du.out, "%s\t%s\t%s\n", formatSize(logical), formatSize(disk), name)
+	} else {
+		fmt.Fprintf(du.out, "%d\t%d\t%s\n", logical, disk, name)
+	}
+}
+
+// runFrag prints the fragments, the space taken, the span in the image
+// and the fragmentation score of each regular file below a path, like
+// filefrag, and the totals
+func runFrag(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("frag", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	summary := flagSet.Bool("s", false, "print only the totals")
+	human := flagSet.Bool("h", false, "print sizes in human-readable units")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: frag [-a] [-s] [-h] [path]")
+	}
+	if _, ok := filesystem.(fsys.ExtentMapper); !ok {
+		return fmt.Errorf("filesystem type %s does not support extent mapping", filesystem.Type())
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = flagSet.Arg(0)
+	}
+
+	out := bufio.NewWriter(stdout)
+	size := func(n int64) string {
+		if *human {
+			return formatSize(n)
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	var total fsys.Fragmentation
+	failed := 0
+	opts := fsys.WalkOptions{Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "frag: %v\n", err)
+		failed++
+	}}
+	err := fsys.Walk(filesystem, root, opts, func(name, _ string, d fs.DirEntry) error {
+		if name != root && !*all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// Files kept in their metadata, or compressed, have no extents
+		f, err := fsys.FileFragmentation(filesystem, name)
+		if err != nil || f.Files == 0 {
+			return nil
+		}
+		total.Add(f)
+		if !*summary {
+			fmt.Fprintf(out, "%d\t%s\t%s\t%.3f\t%s\n", f.Fragments, size(f.Bytes), size(f.Span), f.Score(), name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	percent := 0.0
+	if total.Files > 0 {
+		percent = 100 * float64(total.Fragmented) / float64(total.Files)
+	}
+	fmt.Fprintf(out, "%d files, %d fragmented (%.1f%%), %d fragments, %s of data, score %.3f\n",
+		total.Files, total.Fragmented, percent, total.Fragments, size(total.Bytes), total.Score())
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+// diffEntry is what runDiff and manifest verify compare of a file
+type diffEntry struct {
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	target  string // Of a symbolic link
+	at      string // Path to open, past any links followed
+	sum     string // Digest in hexadecimal, from a manifest
+}
+
+// runDiff compares the files below a path with those below the same path
+// of another image, the one given or the one in a file of it with -in, and
+// prints each one added, removed or changed in the other image
+func runDiff(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("diff", flag.ContinueOnError)
+	opts := addOpenFlags(flagSet)
+	withHash := flagSet.Bool("hash", false, "compare the contents of files of the same size, not only their size and modification time")
+	all := flagSet.Bool("a", false, "include system files")
+	in := flagSet.String("in", "", "compare with the image in this `path` of the other image, as fscat opens it")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 || flagSet.NArg() > 2 {
+		return fmt.Errorf("usage: diff [-hash] [-a] [-in path] [-K key] [-sb group] [-vol index] [-j] [-lba-size n] [-table mbr|gpt] <image> [path]")
+	}
+	root := "."
+	if flagSet.NArg() == 2 {
+		root = flagSet.Arg(1)
+	}
+
+	img, err := imagefs.OpenImageContext(ctx, flagSet.Arg(0), *opts)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	other := img.FS
+	if *in != "" {
+		if other, err = imagefs.OpenFile(img.FS, *in, imagefs.Options{}); err != nil {
+			return err
+		}
+		defer imagefs.CloseFile(img.FS, other)
+	}
+
+	failed := 0
+	before, err := collectDiffEntries(ctx, filesystem, root, *all, "diff", stderr, &failed)
+	if err != nil {
+		return err
+	}
+	after, err := collectDiffEntries(ctx, other, root, *all, "diff", stderr, &failed)
+	if err != nil {
+		return err
+	}
+
+	var same func(a, b diffEntry) (bool, error)
+	if *withHash {
+		same = func(a, b diffEntry) (bool, error) {
+			return sameContents(filesystem, a.at, other, b.at)
+		}
+	}
+	counts, err := printDiff(ctx, before, after, same, "diff", stdout, stderr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "diff: %d added, %d removed, %d changed\n", counts.added, counts.removed, counts.changed)
+	if failed += counts.failed; failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+// collectDiffEntries returns the files below root by name, leaving out
+// root itself and, unless all, system files. Errors below root are printed
+// after the name of the command and counted in failed.
+func collectDiffEntries(ctx context.Context, filesystem fsys.FS, root string, all bool, command string, stderr io.Writer, failed *int) (map[string]diffEntry, error) {
+	entries := make(map[string]diffEntry)
+	opts := fsys.WalkOptions{Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "%s: %v\n", command, err)
+		*failed++
+	}}
+	err := fsys.Walk(filesystem, root, opts, func(name, at string, d fs.DirEntry) error {
+		if name == root {
+			return nil
+		}
+		if !all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			opts.Error(err)
+			return nil
+		}
+		e := diffEntry{mode: info.Mode(), size: info.Size(), modTime: info.ModTime(), at: at}
+		if e.mode&fs.ModeSymlink != 0 {
+			e.target, _ = fsys.ReadLink(filesystem, name)
+		}
+		entries[name] = e
+		return nil
+	})
+	return entries, err
+}
+
+// diffCounts are the files printDiff found added, removed and changed,
+// and those it could not compare
+type diffCounts struct {
+	added, removed, changed, failed int
+}
+
+// printDiff prints the names in before or after in order, with A for the
+// added, D for the removed and M for the changed, followed by what
+// changed. If same is not nil it compares the contents of regular files of
+// the same size.
+func printDiff(ctx context.Context, before, after map[string]diffEntry, same func(a, b diffEntry) (bool, error), command string, stdout, stderr io.Writer) (diffCounts, error) {
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(stdout)
+	var counts diffCounts
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return counts, err
+		}
+		a, inBefore := before[name]
+		b, inAfter := after[name]
+		switch {
+		case !inBefore:
+			fmt.Fprintf(out, "A\t%s\n", name)
+			counts.added++
+			continue
+		case !inAfter:
+			fmt.Fprintf(out, "D\t%s\n", name)
+			counts.removed++
+			continue
+		}
+
+		var what []string
+		switch {
+		case a.mode.Type() != b.mode.Type():
+			what = append(what, "type")
+		case a.mode.IsRegular():
+			if a.size != b.size {
+				what = append(what, "size")
+			}
+			if !a.modTime.Equal(b.modTime) {
+				what = append(what, "mtime")
+			}
+			if same != nil && a.size == b.size {
+				ok, err := same(a, b)
+				if err != nil {
+					fmt.Fprintf(stderr, "%s: %s: %v\n", command, name, err)
+					counts.failed++
+				} else if !ok {
+					what = append(what, "content")
+				}
+			}
+		case a.mode&fs.ModeSymlink != 0 && a.target != b.target:
+			what = append(what, "target")
+		}
+		if a.mode.Perm() != b.mode.Perm() {
+			what = append(what, "mode")
+		}
+		if len(what) > 0 {
+			fmt.Fprintf(out, "M\t%s\t%s\n", name, strings.Join(what, ","))
+			counts.changed++
+		}
+	}
+	return counts, out.Flush()
+}
+
+// sameContents reports whether file a of fsA holds the same bytes as file
+// b of fsB, which are the same size, by their SHA-256
+func sameContents(fsA fsys.FS, a string, fsB fsys.FS, b string) (bool, error) {
+	sumA, err := fileDigest(fsA, a, sha256.New)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := fileDigest(fsB, b, sha256.New)
+	return sumA == sumB, err
+}
+
+// manifestFile is a file in a manifest
+type manifestFile struct {
+	Path       string     `json:"path"`
+	Type       string     `json:"type"`
+	Mode       string     `json:"mode"` // Permissions in octal
+	Size       int64      `json:"size"`
+	ModTime    time.Time  `json:"mtime"`
+	AccessTime *time.Time `json:"atime,omitempty"`
+	ChangeTime *time.Time `json:"ctime,omitempty"`
+	BirthTime  *time.Time `json:"crtime,omitempty"`
+	Target     string     `json:"target,omitempty"` // Of a symbolic link
+	Hash       string     `json:"hash,omitempty"`   // Of a regular file
+}
+
+// manifest is what manifest create writes: the files below a path, with
+// paths relative to it
+type manifest struct {
+	Created time.Time      `json:"created"`
+	Type    string         `json:"type"` // Of the filesystem
+	Root    string         `json:"root"`
+	Algo    string         `json:"algo"`
+	Files   []manifestFile `json:"files"`
+}
+
+// manifestTypes are the file types of a manifest and their modes; others
+// are "other"
+var manifestTypes = map[string]fs.FileMode{
+	"file":    0,
+	"dir":     fs.ModeDir,
+	"symlink": fs.ModeSymlink,
+	"fifo":    fs.ModeNamedPipe,
+	"socket":  fs.ModeSocket,
+	"device":  fs.ModeDevice,
+	"chardev": fs.ModeDevice | fs.ModeCharDevice,
+}
+
+// manifestType returns the manifest type of a mode
+func manifestType(mode fs.FileMode) string {
+	for name, t := range manifestTypes {
+		if mode.Type() == t {
+			return name
+		}
+	}
+	return "other"
+}
+
+// runManifest writes a manifest of the files below a path as JSON, or
+// checks the files against one
+func runManifest(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return runManifestCreate(ctx, filesystem, args[1:], stdout, stderr)
+		case "verify":
+			return runManifestVerify(ctx, filesystem, args[1:], stdout, stderr)
+		}
+	}
+	return fmt.Errorf("usage: manifest create|verify [args]")
+}
+
+// runManifestCreate writes the manifest of the files below a path, one
+// file to a line
+func runManifestCreate(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("manifest create", flag.ContinueOnError)
+	algo := flagSet.String("algo", "sha256", "digest: md5, sha1, sha256 or blake3")
+	all := flagSet.Bool("a", false, "include system files")
+	jobs := flagSet.Int("j", defaultJobs, "files to read at once")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: manifest create [-algo md5|sha1|sha256|blake3] [-a] [-j n] [path]")
+	}
+	newHash, ok := hashAlgorithms[*algo]
+	if !ok {
+		return fmt.Errorf("unknown digest %q: use md5, sha1, sha256 or blake3", *algo)
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = path.Clean(flagSet.Arg(0))
+	}
+
+	// The files are written as they are hashed rather than kept
+	out := bufio.NewWriter(stdout)
+	header := func(key string, v any) {
+		value, _ := json.Marshal(v)
+		fmt.Fprintf(out, "  %q: %s,\n", key, value)
+	}
+	fmt.Fprintf(out, "{\n")
+	header("created", time.Now().UTC())
+	header("type", filesystem.Type())
+	header("root", root)
+	header("algo", *algo)
+	fmt.Fprintf(out, "  \"files\": [")
+	first := true
+
+	var failed int
+	opts := fsys.WalkOptions{Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "manifest: %v\n", err)
+		failed++
+	}}
+	pool := newOrderedPool(*jobs)
+	err := fsys.Walk(filesystem, root, opts, func(name, at string, d fs.DirEntry) error {
+		if name == root {
+			return nil
+		}
+		if !*all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			opts.Error(err)
+			return nil
+		}
+		file := manifestFile{
+			Path:    relPath(root, name),
+			Type:    manifestType(info.Mode()),
+			Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if ti, ok := info.(fsys.TimesInfo); ok {
+			file.AccessTime, file.ChangeTime, file.BirthTime = optionalTime(ti.AccessTime()), optionalTime(ti.ChangeTime()), optionalTime(ti.BirthTime())
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			file.Target, _ = fsys.ReadLink(filesystem, name)
+		}
+
+		return pool.Go(func() func() error {
+			var err error
+			if info.Mode().IsRegular() {
+				file.Hash, err = fileDigest(filesystem, at, newHash)
+			}
+			return func() error {
+				if err != nil {
+					fmt.Fprintf(stderr, "manifest: %s: %v\n", name, err)
+					failed++
+				}
+				line, err := json.Marshal(file)
+				if err != nil {
+					return err
+				}
+				if !first {
+					out.WriteString(",")
+				}
+				first = false
+				_, err = fmt.Fprintf(out, "\n    %s", line)
+				return err
+			}
+		})
+	})
+	if werr := pool.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n  ]\n}\n")
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+// runManifestVerify compares the files below a path, that of the manifest
+// unless given, with a manifest, as runDiff does. It fails if any differ.
+func runManifestVerify(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("manifest verify", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 || flagSet.NArg() > 2 {
+		return fmt.Errorf("usage: manifest verify [-a] <manifest.json> [path]")
+	}
+
+	f, err := os.Open(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	var m manifest
+	err = json.NewDecoder(f).Decode(&m)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading manifest %s: %w", flagSet.Arg(0), err)
+	}
+	newHash, ok := hashAlgorithms[m.Algo]
+	if !ok {
+		return fmt.Errorf("manifest %s: unknown digest %q", flagSet.Arg(0), m.Algo)
+	}
+	root := m.Root
+	if flagSet.NArg() == 2 {
+		root = path.Clean(flagSet.Arg(1))
+	}
+	if root == "" {
+		root = "."
+	}
+
+	before := make(map[string]diffEntry, len(m.Files))
+	for _, file := range m.Files {
+		mode, ok := manifestTypes[file.Type]
+		if !ok {
+			mode = fs.ModeIrregular
+		}
+		perm, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %s: bad mode %q", flagSet.Arg(0), file.Path, file.Mode)
+		}
+		before[file.Path] = diffEntry{mode: mode | fs.FileMode(perm).Perm(), size: file.Size, modTime: file.ModTime, target: file.Target, sum: file.Hash}
+	}
+
+	failed := 0
+	found, err := collectDiffEntries(ctx, filesystem, root, *all, "manifest", stderr, &failed)
+	if err != nil {
+		return err
+	}
+	after := make(map[string]diffEntry, len(found))
+	for name, e := range found {
+		after[relPath(root, name)] = e
+	}
+
+	same := func(a, b diffEntry) (bool, error) {
+		if a.sum == "" {
+			return true, nil
+		}
+		sum, err := fileDigest(filesystem, b.at, newHash)
+		return sum == a.sum, err
+	}
+	counts, err := printDiff(ctx, before, after, same, "manifest", stdout, stderr)
+	if err != nil {
+		return err
+	}
+	matching := len(before) - counts.removed - counts.changed
+	fmt.Fprintf(stderr, "manifest: %d files match, %d added, %d removed, %d changed\n", matching, counts.added, counts.removed, counts.changed)
+	if failed += counts.failed; failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	if differ := counts.added + counts.removed + counts.changed; differ > 0 {
+		return fmt.Errorf("%d files differ from the manifest", differ)
+	}
+	return nil
+}
+
+// relPath returns name, a path below root, relative to root
+func relPath(root, name string) string {
+	if root == "." {
+		return name
+	}
+	return strings.TrimPrefix(name, root+"/")
+}
+
+// optionalTime returns t, or nil if it is not known
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// fileDigest returns the digest of a file in hexadecimal
+func fileDigest(filesystem fsys.FS, name string, newHash func() hash.Hash) (string, error) {
+	reader, size, err := fsys.OpenReaderAt(filesystem, name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := newHash()
+	if err := streamToWriter(reader, size, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runTree prints the directory hierarchy below a path, like tree(1)
+func runTree(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("tree", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	maxDepth := flagSet.Int("d", -1, "descend at most `depth` levels below the path")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: tree [-a] [-d depth] [path]")
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = flagSet.Arg(0)
+	}
+	if _, err := filesystem.ReadDir(root); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(stdout)
+	var dirs, files int
+	var walk func(name, indent string, depth int)
+	walk = func(name, indent string, depth int) {
+		entries, err := filesystem.ReadDir(name)
+		if err != nil {
+			fmt.Fprintf(out, "%s[%v]\n", indent, err)
+			return
+		}
+		if !*all {
+			entries = slices.DeleteFunc(entries, func(e fs.DirEntry) bool { return isSystemFile(e.Name()) })
+		}
+		for i, e := range entries {
+			branch, next := "├── ", "│   "
+			if i == len(entries)-1 {
+				branch, next = "└── ", "    "
+			}
+			child := path.Join(name, e.Name())
+			label := e.Name()
+			if e.Type()&fs.ModeSymlink != 0 {
+				if target, err := fsys.ReadLink(filesystem, child); err == nil {
+					label += " -> " + target
+				}
+			}
+			fmt.Fprintf(out, "%s%s%s\n", indent, branch, label)
+
+			if !e.IsDir() {
+				files++
+				continue
+			}
+			dirs++
+			if *maxDepth < 0 || depth < *maxDepth {
+				walk(child, indent+next, depth+1)
+			}
+		}
+	}
+	fmt.Fprintln(out, root)
+	walk(root, "", 1)
+	fmt.Fprintf(out, "\n%d directories, %d files\n", dirs, files)
+	return out.Flush()
+}
+
+// runGrep prints the offsets of the matches of a regular expression, or
+// bytes given in hex, in the files below a path or in the free space
+func runGrep(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("grep", flag.ContinueOnError)
+	ignoreCase := flagSet.Bool("i", false, "ignore case")
+	hexPattern := flagSet.Bool("x", false, "the pattern is bytes in hex, not a regular expression")
+	filesOnly := flagSet.Bool("l", false, "print only the names of files with matches")
+	opts := addSearchFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 || flagSet.NArg() > 2 || (*opts.free && flagSet.NArg() > 1) {
+		return fmt.Errorf("usage: grep [-i] [-x] [-l] [-a] [-free] <pattern> [path]")
+	}
+
+	var find func([]byte) [][]int
+	if *hexPattern {
+		needle, err := hex.DecodeString(flagSet.Arg(0))
+		if err != nil || len(needle) == 0 {
+			return fmt.Errorf("bad hex pattern %q", flagSet.Arg(0))
+		}
+		if *ignoreCase {
+			needle = asciiLower(needle)
+		}
+		find = func(b []byte) [][]int {
+			if *ignoreCase {
+				b = asciiLower(b)
+			}
+			var matches [][]int
+			for i := 0; ; {
+				j := bytes.Index(b[i:], needle)
+				if j < 0 {
+					return matches
+				}
+				matches = append(matches, []int{i + j, i + j + len(needle)})
+				i += j + 1
+			}
+		}
+	} else {
+		pattern := flagSet.Arg(0)
+		if *ignoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		find = func(b []byte) [][]int { return re.FindAllIndex(b, -1) }
+	}
+
+	out := bufio.NewWriter(stdout)
+	err := opts.search(filesystem, flagSet.Arg(1), find, stderr, func(name string, offset int64, match []byte) error {
+		if *filesOnly {
+			fmt.Fprintln(out, name)
+			return errSkipFile
+		}
+		_, err := fmt.Fprintf(out, "%s:%d:%q\n", name, offset, match)
+		return err
+	})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// asciiLower returns a copy of b with A-Z lowered. Unlike bytes.ToLower it
+// leaves bytes that are not UTF-8 alone, so offsets in the copy are offsets
+// in b.
+func asciiLower(b []byte) []byte {
+	lower := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
+
+// runStrings prints the runs of printable ASCII in the files below a path
+// or in the free space, with their offsets, like strings(1)
+func runStrings(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("strings", flag.ContinueOnError)
+	minLen := flagSet.Int("n", 4, "print runs of at least `length` characters")
+	opts := addSearchFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 || (*opts.free && flagSet.NArg() > 0) {
+		return fmt.Errorf("usage: strings [-n length] [-a] [-free] [path]")
+	}
+	if *minLen < 1 || *minLen > 1000 {
+		return fmt.Errorf("bad length %d: must be 1 to 1000", *minLen)
+	}
+
+	re := regexp.MustCompile(fmt.Sprintf("[\\t\\x20-\\x7e]{%d,}", *minLen))
+	out := bufio.NewWriter(stdout)
+	err := opts.search(filesystem, flagSet.Arg(0), func(b []byte) [][]int { return re.FindAllIndex(b, -1) }, stderr,
+		func(name string, offset int64, match []byte) error {
+			_, err := fmt.Fprintf(out, "%s:%d:%s\n", name, offset, match)
+			return err
+		})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// searchOptions are the flags grep and strings share
+type searchOptions struct {
+	all  *bool
+	free *bool
+}
+
+func addSearchFlags(flagSet *flag.FlagSet) searchOptions {
+	return searchOptions{
+		all:  flagSet.Bool("a", false, "include system files"),
+		free: flagSet.Bool("free", false, "search the free space instead of files"),
+	}
+}
+
+// errSkipFile stops the search of the current file
+var errSkipFile = errors.New("skip file")
+
+// search calls report for the matches of find in the files below root (the
+// whole filesystem if empty) or, for -free, in the free space, which is
+// reported as "free" with offsets in the image
+func (opts searchOptions) search(filesystem fsys.FS, root string, find func([]byte) [][]int, stderr io.Writer, report func(name string, offset int64, match []byte) error) error {
+	if *opts.free {
+		fb, ok := filesystem.(fsys.FreeBlocker)
+		if !ok {
+			return fmt.Errorf("filesystem type %s does not support free block listing", filesystem.Type())
+		}
+		br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+		if !ok {
+			return fmt.Errorf("filesystem does not expose base reader")
+		}
+		ranges, err := fb.FreeBlocks()
+		if err != nil {
+			return fmt.Errorf("getting free blocks: %w", err)
+		}
+		report := func(offset int64, match []byte) error { return report("free", offset, match) }
+		for _, r := range ranges {
+			if err := searchReader(br.BaseReader(), r.Start, r.Size(), find, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if root == "" {
+		root = "."
+	}
+	var failed int
+	err := fs.WalkDir(filesystem, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == root {
+				return err
+			}
+			fmt.Fprintf(stderr, "%v\n", err)
+			failed++
+			return nil
+		}
+		if name != root && !*opts.all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		// Errors reading a file are reported and skipped, those writing
+		// the output end the search
+		var reportErr error
+		reader, size, err := fsys.OpenReaderAt(filesystem, name)
+		if err == nil {
+			defer reader.Close()
+			err = searchReader(reader, 0, size, find, func(offset int64, match []byte) error {
+				reportErr = report(name, offset, match)
+				return reportErr
+			})
+		}
+		if reportErr != nil {
+			if reportErr == errSkipFile {
+				return nil
+			}
+			return reportErr
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			failed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+const (
+	searchChunk   = 1 << 20
+	searchOverlap = 4 << 10 // Longest match certain to be found whole
+)
+
+// searchReader reports the matches of find in size bytes of r from start,
+// reading a chunk at a time. Chunks overlap so that matches across their
+// boundaries are found; longer matches may be cut short.
+func searchReader(r io.ReaderAt, start, size int64, find func([]byte) [][]int, report func(offset int64, match []byte) error) error {
+	buf := make([]byte, searchChunk+searchOverlap)
+	var next int64 // Matches cannot start in the previous one
+	for off := int64(0); off < size; off += searchChunk {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), size-off)], start+off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		window := buf[:n]
+		for _, m := range find(window) {
+			if m[0] == m[1] || off+int64(m[0]) < next {
+				continue
+			}
+			if m[0] >= searchChunk {
+				break // The next chunk finds it
+			}
+			if err := report(start+off+int64(m[0]), window[m[0]:m[1]]); err != nil {
+				return err
+			}
+			next = off + int64(m[1])
+		}
+	}
+	return nil
+}
+
+// runTimeline prints every file's timestamps in the Sleuth Kit body file
+// format that mactime(1) turns into a timeline, or as CSV
+func runTimeline(filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("timeline", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	asCSV := flagSet.Bool("csv", false, "write CSV with RFC 3339 times instead of a body file")
+	withMD5 := flagSet.Bool("md5", false, "fill in the MD5 of regular files")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: timeline [-a] [-csv] [-md5] [path]")
+	}
+	root := "."
+	if flagSet.NArg() == 1 {
+		root = flagSet.Arg(0)
+	}
+
+	out := bufio.NewWriter(stdout)
+	cw := csv.NewWriter(out)
+	if *asCSV {
+		cw.Write([]string{"md5", "path", "inode", "mode", "size", "atime", "mtime", "ctime", "crtime"})
+	}
+
+	var failed int
+	err := fs.WalkDir(filesystem, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == root {
+				return err
+			}
+			fmt.Fprintf(stderr, "timeline: %v\n", err)
+			failed++
+			return nil
+		}
+		if name != root && !*all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			fmt.Fprintf(stderr, "timeline: %s: %v\n", name, err)
+			failed++
+			return nil
+		}
+
+		// The body file has a leading slash and shows symlink targets
+		// in the name
+		bodyName := "/" + strings.TrimPrefix(name, ".")
+		if bodyName != "/" {
+			bodyName = path.Clean(bodyName)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if target, err := fsys.ReadLink(filesystem, name); err == nil {
+				bodyName += " -> " + target
+			}
+		}
+
+		sum := "0"
+		if *withMD5 && info.Mode().IsRegular() {
+			reader, size, err := fsys.OpenReaderAt(filesystem, name)
+			if err == nil {
+				h := md5.New()
+				if err = streamToWriter(reader, size, h); err == nil {
+					sum = hex.EncodeToString(h.Sum(nil))
+				}
+				reader.Close()
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "timeline: %s: %v\n", name, err)
+				failed++
+			}
+		}
+
+		var inode uint64
+		if fi, ok := info.(fsys.FileInfo); ok {
+			inode = fi.Inode()
+		}
+		var atime, ctime, crtime time.Time
+		if ti, ok := info.(fsys.TimesInfo); ok {
+			atime, ctime, crtime = ti.AccessTime(), ti.ChangeTime(), ti.BirthTime()
+		}
+		times := []time.Time{atime, info.ModTime(), ctime, crtime}
+
+		if *asCSV {
+			record := []string{sum, bodyName, strconv.FormatUint(inode, 10), info.Mode().String(), strconv.FormatInt(info.Size(), 10)}
+			for _, t := range times {
+				s := ""
+				if !t.IsZero() {
+					s = t.UTC().Format(time.RFC3339Nano)
+				}
+				record = append(record, s)
+			}
+			return cw.Write(record)
+		}
+
+		fmt.Fprintf(out, "%s|%s|%d|%s|0|0|%d", sum, bodyName, inode, bodyMode(info.Mode()), info.Size())
+		for _, t := range times {
+			var secs int64
+			if !t.IsZero() {
+				secs = t.Unix()
+			}
+			fmt.Fprintf(out, "|%d", secs)
+		}
+		_, err = fmt.Fprintln(out)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
+
+// bodyMode formats a file mode as the Sleuth Kit does in body files, the
+// type twice and the permissions: r/rrw-r--r--
+func bodyMode(mode fs.FileMode) string {
+	t := "-"
+	switch {
+	case mode.IsRegular():
+		t = "r"
+	case mode.IsDir():
+		t = "d"
+	case mode&fs.ModeSymlink != 0:
+		t = "l"
+	}
+	return t + "/" + t + mode.Perm().String()[1:]
+}
+
+// runDd copies a byte range of a file, or of the image holding the
+// filesystem, to stdout
+func runDd(filesystem fsys.FS, args []string, stdout io.Writer) error {
+	flagSet := flag.NewFlagSet("dd", flag.ContinueOnError)
+	bsArg := flagSet.String("bs", "1", "unit of -skip and -count, in bytes")
+	skipArg := flagSet.String("skip", "0", "units to skip from the start")
+	countArg := flagSet.String("count", "", "units to copy (default: to the end)")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: dd [-bs n] [-skip n] [-count n] [path]")
+	}
+
+	var nums [3]int64
+	for i, arg := range []string{*bsArg, *skipArg, *countArg} {
+		if arg == "" {
+			nums[i] = -1
+			continue
+		}
+		n, err := parseByteCount(arg)
+		if err != nil {
+			return err
+		}
+		nums[i] = n
+	}
+	bs, skip, count := nums[0], nums[1], nums[2]
+	if bs < 1 {
+		return fmt.Errorf("bad block size %s", *bsArg)
+	}
+
+	var reader io.ReaderAt
+	size := int64(-1) // Unknown: copy up to EOF
+	if flagSet.NArg() == 1 {
+		r, sz, err := fsys.OpenReaderAt(filesystem, flagSet.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		reader, size = r, sz
+	} else {
+		br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+		if !ok {
+			return fmt.Errorf("filesystem does not expose base reader")
+		}
+		reader = br.BaseReader()
+		if s, ok := reader.(interface{ Size() int64 }); ok {
+			size = s.Size()
+		}
+	}
+
+	start, length := skip*bs, int64(math.MaxInt64)
+	if count >= 0 {
+		length = count * bs
+	}
+	if size >= 0 {
+		length = max(min(length, size-start), 0)
+	} else {
+		length = min(length, math.MaxInt64-start)
+	}
+	_, err := io.Copy(stdout, io.NewSectionReader(reader, start, length))
+	return err
+}
+
+// parseByteCount parses a count of bytes with an optional k, M, G or T
+// suffix for powers of 1024. Hex with 0x works too.
+func parseByteCount(s string) (int64, error) {
+	num, shift := s, 0
+	if i := strings.IndexAny(s, "kMGT"); i > 0 && i == len(s)-1 && !strings.HasPrefix(s, "0x") {
+		num, shift = s[:i], 10*(strings.IndexByte("kMGT", s[i])+1)
+	}
+	n, err := strconv.ParseInt(num, 0, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("bad byte count %q", s)
+	}
+	return n << shift, nil
+}
+
+// runXxd hex-dumps part of a file, or of the image holding the filesystem,
+// like xxd(1). With -e each line shows where in the image its bytes are,
+// and a line before each extent or hole gives its mapping.
+func runXxd(filesystem fsys.FS, args []string, stdout io.Writer) error {
+	flagSet := flag.NewFlagSet("xxd", flag.ContinueOnError)
+	annotate := flagSet.Bool("e", false, "show the physical offset of each line and the extents")
+	image := flagSet.Bool("image", false, "dump the image the filesystem is in instead of a file")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	rest := flagSet.Args()
+	if !*image {
+		if len(rest) == 0 {
+			return fmt.Errorf("usage: xxd [-e] <path> [offset] [length] | xxd -image [offset] [length]")
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 2 {
+		return fmt.Errorf("usage: xxd [-e] <path> [offset] [length] | xxd -image [offset] [length]")
+	}
+	start, length := int64(0), int64(-1)
+	for i, arg := range rest {
+		n, err := parseByteCount(arg)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			start = n
+		} else {
+			length = n
+		}
+	}
+
+	var reader io.ReaderAt
+	size := int64(-1) // Unknown: dump up to EOF
+	var extents []fsys.Extent
+	if *image {
+		if *annotate {
+			return fmt.Errorf("-e needs a file: image offsets are physical already")
+		}
+		br, ok := filesystem.(interface{ BaseReader() io.ReaderAt })
+		if !ok {
+			return fmt.Errorf("filesystem does not expose base reader")
+		}
+		reader = br.BaseReader()
+		if s, ok := reader.(interface{ Size() int64 }); ok {
+			size = s.Size()
+		}
+	} else {
+		name := flagSet.Arg(0)
+		r, sz, err := fsys.OpenReaderAt(filesystem, name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		reader, size = r, sz
+		if *annotate {
+			em, ok := filesystem.(fsys.ExtentMapper)
+			if !ok {
+				return fmt.Errorf("filesystem type %s does not map extents", filesystem.Type())
+			}
+			if extents, err = em.FileExtents(name); err != nil {
+				return err
+			}
+			sort.Slice(extents, func(i, j int) bool { return extents[i].Logical < extents[j].Logical })
+		}
+	}
+
+	end := int64(math.MaxInt64)
+	if length >= 0 {
+		end = min(start+length, end)
+	}
+	if size >= 0 {
+		end = min(end, size)
+	}
+
+	out := bufio.NewWriter(stdout)
+	buf := make([]byte, 16)
+	lastExtent := -2 // Index of the extent of the previous line, -1 for a hole
+	for off := start; off < end; {
+		n := min(int64(len(buf)), end-off)
+		idx := -1
+		if *annotate {
+			// Lines stop at extent boundaries so that each is in one place
+			next := end
+			for i, e := range extents {
+				if off >= e.Logical && off < e.Logical+e.Length {
+					idx, next = i, e.Logical+e.Length
+					break
+				}
+				if e.Logical > off {
+					next = min(next, e.Logical)
+					break
+				}
+			}
+			n = min(n, next-off)
+			if idx != lastExtent {
+				if idx < 0 {
+					fmt.Fprintf(out, "-- hole at %#x\n", off)
+				} else {
+					e := extents[idx]
+					zero := ""
+					if e.Zero {
+						zero = ", reads as zeros"
+					}
+					fmt.Fprintf(out, "-- extent %d: logical %#x, physical %#x, length %#x%s\n", idx, e.Logical, e.Physical, e.Length, zero)
+				}
+				lastExtent = idx
+			}
+		}
+
+		got, err := reader.ReadAt(buf[:n], off)
+		if got > 0 {
+			writeHexLine(out, off, buf[:got])
+			if *annotate && idx >= 0 {
+				fmt.Fprintf(out, "%s  @%#x", strings.Repeat(" ", len(buf)-got), extents[idx].Physical+off-extents[idx].Logical)
+			}
+			fmt.Fprintln(out)
+			off += int64(got)
+		}
+		if err == io.EOF || (err == nil && got == 0) {
+			break
+		}
+		if err != nil {
+			out.Flush()
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// writeHexLine writes one line of an xxd dump, without the newline
+func writeHexLine(out *bufio.Writer, off int64, b []byte) {
+	fmt.Fprintf(out, "%08x: ", off)
+	for i := 0; i < 16; i++ {
+		if i < len(b) {
+			fmt.Fprintf(out, "%02x", b[i])
+		} else {
+			out.WriteString("  ")
+		}
+		if i%2 == 1 {
+			out.WriteByte(' ')
+		}
+	}
+	out.WriteByte(' ')
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+		out.WriteByte(c)
+	}
+}
+
+// runExtents prints the physical layout of a file, like filefrag -v
+func runExtents(filesystem fsys.FS, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("extents", flag.ContinueOnError)
+	outer := flagSet.Bool("image", false, "give physical offsets in the outermost image, through any nesting")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: extents [-image] <path>")
+	}
+	name := flagSet.Arg(0)
+
+	em, ok := filesystem.(fsys.ExtentMapper)
+	if !ok {
+		return fmt.Errorf("filesystem type %s does not map extents", filesystem.Type())
+	}
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	extents, err := em.FileExtents(name)
+	if err != nil {
+		return err
+	}
+	if *outer {
+		// A nested filesystem reads through an ExtentReaderAt, whose
+		// extents already lead to the outermost image
+		if br, ok := filesystem.(interface{ BaseReader() io.ReaderAt }); ok {
+			if base, ok := br.BaseReader().(*fsys.ExtentReaderAt); ok {
+				extents = fsys.ComposeExtents(extents, base.Extents())
+			}
+		}
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Logical < extents[j].Logical })
+
+	fmt.Fprintf(out, "%4s %14s %14s %12s  %s\n", "ext", "logical", "physical", "length", "flags")
+	var mapped, next int64
+	for i, e := range extents {
+		var flags []string
+		if e.Logical > next {
+			flags = append(flags, "after-hole")
+		}
+		if e.Shared {
+			flags = append(flags, "shared")
+		}
+		if e.Zero {
+			flags = append(flags, "zero")
+		}
+		if i == len(extents)-1 {
+			flags = append(flags, "last")
+		}
+		fmt.Fprintf(out, "%4d %14d %14d %12d  %s\n", i, e.Logical, e.Physical, e.Length, strings.Join(flags, ","))
+		mapped += e.Length
+		next = e.Logical + e.Length
 	}
+	_, err = fmt.Fprintf(out, "%s: %d extents, %d of %d bytes mapped\n", name, len(extents), mapped, info.Size())
+	return err
+}
 
-	// Re-open the file in read-write mode
-	rwFile, err := os.OpenFile(baseFile.Name(), os.O_RDWR, 0)
+// runExtract copies a file or directory tree out of the image. The
+// contents of a directory go into dstdir; a file is copied into it.
+func runExtract(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("extract", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	follow := flagSet.Bool("L", false, "copy what symbolic links point to instead of the links")
+	jobs := flagSet.Int("j", defaultJobs, "files to copy at once")
+	progressOpts := addProgressFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("usage: extract [-a] [-L] [-j n] [-progress] [-limit-rate n] <src> <dstdir>")
+	}
+	pattern, dstDir := flagSet.Arg(0), flagSet.Arg(1)
+	srcs, err := globPaths(filesystem, pattern)
 	if err != nil {
-		return nil, fmt.Errorf("opening file for writing: %w", err)
+		return err
 	}
-
-	// Rebuild the write chain
-	var writer io.WriterAt = rwFile
-
-	// Add extent layer if present
-	if len(extents) > 0 {
-		writer = fsys.NewExtentWriterAt(writer, extents, extentSize)
+	prog, err := progressOpts.start(stderr, func() int64 {
+		return extractSize(ctx, filesystem, srcs, *all, *follow)
+	})
+	if err != nil {
+		return err
 	}
 
-	// Add XTS layer if present
-	if xtsCipher != nil {
-		size := xtsSize
-		if size == 0 {
-			size = extentSize
-		}
-		writer = xts.NewWriterAt(writer, xtsCipher, size)
+	var files, dirs, links, skipped, failed int
+	var bytes int64
+	type dirTimes struct {
+		dst  string
+		info fs.FileInfo
 	}
+	var doneDirs []dirTimes
 
-	return writer, nil
-}
+	pool := newOrderedPool(*jobs)
+	for _, src := range srcs {
+		info, err := filesystem.Stat(src)
+		if err != nil {
+			pool.Wait()
+			return err
+		}
+		// Matches of a pattern keep their path below its last directory
+		// without wildcards, so that "Users/*/NTUSER.DAT" gives a file
+		// per user
+		base := src
+		switch {
+		case hasGlobMeta(pattern):
+			base = globBase(pattern)
+		case !info.IsDir():
+			base = path.Dir(src)
+		}
+		opts := fsys.WalkOptions{FollowLinks: *follow, Context: ctx, Error: func(err error) {
+			fmt.Fprintf(stderr, "extract: %v\n", err)
+			failed++
+		}}
+		err = fsys.Walk(filesystem, src, opts, func(name, at string, d fs.DirEntry) error {
+			if name != src && !*all && isSystemFile(d.Name()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
 
-// serveNbd starts an NBD server with the given reader and optional writer
-func serveNbd(socketPath, exportName string, reader io.ReaderAt, writer io.WriterAt, size int64, stdout, stderr io.Writer) error {
-	server := nbd.NewServer(socketPath)
+			rel := name
+			if base != "." {
+				rel = strings.TrimPrefix(strings.TrimPrefix(name, base), "/")
+			}
+			dst := filepath.Join(dstDir, filepath.FromSlash(rel))
+			info, err := d.Info()
+			if err != nil {
+				fmt.Fprintf(stderr, "extract: %s: %v\n", name, err)
+				failed++
+				return nil
+			}
 
-	exp := &nbd.Export{
-		Name:   exportName,
-		Reader: reader,
-		Writer: writer,
-		Size:   size,
+			switch {
+			case d.IsDir():
+				// Made writable until its times and mode are set at the end
+				if err := os.MkdirAll(dst, 0o755); err != nil {
+					return err
+				}
+				doneDirs = append(doneDirs, dirTimes{dst, info})
+				dirs++
+			case info.Mode().IsRegular():
+				// The directories above a file that matched a pattern
+				// are not walked
+				if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+					return err
+				}
+				return pool.Go(func() func() error {
+					n, err := extractFile(filesystem, at, dst, info, prog)
+					return func() error {
+						bytes += n
+						if err != nil {
+							fmt.Fprintf(stderr, "extract: %s: %v\n", name, err)
+							failed++
+							return nil
+						}
+						files++
+						return nil
+					}
+				})
+			case info.Mode()&fs.ModeSymlink != 0:
+				if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+					return err
+				}
+				if err := extractLink(filesystem, at, dst); err != nil {
+					fmt.Fprintf(stderr, "extract: %s: %v\n", name, err)
+					failed++
+					return nil
+				}
+				links++
+			default:
+				fmt.Fprintf(stderr, "extract: %s: skipping special file\n", name)
+				skipped++
+			}
+			return nil
+		})
+		if err != nil {
+			pool.Wait()
+			prog.finish()
+			return err
+		}
 	}
-
-	if err := server.AddExport(exp); err != nil {
+	err = pool.Wait()
+	prog.finish()
+	if err != nil {
 		return err
 	}
 
-	// Handle shutdown signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Fprintln(stderr, "\nShutting down...")
-		server.Close()
-	}()
+	// Children are done, so directory times can no longer change
+	for i := len(doneDirs) - 1; i >= 0; i-- {
+		setFileTimes(doneDirs[i].dst, doneDirs[i].info)
+		os.Chmod(doneDirs[i].dst, doneDirs[i].info.Mode().Perm())
+	}
 
-	rwStr := "read-only"
-	if writer != nil {
-		rwStr = "read-write"
+	fmt.Fprintf(stdout, "Extracted %d files, %d directories, %d bytes", files, dirs, bytes)
+	if links > 0 {
+		fmt.Fprintf(stdout, ", %d symlinks", links)
 	}
+	if skipped > 0 {
+		fmt.Fprintf(stdout, ", skipped %d", skipped)
+	}
+	fmt.Fprintln(stdout)
+	if failed > 0 {
+		return fmt.Errorf("%d errors", failed)
+	}
+	return nil
+}
 
-	fmt.Fprintf(stdout, "NBD server starting on unix:%s\n", socketPath)
-	fmt.Fprintf(stdout, "Export: %s (%d bytes, %s)\n", exportName, size, rwStr)
-	fmt.Fprintf(stdout, "Connect with: sudo nbd-client -N %s -unix %s /dev/nbdX\n", exportName, socketPath)
-	fmt.Fprintf(stdout, "Press Ctrl+C to stop\n")
+// extractLink makes a symlink at dst on the host with the target of one
+// in the filesystem, replacing a file left there by an earlier extract
+func extractLink(filesystem fsys.FS, name, dst string) error {
+	target, err := fsys.ReadLink(filesystem, name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dst); err == nil && !info.IsDir() {
+		os.Remove(dst)
+	}
+	return os.Symlink(target, dst)
+}
 
-	return server.Serve()
+// extractSize returns the bytes extract copies from the trees at srcs
+func extractSize(ctx context.Context, filesystem fsys.FS, srcs []string, all, follow bool) int64 {
+	var total int64
+	opts := fsys.WalkOptions{FollowLinks: follow, Context: ctx}
+	for _, src := range srcs {
+		fsys.Walk(filesystem, src, opts, func(name, _ string, d fs.DirEntry) error {
+			if name != src && !all && isSystemFile(d.Name()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+	return total
 }
 
-func openFilesystem(r io.ReaderAt, size int64, fsType detect.Type) (fsys.FS, error) {
-	switch {
-	case fsType.IsPartitionTable():
-		return part.Open(r, size, fsType)
-	case fsType.IsFAT():
-		return fat.Open(r, size)
-	case fsType.IsExt():
-		return ext.Open(r, size)
-	case fsType == detect.NTFS:
-		return ntfs.Open(r, size)
-	case fsType == detect.APFS:
-		return apfs.Open(r, size)
-	case fsType == detect.HFSPlus:
-		return hfsplus.Open(r, size)
-	default:
-		return nil, fmt.Errorf("unsupported filesystem type: %s", fsType)
+// extractFile copies a file to dst on the host, with its mode and times,
+// and returns the bytes copied
+func extractFile(filesystem fsys.FS, name, dst string, info fs.FileInfo, prog *progress) (int64, error) {
+	reader, size, err := fsys.OpenReaderAt(filesystem, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
 	}
+	if err := streamToWriter(reader, size, prog.writer(f)); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	os.Chmod(dst, info.Mode().Perm())
+	setFileTimes(dst, info)
+	return size, nil
 }
 
-func runLs(filesystem fsys.FS, args []string, out io.Writer) error {
-	flagSet := flag.NewFlagSet("ls", flag.ContinueOnError)
-	long := flagSet.Bool("l", false, "use long listing format")
-	all := flagSet.Bool("a", false, "show all files including system files")
-	if err := flagSet.Parse(args); err != nil {
-		return err
+// setFileTimes sets the access and modification times of a host file to
+// those of a file in the image, where recorded
+func setFileTimes(dst string, info fs.FileInfo) {
+	mtime := info.ModTime()
+	if mtime.IsZero() {
+		return
+	}
+	atime := mtime
+	if ti, ok := info.(fsys.TimesInfo); ok && !ti.AccessTime().IsZero() {
+		atime = ti.AccessTime()
 	}
+	os.Chtimes(dst, atime, mtime)
+}
 
-	path := "."
-	if flagSet.NArg() > 0 {
-		path = flagSet.Arg(0)
+// runTar writes a file or directory tree to stdout as a tar archive, with
+// the holes of sparse files kept
+func runTar(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("tar", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	jobs := flagSet.Int("j", defaultJobs, "files to read at once")
+	progressOpts := addProgressFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: tar [-a] [-j n] [-progress] [-limit-rate n] [path]")
 	}
 
-	// Check if path is a file or directory
-	info, err := filesystem.Stat(path)
+	// Holes are left out of the archive, so only data counts
+	prog, err := progressOpts.start(stderr, func() int64 {
+		var total int64
+		walkArchive(ctx, filesystem, flagSet.Arg(0), *all, io.Discard, func(name, _ string, info fs.FileInfo) error {
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			segs := dataSegments(filesystem, name, info.Size())
+			if segs == nil {
+				total += info.Size()
+			}
+			for _, seg := range segs {
+				total += seg.Length
+			}
+			return nil
+		})
+		return total
+	})
 	if err != nil {
 		return err
 	}
+	defer prog.finish()
 
-	if !info.IsDir() {
-		// It's a file - just show its info
-		if *long {
-			fmt.Fprintf(out, "%s %12d %s %s\n",
-				info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
-		} else {
-			fmt.Fprintln(out, info.Name())
+	// Files are read ahead by the pool, those small enough into memory,
+	// and written to the archive in order
+	out := bufio.NewWriterSize(stdout, 1<<20)
+	tw := pax.NewWriter(out)
+	pool := newOrderedPool(*jobs)
+	err = walkArchive(ctx, filesystem, flagSet.Arg(0), *all, stderr, func(name, archName string, info fs.FileInfo) error {
+		h := &pax.Header{Name: archName, Mode: archiveMode(info.Mode()), ModTime: info.ModTime()}
+		if ti, ok := info.(fsys.TimesInfo); ok {
+			h.AccessTime = ti.AccessTime()
 		}
-		return nil
-	}
 
-	// It's a directory - list contents
-	entries, err := filesystem.ReadDir(path)
+		// Extended attributes go in the header, as GNU tar and bsdtar
+		// write them; a file whose attributes cannot be read is archived
+		// without them
+		writeHeader := func(xerr error) error {
+			if xerr != nil {
+				fmt.Fprintf(stderr, "tar: %s: extended attributes: %v\n", name, xerr)
+			}
+			return tw.WriteHeader(h)
+		}
+
+		switch {
+		case info.IsDir():
+			h.Typeflag, h.Name = tar.TypeDir, archName+"/"
+			return pool.Go(func() func() error {
+				var xerr error
+				h.Xattrs, xerr = archiveXattrs(filesystem, name)
+				return func() error { return writeHeader(xerr) }
+			})
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := fsys.ReadLink(filesystem, name)
+			if err != nil {
+				fmt.Fprintf(stderr, "tar: %s: %v\n", name, err)
+				return nil
+			}
+			h.Typeflag, h.Linkname = tar.TypeSymlink, target
+			return pool.Go(func() func() error {
+				var xerr error
+				h.Xattrs, xerr = archiveXattrs(filesystem, name)
+				return func() error { return writeHeader(xerr) }
+			})
+		}
+
+		return pool.GoDiscard(func() (func() error, func()) {
+			var xerr error
+			h.Xattrs, xerr = archiveXattrs(filesystem, name)
+			reader, size, err := fsys.OpenReaderAt(filesystem, name)
+			if err != nil {
+				return func() error {
+					fmt.Fprintf(stderr, "tar: %s: %v\n", name, err)
+					return nil
+				}, nil
+			}
+			h.Typeflag, h.Size = tar.TypeReg, size
+			h.Data = dataSegments(filesystem, name, size)
+			write := func(w io.Writer) error {
+				if h.Data == nil {
+					return streamToWriter(reader, size, w)
+				}
+				for _, seg := range h.Data {
+					if err := streamToWriter(io.NewSectionReader(reader, seg.Offset, seg.Length), seg.Length, w); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			if size > tarBufferSize {
+				return func() error {
+					defer reader.Close()
+					if err := writeHeader(xerr); err != nil {
+						return err
+					}
+					return write(prog.writer(tw))
+				}, func() { reader.Close() }
+			}
+			var buf bytes.Buffer
+			err = write(&buf)
+			reader.Close()
+			return func() error {
+				if err != nil {
+					return err
+				}
+				if err := writeHeader(xerr); err != nil {
+					return err
+				}
+				_, err := prog.writer(tw).Write(buf.Bytes())
+				return err
+			}, nil
+		})
+	})
+	if werr := pool.Wait(); err == nil {
+		err = werr
+	}
 	if err != nil {
 		return err
 	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
 
-	for _, entry := range entries {
-		// Skip system files unless -a
-		if !*all && isSystemFile(entry.Name()) {
-			continue
+// tarBufferSize is the largest file tar reads into memory ahead of writing
+// it; larger ones are read as they are written
+const tarBufferSize = 1 << 20
+
+// runZip writes a file or directory tree to stdout as a zip archive
+func runZip(ctx context.Context, filesystem fsys.FS, args []string, stdout, stderr io.Writer) error {
+	flagSet := flag.NewFlagSet("zip", flag.ContinueOnError)
+	all := flagSet.Bool("a", false, "include system files")
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("usage: zip [-a] [path]")
+	}
+
+	out := bufio.NewWriterSize(stdout, 1<<20)
+	zw := zip.NewWriter(out)
+	err := walkArchive(ctx, filesystem, flagSet.Arg(0), *all, stderr, func(name, archName string, info fs.FileInfo) error {
+		h, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
 		}
+		h.Name = archName
 
-		if *long {
-			einfo, err := entry.Info()
+		var reader io.ReaderAt
+		var size int64
+		switch {
+		case info.IsDir():
+			h.Name += "/"
+		case info.Mode()&fs.ModeSymlink != 0:
+			// A symlink's target is its content
+			target, err := fsys.ReadLink(filesystem, name)
 			if err != nil {
-				continue
+				fmt.Fprintf(stderr, "zip: %s: %v\n", name, err)
+				return nil
 			}
-			fmt.Fprintf(out, "%s %12d %s %s\n",
-				einfo.Mode(), einfo.Size(), einfo.ModTime().Format("Jan _2 15:04"), entry.Name())
-		} else {
-			name := entry.Name()
-			if entry.IsDir() {
-				name += "/"
+			reader, size = strings.NewReader(target), int64(len(target))
+		default:
+			file, fileSize, err := fsys.OpenReaderAt(filesystem, name)
+			if err != nil {
+				fmt.Fprintf(stderr, "zip: %s: %v\n", name, err)
+				return nil
 			}
-			fmt.Fprintln(out, name)
+			defer file.Close()
+			reader, size = file, fileSize
+			h.Method = zip.Deflate
 		}
-	}
 
-	return nil
+		w, err := zw.CreateHeader(h)
+		if err != nil || reader == nil {
+			return err
+		}
+		return streamToWriter(reader, size, w)
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Flush()
 }
 
-func isSystemFile(name string) bool {
-	// NTFS system files
-	if len(name) > 0 && name[0] == '$' {
-		return true
+// walkArchive calls fn for the files and directories below root (the whole
+// filesystem if empty) that can go in an archive, with their name in it:
+// relative to root's parent, so that the tree keeps root's name. Special
+// files and, unless all is set, system files are left out.
+func walkArchive(ctx context.Context, filesystem fsys.FS, root string, all bool, stderr io.Writer, fn func(name, archName string, info fs.FileInfo) error) error {
+	if root == "" {
+		root = "."
 	}
-	return false
+	parent := path.Dir(root)
+
+	opts := fsys.WalkOptions{Context: ctx, Error: func(err error) {
+		fmt.Fprintf(stderr, "%v\n", err)
+	}}
+	return fsys.Walk(filesystem, root, opts, func(name, _ string, d fs.DirEntry) error {
+		if name == "." {
+			return nil
+		}
+		if name != root && !all && isSystemFile(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			return nil
+		}
+		if fsys.IsSpecial(info.Mode()) {
+			fmt.Fprintf(stderr, "%s: skipping special file\n", name)
+			return nil
+		}
+
+		archName := name
+		if parent != "." {
+			archName = strings.TrimPrefix(name, parent+"/")
+		}
+		return fn(name, archName, info)
+	})
 }
 
-func runCat(filesystem fsys.FS, args []string, out io.Writer) error {
-	if len(args) < 1 {
-		return fmt.Errorf("cat requires a path argument")
+// archiveMode returns the permission bits of a file mode as tar stores them
+func archiveMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
 	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
 
-	path := args[0]
-	reader, size, err := getReaderForPath(filesystem, path)
-	if err != nil {
-		return err
+// dataSegments returns the regions of a file its extents map to data, or nil if
+// they leave no holes, or the filesystem does not map extents
+func dataSegments(filesystem fsys.FS, name string, size int64) []pax.Segment {
+	em, ok := filesystem.(fsys.ExtentMapper)
+	if !ok {
+		return nil
 	}
+	extents, err := em.FileExtents(name)
+	if err != nil || len(extents) == 0 {
+		return nil
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Logical < extents[j].Logical })
 
-	return streamToWriter(reader, size, out)
+	var segs []pax.Segment
+	var covered int64
+	for _, e := range extents {
+		if e.Zero {
+			continue // Stored as a hole like the gaps
+		}
+		start, end := e.Logical, min(e.Logical+e.Length, size)
+		if n := len(segs); n > 0 && start <= segs[n-1].Offset+segs[n-1].Length {
+			last := &segs[n-1]
+			start = last.Offset + last.Length
+			if end > start {
+				last.Length += end - start
+				covered += end - start
+			}
+			continue
+		}
+		if end > start {
+			segs = append(segs, pax.Segment{Offset: start, Length: end - start})
+			covered += end - start
+		}
+	}
+	if covered >= size {
+		return nil
+	}
+	return segs
 }
 
 // streamToWriter copies from ReaderAt to Writer
@@ -675,6 +5255,311 @@ func streamToWriter(r io.ReaderAt, size int64, out io.Writer) error {
 	return nil
 }
 
+// defaultJobs is how many files extract, tar and hash read at once
+// unless -j says otherwise
+const defaultJobs = 4
+
+// orderedPool runs work on up to n goroutines at once, and the function
+// each work returns on the goroutine that gave it, in the order it was
+// given, so that output stays in order and the state of the caller is
+// only touched by the caller
+type orderedPool struct {
+	sem     chan struct{}
+	pending []chan poolResult // Results of the work started, oldest first
+	err     error             // First error a finish function returned
+}
+
+// poolResult is what work gives the pool: the function finishing it, and
+// one releasing what it holds for the finish function if that is not run
+type poolResult struct {
+	finish  func() error
+	discard func()
+}
+
+func newOrderedPool(n int) *orderedPool {
+	return &orderedPool{sem: make(chan struct{}, max(n, 1))}
+}
+
+// Go starts work, first finishing the oldest work when twice n are not
+// finished. It returns the error of a finish function, after which no
+// more work is started.
+func (p *orderedPool) Go(work func() (finish func() error)) error {
+	return p.GoDiscard(func() (func() error, func()) { return work(), nil })
+}
+
+// GoDiscard is Go for work whose finish function holds something, such as
+// an open file, that discard releases when a failure leaves it unrun
+func (p *orderedPool) GoDiscard(work func() (finish func() error, discard func())) error {
+	for p.err == nil && len(p.pending) >= 2*cap(p.sem) {
+		p.finish(<-p.pending[0])
+	}
+	if p.err != nil {
+		return p.err
+	}
+	result := make(chan poolResult, 1)
+	p.pending = append(p.pending, result)
+	p.sem <- struct{}{}
+	go func() {
+		defer func() { <-p.sem }()
+		finish, discard := work()
+		result <- poolResult{finish, discard}
+	}()
+
+	// Whatever is done already is finished now rather than later
+	for p.err == nil && len(p.pending) > 0 {
+		select {
+		case r := <-p.pending[0]:
+			p.finish(r)
+			continue
+		default:
+		}
+		break
+	}
+	return p.err
+}
+
+// finish runs the finish function of the oldest work
+func (p *orderedPool) finish(r poolResult) {
+	p.pending = p.pending[1:]
+	if err := r.finish(); err != nil && p.err == nil {
+		p.err = err
+	}
+}
+
+// Wait finishes the work started, unless a finish function failed, in
+// which case it only waits for it and discards it, and returns the first
+// error
+func (p *orderedPool) Wait() error {
+	for len(p.pending) > 0 {
+		r := <-p.pending[0]
+		if p.err != nil {
+			p.pending = p.pending[1:]
+			if r.discard != nil {
+				r.discard()
+			}
+			continue
+		}
+		p.finish(r)
+	}
+	return p.err
+}
+
+// sparseBlockSize is the size of the blocks of zeros sparseFile leaves as
+// holes
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// sparseOutput returns out and a function that does nothing, or when out
+// is a regular file written at its end, as stdout redirected to a file is,
+// a writer that leaves holes in it for blocks of zeros and the function
+// that gives the file its full size after a last hole
+func sparseOutput(out io.Writer) (io.Writer, func() error) {
+	f, ok := out.(*os.File)
+	if !ok {
+		return out, func() error { return nil }
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return out, func() error { return nil }
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || pos != info.Size() {
+		return out, func() error { return nil }
+	}
+	s := &sparseFile{f: f, pos: pos, size: pos}
+	return s, s.finish
+}
+
+// sparseFile writes to the end of a file, skipping the whole blocks of
+// zeros, which it makes holes of by extending the file before the next
+// write. This works for a file opened to append as well.
+type sparseFile struct {
+	f    *os.File
+	pos  int64 // Offset the next byte goes to
+	size int64 // Size of the file, short of pos after a hole
+}
+
+func (s *sparseFile) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		rest := b[written:]
+		n := s.run(rest, false)
+		if n > 0 {
+			if s.pos > s.size {
+				if err := s.finish(); err != nil {
+					return written, err
+				}
+				if _, err := s.f.Seek(s.pos, io.SeekStart); err != nil {
+					return written, err
+				}
+			}
+			m, err := s.f.Write(rest[:n])
+			s.pos += int64(m)
+			s.size = s.pos
+			written += m
+			if err != nil {
+				return written, err
+			}
+		}
+		zeros := s.run(b[written:], true)
+		s.pos += int64(zeros)
+		written += zeros
+	}
+	return written, nil
+}
+
+// run returns the length of the start of b, from pos, that is whole
+// blocks of zeros when zeros is set, or up to the first of them when not
+func (s *sparseFile) run(b []byte, zeros bool) int {
+	n := 0
+	for n < len(b) {
+		end := min(len(b), n+sparseBlockSize-int((s.pos+int64(n))%sparseBlockSize))
+		isZero := end-n == sparseBlockSize && bytes.Equal(b[n:end], zeroBlock[:])
+		if isZero != zeros {
+			break
+		}
+		n = end
+	}
+	return n
+}
+
+// finish extends the file over a hole at its end
+func (s *sparseFile) finish() error {
+	if s.pos == s.size {
+		return nil
+	}
+	if err := s.f.Truncate(s.pos); err != nil {
+		return err
+	}
+	s.size = s.pos
+	return nil
+}
+
+// progressOptions are the flags the commands that copy a lot of data share
+// for showing how far they are and limiting their rate
+type progressOptions struct {
+	show  *bool
+	limit *string
+}
+
+func addProgressFlags(flagSet *flag.FlagSet) *progressOptions {
+	return &progressOptions{
+		show:  flagSet.Bool("progress", false, "show the bytes copied, the throughput and the time left on stderr"),
+		limit: flagSet.String("limit-rate", "", "copy at most this many `bytes` a second, with a k, M or G suffix"),
+	}
+}
+
+// start returns the progress of a copy, or nil if neither flag is set.
+// total is only called with -progress, as it may have to walk a tree.
+func (opts *progressOptions) start(stderr io.Writer, total func() int64) (*progress, error) {
+	var rate int64
+	if *opts.limit != "" {
+		var err error
+		rate, err = parseByteCount(*opts.limit)
+		if err != nil || rate == 0 {
+			return nil, fmt.Errorf("bad -limit-rate %q", *opts.limit)
+		}
+	}
+	if !*opts.show && rate == 0 {
+		return nil, nil
+	}
+	p := &progress{rate: rate}
+	if *opts.show {
+		p.out, p.total = stderr, total()
+	}
+	p.start = time.Now()
+	p.last = p.start
+	return p, nil
+}
+
+// progressInterval is how often the status line is redrawn
+const progressInterval = 500 * time.Millisecond
+
+// progress counts the bytes a command copies, shows them on a status line
+// when out is set, and holds the copy to rate bytes a second when that is
+// set. The methods of a nil progress do nothing.
+type progress struct {
+	mu          sync.Mutex // Held by add, as extract copies several files at once
+	out         io.Writer
+	total, rate int64
+	done        int64
+	start, last time.Time
+}
+
+// writer returns w, counting what is written through it
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w, p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.add(int64(n))
+	return n, err
+}
+
+// add counts n bytes copied, sleeping if they came too fast
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	now := time.Now()
+	if p.rate > 0 {
+		due := p.start.Add(time.Duration(float64(p.done) / float64(p.rate) * float64(time.Second)))
+		if wait := due.Sub(now); wait > 0 {
+			time.Sleep(wait)
+			now = due
+		}
+	}
+	if p.out != nil && now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.report(now, false)
+	}
+}
+
+// finish ends the status line with the totals
+func (p *progress) finish() {
+	if p != nil && p.out != nil {
+		p.report(time.Now(), true)
+	}
+}
+
+// report redraws the status line: the bytes copied, of how many, the
+// throughput, and the time left, or the time taken once done
+func (p *progress) report(now time.Time, done bool) {
+	elapsed := now.Sub(p.start)
+	var speed float64
+	if elapsed > 0 {
+		speed = float64(p.done) / elapsed.Seconds()
+	}
+
+	line := formatSize(p.done)
+	if p.total > 0 {
+		line += fmt.Sprintf(" of %s (%.0f%%)", formatSize(p.total), 100*float64(p.done)/float64(p.total))
+	}
+	line += fmt.Sprintf(", %s/s", formatSize(int64(speed)))
+	switch {
+	case done:
+		line += fmt.Sprintf(", %v", elapsed.Round(time.Second))
+	case p.total > p.done && speed > 0:
+		left := time.Duration(float64(p.total-p.done) / speed * float64(time.Second))
+		line += fmt.Sprintf(", ETA %v", left.Round(time.Second))
+	}
+	// Padded to blank out the rest of a longer line before it
+	fmt.Fprintf(p.out, "\r%-50s", line)
+	if done {
+		fmt.Fprintln(p.out)
+	}
+}
+
 func runInfo(filesystem fsys.FS, out io.Writer) error {
 	fmt.Fprintf(out, "Filesystem: %s\n", filesystem.Type())
 
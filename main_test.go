@@ -0,0 +1,989 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lvdlvd/rawhide/fsys"
+	"github.com/lvdlvd/rawhide/imagefs"
+	"github.com/lvdlvd/rawhide/xts"
+)
+
+// extentFS is a filesystem whose one file, "f", is stored in an image file
+// at the extents given
+type extentFS struct {
+	fstest.MapFS
+	image   *os.File
+	extents []fsys.Extent
+}
+
+func (*extentFS) Type() string                                { return "extents" }
+func (*extentFS) Close() error                                { return nil }
+func (e *extentFS) BaseReader() io.ReaderAt                   { return e.image }
+func (e *extentFS) FileExtents(string) ([]fsys.Extent, error) { return e.extents, nil }
+
+// newExtentFS returns an extentFS for the image file at path, with "f" of
+// the given size
+func newExtentFS(t *testing.T, path string, size int, extents []fsys.Extent) *extentFS {
+	t.Helper()
+	image, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { image.Close() })
+	return &extentFS{fstest.MapFS{"f": {Data: make([]byte, size)}}, image, extents}
+}
+
+func TestWriteShared(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.img")
+	image := bytes.Repeat([]byte{0xAA}, 8192)
+	if err := os.WriteFile(name, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second half of f is shared, and would be zeroed by a write of
+	// the first half alone
+	filesystem := newExtentFS(t, name, 2048, []fsys.Extent{
+		{Logical: 0, Physical: 0, Length: 1024},
+		{Logical: 1024, Physical: 4096, Length: 1024, Shared: true},
+	})
+	var stderr bytes.Buffer
+	err := runWrite(filesystem, []string{"f"}, strings.NewReader("short"), &stderr)
+	if err == nil || !strings.Contains(err.Error(), "shares its blocks at offset 1024") {
+		t.Errorf("writing over a shared extent: %v", err)
+	}
+	if got, _ := os.ReadFile(name); !bytes.Equal(got, image) {
+		t.Error("the image was changed")
+	}
+
+	// Without the sharing the rest of f is zeroed, and nothing else
+	filesystem.extents[1].Shared = false
+	if err := runWrite(filesystem, []string{"f"}, strings.NewReader("short"), &stderr); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Clone(image)
+	copy(want, "short")
+	clear(want[5:1024])
+	clear(want[4096:5120])
+	if got, _ := os.ReadFile(name); !bytes.Equal(got, want) {
+		t.Error("the image does not hold the file as written")
+	}
+}
+
+func TestWriteJournaled(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "hostname"), bytes.Repeat([]byte("x"), 3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-b", "1024", "-d", root, name, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+
+	write := func(content string) error {
+		img, err := imagefs.OpenImage(name, imagefs.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		var stderr bytes.Buffer
+		return runWrite(img.FS, []string{"hostname"}, strings.NewReader(content), &stderr)
+	}
+	if err := write("clean\n"); err != nil {
+		t.Fatalf("writing to a clean filesystem: %v", err)
+	}
+
+	if out, err := exec.Command(debugfs, "-w", "-R", "feature needs_recovery", name).CombinedOutput(); err != nil {
+		t.Fatalf("debugfs: %v\n%s", err, out)
+	}
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write("dirty\n"); err == nil || !strings.Contains(err.Error(), "not unmounted cleanly") {
+		t.Errorf("writing to a filesystem needing recovery: %v", err)
+	}
+	if after, _ := os.ReadFile(name); !bytes.Equal(before, after) {
+		t.Error("the image was changed")
+	}
+}
+
+func TestWriteEncrypted(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret"), bytes.Repeat([]byte("x"), 3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-b", "1024", "-d", root, name, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+	// Extents and fscrypt encryption
+	if out, err := exec.Command(debugfs, "-w", "-R", "set_inode_field /secret flags 0x80800", name).CombinedOutput(); err != nil {
+		t.Fatalf("debugfs: %v\n%s", err, out)
+	}
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := imagefs.OpenImage(name, imagefs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	var stderr bytes.Buffer
+	if err := runWrite(img.FS, []string{"secret"}, strings.NewReader("plaintext\n"), &stderr); !errors.Is(err, fsys.ErrEncrypted) {
+		t.Errorf("writing an encrypted file: %v, want ErrEncrypted", err)
+	}
+	if after, _ := os.ReadFile(name); !bytes.Equal(before, after) {
+		t.Error("the image was changed")
+	}
+}
+
+// mapFS makes an fstest.MapFS an fsys.FS
+type mapFS struct{ fstest.MapFS }
+
+func (mapFS) Type() string { return "map" }
+func (mapFS) Close() error { return nil }
+
+func TestGrepHexIgnoreCase(t *testing.T) {
+	// Bytes that are not UTF-8 before a match, and a megabyte of them
+	// before another, near the end of the window searched
+	data := append([]byte{0xFF, 0xFE, 0xFF, 0xFE}, "AB"...)
+	big := append(bytes.Repeat([]byte{0xFF}, 1<<20-1), "ab"...)
+	filesystem := mapFS{fstest.MapFS{"bin.dat": {Data: data}, "big.dat": {Data: big}}}
+
+	for _, args := range [][]string{{"-x", "4142"}, {"-x", "-i", "4142"}} {
+		var stdout, stderr bytes.Buffer
+		if err := runGrep(filesystem, args, &stdout, &stderr); err != nil {
+			t.Fatalf("grep %v: %v", args, err)
+		}
+		want := "bin.dat:4:\"AB\"\n"
+		if args[1] == "-i" {
+			want = fmt.Sprintf("big.dat:%d:\"ab\"\n", 1<<20-1) + want
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("grep %v printed %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestCommandSettings(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from")
+	for _, name := range []string{"a.dat", "sub/b.dat", "sub/c.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(from, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(from, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(dir, "g.img")
+	if err := run([]string{image, "mkfs", "-size", "2M", "-from", from}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	settings := filepath.Join(dir, "c.toml")
+	if err := os.WriteFile(settings, []byte("[find]\na = true\n\n[manifest]\na = true\nalgo = \"md5\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// find takes its path before its flags
+	var stdout bytes.Buffer
+	if err := run([]string{"-config", settings, image, "find", "/", "-name", "*.dat"}, &stdout, io.Discard); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if got, want := stdout.String(), "a.dat\nsub/b.dat\n"; got != want {
+		t.Errorf("find printed %q, want %q", got, want)
+	}
+
+	// manifest takes create or verify first, and create has -algo where
+	// verify does not
+	stdout.Reset()
+	if err := run([]string{"-config", settings, image, "manifest", "create", "sub"}, &stdout, io.Discard); err != nil {
+		t.Fatalf("manifest create: %v", err)
+	}
+	if !strings.Contains(stdout.String(), `"algo": "md5"`) {
+		t.Errorf("manifest create did not take -algo from the settings:\n%s", stdout.String())
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := os.WriteFile(manifest, stdout.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-config", settings, image, "manifest", "verify", manifest}, io.Discard, io.Discard); err != nil {
+		t.Errorf("manifest verify: %v", err)
+	}
+
+	// The command line wins over the settings
+	stdout.Reset()
+	if err := run([]string{"-config", settings, image, "manifest", "create", "-algo", "sha1", "sub"}, &stdout, io.Discard); err != nil {
+		t.Fatalf("manifest create: %v", err)
+	}
+	if !strings.Contains(stdout.String(), `"algo": "sha1"`) {
+		t.Errorf("manifest create -algo sha1 took -algo from the settings:\n%s", stdout.String())
+	}
+}
+
+func TestPutMmap(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "g.img")
+	if err := run([]string{image, "mkfs", "-size", "2M"}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	host := filepath.Join(dir, "host.txt")
+	if err := os.WriteFile(host, []byte("mapped\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-mmap", image, "put", host, "new.txt"}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("put through -mmap: %v", err)
+	}
+	var stdout bytes.Buffer
+	if err := run([]string{"-mmap", image, "cat", "new.txt"}, &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "mapped\n" {
+		t.Errorf("cat new.txt = %q after put", got)
+	}
+}
+
+func TestDuBlocks(t *testing.T) {
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "d1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	const files = 300
+	for i := range files {
+		if err := os.WriteFile(filepath.Join(root, "d1", fmt.Sprintf("file%04d", i)), []byte("ten bytes\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "ext4.img")
+	if out, err := exec.Command(mke2fs, "-q", "-F", "-t", "ext4", "-b", "1024", "-d", root, name, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v\n%s", err, out)
+	}
+	img, err := imagefs.OpenImage(name, imagefs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	var stdout bytes.Buffer
+	if err := runDu(img.FS, []string{"d1"}, &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var logical, disk int64
+	if _, err := fmt.Sscanf(stdout.String(), "%d\t%d\td1\n", &logical, &disk); err != nil {
+		t.Fatalf("du printed %q: %v", stdout.String(), err)
+	}
+	// A block for each file, and the blocks of the directory entries
+	if logical != files*10 || disk <= files*1024 {
+		t.Errorf("du d1 = %d logical, %d on disk, want %d and more than %d", logical, disk, files*10, files*1024)
+	}
+}
+
+func TestFscatAutoEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	inner := filepath.Join(dir, "inner")
+	if err := os.Mkdir(inner, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inner, "hello.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain.img")
+	if err := run([]string{plain, "mkfs", "-size", "1M", "-from", inner}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The FAT image encrypted, in the one partition of a disk, in a FAT
+	// image of its own
+	key := bytes.Repeat([]byte{7}, 32)
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := xts.New(key, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "encrypted.img")
+	f, err := os.Create(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = xts.NewWriterAt(f, cipher, int64(len(data))).WriteAt(data, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := filepath.Join(dir, "outer")
+	if err := os.Mkdir(outer, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{filepath.Join(outer, "disk.img"), "mkimage", encrypted + ",type=linux"}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "outer.img")
+	if err := run([]string{image, "mkfs", "-size", "4M", "-from", outer}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{image, "fs", "-auto", "-K", hex.EncodeToString(key), "disk.img", "cat", "hello.txt"}, &stdout, &stderr); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "hello\n" {
+		t.Errorf("cat hello.txt = %q, want %q", got, "hello\n")
+	}
+	if !strings.Contains(stderr.String(), "fs -K <key> p0") {
+		t.Errorf("fs -auto did not report descending into the encrypted partition:\n%s", stderr.String())
+	}
+}
+
+func TestOrderedPool(t *testing.T) {
+	// Work that finishes out of order is still finished in order
+	pool := newOrderedPool(4)
+	var got []int
+	for i := range 40 {
+		pool.Go(func() func() error {
+			time.Sleep(time.Duration(rand.IntN(2000)) * time.Microsecond)
+			return func() error {
+				got = append(got, i)
+				return nil
+			}
+		})
+	}
+	if err := pool.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("finished in the order %v", got)
+		}
+	}
+	if len(got) != 40 {
+		t.Errorf("finished %d of 40", len(got))
+	}
+}
+
+func TestOrderedPoolDiscard(t *testing.T) {
+	// After a finish function fails, what is left is discarded instead
+	failure := errors.New("failed")
+	pool := newOrderedPool(4)
+	var started atomic.Int64
+	finished, discarded := 0, 0
+	for i := range 40 {
+		err := pool.GoDiscard(func() (func() error, func()) {
+			started.Add(1)
+			// The work that fails is the slowest, so that later work is
+			// started before it finishes
+			sleep := time.Duration(rand.IntN(2000)) * time.Microsecond
+			if i == 5 {
+				sleep = 5 * time.Millisecond
+			}
+			time.Sleep(sleep)
+			finish := func() error {
+				finished++
+				if i == 5 {
+					return failure
+				}
+				return nil
+			}
+			return finish, func() { discarded++ }
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err := pool.Wait(); err != failure {
+		t.Errorf("Wait() = %v, want the finish function's error", err)
+	}
+	if finished != 6 {
+		t.Errorf("finished %d, want the 6 up to the failure", finished)
+	}
+	if discarded == 0 {
+		t.Error("no work was discarded")
+	}
+	if n := int(started.Load()); finished+discarded != n {
+		t.Errorf("finished %d and discarded %d of the %d started", finished, discarded, n)
+	}
+}
+
+// archiveTree is a tree of files of every size tar handles differently,
+// from empty to one streamed rather than read into memory
+func archiveTree() mapFS {
+	big := make([]byte, tarBufferSize+12345)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	tree := fstest.MapFS{
+		"big.bin":       {Data: big},
+		"empty":         {Data: nil},
+		"dir/sub/empty": {Mode: fs.ModeDir | 0o755},
+		"link":          {Data: []byte("dir/a.txt"), Mode: fs.ModeSymlink | 0o777},
+	}
+	for i := range 30 {
+		tree[fmt.Sprintf("dir/f%02d.txt", i)] = &fstest.MapFile{Data: bytes.Repeat([]byte{byte('a' + i)}, i*1000)}
+	}
+	return mapFS{tree}
+}
+
+func TestJobsOrder(t *testing.T) {
+	filesystem := archiveTree()
+	run := func(command func(context.Context, fsys.FS, []string, io.Writer, io.Writer) error, jobs string) []byte {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := command(context.Background(), filesystem, []string{"-j", jobs}, &stdout, &stderr); err != nil {
+			t.Fatalf("-j %s: %v\n%s", jobs, err, stderr.Bytes())
+		}
+		return stdout.Bytes()
+	}
+
+	archive := run(runTar, "1")
+	if !bytes.Equal(run(runTar, "4"), archive) {
+		t.Error("tar -j 4 wrote another archive than tar -j 1")
+	}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filesystem.MapFS[h.Name].Data; !bytes.Equal(data, want) {
+			t.Errorf("%s holds %d bytes in the archive, want its %d", h.Name, len(data), len(want))
+		}
+	}
+	if len(names) != 36 {
+		t.Errorf("archived %d entries, want 36: %v", len(names), names)
+	}
+
+	sums := run(runHash, "1")
+	if !bytes.Equal(run(runHash, "4"), sums) {
+		t.Error("hash -j 4 printed other sums than hash -j 1")
+	}
+	if n := bytes.Count(sums, []byte("\n")); n != 32 {
+		t.Errorf("hash printed %d sums, want 32", n)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(&fsHandler{fs: mapFS{fstest.MapFS{
+		"big.dat":       {Data: data, ModTime: mtime},
+		"dir/a b.txt":   {Data: []byte("spaced"), Mode: 0o644, ModTime: mtime},
+		"dir/sub/c.txt": {Data: []byte("c")},
+	}}})
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	get := func(method, path string, header ...string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("GET", "/big.dat")
+	if resp.StatusCode != http.StatusOK || body != string(data) {
+		t.Errorf("GET /big.dat: %s, %d bytes", resp.Status, len(body))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") != mtime.Format(http.TimeFormat) {
+		t.Errorf("GET /big.dat: ETag %q, Last-Modified %q", etag, resp.Header.Get("Last-Modified"))
+	}
+
+	// Ranges, and requests for what the client has already
+	for _, tt := range []struct {
+		header []string
+		status int
+		body   string
+	}{
+		{[]string{"Range", "bytes=5-14"}, http.StatusPartialContent, "5678901234"},
+		{[]string{"Range", "bytes=-3"}, http.StatusPartialContent, "789"},
+		{[]string{"Range", "bytes=20000-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{[]string{"If-None-Match", etag}, http.StatusNotModified, ""},
+		{[]string{"If-None-Match", `"other"`}, http.StatusOK, string(data)},
+		{[]string{"Range", "bytes=0-1", "If-Range", etag}, http.StatusPartialContent, "01"},
+		{[]string{"Range", "bytes=0-1", "If-Range", `"other"`}, http.StatusOK, string(data)},
+	} {
+		resp, body := get("GET", "/big.dat", tt.header...)
+		if resp.StatusCode != tt.status || tt.body != "" && body != tt.body {
+			t.Errorf("GET /big.dat with %q: %s, %.20q", tt.header, resp.Status, body)
+		}
+	}
+
+	// Listings
+	resp, body = get("GET", "/dir?format=json")
+	if want := `[{"name":"a b.txt","dir":false,"size":6,"mode":"-rw-r--r--"`; resp.Header.Get("Content-Type") != "application/json" || !strings.HasPrefix(body, want) {
+		t.Errorf("GET /dir?format=json: %s, %q", resp.Header.Get("Content-Type"), body)
+	}
+	if _, body := get("GET", "/dir/sub", "Accept", "application/json"); !strings.Contains(body, `"name":"c.txt"`) {
+		t.Errorf("GET /dir/sub with Accept application/json: %q", body)
+	}
+	if resp, _ := get("GET", "/dir"); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/dir/" {
+		t.Errorf("GET /dir: %s to %q, want a redirect to /dir/", resp.Status, resp.Header.Get("Location"))
+	}
+	resp, body = get("GET", "/dir/")
+	for _, want := range []string{`<a href="a%20b.txt">a b.txt</a>`, `<a href="sub/">sub/</a>`, `<a href="../">`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /dir/ lacks %s:\n%s", want, body)
+		}
+	}
+	if _, body := get("GET", "/"); strings.Contains(body, `href="../"`) {
+		t.Errorf("GET / links to its parent:\n%s", body)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/missing", http.StatusNotFound},
+		{"HEAD", "/big.dat", http.StatusOK},
+		{"POST", "/big.dat", http.StatusMethodNotAllowed},
+		{"GET", "/../big.dat", http.StatusOK},
+	} {
+		if resp, _ := get(tt.method, tt.path); resp.StatusCode != tt.status {
+			t.Errorf("%s %s: %s, want %d", tt.method, tt.path, resp.Status, tt.status)
+		}
+	}
+}
+
+// newFATImage makes a FAT image at name holding files, by path
+func newFATImage(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	from := filepath.Join(t.TempDir(), "from")
+	if err := os.Mkdir(from, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(from, path)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(from, path), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := run([]string{name, "mkfs", "-size", "2M", "-from", from}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openImage opens an image until the end of the test
+func openImage(t *testing.T, name string) fsys.FS {
+	t.Helper()
+	img, err := imagefs.OpenImage(name, imagefs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return img.FS
+}
+
+// putFile copies data into an image as name with the put command
+func putFile(t *testing.T, image, name, data string) {
+	t.Helper()
+	host := filepath.Join(t.TempDir(), "put")
+	if err := os.WriteFile(host, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{image, "put", host, name}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("put %s: %v", name, err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	// Two copies of an image, one with a file removed, the other with one
+	// added, one changed in size and one in its contents alone
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.img"), filepath.Join(dir, "b.img")
+	newFATImage(t, a, map[string]string{"keep.txt": "keep", "changed.txt": "old", "same.txt": "same", "sub/x.txt": "x"})
+	image, err := os.ReadFile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, a, "removed.txt", "gone")
+	putFile(t, b, "sub/added.txt", "added")
+	putFile(t, b, "changed.txt", "new contents")
+	if err := runWrite(openImage(t, b), []string{"same.txt"}, strings.NewReader("SAME"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args   []string
+		want   string
+		counts string
+	}{
+		{[]string{b}, "M\tchanged.txt\tsize\nD\tremoved.txt\nA\tsub/added.txt\n", "1 added, 1 removed, 1 changed"},
+		{[]string{"-hash", b}, "M\tchanged.txt\tsize\nD\tremoved.txt\nM\tsame.txt\tcontent\nA\tsub/added.txt\n", "1 added, 1 removed, 2 changed"},
+		{[]string{b, "sub"}, "A\tsub/added.txt\n", "1 added, 0 removed, 0 changed"},
+		{[]string{"-hash", a}, "", "0 added, 0 removed, 0 changed"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		if err := runCommand(context.Background(), openImage(t, a), append([]string{"diff"}, tt.args...), &stdout, &stderr); err != nil {
+			t.Errorf("diff %q: %v", tt.args, err)
+			continue
+		}
+		// put sets the time of changed.txt, which may or may not fall in
+		// another of FAT's two-second steps
+		if got := strings.ReplaceAll(stdout.String(), "size,mtime", "size"); got != tt.want {
+			t.Errorf("diff %q printed %q, want %q", tt.args, got, tt.want)
+		}
+		if want := "diff: " + tt.counts + "\n"; stderr.String() != want {
+			t.Errorf("diff %q: %q, want %q", tt.args, stderr.String(), want)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.img"), filepath.Join(dir, "b.img")
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/deeper/c.txt": "ccc", "copy/b.txt": "bb"}
+	newFATImage(t, a, files)
+	newFATImage(t, b, files)
+
+	var stdout bytes.Buffer
+	if err := runCommand(context.Background(), openImage(t, a), []string{"manifest", "create", "sub"}, &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(stdout.Bytes(), &m); err != nil {
+		t.Fatalf("manifest create wrote bad JSON: %v\n%s", err, stdout.Bytes())
+	}
+	var got []string
+	for _, f := range m.Files {
+		got = append(got, fmt.Sprintf("%s %s %d %s", f.Path, f.Type, f.Size, f.Hash))
+	}
+	sum := func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) }
+	want := []string{"b.txt file 2 " + sum("bb"), "deeper dir 0 ", "deeper/c.txt file 3 " + sum("ccc")}
+	if m.Root != "sub" || m.Algo != "sha256" || m.Type != "FAT12" || !slices.Equal(got, want) {
+		t.Errorf("manifest of %s, %s, %s: %q, want %q", m.Root, m.Algo, m.Type, got, want)
+	}
+	manifestFile := filepath.Join(dir, "manifest.json")
+	if err := os.WriteFile(manifestFile, stdout.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same image matches
+	var stderr bytes.Buffer
+	stdout.Reset()
+	if err := runCommand(context.Background(), openImage(t, a), []string{"manifest", "verify", manifestFile}, &stdout, &stderr); err != nil {
+		t.Errorf("manifest verify: %v\n%s", err, stderr.Bytes())
+	}
+	if want := "manifest: 3 files match, 0 added, 0 removed, 0 changed\n"; stderr.String() != want {
+		t.Errorf("manifest verify: %q, want %q", stderr.String(), want)
+	}
+
+	// A file changed after the manifest was made
+	if err := runWrite(openImage(t, b), []string{"sub/b.txt"}, strings.NewReader("BB"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, b, "sub/new.txt", "new")
+	stdout.Reset()
+	err := runCommand(context.Background(), openImage(t, b), []string{"manifest", "verify", manifestFile}, &stdout, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "files differ") {
+		t.Errorf("manifest verify of a changed image: %v", err)
+	}
+	// The other files differ at most in their times, which were set when
+	// the image was made
+	if out := stdout.String(); !strings.Contains(out, "A\tnew.txt\n") || !strings.Contains(out, "M\tb.txt\t") || !strings.Contains(out, "content\n") {
+		t.Errorf("manifest verify printed %q, want b.txt's content changed and new.txt added", out)
+	}
+
+	// The manifest checked against another directory
+	stdout.Reset()
+	if err := runCommand(context.Background(), openImage(t, a), []string{"manifest", "verify", manifestFile, "copy"}, &stdout, io.Discard); err == nil {
+		t.Error("manifest verify of a directory lacking files succeeded")
+	}
+	if !strings.Contains(stdout.String(), "D\tdeeper\nD\tdeeper/c.txt\n") || strings.Contains(stdout.String(), "content") {
+		t.Errorf("manifest verify copy printed %q", stdout.String())
+	}
+}
+
+func TestCatOutput(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "g.img")
+	newFATImage(t, image, map[string]string{"a.txt": "A", "sub/b.txt": "sub B", "other/b.txt": "other B", "other/c.dat": "C"})
+	filesystem := openImage(t, image)
+
+	tests := []struct {
+		args []string // {out} is the output directory
+		want map[string]string
+		err  string
+	}{
+		{[]string{"-o", "{out}/{name}", "a.txt", "sub/b.txt"}, map[string]string{"a.txt": "A", "b.txt": "sub B"}, ""},
+		{[]string{"-o", "{out}/{path}.copy", "other/*", "sub/b.txt"}, map[string]string{"other/b.txt.copy": "other B", "other/c.dat.copy": "C", "sub/b.txt.copy": "sub B"}, ""},
+		{[]string{"-o", "{out}/one", "other/c.dat"}, map[string]string{"one": "C"}, ""},
+		{[]string{"-o", "{out}/one", "a.txt", "sub/b.txt"}, nil, "would write all 2 files to one file"},
+		{[]string{"-o", "{out}/one", "*.txt", "sub/*"}, nil, "would write all 2 files to one file"},
+		// The first file is written before the clash is found
+		{[]string{"-o", "{out}/{name}", "sub/b.txt", "other/b.txt"}, map[string]string{"b.txt": "sub B"}, "would write both sub/b.txt and other/b.txt"},
+	}
+	for i, tt := range tests {
+		out := filepath.Join(dir, fmt.Sprint(i))
+		args := slices.Clone(tt.args)
+		args[1] = strings.ReplaceAll(args[1], "{out}", out)
+		var stdout bytes.Buffer
+		err := runCommand(context.Background(), filesystem, append([]string{"cat"}, args...), &stdout, io.Discard)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("cat %q: %v, want error %q", tt.args, err, tt.err)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("cat %q wrote %q to stdout", tt.args, stdout.String())
+		}
+		got := make(map[string]string)
+		filepath.WalkDir(out, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				data, _ := os.ReadFile(name)
+				rel, _ := filepath.Rel(out, name)
+				got[filepath.ToSlash(rel)] = string(data)
+			}
+			return nil
+		})
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("cat %q wrote %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+// lsImage makes a FAT image for the tests of ls
+func lsImage(t *testing.T) fsys.FS {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "g.img")
+	newFATImage(t, image, map[string]string{
+		"a.txt":          "a",
+		"big.dat":        strings.Repeat("b", 100),
+		"mid.txt":        "0123456789",
+		"sub/y.txt":      "yy",
+		"sub/deep/x.txt": "xxx",
+	})
+	return openImage(t, image)
+}
+
+func TestLsRecursiveSorted(t *testing.T) {
+	filesystem := lsImage(t)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "a.txt\nbig.dat\nmid.txt\nsub/\n"},
+		{[]string{"-R"}, ".:\na.txt\nbig.dat\nmid.txt\nsub/\n\nsub:\ndeep/\ny.txt\n\nsub/deep:\nx.txt\n"},
+		{[]string{"-S"}, "big.dat\nmid.txt\na.txt\nsub/\n"},
+		{[]string{"-S", "-r"}, "sub/\na.txt\nmid.txt\nbig.dat\n"},
+		{[]string{"-r"}, "sub/\nmid.txt\nbig.dat\na.txt\n"},
+		{[]string{"-R", "-S", "-r", "sub"}, "sub:\ndeep/\ny.txt\n\nsub/deep:\nx.txt\n"},
+		{[]string{"-d", "sub"}, "sub\n"},
+		{[]string{"-d", "."}, ".\n"},
+		// Files first, then directories with headers
+		{[]string{"sub", "a.txt", "."}, "a.txt\n\nsub:\ndeep/\ny.txt\n\n.:\na.txt\nbig.dat\nmid.txt\nsub/\n"},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		if err := runCommand(context.Background(), filesystem, append([]string{"ls"}, tt.args...), &stdout, io.Discard); err != nil {
+			t.Errorf("ls %q: %v", tt.args, err)
+		} else if stdout.String() != tt.want {
+			t.Errorf("ls %q printed %q, want %q", tt.args, stdout.String(), tt.want)
+		}
+	}
+
+	// -t sorts newest first, ties by name
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timed := mapFS{fstest.MapFS{
+		"old":   {ModTime: base},
+		"new":   {ModTime: base.Add(time.Hour)},
+		"tie.b": {ModTime: base.Add(time.Minute)},
+		"tie.a": {ModTime: base.Add(time.Minute)},
+	}}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-t"}, "new\ntie.a\ntie.b\nold\n"},
+		{[]string{"-t", "-r"}, "old\ntie.b\ntie.a\nnew\n"},
+	} {
+		var stdout bytes.Buffer
+		if err := runCommand(context.Background(), timed, append([]string{"ls"}, tt.args...), &stdout, io.Discard); err != nil {
+			t.Errorf("ls %q: %v", tt.args, err)
+		} else if stdout.String() != tt.want {
+			t.Errorf("ls %q printed %q, want %q", tt.args, stdout.String(), tt.want)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "g.img")
+	newFATImage(t, image, map[string]string{
+		"Users/alice/NTUSER.DAT": "alice",
+		"Users/bob/NTUSER.DAT":   "bob",
+		"Users/bob/other.txt":    "other",
+		"a.txt":                  "a",
+	})
+	filesystem := openImage(t, image)
+
+	tests := []struct {
+		args []string
+		want string
+		err  string
+	}{
+		{[]string{"ls", "Users/*/NTUSER.DAT"}, "Users/alice/NTUSER.DAT\nUsers/bob/NTUSER.DAT\n", ""},
+		{[]string{"ls", "Users/[ab]*"}, "Users/alice:\nNTUSER.DAT\n\nUsers/bob:\nNTUSER.DAT\nother.txt\n", ""},
+		{[]string{"ls", "*.txt", "Users/b?b/*.txt"}, "a.txt\nUsers/bob/other.txt\n", ""},
+		{[]string{"ls", "*.none"}, "", "no matching files"},
+		{[]string{"ls", "Users/["}, "", "syntax error in pattern"},
+		{[]string{"cat", "Users/*/NTUSER.DAT", "a.txt"}, "aliceboba", ""},
+		{[]string{"cat", "a.txt", "*/nobody/*"}, "", "no matching files"},
+		// Without wildcards a path is taken as it is
+		{[]string{"cat", "a.txt"}, "a", ""},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		err := runCommand(context.Background(), filesystem, tt.args, &stdout, io.Discard)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q: %v, want error %q", tt.args, err, tt.err)
+		} else if err == nil && stdout.String() != tt.want {
+			t.Errorf("%q printed %q, want %q", tt.args, stdout.String(), tt.want)
+		}
+	}
+
+	// Extracted matches keep their path below the pattern's directory
+	dst := filepath.Join(dir, "out")
+	if err := runCommand(context.Background(), filesystem, []string{"extract", "Users/*/NTUSER.DAT", dst}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if data, err := os.ReadFile(filepath.Join(dst, user, "NTUSER.DAT")); err != nil || string(data) != user {
+			t.Errorf("extracted %s's NTUSER.DAT: %q, %v", user, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "bob", "other.txt")); !os.IsNotExist(err) {
+		t.Errorf("extract copied a file not matching: %v", err)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "g.img")
+	data := strings.Repeat("rate", 16<<10)
+	newFATImage(t, image, map[string]string{"a.dat": data, "sub/b.dat": data})
+	filesystem := openImage(t, image)
+
+	// 64 KiB at 128 KiB a second takes half a second, however fast the
+	// image is read, for cat and for the files tar writes
+	for _, tt := range []struct {
+		args []string
+		size int
+	}{
+		{[]string{"cat", "-limit-rate", "128k", "a.dat"}, len(data)},
+		{[]string{"tar", "-limit-rate", "256k", "."}, 2 * len(data)},
+	} {
+		var stdout bytes.Buffer
+		start := time.Now()
+		if err := runCommand(context.Background(), filesystem, tt.args, &stdout, io.Discard); err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("%q took %v, want about half a second", tt.args, elapsed)
+		}
+		if stdout.Len() < tt.size {
+			t.Errorf("%q wrote %d bytes, want at least %d", tt.args, stdout.Len(), tt.size)
+		}
+	}
+
+	// The totals are shown once done
+	var stderr bytes.Buffer
+	if err := runCommand(context.Background(), filesystem, []string{"cat", "-progress", "-limit-rate", "1M", "a.dat", "sub/b.dat"}, io.Discard, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if got := stderr.String(); !strings.HasPrefix(got, "\r128.0K of 128.0K (100%), ") || !strings.HasSuffix(got, "\n") {
+		t.Errorf("cat -progress printed %q", got)
+	}
+
+	for _, rate := range []string{"fast", "0", "-1"} {
+		if err := runCommand(context.Background(), filesystem, []string{"cat", "-limit-rate", rate, "a.dat"}, io.Discard, io.Discard); err == nil || !strings.Contains(err.Error(), "bad -limit-rate") {
+			t.Errorf("cat -limit-rate %s: %v", rate, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package mapping reads a disk image stitched together from pieces of other
+// files, as described by a table in the style of dmsetup, for rebuilding a
+// disk from partial dumps: the partition table from one file, say, and each
+// partition from a dump of its own.
+//
+// Each line of a table maps a run of 512-byte sectors of the image:
+//
+//	# start length target [args]
+//	0 2048 linear header.bin 0
+//	2048 409600 linear /dumps/sda1.img 0
+//	411648 1024 zero
+//
+// A linear piece is read from the named file starting at the given sector
+// of it; a relative name is relative to the directory of the table, and a
+// URL is passed to the OpenFunc as it is. A zero piece reads as zeros, as
+// do sectors no line maps. The image ends with the last piece.
+package mapping
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// SectorSize is the unit of the starts, lengths and offsets of a table
+const SectorSize = 512
+
+// Piece is a run of sectors of the image and where it is read from
+type Piece struct {
+	Start  int64  // First sector of the image
+	Length int64  // Number of sectors
+	Source string // File the piece is read from, "" for zeros
+	Offset int64  // Sector of Source the piece starts at
+}
+
+// Parse reads a table, returning its pieces in order of their start. Pieces
+// may leave gaps but not overlap.
+func Parse(r io.Reader) ([]Piece, error) {
+	var pieces []Piece
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		p, err := parseLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pieces = append(pieces, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pieces) == 0 {
+		return nil, errors.New("table maps no sectors")
+	}
+
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].Start < pieces[j].Start })
+	for i := 1; i < len(pieces); i++ {
+		if prev := pieces[i-1]; prev.Start+prev.Length > pieces[i].Start {
+			return nil, fmt.Errorf("sectors %d-%d and %d-%d overlap", prev.Start, prev.Start+prev.Length-1,
+				pieces[i].Start, pieces[i].Start+pieces[i].Length-1)
+		}
+	}
+	return pieces, nil
+}
+
+// parseLine decodes the fields of one line of a table
+func parseLine(fields []string) (Piece, error) {
+	if len(fields) < 3 {
+		return Piece{}, errors.New("want start, length and target")
+	}
+	var p Piece
+	var err error
+	if p.Start, err = parseSectors(fields[0]); err != nil {
+		return Piece{}, err
+	}
+	if p.Length, err = parseSectors(fields[1]); err != nil {
+		return Piece{}, err
+	}
+	if p.Length == 0 {
+		return Piece{}, errors.New("length is 0")
+	}
+	switch target := fields[2]; target {
+	case "linear":
+		if len(fields) != 5 {
+			return Piece{}, errors.New("want linear <file> <offset>")
+		}
+		p.Source = fields[3]
+		if p.Offset, err = parseSectors(fields[4]); err != nil {
+			return Piece{}, err
+		}
+	case "zero":
+		if len(fields) != 3 {
+			return Piece{}, errors.New("zero takes no arguments")
+		}
+	default:
+		return Piece{}, fmt.Errorf("unknown target %q (use linear or zero)", target)
+	}
+	return p, nil
+}
+
+// parseSectors decodes a sector number or count
+func parseSectors(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/SectorSize {
+		return 0, fmt.Errorf("bad sector number %q", s)
+	}
+	return n, nil
+}
+
+// OpenFunc opens a source of a table, returning its size and what closes it
+type OpenFunc func(name string) (io.ReaderAt, int64, io.Closer, error)
+
+// Reader reads the image a table describes. Its pieces are extents of the
+// sources laid end to end.
+type Reader struct {
+	*fsys.ExtentReaderAt
+	closers []io.Closer
+}
+
+// Open reads the table at path and opens the files it names with open,
+// each once however many pieces come from it
+func Open(path string, open OpenFunc) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	pieces, err := Parse(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	r := &Reader{}
+	var all sources
+	bases := make(map[string]int) // Index in all of each source by name
+	var extents []fsys.Extent
+	for _, p := range pieces {
+		e := fsys.Extent{Logical: p.Start * SectorSize, Length: p.Length * SectorSize, Zero: p.Source == ""}
+		if p.Source != "" {
+			name := p.Source
+			if !filepath.IsAbs(name) && !strings.Contains(name, "://") {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			i, ok := bases[name]
+			if !ok {
+				src, size, closer, err := open(name)
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				r.closers = append(r.closers, closer)
+				i = all.add(src, size)
+				bases[name] = i
+			}
+			if end := (p.Offset + p.Length) * SectorSize; end > all.size(i) {
+				r.Close()
+				return nil, fmt.Errorf("%s: sectors %d-%d run past the end of %s (%d bytes)",
+					path, p.Start, p.Start+p.Length-1, p.Source, all.size(i))
+			}
+			e.Physical = all.base[i] + p.Offset*SectorSize
+		}
+		extents = append(extents, e)
+	}
+
+	last := pieces[len(pieces)-1]
+	r.ExtentReaderAt = fsys.NewExtentReaderAt(&all, extents, (last.Start+last.Length)*SectorSize)
+	return r, nil
+}
+
+// Close closes the sources
+func (r *Reader) Close() error {
+	var errs []error
+	for _, c := range r.closers {
+		errs = append(errs, c.Close())
+	}
+	r.closers = nil
+	return errors.Join(errs...)
+}
+
+// sources reads the sources of a table as if they were one file, each
+// starting where the one before it ends
+type sources struct {
+	readers []io.ReaderAt
+	base    []int64 // Offset of each source, and past the end of the last
+}
+
+// add appends a source of the given size, returning its index
+func (s *sources) add(r io.ReaderAt, size int64) int {
+	if len(s.base) == 0 {
+		s.base = append(s.base, 0)
+	}
+	s.readers = append(s.readers, r)
+	s.base = append(s.base, s.base[len(s.base)-1]+size)
+	return len(s.readers) - 1
+}
+
+// size returns the size of source i
+func (s *sources) size(i int) int64 {
+	return s.base[i+1] - s.base[i]
+}
+
+// ReadAt implements io.ReaderAt. Extents coalesced across the end of one
+// source and the start of the next are read from both.
+func (s *sources) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		i := sort.Search(len(s.readers), func(i int) bool { return s.base[i+1] > pos })
+		if i == len(s.readers) {
+			return n, io.EOF
+		}
+		chunk := p[n : n+int(min(int64(len(p)-n), s.base[i+1]-pos))]
+		m, err := s.readers[i].ReadAt(chunk, pos-s.base[i])
+		n += m
+		if err != nil && (err != io.EOF || m < len(chunk)) {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package mapping
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openFile is an OpenFunc for files, counting the opens
+func openFile(opens *int) OpenFunc {
+	return func(name string) (io.ReaderAt, int64, io.Closer, error) {
+		*opens++
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+		return f, info.Size(), f, nil
+	}
+}
+
+// sectors returns n sectors of the given byte
+func sectors(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n*SectorSize)
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	a := append(sectors(2, 'a'), sectors(2, 'A')...)
+	b := sectors(3, 'b')
+	for name, data := range map[string][]byte{"a.bin": a, "b.bin": b} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second piece of a.bin and b.bin are coalesced into one extent of
+	// the sources, and sector 8 is in no piece
+	table := `# A test table
+0 1 linear a.bin 2
+1 2 linear a.bin 0
+3 1 linear a.bin 3
+4 3 linear ` + filepath.Join(dir, "b.bin") + ` 0
+7 1 zero
+9 1 linear a.bin 1
+`
+	tablePath := filepath.Join(dir, "disk.table")
+	if err := os.WriteFile(tablePath, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var opens int
+	r, err := Open(tablePath, openFile(&opens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if opens != 2 {
+		t.Errorf("%d opens, want one per file", opens)
+	}
+
+	want := bytes.Join([][]byte{sectors(1, 'A'), sectors(2, 'a'), sectors(1, 'A'), b, sectors(2, 0), sectors(1, 'a')}, nil)
+	if r.Size() != int64(len(want)) {
+		t.Fatalf("Size() = %d, want %d", r.Size(), len(want))
+	}
+	got := make([]byte, len(want))
+	if n, err := r.ReadAt(got, 0); n != len(want) || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("read the wrong data")
+	}
+
+	// A read across the end of one source and the start of the next
+	got = got[:2*SectorSize]
+	if _, err := r.ReadAt(got, 3*SectorSize+SectorSize/2); err != nil || !bytes.Equal(got, want[3*SectorSize+SectorSize/2:][:2*SectorSize]) {
+		t.Errorf("ReadAt across sources = %v, or the wrong data", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		table, want string
+	}{
+		{"", "no sectors"},
+		{"0 8 linear a.bin", "want linear <file> <offset>"},
+		{"0 8 striped a.bin 0", "unknown target"},
+		{"0 0 zero", "length is 0"},
+		{"0 -1 zero", "bad sector number"},
+		{"0 8 zero extra", "no arguments"},
+		{"0 8 zero\n4 8 zero", "overlap"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(strings.NewReader(tt.table)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) = %v, want an error with %q", tt.table, err, tt.want)
+		}
+	}
+}
+
+func TestOpenPastEnd(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "short.bin"), sectors(2, 's'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tablePath := filepath.Join(dir, "disk.table")
+	if err := os.WriteFile(tablePath, []byte("0 4 linear short.bin 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var opens int
+	if _, err := Open(tablePath, openFile(&opens)); err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Errorf("Open = %v, want an error about the end of short.bin", err)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build unix
+
+package nbd
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSocketActivation runs itself as a socket-activated server, handed a
+// listening socket as fd 3, which shuts down once idle
+func TestSocketActivation(t *testing.T) {
+	data := bytes.Repeat([]byte("activated"), 1000)
+	if os.Getenv("NBD_TEST_ACTIVATED") == "1" {
+		// systemd sets LISTEN_PID to the service's own PID
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		server := NewServer("")
+		server.SetLogger(log.New(io.Discard, "", 0))
+		server.SetIdleTimeout(200 * time.Millisecond)
+		server.AddExport(&Export{Name: "disk", Reader: bytes.NewReader(data), Size: int64(len(data))})
+		if err := server.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Error("LISTEN_FDS left for child processes")
+		}
+		return
+	}
+
+	socket := filepath.Join(t.TempDir(), "nbd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	f, err := listener.(*net.UnixListener).File()
+	listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSocketActivation$")
+	cmd.Env = append(os.Environ(), "NBD_TEST_ACTIVATED=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// The server answers on the socket it was given, and stays up while a
+	// client is connected, however long
+	client, err := Dial("unix", socket, "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	got := make([]byte, len(data))
+	if _, err := client.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAt after a wait = %v", err)
+	}
+	client.Close()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("server: %v\n%s", err, out.Bytes())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("server still running once idle")
+	}
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("the socket systemd made is gone: %v", err)
+	}
+}
@@ -1,5 +1,6 @@
-// Package nbd implements an NBD (Network Block Device) server.
-// It exposes an io.ReaderAt as a block device via the Linux NBD protocol.
+// Package nbd implements an NBD (Network Block Device) server and client.
+// The server exposes an io.ReaderAt as a block device via the Linux NBD
+// protocol; the client reads a remote export as an io.ReaderAt.
 package nbd
 
 import (
@@ -9,8 +10,13 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // NBD protocol constants
@@ -20,37 +26,58 @@ const (
 	nbdReplyMagic       = uint64(0x3e889045565a9)
 	nbdRequestMagic     = uint32(0x25609513)
 	nbdReplyMagicSimple = uint32(0x67446698)
+	nbdReplyMagicChunk  = uint32(0x668e33ef)
 
 	nbdFlagFixedNewstyle  = uint16(1 << 0)
 	nbdFlagNoZeroes       = uint16(1 << 1)
 	nbdFlagCFixedNewstyle = uint32(1 << 0)
 	nbdFlagCNoZeroes      = uint32(1 << 1)
 
-	nbdFlagHasFlags  = uint16(1 << 0)
-	nbdFlagReadOnly  = uint16(1 << 1)
-	nbdFlagSendFlush = uint16(1 << 2)
-	nbdFlagSendFUA   = uint16(1 << 3)
-	nbdFlagSendTrim  = uint16(1 << 5)
+	nbdFlagHasFlags        = uint16(1 << 0)
+	nbdFlagReadOnly        = uint16(1 << 1)
+	nbdFlagSendFlush       = uint16(1 << 2)
+	nbdFlagSendFUA         = uint16(1 << 3)
+	nbdFlagSendTrim        = uint16(1 << 5)
+	nbdFlagSendWriteZeroes = uint16(1 << 6)
+
+	nbdCmdFlagFUA = uint16(1 << 0)
 
 	nbdOptExportName = uint32(1)
 	nbdOptAbort      = uint32(2)
 	nbdOptList       = uint32(3)
 	nbdOptGo         = uint32(7)
-
-	nbdRepAck        = uint32(1)
-	nbdRepServer     = uint32(2)
-	nbdRepInfo       = uint32(3)
-	nbdRepErrUnsup   = uint32(0x80000001)
-	nbdRepErrUnknown = uint32(0x80000006)
+	nbdOptStructured = uint32(8)
+	nbdOptListMeta   = uint32(9)
+	nbdOptSetMeta    = uint32(10)
+
+	nbdRepAck         = uint32(1)
+	nbdRepServer      = uint32(2)
+	nbdRepInfo        = uint32(3)
+	nbdRepMetaContext = uint32(4)
+	nbdRepErrUnsup    = uint32(0x80000001)
+	nbdRepErrInvalid  = uint32(0x80000003)
+	nbdRepErrUnknown  = uint32(0x80000006)
 
 	nbdInfoExport    = uint16(0)
 	nbdInfoBlockSize = uint16(3)
 
-	nbdCmdRead  = uint16(0)
-	nbdCmdWrite = uint16(1)
-	nbdCmdDisc  = uint16(2)
-	nbdCmdFlush = uint16(3)
-	nbdCmdTrim  = uint16(4)
+	nbdCmdRead        = uint16(0)
+	nbdCmdWrite       = uint16(1)
+	nbdCmdDisc        = uint16(2)
+	nbdCmdFlush       = uint16(3)
+	nbdCmdTrim        = uint16(4)
+	nbdCmdWriteZeroes = uint16(6)
+	nbdCmdBlockStatus = uint16(7)
+
+	nbdReplyFlagDone        = uint16(1 << 0)
+	nbdReplyTypeOffsetData  = uint16(1)
+	nbdReplyTypeBlockStatus = uint16(5)
+	nbdReplyTypeError       = uint16(1<<15 + 1)
+
+	// The base:allocation metadata context, the only one served
+	metaContextAllocation = "base:allocation"
+	allocationContextID   = uint32(1)
+	nbdStateHole          = uint32(1 << 0)
 
 	nbdErrNone  = uint32(0)
 	nbdErrPerm  = uint32(1)
@@ -58,6 +85,9 @@ const (
 	nbdErrInval = uint32(22)
 
 	defaultBlockSize = uint32(4096)
+
+	// maxInFlight bounds the requests of a connection handled at once
+	maxInFlight = 16
 )
 
 // Export defines a named block device to expose
@@ -66,6 +96,119 @@ type Export struct {
 	Reader   io.ReaderAt  // Data source
 	Writer   io.WriterAt  // Optional: data sink for writes (nil = read-only)
 	Size     int64        // Size of the export in bytes
+	ReadOnly bool         // Reject writes even if Writer is set
+
+	// Requests served, shared by all connections
+	statsMu sync.Mutex
+	stats   Stats
+
+	// Regions clients have trimmed since, shared by all connections
+	trimMu  sync.Mutex
+	trimmed []span
+}
+
+// readOnly reports whether the export rejects writes
+func (exp *Export) readOnly() bool {
+	return exp.ReadOnly || exp.Writer == nil
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets
+// in Stats; the last bucket counts the slower requests
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Stats counts the read and write requests an export has served
+type Stats struct {
+	Reads        uint64 // Read requests, including failed ones
+	Writes       uint64 // Write and write zeroes requests, including failed ones
+	BytesRead    uint64
+	BytesWritten uint64
+	Errors       uint64 // Requests answered with an error
+
+	// Requests by latency, one bucket per latencyBuckets entry plus one
+	// for anything slower
+	Latency [len(latencyBuckets) + 1]uint64
+}
+
+// Stats returns a snapshot of the requests the export has served
+func (exp *Export) Stats() Stats {
+	exp.statsMu.Lock()
+	defer exp.statsMu.Unlock()
+	return exp.stats
+}
+
+// record counts a read or write of length bytes that started at start and
+// was answered with code
+func (exp *Export) record(write bool, length uint32, start time.Time, code uint32) {
+	elapsed := time.Since(start)
+	bucket := 0
+	for bucket < len(latencyBuckets) && elapsed >= latencyBuckets[bucket] {
+		bucket++
+	}
+
+	exp.statsMu.Lock()
+	defer exp.statsMu.Unlock()
+	st := &exp.stats
+	switch {
+	case write:
+		st.Writes++
+		if code == nbdErrNone {
+			st.BytesWritten += uint64(length)
+		}
+	default:
+		st.Reads++
+		if code == nbdErrNone {
+			st.BytesRead += uint64(length)
+		}
+	}
+	if code != nbdErrNone {
+		st.Errors++
+	}
+	st.Latency[bucket]++
+}
+
+// WriteStats writes the request counts of every export to w
+func (s *Server) WriteStats(w io.Writer) error {
+	s.exportsMu.RLock()
+	names := make([]string, 0, len(s.exports))
+	for name := range s.exports {
+		names = append(names, name)
+	}
+	s.exportsMu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		s.exportsMu.RLock()
+		exp := s.exports[name]
+		s.exportsMu.RUnlock()
+		st := exp.Stats()
+		if _, err := fmt.Fprintf(w, "Export %q: %d reads (%d bytes), %d writes (%d bytes), %d errors\n",
+			name, st.Reads, st.BytesRead, st.Writes, st.BytesWritten, st.Errors); err != nil {
+			return err
+		}
+		latency := make([]string, len(st.Latency))
+		for i, n := range st.Latency {
+			if i < len(latencyBuckets) {
+				latency[i] = fmt.Sprintf("<%v: %d", latencyBuckets[i], n)
+			} else {
+				latency[i] = fmt.Sprintf(">=%v: %d", latencyBuckets[i-1], n)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "  latency %s\n", strings.Join(latency, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// span is a byte range [start, end) of an export
+type span struct {
+	start, end int64
 }
 
 // Server represents the NBD server
@@ -74,8 +217,16 @@ type Server struct {
 	exports    map[string]*Export
 	exportsMu  sync.RWMutex
 	listener   net.Listener
+	activated  bool // The listener was passed in by systemd
 	done       chan struct{}
+	closeOnce  sync.Once
 	logger     *log.Logger
+
+	// Shut down after idleTimeout without connections, if set
+	idleTimeout time.Duration
+	idleMu      sync.Mutex
+	idleTimer   *time.Timer
+	active      int // Open connections
 }
 
 // session represents an active client connection
@@ -84,6 +235,13 @@ type session struct {
 	conn     net.Conn
 	export   *Export
 	noZeroes bool
+
+	structured bool // Structured replies negotiated
+	allocation bool // base:allocation metadata context selected
+
+	writeMu  sync.Mutex     // Serializes replies, which workers send concurrently
+	slots    chan struct{}  // Semaphore bounding the requests in flight
+	inFlight sync.WaitGroup // Requests being handled by workers
 }
 
 // NewServer creates a new NBD server
@@ -101,6 +259,12 @@ func (s *Server) SetLogger(l *log.Logger) {
 	s.logger = l
 }
 
+// SetIdleTimeout makes Serve return once no client has been connected for
+// the given time. Zero, the default, serves until Close.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
 // AddExport registers a new export
 func (s *Server) AddExport(exp *Export) error {
 	s.exportsMu.Lock()
@@ -139,31 +303,43 @@ func (s *Server) Serve() error {
 		return errors.New("no exports defined")
 	}
 
-	// Remove existing socket file if present
-	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove existing socket: %w", err)
-	}
-
-	listener, err := net.Listen("unix", s.socketPath)
+	listener, err := activationListener()
 	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+		return fmt.Errorf("using socket from systemd: %w", err)
 	}
-	s.listener = listener
+	if listener != nil {
+		s.activated = true
+		s.logger.Printf("Listening on socket from systemd (%s)", listener.Addr())
+	} else {
+		// Remove existing socket file if present
+		if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove existing socket: %w", err)
+		}
 
-	// Make socket accessible
-	if err := os.Chmod(s.socketPath, 0660); err != nil {
-		s.logger.Printf("Warning: failed to chmod socket: %v", err)
-	}
+		listener, err = net.Listen("unix", s.socketPath)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
 
-	s.logger.Printf("Listening on unix:%s", s.socketPath)
+		// Make socket accessible
+		if err := os.Chmod(s.socketPath, 0660); err != nil {
+			s.logger.Printf("Warning: failed to chmod socket: %v", err)
+		}
+
+		s.logger.Printf("Listening on unix:%s", s.socketPath)
+	}
+	s.listener = listener
 	for _, exp := range s.exports {
 		roStr := ""
-		if exp.Writer == nil {
+		if exp.readOnly() {
 			roStr = " (read-only)"
 		}
 		s.logger.Printf("Export %q: %d bytes%s", exp.Name, exp.Size, roStr)
 	}
-	s.logger.Printf("Connect with: sudo nbd-client -N <export-name> -unix %s /dev/nbdX", s.socketPath)
+	if !s.activated {
+		s.logger.Printf("Connect with: sudo nbd-client -N <export-name> -unix %s /dev/nbdX", s.socketPath)
+	}
+	s.connectionDone() // Start the idle timer
 
 	for {
 		conn, err := listener.Accept()
@@ -182,18 +358,83 @@ func (s *Server) Serve() error {
 
 // Close shuts down the server
 func (s *Server) Close() error {
-	close(s.done)
+	s.closeOnce.Do(func() {
+		close(s.done)
 
-	if s.listener != nil {
-		s.listener.Close()
-	}
+		if s.listener != nil {
+			s.listener.Close()
+		}
 
-	os.Remove(s.socketPath)
+		if !s.activated {
+			os.Remove(s.socketPath)
+		}
+	})
 	return nil
 }
 
+// activationListener returns the listening socket systemd passes to a
+// socket-activated service (the first of LISTEN_FDS, from fd 3), or nil if
+// the server was not started that way
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// Not for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// connectionStarted stops the idle timer while a client is connected
+func (s *Server) connectionStarted() {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	s.active++
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+}
+
+// connectionDone starts the idle timer once the last client is gone
+func (s *Server) connectionDone() {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	if s.active > 0 {
+		s.active--
+	}
+	if s.idleTimeout <= 0 || s.active > 0 {
+		return
+	}
+	if s.idleTimer == nil {
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.idleShutdown)
+	} else {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+}
+
+// idleShutdown closes the server if no client connected meanwhile
+func (s *Server) idleShutdown() {
+	s.idleMu.Lock()
+	idle := s.active == 0
+	s.idleMu.Unlock()
+	if idle {
+		s.logger.Printf("No connections for %v, shutting down", s.idleTimeout)
+		s.Close()
+	}
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
+	s.connectionStarted()
+	defer s.connectionDone()
 	s.logger.Printf("New connection from %s", conn.RemoteAddr())
 
 	sess := &session{
@@ -317,6 +558,16 @@ func (sess *session) handleOption(optType uint32, optData []byte) (done bool, er
 		sess.sendOptionReply(optType, nbdRepAck, nil)
 		return false, nil
 
+	case nbdOptStructured:
+		if len(optData) != 0 {
+			return false, sess.sendOptionReply(optType, nbdRepErrInvalid, nil)
+		}
+		sess.structured = true
+		return false, sess.sendOptionReply(optType, nbdRepAck, nil)
+
+	case nbdOptListMeta, nbdOptSetMeta:
+		return false, sess.handleMetaContext(optType, optData)
+
 	case nbdOptAbort:
 		sess.sendOptionReply(optType, nbdRepAck, nil)
 		return false, errors.New("client aborted")
@@ -327,6 +578,64 @@ func (sess *session) handleOption(optType uint32, optData []byte) (done bool, er
 	}
 }
 
+// handleMetaContext answers NBD_OPT_LIST_META_CONTEXT and
+// NBD_OPT_SET_META_CONTEXT. Only base:allocation is offered; listing with
+// no queries, or a "base:" query, lists it too.
+func (sess *session) handleMetaContext(optType uint32, optData []byte) error {
+	if optType == nbdOptSetMeta && !sess.structured {
+		return sess.sendOptionReply(optType, nbdRepErrInvalid, nil)
+	}
+
+	// Export name, then the number of queries and the queries, each
+	// prefixed with its length
+	var queries []string
+	data := optData
+	field := func() ([]byte, bool) {
+		if len(data) < 4 || uint32(len(data)-4) < binary.BigEndian.Uint32(data[0:4]) {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(data[0:4])
+		f := data[4 : 4+n]
+		data = data[4+n:]
+		return f, true
+	}
+	_, ok := field()
+	if ok && len(data) >= 4 {
+		count := binary.BigEndian.Uint32(data[0:4])
+		data = data[4:]
+		for i := uint32(0); i < count && ok; i++ {
+			var q []byte
+			if q, ok = field(); ok {
+				queries = append(queries, string(q))
+			}
+		}
+	} else {
+		ok = false
+	}
+	if !ok {
+		return sess.sendOptionReply(optType, nbdRepErrInvalid, nil)
+	}
+
+	match := len(queries) == 0 && optType == nbdOptListMeta
+	for _, q := range queries {
+		if q == metaContextAllocation || (q == "base:" && optType == nbdOptListMeta) {
+			match = true
+		}
+	}
+	if optType == nbdOptSetMeta {
+		sess.allocation = match
+	}
+	if match {
+		reply := make([]byte, 4+len(metaContextAllocation))
+		binary.BigEndian.PutUint32(reply[0:4], allocationContextID)
+		copy(reply[4:], metaContextAllocation)
+		if err := sess.sendOptionReply(optType, nbdRepMetaContext, reply); err != nil {
+			return err
+		}
+	}
+	return sess.sendOptionReply(optType, nbdRepAck, nil)
+}
+
 func (sess *session) sendOptionReply(option, replyType uint32, data []byte) error {
 	reply := make([]byte, 20+len(data))
 	binary.BigEndian.PutUint64(reply[0:8], nbdReplyMagic)
@@ -348,8 +657,10 @@ func (sess *session) sendExportInfo(option uint32) error {
 	binary.BigEndian.PutUint16(infoExport[0:2], nbdInfoExport)
 	binary.BigEndian.PutUint64(infoExport[2:10], uint64(exp.Size))
 	flags := nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA
-	if exp.Writer == nil {
+	if exp.readOnly() {
 		flags |= nbdFlagReadOnly
+	} else {
+		flags |= nbdFlagSendTrim | nbdFlagSendWriteZeroes
 	}
 	binary.BigEndian.PutUint16(infoExport[10:12], flags)
 	if err := sess.sendOptionReply(option, nbdRepInfo, infoExport); err != nil {
@@ -379,8 +690,10 @@ func (sess *session) sendOldstyleExportInfo() error {
 	resp := make([]byte, respLen)
 	binary.BigEndian.PutUint64(resp[0:8], uint64(exp.Size))
 	flags := nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA
-	if exp.Writer == nil {
+	if exp.readOnly() {
 		flags |= nbdFlagReadOnly
+	} else {
+		flags |= nbdFlagSendTrim | nbdFlagSendWriteZeroes
 	}
 	binary.BigEndian.PutUint16(resp[8:10], flags)
 
@@ -388,9 +701,16 @@ func (sess *session) sendOldstyleExportInfo() error {
 	return err
 }
 
+// transmit reads requests and hands reads and writes to workers, so that a
+// slow read does not hold up the others. Replies carry the request handle,
+// so they may be sent in any order. A flush or disconnect waits for the
+// requests in flight first, and so does a trim, so that a write sent
+// before it cannot finish after it and mark the region written again.
 func (sess *session) transmit() error {
 	header := make([]byte, 28)
 	exp := sess.export
+	sess.slots = make(chan struct{}, maxInFlight)
+	defer sess.inFlight.Wait()
 
 	sess.server.logger.Printf("Transmission phase for export %q (%d bytes)", exp.Name, exp.Size)
 
@@ -404,23 +724,33 @@ func (sess *session) transmit() error {
 			return fmt.Errorf("bad request magic: %x", magic)
 		}
 
+		cmdFlags := binary.BigEndian.Uint16(header[4:6])
 		cmdType := binary.BigEndian.Uint16(header[6:8])
-		handle := header[8:16]
+		handle := append([]byte(nil), header[8:16]...) // header is reused
 		offset := binary.BigEndian.Uint64(header[16:24])
 		length := binary.BigEndian.Uint32(header[24:28])
 
 		switch cmdType {
 		case nbdCmdRead:
-			sess.handleRead(handle, offset, length)
+			start := time.Now()
+			sess.dispatch(func() { exp.record(false, length, start, sess.handleRead(handle, offset, length)) })
 		case nbdCmdWrite:
-			sess.handleWrite(handle, offset, length)
+			if err := sess.handleWrite(handle, cmdFlags, offset, length); err != nil {
+				return err
+			}
+		case nbdCmdWriteZeroes:
+			sess.handleWriteZeroes(handle, cmdFlags, offset, length)
 		case nbdCmdFlush:
-			sess.sendReply(handle, nbdErrNone, nil)
+			sess.inFlight.Wait()
+			sess.sendReply(handle, sess.flush(), nil)
 		case nbdCmdDisc:
 			sess.server.logger.Printf("Client disconnected")
 			return nil
 		case nbdCmdTrim:
-			sess.sendReply(handle, nbdErrNone, nil)
+			sess.inFlight.Wait()
+			sess.handleTrim(handle, offset, length)
+		case nbdCmdBlockStatus:
+			sess.handleBlockStatus(handle, offset, length)
 		default:
 			sess.server.logger.Printf("Unknown command: %d", cmdType)
 			sess.sendReply(handle, nbdErrInval, nil)
@@ -428,12 +758,26 @@ func (sess *session) transmit() error {
 	}
 }
 
-func (sess *session) handleRead(handle []byte, offset uint64, length uint32) {
+// dispatch runs fn on a worker, waiting for a free slot first
+func (sess *session) dispatch(fn func()) {
+	sess.slots <- struct{}{}
+	sess.inFlight.Add(1)
+	go func() {
+		defer func() {
+			<-sess.slots
+			sess.inFlight.Done()
+		}()
+		fn()
+	}()
+}
+
+// handleRead answers a read request and returns the error code sent
+func (sess *session) handleRead(handle []byte, offset uint64, length uint32) uint32 {
 	exp := sess.export
 
 	if offset+uint64(length) > uint64(exp.Size) {
-		sess.sendReply(handle, nbdErrInval, nil)
-		return
+		sess.sendError(handle, nbdErrInval)
+		return nbdErrInval
 	}
 
 	data := make([]byte, length)
@@ -441,8 +785,8 @@ func (sess *session) handleRead(handle []byte, offset uint64, length uint32) {
 
 	if err != nil && err != io.EOF {
 		sess.server.logger.Printf("Read error at offset %d: %v", offset, err)
-		sess.sendReply(handle, nbdErrIO, nil)
-		return
+		sess.sendError(handle, nbdErrIO)
+		return nbdErrIO
 	}
 
 	// Zero-fill if we read less than requested
@@ -450,38 +794,256 @@ func (sess *session) handleRead(handle []byte, offset uint64, length uint32) {
 		data[i] = 0
 	}
 
-	sess.sendReply(handle, nbdErrNone, data)
+	if !sess.structured {
+		sess.sendReply(handle, nbdErrNone, data)
+		return nbdErrNone
+	}
+	chunk := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(chunk[0:8], offset)
+	copy(chunk[8:], data)
+	sess.sendChunk(handle, nbdReplyTypeOffsetData, chunk)
+	return nbdErrNone
+}
+
+// handleWrite reads the data of a write request, which follows the header
+// on the connection, and hands the write to a worker
+func (sess *session) handleWrite(handle []byte, cmdFlags uint16, offset uint64, length uint32) error {
+	exp := sess.export
+	start := time.Now()
+
+	// Refuse the write before looking at the data, which is drained
+	if exp.readOnly() || offset+uint64(length) > uint64(exp.Size) {
+		code := nbdErrInval
+		if exp.readOnly() {
+			code = nbdErrPerm
+		}
+		_, err := io.CopyN(io.Discard, sess.conn, int64(length))
+		sess.sendReply(handle, code, nil)
+		exp.record(true, length, start, code)
+		return err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(sess.conn, data); err != nil {
+		return fmt.Errorf("failed to read write data: %w", err)
+	}
+
+	sess.dispatch(func() {
+		if _, err := exp.Writer.WriteAt(data, int64(offset)); err != nil {
+			sess.server.logger.Printf("Write error at offset %d: %v", offset, err)
+			sess.sendReply(handle, nbdErrIO, nil)
+			exp.record(true, length, start, nbdErrIO)
+			return
+		}
+		exp.untrim(int64(offset), int64(offset)+int64(length))
+		code := sess.forceUnitAccess(cmdFlags)
+		sess.sendReply(handle, code, nil)
+		exp.record(true, length, start, code)
+	})
+	return nil
 }
 
-func (sess *session) handleWrite(handle []byte, offset uint64, length uint32) {
+// zeroChunk is the most WRITE_ZEROES writes at a time
+const zeroChunk = 64 * 1024
+
+// handleWriteZeroes writes zeroes from a small buffer, as the request
+// carries no data
+func (sess *session) handleWriteZeroes(handle []byte, cmdFlags uint16, offset uint64, length uint32) {
 	exp := sess.export
+	start := time.Now()
 
-	if exp.Writer == nil {
-		io.CopyN(io.Discard, sess.conn, int64(length))
+	if exp.readOnly() {
 		sess.sendReply(handle, nbdErrPerm, nil)
+		exp.record(true, length, start, nbdErrPerm)
+		return
+	}
+	if offset+uint64(length) > uint64(exp.Size) {
+		sess.sendReply(handle, nbdErrInval, nil)
+		exp.record(true, length, start, nbdErrInval)
 		return
 	}
 
+	sess.dispatch(func() {
+		zeroes := make([]byte, min(length, zeroChunk))
+		for off, end := int64(offset), int64(offset)+int64(length); off < end; off += int64(len(zeroes)) {
+			n := min(int64(len(zeroes)), end-off)
+			if _, err := exp.Writer.WriteAt(zeroes[:n], off); err != nil {
+				sess.server.logger.Printf("Write error at offset %d: %v", off, err)
+				sess.sendReply(handle, nbdErrIO, nil)
+				exp.record(true, length, start, nbdErrIO)
+				return
+			}
+		}
+		exp.untrim(int64(offset), int64(offset)+int64(length))
+		code := sess.forceUnitAccess(cmdFlags)
+		sess.sendReply(handle, code, nil)
+		exp.record(true, length, start, code)
+	})
+}
+
+// forceUnitAccess flushes a write to stable storage if the client asked
+// for it with the FUA flag, and returns the error code for the reply
+func (sess *session) forceUnitAccess(cmdFlags uint16) uint32 {
+	if cmdFlags&nbdCmdFlagFUA == 0 {
+		return nbdErrNone
+	}
+	return sess.flush()
+}
+
+// flush syncs the export to stable storage and returns the error code for
+// the reply
+func (sess *session) flush() uint32 {
+	if err := sess.export.Sync(); err != nil {
+		sess.server.logger.Printf("Sync error: %v", err)
+		return nbdErrIO
+	}
+	return nbdErrNone
+}
+
+// Sync flushes the file under the export's writer to stable storage,
+// looking through the layers that expose their base writer
+func (exp *Export) Sync() error {
+	w := exp.Writer
+	for w != nil {
+		switch v := w.(type) {
+		case interface{ Sync() error }:
+			return v.Sync()
+		case interface{ BaseWriter() io.WriterAt }:
+			w = v.BaseWriter()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleTrim records a trimmed region. The data stays in place, but block
+// status reports the region as a hole until it is written again.
+func (sess *session) handleTrim(handle []byte, offset uint64, length uint32) {
+	exp := sess.export
+
+	if exp.readOnly() {
+		sess.sendReply(handle, nbdErrPerm, nil)
+		return
+	}
 	if offset+uint64(length) > uint64(exp.Size) {
-		io.CopyN(io.Discard, sess.conn, int64(length))
 		sess.sendReply(handle, nbdErrInval, nil)
 		return
 	}
 
-	data := make([]byte, length)
-	if _, err := io.ReadFull(sess.conn, data); err != nil {
-		sess.server.logger.Printf("Failed to read write data: %v", err)
+	exp.trim(int64(offset), int64(offset)+int64(length))
+	sess.sendReply(handle, nbdErrNone, nil)
+}
+
+// handleBlockStatus reports which parts of a region are trimmed, in the
+// base:allocation context
+func (sess *session) handleBlockStatus(handle []byte, offset uint64, length uint32) {
+	exp := sess.export
+
+	if !sess.allocation || length == 0 || offset >= uint64(exp.Size) {
+		sess.sendError(handle, nbdErrInval)
 		return
 	}
+	end := min(int64(offset)+int64(length), exp.Size)
 
-	_, err := exp.Writer.WriteAt(data, int64(offset))
-	if err != nil {
-		sess.server.logger.Printf("Write error at offset %d: %v", offset, err)
-		sess.sendReply(handle, nbdErrIO, nil)
+	// Context ID, then a length and flags for every extent
+	payload := binary.BigEndian.AppendUint32(nil, allocationContextID)
+	for _, ext := range exp.status(int64(offset), end) {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(ext.end-ext.start))
+		payload = binary.BigEndian.AppendUint32(payload, ext.flags)
+	}
+	sess.sendChunk(handle, nbdReplyTypeBlockStatus, payload)
+}
+
+// trim marks [start, end) as trimmed
+func (exp *Export) trim(start, end int64) {
+	exp.trimMu.Lock()
+	defer exp.trimMu.Unlock()
+
+	var merged []span
+	for _, t := range exp.trimmed {
+		if t.end < start || t.start > end {
+			merged = append(merged, t)
+			continue
+		}
+		start, end = min(start, t.start), max(end, t.end)
+	}
+	merged = append(merged, span{start, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i].start < merged[j].start })
+	exp.trimmed = merged
+}
+
+// untrim removes [start, end) from the trimmed regions
+func (exp *Export) untrim(start, end int64) {
+	exp.trimMu.Lock()
+	defer exp.trimMu.Unlock()
+
+	var kept []span
+	for _, t := range exp.trimmed {
+		if t.start < start {
+			kept = append(kept, span{t.start, min(t.end, start)})
+		}
+		if t.end > end {
+			kept = append(kept, span{max(t.start, end), t.end})
+		}
+	}
+	exp.trimmed = kept
+}
+
+// statusExtent is a run of bytes with the same block status flags
+type statusExtent struct {
+	start, end int64
+	flags      uint32
+}
+
+// status describes [start, end) as alternating allocated and trimmed extents
+func (exp *Export) status(start, end int64) []statusExtent {
+	exp.trimMu.Lock()
+	defer exp.trimMu.Unlock()
+
+	var exts []statusExtent
+	pos := start
+	for _, t := range exp.trimmed {
+		if t.end <= pos || t.start >= end {
+			continue
+		}
+		if t.start > pos {
+			exts = append(exts, statusExtent{pos, t.start, 0})
+			pos = t.start
+		}
+		exts = append(exts, statusExtent{pos, min(t.end, end), nbdStateHole})
+		pos = min(t.end, end)
+	}
+	if pos < end {
+		exts = append(exts, statusExtent{pos, end, 0})
+	}
+	return exts
+}
+
+// sendError reports a failed command, with an error chunk once structured
+// replies are negotiated
+func (sess *session) sendError(handle []byte, errCode uint32) {
+	if !sess.structured {
+		sess.sendReply(handle, errCode, nil)
 		return
 	}
+	payload := make([]byte, 6) // Error, then an empty message
+	binary.BigEndian.PutUint32(payload[0:4], errCode)
+	sess.sendChunk(handle, nbdReplyTypeError, payload)
+}
 
-	sess.sendReply(handle, nbdErrNone, nil)
+// sendChunk sends the only chunk of a structured reply
+func (sess *session) sendChunk(handle []byte, replyType uint16, payload []byte) {
+	reply := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint32(reply[0:4], nbdReplyMagicChunk)
+	binary.BigEndian.PutUint16(reply[4:6], nbdReplyFlagDone)
+	binary.BigEndian.PutUint16(reply[6:8], replyType)
+	copy(reply[8:16], handle)
+	binary.BigEndian.PutUint32(reply[16:20], uint32(len(payload)))
+	copy(reply[20:], payload)
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.conn.Write(reply)
 }
 
 func (sess *session) sendReply(handle []byte, errCode uint32, data []byte) {
@@ -492,5 +1054,253 @@ func (sess *session) sendReply(handle []byte, errCode uint32, data []byte) {
 	if len(data) > 0 {
 		copy(reply[16:], data)
 	}
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
 	sess.conn.Write(reply)
 }
+
+// DefaultPort is the TCP port NBD servers listen on
+const DefaultPort = "10809"
+
+// maxReadChunk bounds the size of the read requests a Client sends
+const maxReadChunk = 1 << 20
+
+// Client is a connection to an export on a remote NBD server. It reads
+// the export as an io.ReaderAt; reads are sent one at a time.
+type Client struct {
+	conn    net.Conn
+	name    string
+	size    int64
+	mu      sync.Mutex
+	handle  uint64
+	timeout time.Duration // Longest wait for a reply, 0 for no limit
+	err     error         // Set when the connection fails, which ends it
+}
+
+// OpenURL connects to the export named by an NBD URL: nbd://host[:port]/export
+// for TCP, or nbd+unix:///export?socket=path for a Unix socket
+func OpenURL(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing NBD URL: %w", err)
+	}
+	export := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "nbd":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), DefaultPort)
+		}
+		return Dial("tcp", host, export)
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return nil, fmt.Errorf("NBD URL %q has no socket parameter", rawURL)
+		}
+		return Dial("unix", socket, export)
+	default:
+		return nil, fmt.Errorf("unsupported NBD URL scheme %q", u.Scheme)
+	}
+}
+
+// IsURL reports whether name looks like an NBD URL rather than a file name
+func IsURL(name string) bool {
+	return strings.HasPrefix(name, "nbd://") || strings.HasPrefix(name, "nbd+unix://")
+}
+
+// Dial connects to the named export of an NBD server using fixed
+// newstyle negotiation
+func Dial(network, address, export string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, name: export}
+	if err := c.negotiate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("negotiating with %s: %w", address, err)
+	}
+	return c, nil
+}
+
+func (c *Client) negotiate() error {
+	greeting := make([]byte, 18)
+	if _, err := io.ReadFull(c.conn, greeting); err != nil {
+		return fmt.Errorf("reading greeting: %w", err)
+	}
+	if binary.BigEndian.Uint64(greeting[0:8]) != nbdMagic || binary.BigEndian.Uint64(greeting[8:16]) != nbdOptionMagic {
+		return errors.New("not a newstyle NBD server")
+	}
+	serverFlags := binary.BigEndian.Uint16(greeting[16:18])
+	if serverFlags&nbdFlagFixedNewstyle == 0 {
+		return errors.New("server does not support fixed newstyle negotiation")
+	}
+	clientFlags := nbdFlagCFixedNewstyle
+	if serverFlags&nbdFlagNoZeroes != 0 {
+		clientFlags |= nbdFlagCNoZeroes
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, clientFlags); err != nil {
+		return err
+	}
+
+	// NBD_OPT_GO: the export name, and no information requests
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(c.name)))
+	data = append(data, c.name...)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	if err := c.sendOption(nbdOptGo, data); err != nil {
+		return err
+	}
+	for {
+		replyType, payload, err := c.readOptionReply(nbdOptGo)
+		if err != nil {
+			return err
+		}
+		switch {
+		case replyType == nbdRepAck:
+			if c.size == 0 {
+				return errors.New("server sent no export size")
+			}
+			return nil
+		case replyType == nbdRepInfo && len(payload) >= 12 && binary.BigEndian.Uint16(payload[0:2]) == nbdInfoExport:
+			c.size = int64(binary.BigEndian.Uint64(payload[2:10]))
+		case replyType == nbdRepErrUnsup:
+			return c.exportName(serverFlags)
+		case replyType == nbdRepErrUnknown:
+			return fmt.Errorf("unknown export %q", c.name)
+		case replyType&0x80000000 != 0:
+			return fmt.Errorf("export %q refused: error %#x %s", c.name, replyType, payload)
+		}
+	}
+}
+
+// exportName selects the export with NBD_OPT_EXPORT_NAME, for servers that
+// do not know NBD_OPT_GO
+func (c *Client) exportName(serverFlags uint16) error {
+	if err := c.sendOption(nbdOptExportName, []byte(c.name)); err != nil {
+		return err
+	}
+	resp := make([]byte, 134)
+	if serverFlags&nbdFlagNoZeroes != 0 {
+		resp = resp[:10]
+	}
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return fmt.Errorf("reading export info: %w", err)
+	}
+	c.size = int64(binary.BigEndian.Uint64(resp[0:8]))
+	return nil
+}
+
+func (c *Client) sendOption(option uint32, data []byte) error {
+	header := make([]byte, 16, 16+len(data))
+	binary.BigEndian.PutUint64(header[0:8], nbdOptionMagic)
+	binary.BigEndian.PutUint32(header[8:12], option)
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(data)))
+	_, err := c.conn.Write(append(header, data...))
+	return err
+}
+
+func (c *Client) readOptionReply(option uint32) (uint32, []byte, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return 0, nil, fmt.Errorf("reading option reply: %w", err)
+	}
+	if binary.BigEndian.Uint64(header[0:8]) != nbdReplyMagic || binary.BigEndian.Uint32(header[8:12]) != option {
+		return 0, nil, errors.New("bad option reply")
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[16:20]))
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return 0, nil, fmt.Errorf("reading option reply: %w", err)
+	}
+	return binary.BigEndian.Uint32(header[12:16]), payload, nil
+}
+
+// Size returns the size of the export
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// SetReadTimeout makes reads fail when the server takes longer than d to
+// answer one of their requests, 0 for no limit. The connection cannot be
+// used after a read times out.
+func (c *Client) SetReadTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = d
+}
+
+// ReadAt implements io.ReaderAt
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("nbd: negative offset")
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), c.size-off))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	for done := 0; done < n; {
+		chunk := min(n-done, maxReadChunk)
+		if err := c.read(p[done:done+chunk], off+int64(done)); err != nil {
+			return done, err
+		}
+		done += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// read sends a single read request and waits for its simple reply. A
+// failure of the connection leaves it out of step, so it is kept in c.err.
+func (c *Client) read(p []byte, off int64) error {
+	c.handle++
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	req := make([]byte, 28)
+	binary.BigEndian.PutUint32(req[0:4], nbdRequestMagic)
+	binary.BigEndian.PutUint16(req[6:8], nbdCmdRead)
+	binary.BigEndian.PutUint64(req[8:16], c.handle)
+	binary.BigEndian.PutUint64(req[16:24], uint64(off))
+	binary.BigEndian.PutUint32(req[24:28], uint32(len(p)))
+	if _, err := c.conn.Write(req); err != nil {
+		c.err = fmt.Errorf("nbd: sending read: %w", err)
+		return c.err
+	}
+
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		c.err = fmt.Errorf("nbd: reading reply: %w", err)
+		return c.err
+	}
+	if binary.BigEndian.Uint32(reply[0:4]) != nbdReplyMagicSimple || binary.BigEndian.Uint64(reply[8:16]) != c.handle {
+		c.err = errors.New("nbd: bad reply")
+		return c.err
+	}
+	if code := binary.BigEndian.Uint32(reply[4:8]); code != nbdErrNone {
+		return fmt.Errorf("nbd: read at offset %d failed with error %d", off, code)
+	}
+	if _, err := io.ReadFull(c.conn, p); err != nil {
+		c.err = fmt.Errorf("nbd: reading data: %w", err)
+		return c.err
+	}
+	return nil
+}
+
+// Close disconnects from the server
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := make([]byte, 28)
+	binary.BigEndian.PutUint32(req[0:4], nbdRequestMagic)
+	binary.BigEndian.PutUint16(req[6:8], nbdCmdDisc)
+	c.conn.Write(req)
+	return c.conn.Close()
+}
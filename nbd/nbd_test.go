@@ -0,0 +1,557 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrimStatus(t *testing.T) {
+	exp := &Export{Size: 100}
+	exp.trim(10, 20)
+	exp.trim(30, 40)
+	exp.trim(20, 25) // Touches the first region
+	exp.untrim(32, 35)
+
+	got := fmt.Sprint(exp.status(0, 100))
+	want := fmt.Sprint([]statusExtent{
+		{0, 10, 0}, {10, 25, nbdStateHole}, {25, 30, 0}, {30, 32, nbdStateHole},
+		{32, 35, 0}, {35, 40, nbdStateHole}, {40, 100, 0},
+	})
+	if got != want {
+		t.Errorf("status = %s, want %s", got, want)
+	}
+
+	// A query starting inside a trimmed region
+	got = fmt.Sprint(exp.status(15, 31))
+	want = fmt.Sprint([]statusExtent{{15, 25, nbdStateHole}, {25, 30, 0}, {30, 31, nbdStateHole}})
+	if got != want {
+		t.Errorf("status(15, 31) = %s, want %s", got, want)
+	}
+}
+
+func TestClient(t *testing.T) {
+	data := make([]byte, 3*maxReadChunk+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	socket := filepath.Join(t.TempDir(), "nbd.sock")
+	server := NewServer(socket)
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.AddExport(&Export{Name: "disk", Reader: bytes.NewReader(data), Size: int64(len(data))})
+	go server.Serve()
+	defer server.Close()
+
+	var client *Client
+	var err error
+	for i := 0; i < 50; i++ {
+		if client, err = OpenURL("nbd+unix:///disk?socket=" + socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.Size() != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", client.Size(), len(data))
+	}
+	got := make([]byte, len(data))
+	if n, err := client.ReadAt(got[1:], 1); n != len(data)-1 || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(got[1:], data[1:]) {
+		t.Error("data read differs")
+	}
+	if n, err := client.ReadAt(got[:10], int64(len(data))-5); n != 5 || err != io.EOF {
+		t.Errorf("ReadAt at end = %d, %v; want 5, EOF", n, err)
+	}
+
+	if _, err := Dial("unix", socket, "nope"); err == nil {
+		t.Error("Dial of unknown export succeeded")
+	}
+}
+
+// stuckReader blocks reads until released
+type stuckReader chan struct{}
+
+func (r stuckReader) ReadAt(p []byte, off int64) (int, error) {
+	<-r
+	return len(p), nil
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "nbd.sock")
+	server := NewServer(socket)
+	server.SetLogger(log.New(io.Discard, "", 0))
+	stuck := make(stuckReader)
+	server.AddExport(&Export{Name: "disk", Reader: stuck, Size: 4096})
+	go server.Serve()
+	defer server.Close()
+	defer close(stuck)
+
+	var client *Client
+	var err error
+	for i := 0; i < 50; i++ {
+		if client, err = OpenURL("nbd+unix:///disk?socket=" + socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.SetReadTimeout(50 * time.Millisecond)
+	buf := make([]byte, 512)
+	if _, err := client.ReadAt(buf, 0); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadAt of a stuck export = %v, want a timeout", err)
+	}
+	if _, err := client.ReadAt(buf, 0); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadAt after a timeout = %v, want the timeout again", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	exp := &Export{Name: "disk", Size: 100}
+	start := time.Now()
+	exp.record(false, 10, start, nbdErrNone)
+	exp.record(false, 10, start, nbdErrIO)
+	exp.record(true, 20, start, nbdErrNone)
+	exp.record(true, 20, start.Add(-2*time.Second), nbdErrPerm)
+
+	st := exp.Stats()
+	if st.Reads != 2 || st.BytesRead != 10 || st.Writes != 2 || st.BytesWritten != 20 || st.Errors != 2 {
+		t.Errorf("Stats = %+v", st)
+	}
+	if st.Latency[len(st.Latency)-1] != 1 {
+		t.Errorf("Latency = %v, want one request in the last bucket", st.Latency)
+	}
+
+	server := NewServer("")
+	server.AddExport(exp)
+	var buf bytes.Buffer
+	if err := server.WriteStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `Export "disk": 2 reads (10 bytes), 2 writes (20 bytes), 2 errors`; !bytes.HasPrefix(buf.Bytes(), []byte(want)) {
+		t.Errorf("WriteStats = %q, want prefix %q", buf.String(), want)
+	}
+}
+
+// slowWriter holds up writes until released
+type slowWriter struct {
+	release chan struct{}
+}
+
+func (w slowWriter) WriteAt(p []byte, off int64) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestTrimAfterWrite(t *testing.T) {
+	w := slowWriter{make(chan struct{})}
+	exp := &Export{Name: "disk", Reader: bytes.NewReader(make([]byte, 4096)), Writer: w, Size: 4096}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	client, conn := net.Pipe()
+	defer client.Close()
+	sess := &session{server: server, conn: conn, export: exp}
+	go sess.transmit()
+
+	request := func(cmd uint16, handle byte, data []byte) {
+		header := make([]byte, 28)
+		binary.BigEndian.PutUint32(header[0:4], nbdRequestMagic)
+		binary.BigEndian.PutUint16(header[6:8], cmd)
+		header[15] = handle
+		binary.BigEndian.PutUint64(header[16:24], 512)
+		binary.BigEndian.PutUint32(header[24:28], 1024)
+		if _, err := client.Write(append(header, data...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The write is still running when the trim of the same range arrives
+	request(nbdCmdWrite, 1, make([]byte, 1024))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(w.release)
+	}()
+	request(nbdCmdTrim, 2, nil)
+
+	reply := make([]byte, 16)
+	for _, want := range []byte{1, 2} {
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[15] != want || binary.BigEndian.Uint32(reply[4:8]) != nbdErrNone {
+			t.Errorf("reply for handle %d, error %d; want handle %d", reply[15], binary.BigEndian.Uint32(reply[4:8]), want)
+		}
+	}
+
+	got := fmt.Sprint(exp.status(512, 1536))
+	want := fmt.Sprint([]statusExtent{{512, 1536, nbdStateHole}})
+	if got != want {
+		t.Errorf("status after write and trim = %s, want %s", got, want)
+	}
+}
+
+// connect negotiates export with a server over an in-memory connection,
+// as a client sending NBD_OPT_GO, and returns the connection in the
+// transmission phase and the transmission flags
+func connect(t *testing.T, server *Server, export string) (net.Conn, uint16) {
+	t.Helper()
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go server.handleConnection(conn)
+
+	greeting := make([]byte, 18)
+	if _, err := io.ReadFull(client, greeting); err != nil {
+		t.Fatal(err)
+	}
+	opt := binary.BigEndian.AppendUint32(nil, nbdFlagCFixedNewstyle|nbdFlagCNoZeroes)
+	opt = binary.BigEndian.AppendUint64(opt, nbdOptionMagic)
+	opt = binary.BigEndian.AppendUint32(opt, nbdOptGo)
+	opt = binary.BigEndian.AppendUint32(opt, uint32(4+len(export)+2))
+	opt = binary.BigEndian.AppendUint32(opt, uint32(len(export)))
+	opt = append(opt, export...)
+	opt = binary.BigEndian.AppendUint16(opt, 0) // No information requests
+	if _, err := client.Write(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	var flags uint16
+	for {
+		header := make([]byte, 20)
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[16:20]))
+		if _, err := io.ReadFull(client, data); err != nil {
+			t.Fatal(err)
+		}
+		switch binary.BigEndian.Uint32(header[12:16]) {
+		case nbdRepInfo:
+			if binary.BigEndian.Uint16(data[0:2]) == nbdInfoExport {
+				flags = binary.BigEndian.Uint16(data[10:12])
+			}
+		case nbdRepAck:
+			return client, flags
+		default:
+			t.Fatalf("NBD_OPT_GO %q: reply %#x", export, binary.BigEndian.Uint32(header[12:16]))
+		}
+	}
+}
+
+// sendRequest sends a request, followed by the data of a write
+func sendRequest(t *testing.T, conn net.Conn, cmd, flags uint16, handle byte, offset uint64, length uint32, data []byte) {
+	t.Helper()
+	header := make([]byte, 28)
+	binary.BigEndian.PutUint32(header[0:4], nbdRequestMagic)
+	binary.BigEndian.PutUint16(header[4:6], flags)
+	binary.BigEndian.PutUint16(header[6:8], cmd)
+	header[15] = handle
+	binary.BigEndian.PutUint64(header[16:24], offset)
+	binary.BigEndian.PutUint32(header[24:28], length)
+	if _, err := conn.Write(append(header, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readReply reads the header of a simple reply; the data of a read
+// follows it
+func readReply(t *testing.T, conn net.Conn) (handle byte, code uint32) {
+	t.Helper()
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[15], binary.BigEndian.Uint32(reply[4:8])
+}
+
+// gatedReader holds up reads of its first block until gate is closed
+type gatedReader struct {
+	data []byte
+	gate chan struct{}
+}
+
+func (r gatedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 4096 {
+		<-r.gate
+	}
+	return copy(p, r.data[off:]), nil
+}
+
+func TestParallelReads(t *testing.T) {
+	data := make([]byte, 8192)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	r := gatedReader{data, make(chan struct{})}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.AddExport(&Export{Name: "disk", Reader: r, Size: int64(len(data))})
+	conn, _ := connect(t, server, "disk")
+
+	// A read of the second block is answered while the first is held up,
+	// and a flush waits for the read in flight
+	sendRequest(t, conn, nbdCmdRead, 0, 1, 0, 512, nil)
+	sendRequest(t, conn, nbdCmdRead, 0, 2, 4096, 512, nil)
+	sendRequest(t, conn, nbdCmdFlush, 0, 3, 0, 0, nil)
+	if handle, code := readReply(t, conn); handle != 2 || code != nbdErrNone {
+		t.Fatalf("first reply for handle %d, error %d; want handle 2", handle, code)
+	}
+	got := make([]byte, 512)
+	if _, err := io.ReadFull(conn, got); err != nil || got[0] != 8 {
+		t.Errorf("read of the second block = %d, %v", got[0], err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(r.gate)
+	}()
+	if handle, _ := readReply(t, conn); handle != 1 {
+		t.Fatalf("reply for handle %d, want the held-up read's", handle)
+	}
+	if _, err := io.ReadFull(conn, got); err != nil || got[0] != 0 {
+		t.Errorf("read of the first block = %d, %v", got[0], err)
+	}
+	if handle, _ := readReply(t, conn); handle != 3 {
+		t.Errorf("reply for handle %d, want the flush's", handle)
+	}
+}
+
+func TestInFlightLimit(t *testing.T) {
+	r := gatedReader{make([]byte, 8192), make(chan struct{})}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.AddExport(&Export{Name: "disk", Reader: r, Size: 8192})
+	conn, _ := connect(t, server, "disk")
+
+	// Once maxInFlight reads are held up, the next waits for one of them
+	for i := range maxInFlight {
+		sendRequest(t, conn, nbdCmdRead, 0, byte(i), 0, 512, nil)
+	}
+	sendRequest(t, conn, nbdCmdRead, 0, maxInFlight, 4096, 512, nil)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("a read beyond the limit was answered: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	close(r.gate)
+	seen := make(map[byte]bool)
+	for range maxInFlight + 1 {
+		handle, code := readReply(t, conn)
+		if code != nbdErrNone || seen[handle] {
+			t.Fatalf("reply for handle %d, error %d", handle, code)
+		}
+		seen[handle] = true
+		io.ReadFull(conn, make([]byte, 512))
+	}
+}
+
+// syncedDisk is a writable export counting its syncs and the largest
+// write it was given
+type syncedDisk struct {
+	mu       sync.Mutex
+	data     []byte
+	syncs    int
+	maxWrite int
+}
+
+func (d *syncedDisk) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *syncedDisk) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxWrite = max(d.maxWrite, len(p))
+	return copy(d.data[off:], p), nil
+}
+
+func (d *syncedDisk) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.syncs++
+	return nil
+}
+
+func TestWriteZeroesFlushFUA(t *testing.T) {
+	disk := &syncedDisk{data: bytes.Repeat([]byte{0xAA}, 1<<20)}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.AddExport(&Export{Name: "disk", Reader: disk, Writer: disk, Size: int64(len(disk.data))})
+	conn, flags := connect(t, server, "disk")
+
+	want := nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA | nbdFlagSendTrim | nbdFlagSendWriteZeroes
+	if flags != want {
+		t.Errorf("transmission flags %#x, want %#x", flags, want)
+	}
+
+	tests := []struct {
+		name   string
+		cmd    uint16
+		flags  uint16
+		offset uint64
+		length uint32
+		code   uint32
+		syncs  int // Syncs so far
+	}{
+		{"write", nbdCmdWrite, 0, 0, 100, nbdErrNone, 0},
+		{"write with FUA", nbdCmdWrite, nbdCmdFlagFUA, 100, 100, nbdErrNone, 1},
+		{"flush", nbdCmdFlush, 0, 0, 0, nbdErrNone, 2},
+		{"write zeroes", nbdCmdWriteZeroes, 0, 1000, 300000, nbdErrNone, 2},
+		{"write zeroes with FUA", nbdCmdWriteZeroes, nbdCmdFlagFUA, 400000, 1000, nbdErrNone, 3},
+		{"write zeroes past the end", nbdCmdWriteZeroes, 0, 1<<20 - 10, 20, nbdErrInval, 3},
+	}
+	for i, tt := range tests {
+		var data []byte
+		if tt.cmd == nbdCmdWrite {
+			data = make([]byte, tt.length)
+		}
+		sendRequest(t, conn, tt.cmd, tt.flags, byte(i), tt.offset, tt.length, data)
+		if handle, code := readReply(t, conn); handle != byte(i) || code != tt.code {
+			t.Errorf("%s: reply for handle %d, error %d; want error %d", tt.name, handle, code, tt.code)
+		}
+		disk.mu.Lock()
+		if disk.syncs != tt.syncs {
+			t.Errorf("%s: %d syncs, want %d", tt.name, disk.syncs, tt.syncs)
+		}
+		disk.mu.Unlock()
+	}
+
+	// The zeroes are written a chunk at a time, and only where asked
+	for i, b := range disk.data {
+		zero := i < 200 || i >= 1000 && i < 301000 || i >= 400000 && i < 401000
+		if (b == 0) != zero {
+			t.Fatalf("byte %d is %#x", i, b)
+		}
+	}
+	if disk.maxWrite > zeroChunk {
+		t.Errorf("zeroes written %d bytes at a time, more than %d", disk.maxWrite, zeroChunk)
+	}
+}
+
+// layer is a writer over another, which it exposes as its base
+type layer struct{ io.WriterAt }
+
+func (l layer) BaseWriter() io.WriterAt { return l.WriterAt }
+
+func TestSyncBase(t *testing.T) {
+	disk := &syncedDisk{}
+	if err := (&Export{Writer: layer{layer{disk}}}).Sync(); err != nil || disk.syncs != 1 {
+		t.Errorf("Sync through two layers = %v, %d syncs", err, disk.syncs)
+	}
+	if err := (&Export{Writer: slowWriter{}}).Sync(); err != nil {
+		t.Errorf("Sync of a writer with nothing to sync = %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "nbd.sock")
+	server := NewServer(socket)
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.SetIdleTimeout(50 * time.Millisecond)
+	server.AddExport(&Export{Name: "disk", Reader: bytes.NewReader(nil)})
+
+	// With no client ever connecting, the server shuts down by itself
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		server.Close()
+		t.Fatal("Serve still running once idle")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
+
+func TestReadOnlyExport(t *testing.T) {
+	disk := &syncedDisk{data: bytes.Repeat([]byte{0xAA}, 8192)}
+	server := NewServer("")
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.AddExport(&Export{Name: "rw", Reader: disk, Writer: disk, Size: 8192})
+	server.AddExport(&Export{Name: "ro", Reader: disk, Writer: disk, Size: 8192, ReadOnly: true})
+	server.AddExport(&Export{Name: "nowriter", Reader: disk, Size: 8192})
+
+	for _, tt := range []struct {
+		export   string
+		readOnly bool
+	}{
+		{"rw", false},
+		{"ro", true},
+		{"nowriter", true},
+	} {
+		conn, flags := connect(t, server, tt.export)
+		if flags&nbdFlagReadOnly != 0 != tt.readOnly || flags&nbdFlagSendWriteZeroes != 0 == tt.readOnly {
+			t.Errorf("%s: transmission flags %#x", tt.export, flags)
+		}
+
+		// A refused write's data is drained, so the read after it is
+		// answered
+		want := nbdErrNone
+		if tt.readOnly {
+			want = nbdErrPerm
+		}
+		sendRequest(t, conn, nbdCmdWrite, 0, 1, 0, 1024, make([]byte, 1024))
+		if _, code := readReply(t, conn); code != want {
+			t.Errorf("%s: write answered with error %d, want %d", tt.export, code, want)
+		}
+		for _, cmd := range []uint16{nbdCmdWriteZeroes, nbdCmdTrim} {
+			sendRequest(t, conn, cmd, 0, 2, 0, 1024, nil)
+			if _, code := readReply(t, conn); code != want {
+				t.Errorf("%s: command %d answered with error %d, want %d", tt.export, cmd, code, want)
+			}
+		}
+		sendRequest(t, conn, nbdCmdRead, 0, 3, 4096, 512, nil)
+		if handle, code := readReply(t, conn); handle != 3 || code != nbdErrNone {
+			t.Errorf("%s: read after the write: handle %d, error %d", tt.export, handle, code)
+		}
+		io.ReadFull(conn, make([]byte, 512))
+
+		// The flush is answered once the read is counted
+		sendRequest(t, conn, nbdCmdFlush, 0, 4, 0, 0, nil)
+		readReply(t, conn)
+	}
+	if disk.data[0] != 0 || disk.data[1024] != 0xAA {
+		t.Errorf("writes reached the disk wrongly: %#x %#x", disk.data[0], disk.data[1024])
+	}
+
+	// Each export counts its own requests
+	for _, tt := range []struct {
+		export        string
+		reads, writes uint64
+		written       uint64
+		errors        uint64
+	}{
+		{"rw", 1, 2, 2048, 0},
+		{"ro", 1, 2, 0, 2},
+		{"nowriter", 1, 2, 0, 2},
+	} {
+		st := server.getExport(tt.export).Stats()
+		if st.Reads != tt.reads || st.BytesRead != 512*tt.reads || st.Writes != tt.writes || st.BytesWritten != tt.written || st.Errors != tt.errors {
+			t.Errorf("%s: Stats = %+v", tt.export, st)
+		}
+	}
+}
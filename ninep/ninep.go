@@ -0,0 +1,735 @@
+// Package ninep implements a read-only 9P2000.L file server, which exports
+// a filesystem to Linux clients (mount -t 9p) such as virtual machines.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lvdlvd/rawhide/fsys"
+)
+
+// Message types
+const (
+	msgRlerror      = uint8(7)
+	msgTstatfs      = uint8(8)
+	msgRstatfs      = uint8(9)
+	msgTlopen       = uint8(12)
+	msgRlopen       = uint8(13)
+	msgTlcreate     = uint8(14)
+	msgTsymlink     = uint8(16)
+	msgTmknod       = uint8(18)
+	msgTrename      = uint8(20)
+	msgTreadlink    = uint8(22)
+	msgRreadlink    = uint8(23)
+	msgTgetattr     = uint8(24)
+	msgRgetattr     = uint8(25)
+	msgTsetattr     = uint8(26)
+	msgTxattrwalk   = uint8(30)
+	msgTxattrcreate = uint8(32)
+	msgTreaddir     = uint8(40)
+	msgRreaddir     = uint8(41)
+	msgTfsync       = uint8(50)
+	msgRfsync       = uint8(51)
+	msgTlock        = uint8(52)
+	msgRlock        = uint8(53)
+	msgTgetlock     = uint8(54)
+	msgRgetlock     = uint8(55)
+	msgTlink        = uint8(70)
+	msgTmkdir       = uint8(72)
+	msgTrenameat    = uint8(74)
+	msgTunlinkat    = uint8(76)
+	msgTversion     = uint8(100)
+	msgRversion     = uint8(101)
+	msgTauth        = uint8(102)
+	msgTattach      = uint8(104)
+	msgRattach      = uint8(105)
+	msgTflush       = uint8(108)
+	msgRflush       = uint8(109)
+	msgTwalk        = uint8(110)
+	msgRwalk        = uint8(111)
+	msgTread        = uint8(116)
+	msgRread        = uint8(117)
+	msgTwrite       = uint8(118)
+	msgTclunk       = uint8(120)
+	msgRclunk       = uint8(121)
+	msgTremove      = uint8(122)
+)
+
+// Linux errno values sent in Rlerror
+const (
+	errNOENT     = uint32(2)
+	errIO        = uint32(5)
+	errBADF      = uint32(9)
+	errACCES     = uint32(13)
+	errNOTDIR    = uint32(20)
+	errISDIR     = uint32(21)
+	errINVAL     = uint32(22)
+	errROFS      = uint32(30)
+	errNOSYS     = uint32(38)
+	errOPNOTSUPP = uint32(95)
+)
+
+const (
+	version    = "9P2000.L"
+	maxMsize   = 1 << 20
+	headerSize = 7 // size[4] type[1] tag[2]
+
+	qidDir     = uint8(0x80)
+	qidSymlink = uint8(0x02)
+
+	// Directory entry types in Rreaddir
+	dtDir  = uint8(4)
+	dtReg  = uint8(8)
+	dtLink = uint8(10)
+
+	getattrBasic = uint64(0x7ff) // Mode through blocks
+	getattrBtime = uint64(0x800)
+
+	v9fsMagic = uint32(0x01021997)
+)
+
+// OpenFunc returns the contents of a file, for reading at any offset
+type OpenFunc func(name string) (io.ReaderAt, int64, error)
+
+// Server serves a filesystem over 9P2000.L
+type Server struct {
+	fs        fsys.FS
+	open      OpenFunc
+	fsMu      sync.Mutex // Filesystems are not safe for concurrent lookups
+	listener  net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *log.Logger
+}
+
+// conn is a client connection and the fids it has in use
+type conn struct {
+	server *Server
+	rw     net.Conn
+	msize  uint32
+	fids   map[uint32]*fid
+}
+
+// fid is a file a client refers to by number
+type fid struct {
+	name string // Path in the filesystem, "." for the root
+	info fs.FileInfo
+
+	// Set by Tlopen
+	opened  bool
+	reader  io.ReaderAt
+	size    int64
+	entries []dirent
+}
+
+// dirent is a directory entry as returned by Treaddir
+type dirent struct {
+	qid  [13]byte
+	typ  uint8
+	name string
+}
+
+// NewServer creates a server for filesystem, reading files through open
+func NewServer(filesystem fsys.FS, open OpenFunc) *Server {
+	return &Server{
+		fs:     filesystem,
+		open:   open,
+		done:   make(chan struct{}),
+		logger: log.New(os.Stderr, "9p: ", log.LstdFlags),
+	}
+}
+
+// SetLogger sets a custom logger
+func (s *Server) SetLogger(l *log.Logger) {
+	s.logger = l
+}
+
+// Serve accepts connections on listener until Close
+func (s *Server) Serve(listener net.Listener) error {
+	s.listener = listener
+	s.logger.Printf("Listening on %s:%s", listener.Addr().Network(), listener.Addr())
+
+	for {
+		rw, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+				s.logger.Printf("Accept error: %v", err)
+				continue
+			}
+		}
+		go s.handleConnection(rw)
+	}
+}
+
+// Close shuts down the server
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+	return nil
+}
+
+func (s *Server) handleConnection(rw net.Conn) {
+	defer rw.Close()
+	s.logger.Printf("New connection from %s", rw.RemoteAddr())
+
+	c := &conn{server: s, rw: rw, msize: maxMsize, fids: make(map[uint32]*fid)}
+	if err := c.serve(); err != nil && !errors.Is(err, io.EOF) {
+		s.logger.Printf("Connection error: %v", err)
+	}
+	s.logger.Printf("Connection from %s closed", rw.RemoteAddr())
+}
+
+// serve answers the requests of a connection one at a time
+func (c *conn) serve() error {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(c.rw, header); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		msgType := header[4]
+		tag := binary.LittleEndian.Uint16(header[5:7])
+		if size < headerSize || size > c.msize {
+			return fmt.Errorf("bad message size %d", size)
+		}
+		body := make([]byte, size-headerSize)
+		if _, err := io.ReadFull(c.rw, body); err != nil {
+			return err
+		}
+
+		c.server.fsMu.Lock()
+		rType, reply, errno := c.handle(msgType, &decoder{b: body})
+		c.server.fsMu.Unlock()
+		if errno != 0 {
+			rType, reply = msgRlerror, binary.LittleEndian.AppendUint32(nil, errno)
+		}
+		if err := c.send(rType, tag, reply); err != nil {
+			return err
+		}
+	}
+}
+
+// send writes a reply message
+func (c *conn) send(msgType uint8, tag uint16, body []byte) error {
+	msg := make([]byte, headerSize, headerSize+len(body))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(headerSize+len(body)))
+	msg[4] = msgType
+	binary.LittleEndian.PutUint16(msg[5:7], tag)
+	_, err := c.rw.Write(append(msg, body...))
+	return err
+}
+
+// handle answers a request, returning the reply type and body, or an errno
+func (c *conn) handle(msgType uint8, d *decoder) (uint8, []byte, uint32) {
+	switch msgType {
+	case msgTversion:
+		return c.version(d)
+	case msgTauth:
+		return 0, nil, errOPNOTSUPP
+	case msgTattach:
+		return c.attach(d)
+	case msgTwalk:
+		return c.walk(d)
+	case msgTgetattr:
+		return c.getattr(d)
+	case msgTlopen:
+		return c.lopen(d)
+	case msgTread:
+		return c.read(d)
+	case msgTreaddir:
+		return c.readdir(d)
+	case msgTreadlink:
+		return c.readlink(d)
+	case msgTstatfs:
+		if _, errno := c.fid(d.u32()); errno != 0 {
+			return 0, nil, errno
+		}
+		reply := binary.LittleEndian.AppendUint32(nil, v9fsMagic)
+		reply = binary.LittleEndian.AppendUint32(reply, 4096) // Block size
+		reply = append(reply, make([]byte, 6*8)...)           // Block and file counts, fsid
+		reply = binary.LittleEndian.AppendUint32(reply, 255)  // Longest name
+		return msgRstatfs, reply, 0
+	case msgTclunk:
+		id := d.u32()
+		if _, errno := c.fid(id); errno != 0 {
+			return 0, nil, errno
+		}
+		delete(c.fids, id)
+		return msgRclunk, nil, 0
+	case msgTflush:
+		// Requests are answered in order, so the old one is done already
+		return msgRflush, nil, 0
+	case msgTfsync:
+		return msgRfsync, nil, 0
+	case msgTlock:
+		return msgRlock, []byte{0}, 0 // Success: nobody else can write
+	case msgTgetlock:
+		return c.getlock(d)
+	case msgTxattrwalk:
+		return 0, nil, errOPNOTSUPP
+	case msgTlcreate, msgTsymlink, msgTmknod, msgTrename, msgTsetattr, msgTxattrcreate,
+		msgTlink, msgTmkdir, msgTrenameat, msgTunlinkat, msgTwrite, msgTremove:
+		return 0, nil, errROFS
+	default:
+		c.server.logger.Printf("Unknown message type %d", msgType)
+		return 0, nil, errNOSYS
+	}
+}
+
+// fid looks up a fid in use
+func (c *conn) fid(id uint32) (*fid, uint32) {
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, errBADF
+	}
+	return f, 0
+}
+
+func (c *conn) version(d *decoder) (uint8, []byte, uint32) {
+	msize := d.u32()
+	v := d.str()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+
+	// A new session: forget the fids of the old one
+	c.fids = make(map[uint32]*fid)
+	c.msize = min(max(msize, 4096), maxMsize)
+	if !strings.HasPrefix(v, version) {
+		v = "unknown"
+	} else {
+		v = version
+	}
+	reply := binary.LittleEndian.AppendUint32(nil, c.msize)
+	return msgRversion, appendString(reply, v), 0
+}
+
+func (c *conn) attach(d *decoder) (uint8, []byte, uint32) {
+	id := d.u32()
+	d.u32() // afid
+	d.str() // uname
+	aname := d.str()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	if _, ok := c.fids[id]; ok {
+		return 0, nil, errINVAL
+	}
+
+	// The attach name selects the directory to export, the root by default
+	name := strings.TrimPrefix(path.Clean("/"+aname), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := c.server.fs.Stat(name)
+	if err != nil {
+		return 0, nil, errnoOf(err)
+	}
+	if !info.IsDir() {
+		return 0, nil, errNOTDIR
+	}
+	c.fids[id] = &fid{name: name, info: info}
+	q := qidOf(name, info)
+	return msgRattach, q[:], 0
+}
+
+func (c *conn) walk(d *decoder) (uint8, []byte, uint32) {
+	id := d.u32()
+	f, errno := c.fid(id)
+	newID := d.u32()
+	names := make([]string, d.u16())
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if f.opened {
+		return 0, nil, errBADF
+	}
+	if _, ok := c.fids[newID]; ok && newID != id {
+		return 0, nil, errINVAL
+	}
+
+	name, info := f.name, f.info
+	reply := binary.LittleEndian.AppendUint16(nil, 0)
+	for i, elem := range names {
+		if !info.IsDir() {
+			errno = errNOTDIR
+		} else if elem == "" || strings.Contains(elem, "/") {
+			errno = errNOENT
+		} else {
+			next := path.Join(name, elem)
+			if next == ".." || strings.HasPrefix(next, "../") {
+				next = "." // Nothing is above the root
+			}
+			var err error
+			if info, err = c.server.fs.Stat(next); err != nil {
+				errno = errnoOf(err)
+			}
+			name = next
+		}
+		if errno != 0 {
+			// Only an error for the first element; otherwise the walk is
+			// partial and newfid stays unused
+			if i == 0 {
+				return 0, nil, errno
+			}
+			return msgRwalk, reply, 0
+		}
+		q := qidOf(name, info)
+		reply = append(reply, q[:]...)
+		binary.LittleEndian.PutUint16(reply[0:2], uint16(i+1))
+	}
+
+	c.fids[newID] = &fid{name: name, info: info}
+	return msgRwalk, reply, 0
+}
+
+func (c *conn) getattr(d *decoder) (uint8, []byte, uint32) {
+	f, errno := c.fid(d.u32())
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	info := f.info
+
+	mtime := info.ModTime()
+	atime, ctime, btime := mtime, mtime, time.Time{}
+	if ti, ok := info.(fsys.TimesInfo); ok {
+		if t := ti.AccessTime(); !t.IsZero() {
+			atime = t
+		}
+		if t := ti.ChangeTime(); !t.IsZero() {
+			ctime = t
+		}
+		btime = ti.BirthTime()
+	}
+
+	valid := getattrBasic
+	if !btime.IsZero() {
+		valid |= getattrBtime
+	}
+	nlink := uint64(1)
+	if info.IsDir() {
+		nlink = 2
+	}
+
+	q := qidOf(f.name, info)
+	reply := binary.LittleEndian.AppendUint64(nil, valid)
+	reply = append(reply, q[:]...)
+	reply = binary.LittleEndian.AppendUint32(reply, unixMode(info.Mode()))
+	reply = binary.LittleEndian.AppendUint32(reply, 0) // uid
+	reply = binary.LittleEndian.AppendUint32(reply, 0) // gid
+	reply = binary.LittleEndian.AppendUint64(reply, nlink)
+	reply = binary.LittleEndian.AppendUint64(reply, 0) // rdev
+	reply = binary.LittleEndian.AppendUint64(reply, uint64(info.Size()))
+	reply = binary.LittleEndian.AppendUint64(reply, 4096) // blksize
+	reply = binary.LittleEndian.AppendUint64(reply, uint64(info.Size()+511)/512)
+	for _, t := range []time.Time{atime, mtime, ctime, btime} {
+		if t.IsZero() {
+			reply = append(reply, make([]byte, 16)...)
+			continue
+		}
+		reply = binary.LittleEndian.AppendUint64(reply, uint64(t.Unix()))
+		reply = binary.LittleEndian.AppendUint64(reply, uint64(t.Nanosecond()))
+	}
+	reply = append(reply, make([]byte, 16)...) // gen, data_version
+	return msgRgetattr, reply, 0
+}
+
+func (c *conn) lopen(d *decoder) (uint8, []byte, uint32) {
+	f, errno := c.fid(d.u32())
+	flags := d.u32()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if f.opened {
+		return 0, nil, errBADF
+	}
+	if flags&3 != 0 || flags&0o1000 != 0 { // O_WRONLY, O_RDWR, O_TRUNC
+		return 0, nil, errROFS
+	}
+
+	if f.info.IsDir() {
+		entries, err := c.readDirEntries(f)
+		if err != nil {
+			return 0, nil, errnoOf(err)
+		}
+		f.entries = entries
+	} else if f.info.Mode()&fs.ModeSymlink == 0 {
+		reader, size, err := c.server.open(f.name)
+		if err != nil {
+			return 0, nil, errnoOf(err)
+		}
+		f.reader, f.size = reader, size
+	}
+	f.opened = true
+
+	q := qidOf(f.name, f.info)
+	reply := append([]byte(nil), q[:]...)
+	return msgRlopen, binary.LittleEndian.AppendUint32(reply, 0), 0 // iounit 0: up to msize
+}
+
+// readDirEntries lists a directory, starting with . and ..
+func (c *conn) readDirEntries(f *fid) ([]dirent, error) {
+	entries, err := c.server.fs.ReadDir(f.name)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := path.Dir(f.name)
+	parentInfo, err := c.server.fs.Stat(parent)
+	if err != nil {
+		return nil, err
+	}
+	list := []dirent{
+		{qid: qidOf(f.name, f.info), typ: dtDir, name: "."},
+		{qid: qidOf(parent, parentInfo), typ: dtDir, name: ".."},
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := path.Join(f.name, entry.Name())
+		typ := dtReg
+		switch {
+		case info.IsDir():
+			typ = dtDir
+		case info.Mode()&fs.ModeSymlink != 0:
+			typ = dtLink
+		}
+		list = append(list, dirent{qid: qidOf(name, info), typ: typ, name: entry.Name()})
+	}
+	return list, nil
+}
+
+func (c *conn) read(d *decoder) (uint8, []byte, uint32) {
+	f, errno := c.fid(d.u32())
+	offset := d.u64()
+	count := d.u32()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if !f.opened || f.reader == nil {
+		if f.info.IsDir() {
+			return 0, nil, errISDIR
+		}
+		return 0, nil, errBADF
+	}
+
+	// Rread is size[4] type[1] tag[2] count[4] data
+	count = min(count, c.msize-headerSize-4)
+	if offset >= uint64(f.size) {
+		return msgRread, binary.LittleEndian.AppendUint32(nil, 0), 0
+	}
+	count = uint32(min(uint64(count), uint64(f.size)-offset))
+
+	reply := make([]byte, 4+count)
+	n, err := f.reader.ReadAt(reply[4:], int64(offset))
+	if err != nil && err != io.EOF {
+		c.server.logger.Printf("Read error in %s at offset %d: %v", f.name, offset, err)
+		return 0, nil, errIO
+	}
+	binary.LittleEndian.PutUint32(reply[0:4], uint32(n))
+	return msgRread, reply[:4+n], 0
+}
+
+func (c *conn) readdir(d *decoder) (uint8, []byte, uint32) {
+	f, errno := c.fid(d.u32())
+	offset := d.u64()
+	count := d.u32()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if !f.opened || !f.info.IsDir() {
+		return 0, nil, errNOTDIR
+	}
+
+	// The offset of an entry is the index of the one after it
+	count = min(count, c.msize-headerSize-4)
+	reply := make([]byte, 4)
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		e := f.entries[i]
+		if len(reply)-4+13+8+1+2+len(e.name) > int(count) {
+			break
+		}
+		reply = append(reply, e.qid[:]...)
+		reply = binary.LittleEndian.AppendUint64(reply, i+1)
+		reply = append(reply, e.typ)
+		reply = appendString(reply, e.name)
+	}
+	binary.LittleEndian.PutUint32(reply[0:4], uint32(len(reply)-4))
+	return msgRreaddir, reply, 0
+}
+
+func (c *conn) readlink(d *decoder) (uint8, []byte, uint32) {
+	f, errno := c.fid(d.u32())
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if f.info.Mode()&fs.ModeSymlink == 0 {
+		return 0, nil, errINVAL
+	}
+
+	// The target is the content of the link, when the filesystem gives it
+	reader, size, err := c.server.open(f.name)
+	if err != nil {
+		return 0, nil, errnoOf(err)
+	}
+	if size == 0 {
+		return 0, nil, errIO
+	}
+	target := make([]byte, size)
+	if n, err := reader.ReadAt(target, 0); err != nil && !(err == io.EOF && n == len(target)) {
+		return 0, nil, errIO
+	}
+	return msgRreadlink, appendString(nil, string(target)), 0
+}
+
+// getlock reports every lock as available, as nothing can write the files
+func (c *conn) getlock(d *decoder) (uint8, []byte, uint32) {
+	d.u32() // fid
+	d.u8()  // type
+	start := d.u64()
+	length := d.u64()
+	procID := d.u32()
+	clientID := d.str()
+	if d.err != nil {
+		return 0, nil, errINVAL
+	}
+	reply := []byte{2} // F_UNLCK
+	reply = binary.LittleEndian.AppendUint64(reply, start)
+	reply = binary.LittleEndian.AppendUint64(reply, length)
+	reply = binary.LittleEndian.AppendUint32(reply, procID)
+	return msgRgetlock, appendString(reply, clientID), 0
+}
+
+// qidOf identifies a file to the client by its inode number or, on
+// filesystems without them, by a hash of its path
+func qidOf(name string, info fs.FileInfo) [13]byte {
+	var q [13]byte
+	switch {
+	case info.IsDir():
+		q[0] = qidDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		q[0] = qidSymlink
+	}
+
+	var id uint64
+	if fi, ok := info.(fsys.FileInfo); ok {
+		id = fi.Inode()
+	}
+	if id == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		id = h.Sum64()
+	}
+	binary.LittleEndian.PutUint32(q[1:5], uint32(info.ModTime().Unix()))
+	binary.LittleEndian.PutUint64(q[5:13], id)
+	return q
+}
+
+// unixMode converts a file mode to the Linux st_mode bits
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	switch {
+	case mode.IsDir():
+		m |= 0o040000
+	case mode&fs.ModeSymlink != 0:
+		m |= 0o120000
+	case mode&fs.ModeNamedPipe != 0:
+		m |= 0o010000
+	case mode&fs.ModeSocket != 0:
+		m |= 0o140000
+	case mode&fs.ModeCharDevice != 0:
+		m |= 0o020000
+	case mode&fs.ModeDevice != 0:
+		m |= 0o060000
+	default:
+		m |= 0o100000
+	}
+	return m
+}
+
+// errnoOf maps a filesystem error to the errno sent to the client
+func errnoOf(err error) uint32 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errNOENT
+	case errors.Is(err, fs.ErrPermission):
+		return errACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return errINVAL
+	default:
+		return errIO
+	}
+}
+
+// appendString appends a 9P string, its length then its bytes
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads the fields of a message body, recording when it runs short
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) u8() uint8   { return d.next(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+func (d *decoder) str() string { return string(d.next(int(d.u16()))) }
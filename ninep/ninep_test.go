@@ -0,0 +1,117 @@
+package ninep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"testing/fstest"
+)
+
+// mapFS adapts a MapFS to fsys.FS
+type mapFS struct{ fstest.MapFS }
+
+func (mapFS) Type() string { return "map" }
+func (mapFS) Close() error { return nil }
+
+// call sends a request over c and returns the reply type and body
+func call(t *testing.T, c net.Conn, msgType uint8, body []byte) (uint8, []byte) {
+	t.Helper()
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(headerSize+len(body)))
+	msg = append(msg, msgType, 1, 0)
+	if _, err := c.Write(append(msg, body...)); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header)-headerSize)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	return header[4], reply
+}
+
+func TestServer(t *testing.T) {
+	filesystem := mapFS{fstest.MapFS{
+		"dir/hello.txt": {Data: []byte("hello, world")},
+		"top":           {Data: []byte("x")},
+	}}
+	open := func(name string) (io.ReaderAt, int64, error) {
+		data, err := filesystem.ReadFile(name)
+		return bytes.NewReader(data), int64(len(data)), err
+	}
+	server := NewServer(filesystem, open)
+	server.SetLogger(log.New(io.Discard, "", 0))
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	typ, reply := call(t, client, msgTversion, appendString(binary.LittleEndian.AppendUint32(nil, 8192), version))
+	if typ != msgRversion || binary.LittleEndian.Uint32(reply) != 8192 {
+		t.Fatalf("Tversion = %d %x", typ, reply)
+	}
+
+	// attach fid 0 to the root
+	attach := binary.LittleEndian.AppendUint32(nil, 0)
+	attach = binary.LittleEndian.AppendUint32(attach, ^uint32(0))
+	attach = appendString(appendString(attach, "root"), "")
+	if typ, reply = call(t, client, msgTattach, binary.LittleEndian.AppendUint32(attach, 0)); typ != msgRattach || reply[0] != qidDir {
+		t.Fatalf("Tattach = %d %x", typ, reply)
+	}
+
+	// walk fid 0 to dir/hello.txt as fid 1
+	walk := binary.LittleEndian.AppendUint32(nil, 0)
+	walk = binary.LittleEndian.AppendUint32(walk, 1)
+	walk = binary.LittleEndian.AppendUint16(walk, 2)
+	walk = appendString(appendString(walk, "dir"), "hello.txt")
+	if typ, reply = call(t, client, msgTwalk, walk); typ != msgRwalk || binary.LittleEndian.Uint16(reply) != 2 {
+		t.Fatalf("Twalk = %d %x", typ, reply)
+	}
+
+	// A walk to a missing file fails on its first element
+	walk = binary.LittleEndian.AppendUint32(nil, 0)
+	walk = binary.LittleEndian.AppendUint32(walk, 2)
+	walk = appendString(binary.LittleEndian.AppendUint16(walk, 1), "nope")
+	if typ, reply = call(t, client, msgTwalk, walk); typ != msgRlerror || binary.LittleEndian.Uint32(reply) != errNOENT {
+		t.Errorf("Twalk to a missing file = %d %x", typ, reply)
+	}
+
+	// Writing is refused, reading works
+	if typ, reply = call(t, client, msgTlopen, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 1), 2)); typ != msgRlerror || binary.LittleEndian.Uint32(reply) != errROFS {
+		t.Errorf("Tlopen O_RDWR = %d %x", typ, reply)
+	}
+	if typ, reply = call(t, client, msgTlopen, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 1), 0)); typ != msgRlopen {
+		t.Fatalf("Tlopen = %d %x", typ, reply)
+	}
+	read := binary.LittleEndian.AppendUint32(nil, 1)
+	read = binary.LittleEndian.AppendUint64(read, 7)
+	read = binary.LittleEndian.AppendUint32(read, 100)
+	if typ, reply = call(t, client, msgTread, read); typ != msgRread || string(reply[4:]) != "world" {
+		t.Errorf("Tread = %d %q", typ, reply)
+	}
+
+	// List the root: ., .., dir and top
+	if typ, _ = call(t, client, msgTlopen, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 0), 0)); typ != msgRlopen {
+		t.Fatalf("Tlopen of the root = %d", typ)
+	}
+	readdir := binary.LittleEndian.AppendUint32(nil, 0)
+	readdir = binary.LittleEndian.AppendUint64(readdir, 2) // Skip . and ..
+	readdir = binary.LittleEndian.AppendUint32(readdir, 4096)
+	typ, reply = call(t, client, msgTreaddir, readdir)
+	if typ != msgRreaddir {
+		t.Fatalf("Treaddir = %d %x", typ, reply)
+	}
+	var names []string
+	for d := (&decoder{b: reply[4:]}); len(d.b) > 0 && d.err == nil; {
+		d.next(13 + 8 + 1)
+		names = append(names, d.str())
+	}
+	if len(names) != 2 || names[0] != "dir" || names[1] != "top" {
+		t.Errorf("Treaddir names = %q", names)
+	}
+}
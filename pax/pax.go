@@ -0,0 +1,251 @@
+// Package pax writes tar archives in the POSIX pax format. Unlike
+// archive/tar it can write sparse files, in the GNU 1.0 sparse format that
+// GNU tar, bsdtar and archive/tar read back with their holes.
+package pax
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const blockSize = 512
+
+// Header describes an archive entry
+type Header struct {
+	Name       string
+	Typeflag   byte   // tar.TypeReg, tar.TypeDir or tar.TypeSymlink
+	Linkname   string // Target of a symlink
+	Mode       int64  // Permission bits
+	Size       int64  // Size of a file, holes included
+	ModTime    time.Time
+	AccessTime time.Time         // Not recorded if zero
+	Xattrs     map[string]string // Extended attributes
+
+	// Data lists the regions of a sparse file that hold data, ascending
+	// and not overlapping; the rest of the file reads as zeros. Nil for a
+	// file without holes.
+	Data []Segment
+}
+
+// Segment is a region of a sparse file
+type Segment struct {
+	Offset, Length int64
+}
+
+// Writer writes a tar archive. After each WriteHeader, Write takes the
+// entry's data: all of it for a regular file, only the data of Header.Data
+// for a sparse one.
+type Writer struct {
+	w         io.Writer
+	remaining int64 // Data of the current entry still to be written
+	pad       int64 // Zeroes after it, to the end of the block
+	err       error
+}
+
+// NewWriter creates a Writer writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader finishes the previous entry and starts a new one
+func (tw *Writer) WriteHeader(h *Header) error {
+	if err := tw.finishEntry(); err != nil {
+		return err
+	}
+
+	records := make(map[string]string)
+	name, size := h.Name, h.Size
+	var sparseMap []byte
+	if h.Data != nil {
+		// The data follows a map of the segments, under a name that
+		// tools without sparse support will not mistake for the file
+		records["GNU.sparse.major"] = "1"
+		records["GNU.sparse.minor"] = "0"
+		records["GNU.sparse.name"] = h.Name
+		records["GNU.sparse.realsize"] = strconv.FormatInt(h.Size, 10)
+		name = path.Join(path.Dir(h.Name), "GNUSparseFile.0", path.Base(h.Name))
+
+		// A file ending in a hole ends its map with an empty segment, or
+		// GNU tar cuts it short
+		data := h.Data
+		if n := len(data); n == 0 || data[n-1].Offset+data[n-1].Length < h.Size {
+			data = append(data[:n:n], Segment{Offset: h.Size})
+		}
+		sparseMap = fmt.Appendf(nil, "%d\n", len(data))
+		size = 0
+		for _, seg := range data {
+			sparseMap = fmt.Appendf(sparseMap, "%d\n%d\n", seg.Offset, seg.Length)
+			size += seg.Length
+		}
+		sparseMap = append(sparseMap, make([]byte, padding(int64(len(sparseMap))))...)
+		size += int64(len(sparseMap))
+	}
+	if h.Typeflag != tar.TypeReg {
+		size = 0
+	}
+
+	if len(name) > 100 || !isASCII(name) {
+		records["path"] = name
+	}
+	if len(h.Linkname) > 100 || !isASCII(h.Linkname) {
+		records["linkpath"] = h.Linkname
+	}
+	if size > 0o77777777777 {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+	if h.ModTime.Nanosecond() != 0 || h.ModTime.Unix() < 0 {
+		records["mtime"] = formatTime(h.ModTime)
+	}
+	if !h.AccessTime.IsZero() {
+		records["atime"] = formatTime(h.AccessTime)
+	}
+	for k, v := range h.Xattrs {
+		records["SCHILY.xattr."+k] = v
+	}
+
+	if len(records) > 0 {
+		payload := encodeRecords(records)
+		xName := path.Join(path.Dir(name), "PaxHeaders.0", path.Base(name))
+		if err := tw.writeBlocks(header(xName, tar.TypeXHeader, "", 0, int64(len(payload)), h.ModTime), payload); err != nil {
+			return err
+		}
+	}
+	if err := tw.writeBlocks(header(name, h.Typeflag, h.Linkname, h.Mode, size, h.ModTime), nil); err != nil {
+		return err
+	}
+	if _, err := tw.w.Write(sparseMap); err != nil {
+		tw.err = err
+		return err
+	}
+	tw.remaining = size - int64(len(sparseMap))
+	tw.pad = padding(size)
+	return nil
+}
+
+// Write writes data of the current entry
+func (tw *Writer) Write(p []byte) (int, error) {
+	if tw.err != nil {
+		return 0, tw.err
+	}
+	if int64(len(p)) > tw.remaining {
+		return 0, errors.New("pax: write beyond the entry size")
+	}
+	n, err := tw.w.Write(p)
+	tw.remaining -= int64(n)
+	tw.err = err
+	return n, err
+}
+
+// Close finishes the archive. It does not close the underlying writer.
+func (tw *Writer) Close() error {
+	if err := tw.finishEntry(); err != nil {
+		return err
+	}
+	_, err := tw.w.Write(make([]byte, 2*blockSize))
+	tw.err = errors.New("pax: writer closed")
+	return err
+}
+
+// finishEntry pads the data of the current entry to the end of its block
+func (tw *Writer) finishEntry() error {
+	if tw.err != nil {
+		return tw.err
+	}
+	if tw.remaining > 0 {
+		return fmt.Errorf("pax: %d bytes of the entry missing", tw.remaining)
+	}
+	_, tw.err = tw.w.Write(make([]byte, tw.pad))
+	tw.pad = 0
+	return tw.err
+}
+
+// writeBlocks writes a header block and its data, padded
+func (tw *Writer) writeBlocks(hdr []byte, data []byte) error {
+	data = append(data, make([]byte, padding(int64(len(data))))...)
+	if _, err := tw.w.Write(append(hdr, data...)); err != nil {
+		tw.err = err
+	}
+	return tw.err
+}
+
+// header builds a ustar header block. Fields that do not fit are cut;
+// the pax records carry them whole.
+func header(name string, typeflag byte, linkname string, mode, size int64, mtime time.Time) []byte {
+	b := make([]byte, blockSize)
+	copy(b[0:100], name)
+	octal(b[100:108], mode&0o7777)
+	octal(b[108:116], 0) // uid
+	octal(b[116:124], 0) // gid
+	octal(b[124:136], min(size, 0o77777777777))
+	octal(b[136:148], max(mtime.Unix(), 0))
+	b[156] = typeflag
+	copy(b[157:257], linkname)
+	copy(b[257:265], "ustar\x0000")
+
+	// The checksum counts its own field as spaces
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	octal(b[148:155], sum)
+	return b
+}
+
+// octal writes n as a NUL-terminated octal number filling field
+func octal(field []byte, n int64) {
+	s := strconv.FormatInt(n, 8)
+	s = strings.Repeat("0", max(len(field)-1-len(s), 0)) + s
+	copy(field, s)
+	field[len(field)-1] = 0
+}
+
+// encodeRecords encodes pax records, sorted by key. Each record starts with
+// its own length in decimal, which counts the digits of the length too.
+func encodeRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		rec := " " + k + "=" + records[k] + "\n"
+		n := len(rec) + 1
+		for len(strconv.Itoa(n))+len(rec) != n {
+			n++
+		}
+		b = append(b, strconv.Itoa(n)+rec...)
+	}
+	return b
+}
+
+// formatTime formats a time as pax does, in seconds with a fraction
+func formatTime(t time.Time) string {
+	s := strconv.FormatInt(t.Unix(), 10)
+	if ns := t.Nanosecond(); ns != 0 {
+		s += "." + strings.TrimRight(fmt.Sprintf("%09d", ns), "0")
+	}
+	return s
+}
+
+func padding(n int64) int64 {
+	return -n & (blockSize - 1)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package pax
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	mtime := time.Date(2020, 6, 15, 12, 34, 56, 500000000, time.UTC)
+	longName := "dir/" + strings.Repeat("x", 120)
+
+	entries := []struct {
+		hdr  Header
+		data string
+	}{
+		{Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime}, ""},
+		{Header{Name: longName, Typeflag: tar.TypeReg, Mode: 0o644, Size: 5, ModTime: mtime,
+			Xattrs: map[string]string{"user.test": "value"}}, "hello"},
+		{Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../target", Mode: 0o777, ModTime: mtime}, ""},
+		{Header{Name: "dir/sparse", Typeflag: tar.TypeReg, Mode: 0o600, Size: 6000, ModTime: mtime,
+			Data: []Segment{{1000, 3}, {4998, 2}}}, "abcde"},
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for _, e := range entries {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", e.hdr.Name, err)
+		}
+		if hdr.Name != e.hdr.Name || hdr.Linkname != e.hdr.Linkname || hdr.Mode != e.hdr.Mode || !hdr.ModTime.Equal(mtime) {
+			t.Errorf("header = %+v, want %+v", hdr, e.hdr)
+		}
+		for k, v := range e.hdr.Xattrs {
+			if hdr.PAXRecords["SCHILY.xattr."+k] != v {
+				t.Errorf("%s: xattr %s = %q, want %q", hdr.Name, k, hdr.PAXRecords["SCHILY.xattr."+k], v)
+			}
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%s: %v", hdr.Name, err)
+		}
+		want := e.data
+		if e.hdr.Data != nil {
+			sparse := make([]byte, e.hdr.Size)
+			copy(sparse[1000:], "abc")
+			copy(sparse[4998:], "de")
+			want = string(sparse)
+		}
+		if string(data) != want {
+			t.Errorf("%s: data = %q, want %q", hdr.Name, data, want)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("after the last entry: %v", err)
+	}
+}
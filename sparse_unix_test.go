@@ -0,0 +1,167 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// allocated returns the bytes the file at name takes up on disk
+func allocated(t *testing.T, name string) int64 {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// skipWithoutHoles skips the test where the temporary directory's
+// filesystem does not leave holes in sparse files
+func skipWithoutHoles(t *testing.T, dir string) {
+	t.Helper()
+	name := filepath.Join(dir, "probe")
+	if err := os.WriteFile(name, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if allocated(t, name) >= 1<<20 {
+		t.Skip("the temporary directory does not keep files sparse")
+	}
+}
+
+// hole is a run of zeros long enough to leave a hole in any block size
+var hole = make([]byte, 256<<10)
+
+func TestSparseOutput(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutHoles(t, dir)
+	data := func(n int) []byte { return bytes.Repeat([]byte("data"), n/4) }
+
+	tests := []struct {
+		name   string
+		before []byte // What the file holds before
+		flag   int    // os.OpenFile flags besides O_WRONLY|O_CREATE
+		writes [][]byte
+		holes  bool // Whether holes are expected
+	}{
+		// The holes start at blocks of the file, not of the output
+		{"unaligned", data(100), 0, [][]byte{data(5000), hole, data(10)}, true},
+		// Zeros short of a block, or across two, are written
+		{"partial", nil, 0, [][]byte{data(100), make([]byte, 4000), data(4), make([]byte, sparseBlockSize+100), data(8)}, false},
+		{"trailing hole", nil, 0, [][]byte{data(1000), hole}, true},
+		{"zeros only", nil, 0, [][]byte{hole, hole}, true},
+		{"append", nil, os.O_APPEND, [][]byte{data(4096), hole, data(12)}, true},
+		// Appended to a file already holding data, the output is written
+		// as it is, whatever its offset
+		{"append after data", data(100), os.O_APPEND, [][]byte{hole, data(12)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(name, tt.before, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|tt.flag, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if tt.flag&os.O_APPEND == 0 {
+				if _, err := f.Seek(0, io.SeekEnd); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w, finish := sparseOutput(f)
+			want := bytes.Clone(tt.before)
+			for _, b := range tt.writes {
+				if n, err := w.Write(b); n != len(b) || err != nil {
+					t.Fatalf("Write of %d bytes = %d, %v", len(b), n, err)
+				}
+				want = append(want, b...)
+			}
+			if err := finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("the file holds %d bytes, differing from the %d written", len(got), len(want))
+			}
+			if holes := allocated(t, name) < int64(len(want))-int64(len(hole))/2; holes != tt.holes {
+				t.Errorf("%d bytes of %d allocated, want holes %v", allocated(t, name), len(want), tt.holes)
+			}
+		})
+	}
+}
+
+func TestCatSparse(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutHoles(t, dir)
+
+	// Files ending and starting with holes, concatenated to stdout
+	a := append(bytes.Repeat([]byte("a"), sparseBlockSize), hole...)
+	b := append(bytes.Clone(hole), "b"...)
+	filesystem := unreadableFS{mapFS{fstest.MapFS{"a": {Data: a}, "b": {Data: b}, "bad": {Data: b}}}}
+	name := filepath.Join(dir, "out")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var stderr bytes.Buffer
+	if err := runCat(filesystem, []string{"a", "b"}, f, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Clone(a), b...)
+	if got, _ := os.ReadFile(name); !bytes.Equal(got, want) {
+		t.Errorf("cat a b wrote %d bytes, differing from the %d of a and b", len(got), len(want))
+	}
+	if n := allocated(t, name); n >= int64(len(hole)) {
+		t.Errorf("%d bytes allocated for the %d of a and b", n, len(want))
+	}
+
+	// A file that cannot be read still leaves those before it their
+	// full size, a last hole included
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCat(filesystem, []string{"a", "bad"}, f, &stderr); err == nil {
+		t.Error("cat of an unreadable file succeeded")
+	}
+	if got, _ := os.ReadFile(name); !bytes.Equal(got, a) {
+		t.Errorf("cat a bad left %d bytes, want the %d of a", len(got), len(a))
+	}
+}
+
+// unreadableFS is a filesystem whose file "bad" fails to be read
+type unreadableFS struct{ mapFS }
+
+func (u unreadableFS) Open(name string) (fs.File, error) {
+	f, err := u.mapFS.Open(name)
+	if err == nil && name == "bad" {
+		f = unreadableFile{f}
+	}
+	return f, err
+}
+
+type unreadableFile struct{ fs.File }
+
+func (unreadableFile) Read([]byte) (int, error) { return 0, errors.New("unreadable") }
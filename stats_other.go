@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyStats does nothing where there is no SIGUSR1 to ask for request
+// counts with
+func notifyStats(c chan<- os.Signal) bool {
+	return false
+}